@@ -0,0 +1,268 @@
+// clientshell runs a single client against a running homeserver, and reads commands from stdin to drive it.
+// This is useful to manually reproduce a failing test step by step, without writing a throwaway test.
+// The client is made by the same language bindings as the tests, so build with the tags for the language
+// you want to use.
+//
+// Usage:
+//
+//	go run -tags jssdk ./cmd/clientshell -lang js -hs http://localhost:8008
+//	> login @alice:hs1 complement-crypto-password
+//	> join !room:hs1 hs1
+//	> send !room:hs1 hello world
+//	> show-timeline !room:hs1
+//	> trust-state @bob:hs1
+//
+// Type "help" for every command.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/api/langs"
+)
+
+var (
+	flagLang       = flag.String("lang", "rust", "The language of the client: rust, js or nio")
+	flagHS         = flag.String("hs", "http://localhost:8008", "The base URL of the homeserver to connect to")
+	flagPersistent = flag.Bool("persistent", false, "Ask the client to use persistent storage")
+)
+
+func main() {
+	flag.Parse()
+	lang := api.ClientTypeLang(*flagLang)
+	bindings := langs.GetLanguageBindings(lang)
+	if bindings == nil {
+		log.Fatalf("unknown language bindings %s: did you build with the correct -tags?", lang)
+	}
+	bindings.PreTestRun("clientshell")
+	defer bindings.PostTestRun("clientshell")
+	t := &api.MockT{TestName: "clientshell"}
+	shell := NewShell(os.Stdout, func(opts api.ClientCreationOpts) api.Client {
+		opts.BaseURL = *flagHS
+		opts.PersistentStorage = *flagPersistent
+		return bindings.MustCreateClient(t, opts)
+	})
+	shell.Run(os.Stdin)
+	shell.Close()
+}
+
+// Shell runs commands against a single client, which is made by the login command.
+type Shell struct {
+	out       io.Writer
+	t         *api.MockT
+	newClient func(opts api.ClientCreationOpts) api.Client
+	commands  map[string]command
+
+	client      api.Client
+	stopSyncing func()
+}
+
+type command struct {
+	usage string
+	// the minimum number of arguments
+	minArgs int
+	run     func(args []string) error
+}
+
+// NewShell makes a shell which writes to out. newClient is called by the login command to make the client.
+func NewShell(out io.Writer, newClient func(opts api.ClientCreationOpts) api.Client) *Shell {
+	s := &Shell{
+		out:       out,
+		t:         &api.MockT{TestName: "clientshell"},
+		newClient: newClient,
+	}
+	s.commands = map[string]command{
+		"login": {
+			usage:   "login <user_id> <password> [device_id]: make the client, log in and start syncing",
+			minArgs: 2,
+			run:     s.login,
+		},
+		"join": {
+			usage:   "join <room_id_or_alias> [server_name...]: join a room",
+			minArgs: 1,
+			run:     s.join,
+		},
+		"send": {
+			usage:   "send <room_id> <text...>: send a message to a room",
+			minArgs: 2,
+			run:     s.send,
+		},
+		"show-timeline": {
+			usage:   "show-timeline <room_id>: print the events in the room's timeline",
+			minArgs: 1,
+			run:     s.showTimeline,
+		},
+		"trust-state": {
+			usage:   "trust-state <user_id> [device_id...]: print the trust level of the user's devices",
+			minArgs: 1,
+			run:     s.trustState,
+		},
+	}
+	return s
+}
+
+// Run executes each line of in as a command until in is closed or the quit command is given.
+func (s *Shell) Run(in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	s.prompt()
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "quit" || line == "exit" {
+			return
+		}
+		if err := s.Exec(line); err != nil {
+			fmt.Fprintf(s.out, "error: %s\n", err)
+		}
+		s.prompt()
+	}
+}
+
+// Exec runs a single command line.
+func (s *Shell) Exec(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	name, args := fields[0], fields[1:]
+	if name == "help" {
+		s.help()
+		return nil
+	}
+	cmd, ok := s.commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %q, type 'help' for every command", name)
+	}
+	if len(args) < cmd.minArgs {
+		return fmt.Errorf("usage: %s", cmd.usage)
+	}
+	if name != "login" && s.client == nil {
+		return fmt.Errorf("not logged in, use 'login' first")
+	}
+	return cmd.run(args)
+}
+
+// Close stops syncing and closes the client, if there is one.
+func (s *Shell) Close() {
+	if s.stopSyncing != nil {
+		s.stopSyncing()
+		s.stopSyncing = nil
+	}
+	if s.client != nil {
+		s.client.Close(s.t)
+		s.client = nil
+	}
+}
+
+func (s *Shell) prompt() {
+	fmt.Fprint(s.out, "> ")
+}
+
+func (s *Shell) help() {
+	names := make([]string, 0, len(s.commands))
+	for name := range s.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(s.out, s.commands[name].usage)
+	}
+	fmt.Fprintln(s.out, "quit: close the client and exit")
+}
+
+func (s *Shell) login(args []string) error {
+	if s.client != nil {
+		return fmt.Errorf("already logged in as %s", s.client.UserID())
+	}
+	opts := api.ClientCreationOpts{
+		UserID:   args[0],
+		Password: args[1],
+	}
+	if len(args) > 2 {
+		opts.DeviceID = args[2]
+	}
+	client := s.newClient(opts)
+	if err := client.Login(s.t, client.Opts()); err != nil {
+		client.Close(s.t)
+		return fmt.Errorf("Login: %s", err)
+	}
+	stopSyncing, err := client.StartSyncing(s.t)
+	if err != nil {
+		client.Close(s.t)
+		return fmt.Errorf("StartSyncing: %s", err)
+	}
+	s.client = client
+	s.stopSyncing = stopSyncing
+	fmt.Fprintf(s.out, "logged in as %s and syncing\n", client.UserID())
+	return nil
+}
+
+func (s *Shell) join(args []string) error {
+	if err := s.client.JoinRoom(s.t, args[0], args[1:]); err != nil {
+		return fmt.Errorf("JoinRoom: %s", err)
+	}
+	fmt.Fprintf(s.out, "joined %s\n", args[0])
+	return nil
+}
+
+func (s *Shell) send(args []string) error {
+	eventID, err := s.client.SendMessage(s.t, args[0], strings.Join(args[1:], " "))
+	if err != nil {
+		return fmt.Errorf("SendMessage: %s", err)
+	}
+	fmt.Fprintf(s.out, "sent %s\n", eventID)
+	return nil
+}
+
+func (s *Shell) showTimeline(args []string) error {
+	timeline, err := s.client.GetTimeline(s.t, args[0])
+	if err != nil {
+		return fmt.Errorf("GetTimeline: %s", err)
+	}
+	for _, ev := range timeline {
+		if ev == nil {
+			continue
+		}
+		fmt.Fprintln(s.out, formatEvent(ev))
+	}
+	return nil
+}
+
+func (s *Shell) trustState(args []string) error {
+	userID, deviceIDs := args[0], args[1:]
+	if len(deviceIDs) == 0 {
+		var err error
+		deviceIDs, err = s.client.GetDeviceIDs(s.t, userID)
+		if err != nil {
+			return fmt.Errorf("GetDeviceIDs: %s, try passing the device IDs", err)
+		}
+	}
+	for _, deviceID := range deviceIDs {
+		trust, err := s.client.GetDeviceTrust(s.t, userID, deviceID)
+		if err != nil {
+			return fmt.Errorf("GetDeviceTrust(%s): %s", deviceID, err)
+		}
+		fmt.Fprintf(s.out, "%s %s: %s\n", userID, deviceID, trust)
+	}
+	return nil
+}
+
+func formatEvent(ev *api.Event) string {
+	var details string
+	switch {
+	case ev.FailedToDecrypt:
+		details = fmt.Sprintf("UTD session=%s reason=%s", ev.SessionID, ev.DecryptionFailureReason)
+	case ev.Membership != "":
+		details = fmt.Sprintf("%s %s", ev.Target, ev.Membership)
+	default:
+		details = fmt.Sprintf("%q", ev.Text)
+	}
+	return fmt.Sprintf("%s %s %s %s", ev.ID, ev.Sender, ev.Type, details)
+}
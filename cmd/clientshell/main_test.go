@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement/ct"
+)
+
+// fakeClient implements the parts of api.Client used by the shell. Calling anything else panics.
+type fakeClient struct {
+	api.Client
+	opts     api.ClientCreationOpts
+	sent     []string
+	timeline []*api.Event
+}
+
+func (c *fakeClient) Opts() api.ClientCreationOpts                           { return c.opts }
+func (c *fakeClient) UserID() string                                         { return c.opts.UserID }
+func (c *fakeClient) Login(t ct.TestLike, opts api.ClientCreationOpts) error { return nil }
+func (c *fakeClient) StartSyncing(t ct.TestLike) (func(), error)             { return func() {}, nil }
+func (c *fakeClient) Close(t ct.TestLike)                                    {}
+func (c *fakeClient) SendMessage(t ct.TestLike, roomID, text string) (string, error) {
+	c.sent = append(c.sent, roomID+" "+text)
+	return "$event", nil
+}
+func (c *fakeClient) GetTimeline(t ct.TestLike, roomID string) ([]*api.Event, error) {
+	return c.timeline, nil
+}
+
+func TestShellRunsCommands(t *testing.T) {
+	var client *fakeClient
+	var out bytes.Buffer
+	shell := NewShell(&out, func(opts api.ClientCreationOpts) api.Client {
+		client = &fakeClient{
+			opts: opts,
+			timeline: []*api.Event{
+				{ID: "$1", Sender: "@alice:hs1", Type: "m.room.member", Target: "@alice:hs1", Membership: "join"},
+				{ID: "$2", Sender: "@alice:hs1", Type: "m.room.message", Text: "hello world"},
+				{ID: "$3", Sender: "@bob:hs1", Type: "m.room.encrypted", FailedToDecrypt: true, SessionID: "abc", DecryptionFailureReason: api.DecryptionFailureReasonMissingKey},
+			},
+		}
+		return client
+	})
+	defer shell.Close()
+
+	if err := shell.Exec("send !room:hs1 hi"); err == nil || !strings.Contains(err.Error(), "not logged in") {
+		t.Fatalf("send before login: got %v, want not logged in error", err)
+	}
+	if err := shell.Exec("login @alice:hs1"); err == nil || !strings.Contains(err.Error(), "usage") {
+		t.Fatalf("login without password: got %v, want usage error", err)
+	}
+	if err := shell.Exec("unknown"); err == nil {
+		t.Fatalf("unknown command: got nil error")
+	}
+	for _, line := range []string{"login @alice:hs1 password DEVICE", "send !room:hs1 hello   world", "show-timeline !room:hs1"} {
+		if err := shell.Exec(line); err != nil {
+			t.Fatalf("%s: %s", line, err)
+		}
+	}
+	if client.opts.DeviceID != "DEVICE" || client.opts.Password != "password" {
+		t.Errorf("login made client with opts %+v", client.opts)
+	}
+	if len(client.sent) != 1 || client.sent[0] != "!room:hs1 hello world" {
+		t.Errorf("send sent %v, want the room ID and text", client.sent)
+	}
+	wantOut := []string{
+		"logged in as @alice:hs1 and syncing",
+		"sent $event",
+		`$1 @alice:hs1 m.room.member @alice:hs1 join`,
+		`$2 @alice:hs1 m.room.message "hello world"`,
+		`$3 @bob:hs1 m.room.encrypted UTD session=abc reason=` + string(api.DecryptionFailureReasonMissingKey),
+	}
+	if got := strings.Split(strings.TrimSpace(out.String()), "\n"); strings.Join(got, "\n") != strings.Join(wantOut, "\n") {
+		t.Errorf("got output:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(wantOut, "\n"))
+	}
+}
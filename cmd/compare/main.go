@@ -0,0 +1,263 @@
+// compare runs the test suite twice, once against an old build of the rust SDK and once against the current
+// build, then reports which tests pass on one build but not the other. This lets SDK maintainers see which
+// tests newly regress on a branch.
+//
+// The old build is the directory containing libmatrix_sdk_ffi given by COMPLEMENT_CRYPTO_COMPARE_SDK. The
+// current build is given by -current, else the existing LIBRARY_PATH is used. Both builds must be compatible
+// with the generated Go bindings, as uniffi checks this when the library is loaded.
+//
+// Usage:
+//
+//	COMPLEMENT_CRYPTO_COMPARE_SDK=/path/to/old/matrix-rust-sdk/target/debug \
+//	COMPLEMENT_CRYPTO_TEST_CLIENT_MATRIX=rr \
+//	COMPLEMENT_BASE_IMAGE=ghcr.io/matrix-org/synapse-service:v1.114.0 \
+//	go run ./cmd/compare -current /path/to/matrix-rust-sdk/target/debug -report compare.json ./tests ./tests/rust
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	flagCurrent = flag.String("current", "", "The directory containing the current build of libmatrix_sdk_ffi. If unset, the existing LIBRARY_PATH is used.")
+	flagRun     = flag.String("run", "", "Only run tests matching this regular expression, as per go test -run")
+	flagTags    = flag.String("tags", "rust", "The build tags to use, as per go test -tags")
+	flagTimeout = flag.String("timeout", "30m", "The timeout for each run of the test suite, as per go test -timeout")
+	flagReport  = flag.String("report", "", "If set, write the comparison as JSON to this path")
+)
+
+// Outcome is the result of a single test.
+type Outcome string
+
+const (
+	OutcomePass Outcome = "pass"
+	OutcomeFail Outcome = "fail"
+	OutcomeSkip Outcome = "skip"
+	// The test did not run at all on this build.
+	OutcomeMissing Outcome = "missing"
+)
+
+// testEvent is a line of output from `go test -json`, see `go doc test2json`.
+type testEvent struct {
+	Action  string
+	Package string
+	Test    string
+	Output  string
+}
+
+// Diff is a test which had a different outcome on the old and current builds.
+type Diff struct {
+	Test    string  `json:"test"`
+	Old     Outcome `json:"old"`
+	Current Outcome `json:"current"`
+}
+
+// Summary is the comparison between the old and current builds.
+type Summary struct {
+	OldSDK     string `json:"old_sdk"`
+	CurrentSDK string `json:"current_sdk"`
+	// Tests which passed on the old build but failed on the current build.
+	Regressions []Diff `json:"regressions"`
+	// Tests which failed on the old build but passed on the current build.
+	Fixes []Diff `json:"fixes"`
+	// Any other change e.g tests which are now skipped.
+	Changes []Diff `json:"changes"`
+	// The number of tests which had the same outcome on both builds.
+	Unchanged int `json:"unchanged"`
+}
+
+func main() {
+	flag.Parse()
+	oldSDK := os.Getenv("COMPLEMENT_CRYPTO_COMPARE_SDK")
+	if oldSDK == "" {
+		log.Fatal("COMPLEMENT_CRYPTO_COMPARE_SDK must be set to the directory containing the old build of libmatrix_sdk_ffi")
+	}
+	packages := flag.Args()
+	if len(packages) == 0 {
+		packages = []string{"./tests"}
+	}
+
+	log.Printf("running tests against old SDK %s", oldSDK)
+	oldOutcomes, err := runTests(oldSDK, packages)
+	if err != nil {
+		log.Fatalf("failed to run tests against old SDK: %s", err)
+	}
+	log.Printf("running tests against current SDK %s", currentSDKName())
+	currentOutcomes, err := runTests(*flagCurrent, packages)
+	if err != nil {
+		log.Fatalf("failed to run tests against current SDK: %s", err)
+	}
+
+	summary := compare(oldOutcomes, currentOutcomes)
+	summary.OldSDK = oldSDK
+	summary.CurrentSDK = currentSDKName()
+	printSummary(os.Stdout, summary)
+	if *flagReport != "" {
+		data, err := json.MarshalIndent(summary, "", "  ")
+		if err != nil {
+			log.Fatalf("failed to marshal report: %s", err)
+		}
+		if err := os.WriteFile(*flagReport, data, 0o644); err != nil {
+			log.Fatalf("failed to write report: %s", err)
+		}
+	}
+	if len(summary.Regressions) > 0 {
+		os.Exit(1)
+	}
+}
+
+func currentSDKName() string {
+	if *flagCurrent == "" {
+		return "LIBRARY_PATH=" + os.Getenv("LIBRARY_PATH")
+	}
+	return *flagCurrent
+}
+
+// runTests runs `go test` against the SDK in sdkDir, or the existing library paths if sdkDir is empty,
+// and returns the outcome of every test keyed off "package.TestName".
+func runTests(sdkDir string, packages []string) (map[string]Outcome, error) {
+	args := []string{"test", "-json", "-count=1", "-tags=" + *flagTags, "-timeout", *flagTimeout}
+	if *flagRun != "" {
+		args = append(args, "-run", *flagRun)
+	}
+	args = append(args, packages...)
+	cmd := exec.Command("go", args...)
+	cmd.Env = os.Environ()
+	if sdkDir != "" {
+		absDir, err := filepath.Abs(sdkDir)
+		if err != nil {
+			return nil, err
+		}
+		// LIBRARY_PATH is used when linking, the others when the test binary loads the library.
+		for _, key := range []string{"LIBRARY_PATH", "LD_LIBRARY_PATH", "DYLD_LIBRARY_PATH"} {
+			cmd.Env = append(cmd.Env, key+"="+prependPath(absDir, os.Getenv(key)))
+		}
+	}
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	outcomes, err := parseTestEvents(stdout)
+	if err != nil {
+		return nil, err
+	}
+	// go test exits non-zero if any test fails, which is expected.
+	if err := cmd.Wait(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return nil, err
+		}
+	}
+	if len(outcomes) == 0 {
+		return nil, fmt.Errorf("no tests were run, check the build output above")
+	}
+	return outcomes, nil
+}
+
+func prependPath(dir, existing string) string {
+	if existing == "" {
+		return dir
+	}
+	return dir + string(os.PathListSeparator) + existing
+}
+
+// parseTestEvents reads the output of `go test -json`, returning the final outcome of every test.
+func parseTestEvents(r io.Reader) (map[string]Outcome, error) {
+	outcomes := make(map[string]Outcome)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024) // test output lines can be long
+	for scanner.Scan() {
+		var ev testEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			// build failures are printed as plain text
+			fmt.Println(scanner.Text())
+			continue
+		}
+		if ev.Test == "" {
+			continue
+		}
+		key := ev.Package + "." + ev.Test
+		switch ev.Action {
+		case "pass":
+			outcomes[key] = OutcomePass
+		case "fail":
+			outcomes[key] = OutcomeFail
+		case "skip":
+			outcomes[key] = OutcomeSkip
+		}
+	}
+	return outcomes, scanner.Err()
+}
+
+func compare(oldOutcomes, currentOutcomes map[string]Outcome) Summary {
+	var summary Summary
+	tests := make(map[string]bool)
+	for test := range oldOutcomes {
+		tests[test] = true
+	}
+	for test := range currentOutcomes {
+		tests[test] = true
+	}
+	for test := range tests {
+		d := Diff{
+			Test:    test,
+			Old:     outcomeOf(oldOutcomes, test),
+			Current: outcomeOf(currentOutcomes, test),
+		}
+		switch {
+		case d.Old == d.Current:
+			summary.Unchanged++
+		case d.Old == OutcomePass && d.Current == OutcomeFail:
+			summary.Regressions = append(summary.Regressions, d)
+		case d.Old == OutcomeFail && d.Current == OutcomePass:
+			summary.Fixes = append(summary.Fixes, d)
+		default:
+			summary.Changes = append(summary.Changes, d)
+		}
+	}
+	for _, diffs := range [][]Diff{summary.Regressions, summary.Fixes, summary.Changes} {
+		sort.Slice(diffs, func(i, j int) bool {
+			return diffs[i].Test < diffs[j].Test
+		})
+	}
+	return summary
+}
+
+func outcomeOf(outcomes map[string]Outcome, test string) Outcome {
+	outcome, ok := outcomes[test]
+	if !ok {
+		return OutcomeMissing
+	}
+	return outcome
+}
+
+func printSummary(w io.Writer, summary Summary) {
+	fmt.Fprintf(w, "\nold:     %s\ncurrent: %s\n", summary.OldSDK, summary.CurrentSDK)
+	for _, section := range []struct {
+		title string
+		diffs []Diff
+	}{
+		{"REGRESSIONS", summary.Regressions},
+		{"FIXES", summary.Fixes},
+		{"OTHER CHANGES", summary.Changes},
+	} {
+		fmt.Fprintf(w, "\n%s (%d)\n", section.title, len(section.diffs))
+		for _, d := range section.diffs {
+			fmt.Fprintf(w, "  %-8s -> %-8s %s\n", d.Old, d.Current, strings.TrimPrefix(d.Test, "github.com/matrix-org/complement-crypto/"))
+		}
+	}
+	fmt.Fprintf(w, "\n%d tests unchanged\n", summary.Unchanged)
+}
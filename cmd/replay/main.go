@@ -0,0 +1,184 @@
+// replay serves the HTTP responses in a traffic recording made by deploy.RecordTraffic, so that a client can
+// be pointed at it to reproduce a test failure offline, without any homeservers or mitmproxy. Requests are
+// matched to recorded flows by HTTP method and path, preferring flows with the same query string, and each
+// recorded flow is only served once, in the order it was recorded. Requests which were never recorded
+// return HTTP 404.
+//
+// Recordings contain traffic to every homeserver, so use -server to pick which homeserver to impersonate.
+// Run one replayer per homeserver if the client talks to more than one.
+//
+// Usage:
+//
+//	go run ./cmd/replay -list ./logs/traffic/TestRoomKeyIsCycledOnDeviceLogout_rust_rust.json
+//	go run ./cmd/replay -server hs1 -listen localhost:8008 ./logs/traffic/TestRoomKeyIsCycledOnDeviceLogout_rust_rust.json
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/deploy"
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+)
+
+var (
+	flagListen   = flag.String("listen", "localhost:8008", "The address to serve recorded responses on")
+	flagServer   = flag.String("server", "", "Only replay flows to this homeserver e.g hs1. If unset, flows to every homeserver are replayed.")
+	flagList     = flag.Bool("list", false, "Print every flow in the recording then exit, instead of serving them")
+	flagRealtime = flag.Bool("realtime", false, "Delay each response by as long as the homeserver took to respond when it was recorded")
+)
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		log.Fatal("usage: replay [flags] recording.json")
+	}
+	data, err := os.ReadFile(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("failed to read recording: %s", err)
+	}
+	var recording deploy.TrafficRecording
+	if err := json.Unmarshal(data, &recording); err != nil {
+		log.Fatalf("failed to parse recording: %s", err)
+	}
+	flows := filterFlows(recording.Flows, *flagServer)
+	if *flagList {
+		printFlows(os.Stdout, flows)
+		return
+	}
+	log.Printf("replaying %d flows from %s on %s", len(flows), recording.TestName, *flagListen)
+	replayer := NewReplayer(flows, *flagRealtime)
+	log.Fatal(http.ListenAndServe(*flagListen, replayer))
+}
+
+// filterFlows returns the flows to the given homeserver, or all flows if server is empty.
+func filterFlows(flows []mitm.RecordedFlow, server string) []mitm.RecordedFlow {
+	if server == "" {
+		return flows
+	}
+	var filtered []mitm.RecordedFlow
+	for _, f := range flows {
+		u, err := url.Parse(f.URL)
+		if err != nil {
+			continue
+		}
+		if u.Hostname() == server {
+			filtered = append(filtered, f)
+		}
+	}
+	return filtered
+}
+
+func printFlows(w io.Writer, flows []mitm.RecordedFlow) {
+	if len(flows) == 0 {
+		fmt.Fprintln(w, "no flows recorded")
+		return
+	}
+	start := flows[0].RequestTimestampMs
+	for _, f := range flows {
+		if f.RequestTimestampMs < start {
+			start = f.RequestTimestampMs
+		}
+	}
+	for _, f := range flows {
+		u, _ := url.Parse(f.URL)
+		outcome := fmt.Sprintf("HTTP %d (%dms)", f.ResponseCode, f.ResponseTimestampMs-f.RequestTimestampMs)
+		if f.Error != "" {
+			outcome = "ERROR " + f.Error
+		}
+		fmt.Fprintf(w, "+%8.3fs %s %s %s => %s\n",
+			float64(f.RequestTimestampMs-start)/1000, u.Host, f.Method, u.RequestURI(), outcome)
+	}
+}
+
+// Replayer is an http.Handler which responds to requests with recorded responses.
+type Replayer struct {
+	mu       sync.Mutex
+	flows    []mitm.RecordedFlow
+	served   []bool
+	realtime bool
+}
+
+func NewReplayer(flows []mitm.RecordedFlow, realtime bool) *Replayer {
+	return &Replayer{
+		flows:    flows,
+		served:   make([]bool, len(flows)),
+		realtime: realtime,
+	}
+}
+
+// next returns the next unserved flow which matches the request, marking it as served. Flows with the same
+// query string are preferred, as query strings include things like sync tokens which are often the same
+// when the client behaves the same way. Returns nil if there are no matching flows left.
+func (r *Replayer) next(method string, u *url.URL) *mitm.RecordedFlow {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fallback := -1
+	for i, f := range r.flows {
+		if r.served[i] || f.Method != method {
+			continue
+		}
+		recordedURL, err := url.Parse(f.URL)
+		if err != nil || recordedURL.Path != u.Path {
+			continue
+		}
+		if recordedURL.RawQuery == u.RawQuery {
+			r.served[i] = true
+			return &r.flows[i]
+		}
+		if fallback == -1 {
+			fallback = i
+		}
+	}
+	if fallback == -1 {
+		return nil
+	}
+	r.served[fallback] = true
+	return &r.flows[fallback]
+}
+
+func (r *Replayer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	flow := r.next(req.Method, req.URL)
+	if flow == nil {
+		log.Printf("%s %s => no recorded flow", req.Method, req.URL.RequestURI())
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(404)
+		w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"no recorded response for this request"}`))
+		return
+	}
+	if r.realtime && flow.ResponseTimestampMs > flow.RequestTimestampMs {
+		time.Sleep(time.Duration(flow.ResponseTimestampMs-flow.RequestTimestampMs) * time.Millisecond)
+	}
+	if flow.Error != "" {
+		// the client never got a response, so close the connection as mitmproxy did
+		log.Printf("%s %s => killing connection: %s", req.Method, req.URL.RequestURI(), flow.Error)
+		if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+		panic(http.ErrAbortHandler)
+	}
+	log.Printf("%s %s => HTTP %d", req.Method, req.URL.RequestURI(), flow.ResponseCode)
+	for k, vals := range flow.ResponseHeaders {
+		switch http.CanonicalHeaderKey(k) {
+		// the recorded body is decoded and may be a different length to when it was sent
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding":
+			continue
+		}
+		for _, v := range vals {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(flow.ResponseCode)
+	w.Write(flow.ResponseBody)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+)
+
+func TestReplayerServesFlowsInOrder(t *testing.T) {
+	replayer := NewReplayer(filterFlows([]mitm.RecordedFlow{
+		{Method: "GET", URL: "http://hs1:8008/_matrix/client/v3/sync?since=s1", ResponseCode: 200, ResponseBody: []byte(`s1`)},
+		{Method: "GET", URL: "http://hs1:8008/_matrix/client/v3/sync?since=s2", ResponseCode: 200, ResponseBody: []byte(`s2`)},
+		{Method: "GET", URL: "http://hs2:8008/_matrix/client/v3/sync?since=s1", ResponseCode: 200, ResponseBody: []byte(`hs2`)},
+		{Method: "PUT", URL: "http://hs1:8008/_matrix/client/v3/sendToDevice/m.room.encrypted/1", ResponseCode: 502},
+		{Method: "PUT", URL: "http://hs1:8008/_matrix/client/v3/sendToDevice/m.room.encrypted/1", ResponseCode: 200, ResponseBody: []byte(`{}`)},
+	}, "hs1"), false)
+	srv := httptest.NewServer(replayer)
+	defer srv.Close()
+
+	testCases := []struct {
+		method   string
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		// the query string matches exactly, even though this was recorded second
+		{"GET", "/_matrix/client/v3/sync?since=s2", 200, "s2"},
+		// no exact match left, so fall back to any matching path
+		{"GET", "/_matrix/client/v3/sync?since=s3", 200, "s1"},
+		// hs2 was filtered out, and all the hs1 flows have been served
+		{"GET", "/_matrix/client/v3/sync?since=s1", 404, `{"errcode":"M_NOT_FOUND","error":"no recorded response for this request"}`},
+		// retries get the next response
+		{"PUT", "/_matrix/client/v3/sendToDevice/m.room.encrypted/1", 502, ""},
+		{"PUT", "/_matrix/client/v3/sendToDevice/m.room.encrypted/1", 200, "{}"},
+	}
+	for _, tc := range testCases {
+		req, err := http.NewRequest(tc.method, srv.URL+tc.path, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %s", err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %s", tc.method, tc.path, err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != tc.wantCode || string(body) != tc.wantBody {
+			t.Errorf("%s %s: got HTTP %d %s, want HTTP %d %s", tc.method, tc.path, res.StatusCode, body, tc.wantCode, tc.wantBody)
+		}
+	}
+}
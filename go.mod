@@ -11,7 +11,9 @@ require (
 	github.com/matrix-org/complement v0.0.0-20240925142218-911d7d39773a
 	github.com/testcontainers/testcontainers-go v0.31.0
 	github.com/tidwall/gjson v1.16.0
+	golang.org/x/crypto v0.27.0
 	golang.org/x/exp v0.0.0-20230905200255-921286631fa9
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -72,7 +74,6 @@ require (
 	go.opentelemetry.io/otel v1.30.0 // indirect
 	go.opentelemetry.io/otel/metric v1.30.0 // indirect
 	go.opentelemetry.io/otel/trace v1.30.0 // indirect
-	golang.org/x/crypto v0.27.0 // indirect
 	golang.org/x/mod v0.16.0 // indirect
 	golang.org/x/net v0.26.0 // indirect
 	golang.org/x/sys v0.25.0 // indirect
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/must"
+)
+
+// Appservice is a minimal application service, which puppets users in its namespace as bridges do. It does not
+// receive events from the homeserver: everything is done by puppeted users via the client-server API, using the
+// appservice's token. Puppeted users can log in any number of devices, which can be used to create test clients
+// via ClientCreationOpts.AccessToken, so tests can check how SDKs handle encrypted rooms with bridged users.
+type Appservice struct {
+	// The ID of the appservice registration.
+	ID string
+	// The URL of the client-server API of the homeserver this appservice is registered on.
+	BaseURL string
+	// The server name of the homeserver this appservice is registered on e.g "hs3".
+	ServerName string
+	// The token the appservice uses to authenticate with the homeserver.
+	ASToken string
+	// The token the homeserver would use to authenticate with the appservice.
+	HSToken string
+	// The localpart of the appservice's sender user e.g the bridge bot.
+	SenderLocalpart string
+	// The localpart prefix of users in the appservice's exclusive namespace.
+	PuppetPrefix string
+}
+
+// RegistrationYAML returns the appservice registration file for this appservice. The registration has no URL,
+// so the homeserver does not send transactions to the appservice. The namespace does not depend on the server
+// name, so the registration can be made before the homeserver.
+func (as *Appservice) RegistrationYAML() string {
+	return fmt.Sprintf(`id: %s
+url: null
+as_token: %s
+hs_token: %s
+sender_localpart: %s
+rate_limited: false
+namespaces:
+  users:
+    - exclusive: true
+      regex: "@%s.*"
+  rooms: []
+  aliases: []
+`, as.ID, as.ASToken, as.HSToken, as.SenderLocalpart, as.PuppetPrefix)
+}
+
+// SenderUserID returns the user ID of the appservice's sender user.
+func (as *Appservice) SenderUserID() string {
+	return fmt.Sprintf("@%s:%s", as.SenderLocalpart, as.ServerName)
+}
+
+// PuppetUserID returns the user ID of the puppeted user with the given suffix.
+func (as *Appservice) PuppetUserID(suffix string) string {
+	return fmt.Sprintf("@%s%s:%s", as.PuppetPrefix, suffix, as.ServerName)
+}
+
+// MustRegisterPuppet registers the puppeted user with the given suffix, as per PuppetUserID, and logs in a
+// device for them. Returns a client for the new device.
+func (as *Appservice) MustRegisterPuppet(t ct.TestLike, suffix string) *client.CSAPI {
+	t.Helper()
+	cli := as.client(t)
+	res := cli.MustDo(t, "POST", []string{"_matrix", "client", "v3", "register"}, client.WithJSONBody(t, map[string]any{
+		"type":     "m.login.application_service",
+		"username": as.PuppetPrefix + suffix,
+	}))
+	body := must.ParseJSON(t, res.Body)
+	cli.UserID = must.GetJSONFieldStr(t, body, "user_id")
+	cli.AccessToken = must.GetJSONFieldStr(t, body, "access_token")
+	cli.DeviceID = must.GetJSONFieldStr(t, body, "device_id")
+	return cli
+}
+
+// MustLoginPuppet logs in a new device for an already registered puppeted user. If deviceID is empty, the
+// homeserver picks the device ID. Returns a client for the new device.
+func (as *Appservice) MustLoginPuppet(t ct.TestLike, userID, deviceID string) *client.CSAPI {
+	t.Helper()
+	cli := as.client(t)
+	reqBody := map[string]any{
+		"type": "m.login.application_service",
+		"identifier": map[string]any{
+			"type": "m.id.user",
+			"user": userID,
+		},
+	}
+	if deviceID != "" {
+		reqBody["device_id"] = deviceID
+	}
+	res := cli.MustDo(t, "POST", []string{"_matrix", "client", "v3", "login"}, client.WithJSONBody(t, reqBody))
+	body := must.ParseJSON(t, res.Body)
+	cli.UserID = must.GetJSONFieldStr(t, body, "user_id")
+	cli.AccessToken = must.GetJSONFieldStr(t, body, "access_token")
+	cli.DeviceID = must.GetJSONFieldStr(t, body, "device_id")
+	return cli
+}
+
+// Sender returns a client for the appservice's sender user, authenticated with the appservice's token. As with
+// all appservice requests, this can act as any puppeted user by setting the `user_id` query parameter.
+func (as *Appservice) Sender(t ct.TestLike) *client.CSAPI {
+	t.Helper()
+	cli := as.client(t)
+	cli.UserID = as.SenderUserID()
+	return cli
+}
+
+// client returns a client authenticated as the appservice. Clients for puppeted devices replace the access
+// token with the one for the new device.
+func (as *Appservice) client(t ct.TestLike) *client.CSAPI {
+	return &client.CSAPI{
+		BaseURL:          as.BaseURL,
+		Client:           client.NewLoggedClient(t, as.ServerName, nil),
+		AccessToken:      as.ASToken,
+		SyncUntilTimeout: 5 * time.Second,
+	}
+}
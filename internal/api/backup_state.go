@@ -0,0 +1,166 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// BackupState is the state of a client's server-side key backup, normalised across SDKs. Not all SDKs
+// report every state: clients which only know whether the backup is enabled only report
+// BackupStateDisabled and BackupStateEnabled.
+type BackupState string
+
+const (
+	// The client is not backing up keys, either because there is no backup or it has not been enabled on
+	// this device.
+	BackupStateDisabled BackupState = "disabled"
+	// The client is creating a new backup, or enabling or resuming an existing one.
+	BackupStateEnabling BackupState = "enabling"
+	// The client is backing up keys.
+	BackupStateEnabled BackupState = "enabled"
+	// The client is downloading keys from the backup.
+	BackupStateDownloading BackupState = "downloading"
+	// The client is disabling the backup.
+	BackupStateDisabling BackupState = "disabling"
+)
+
+// BackupStateListeners is a set of backup state streams which clients can use to implement
+// ListenForBackupStates. The zero value is ready to use.
+type BackupStateListeners struct {
+	mu        sync.Mutex
+	current   *BackupState
+	listeners map[int]*backupStateQueue
+	nextID    int
+}
+
+// Listen returns a channel which receives the current backup state if there is one, then every
+// change to the backup state until ctx is done, at which point the channel is closed. States are
+// queued if the channel is not being read, so Broadcast never blocks.
+func (l *BackupStateListeners) Listen(ctx context.Context) <-chan BackupState {
+	q := &backupStateQueue{
+		notify: make(chan struct{}, 1),
+	}
+	l.mu.Lock()
+	if l.listeners == nil {
+		l.listeners = make(map[int]*backupStateQueue)
+	}
+	id := l.nextID
+	l.nextID++
+	l.listeners[id] = q
+	if l.current != nil {
+		q.push(*l.current)
+	}
+	l.mu.Unlock()
+
+	ch := make(chan BackupState)
+	go func() {
+		defer close(ch)
+		defer func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			delete(l.listeners, id)
+		}()
+		for {
+			s, ok := q.pop()
+			if !ok {
+				select {
+				case <-q.notify:
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case ch <- s:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// Broadcast the new backup state to all listeners. Does nothing if the state has not changed.
+func (l *BackupStateListeners) Broadcast(s BackupState) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.current != nil && *l.current == s {
+		return
+	}
+	l.current = &s
+	for _, q := range l.listeners {
+		q.push(s)
+	}
+}
+
+type backupStateQueue struct {
+	mu     sync.Mutex
+	states []BackupState
+	// has a value when states may be non-empty
+	notify chan struct{}
+}
+
+func (q *backupStateQueue) push(s BackupState) {
+	q.mu.Lock()
+	q.states = append(q.states, s)
+	q.mu.Unlock()
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *backupStateQueue) pop() (BackupState, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.states) == 0 {
+		return "", false
+	}
+	s := q.states[0]
+	q.states = q.states[1:]
+	return s, true
+}
+
+// backupStateWaiter waits for a backup state, see TestClient.WaitUntilBackupState
+type backupStateWaiter struct {
+	want   BackupState
+	ch     <-chan BackupState
+	cancel func()
+	err    error
+	// every state seen, for failure messages
+	seen []BackupState
+}
+
+func (w *backupStateWaiter) Waitf(t ct.TestLike, s time.Duration, format string, args ...any) {
+	t.Helper()
+	if err := w.TryWaitf(t, s, format, args...); err != nil {
+		ct.Fatalf(t, "%s", err)
+	}
+}
+
+func (w *backupStateWaiter) TryWaitf(t ct.TestLike, s time.Duration, format string, args ...any) error {
+	t.Helper()
+	if w.err != nil {
+		return fmt.Errorf("%s: %s", fmt.Sprintf(format, args...), w.err)
+	}
+	defer w.cancel()
+	deadline := time.After(s)
+	for {
+		select {
+		case state, ok := <-w.ch:
+			if !ok {
+				return fmt.Errorf("%s: backup state stream closed, saw %v", fmt.Sprintf(format, args...), w.seen)
+			}
+			w.seen = append(w.seen, state)
+			if state == w.want {
+				return nil
+			}
+		case <-deadline:
+			return fmt.Errorf("%s: timed out after %v waiting for backup state %s, saw %v", fmt.Sprintf(format, args...), s, w.want, w.seen)
+		}
+	}
+}
@@ -1,13 +1,21 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"slices"
 	"time"
 
 	"github.com/matrix-org/complement/client"
 	"github.com/matrix-org/complement/ct"
 )
 
+// ErrNotSupported is returned by Client methods which the client cannot perform, either because the SDK
+// does not support the operation or because it is not exposed to complement-crypto. Implementations should
+// wrap it with the name of the operation, and tests should check for it with errors.Is before skipping.
+var ErrNotSupported = errors.New("not supported by this client")
+
 type ClientType struct {
 	Lang ClientTypeLang // rust or js
 	HS   string         // hs1 or hs2
@@ -29,6 +37,10 @@ type Client interface {
 	ForceClose(t ct.TestLike)
 	// Remove any persistent storage, if it was enabled.
 	DeletePersistentStorage(t ct.TestLike)
+	// PersistentStoragePath returns the directory containing this client's on-disk storage, or the empty
+	// string if the client does not store anything on disk. The directory MAY be shared with other clients
+	// of the same type. The client MUST be closed before the directory is copied or modified.
+	PersistentStoragePath(t ct.TestLike) string
 	// Login the given user. This function MUST block until one-time keys and device keys have been
 	// uploaded to the server. Failure to block will result in flakey tests as other users may not
 	// encrypt for this Client due to not detecting keys for the Client.
@@ -38,27 +50,191 @@ type Client interface {
 	// MUST BLOCK until the initial sync is complete.
 	// Returns an error if there was a problem syncing.
 	StartSyncing(t ct.TestLike) (stopSyncing func(), err error)
+	// ListenForSyncStates calls the callback whenever the sync loop changes state, e.g when it starts syncing
+	// or encounters an error. If the state is already known, the callback MUST be called immediately. The
+	// callback MUST NOT block. Call the returned function to stop listening. Tests should typically use
+	// ClientSyncMonitor instead of calling this directly.
+	ListenForSyncStates(t ct.TestLike, callback func(s SyncState)) (cancel func(), err error)
+	// ClearCacheAndRestart simulates the user clearing the cache of the client. This MUST
+	// drop any cached events and the sync token, but MUST keep the crypto store intact, and
+	// MUST NOT log out. If the client was syncing, it MUST resume syncing and BLOCK until the
+	// initial sync has completed, at which point the stopSyncing function previously returned
+	// from StartSyncing must still stop the sync loop.
+	ClearCacheAndRestart(t ct.TestLike) error
+	// Restart simulates the user closing and reopening the app. The client MUST be shut down then re-created
+	// from its persistent storage, so it MUST keep the same device and crypto store, and MUST NOT log in
+	// again. Requires PersistentStorage for clients which do not always store to disk. As with
+	// ClearCacheAndRestart, if the client was syncing it MUST resume syncing and BLOCK until the initial sync
+	// has completed, and the stopSyncing function previously returned from StartSyncing must still work.
+	Restart(t ct.TestLike) error
+	// Kill simulates the client crashing. The client MUST stop immediately without flushing anything to disk or
+	// shutting down cleanly, so writes which were in progress MAY be lost or only partially written. Callbacks
+	// MUST NOT be called after Kill returns. The client cannot be used again until RestoreFromStorage is called.
+	Kill(t ct.TestLike) error
+	// RestoreFromStorage re-creates a killed client from whatever was in its persistent storage when it was killed.
+	// The client MUST keep the same device and MUST NOT log in again. Unlike Restart, the client does not resume
+	// syncing, so tests should call StartSyncing. Requires PersistentStorage for clients which do not always store
+	// to disk. Returns an error if the client was not killed, or if the storage could not be loaded.
+	RestoreFromStorage(t ct.TestLike) error
+	// SetStorePassphrase sets the passphrase used to open the persistent store when the client is next re-created
+	// by Restart or RestoreFromStorage, as if the user had entered a different passphrase. This MUST NOT re-encrypt
+	// the existing store, so re-creating the client MUST return an error if the passphrase does not match the one
+	// the store was encrypted with. Clients MUST NOT silently reset or replace the store when this happens, so
+	// that re-creating the client again with the right passphrase succeeds. See ClientCreationOpts.StorePassphrase.
+	SetStorePassphrase(t ct.TestLike, passphrase string) error
 	// IsRoomEncrypted returns true if the room is encrypted. May return an error e.g if you
 	// provide a bogus room ID.
 	IsRoomEncrypted(t ct.TestLike, roomID string) (bool, error)
-	// InviteUser attempts to invite the given user into the given room.
+	// GetEncryptionAlgorithm returns the algorithm in the room's m.room.encryption state as this client sees it
+	// e.g m.megolm.v1.aes-sha2, or the empty string if the client does not think the room is encrypted. May
+	// return an error e.g if you provide a bogus room ID.
+	GetEncryptionAlgorithm(t ct.TestLike, roomID string) (string, error)
+	// IsDirect returns true if the room is a direct message room with another user, as determined by
+	// the `m.direct` account data of the user. May return an error e.g if you provide a bogus room ID.
+	IsDirect(t ct.TestLike, roomID string) (bool, error)
+	// InviteUser attempts to invite the given user into the given room. If the client was created with
+	// EnableShareHistoryOnInvite, this MUST also share historical room keys with the invited user.
 	InviteUser(t ct.TestLike, roomID, userID string) error
+	// JoinRoom attempts to join the given room, via the given servers if the room is on another server.
+	// If the client was created with EnableShareHistoryOnInvite, this MUST also accept any historical room
+	// keys shared by the inviter. Returns an error if the room could not be joined.
+	JoinRoom(t ct.TestLike, roomID string, serverNames []string) error
+	// FollowTombstone joins the replacement room given in the m.room.tombstone event of the given room, via the
+	// given servers, and returns the ID of the replacement room. MUST BLOCK until the replacement room has been
+	// joined. Returns an error if the room has not been upgraded or the replacement room could not be joined.
+	FollowTombstone(t ct.TestLike, roomID string, serverNames []string) (newRoomID string, err error)
+	// IgnoreUser adds the given user to this user's ignored users list (m.ignored_user_list account data),
+	// and MUST BLOCK until the list has been updated on the server. Clients MUST NOT share room keys with the
+	// ignored user's devices when sending messages in encrypted rooms, even if they share a room.
+	IgnoreUser(t ct.TestLike, userID string) error
+	// UnignoreUser removes the given user from this user's ignored users list, and MUST BLOCK until the list
+	// has been updated on the server. Clients MUST share room keys with the user's devices again, at the
+	// latest when the room key is next rotated.
+	UnignoreUser(t ct.TestLike, userID string) error
 	// SendMessage sends the given text as an encrypted/unencrypted message in the room, depending
 	// if the room is encrypted or not. Returns the event ID of the sent event, so MUST BLOCK until the event has been sent.
 	// If the event cannot be sent, returns an error.
 	SendMessage(t ct.TestLike, roomID, text string) (eventID string, err error)
+	// SendThreadedMessage is SendMessage but sends the message in the thread with the given root event, as per
+	// MSC3440. The message MUST be encrypted if the room is encrypted. MUST BLOCK until the event has been sent.
+	SendThreadedMessage(t ct.TestLike, roomID, threadRootID, text string) (eventID string, err error)
+	// SendEncryptedFile encrypts the contents, uploads them and sends them as a file attachment (m.file) with
+	// the given filename in the room, which MUST be encrypted. Returns the event ID of the sent event, so MUST
+	// BLOCK until the event has been sent. If the file cannot be uploaded or sent, returns an error.
+	SendEncryptedFile(t ct.TestLike, roomID, filename string, contents []byte) (eventID string, err error)
+	// RedactEvent redacts the given event in the room, with an optional reason. MUST BLOCK until the redaction
+	// has been sent. Returns an error if the event could not be redacted e.g due to insufficient power level.
+	RedactEvent(t ct.TestLike, roomID, eventID, reason string) error
+	// React sends an m.reaction event annotating the given event with the key, which is typically an emoji. The
+	// reaction MUST be encrypted if the room is encrypted. Clients MAY return before the reaction has been sent, as
+	// some SDKs only queue reactions. Returns an error if the reaction could not be sent or queued.
+	React(t ct.TestLike, roomID, eventID, key string) error
+	// EditMessage replaces the text of the given message, which MUST have been sent by this client, with newBody by
+	// sending an m.replace event. The edit MUST be encrypted if the room is encrypted. MUST BLOCK until the edit has
+	// been sent. Returns an error if the event cannot be edited e.g because it was sent by someone else.
+	EditMessage(t ct.TestLike, roomID, eventID, newBody string) error
+	// SetRoomTopic sets the topic of the room by sending an m.room.topic state event. If the room has encrypted
+	// state events enabled (MSC3414) and the client supports them, the event MUST be encrypted. MUST BLOCK until
+	// the event has been sent, returning its event ID.
+	SetRoomTopic(t ct.TestLike, roomID, topic string) (eventID string, err error)
+	// GetOutboundSessionID is a debug method which returns the megolm session ID this client used to encrypt
+	// an event it sent, so tests can check when clients rotate their outbound session. Returns an error if the
+	// event was not sent by this client or is not encrypted.
+	GetOutboundSessionID(t ct.TestLike, roomID, eventID string) (sessionID string, err error)
+	// GetOutboundSessionInfo is a debug method which returns information about the megolm session this client
+	// is using to encrypt messages in the room, so tests can assert that the session was rotated. Returns nil
+	// if the client has no outbound session for the room.
+	GetOutboundSessionInfo(t ct.TestLike, roomID string) (*OutboundSessionInfo, error)
 	// Wait until an event is seen in the given room. The checker functions can be custom or you can use
 	// a pre-defined one like api.CheckEventHasMembership, api.CheckEventHasBody, or api.CheckEventHasEventID.
 	WaitUntilEventInRoom(t ct.TestLike, roomID string, checker func(e Event) bool) Waiter
-	// Backpaginate in this room by `count` events. Returns an error if there was a problem backpaginating.
-	// Getting to the beginning of the room is not an error condition.
-	Backpaginate(t ct.TestLike, roomID string, count int) error
+	// WaitUntilEventInRoomWithOpts is WaitUntilEventInRoom but only events which match the options are
+	// passed to the checker function. This avoids checkers having to skip over unrelated events.
+	WaitUntilEventInRoomWithOpts(t ct.TestLike, roomID string, opts TimelineListenerOpts, checker func(e Event) bool) Waiter
+	// Backpaginate in this room by `count` events, then return the client's view of the room timeline, oldest
+	// event first, as per GetTimeline. Clients MUST have attempted to decrypt the paginated events before
+	// returning, so tests can assert whether historical events can be decrypted without waiting.
+	// Returns an error if there was a problem backpaginating. Getting to the beginning of the room is not an
+	// error condition.
+	Backpaginate(t ct.TestLike, roomID string, count int) (timeline []*Event, err error)
 	// GetEvent will return the client's view of this event, or returns an error if the event cannot be found.
+	// If the event has a file attachment, clients MUST download and decrypt the file, see EventFile.
 	GetEvent(t ct.TestLike, roomID, eventID string) (*Event, error)
+	// GetTimeline returns the client's view of the room timeline, oldest event first. Only events the client
+	// currently has in its timeline are returned, so tests may need to Backpaginate first. Returns an error if
+	// the room cannot be found.
+	GetTimeline(t ct.TestLike, roomID string) ([]*Event, error)
+	// GetThread fetches the events in the thread with the given root event from the server via /relations,
+	// oldest event first, not including the root. Clients MUST have attempted to decrypt the events before
+	// returning. Returns an error if the thread cannot be fetched.
+	GetThread(t ct.TestLike, roomID, threadRootID string) ([]*Event, error)
+	// MarkAsRead sends a public read receipt for the latest event in the room's timeline, as the client would when
+	// the user views the room. Clients decide which events receipts can be sent for, so the receipt may not be
+	// for the latest event e.g if it failed to decrypt. Returns an error if the receipt could not be sent.
+	MarkAsRead(t ct.TestLike, roomID string) error
+	// GetReadReceipt returns the ID of the event which the user's public read receipt in the room is for, as seen
+	// by this client, or the empty string if the client has not seen a read receipt from the user. Returns an
+	// error if the room cannot be found.
+	GetReadReceipt(t ct.TestLike, roomID, userID string) (eventID string, err error)
 	// BackupKeys will backup E2EE keys, else return an error.
 	BackupKeys(t ct.TestLike) (recoveryKey string, err error)
 	// LoadBackup will recover E2EE keys from the latest backup, else return an error.
 	LoadBackup(t ct.TestLike, recoveryKey string) error
+	// ExportRoomKeys exports every room key this client has, encrypted with the passphrase in the standard key
+	// export format (https://spec.matrix.org/v1.11/client-server-api/#key-exports), so it can be imported by any
+	// SDK. Returns the ASCII-armored export, or an error if the keys could not be exported.
+	ExportRoomKeys(t ct.TestLike, passphrase string) ([]byte, error)
+	// ImportRoomKeys imports the room keys in the export, which is in the standard key export format and encrypted
+	// with the passphrase. MUST BLOCK until the keys have been imported, and events encrypted with them MUST be
+	// decryptable afterwards. Returns an error if the export is malformed or the passphrase is wrong.
+	ImportRoomKeys(t ct.TestLike, export []byte, passphrase string) error
+	// CreateSecretStorageKey creates a new default secret storage (4S) key and returns its recovery key. If there
+	// is already a default key, it is replaced, and the secrets the SDK manages e.g cross-signing keys are
+	// re-encrypted with the new key. Other secrets are not re-encrypted.
+	CreateSecretStorageKey(t ct.TestLike) (recoveryKey string, err error)
+	// UnlockSecretStorage lets this client decrypt secrets encrypted with the default secret storage key, using
+	// the recovery key returned from CreateSecretStorageKey, which may have been called on another device.
+	// Returns an error if the recovery key is not for the default key.
+	UnlockSecretStorage(t ct.TestLike, recoveryKey string) error
+	// StoreSecret encrypts the value with the default secret storage key and stores it in account data under
+	// name e.g "org.example.secret". The key must have been created or unlocked on this client first.
+	StoreSecret(t ct.TestLike, name, value string) error
+	// GetSecret decrypts the secret stored under name with the default secret storage key. The key must have
+	// been created or unlocked on this client first. Returns an error if there is no such secret.
+	GetSecret(t ct.TestLike, name string) (value string, err error)
+	// ListenForBackupStates returns a channel which receives the current state of the key backup, then every
+	// change to it until ctx is done, at which point the channel is closed. Clients MUST queue states rather
+	// than block if the channel is not being read. Tests should typically use WaitUntilBackupState instead
+	// of calling this directly.
+	ListenForBackupStates(t ct.TestLike, ctx context.Context) (<-chan BackupState, error)
+	// CreateDehydratedDevice creates a dehydrated device for this user as per MSC3814, replacing any existing
+	// one, so that other users can send room keys to this user whilst they have no other devices. The dehydration
+	// key is stored in secret storage, so BackupKeys MUST be called first. Returns an error if the homeserver
+	// does not support dehydrated devices.
+	CreateDehydratedDevice(t ct.TestLike) error
+	// RehydrateDevice loads this user's dehydrated device using the dehydration key in secret storage, which is
+	// unlocked with the recovery key from BackupKeys. Room keys sent to the dehydrated device MUST be imported
+	// before this returns. Clients MAY create a new dehydrated device afterwards.
+	RehydrateDevice(t ct.TestLike, recoveryKey string) error
+	// RequestRoomKey asks this user's other devices for the room key for the given megolm session (see
+	// Event.SessionID), as per m.room_key_request. The room MUST contain an event encrypted with this session
+	// which this client failed to decrypt. This MUST return once the request has been sent: whether other
+	// devices share the key is up to them, typically depending on whether they trust this device. If a key is
+	// received, the client MUST retry decrypting events encrypted with this session.
+	RequestRoomKey(t ct.TestLike, roomID, sessionID string) error
+	// CancelRoomKeyRequest cancels a request made via RequestRoomKey, so that other devices do not share the
+	// key if they have not already done so. Returns an error if there is no outstanding request for this session.
+	CancelRoomKeyRequest(t ct.TestLike, roomID, sessionID string) error
+	// RetryDecryption asks the client to try again to decrypt events in the room which failed to decrypt, e.g
+	// after room keys arrived late. If sessionIDs is empty, every undecryptable event is retried, else only events
+	// encrypted with these megolm sessions (see Event.SessionID). Newly decrypted events MUST be reported to
+	// timeline listeners. This MUST return once decryption has been retried, regardless of whether it succeeded.
+	RetryDecryption(t ct.TestLike, roomID string, sessionIDs []string) error
+	// FallbackKeyUsed returns true if the server has told this client, via the unused fallback key types in
+	// the sync response, that this device's fallback key was claimed since the client was created. This happens
+	// when other devices claim keys after all of this device's one-time keys have been used up. Returns an
+	// error if the client does not expose this.
+	FallbackKeyUsed(t ct.TestLike) (used bool, err error)
 	// GetNotification gets push notification-like information for the given event. If there is a problem, an error is returned.
 	// Clients should implement this AS IF they received a push notification.
 	GetNotification(t ct.TestLike, roomID, eventID string) (*Notification, error)
@@ -79,7 +255,56 @@ type Client interface {
 	//    }
 	// The channel is closed when the verification process reaches a terminal state.
 	RequestOwnUserVerification(t ct.TestLike) chan VerificationStage
-	// Log something to stdout and the underlying client log file
+	// RequestUserVerification tries to verify another user by sending m.key.verification.request as an event
+	// in the given room, which should be a DM with that user. The other user sees the request via
+	// ListenForVerificationRequests. Returns a stream of verification stages as per RequestOwnUserVerification,
+	// or an error if the request could not be sent.
+	RequestUserVerification(t ct.TestLike, userID, roomID string) (chan VerificationStage, error)
+	// GetDeviceTrust returns how much this client trusts the given device, which may belong to this user
+	// or another user. Clients SHOULD return TrustLevelUnknown if they have not downloaded the device keys
+	// for this device. Returns an error if there was a problem determining the trust level.
+	GetDeviceTrust(t ct.TestLike, userID, deviceID string) (TrustLevel, error)
+	// GetDeviceIDs returns the IDs of the devices this client currently knows about for the given user, from
+	// its local copy of the user's device list. This does not query the server, so reflects the device list
+	// updates the client has processed. Devices which have been deleted MUST NOT be returned.
+	GetDeviceIDs(t ct.TestLike, userID string) (deviceIDs []string, err error)
+	// SetDeviceDisplayName sets the display name of this client's device on the server. Other users see the new
+	// name the next time they fetch this user's device list. Changing the display name MUST NOT cause this client
+	// or other clients to rotate room keys, as the device's keys are unchanged. Returns an error if the name could
+	// not be set.
+	SetDeviceDisplayName(t ct.TestLike, name string) error
+	// ListenForDeviceListChanges calls the callback with user IDs whenever the client learns that the device lists
+	// of those users have changed e.g via device_lists.changed in /sync. Clients MAY call the callback once they have
+	// fetched the new device lists rather than when the old ones are invalidated. Call cancel to stop listening.
+	ListenForDeviceListChanges(t ct.TestLike, callback func(userIDs []string)) (cancel func(), err error)
+	// ResetCrossSigning creates a new cross-signing identity for this user, replacing any existing one, and
+	// signs this device with it. Other clients SHOULD notice the new master key the next time they query
+	// this user's keys. If the server requires user-interactive auth to upload the new keys, authCallback
+	// is called to get the user's password. Clients MAY call authCallback even if auth is not required.
+	// Returns an error if the identity could not be reset.
+	ResetCrossSigning(t ct.TestLike, authCallback func() (password string)) error
+	// BootstrapCrossSigning sets up cross-signing for this user if this device does not already have the
+	// cross-signing private keys, uploading new master, self-signing and user-signing keys and signing this
+	// device with them. Unlike ResetCrossSigning, this does nothing if cross-signing is already set up on this
+	// device, so it is safe to call more than once. If the server requires user-interactive auth to upload the
+	// keys, authCallback is called to get the user's password. Returns an error if cross-signing could not be set up.
+	BootstrapCrossSigning(t ct.TestLike, authCallback func() (password string)) error
+	// SetGlobalOnlyTrustVerified controls whether this client only sends room keys to verified devices in every
+	// room. When enabled, clients MUST NOT share room keys for messages sent afterwards with devices which are
+	// not verified, and SHOULD send m.room_key.withheld with the code m.unverified to those devices instead.
+	// Room keys which have already been shared are not affected. Returns an error if the setting could not be changed.
+	SetGlobalOnlyTrustVerified(t ct.TestLike, enabled bool) error
+	// SetRoomOnlyTrustVerified is SetGlobalOnlyTrustVerified but only for the given room. The room setting overrides
+	// the global setting for that room. Returns an error if the setting could not be changed.
+	SetRoomOnlyTrustVerified(t ct.TestLike, roomID string, enabled bool) error
+	// BlacklistDevice marks the given device as blacklisted, regardless of whether it is verified. Clients MUST NOT
+	// share room keys for messages sent afterwards with blacklisted devices, and SHOULD send m.room_key.withheld
+	// with the code m.blacklisted to them instead. As the device may already have the current room key, clients
+	// SHOULD rotate the room key before sending another message. This client MUST already know about the device.
+	// Returns an error if the device could not be blacklisted.
+	BlacklistDevice(t ct.TestLike, userID, deviceID string) error
+	// Log something to stdout and the underlying client log file. Implementations MUST also pass
+	// the formatted line to logging.Write, so it is included in the log bundle if the test fails.
 	Logf(t ct.TestLike, format string, args ...interface{})
 	// The user for this client
 	UserID() string
@@ -96,16 +321,99 @@ type TestClient interface {
 	Client
 	// MustStartSyncing is StartSyncing but fails the test on error.
 	MustStartSyncing(t ct.TestLike) (stopSyncing func())
+	// MustClearCacheAndRestart is ClearCacheAndRestart but fails the test on error.
+	MustClearCacheAndRestart(t ct.TestLike)
+	// MustRestart is Restart but fails the test on error.
+	MustRestart(t ct.TestLike)
+	// MustKill is Kill but fails the test on error.
+	MustKill(t ct.TestLike)
+	// MustRestoreFromStorage is RestoreFromStorage but fails the test on error.
+	MustRestoreFromStorage(t ct.TestLike)
+	// MustSetStorePassphrase is SetStorePassphrase but fails the test on error.
+	MustSetStorePassphrase(t ct.TestLike, passphrase string)
 	// MustLoadBackup is LoadBackup but fails the test on error.
 	MustLoadBackup(t ct.TestLike, recoveryKey string)
+	// MustExportRoomKeys is ExportRoomKeys but fails the test on error.
+	MustExportRoomKeys(t ct.TestLike, passphrase string) []byte
+	// MustImportRoomKeys is ImportRoomKeys but fails the test on error.
+	MustImportRoomKeys(t ct.TestLike, export []byte, passphrase string)
+	// MustStoreSecret is StoreSecret but fails the test on error.
+	MustStoreSecret(t ct.TestLike, name, value string)
+	// MustGetSecret is GetSecret but fails the test on error.
+	MustGetSecret(t ct.TestLike, name string) (value string)
+	// WaitUntilBackupState returns a Waiter which waits until the key backup enters the given state. The
+	// client starts listening when this is called, so create the waiter before changing the backup state
+	// e.g before calling BackupKeys. The Waiter fails if the client cannot report its backup state.
+	WaitUntilBackupState(t ct.TestLike, want BackupState) Waiter
+	// WaitUntilDeviceList returns a Waiter which polls GetDeviceIDs for the given user until checker returns
+	// true e.g CheckDeviceListExcludes. The Waiter fails if the client cannot return its device list.
+	WaitUntilDeviceList(t ct.TestLike, userID string, checker func(deviceIDs []string) bool) Waiter
+	// MustCreateDehydratedDevice is CreateDehydratedDevice but fails the test on error.
+	MustCreateDehydratedDevice(t ct.TestLike)
+	// MustRehydrateDevice is RehydrateDevice but fails the test on error.
+	MustRehydrateDevice(t ct.TestLike, recoveryKey string)
+	// MustRequestRoomKey is RequestRoomKey but fails the test on error.
+	MustRequestRoomKey(t ct.TestLike, roomID, sessionID string)
 	// MustSendMessage is SendMessage but fails the test on error.
 	MustSendMessage(t ct.TestLike, roomID, text string) (eventID string)
+	// MustSendThreadedMessage is SendThreadedMessage but fails the test on error.
+	MustSendThreadedMessage(t ct.TestLike, roomID, threadRootID, text string) (eventID string)
+	// MustSendEncryptedFile is SendEncryptedFile but fails the test on error.
+	MustSendEncryptedFile(t ct.TestLike, roomID, filename string, contents []byte) (eventID string)
+	// MustRedactEvent is RedactEvent but fails the test on error.
+	MustRedactEvent(t ct.TestLike, roomID, eventID, reason string)
+	// MustReact is React but fails the test on error.
+	MustReact(t ct.TestLike, roomID, eventID, key string)
+	// MustEditMessage is EditMessage but fails the test on error.
+	MustEditMessage(t ct.TestLike, roomID, eventID, newBody string)
+	// MustSetRoomTopic is SetRoomTopic but fails the test on error.
+	MustSetRoomTopic(t ct.TestLike, roomID, topic string) (eventID string)
+	// MustGetOutboundSessionID is GetOutboundSessionID but fails the test on error.
+	MustGetOutboundSessionID(t ct.TestLike, roomID, eventID string) (sessionID string)
+	// MustGetOutboundSessionInfo is GetOutboundSessionInfo but fails the test on error.
+	MustGetOutboundSessionInfo(t ct.TestLike, roomID string) *OutboundSessionInfo
 	// MustGetEvent is GetEvent but fails the test on error.
 	MustGetEvent(t ct.TestLike, roomID, eventID string) *Event
+	// MustRemainUndecryptable fails the test if the given event, which must currently be undecryptable, is
+	// decrypted within the duration d. Fails as soon as the event is decrypted, else blocks for d. Use this
+	// instead of sleeping then calling MustGetEvent.
+	MustRemainUndecryptable(t ct.TestLike, roomID, eventID string, d time.Duration)
+	// WaitUntilDecryptionRetried returns a Waiter which waits until the given event, which must currently be
+	// undecryptable, is decrypted e.g after room keys arrive late and the client retries decryption. Unlike
+	// waiting for CheckEventIsDecrypted, this fails the test if the event was never undecryptable, and fails the
+	// Waiter unless timeline listeners are told about the decrypted event and GetEvent returns it decrypted.
+	WaitUntilDecryptionRetried(t ct.TestLike, roomID, eventID string) Waiter
+	// MustJoinRoom is JoinRoom but fails the test on error.
+	MustJoinRoom(t ct.TestLike, roomID string, serverNames []string)
+	// MustFollowTombstone is FollowTombstone but fails the test on error.
+	MustFollowTombstone(t ct.TestLike, roomID string, serverNames []string) (newRoomID string)
+	// MustIgnoreUser is IgnoreUser but fails the test on error.
+	MustIgnoreUser(t ct.TestLike, userID string)
+	// MustUnignoreUser is UnignoreUser but fails the test on error.
+	MustUnignoreUser(t ct.TestLike, userID string)
+	// MustGetTimeline is GetTimeline but fails the test on error.
+	MustGetTimeline(t ct.TestLike, roomID string) []*Event
 	// MustBackupKeys is BackupKeys but fails the test on error.
 	MustBackupKeys(t ct.TestLike) (recoveryKey string)
 	// MustBackpaginate is Backpaginate but fails the test on error.
-	MustBackpaginate(t ct.TestLike, roomID string, count int)
+	MustBackpaginate(t ct.TestLike, roomID string, count int) []*Event
+	// MustGetDeviceTrust is GetDeviceTrust but fails the test on error.
+	MustGetDeviceTrust(t ct.TestLike, userID, deviceID string) TrustLevel
+	// MustResetCrossSigning is ResetCrossSigning but fails the test on error.
+	MustResetCrossSigning(t ct.TestLike, authCallback func() (password string))
+	// MustSetDeviceDisplayName is SetDeviceDisplayName but fails the test on error.
+	MustSetDeviceDisplayName(t ct.TestLike, name string)
+	// MustBootstrapCrossSigning is BootstrapCrossSigning but fails the test on error.
+	MustBootstrapCrossSigning(t ct.TestLike, authCallback func() (password string))
+	// MustSetGlobalOnlyTrustVerified is SetGlobalOnlyTrustVerified but fails the test on error.
+	MustSetGlobalOnlyTrustVerified(t ct.TestLike, enabled bool)
+	// MustSetRoomOnlyTrustVerified is SetRoomOnlyTrustVerified but fails the test on error.
+	MustSetRoomOnlyTrustVerified(t ct.TestLike, roomID string, enabled bool)
+	// MustRequestUserVerification is RequestUserVerification but fails the test on error.
+	MustRequestUserVerification(t ct.TestLike, userID, roomID string) chan VerificationStage
+	// LogMarker logs a prominent line to make it easier to find where something happened in the logs,
+	// e.g LogMarker(t, "about to logout").
+	LogMarker(t ct.TestLike, marker string)
 }
 
 // NewTestClient wraps a Client implementation with helper functions which tests can use.
@@ -128,6 +436,46 @@ func (c *testClientImpl) MustStartSyncing(t ct.TestLike) (stopSyncing func()) {
 	return stopSyncing
 }
 
+func (c *testClientImpl) MustClearCacheAndRestart(t ct.TestLike) {
+	t.Helper()
+	err := c.ClearCacheAndRestart(t)
+	if err != nil {
+		ct.Fatalf(t, "MustClearCacheAndRestart: %s", err)
+	}
+}
+
+func (c *testClientImpl) MustRestart(t ct.TestLike) {
+	t.Helper()
+	err := c.Restart(t)
+	if err != nil {
+		ct.Fatalf(t, "MustRestart: %s", err)
+	}
+}
+
+func (c *testClientImpl) MustKill(t ct.TestLike) {
+	t.Helper()
+	err := c.Kill(t)
+	if err != nil {
+		ct.Fatalf(t, "MustKill: %s", err)
+	}
+}
+
+func (c *testClientImpl) MustRestoreFromStorage(t ct.TestLike) {
+	t.Helper()
+	err := c.RestoreFromStorage(t)
+	if err != nil {
+		ct.Fatalf(t, "MustRestoreFromStorage: %s", err)
+	}
+}
+
+func (c *testClientImpl) MustSetStorePassphrase(t ct.TestLike, passphrase string) {
+	t.Helper()
+	err := c.SetStorePassphrase(t, passphrase)
+	if err != nil {
+		ct.Fatalf(t, "MustSetStorePassphrase: %s", err)
+	}
+}
+
 func (c *testClientImpl) MustLoadBackup(t ct.TestLike, recoveryKey string) {
 	t.Helper()
 	err := c.LoadBackup(t, recoveryKey)
@@ -136,6 +484,73 @@ func (c *testClientImpl) MustLoadBackup(t ct.TestLike, recoveryKey string) {
 	}
 }
 
+func (c *testClientImpl) MustExportRoomKeys(t ct.TestLike, passphrase string) []byte {
+	t.Helper()
+	export, err := c.ExportRoomKeys(t, passphrase)
+	if err != nil {
+		ct.Fatalf(t, "MustExportRoomKeys: %s", err)
+	}
+	return export
+}
+
+func (c *testClientImpl) MustImportRoomKeys(t ct.TestLike, export []byte, passphrase string) {
+	t.Helper()
+	err := c.ImportRoomKeys(t, export, passphrase)
+	if err != nil {
+		ct.Fatalf(t, "MustImportRoomKeys: %s", err)
+	}
+}
+
+func (c *testClientImpl) MustStoreSecret(t ct.TestLike, name, value string) {
+	t.Helper()
+	err := c.StoreSecret(t, name, value)
+	if err != nil {
+		ct.Fatalf(t, "MustStoreSecret: %s", err)
+	}
+}
+
+func (c *testClientImpl) MustGetSecret(t ct.TestLike, name string) (value string) {
+	t.Helper()
+	value, err := c.GetSecret(t, name)
+	if err != nil {
+		ct.Fatalf(t, "MustGetSecret: %s", err)
+	}
+	return value
+}
+
+func (c *testClientImpl) WaitUntilBackupState(t ct.TestLike, want BackupState) Waiter {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := c.ListenForBackupStates(t, ctx)
+	if err != nil {
+		cancel()
+	}
+	return ObserveWaiter(&backupStateWaiter{
+		want:   want,
+		ch:     ch,
+		cancel: cancel,
+		err:    err,
+	})
+}
+
+func (c *testClientImpl) WaitUntilDeviceList(t ct.TestLike, userID string, checker func(deviceIDs []string) bool) Waiter {
+	return ObserveWaiter(&deviceListWaiter{
+		client:  c.Client,
+		userID:  userID,
+		checker: checker,
+	})
+}
+
+func (c *testClientImpl) WaitUntilEventInRoom(t ct.TestLike, roomID string, checker func(e Event) bool) Waiter {
+	t.Helper()
+	return ObserveWaiter(c.Client.WaitUntilEventInRoom(t, roomID, checker))
+}
+
+func (c *testClientImpl) WaitUntilEventInRoomWithOpts(t ct.TestLike, roomID string, opts TimelineListenerOpts, checker func(e Event) bool) Waiter {
+	t.Helper()
+	return ObserveWaiter(c.Client.WaitUntilEventInRoomWithOpts(t, roomID, opts, checker))
+}
+
 func (c *testClientImpl) MustBackupKeys(t ct.TestLike) (recoveryKey string) {
 	t.Helper()
 	recoveryKey, err := c.BackupKeys(t)
@@ -145,12 +560,37 @@ func (c *testClientImpl) MustBackupKeys(t ct.TestLike) (recoveryKey string) {
 	return recoveryKey
 }
 
-func (c *testClientImpl) MustBackpaginate(t ct.TestLike, roomID string, count int) {
+func (c *testClientImpl) MustBackpaginate(t ct.TestLike, roomID string, count int) []*Event {
 	t.Helper()
-	err := c.Backpaginate(t, roomID, count)
+	timeline, err := c.Backpaginate(t, roomID, count)
 	if err != nil {
 		ct.Fatalf(t, "MustBackpaginate: %s", err)
 	}
+	return timeline
+}
+
+func (c *testClientImpl) MustCreateDehydratedDevice(t ct.TestLike) {
+	t.Helper()
+	err := c.CreateDehydratedDevice(t)
+	if err != nil {
+		ct.Fatalf(t, "MustCreateDehydratedDevice: %s", err)
+	}
+}
+
+func (c *testClientImpl) MustRehydrateDevice(t ct.TestLike, recoveryKey string) {
+	t.Helper()
+	err := c.RehydrateDevice(t, recoveryKey)
+	if err != nil {
+		ct.Fatalf(t, "MustRehydrateDevice: %s", err)
+	}
+}
+
+func (c *testClientImpl) MustRequestRoomKey(t ct.TestLike, roomID, sessionID string) {
+	t.Helper()
+	err := c.RequestRoomKey(t, roomID, sessionID)
+	if err != nil {
+		ct.Fatalf(t, "MustRequestRoomKey: %s", err)
+	}
 }
 
 func (c *testClientImpl) MustSendMessage(t ct.TestLike, roomID, text string) (eventID string) {
@@ -162,6 +602,75 @@ func (c *testClientImpl) MustSendMessage(t ct.TestLike, roomID, text string) (ev
 	return eventID
 }
 
+func (c *testClientImpl) MustSendThreadedMessage(t ct.TestLike, roomID, threadRootID, text string) (eventID string) {
+	t.Helper()
+	eventID, err := c.SendThreadedMessage(t, roomID, threadRootID, text)
+	if err != nil {
+		ct.Fatalf(t, "MustSendThreadedMessage: %s", err)
+	}
+	return eventID
+}
+
+func (c *testClientImpl) MustSendEncryptedFile(t ct.TestLike, roomID, filename string, contents []byte) (eventID string) {
+	t.Helper()
+	eventID, err := c.SendEncryptedFile(t, roomID, filename, contents)
+	if err != nil {
+		ct.Fatalf(t, "MustSendEncryptedFile: %s", err)
+	}
+	return eventID
+}
+
+func (c *testClientImpl) MustRedactEvent(t ct.TestLike, roomID, eventID, reason string) {
+	t.Helper()
+	err := c.RedactEvent(t, roomID, eventID, reason)
+	if err != nil {
+		ct.Fatalf(t, "MustRedactEvent: %s", err)
+	}
+}
+
+func (c *testClientImpl) MustReact(t ct.TestLike, roomID, eventID, key string) {
+	t.Helper()
+	err := c.React(t, roomID, eventID, key)
+	if err != nil {
+		ct.Fatalf(t, "MustReact: %s", err)
+	}
+}
+
+func (c *testClientImpl) MustEditMessage(t ct.TestLike, roomID, eventID, newBody string) {
+	t.Helper()
+	err := c.EditMessage(t, roomID, eventID, newBody)
+	if err != nil {
+		ct.Fatalf(t, "MustEditMessage: %s", err)
+	}
+}
+
+func (c *testClientImpl) MustSetRoomTopic(t ct.TestLike, roomID, topic string) (eventID string) {
+	t.Helper()
+	eventID, err := c.SetRoomTopic(t, roomID, topic)
+	if err != nil {
+		ct.Fatalf(t, "MustSetRoomTopic: %s", err)
+	}
+	return eventID
+}
+
+func (c *testClientImpl) MustGetOutboundSessionID(t ct.TestLike, roomID, eventID string) (sessionID string) {
+	t.Helper()
+	sessionID, err := c.GetOutboundSessionID(t, roomID, eventID)
+	if err != nil {
+		ct.Fatalf(t, "MustGetOutboundSessionID: %s", err)
+	}
+	return sessionID
+}
+
+func (c *testClientImpl) MustGetOutboundSessionInfo(t ct.TestLike, roomID string) *OutboundSessionInfo {
+	t.Helper()
+	info, err := c.GetOutboundSessionInfo(t, roomID)
+	if err != nil {
+		ct.Fatalf(t, "MustGetOutboundSessionInfo: %s", err)
+	}
+	return info
+}
+
 func (c *testClientImpl) MustGetEvent(t ct.TestLike, roomID, eventID string) *Event {
 	t.Helper()
 	ev, err := c.GetEvent(t, roomID, eventID)
@@ -171,6 +680,139 @@ func (c *testClientImpl) MustGetEvent(t ct.TestLike, roomID, eventID string) *Ev
 	return ev
 }
 
+func (c *testClientImpl) MustRemainUndecryptable(t ct.TestLike, roomID, eventID string, d time.Duration) {
+	t.Helper()
+	ev := c.MustGetEvent(t, roomID, eventID)
+	if !ev.FailedToDecrypt {
+		ct.Fatalf(t, "MustRemainUndecryptable: event %s is already decrypted", eventID)
+	}
+	// the waiter checks the current timeline as well as timeline updates, so this catches the event
+	// being decrypted since we called MustGetEvent.
+	err := c.WaitUntilEventInRoom(t, roomID, CheckEventIsDecrypted(eventID)).TryWaitf(t, d, "event %s was not decrypted", eventID)
+	if err == nil {
+		ct.Fatalf(t, "MustRemainUndecryptable: event %s was decrypted within %v", eventID, d)
+	}
+}
+
+func (c *testClientImpl) WaitUntilDecryptionRetried(t ct.TestLike, roomID, eventID string) Waiter {
+	t.Helper()
+	ev := c.MustGetEvent(t, roomID, eventID)
+	if !ev.FailedToDecrypt {
+		ct.Fatalf(t, "WaitUntilDecryptionRetried: event %s is already decrypted", eventID)
+	}
+	return ObserveWaiter(&decryptionRetryWaiter{
+		client:  c.Client,
+		roomID:  roomID,
+		eventID: eventID,
+		reason:  ev.DecryptionFailureReason,
+	})
+}
+
+func (c *testClientImpl) MustJoinRoom(t ct.TestLike, roomID string, serverNames []string) {
+	t.Helper()
+	err := c.JoinRoom(t, roomID, serverNames)
+	if err != nil {
+		ct.Fatalf(t, "MustJoinRoom: %s", err)
+	}
+}
+
+func (c *testClientImpl) MustFollowTombstone(t ct.TestLike, roomID string, serverNames []string) (newRoomID string) {
+	t.Helper()
+	newRoomID, err := c.FollowTombstone(t, roomID, serverNames)
+	if err != nil {
+		ct.Fatalf(t, "MustFollowTombstone: %s", err)
+	}
+	return newRoomID
+}
+
+func (c *testClientImpl) MustIgnoreUser(t ct.TestLike, userID string) {
+	t.Helper()
+	err := c.IgnoreUser(t, userID)
+	if err != nil {
+		ct.Fatalf(t, "MustIgnoreUser: %s", err)
+	}
+}
+
+func (c *testClientImpl) MustUnignoreUser(t ct.TestLike, userID string) {
+	t.Helper()
+	err := c.UnignoreUser(t, userID)
+	if err != nil {
+		ct.Fatalf(t, "MustUnignoreUser: %s", err)
+	}
+}
+
+func (c *testClientImpl) MustGetTimeline(t ct.TestLike, roomID string) []*Event {
+	t.Helper()
+	events, err := c.GetTimeline(t, roomID)
+	if err != nil {
+		ct.Fatalf(t, "MustGetTimeline: %s", err)
+	}
+	return events
+}
+
+func (c *testClientImpl) MustGetDeviceTrust(t ct.TestLike, userID, deviceID string) TrustLevel {
+	t.Helper()
+	trust, err := c.GetDeviceTrust(t, userID, deviceID)
+	if err != nil {
+		ct.Fatalf(t, "MustGetDeviceTrust: %s", err)
+	}
+	return trust
+}
+
+func (c *testClientImpl) MustResetCrossSigning(t ct.TestLike, authCallback func() (password string)) {
+	t.Helper()
+	err := c.ResetCrossSigning(t, authCallback)
+	if err != nil {
+		ct.Fatalf(t, "MustResetCrossSigning: %s", err)
+	}
+}
+
+func (c *testClientImpl) MustBootstrapCrossSigning(t ct.TestLike, authCallback func() (password string)) {
+	t.Helper()
+	err := c.BootstrapCrossSigning(t, authCallback)
+	if err != nil {
+		ct.Fatalf(t, "MustBootstrapCrossSigning: %s", err)
+	}
+}
+
+func (c *testClientImpl) MustSetDeviceDisplayName(t ct.TestLike, name string) {
+	t.Helper()
+	err := c.SetDeviceDisplayName(t, name)
+	if err != nil {
+		ct.Fatalf(t, "MustSetDeviceDisplayName: %s", err)
+	}
+}
+
+func (c *testClientImpl) MustSetGlobalOnlyTrustVerified(t ct.TestLike, enabled bool) {
+	t.Helper()
+	err := c.SetGlobalOnlyTrustVerified(t, enabled)
+	if err != nil {
+		ct.Fatalf(t, "MustSetGlobalOnlyTrustVerified: %s", err)
+	}
+}
+
+func (c *testClientImpl) MustSetRoomOnlyTrustVerified(t ct.TestLike, roomID string, enabled bool) {
+	t.Helper()
+	err := c.SetRoomOnlyTrustVerified(t, roomID, enabled)
+	if err != nil {
+		ct.Fatalf(t, "MustSetRoomOnlyTrustVerified: %s", err)
+	}
+}
+
+func (c *testClientImpl) MustRequestUserVerification(t ct.TestLike, userID, roomID string) chan VerificationStage {
+	t.Helper()
+	ch, err := c.RequestUserVerification(t, userID, roomID)
+	if err != nil {
+		ct.Fatalf(t, "MustRequestUserVerification: %s", err)
+	}
+	return ch
+}
+
+func (c *testClientImpl) LogMarker(t ct.TestLike, marker string) {
+	t.Helper()
+	c.Logf(t, "========== %s ==========", marker)
+}
+
 type LoggedClient struct {
 	Client
 }
@@ -206,6 +848,38 @@ func (c *LoggedClient) GetEvent(t ct.TestLike, roomID, eventID string) (*Event,
 	return c.Client.GetEvent(t, roomID, eventID)
 }
 
+func (c *LoggedClient) GetTimeline(t ct.TestLike, roomID string) ([]*Event, error) {
+	t.Helper()
+	c.Logf(t, "%s GetTimeline(%s)", c.logPrefix(), roomID)
+	events, err := c.Client.GetTimeline(t, roomID)
+	c.Logf(t, "%s GetTimeline(%s) => %d events %v", c.logPrefix(), roomID, len(events), err)
+	return events, err
+}
+
+func (c *LoggedClient) GetThread(t ct.TestLike, roomID, threadRootID string) ([]*Event, error) {
+	t.Helper()
+	c.Logf(t, "%s GetThread(%s, %s)", c.logPrefix(), roomID, threadRootID)
+	events, err := c.Client.GetThread(t, roomID, threadRootID)
+	c.Logf(t, "%s GetThread(%s, %s) => %d events %v", c.logPrefix(), roomID, threadRootID, len(events), err)
+	return events, err
+}
+
+func (c *LoggedClient) MarkAsRead(t ct.TestLike, roomID string) error {
+	t.Helper()
+	c.Logf(t, "%s MarkAsRead %s", c.logPrefix(), roomID)
+	err := c.Client.MarkAsRead(t, roomID)
+	c.Logf(t, "%s MarkAsRead %s => %v", c.logPrefix(), roomID, err)
+	return err
+}
+
+func (c *LoggedClient) GetReadReceipt(t ct.TestLike, roomID, userID string) (eventID string, err error) {
+	t.Helper()
+	c.Logf(t, "%s GetReadReceipt %s %s", c.logPrefix(), roomID, userID)
+	eventID, err = c.Client.GetReadReceipt(t, roomID, userID)
+	c.Logf(t, "%s GetReadReceipt %s %s => %s %v", c.logPrefix(), roomID, userID, eventID, err)
+	return eventID, err
+}
+
 func (c *LoggedClient) StartSyncing(t ct.TestLike) (stopSyncing func(), err error) {
 	t.Helper()
 	c.Logf(t, "%s StartSyncing starting to sync", c.logPrefix())
@@ -214,12 +888,80 @@ func (c *LoggedClient) StartSyncing(t ct.TestLike) (stopSyncing func(), err erro
 	return
 }
 
+func (c *LoggedClient) ListenForSyncStates(t ct.TestLike, callback func(s SyncState)) (cancel func(), err error) {
+	t.Helper()
+	c.Logf(t, "%s ListenForSyncStates", c.logPrefix())
+	return c.Client.ListenForSyncStates(t, callback)
+}
+
+func (c *LoggedClient) ListenForBackupStates(t ct.TestLike, ctx context.Context) (<-chan BackupState, error) {
+	t.Helper()
+	c.Logf(t, "%s ListenForBackupStates", c.logPrefix())
+	return c.Client.ListenForBackupStates(t, ctx)
+}
+
+func (c *LoggedClient) ClearCacheAndRestart(t ct.TestLike) error {
+	t.Helper()
+	c.Logf(t, "%s ClearCacheAndRestart", c.logPrefix())
+	err := c.Client.ClearCacheAndRestart(t)
+	c.Logf(t, "%s ClearCacheAndRestart => %v", c.logPrefix(), err)
+	return err
+}
+
+func (c *LoggedClient) Restart(t ct.TestLike) error {
+	t.Helper()
+	c.Logf(t, "%s Restart", c.logPrefix())
+	err := c.Client.Restart(t)
+	c.Logf(t, "%s Restart => %v", c.logPrefix(), err)
+	return err
+}
+
+func (c *LoggedClient) Kill(t ct.TestLike) error {
+	t.Helper()
+	c.Logf(t, "%s Kill", c.logPrefix())
+	err := c.Client.Kill(t)
+	c.Logf(t, "%s Kill => %v", c.logPrefix(), err)
+	return err
+}
+
+func (c *LoggedClient) RestoreFromStorage(t ct.TestLike) error {
+	t.Helper()
+	c.Logf(t, "%s RestoreFromStorage", c.logPrefix())
+	err := c.Client.RestoreFromStorage(t)
+	c.Logf(t, "%s RestoreFromStorage => %v", c.logPrefix(), err)
+	return err
+}
+
+func (c *LoggedClient) SetStorePassphrase(t ct.TestLike, passphrase string) error {
+	t.Helper()
+	c.Logf(t, "%s SetStorePassphrase passphrase=%s", c.logPrefix(), passphrase)
+	err := c.Client.SetStorePassphrase(t, passphrase)
+	c.Logf(t, "%s SetStorePassphrase => %v", c.logPrefix(), err)
+	return err
+}
+
 func (c *LoggedClient) IsRoomEncrypted(t ct.TestLike, roomID string) (bool, error) {
 	t.Helper()
 	c.Logf(t, "%s IsRoomEncrypted %s", c.logPrefix(), roomID)
 	return c.Client.IsRoomEncrypted(t, roomID)
 }
 
+func (c *LoggedClient) GetEncryptionAlgorithm(t ct.TestLike, roomID string) (string, error) {
+	t.Helper()
+	c.Logf(t, "%s GetEncryptionAlgorithm %s", c.logPrefix(), roomID)
+	algorithm, err := c.Client.GetEncryptionAlgorithm(t, roomID)
+	c.Logf(t, "%s GetEncryptionAlgorithm %s => %s %v", c.logPrefix(), roomID, algorithm, err)
+	return algorithm, err
+}
+
+func (c *LoggedClient) IsDirect(t ct.TestLike, roomID string) (bool, error) {
+	t.Helper()
+	c.Logf(t, "%s IsDirect %s", c.logPrefix(), roomID)
+	isDirect, err := c.Client.IsDirect(t, roomID)
+	c.Logf(t, "%s IsDirect %s => %v %v", c.logPrefix(), roomID, isDirect, err)
+	return isDirect, err
+}
+
 func (c *LoggedClient) SendMessage(t ct.TestLike, roomID, text string) (eventID string, err error) {
 	t.Helper()
 	c.Logf(t, "%s SendMessage %s => %s", c.logPrefix(), roomID, text)
@@ -228,18 +970,124 @@ func (c *LoggedClient) SendMessage(t ct.TestLike, roomID, text string) (eventID
 	return
 }
 
+func (c *LoggedClient) SendThreadedMessage(t ct.TestLike, roomID, threadRootID, text string) (eventID string, err error) {
+	t.Helper()
+	c.Logf(t, "%s SendThreadedMessage %s in thread %s => %s", c.logPrefix(), roomID, threadRootID, text)
+	eventID, err = c.Client.SendThreadedMessage(t, roomID, threadRootID, text)
+	c.Logf(t, "%s SendThreadedMessage %s in thread %s => %s %s", c.logPrefix(), roomID, threadRootID, eventID, err)
+	return
+}
+
+func (c *LoggedClient) SendEncryptedFile(t ct.TestLike, roomID, filename string, contents []byte) (eventID string, err error) {
+	t.Helper()
+	c.Logf(t, "%s SendEncryptedFile %s => %s (%d bytes)", c.logPrefix(), roomID, filename, len(contents))
+	eventID, err = c.Client.SendEncryptedFile(t, roomID, filename, contents)
+	c.Logf(t, "%s SendEncryptedFile %s => %s %s", c.logPrefix(), roomID, eventID, err)
+	return
+}
+
+func (c *LoggedClient) RedactEvent(t ct.TestLike, roomID, eventID, reason string) error {
+	t.Helper()
+	c.Logf(t, "%s RedactEvent %s %s reason=%q", c.logPrefix(), roomID, eventID, reason)
+	err := c.Client.RedactEvent(t, roomID, eventID, reason)
+	c.Logf(t, "%s RedactEvent %s %s => %v", c.logPrefix(), roomID, eventID, err)
+	return err
+}
+
+func (c *LoggedClient) React(t ct.TestLike, roomID, eventID, key string) error {
+	t.Helper()
+	c.Logf(t, "%s React %s %s key=%q", c.logPrefix(), roomID, eventID, key)
+	err := c.Client.React(t, roomID, eventID, key)
+	c.Logf(t, "%s React %s %s => %v", c.logPrefix(), roomID, eventID, err)
+	return err
+}
+
+func (c *LoggedClient) EditMessage(t ct.TestLike, roomID, eventID, newBody string) error {
+	t.Helper()
+	c.Logf(t, "%s EditMessage %s %s body=%q", c.logPrefix(), roomID, eventID, newBody)
+	err := c.Client.EditMessage(t, roomID, eventID, newBody)
+	c.Logf(t, "%s EditMessage %s %s => %v", c.logPrefix(), roomID, eventID, err)
+	return err
+}
+
+func (c *LoggedClient) SetRoomTopic(t ct.TestLike, roomID, topic string) (eventID string, err error) {
+	t.Helper()
+	c.Logf(t, "%s SetRoomTopic %s topic=%q", c.logPrefix(), roomID, topic)
+	eventID, err = c.Client.SetRoomTopic(t, roomID, topic)
+	c.Logf(t, "%s SetRoomTopic %s => %s %v", c.logPrefix(), roomID, eventID, err)
+	return
+}
+
+func (c *LoggedClient) GetOutboundSessionID(t ct.TestLike, roomID, eventID string) (sessionID string, err error) {
+	t.Helper()
+	c.Logf(t, "%s GetOutboundSessionID %s %s", c.logPrefix(), roomID, eventID)
+	sessionID, err = c.Client.GetOutboundSessionID(t, roomID, eventID)
+	c.Logf(t, "%s GetOutboundSessionID %s %s => %s %v", c.logPrefix(), roomID, eventID, sessionID, err)
+	return
+}
+
+func (c *LoggedClient) GetOutboundSessionInfo(t ct.TestLike, roomID string) (*OutboundSessionInfo, error) {
+	t.Helper()
+	c.Logf(t, "%s GetOutboundSessionInfo %s", c.logPrefix(), roomID)
+	info, err := c.Client.GetOutboundSessionInfo(t, roomID)
+	if info != nil {
+		c.Logf(t, "%s GetOutboundSessionInfo %s => %s index=%d created=%v %v", c.logPrefix(), roomID, info.SessionID, info.MessageIndex, info.CreationTime, err)
+	} else {
+		c.Logf(t, "%s GetOutboundSessionInfo %s => nil %v", c.logPrefix(), roomID, err)
+	}
+	return info, err
+}
+
+func (c *LoggedClient) JoinRoom(t ct.TestLike, roomID string, serverNames []string) error {
+	t.Helper()
+	c.Logf(t, "%s JoinRoom %s via %v", c.logPrefix(), roomID, serverNames)
+	err := c.Client.JoinRoom(t, roomID, serverNames)
+	c.Logf(t, "%s JoinRoom %s => %v", c.logPrefix(), roomID, err)
+	return err
+}
+
+func (c *LoggedClient) FollowTombstone(t ct.TestLike, roomID string, serverNames []string) (newRoomID string, err error) {
+	t.Helper()
+	c.Logf(t, "%s FollowTombstone %s via %v", c.logPrefix(), roomID, serverNames)
+	newRoomID, err = c.Client.FollowTombstone(t, roomID, serverNames)
+	c.Logf(t, "%s FollowTombstone %s => %s %v", c.logPrefix(), roomID, newRoomID, err)
+	return
+}
+
+func (c *LoggedClient) IgnoreUser(t ct.TestLike, userID string) error {
+	t.Helper()
+	c.Logf(t, "%s IgnoreUser %s", c.logPrefix(), userID)
+	err := c.Client.IgnoreUser(t, userID)
+	c.Logf(t, "%s IgnoreUser %s => %v", c.logPrefix(), userID, err)
+	return err
+}
+
+func (c *LoggedClient) UnignoreUser(t ct.TestLike, userID string) error {
+	t.Helper()
+	c.Logf(t, "%s UnignoreUser %s", c.logPrefix(), userID)
+	err := c.Client.UnignoreUser(t, userID)
+	c.Logf(t, "%s UnignoreUser %s => %v", c.logPrefix(), userID, err)
+	return err
+}
+
 func (c *LoggedClient) WaitUntilEventInRoom(t ct.TestLike, roomID string, checker func(e Event) bool) Waiter {
 	t.Helper()
 	c.Logf(t, "%s WaitUntilEventInRoom %s", c.logPrefix(), roomID)
 	return c.Client.WaitUntilEventInRoom(t, roomID, checker)
 }
 
-func (c *LoggedClient) Backpaginate(t ct.TestLike, roomID string, count int) error {
+func (c *LoggedClient) WaitUntilEventInRoomWithOpts(t ct.TestLike, roomID string, opts TimelineListenerOpts, checker func(e Event) bool) Waiter {
+	t.Helper()
+	c.Logf(t, "%s WaitUntilEventInRoomWithOpts %s %+v", c.logPrefix(), roomID, opts)
+	return c.Client.WaitUntilEventInRoomWithOpts(t, roomID, opts, checker)
+}
+
+func (c *LoggedClient) Backpaginate(t ct.TestLike, roomID string, count int) ([]*Event, error) {
 	t.Helper()
 	c.Logf(t, "%s Backpaginate %d %s", c.logPrefix(), count, roomID)
-	err := c.Client.Backpaginate(t, roomID, count)
-	c.Logf(t, "%s Backpaginate %d %s => %s", c.logPrefix(), count, roomID, err)
-	return err
+	timeline, err := c.Client.Backpaginate(t, roomID, count)
+	c.Logf(t, "%s Backpaginate %d %s => %d events %v", c.logPrefix(), count, roomID, len(timeline), err)
+	return timeline, err
 }
 
 func (c *LoggedClient) BackupKeys(t ct.TestLike) (recoveryKey string, err error) {
@@ -256,19 +1104,219 @@ func (c *LoggedClient) LoadBackup(t ct.TestLike, recoveryKey string) error {
 	return c.Client.LoadBackup(t, recoveryKey)
 }
 
+func (c *LoggedClient) ExportRoomKeys(t ct.TestLike, passphrase string) ([]byte, error) {
+	t.Helper()
+	c.Logf(t, "%s ExportRoomKeys passphrase=%s", c.logPrefix(), passphrase)
+	export, err := c.Client.ExportRoomKeys(t, passphrase)
+	c.Logf(t, "%s ExportRoomKeys => %d bytes %v", c.logPrefix(), len(export), err)
+	return export, err
+}
+
+func (c *LoggedClient) ImportRoomKeys(t ct.TestLike, export []byte, passphrase string) error {
+	t.Helper()
+	c.Logf(t, "%s ImportRoomKeys %d bytes passphrase=%s", c.logPrefix(), len(export), passphrase)
+	err := c.Client.ImportRoomKeys(t, export, passphrase)
+	c.Logf(t, "%s ImportRoomKeys => %v", c.logPrefix(), err)
+	return err
+}
+
+func (c *LoggedClient) CreateSecretStorageKey(t ct.TestLike) (recoveryKey string, err error) {
+	t.Helper()
+	c.Logf(t, "%s CreateSecretStorageKey", c.logPrefix())
+	recoveryKey, err = c.Client.CreateSecretStorageKey(t)
+	c.Logf(t, "%s CreateSecretStorageKey => %s %v", c.logPrefix(), recoveryKey, err)
+	return recoveryKey, err
+}
+
+func (c *LoggedClient) UnlockSecretStorage(t ct.TestLike, recoveryKey string) error {
+	t.Helper()
+	c.Logf(t, "%s UnlockSecretStorage key=%s", c.logPrefix(), recoveryKey)
+	err := c.Client.UnlockSecretStorage(t, recoveryKey)
+	c.Logf(t, "%s UnlockSecretStorage => %v", c.logPrefix(), err)
+	return err
+}
+
+func (c *LoggedClient) StoreSecret(t ct.TestLike, name, value string) error {
+	t.Helper()
+	c.Logf(t, "%s StoreSecret %s", c.logPrefix(), name)
+	err := c.Client.StoreSecret(t, name, value)
+	c.Logf(t, "%s StoreSecret %s => %v", c.logPrefix(), name, err)
+	return err
+}
+
+func (c *LoggedClient) GetSecret(t ct.TestLike, name string) (value string, err error) {
+	t.Helper()
+	c.Logf(t, "%s GetSecret %s", c.logPrefix(), name)
+	value, err = c.Client.GetSecret(t, name)
+	c.Logf(t, "%s GetSecret %s => %v", c.logPrefix(), name, err)
+	return value, err
+}
+
+func (c *LoggedClient) CreateDehydratedDevice(t ct.TestLike) error {
+	t.Helper()
+	c.Logf(t, "%s CreateDehydratedDevice", c.logPrefix())
+	err := c.Client.CreateDehydratedDevice(t)
+	c.Logf(t, "%s CreateDehydratedDevice => %v", c.logPrefix(), err)
+	return err
+}
+
+func (c *LoggedClient) RehydrateDevice(t ct.TestLike, recoveryKey string) error {
+	t.Helper()
+	c.Logf(t, "%s RehydrateDevice key=%s", c.logPrefix(), recoveryKey)
+	err := c.Client.RehydrateDevice(t, recoveryKey)
+	c.Logf(t, "%s RehydrateDevice => %v", c.logPrefix(), err)
+	return err
+}
+
+func (c *LoggedClient) RequestRoomKey(t ct.TestLike, roomID, sessionID string) error {
+	t.Helper()
+	c.Logf(t, "%s RequestRoomKey %s session=%s", c.logPrefix(), roomID, sessionID)
+	err := c.Client.RequestRoomKey(t, roomID, sessionID)
+	c.Logf(t, "%s RequestRoomKey %s session=%s => %v", c.logPrefix(), roomID, sessionID, err)
+	return err
+}
+
+func (c *LoggedClient) CancelRoomKeyRequest(t ct.TestLike, roomID, sessionID string) error {
+	t.Helper()
+	c.Logf(t, "%s CancelRoomKeyRequest %s session=%s", c.logPrefix(), roomID, sessionID)
+	err := c.Client.CancelRoomKeyRequest(t, roomID, sessionID)
+	c.Logf(t, "%s CancelRoomKeyRequest %s session=%s => %v", c.logPrefix(), roomID, sessionID, err)
+	return err
+}
+
+func (c *LoggedClient) RetryDecryption(t ct.TestLike, roomID string, sessionIDs []string) error {
+	t.Helper()
+	c.Logf(t, "%s RetryDecryption %s sessions=%v", c.logPrefix(), roomID, sessionIDs)
+	err := c.Client.RetryDecryption(t, roomID, sessionIDs)
+	c.Logf(t, "%s RetryDecryption %s sessions=%v => %v", c.logPrefix(), roomID, sessionIDs, err)
+	return err
+}
+
+func (c *LoggedClient) FallbackKeyUsed(t ct.TestLike) (used bool, err error) {
+	t.Helper()
+	c.Logf(t, "%s FallbackKeyUsed", c.logPrefix())
+	used, err = c.Client.FallbackKeyUsed(t)
+	c.Logf(t, "%s FallbackKeyUsed => %v %v", c.logPrefix(), used, err)
+	return used, err
+}
+
 func (c *LoggedClient) DeletePersistentStorage(t ct.TestLike) {
 	t.Helper()
 	c.Logf(t, "%s DeletePersistentStorage", c.logPrefix())
 	c.Client.DeletePersistentStorage(t)
 }
 
+func (c *LoggedClient) PersistentStoragePath(t ct.TestLike) string {
+	t.Helper()
+	path := c.Client.PersistentStoragePath(t)
+	c.Logf(t, "%s PersistentStoragePath => %s", c.logPrefix(), path)
+	return path
+}
+
+func (c *LoggedClient) GetDeviceTrust(t ct.TestLike, userID, deviceID string) (TrustLevel, error) {
+	t.Helper()
+	c.Logf(t, "%s GetDeviceTrust %s %s", c.logPrefix(), userID, deviceID)
+	trust, err := c.Client.GetDeviceTrust(t, userID, deviceID)
+	c.Logf(t, "%s GetDeviceTrust %s %s => %s %v", c.logPrefix(), userID, deviceID, trust, err)
+	return trust, err
+}
+
+func (c *LoggedClient) GetDeviceIDs(t ct.TestLike, userID string) ([]string, error) {
+	t.Helper()
+	c.Logf(t, "%s GetDeviceIDs %s", c.logPrefix(), userID)
+	deviceIDs, err := c.Client.GetDeviceIDs(t, userID)
+	c.Logf(t, "%s GetDeviceIDs %s => %v %v", c.logPrefix(), userID, deviceIDs, err)
+	return deviceIDs, err
+}
+
+func (c *LoggedClient) SetDeviceDisplayName(t ct.TestLike, name string) error {
+	t.Helper()
+	c.Logf(t, "%s SetDeviceDisplayName %s", c.logPrefix(), name)
+	err := c.Client.SetDeviceDisplayName(t, name)
+	c.Logf(t, "%s SetDeviceDisplayName %s => %v", c.logPrefix(), name, err)
+	return err
+}
+
+func (c *LoggedClient) ListenForDeviceListChanges(t ct.TestLike, callback func(userIDs []string)) (cancel func(), err error) {
+	t.Helper()
+	c.Logf(t, "%s ListenForDeviceListChanges", c.logPrefix())
+	return c.Client.ListenForDeviceListChanges(t, func(userIDs []string) {
+		c.Logf(t, "%s ListenForDeviceListChanges => %v", c.logPrefix(), userIDs)
+		callback(userIDs)
+	})
+}
+
+func (c *LoggedClient) ResetCrossSigning(t ct.TestLike, authCallback func() (password string)) error {
+	t.Helper()
+	c.Logf(t, "%s ResetCrossSigning", c.logPrefix())
+	err := c.Client.ResetCrossSigning(t, authCallback)
+	c.Logf(t, "%s ResetCrossSigning => %v", c.logPrefix(), err)
+	return err
+}
+
+func (c *LoggedClient) BootstrapCrossSigning(t ct.TestLike, authCallback func() (password string)) error {
+	t.Helper()
+	c.Logf(t, "%s BootstrapCrossSigning", c.logPrefix())
+	err := c.Client.BootstrapCrossSigning(t, authCallback)
+	c.Logf(t, "%s BootstrapCrossSigning => %v", c.logPrefix(), err)
+	return err
+}
+
+func (c *LoggedClient) SetGlobalOnlyTrustVerified(t ct.TestLike, enabled bool) error {
+	t.Helper()
+	c.Logf(t, "%s SetGlobalOnlyTrustVerified %v", c.logPrefix(), enabled)
+	err := c.Client.SetGlobalOnlyTrustVerified(t, enabled)
+	c.Logf(t, "%s SetGlobalOnlyTrustVerified %v => %v", c.logPrefix(), enabled, err)
+	return err
+}
+
+func (c *LoggedClient) SetRoomOnlyTrustVerified(t ct.TestLike, roomID string, enabled bool) error {
+	t.Helper()
+	c.Logf(t, "%s SetRoomOnlyTrustVerified %s %v", c.logPrefix(), roomID, enabled)
+	err := c.Client.SetRoomOnlyTrustVerified(t, roomID, enabled)
+	c.Logf(t, "%s SetRoomOnlyTrustVerified %s %v => %v", c.logPrefix(), roomID, enabled, err)
+	return err
+}
+
+func (c *LoggedClient) BlacklistDevice(t ct.TestLike, userID, deviceID string) error {
+	t.Helper()
+	c.Logf(t, "%s BlacklistDevice %s %s", c.logPrefix(), userID, deviceID)
+	err := c.Client.BlacklistDevice(t, userID, deviceID)
+	c.Logf(t, "%s BlacklistDevice %s %s => %v", c.logPrefix(), userID, deviceID, err)
+	return err
+}
+
+func (c *LoggedClient) RequestUserVerification(t ct.TestLike, userID, roomID string) (chan VerificationStage, error) {
+	t.Helper()
+	c.Logf(t, "%s RequestUserVerification %s %s", c.logPrefix(), userID, roomID)
+	ch, err := c.Client.RequestUserVerification(t, userID, roomID)
+	c.Logf(t, "%s RequestUserVerification %s %s => %v", c.logPrefix(), userID, roomID, err)
+	return ch, err
+}
+
 func (c *LoggedClient) logPrefix() string {
 	return fmt.Sprintf("[%s](%s)", c.UserID(), c.Type())
 }
 
+// TrustLevel is how much a client trusts a device.
+type TrustLevel string
+
+const (
+	// The client does not know about this device, e.g because it has not downloaded the device keys.
+	TrustLevelUnknown TrustLevel = "unknown"
+	// The client knows about this device, but it has not been verified.
+	TrustLevelUnverified TrustLevel = "unverified"
+	// The device is verified, either via cross-signing or because it was verified directly.
+	TrustLevelVerified TrustLevel = "verified"
+)
+
 type Notification struct {
 	Event
+	// True if the push rules which matched the event set the highlight tweak e.g a mention or a keyword rule.
+	// Clients MUST evaluate push rules against the decrypted event. Nil if the client does not expose this.
 	HasMentions *bool
+	// True if the push rules which matched the event set the sound tweak. Nil if the client does not expose this.
+	IsNoisy *bool
 }
 
 // ClientCreationOpts are options to use when creating crypto clients.
@@ -283,7 +1331,8 @@ type ClientCreationOpts struct {
 	// Required. The password for this account.
 	Password string
 
-	// Required for rust clients. The URL of the sliding sync proxy.
+	// Rust only. If set, the client syncs via the sliding sync proxy at this URL instead of using native
+	// sliding sync (MSC4186) on the homeserver. See Instance.SlidingSyncModeMatrix.
 	SlidingSyncURL string
 	// Optional. Set this to login with this device ID.
 	DeviceID string
@@ -291,16 +1340,111 @@ type ClientCreationOpts struct {
 	// A hint to the client implementation that persistent storage is required. Clients may ignore
 	// this flag and always use persistence.
 	PersistentStorage bool
+	// If set, the client encrypts its persistent store with this passphrase e.g the pickle key for the olm
+	// account. Clients MUST return an error if an existing store was encrypted with a different passphrase,
+	// rather than resetting it. If unset, the client's default is used, which may be no encryption.
+	StorePassphrase string
 
 	// A map containing any client-specific creation options, for use for client-specific tests.
 	// Any options in this map MUST BE SERIALISABLE as they may be sent over RPC boundaries.
 	ExtraOpts map[string]any
 
-	// Rust only. If set with EnableCrossProcessRefreshLockProcessName=ProcessNameNSE, the client will be seeded
-	// with a logged in session.
+	// Rust and JS only. If set, the client will be seeded with a logged in session for DeviceID instead of
+	// calling Login, using any existing persistent storage. For rust clients, this is required when
+	// EnableCrossProcessRefreshLockProcessName=ProcessNameNSE.
 	AccessToken string
+
+	// If true, the client will share historical room keys with users it invites, and accept historical
+	// room keys from the inviter when it joins a room, as per MSC3061 / MSC4268. This allows users to
+	// decrypt messages sent before they joined when the room has `shared` history visibility.
+	EnableShareHistoryOnInvite bool
+
+	// Rust and JS only. The store backend to use for crypto and room state. If unset, the client's default backend
+	// is used. Clients MUST return an error if they do not support the backend. See SupportedStoreBackends.
+	StoreBackend StoreBackend
+	// Rust only. If set, the client will migrate an existing store from this backend to StoreBackend when the
+	// client is created. Clients MUST return an error if they cannot perform the migration.
+	MigrateStoreFrom StoreBackend
+
+	// If set, Login authenticates via the homeserver's OIDC provider as per MSC3861, logging in to the provider
+	// with the localpart of UserID and Password, instead of using password login. The device ID is chosen
+	// by the client, so DeviceID is ignored. Clients MUST refresh their access token when it expires. Clients
+	// MUST return an error from Login if they cannot do this. See deploy.NewOIDCHomeserver.
+	UseOIDC bool
+
+	// Rust only. If set, the test fails if a call into the FFI bindings does not return within this duration,
+	// logging which call hung and the state of the client's listeners. This catches deadlocks in the bindings
+	// well before the global `go test` timeout.
+	FFIWatchdogTimeout time.Duration
+
+	// Rust only. If set, Close fails the test if any FFI objects made by the client have not been destroyed,
+	// e.g because a sync loop was never stopped. Otherwise, leaked objects are logged.
+	FailOnFFILeaks bool
+
+	// The algorithm to use when creating a key backup in BackupKeys. If unset, the client's default algorithm
+	// is used. Clients MUST return an error from BackupKeys if they cannot create a backup with this algorithm.
+	BackupAlgorithm BackupAlgorithm
+
+	// If set, the client does not verify the TLS certificate of the homeserver, so it can connect to a BaseURL which
+	// serves an invalid certificate e.g deploy.ComplementCryptoDeployment.ReverseProxyTLSURLForHS. nio never
+	// verifies certificates.
+	DisableSSLVerification bool
+	// Rust only. DER encoded CA certificates which the client trusts in addition to the system roots, so it can
+	// verify the TLS certificate of the homeserver e.g deploy.ComplementCryptoDeployment.ReverseProxyCACertificate.
+	RootCertificates [][]byte
+}
+
+// StoreBackend is the kind of persistent store a client uses to store crypto and room state.
+type StoreBackend string
+
+const (
+	// StoreBackendDefault uses whatever backend the client uses by default.
+	StoreBackendDefault StoreBackend = ""
+	// StoreBackendSQLite uses SQLite databases on disk. Rust only.
+	StoreBackendSQLite StoreBackend = "sqlite"
+	// StoreBackendInMemory keeps everything in memory, so nothing survives the client being closed. Clients MUST
+	// return an error if PersistentStorage is also set.
+	StoreBackendInMemory StoreBackend = "memory"
+	// StoreBackendIndexedDB uses IndexedDB databases in the browser for both the sync and crypto stores. JS only.
+	StoreBackendIndexedDB StoreBackend = "indexeddb"
+)
+
+// SupportedStoreBackends returns the store backends which clients of the given language can be created with,
+// not including StoreBackendDefault.
+func SupportedStoreBackends(lang ClientTypeLang) []StoreBackend {
+	switch lang {
+	case ClientTypeRust:
+		return []StoreBackend{StoreBackendSQLite, StoreBackendInMemory}
+	case ClientTypeJS:
+		return []StoreBackend{StoreBackendInMemory, StoreBackendIndexedDB}
+	default:
+		return nil
+	}
 }
 
+// BackupAlgorithm is the algorithm used to encrypt room keys in a server-side key backup.
+type BackupAlgorithm string
+
+const (
+	// BackupAlgorithmDefault uses whatever algorithm the client uses by default.
+	BackupAlgorithmDefault BackupAlgorithm = ""
+	// BackupAlgorithmCurve25519AESSHA2 is the asymmetric algorithm in the Matrix spec, which every client supports.
+	BackupAlgorithmCurve25519AESSHA2 BackupAlgorithm = "m.megolm_backup.v1.curve25519-aes-sha2"
+	// BackupAlgorithmAESHMACSHA2 is the symmetric algorithm from MSC3270, which allows clients to verify that
+	// keys in the backup were uploaded by someone with the backup key.
+	BackupAlgorithmAESHMACSHA2 BackupAlgorithm = "org.matrix.msc3270.v1.aes-hmac-sha2"
+)
+
+// SlidingSyncMode is how rust clients do sliding sync. Other clients use sync v2 regardless of the mode.
+type SlidingSyncMode string
+
+const (
+	// SlidingSyncModeNative syncs using simplified sliding sync (MSC4186) on the homeserver.
+	SlidingSyncModeNative SlidingSyncMode = "native"
+	// SlidingSyncModeProxy syncs via a sliding sync proxy, which syncs with the homeserver via sync v2.
+	SlidingSyncModeProxy SlidingSyncMode = "proxy"
+)
+
 // GetExtraOption is a safe way to get an extra option from ExtraOpts, with a default value if the key does not exist.
 func (o *ClientCreationOpts) GetExtraOption(key string, defaultValue any) any {
 	if o.ExtraOpts == nil {
@@ -347,23 +1491,146 @@ func (o *ClientCreationOpts) Combine(other *ClientCreationOpts) {
 	if other.PersistentStorage {
 		o.PersistentStorage = true
 	}
+	if other.StorePassphrase != "" {
+		o.StorePassphrase = other.StorePassphrase
+	}
 	if other.SlidingSyncURL != "" {
 		o.SlidingSyncURL = other.SlidingSyncURL
 	}
+	if other.EnableShareHistoryOnInvite {
+		o.EnableShareHistoryOnInvite = true
+	}
+	if other.StoreBackend != StoreBackendDefault {
+		o.StoreBackend = other.StoreBackend
+	}
+	if other.MigrateStoreFrom != StoreBackendDefault {
+		o.MigrateStoreFrom = other.MigrateStoreFrom
+	}
+	if other.UseOIDC {
+		o.UseOIDC = true
+	}
+	if other.FFIWatchdogTimeout != 0 {
+		o.FFIWatchdogTimeout = other.FFIWatchdogTimeout
+	}
+	if other.FailOnFFILeaks {
+		o.FailOnFFILeaks = true
+	}
 	if other.UserID != "" {
 		o.UserID = other.UserID
 	}
+	if other.BackupAlgorithm != BackupAlgorithmDefault {
+		o.BackupAlgorithm = other.BackupAlgorithm
+	}
+	if other.DisableSSLVerification {
+		o.DisableSSLVerification = true
+	}
+	if other.RootCertificates != nil {
+		o.RootCertificates = other.RootCertificates
+	}
 }
 
 type Event struct {
-	ID     string
-	Text   string // FFI bindings don't expose the content object
+	ID string
+	// The body of messages, or the topic of m.room.topic events. FFI bindings don't expose the content object.
+	Text   string
 	Sender string
+	// FFI bindings don't expose type, so this is inferred from the content. Empty if unknown.
+	Type string
+	// The state key of state events, nil for other events. For encrypted state events (MSC3414), this is the
+	// state key once the event has been decrypted. Clients which do not expose state keys leave this nil, apart
+	// from m.room.member events which use Target instead.
+	StateKey *string
 	// FFI bindings don't expose state key
 	Target string
 	// FFI bindings don't expose type
 	Membership      string
 	FailedToDecrypt bool
+	// The megolm session ID of an encrypted event, for use with RequestRoomKey and RetryDecryption. Empty if
+	// the event is not encrypted or the client does not expose it, e.g FFI bindings only expose it for
+	// events which failed to decrypt.
+	SessionID string
+	// Set if this event has a file attachment e.g m.file
+	File *EventFile
+	// If FailedToDecrypt, the reason the sender gave for not sharing the room key with this device,
+	// via m.room_key.withheld. Empty if the key was not withheld or the client does not expose why.
+	WithheldCode WithheldCode
+	// If FailedToDecrypt, why the event could not be decrypted. Empty if the event was decrypted.
+	DecryptionFailureReason DecryptionFailureReason
+	// SDKs represent edits differently. Clients which aggregate edits onto the original event e.g FFI bindings set
+	// Edited on the original event, and Text is the body of the latest edit. Clients which show edits as separate
+	// events e.g JS set EditOf on the m.replace event to the ID of the original event, and Text is the new body.
+	// Use CheckEventHasEdit to match either.
+	Edited bool
+	EditOf string
+	// The ID of the thread root if this event is in a thread (MSC3440), else empty.
+	ThreadRoot string
+}
+
+// EventFile is a file attached to an event.
+type EventFile struct {
+	Name string
+	// The downloaded and decrypted contents of the file. Only set by GetEvent, as downloading can be slow.
+	Contents []byte
+	// Set by GetEvent if the file could not be downloaded or decrypted.
+	DownloadError string
+}
+
+// WithheldCode is the reason a sender gave for withholding a room key, as per m.room_key.withheld.
+// SDKs only distinguish m.unverified from the other codes, so tests cannot tell apart e.g m.blacklisted
+// and m.no_olm.
+type WithheldCode string
+
+const (
+	// The key was withheld because this device is unverified, and the sender only shares keys with verified devices.
+	WithheldCodeUnverified WithheldCode = "m.unverified"
+	// The key was withheld for any other reason e.g m.blacklisted, m.unauthorised, m.unavailable or m.no_olm.
+	WithheldCodeOther WithheldCode = "other"
+)
+
+// DecryptionFailureReason is why an event could not be decrypted. Each SDK reports this differently, so
+// the bindings map their own reasons onto these, which lets tests assert on the reason regardless of SDK.
+type DecryptionFailureReason string
+
+const (
+	// The event failed to decrypt, but the client does not expose why e.g nio, or events from notifications.
+	DecryptionFailureReasonUnknown DecryptionFailureReason = "unknown"
+	// This device does not have the room key, or does not have it at the message index of the event.
+	DecryptionFailureReasonMissingKey DecryptionFailureReason = "missing_key"
+	// The sender withheld the room key from this device via m.room_key.withheld. See Event.WithheldCode for why.
+	DecryptionFailureReasonWithheld DecryptionFailureReason = "withheld"
+	// The event was sent before this device existed, and the room key cannot be fetched from key backup
+	// e.g because backup is not enabled.
+	DecryptionFailureReasonHistoricalKeyUnavailable DecryptionFailureReason = "historical_key_unavailable"
+	// The event was sent before this user joined the room, and the history visibility does not allow it to be seen.
+	DecryptionFailureReasonSentBeforeJoined DecryptionFailureReason = "sent_before_joined"
+	// The room key was sent by a device which this client does not trust enough to decrypt with, e.g an unsigned
+	// device, an unknown device or a user whose identity changed after being verified.
+	DecryptionFailureReasonSenderNotTrusted DecryptionFailureReason = "sender_not_trusted"
+	// The event is not a valid encrypted event e.g it uses an unknown algorithm.
+	DecryptionFailureReasonMalformedEvent DecryptionFailureReason = "malformed_event"
+)
+
+// TimelineListenerOpts controls which events are passed to the checker function in WaitUntilEventInRoomWithOpts.
+// The zero value passes all events.
+type TimelineListenerOpts struct {
+	// If set, only events with one of these types are passed to the checker e.g "m.room.message".
+	// Events which could not be decrypted have the type "m.room.encrypted".
+	EventTypes []string
+	// If true, membership events are not passed to the checker.
+	IgnoreMembership bool
+}
+
+// Filter wraps the checker function so it is only called for events which match these options.
+func (o TimelineListenerOpts) Filter(checker func(e Event) bool) func(e Event) bool {
+	return func(e Event) bool {
+		if o.IgnoreMembership && (e.Type == "m.room.member" || e.Membership != "") {
+			return false
+		}
+		if len(o.EventTypes) > 0 && !slices.Contains(o.EventTypes, e.Type) {
+			return false
+		}
+		return checker(e)
+	}
 }
 
 type Waiter interface {
@@ -381,14 +1648,65 @@ func CheckEventHasBody(body string) func(e Event) bool {
 	}
 }
 
+// CheckEventInThread matches a message with the given body in the thread with the given root event.
+func CheckEventInThread(threadRootID, body string) func(e Event) bool {
+	return func(e Event) bool {
+		return e.ThreadRoot == threadRootID && e.Text == body
+	}
+}
+
+// CheckEventIsDecrypted matches the given event once it has been successfully decrypted.
+func CheckEventIsDecrypted(eventID string) func(e Event) bool {
+	return func(e Event) bool {
+		return e.ID == eventID && !e.FailedToDecrypt && e.Type != "m.room.encrypted"
+	}
+}
+
+// CheckEventFailedToDecryptWithReason matches the given event once it has failed to decrypt for the given reason.
+func CheckEventFailedToDecryptWithReason(eventID string, reason DecryptionFailureReason) func(e Event) bool {
+	return func(e Event) bool {
+		return e.ID == eventID && e.FailedToDecrypt && e.DecryptionFailureReason == reason
+	}
+}
+
+// CheckEventHasEdit matches once the given event has been edited to have the new body, regardless of whether
+// the client shows the edit on the original event or as a separate event.
+func CheckEventHasEdit(originalEventID, newBody string) func(e Event) bool {
+	return func(e Event) bool {
+		if e.Text != newBody {
+			return false
+		}
+		return (e.ID == originalEventID && e.Edited) || e.EditOf == originalEventID
+	}
+}
+
+func CheckEventHasFileName(filename string) func(e Event) bool {
+	return func(e Event) bool {
+		return e.File != nil && e.File.Name == filename
+	}
+}
+
 func CheckEventHasMembership(target, membership string) func(e Event) bool {
 	return func(e Event) bool {
 		return e.Membership == membership && e.Target == target
 	}
 }
 
+// CheckEventHasTopic matches an m.room.topic state event with the given topic, which will only match encrypted
+// state events (MSC3414) once they have been decrypted.
+func CheckEventHasTopic(topic string) func(e Event) bool {
+	return func(e Event) bool {
+		return e.Type == "m.room.topic" && e.Text == topic
+	}
+}
+
 func CheckEventHasEventID(eventID string) func(e Event) bool {
 	return func(e Event) bool {
 		return e.ID == eventID
 	}
 }
+
+// ClientID identifies a client in logs, e.g "@alice:hs1,DEVICE (rust)".
+func ClientID(userID, deviceID string, lang ClientTypeLang) string {
+	return fmt.Sprintf("%s,%s (%s)", userID, deviceID, lang)
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// decryptionRetryWaiter waits for an undecryptable event to be decrypted, see TestClient.WaitUntilDecryptionRetried
+type decryptionRetryWaiter struct {
+	client  Client
+	roomID  string
+	eventID string
+	// why the event failed to decrypt when the waiter was created, for failure messages
+	reason DecryptionFailureReason
+}
+
+func (w *decryptionRetryWaiter) Waitf(t ct.TestLike, s time.Duration, format string, args ...any) {
+	t.Helper()
+	if err := w.TryWaitf(t, s, format, args...); err != nil {
+		ct.Fatalf(t, "%s", err)
+	}
+}
+
+func (w *decryptionRetryWaiter) TryWaitf(t ct.TestLike, s time.Duration, format string, args ...any) error {
+	t.Helper()
+	msg := fmt.Sprintf(format, args...)
+	err := w.client.WaitUntilEventInRoom(t, w.roomID, CheckEventIsDecrypted(w.eventID)).TryWaitf(t, s, "%s", msg)
+	if err != nil {
+		return fmt.Errorf("%s: event %s which failed to decrypt (%q) was not decrypted: %s", msg, w.eventID, w.reason, err)
+	}
+	// timeline listeners saw the decrypted event, ensure the client's copy of the event was updated too
+	ev, err := w.client.GetEvent(t, w.roomID, w.eventID)
+	if err != nil {
+		return fmt.Errorf("%s: GetEvent: %s", msg, err)
+	}
+	if ev.FailedToDecrypt || ev.DecryptionFailureReason != "" {
+		return fmt.Errorf("%s: timeline listeners saw event %s decrypted, but GetEvent still returns it as undecryptable (%q)",
+			msg, w.eventID, ev.DecryptionFailureReason)
+	}
+	return nil
+}
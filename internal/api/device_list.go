@@ -0,0 +1,59 @@
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/complement/ct"
+	"golang.org/x/exp/slices"
+)
+
+// How often deviceListWaiter polls the client's device list.
+const deviceListPollInterval = 100 * time.Millisecond
+
+// CheckDeviceListContains matches a device list which includes the given device.
+func CheckDeviceListContains(deviceID string) func(deviceIDs []string) bool {
+	return func(deviceIDs []string) bool {
+		return slices.Contains(deviceIDs, deviceID)
+	}
+}
+
+// CheckDeviceListExcludes matches a device list which does not include the given device e.g after the
+// device has been deleted.
+func CheckDeviceListExcludes(deviceID string) func(deviceIDs []string) bool {
+	return func(deviceIDs []string) bool {
+		return !slices.Contains(deviceIDs, deviceID)
+	}
+}
+
+// deviceListWaiter waits for a user's device list to match, see TestClient.WaitUntilDeviceList
+type deviceListWaiter struct {
+	client  Client
+	userID  string
+	checker func(deviceIDs []string) bool
+}
+
+func (w *deviceListWaiter) Waitf(t ct.TestLike, s time.Duration, format string, args ...any) {
+	t.Helper()
+	if err := w.TryWaitf(t, s, format, args...); err != nil {
+		ct.Fatalf(t, "%s", err)
+	}
+}
+
+func (w *deviceListWaiter) TryWaitf(t ct.TestLike, s time.Duration, format string, args ...any) error {
+	t.Helper()
+	deadline := time.Now().Add(s)
+	for {
+		deviceIDs, err := w.client.GetDeviceIDs(t, w.userID)
+		if err != nil {
+			return fmt.Errorf("%s: GetDeviceIDs: %s", fmt.Sprintf(format, args...), err)
+		}
+		if w.checker(deviceIDs) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s: timed out after %v, device list for %s is %v", fmt.Sprintf(format, args...), s, w.userID, deviceIDs)
+		}
+		time.Sleep(deviceListPollInterval)
+	}
+}
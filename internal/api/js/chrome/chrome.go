@@ -25,6 +25,15 @@ import (
 //go:embed dist
 var jsSDKDistDirectory embed.FS
 
+// distDirectory is served instead of jsSDKDistDirectory if set, see SetDistDirectory.
+var distDirectory string
+
+// SetDistDirectory serves the JS SDK bundle in dir to browsers started after this is called, instead of the bundle
+// embedded in the test binary. Call this before any tests run.
+func SetDistDirectory(dir string) {
+	distDirectory = dir
+}
+
 // Void is a type which can be used when you want to run an async function without returning anything.
 // It can stop large responses causing errors "Object reference chain is too long (-32000)"
 // when we don't care about the response.
@@ -70,7 +79,21 @@ type Browser struct {
 	Cancel  func()
 }
 
-func RunHeadless(onConsoleLog func(s string), requiresPersistance bool, listenPort int) (*Browser, error) {
+// Reload reloads the page, dropping all in-memory JS state. Anything in IndexedDB or localStorage is kept.
+func (b *Browser) Reload() error {
+	if err := chromedp.Run(b.Ctx, chromedp.Reload()); err != nil {
+		return fmt.Errorf("failed to reload %s: %s", b.BaseURL, err)
+	}
+	return nil
+}
+
+// UserDataDir returns the chrome profile directory used by browsers which require persistence.
+func UserDataDir() string {
+	wd, _ := os.Getwd()
+	return filepath.Join(wd, "chromedp")
+}
+
+func RunHeadless(onConsoleLog func(s string), requiresPersistance, ignoreCertificateErrors bool, listenPort int) (*Browser, error) {
 	ansiRedForeground := "\x1b[31m"
 	ansiResetForeground := "\x1b[39m"
 
@@ -80,13 +103,15 @@ func RunHeadless(onConsoleLog func(s string), requiresPersistance bool, listenPo
 	}
 	opts := chromedp.DefaultExecAllocatorOptions[:]
 	if requiresPersistance {
-		os.Mkdir("chromedp", os.ModePerm) // ignore errors to allow repeated runs
-		wd, _ := os.Getwd()
-		userDir := filepath.Join(wd, "chromedp")
+		userDir := UserDataDir()
+		os.Mkdir(userDir, os.ModePerm) // ignore errors to allow repeated runs
 		opts = append(opts,
 			chromedp.UserDataDir(userDir),
 		)
 	}
+	if ignoreCertificateErrors {
+		opts = append(opts, chromedp.Flag("ignore-certificate-errors", true))
+	}
 	// increase the WS timeout from 20s (default) to 30s as we see timeouts with 20s in CI
 	opts = append(opts, chromedp.WSURLReadTimeout(30*time.Second))
 
@@ -114,6 +139,9 @@ func RunHeadless(onConsoleLog func(s string), requiresPersistance bool, listenPo
 	if err != nil {
 		return nil, fmt.Errorf("failed to strip /dist off JS SDK files: %s", err)
 	}
+	if distDirectory != "" {
+		c = os.DirFS(distDirectory)
+	}
 
 	baseJSURL := ""
 	// run js-sdk (need to run this as a web server to avoid CORS errors you'd otherwise get with file: URLs)
@@ -23,6 +23,8 @@ const (
 	MessageTypeEvent        MessageType = 1
 	MessageTypeSync         MessageType = 2
 	MessageTypeVerification MessageType = 3
+	MessageTypeBackup       MessageType = 4
+	MessageTypeDeviceList   MessageType = 5
 )
 
 type ControlMessage struct {
@@ -67,17 +69,88 @@ func (c *ControlMessage) AsControlMessageSync() *ControlMessageSync {
 	if c.Type != MessageTypeSync {
 		return nil
 	}
-	return &ControlMessageSync{} // no data
+	var cms ControlMessageSync
+	if err := json.Unmarshal(c.Data, &cms); err != nil {
+		fmt.Println("WARN: unable to unmarshal MessageTypeSync control message:", err)
+		return nil
+	}
+	return &cms
+}
+
+func (c *ControlMessage) AsControlMessageBackup() *ControlMessageBackup {
+	if c == nil {
+		return nil
+	}
+	if c.Type != MessageTypeBackup {
+		return nil
+	}
+	var cmb ControlMessageBackup
+	if err := json.Unmarshal(c.Data, &cmb); err != nil {
+		fmt.Println("WARN: unable to unmarshal MessageTypeBackup control message:", err)
+		return nil
+	}
+	return &cmb
 }
 
-type ControlMessageSync struct{}
+func (c *ControlMessage) AsControlMessageDeviceList() *ControlMessageDeviceList {
+	if c == nil {
+		return nil
+	}
+	if c.Type != MessageTypeDeviceList {
+		return nil
+	}
+	var cmd ControlMessageDeviceList
+	if err := json.Unmarshal(c.Data, &cmd); err != nil {
+		fmt.Println("WARN: unable to unmarshal MessageTypeDeviceList control message:", err)
+		return nil
+	}
+	return &cmd
+}
 
-func EmitControlMessageSyncJS() string {
+type ControlMessageBackup struct {
+	Enabled bool
+}
+
+func EmitControlMessageBackupJS(enabledJSCode string) string {
 	return fmt.Sprintf(
 		`console.log("%s"+JSON.stringify({
 			"t":%d,
-			"d":{}
-		}));`, CONSOLE_LOG_CONTROL_STRING, MessageTypeSync,
+			"d":{
+			  Enabled: %s,
+			}
+		}));`, CONSOLE_LOG_CONTROL_STRING, MessageTypeBackup, enabledJSCode,
+	)
+}
+
+type ControlMessageDeviceList struct {
+	UserIDs []string
+}
+
+func EmitControlMessageDeviceListJS(userIDsJSCode string) string {
+	return fmt.Sprintf(
+		`console.log("%s"+JSON.stringify({
+			"t":%d,
+			"d":{
+			  UserIDs: %s,
+			}
+		}));`, CONSOLE_LOG_CONTROL_STRING, MessageTypeDeviceList, userIDsJSCode,
+	)
+}
+
+type ControlMessageSync struct {
+	State string
+	Error string // set when State is ERROR
+}
+
+func EmitControlMessageSyncJS(stateJSCode, errorJSCode string) string {
+	return fmt.Sprintf(
+		`console.log("%s"+JSON.stringify({
+			"t":%d,
+			"d":{
+			  State: %s,
+			  Error: %s,
+			}
+		}));`, CONSOLE_LOG_CONTROL_STRING, MessageTypeSync, stateJSCode, errorJSCode,
 	)
 }
 
@@ -1,6 +1,8 @@
 package js
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/url"
@@ -13,13 +15,16 @@ import (
 
 	"github.com/matrix-org/complement-crypto/internal/api"
 	"github.com/matrix-org/complement-crypto/internal/api/js/chrome"
+	"github.com/matrix-org/complement-crypto/internal/keyexport"
+	"github.com/matrix-org/complement-crypto/internal/logging"
 	"github.com/matrix-org/complement/ct"
 	"github.com/tidwall/gjson"
 )
 
 const (
-	indexedDBName       = "complement-crypto"
-	indexedDBCryptoName = "complement-crypto:crypto"
+	indexedDBName = "complement-crypto"
+	// rust crypto stores its data in IndexedDB databases starting with this prefix
+	rustCryptoDBPrefix = "complement-crypto"
 )
 
 // For clients which want persistent storage, we need to ensure when the browser
@@ -58,9 +63,32 @@ type JSClient struct {
 	opts                  api.ClientCreationOpts
 	verificationChannel   chan api.VerificationStage
 	verificationChannelMu *sync.Mutex
+	// informed whenever the JS SDK emits a "sync" event
+	syncStateListeners api.SyncStateListeners
+	// informed whenever key backup is enabled or disabled
+	backupStateListeners api.BackupStateListeners
+	// true if window.__client emits control messages for events, see listenForEvents
+	listeningForEvents bool
+	// the session of the client when it was killed, used by RestoreFromStorage. nil if the client is alive.
+	killedSession *jsSession
+}
+
+// jsSession is what is needed to re-create a client from its IndexedDB stores.
+type jsSession struct {
+	AccessToken string `json:"access_token"`
+	DeviceID    string `json:"device_id"`
 }
 
 func NewJSClient(t ct.TestLike, opts api.ClientCreationOpts) (api.Client, error) {
+	switch opts.StoreBackend {
+	case api.StoreBackendDefault, api.StoreBackendIndexedDB:
+	case api.StoreBackendInMemory:
+		if opts.PersistentStorage {
+			return nil, fmt.Errorf("store backend %s cannot be used with PersistentStorage", opts.StoreBackend)
+		}
+	default:
+		return nil, fmt.Errorf("store backend %s: %w", opts.StoreBackend, api.ErrNotSupported)
+	}
 	jsc := &JSClient{
 		listeners:             make(map[int32]func(ctrlMsg *ControlMessage)),
 		userID:                opts.UserID,
@@ -69,8 +97,14 @@ func NewJSClient(t ct.TestLike, opts api.ClientCreationOpts) (api.Client, error)
 		verificationChannelMu: &sync.Mutex{},
 	}
 	portKey := opts.UserID + opts.DeviceID
+	testName := t.Name()
+	clientID := api.ClientID(opts.UserID, opts.DeviceID, api.ClientTypeJS)
 	browser, err := chrome.RunHeadless(func(s string) {
 		writeToLog("[%s,%s] console.log %s\n", opts.UserID, opts.DeviceID, s)
+		// lines from Logf are already captured
+		if !strings.HasPrefix(s, testName+": ") {
+			logging.Write(testName, clientID, "console.log "+s)
+		}
 
 		msg := unpackControlMessage(t, s)
 		if msg == nil {
@@ -85,29 +119,76 @@ func NewJSClient(t ct.TestLike, opts api.ClientCreationOpts) (api.Client, error)
 		for _, l := range listeners {
 			l(msg)
 		}
-	}, opts.PersistentStorage, userDeviceToPort[portKey])
+	}, opts.PersistentStorage, opts.DisableSSLVerification, userDeviceToPort[portKey])
 	if err != nil {
 		return nil, fmt.Errorf("failed to RunHeadless: %s", err)
 	}
 	jsc.browser = browser
+	jsc.listenForUpdates(func(ctrlMsg *ControlMessage) {
+		if msg := ctrlMsg.AsControlMessageSync(); msg != nil {
+			jsc.syncStateListeners.Broadcast(api.SyncState{
+				State:   msg.State,
+				Syncing: msg.State == "SYNCING" || msg.State == "PREPARED" || msg.State == "CATCHUP",
+				Error:   msg.Error,
+			})
+		}
+		if msg := ctrlMsg.AsControlMessageBackup(); msg != nil {
+			state := api.BackupStateDisabled
+			if msg.Enabled {
+				state = api.BackupStateEnabled
+			}
+			jsc.backupStateListeners.Broadcast(state)
+		}
+	})
 
-	// now login
-	deviceID := "undefined"
-	if opts.DeviceID != "" {
-		deviceID = `"` + opts.DeviceID + `"`
+	if opts.PersistentStorage {
+		// remember the port for same-origin to remember the store
+		u, _ := url.Parse(browser.BaseURL)
+		portStr := u.Port()
+		port, err := strconv.Atoi(portStr)
+		if portStr == "" || err != nil {
+			ct.Fatalf(t, "failed to extract port from base url %s", browser.BaseURL)
+		}
+		userDeviceToPort[portKey] = port
+		t.Logf("user=%s device=%s will be served from %s due to persistent storage", opts.UserID, opts.DeviceID, browser.BaseURL)
+	}
+	if err = jsc.createClient(t, opts.AccessToken, opts.DeviceID); err != nil {
+		return nil, fmt.Errorf("failed to create client: %s", err)
 	}
+	if opts.AccessToken != "" { // the session was restored, so we won't be logging in
+		if err = jsc.listenForEvents(t); err != nil {
+			return nil, fmt.Errorf("failed to listen for events: %s", err)
+		}
+	}
+	jsc.Logf(t, "NewJSClient[%s,%s] created client storage=%v", opts.UserID, opts.DeviceID, opts.PersistentStorage)
+	return &api.LoggedClient{Client: jsc}, nil
+}
+
+// createClient creates window.__client, using persistent storage if enabled. If accessToken is set, the client
+// is created with an existing session, else the client needs to login.
+func (c *JSClient) createClient(t ct.TestLike, accessToken, deviceID string) error {
+	t.Helper()
+	deviceIDJS := "undefined"
+	if deviceID != "" {
+		deviceIDJS = `"` + deviceID + `"`
+	}
+	accessTokenJS := "undefined"
+	if accessToken != "" {
+		accessTokenJS = `"` + accessToken + `"`
+	}
+	storagePasswordJS := "undefined"
+	if c.opts.StorePassphrase != "" {
+		storagePasswordJS = `"` + c.opts.StorePassphrase + `"`
+	}
+	// By default, the sync store is in memory and the crypto store is in IndexedDB, unless persistent storage is
+	// required, in which case both are in IndexedDB. StoreBackend picks one or the other for both stores.
 	store := "undefined"
-	cryptoStore := "undefined"
-	if opts.PersistentStorage {
+	useIndexedDBForCrypto := c.opts.StoreBackend != api.StoreBackendInMemory
+	if c.opts.PersistentStorage || c.opts.StoreBackend == api.StoreBackendIndexedDB {
 		// TODO: Cannot Must this because of a bug in JS SDK
 		// "Uncaught (in promise) Error: createUser is undefined, it should be set with setUserCreator()!"
 		// https://github.com/matrix-org/matrix-js-sdk/blob/76b9c3950bfdfca922bec7f70502ff2da93bd731/src/store/indexeddb.ts#L143
-		chrome.RunAsyncFn[chrome.Void](t, browser.Ctx, fmt.Sprintf(`
-		// FIXME: this doesn't seem to work.
-		// JS SDK doesn't store this for us, so we need to. Do this before making the stores which can error out.
-		// window.__accessToken = window.localStorage.getItem("complement_crypto_access_token") || undefined;
-		// console.log("localStorage.getItem(complement_crypto_access_token) => " + window.__accessToken);
-
+		chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
 		window.__store = new IndexedDBStore({
 			indexedDB: window.indexedDB,
 			dbName: "%s",
@@ -116,28 +197,17 @@ func NewJSClient(t ct.TestLike, opts api.ClientCreationOpts) (api.Client, error)
 		await window.__store.startup();
 		`, indexedDBName))
 		store = "window.__store"
-		//cryptoStore = fmt.Sprintf(`new IndexedDBCryptoStore(indexedDB, "%s")`, indexedDBCryptoName)
-		// remember the port for same-origin to remember the store
-		u, _ := url.Parse(browser.BaseURL)
-		portStr := u.Port()
-		port, err := strconv.Atoi(portStr)
-		if portStr == "" || err != nil {
-			ct.Fatalf(t, "failed to extract port from base url %s", browser.BaseURL)
-		}
-		userDeviceToPort[portKey] = port
-		t.Logf("user=%s device=%s will be served from %s due to persistent storage", opts.UserID, opts.DeviceID, browser.BaseURL)
 	}
 
-	chrome.MustRunAsyncFn[chrome.Void](t, browser.Ctx, fmt.Sprintf(`
+	_, err := chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
 	window._secretStorageKeys = {};
 	window.__client = matrix.createClient({
 		baseUrl:                "%s",
 		useAuthorizationHeader: %s,
 		userId:                 "%s",
 		deviceId: %s,
-		accessToken: window.__accessToken || undefined,
+		accessToken: %s,
 		store: %s,
-		cryptoStore: %s,
 		cryptoCallbacks: {
 			cacheSecretStorageKey: (keyId, keyInfo, key) => {
 				console.log("cacheSecretStorageKey: keyId="+keyId+" keyInfo="+JSON.stringify(keyInfo)+" key.length:"+key.length);
@@ -163,13 +233,42 @@ func NewJSClient(t ct.TestLike, opts api.ClientCreationOpts) (api.Client, error)
 			},
 		}
 	});
-	await window.__client.initRustCrypto();
-	`, opts.BaseURL, "true", opts.UserID, deviceID, store, cryptoStore))
-	jsc.Logf(t, "NewJSClient[%s,%s] created client storage=%v", opts.UserID, opts.DeviceID, opts.PersistentStorage)
-	return &api.LoggedClient{Client: jsc}, nil
+	// initRustCrypto throws if the crypto store was encrypted with a different password
+	await window.__client.initRustCrypto({ cryptoDatabasePrefix: "%s", storagePassword: %s, useIndexedDB: %v });
+	// record when the server tells us our fallback key was claimed, see FallbackKeyUsed
+	const crypto = window.__client.getCrypto();
+	const processKeyCounts = crypto.processKeyCounts.bind(crypto);
+	crypto.processKeyCounts = function(oneTimeKeysCounts, unusedFallbackKeys) {
+		if (unusedFallbackKeys) {
+			const hasFallbackKey = Array.from(unusedFallbackKeys).includes("signed_curve25519");
+			if (window.__hadFallbackKey && !hasFallbackKey) {
+				window.__fallbackKeyUsed = true;
+			}
+			window.__hadFallbackKey = hasFallbackKey;
+		}
+		return processKeyCounts(oneTimeKeysCounts, unusedFallbackKeys);
+	};
+	window.__client.on("sync", function(state, prevState, data) {
+		`+EmitControlMessageSyncJS("state", "data?.error?.message || null")+`
+	});
+	// CryptoEvent.KeyBackupStatus is only emitted on changes, so emit the current state too.
+	window.__client.on("crypto.keyBackupStatus", function(enabled) {
+		`+EmitControlMessageBackupJS("enabled")+`
+	});
+	// CryptoEvent.DevicesUpdated is emitted once the new device lists have been fetched
+	window.__client.on("crypto.devicesUpdated", function(userIds, initialFetch) {
+		`+EmitControlMessageDeviceListJS("userIds")+`
+	});
+	const backupEnabled = (await crypto.getActiveSessionBackupVersion()) !== null;
+	`+EmitControlMessageBackupJS("backupEnabled")+`
+	`, c.opts.BaseURL, "true", c.opts.UserID, deviceIDJS, accessTokenJS, store, rustCryptoDBPrefix, storagePasswordJS, useIndexedDBForCrypto))
+	return err
 }
 
 func (c *JSClient) Login(t ct.TestLike, opts api.ClientCreationOpts) error {
+	if opts.UseOIDC {
+		return fmt.Errorf("UseOIDC: %w", api.ErrNotSupported)
+	}
 	deviceID := "undefined"
 	if opts.DeviceID != "" {
 		deviceID = `"` + opts.DeviceID + `"`
@@ -188,30 +287,29 @@ func (c *JSClient) Login(t ct.TestLike, opts api.ClientCreationOpts) error {
 		return err
 	}
 
-	// any events need to log the control string so we get notified
-	_, err = chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
+	if err = c.listenForEvents(t); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// listenForEvents logs a control message for every event, so we get notified. Does nothing if
+// we are already listening.
+func (c *JSClient) listenForEvents(t ct.TestLike) error {
+	t.Helper()
+	if c.listeningForEvents {
+		return nil
+	}
+	_, err := chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, `
 	window.__client.on("Event.decrypted", function(event) {
 		`+EmitControlMessageEventJS("event.getRoomId()", "event.getEffectiveEvent()")+`
 	});
 	window.__client.on("event", function(event) {
 		`+EmitControlMessageEventJS("event.getRoomId()", "event.getEffectiveEvent()")+`
-	});`))
-	if err != nil {
-		return err
-	}
-
-	if c.opts.PersistentStorage {
-		/* FIXME: this doesn't work. It doesn't seem to remember across restarts.
-		chrome.MustRunAsyncFn[chrome.Void](t, c.browser.Ctx, `
-			const token = window.__client.getAccessToken();
-			if (token) {
-				window.localStorage.setItem("complement_crypto_access_token",token);
-				console.log("localStorage.setItem(complement_crypto_access_token) => " + token);
-			}
-		`) */
-	}
-
-	return nil
+	});`)
+	c.listeningForEvents = err == nil
+	return err
 }
 
 func (c *JSClient) DeletePersistentStorage(t ct.TestLike) {
@@ -230,18 +328,28 @@ func (c *JSClient) DeletePersistentStorage(t ct.TestLike) {
 		    resolve();
 		};
 	});
-	const cryptoDBName = "%s";
-	await new Promise((resolve, reject) => {
-		const req = window.indexedDB.deleteDatabase(cryptoDBName);
-		req.onerror = (event) => {
-			reject("failed to delete " + cryptoDBName + ": " + event);
-		};
-		req.onsuccess = (event) => {
-			console.log(cryptoDBName + " deleted successfully");
-		    resolve();
-		};
-	});
-	`, indexedDBName, indexedDBCryptoName))
+	for (const cryptoDBName of ["%s::matrix-sdk-crypto", "%s::matrix-sdk-crypto-meta"]) {
+		await new Promise((resolve, reject) => {
+			const req = window.indexedDB.deleteDatabase(cryptoDBName);
+			req.onerror = (event) => {
+				reject("failed to delete " + cryptoDBName + ": " + event);
+			};
+			req.onsuccess = (event) => {
+				console.log(cryptoDBName + " deleted successfully");
+				resolve();
+			};
+		});
+	}
+	`, indexedDBName, rustCryptoDBPrefix, rustCryptoDBPrefix))
+}
+
+// PersistentStoragePath returns the chrome profile directory, which is shared between all JS clients
+// with persistent storage.
+func (c *JSClient) PersistentStoragePath(t ct.TestLike) string {
+	if !c.opts.PersistentStorage {
+		return ""
+	}
+	return chrome.UserDataDir()
 }
 
 func (c *JSClient) CurrentAccessToken(t ct.TestLike) string {
@@ -250,26 +358,168 @@ func (c *JSClient) CurrentAccessToken(t ct.TestLike) string {
 	return *token
 }
 
+// GetNotification fetches the event from the server rather than the local timeline, then decrypts it and
+// evaluates push rules against it, which is what a push handler e.g a service worker would do.
 func (c *JSClient) GetNotification(t ct.TestLike, roomID, eventID string) (*api.Notification, error) {
-	return nil, fmt.Errorf("not implemented yet") // TODO
+	t.Helper()
+	serialised, err := chrome.RunAsyncFn[string](t, c.browser.Ctx, fmt.Sprintf(`
+	const raw = await window.__client.fetchRoomEvent("%s", "%s");
+	const ev = window.__client.getEventMapper()(raw);
+	await window.__client.decryptEventIfNeeded(ev);
+	const actions = window.__client.getPushActionsForEvent(ev, true);
+	return JSON.stringify({
+		event: (`+eventToJSONJS+`)(ev),
+		highlight: !!actions?.tweaks?.highlight,
+		noisy: !!actions?.notify && !!actions?.tweaks?.sound,
+	});
+	`, roomID, eventID))
+	if err != nil {
+		return nil, fmt.Errorf("GetNotification(%s, %s): %s", roomID, eventID, err)
+	}
+	if !gjson.Valid(*serialised) {
+		return nil, fmt.Errorf("GetNotification(%s, %s): invalid output %s", roomID, eventID, *serialised)
+	}
+	result := gjson.Parse(*serialised)
+	hasMentions := result.Get("highlight").Bool()
+	isNoisy := result.Get("noisy").Bool()
+	return &api.Notification{
+		Event:       *serialisedEventToEvent(result.Get("event")),
+		HasMentions: &hasMentions,
+		IsNoisy:     &isNoisy,
+	}, nil
+}
+
+func (c *JSClient) GetDeviceTrust(t ct.TestLike, userID, deviceID string) (api.TrustLevel, error) {
+	trust, err := chrome.RunAsyncFn[string](t, c.browser.Ctx, fmt.Sprintf(`
+	const status = await window.__client.getCrypto().getDeviceVerificationStatus("%s", "%s");
+	if (!status) {
+		return "%s";
+	}
+	return status.isVerified() ? "%s" : "%s";
+	`, userID, deviceID, api.TrustLevelUnknown, api.TrustLevelVerified, api.TrustLevelUnverified))
+	if err != nil {
+		return api.TrustLevelUnknown, err
+	}
+	return api.TrustLevel(*trust), nil
+}
+
+func (c *JSClient) GetDeviceIDs(t ct.TestLike, userID string) ([]string, error) {
+	// Only return devices from the local device list, so this reflects the device list updates the client has processed.
+	deviceIDs, err := chrome.RunAsyncFn[[]string](t, c.browser.Ctx, fmt.Sprintf(`
+	const devices = await window.__client.getCrypto().getUserDeviceInfo(["%s"], false);
+	const userDevices = devices.get("%s");
+	return userDevices ? Array.from(userDevices.keys()) : [];
+	`, userID, userID))
+	if err != nil {
+		return nil, err
+	}
+	return *deviceIDs, nil
+}
+
+func (c *JSClient) SetDeviceDisplayName(t ct.TestLike, name string) error {
+	t.Helper()
+	_, err := chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
+	await window.__client.setDeviceDetails(window.__client.getDeviceId(), { display_name: "%s" });
+	`, name))
+	if err != nil {
+		return fmt.Errorf("failed to set device display name: %s", err)
+	}
+	return nil
+}
+
+func (c *JSClient) ListenForDeviceListChanges(t ct.TestLike, callback func(userIDs []string)) (cancel func(), err error) {
+	return c.listenForUpdates(func(ctrlMsg *ControlMessage) {
+		if msg := ctrlMsg.AsControlMessageDeviceList(); msg != nil {
+			callback(msg.UserIDs)
+		}
+	}), nil
 }
 
 func (c *JSClient) bootstrapCrossSigning(t ct.TestLike) {
-	// when MSC3967 is everywhere, we can drop the auth dict
-	chrome.MustRunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
+	t.Helper()
+	err := c.BootstrapCrossSigning(t, func() string {
+		return c.opts.Password
+	})
+	if err != nil {
+		ct.Fatalf(t, "bootstrapCrossSigning: %s", err)
+	}
+}
+
+func (c *JSClient) BootstrapCrossSigning(t ct.TestLike, authCallback func() (password string)) error {
+	t.Helper()
+	// The JS SDK only creates new keys if this device has no private keys and they are not in secret storage.
+	// When MSC3967 is everywhere, we can drop the auth dict.
+	_, err := chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
 	await window.__client.getCrypto().bootstrapCrossSigning({
 		authUploadDeviceSigningKeys: async function (makeRequest) {
 			return await makeRequest({
-				  "type": "m.login.password",
-				  "identifier": {
-					  "type": "m.id.user",
-					  "user": "%s",
-				  },
-				  "password": "%s",
-		  });
+				"type": "m.login.password",
+				"identifier": {
+					"type": "m.id.user",
+					"user": "%s",
+				},
+				"password": "%s",
+			});
 		},
-	  });
-	  `, c.opts.UserID, c.opts.Password))
+	});`, c.opts.UserID, authCallback()))
+	return err
+}
+
+func (c *JSClient) SetGlobalOnlyTrustVerified(t ct.TestLike, enabled bool) error {
+	t.Helper()
+	_, err := chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
+	window.__client.getCrypto().globalBlacklistUnverifiedDevices = %v;`, enabled))
+	return err
+}
+
+// SetRoomOnlyTrustVerified sets the room's blacklist flag, which the JS SDK checks before the global setting.
+func (c *JSClient) SetRoomOnlyTrustVerified(t ct.TestLike, roomID string, enabled bool) error {
+	t.Helper()
+	_, err := chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
+	const room = window.__client.getRoom("%s");
+	if (!room) {
+		throw new Error("unknown room %s");
+	}
+	room.setBlacklistUnverifiedDevices(%v);`, roomID, roomID, enabled))
+	return err
+}
+
+// BlacklistDevice sets the local trust of the device in the rust crypto OlmMachine, as the JS SDK's CryptoApi
+// cannot blacklist devices. The OlmMachine rotates the room key and withholds it from blacklisted devices.
+func (c *JSClient) BlacklistDevice(t ct.TestLike, userID, deviceID string) error {
+	t.Helper()
+	_, err := chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
+	const olmMachine = window.__client.getCrypto().olmMachine;
+	// the JS SDK does not export the wasm bindings, so borrow the UserId and DeviceId classes from the OlmMachine
+	const UserId = olmMachine.userId.constructor;
+	const DeviceId = olmMachine.deviceId.constructor;
+	const device = await olmMachine.getDevice(new UserId("%s"), new DeviceId("%s"));
+	if (!device) {
+		throw new Error("unknown device %s of %s");
+	}
+	// LocalTrust.BlackListed
+	await device.setLocalTrust(1);`, userID, deviceID, deviceID, userID))
+	return err
+}
+
+func (c *JSClient) ResetCrossSigning(t ct.TestLike, authCallback func() (password string)) error {
+	t.Helper()
+	// the JS SDK asks for auth from within the browser, so get the password up front.
+	_, err := chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
+	await window.__client.getCrypto().bootstrapCrossSigning({
+		setupNewCrossSigning: true,
+		authUploadDeviceSigningKeys: async function (makeRequest) {
+			return await makeRequest({
+				"type": "m.login.password",
+				"identifier": {
+					"type": "m.id.user",
+					"user": "%s",
+				},
+				"password": "%s",
+			});
+		},
+	});`, c.opts.UserID, authCallback()))
+	return err
 }
 
 func (c *JSClient) ensureListeningForVerificationRequests(t ct.TestLike) chan api.VerificationStage {
@@ -280,9 +530,17 @@ func (c *JSClient) ensureListeningForVerificationRequests(t ct.TestLike) chan ap
 		c.bootstrapCrossSigning(t)
 		// we need to support multiple transition stages firing at once
 		c.verificationChannel = make(chan api.VerificationStage, 4)
+		// Requests are tracked when they are received, and when we make in-room requests, as the JS SDK may
+		// not tell us about in-room requests we made. Each request is only tracked once.
 		chrome.MustRunAsyncFn[chrome.Void](t, c.browser.Ctx, `
-	window.__client.on(CryptoEvent.VerificationRequestReceived, function(request) {
-		console.log("CryptoEvent.VerificationRequestReceived fired: request.initiatedByMe " + request.initiatedByMe);
+	window.__trackVerificationRequest = function(request) {
+		if (!window.__pendingVerificationByTxnID) {
+			window.__pendingVerificationByTxnID = {};
+		}
+		if (window.__pendingVerificationByTxnID[request.transactionId]) {
+			return;
+		}
+		window.__pendingVerificationByTxnID[request.transactionId] = request;
 		request.on("change", () => {
 			console.log("RequestOwnUserVerification got phase " + request.phase);
 			switch(request.phase) {
@@ -336,10 +594,6 @@ func (c *JSClient) ensureListeningForVerificationRequests(t ct.TestLike) chan ap
 					break;
 			}
 		});
-		if (!window.__pendingVerificationByTxnID) {
-			window.__pendingVerificationByTxnID = {};
-		}
-		window.__pendingVerificationByTxnID[request.transactionId] = request;
 		// we may have requested this! Let's check.
 		const stage = request.initiatedByMe ? "Requested" : "VerificationRequestReceived";
 		`+EmitControlMessageVerificationJS(
@@ -349,6 +603,10 @@ func (c *JSClient) ensureListeningForVerificationRequests(t ct.TestLike) chan ap
 			"request.otherDeviceId",
 			"{}",
 		)+`
+	};
+	window.__client.on(CryptoEvent.VerificationRequestReceived, function(request) {
+		console.log("CryptoEvent.VerificationRequestReceived fired: request.initiatedByMe " + request.initiatedByMe);
+		window.__trackVerificationRequest(request);
 	});`)
 	}
 	return c.verificationChannel
@@ -357,6 +615,7 @@ func (c *JSClient) ensureListeningForVerificationRequests(t ct.TestLike) chan ap
 func (c *JSClient) ListenForVerificationRequests(t ct.TestLike) chan api.VerificationStage {
 	ch := c.ensureListeningForVerificationRequests(t)
 	txnIDsStarted := make(map[string]bool)
+	txnIDsTransitioned := make(map[string]bool)
 	c.listenForUpdates(func(ctrlMsg *ControlMessage) {
 		msg := ctrlMsg.AsControlMessageVerification()
 		if msg == nil {
@@ -385,7 +644,10 @@ func (c *JSClient) ListenForVerificationRequests(t ct.TestLike) chan api.Verific
 				chrome.MustRunAsyncFn[chrome.Void](t, c.browser.Ctx, `
 					const request = window.__pendingVerificationByTxnID["`+msg.TxnID+`"];
 					const verifier = request.verifier;
-					verifier.on(VerifierEvent.ShowSas, (sas) => {
+					if (!verifier) {
+						throw new Error("no verifier for " + request.transactionId + " in phase " + request.phase);
+					}
+					const emitSas = (sas) => {
 						`+EmitControlMessageVerificationJS(
 					`"TransitionSAS"`,
 					"request.transactionId",
@@ -393,9 +655,18 @@ func (c *JSClient) ListenForVerificationRequests(t ct.TestLike) chan api.Verific
 					"request.otherDeviceId",
 					"sas.sas",
 				)+`
-					});
+					};
+					verifier.on(VerifierEvent.ShowSas, emitSas);
+					// If the other side started the verification (e.g a rust SDK verifier), the SAS may
+					// have been calculated before we started listening, so emit it now.
+					const existingSas = verifier.getShowSasCallbacks();
+					if (existingSas) {
+						emitSas(existingSas);
+					}
 					// don't await on this as it blocks until the verification has completed/cancelled.
-					verifier.verify();
+					verifier.verify().catch((err) => {
+						console.log("verifier.verify() failed: " + err);
+					});
 				`)
 			},
 			SendCancel: func() {
@@ -440,6 +711,11 @@ func (c *JSClient) ListenForVerificationRequests(t ct.TestLike) chan api.Verific
 				ct.Errorf(t, "failed to unmarshal verification data: %s", err)
 			}
 			if len(verificationData.Decimal) > 0 || len(verificationData.Emoji) > 0 {
+				// the SAS can be emitted twice if it was calculated whilst we were adding the listener
+				if txnIDsTransitioned[msg.TxnID] {
+					return
+				}
+				txnIDsTransitioned[msg.TxnID] = true
 				var emoji []string
 				for _, e := range verificationData.Emoji {
 					emoji = append(emoji, e[0])
@@ -475,6 +751,18 @@ func (c *JSClient) RequestOwnUserVerification(t ct.TestLike) chan api.Verificati
 	return ch
 }
 
+func (c *JSClient) RequestUserVerification(t ct.TestLike, userID, roomID string) (chan api.VerificationStage, error) {
+	t.Helper()
+	ch := c.ListenForVerificationRequests(t)
+	_, err := chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
+	const request = await window.__client.getCrypto().requestVerificationDM("%s", "%s");
+	window.__trackVerificationRequest(request);`, userID, roomID))
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
 func (c *JSClient) ForceClose(t ct.TestLike) {
 	t.Helper()
 	t.Logf("force closing a JS client is the same as a normal close (closing browser)")
@@ -502,12 +790,90 @@ func (c *JSClient) Opts() api.ClientCreationOpts {
 }
 
 func (c *JSClient) InviteUser(t ct.TestLike, roomID, userID string) error {
+	if c.opts.EnableShareHistoryOnInvite {
+		canShare, err := chrome.RunAsyncFn[bool](t, c.browser.Ctx, `
+		return !!window.__client.getCrypto().shareRoomHistoryWithUser;
+		`)
+		if err != nil {
+			return fmt.Errorf("failed to share room history with %s: %s", userID, err)
+		}
+		if !*canShare {
+			return fmt.Errorf("sharing room history on invite: %w", api.ErrNotSupported)
+		}
+		_, err = chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
+		await window.__client.getCrypto().shareRoomHistoryWithUser("%s", "%s");
+		`, roomID, userID))
+		if err != nil {
+			return fmt.Errorf("failed to share room history with %s: %s", userID, err)
+		}
+	}
 	_, err := chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprint(`
 		await window.__client.invite("`, roomID, `","`, userID, `");
 	`))
 	return err
 }
 
+func (c *JSClient) IgnoreUser(t ct.TestLike, userID string) error {
+	t.Helper()
+	_, err := chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
+		const ignored = window.__client.getIgnoredUsers();
+		if (!ignored.includes("%s")) {
+			await window.__client.setIgnoredUsers([...ignored, "%s"]);
+		}
+	`, userID, userID))
+	return err
+}
+
+func (c *JSClient) UnignoreUser(t ct.TestLike, userID string) error {
+	t.Helper()
+	_, err := chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
+		const ignored = window.__client.getIgnoredUsers();
+		await window.__client.setIgnoredUsers(ignored.filter((u) => u !== "%s"));
+	`, userID))
+	return err
+}
+
+func (c *JSClient) JoinRoom(t ct.TestLike, roomID string, serverNames []string) error {
+	t.Helper()
+	viaServers, err := json.Marshal(serverNames)
+	if err != nil {
+		return fmt.Errorf("failed to marshal server names: %s", err)
+	}
+	_, err = chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
+		await window.__client.joinRoom("%s", {
+			viaServers: %s,
+			acceptSharedHistory: %v,
+		});
+	`, roomID, string(viaServers), c.opts.EnableShareHistoryOnInvite))
+	if err != nil {
+		return fmt.Errorf("failed to join room %s: %s", roomID, err)
+	}
+	return nil
+}
+
+func (c *JSClient) FollowTombstone(t ct.TestLike, roomID string, serverNames []string) (newRoomID string, err error) {
+	t.Helper()
+	res, err := chrome.RunAsyncFn[string](t, c.browser.Ctx, fmt.Sprintf(`
+		const room = window.__client.getRoom("%s");
+		if (!room) {
+			throw new Error("unknown room %s");
+		}
+		const tombstone = room.currentState.getStateEvents("m.room.tombstone", "");
+		const replacementRoomID = tombstone?.getContent().replacement_room;
+		if (!replacementRoomID) {
+			throw new Error("room %s has no tombstone");
+		}
+		return replacementRoomID;
+	`, roomID, roomID, roomID))
+	if err != nil {
+		return "", fmt.Errorf("FollowTombstone: %s", err)
+	}
+	if err = c.JoinRoom(t, *res, serverNames); err != nil {
+		return "", fmt.Errorf("FollowTombstone: %s", err)
+	}
+	return *res, nil
+}
+
 func (c *JSClient) GetEvent(t ct.TestLike, roomID, eventID string) (*api.Event, error) {
 	t.Helper()
 	// serialised output (if encrypted):
@@ -517,10 +883,23 @@ func (c *JSClient) GetEvent(t ct.TestLike, roomID, eventID string) (*api.Event,
 	// }
 	// else just returns { event }
 	evSerialised, err := chrome.RunAsyncFn[string](t, c.browser.Ctx, fmt.Sprintf(`
-	return JSON.stringify(window.__client.getRoom("%s")?.getLiveTimeline()?.getEvents().filter((ev, i) => {
+	const ev = window.__client.getRoom("%s")?.getLiveTimeline()?.getEvents().filter((ev, i) => {
 		console.log("MustGetEvent["+i+"] => " + ev.getId()+ " " + JSON.stringify(ev.toJSON()));
 		return ev.getId() === "%s";
-	})[0].toJSON());
+	})[0];
+	if (!ev) {
+		return JSON.stringify(ev);
+	}
+	const serialised = (`+eventToJSONJS+`)(ev);
+	const content = ev.getContent();
+	if (content.msgtype === "m.file" && content.file) {
+		try {
+			serialised.file_contents = await (`+downloadAttachmentJS+`)(content.file);
+		} catch (err) {
+			serialised.file_error = err.toString();
+		}
+	}
+	return JSON.stringify(serialised);
 	`, roomID, eventID))
 	if err != nil {
 		return nil, fmt.Errorf("failed to get event %s: %s", eventID, err)
@@ -528,7 +907,117 @@ func (c *JSClient) GetEvent(t ct.TestLike, roomID, eventID string) (*api.Event,
 	if !gjson.Valid(*evSerialised) {
 		return nil, fmt.Errorf("invalid event %s, got %s", eventID, *evSerialised)
 	}
-	result := gjson.Parse(*evSerialised)
+	return serialisedEventToEvent(gjson.Parse(*evSerialised)), nil
+}
+
+func (c *JSClient) GetThread(t ct.TestLike, roomID, threadRootID string) ([]*api.Event, error) {
+	t.Helper()
+	threadSerialised, err := chrome.RunAsyncFn[string](t, c.browser.Ctx, fmt.Sprintf(`
+	const res = await window.__client.relations("%s", "%s", "m.thread", null, { dir: "f" });
+	// the event mapper starts decrypting events but does not wait for them.
+	await Promise.all(res.events.map((ev) => window.__client.decryptEventIfNeeded(ev)));
+	return JSON.stringify(res.events.map(`+eventToJSONJS+`));
+	`, roomID, threadRootID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get thread %s in room %s: %s", threadRootID, roomID, err)
+	}
+	if !gjson.Valid(*threadSerialised) {
+		return nil, fmt.Errorf("invalid thread %s in room %s, got %s", threadRootID, roomID, *threadSerialised)
+	}
+	var thread []*api.Event
+	for _, result := range gjson.Parse(*threadSerialised).Array() {
+		thread = append(thread, serialisedEventToEvent(result))
+	}
+	return thread, nil
+}
+
+// MarkAsRead sends a read receipt for the last event in the live timeline, regardless of whether it was decrypted.
+func (c *JSClient) MarkAsRead(t ct.TestLike, roomID string) error {
+	t.Helper()
+	_, err := chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
+	const room = window.__client.getRoom("%s");
+	if (!room) {
+		throw new Error("room does not exist");
+	}
+	const ev = room.getLiveTimeline().getEvents().at(-1);
+	if (!ev) {
+		throw new Error("room has no events");
+	}
+	await window.__client.sendReadReceipt(ev, "m.read");`, roomID))
+	return err
+}
+
+// GetReadReceipt returns the event in the user's m.read receipt, ignoring receipts the SDK synthesizes for the
+// user's own messages.
+func (c *JSClient) GetReadReceipt(t ct.TestLike, roomID, userID string) (eventID string, err error) {
+	t.Helper()
+	receipt, err := chrome.RunAsyncFn[string](t, c.browser.Ctx, fmt.Sprintf(`
+	const room = window.__client.getRoom("%s");
+	if (!room) {
+		throw new Error("room does not exist");
+	}
+	return room.getReadReceiptForUserId("%s", true, "m.read")?.eventId || "";`, roomID, userID))
+	if err != nil {
+		return "", err
+	}
+	return *receipt, nil
+}
+
+func (c *JSClient) GetTimeline(t ct.TestLike, roomID string) ([]*api.Event, error) {
+	t.Helper()
+	timelineSerialised, err := chrome.RunAsyncFn[string](t, c.browser.Ctx, fmt.Sprintf(`
+	const room = window.__client.getRoom("%s");
+	if (!room) {
+		throw new Error("room does not exist");
+	}
+	return JSON.stringify(room.getLiveTimeline().getEvents().map(`+eventToJSONJS+`));
+	`, roomID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get timeline for room %s: %s", roomID, err)
+	}
+	if !gjson.Valid(*timelineSerialised) {
+		return nil, fmt.Errorf("invalid timeline for room %s, got %s", roomID, *timelineSerialised)
+	}
+	var timeline []*api.Event
+	for _, result := range gjson.Parse(*timelineSerialised).Array() {
+		timeline = append(timeline, serialisedEventToEvent(result))
+	}
+	return timeline, nil
+}
+
+// eventToJSONJS is a JS function which serialises a MatrixEvent with MatrixEvent.toJSON(), adding
+// why it failed to decrypt as decryption_failure_reason, as this is not included in the event JSON.
+const eventToJSONJS = `(ev) => Object.assign(ev.toJSON(), { decryption_failure_reason: ev.decryptionFailureReason })`
+
+// downloadAttachmentJS is a JS function which downloads the encrypted attachment described by an
+// EncryptedFile, verifies its hash then decrypts it, returning the plaintext as base64.
+const downloadAttachmentJS = `async (file) => {
+	const url = window.__client.mxcUrlToHttp(file.url, undefined, undefined, undefined, false, true, true);
+	const res = await fetch(url, {
+		headers: { Authorization: "Bearer " + window.__client.getAccessToken() },
+	});
+	if (!res.ok) {
+		throw new Error("failed to download " + file.url + ": HTTP " + res.status);
+	}
+	const ciphertext = await res.arrayBuffer();
+	const fromBase64 = (s) => Uint8Array.from(atob(s), (c) => c.charCodeAt(0));
+	const hash = new Uint8Array(await crypto.subtle.digest("SHA-256", ciphertext));
+	const wantHash = fromBase64(file.hashes.sha256);
+	if (hash.length !== wantHash.length || hash.some((b, i) => b !== wantHash[i])) {
+		throw new Error("sha256 mismatch for " + file.url);
+	}
+	const key = await crypto.subtle.importKey("jwk", file.key, { name: "AES-CTR" }, false, ["encrypt", "decrypt"]);
+	const plaintext = new Uint8Array(await crypto.subtle.decrypt(
+		{ name: "AES-CTR", counter: fromBase64(file.iv), length: 64 }, key, ciphertext,
+	));
+	let binary = "";
+	plaintext.forEach((b) => { binary += String.fromCharCode(b); });
+	return btoa(binary);
+}`
+
+// serialisedEventToEvent converts the output of eventToJSONJS into an api.Event, including any
+// file_contents or file_error added by GetEvent.
+func serialisedEventToEvent(result gjson.Result) *api.Event {
 	decryptedEvent := result.Get("decrypted")
 	if !decryptedEvent.Exists() {
 		decryptedEvent = result
@@ -539,40 +1028,104 @@ func (c *JSClient) GetEvent(t ct.TestLike, roomID, eventID string) (*api.Event,
 		ID:     decryptedEvent.Get("event_id").Str,
 		Text:   decryptedEvent.Get("content.body").Str,
 		Sender: decryptedEvent.Get("sender").Str,
+		Type:   decryptedEvent.Get("type").Str,
 	}
 	if decryptedEvent.Get("type").Str == "m.room.member" {
 		ev.Membership = decryptedEvent.Get("content.membership").Str
 		ev.Target = decryptedEvent.Get("state_key").Str
 	}
+	if stateKey := decryptedEvent.Get("state_key"); stateKey.Exists() {
+		ev.StateKey = &stateKey.Str
+	} else if stateKey := encryptedEvent.Get("state_key"); stateKey.Exists() {
+		// MSC3414: encrypted state events have a state key of the form "<type>:<state_key>"
+		packed := strings.TrimPrefix(stateKey.Str, ev.Type+":")
+		ev.StateKey = &packed
+	}
+	if ev.Type == "m.room.topic" {
+		ev.Text = decryptedEvent.Get("content.topic").Str
+	}
+	// m.relates_to is not encrypted, so may only be on the encrypted event
+	relatesTo := decryptedEvent.Get("content.m\\.relates_to")
+	if !relatesTo.Exists() {
+		relatesTo = encryptedEvent.Get("content.m\\.relates_to")
+	}
+	switch relatesTo.Get("rel_type").Str {
+	case "m.replace":
+		// edits are separate events, whose body is a fallback e.g "* new body"
+		ev.EditOf = relatesTo.Get("event_id").Str
+		ev.Text = decryptedEvent.Get("content.m\\.new_content.body").Str
+	case "m.thread":
+		ev.ThreadRoot = relatesTo.Get("event_id").Str
+	}
+	if decryptedEvent.Get("content.msgtype").Str == "m.file" {
+		ev.File = &api.EventFile{
+			Name:          decryptedEvent.Get("content.filename").Str,
+			DownloadError: result.Get("file_error").Str,
+		}
+		if ev.File.Name == "" {
+			ev.File.Name = ev.Text
+		}
+		if fileContents := result.Get("file_contents"); fileContents.Exists() {
+			contents, err := base64.StdEncoding.DecodeString(fileContents.Str)
+			if err != nil {
+				ev.File.DownloadError = fmt.Sprintf("failed to decode file contents: %s", err)
+			} else {
+				ev.File.Contents = contents
+			}
+		}
+	}
+	if encryptedEvent.Exists() {
+		ev.SessionID = encryptedEvent.Get("content.session_id").Str
+	}
 	if encryptedEvent.Exists() && decryptedEvent.Get("content.msgtype").Str == "m.bad.encrypted" {
 		ev.FailedToDecrypt = true
+		// the JS SDK replaces the type as well as the content, so report the type of the encrypted event
+		ev.Type = "m.room.encrypted"
+		ev.DecryptionFailureReason = jsDecryptionFailureReason(result.Get("decryption_failure_reason").Str)
+		if encryptedEvent.Get("content.algorithm").Str != "m.megolm.v1.aes-sha2" {
+			ev.DecryptionFailureReason = api.DecryptionFailureReasonMalformedEvent
+		}
+		switch result.Get("decryption_failure_reason").Str {
+		case "MEGOLM_KEY_WITHHELD_FOR_UNVERIFIED_DEVICE":
+			ev.WithheldCode = api.WithheldCodeUnverified
+		case "MEGOLM_KEY_WITHHELD":
+			ev.WithheldCode = api.WithheldCodeOther
+		}
 	}
+	return ev
+}
 
-	return ev, nil
+// jsDecryptionFailureReason maps a DecryptionFailureCode from the JS SDK onto the reasons used by all SDKs.
+// The JS SDK distinguishes an unknown session from an unknown message index, but other SDKs do not, so both
+// are treated as a missing key.
+func jsDecryptionFailureReason(code string) api.DecryptionFailureReason {
+	switch code {
+	case "MEGOLM_UNKNOWN_INBOUND_SESSION_ID", "OLM_UNKNOWN_MESSAGE_INDEX":
+		return api.DecryptionFailureReasonMissingKey
+	case "MEGOLM_KEY_WITHHELD", "MEGOLM_KEY_WITHHELD_FOR_UNVERIFIED_DEVICE":
+		return api.DecryptionFailureReasonWithheld
+	case "HISTORICAL_MESSAGE_NO_KEY_BACKUP", "HISTORICAL_MESSAGE_BACKUP_UNCONFIGURED", "HISTORICAL_MESSAGE_WORKING_BACKUP":
+		return api.DecryptionFailureReasonHistoricalKeyUnavailable
+	case "HISTORICAL_MESSAGE_USER_NOT_JOINED":
+		return api.DecryptionFailureReasonSentBeforeJoined
+	case "SENDER_IDENTITY_PREVIOUSLY_VERIFIED", "UNSIGNED_SENDER_DEVICE", "UNKNOWN_SENDER_DEVICE":
+		return api.DecryptionFailureReasonSenderNotTrusted
+	default:
+		return api.DecryptionFailureReasonUnknown
+	}
 }
 
 // StartSyncing to begin syncing from sync v2 / sliding sync.
 // Tests should call stopSyncing() at the end of the test.
 func (c *JSClient) StartSyncing(t ct.TestLike) (stopSyncing func(), err error) {
 	t.Helper()
-	_, err = chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
-		var fn;
-		fn = function(state) {
-			if (state !== "SYNCING") {
-				return;
-			}
-			`+EmitControlMessageSyncJS()+`
-
-			window.__client.off("sync", fn);
-		};
-		window.__client.on("sync", fn);`))
-	if err != nil {
-		return nil, fmt.Errorf("[%s]failed to listen for sync callback: %s", c.userID, err)
-	}
 	ch := make(chan struct{})
+	var once sync.Once
 	cancel := c.listenForUpdates(func(ctrlMsg *ControlMessage) {
-		if msg := ctrlMsg.AsControlMessageSync(); msg != nil {
-			close(ch)
+		if msg := ctrlMsg.AsControlMessageSync(); msg != nil && msg.State == "SYNCING" {
+			once.Do(func() {
+				close(ch)
+			})
 		}
 	})
 	chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, `await window.__client.startClient({});`)
@@ -591,6 +1144,120 @@ func (c *JSClient) StartSyncing(t ct.TestLike) (stopSyncing func(), err error) {
 	}, nil
 }
 
+func (c *JSClient) ListenForSyncStates(t ct.TestLike, callback func(s api.SyncState)) (cancel func(), err error) {
+	return c.syncStateListeners.Add(callback), nil
+}
+
+func (c *JSClient) ClearCacheAndRestart(t ct.TestLike) error {
+	t.Helper()
+	// We cannot call stopClient() here as that also stops the crypto backend, which cannot
+	// be restarted without making a new client. Instead, just stop the sync loop.
+	wasSyncing, err := chrome.RunAsyncFn[bool](t, c.browser.Ctx, `
+		const wasSyncing = window.__client.clientRunning;
+		window.__client.syncApi?.stop();
+		window.__client.syncApi = undefined;
+		window.__client.clientRunning = false;
+		// this drops all rooms and the sync token, but not the crypto store.
+		await window.__client.store.deleteAllData();
+		return wasSyncing;`)
+	if err != nil {
+		return fmt.Errorf("[%s]failed to clear cache: %s", c.userID, err)
+	}
+	if !*wasSyncing {
+		return nil
+	}
+	// the stopSyncing function from the first StartSyncing call will still work as it calls stopClient().
+	_, err = c.StartSyncing(t)
+	return err
+}
+
+// Restart reloads the page, dropping all in-memory state, then creates the client again from its IndexedDB
+// stores with the same access token.
+func (c *JSClient) Restart(t ct.TestLike) error {
+	t.Helper()
+	if !c.opts.PersistentStorage {
+		return fmt.Errorf("Restart: requires PersistentStorage")
+	}
+	session, err := chrome.RunAsyncFn[map[string]any](t, c.browser.Ctx, `
+		const session = {
+			access_token: window.__client.getAccessToken(),
+			device_id: window.__client.getDeviceId(),
+			was_syncing: window.__client.clientRunning,
+		};
+		// flush the sync store to IndexedDB, then shut down the client including the crypto backend.
+		await window.__client.store.save(true);
+		window.__client.stopClient();
+		return session;`)
+	if err != nil {
+		return fmt.Errorf("Restart: failed to stop client: %s", err)
+	}
+	accessToken, _ := (*session)["access_token"].(string)
+	deviceID, _ := (*session)["device_id"].(string)
+	wasSyncing, _ := (*session)["was_syncing"].(bool)
+	if err = c.browser.Reload(); err != nil {
+		return fmt.Errorf("Restart: %s", err)
+	}
+	c.listeningForEvents = false
+	if err = c.createClient(t, accessToken, deviceID); err != nil {
+		return fmt.Errorf("Restart: failed to create client: %s", err)
+	}
+	if err = c.listenForEvents(t); err != nil {
+		return fmt.Errorf("Restart: failed to listen for events: %s", err)
+	}
+	if !wasSyncing {
+		return nil
+	}
+	// the stopSyncing function from the first StartSyncing call will still work as it calls stopClient().
+	_, err = c.StartSyncing(t)
+	return err
+}
+
+// Kill reloads the page without flushing the stores or stopping the client, which is what happens when a tab
+// crashes. IndexedDB transactions which have not been committed are aborted.
+func (c *JSClient) Kill(t ct.TestLike) error {
+	t.Helper()
+	if !c.opts.PersistentStorage {
+		return fmt.Errorf("Kill: requires PersistentStorage")
+	}
+	session, err := chrome.RunAsyncFn[jsSession](t, c.browser.Ctx, `
+		return {
+			access_token: window.__client.getAccessToken(),
+			device_id: window.__client.getDeviceId(),
+		};`)
+	if err != nil {
+		return fmt.Errorf("Kill: failed to get session: %s", err)
+	}
+	if err = c.browser.Reload(); err != nil {
+		return fmt.Errorf("Kill: %s", err)
+	}
+	c.listeningForEvents = false
+	c.killedSession = session
+	return nil
+}
+
+// RestoreFromStorage creates the client again from its IndexedDB stores with the access token it had when killed.
+func (c *JSClient) RestoreFromStorage(t ct.TestLike) error {
+	t.Helper()
+	if c.killedSession == nil {
+		return fmt.Errorf("RestoreFromStorage: client was not killed")
+	}
+	if err := c.createClient(t, c.killedSession.AccessToken, c.killedSession.DeviceID); err != nil {
+		return fmt.Errorf("RestoreFromStorage: failed to create client: %s", err)
+	}
+	c.killedSession = nil
+	if err := c.listenForEvents(t); err != nil {
+		return fmt.Errorf("RestoreFromStorage: failed to listen for events: %s", err)
+	}
+	return nil
+}
+
+// SetStorePassphrase sets the password given to initRustCrypto when the client is next created, which is
+// used to encrypt the crypto store in IndexedDB.
+func (c *JSClient) SetStorePassphrase(t ct.TestLike, passphrase string) error {
+	c.opts.StorePassphrase = passphrase
+	return nil
+}
+
 // IsRoomEncrypted returns true if the room is encrypted. May return an error e.g if you
 // provide a bogus room ID.
 func (c *JSClient) IsRoomEncrypted(t ct.TestLike, roomID string) (bool, error) {
@@ -604,6 +1271,41 @@ func (c *JSClient) IsRoomEncrypted(t ct.TestLike, roomID string) (bool, error) {
 	return *isEncrypted, nil
 }
 
+// GetEncryptionAlgorithm returns the algorithm in the room's current m.room.encryption state event.
+func (c *JSClient) GetEncryptionAlgorithm(t ct.TestLike, roomID string) (string, error) {
+	t.Helper()
+	algorithm, err := chrome.RunAsyncFn[string](t, c.browser.Ctx, fmt.Sprintf(`
+	const room = window.__client.getRoom("%s");
+	if (!room) {
+		throw new Error("unknown room %s");
+	}
+	const ev = room.currentState.getStateEvents("m.room.encryption", "");
+	return ev?.getContent()?.algorithm || "";`,
+		roomID, roomID,
+	))
+	if err != nil {
+		return "", err
+	}
+	return *algorithm, nil
+}
+
+// IsDirect returns true if the room is a direct message room, based on the m.direct account data.
+func (c *JSClient) IsDirect(t ct.TestLike, roomID string) (bool, error) {
+	t.Helper()
+	isDirect, err := chrome.RunAsyncFn[bool](t, c.browser.Ctx, fmt.Sprintf(`
+	if (!window.__client.getRoom("%s")) {
+		throw new Error("unknown room %s");
+	}
+	const direct = window.__client.getAccountData("m.direct")?.getContent() || {};
+	return Object.values(direct).some((roomIDs) => Array.isArray(roomIDs) && roomIDs.includes("%s"));`,
+		roomID, roomID, roomID,
+	))
+	if err != nil {
+		return false, err
+	}
+	return *isDirect, nil
+}
+
 func (c *JSClient) SendMessage(t ct.TestLike, roomID, text string) (eventID string, err error) {
 	t.Helper()
 	res, err := chrome.RunAsyncFn[map[string]interface{}](t, c.browser.Ctx, fmt.Sprintf(`
@@ -617,16 +1319,167 @@ func (c *JSClient) SendMessage(t ct.TestLike, roomID, text string) (eventID stri
 	return (*res)["event_id"].(string), nil
 }
 
-func (c *JSClient) Backpaginate(t ct.TestLike, roomID string, count int) error {
+func (c *JSClient) SendThreadedMessage(t ct.TestLike, roomID, threadRootID, text string) (eventID string, err error) {
+	t.Helper()
+	// sendMessage adds the m.thread relation when given a thread ID
+	res, err := chrome.RunAsyncFn[map[string]interface{}](t, c.browser.Ctx, fmt.Sprintf(`
+	return await window.__client.sendMessage("%s", "%s", {
+		"msgtype": "m.text",
+		"body": "%s"
+	});`, roomID, threadRootID, text))
+	if err != nil {
+		return "", err
+	}
+	return (*res)["event_id"].(string), nil
+}
+
+func (c *JSClient) SendEncryptedFile(t ct.TestLike, roomID, filename string, contents []byte) (eventID string, err error) {
+	t.Helper()
+	// Encrypt the file as per https://spec.matrix.org/v1.11/client-server-api/#sending-encrypted-attachments
+	res, err := chrome.RunAsyncFn[map[string]interface{}](t, c.browser.Ctx, fmt.Sprintf(`
+	const plaintext = Uint8Array.from(atob("%s"), (c) => c.charCodeAt(0));
+	const toUnpaddedBase64 = (bytes) => btoa(String.fromCharCode(...new Uint8Array(bytes))).replace(/=+$/, "");
+	const key = await crypto.subtle.generateKey({ name: "AES-CTR", length: 256 }, true, ["encrypt", "decrypt"]);
+	// the top 8 bytes are random, the bottom 8 bytes are the counter
+	const iv = new Uint8Array(16);
+	crypto.getRandomValues(iv.subarray(0, 8));
+	const ciphertext = await crypto.subtle.encrypt({ name: "AES-CTR", counter: iv, length: 64 }, key, plaintext);
+	const hash = await crypto.subtle.digest("SHA-256", ciphertext);
+	const upload = await window.__client.uploadContent(new Blob([ciphertext]), {
+		type: "application/octet-stream",
+		name: "%s",
+	});
+	return await window.__client.sendMessage("%s", {
+		"msgtype": "m.file",
+		"body": "%s",
+		"filename": "%s",
+		"info": {
+			"mimetype": "application/octet-stream",
+			"size": plaintext.length,
+		},
+		"file": {
+			"v": "v2",
+			"url": upload.content_uri,
+			"key": await crypto.subtle.exportKey("jwk", key),
+			"iv": toUnpaddedBase64(iv),
+			"hashes": { "sha256": toUnpaddedBase64(hash) },
+		},
+	});`, base64.StdEncoding.EncodeToString(contents), filename, roomID, filename, filename))
+	if err != nil {
+		return "", err
+	}
+	return (*res)["event_id"].(string), nil
+}
+
+func (c *JSClient) RedactEvent(t ct.TestLike, roomID, eventID, reason string) error {
+	t.Helper()
+	_, err := chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
+		const reason = "%s";
+		await window.__client.redactEvent("%s", "%s", undefined, reason ? { reason } : undefined);
+	`, reason, roomID, eventID))
+	if err != nil {
+		return fmt.Errorf("failed to redact event %s: %s", eventID, err)
+	}
+	return nil
+}
+
+func (c *JSClient) React(t ct.TestLike, roomID, eventID, key string) error {
+	t.Helper()
+	_, err := chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
+	await window.__client.sendEvent("%s", "m.reaction", {
+		"m.relates_to": {
+			"rel_type": "m.annotation",
+			"event_id": "%s",
+			"key": "%s"
+		}
+	});`, roomID, eventID, key))
+	if err != nil {
+		return fmt.Errorf("failed to react to event %s: %s", eventID, err)
+	}
+	return nil
+}
+
+func (c *JSClient) EditMessage(t ct.TestLike, roomID, eventID, newBody string) error {
+	t.Helper()
+	_, err := chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
+	await window.__client.sendMessage("%s", {
+		"msgtype": "m.text",
+		"body": "* %s",
+		"m.new_content": {
+			"msgtype": "m.text",
+			"body": "%s"
+		},
+		"m.relates_to": {
+			"rel_type": "m.replace",
+			"event_id": "%s"
+		}
+	});`, roomID, newBody, newBody, eventID))
+	if err != nil {
+		return fmt.Errorf("failed to edit event %s: %s", eventID, err)
+	}
+	return nil
+}
+
+func (c *JSClient) SetRoomTopic(t ct.TestLike, roomID, topic string) (string, error) {
+	t.Helper()
+	eventID, err := chrome.RunAsyncFn[string](t, c.browser.Ctx, fmt.Sprintf(`
+		const res = await window.__client.setRoomTopic("%s", "%s");
+		return res.event_id;`, roomID, topic))
+	if err != nil {
+		return "", fmt.Errorf("failed to set topic in room %s: %s", roomID, err)
+	}
+	return *eventID, nil
+}
+
+func (c *JSClient) GetOutboundSessionID(t ct.TestLike, roomID, eventID string) (sessionID string, err error) {
 	t.Helper()
-	_, err := chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(
-		`await window.__client.scrollback(window.__client.getRoom("%s"), %d);`, roomID, count,
+	res, err := chrome.RunAsyncFn[string](t, c.browser.Ctx, fmt.Sprintf(`
+		const ev = window.__client.getRoom("%s")?.findEventById("%s");
+		if (!ev) {
+			throw new Error("unknown event %s");
+		}
+		if (ev.getSender() !== window.__client.getUserId()) {
+			throw new Error("event %s was sent by " + ev.getSender());
+		}
+		if (!ev.isEncrypted()) {
+			throw new Error("event %s is not encrypted");
+		}
+		return ev.getWireContent().session_id;
+	`, roomID, eventID, eventID, eventID, eventID))
+	if err != nil {
+		return "", fmt.Errorf("GetOutboundSessionID(%s): %s", eventID, err)
+	}
+	return *res, nil
+}
+
+// GetOutboundSessionInfo is not supported as the JS SDK does not expose outbound sessions, and neither does
+// the OlmMachine from matrix-sdk-crypto-wasm which it uses.
+func (c *JSClient) GetOutboundSessionInfo(t ct.TestLike, roomID string) (*api.OutboundSessionInfo, error) {
+	return nil, fmt.Errorf("GetOutboundSessionInfo: %w", api.ErrNotSupported)
+}
+
+func (c *JSClient) Backpaginate(t ct.TestLike, roomID string, count int) ([]*api.Event, error) {
+	t.Helper()
+	_, err := chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
+	const room = window.__client.getRoom("%s");
+	await window.__client.scrollback(room, %d);
+	// scrollback returns before paginated events are decrypted, so wait for them.
+	await Promise.all(room.getLiveTimeline().getEvents().map((ev) => window.__client.decryptEventIfNeeded(ev)));`,
+		roomID, count,
 	))
-	return err
+	if err != nil {
+		return nil, err
+	}
+	return c.GetTimeline(t, roomID)
 }
 
 func (c *JSClient) BackupKeys(t ct.TestLike) (recoveryKey string, err error) {
 	t.Helper()
+	switch c.opts.BackupAlgorithm {
+	case api.BackupAlgorithmDefault, api.BackupAlgorithmCurve25519AESSHA2:
+	default:
+		return "", fmt.Errorf("BackupKeys: backup algorithm %s: %w", c.opts.BackupAlgorithm, api.ErrNotSupported)
+	}
 	key, err := chrome.RunAsyncFn[string](t, c.browser.Ctx, `
 		// we need to ensure that we have a recovery key first, though we don't actually care about it..?
 		const recoveryKey = await window.__client.getCrypto().createRecoveryKeyFromPassphrase();
@@ -649,6 +1502,12 @@ func (c *JSClient) BackupKeys(t ct.TestLike) (recoveryKey string, err error) {
 	return *key, nil
 }
 
+// ListenForBackupStates only reports BackupStateDisabled and BackupStateEnabled, as the JS SDK only emits
+// whether backups are enabled.
+func (c *JSClient) ListenForBackupStates(t ct.TestLike, ctx context.Context) (<-chan api.BackupState, error) {
+	return c.backupStateListeners.Listen(ctx), nil
+}
+
 func (c *JSClient) LoadBackup(t ct.TestLike, recoveryKey string) error {
 	_, err := chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
 		// we assume the recovery key is the private key for the default key id so
@@ -667,17 +1526,204 @@ func (c *JSClient) LoadBackup(t ct.TestLike, recoveryKey string) error {
 	return err
 }
 
+// ExportRoomKeys exports the room keys as JSON from the SDK, as it can only encrypt exports with the slow passphrase
+// derivation Element uses, then encrypts them in Go instead.
+func (c *JSClient) ExportRoomKeys(t ct.TestLike, passphrase string) ([]byte, error) {
+	sessionsJSON, err := chrome.RunAsyncFn[string](t, c.browser.Ctx, `
+		return await window.__client.getCrypto().exportRoomKeysAsJson();`)
+	if err != nil {
+		return nil, fmt.Errorf("ExportRoomKeys: %s", err)
+	}
+	return keyexport.Encrypt([]byte(*sessionsJSON), passphrase, keyexport.DefaultRounds)
+}
+
+func (c *JSClient) ImportRoomKeys(t ct.TestLike, export []byte, passphrase string) error {
+	sessionsJSON, err := keyexport.Decrypt(export, passphrase)
+	if err != nil {
+		return fmt.Errorf("ImportRoomKeys: %s", err)
+	}
+	// the sessions are base64 encoded so they can be embedded in the JS safely
+	_, err = chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
+		await window.__client.getCrypto().importRoomKeysAsJson(atob("%s"));`,
+		base64.StdEncoding.EncodeToString(sessionsJSON)))
+	if err != nil {
+		return fmt.Errorf("ImportRoomKeys: %s", err)
+	}
+	return nil
+}
+
+func (c *JSClient) CreateSecretStorageKey(t ct.TestLike) (recoveryKey string, err error) {
+	// the new key is cached via the cacheSecretStorageKey callback, so this client can use it straight away.
+	key, err := chrome.RunAsyncFn[string](t, c.browser.Ctx, `
+		const recoveryKey = await window.__client.getCrypto().createRecoveryKeyFromPassphrase();
+		await window.__client.getCrypto().bootstrapSecretStorage({
+			createSecretStorageKey: async() => { return recoveryKey; },
+			setupNewSecretStorage: true,
+		});
+		return recoveryKey.encodedPrivateKey;`)
+	if err != nil {
+		return "", err
+	}
+	return *key, nil
+}
+
+func (c *JSClient) UnlockSecretStorage(t ct.TestLike, recoveryKey string) error {
+	_, err := chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
+		const defaultKey = await window.__client.secretStorage.getKey();
+		if (!defaultKey) {
+			throw new Error("there is no default secret storage key");
+		}
+		const [keyId, keyInfo] = defaultKey;
+		const key = window.decodeRecoveryKey("%s");
+		if (!(await window.__client.secretStorage.checkKey(key, keyInfo))) {
+			throw new Error("recovery key is not for the default secret storage key " + keyId);
+		}
+		// getSecretStorageKey returns keys from this cache
+		window._secretStorageKeys[keyId] = {
+			keyInfo: keyInfo,
+			key: key,
+		};`, recoveryKey))
+	return err
+}
+
+func (c *JSClient) StoreSecret(t ct.TestLike, name, value string) error {
+	_, err := chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
+		await window.__client.secretStorage.store("%s", "%s");`, name, value))
+	return err
+}
+
+func (c *JSClient) GetSecret(t ct.TestLike, name string) (value string, err error) {
+	secret, err := chrome.RunAsyncFn[string](t, c.browser.Ctx, fmt.Sprintf(`
+		const secret = await window.__client.secretStorage.get("%s");
+		if (secret === undefined) {
+			throw new Error("no secret named %s");
+		}
+		return secret;`, name, name))
+	if err != nil {
+		return "", err
+	}
+	return *secret, nil
+}
+
+func (c *JSClient) CreateDehydratedDevice(t ct.TestLike) error {
+	_, err := chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, `
+		const crypto = window.__client.getCrypto();
+		if (!(await crypto.isDehydrationSupported())) {
+			throw new Error("homeserver does not support MSC3814 dehydrated devices");
+		}
+		// store a new dehydration key in secret storage and upload a new dehydrated device
+		await crypto.startDehydration(true);`)
+	return err
+}
+
+func (c *JSClient) RehydrateDevice(t ct.TestLike, recoveryKey string) error {
+	_, err := chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
+		// the dehydration key is in secret storage, which is unlocked by the recovery key. See LoadBackup.
+		const keyId = await window.__client.secretStorage.getDefaultKeyId();
+		window._secretStorageKeys[keyId] = {
+			keyInfo: {},
+			key: window.decodeRecoveryKey("%s"),
+		}
+		// the JS SDK logs rehydration errors rather than throwing them
+		let rehydrationError = null;
+		const onError = (msg) => { rehydrationError = msg; };
+		if (CryptoEvent.RehydrationError) {
+			window.__client.on(CryptoEvent.RehydrationError, onError);
+		}
+		try {
+			// this rehydrates the existing dehydrated device, then replaces it with a new one
+			await window.__client.getCrypto().startDehydration(false);
+		} finally {
+			if (CryptoEvent.RehydrationError) {
+				window.__client.off(CryptoEvent.RehydrationError, onError);
+			}
+		}
+		if (rehydrationError) {
+			throw new Error("failed to rehydrate device: " + rehydrationError);
+		}`, recoveryKey))
+	return err
+}
+
+func (c *JSClient) RequestRoomKey(t ct.TestLike, roomID, sessionID string) error {
+	_, err := chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
+		const room = window.__client.getRoom("%s");
+		if (!room) {
+			throw new Error("unknown room %s");
+		}
+		const events = room.getLiveTimeline().getEvents().filter((ev) => {
+			return ev.isDecryptionFailure() && ev.getWireContent().session_id === "%s";
+		});
+		if (events.length === 0) {
+			throw new Error("no undecryptable events for session %s");
+		}
+		// The JS SDK disables room key requests, but the rust crypto OlmMachine still sends one when it fails
+		// to decrypt an event if they are enabled. If the key arrives, the JS SDK retries decryption.
+		const crypto = window.__client.getCrypto();
+		crypto.olmMachine.roomKeyRequestsEnabled = true;
+		await events[0].attemptDecryption(crypto, { isRetry: true });
+		await crypto.outgoingRequestsManager.doProcessOutgoingRequests();`, roomID, roomID, sessionID, sessionID))
+	return err
+}
+
+// CancelRoomKeyRequest is not supported as the rust crypto OlmMachine only cancels room key requests
+// when it receives the key.
+func (c *JSClient) CancelRoomKeyRequest(t ct.TestLike, roomID, sessionID string) error {
+	return fmt.Errorf("CancelRoomKeyRequest: %w", api.ErrNotSupported)
+}
+
+// RetryDecryption retries decrypting events in the live timeline which failed to decrypt. The JS SDK emits
+// Event.decrypted for newly decrypted events, which is reported to timeline listeners.
+func (c *JSClient) RetryDecryption(t ct.TestLike, roomID string, sessionIDs []string) error {
+	t.Helper()
+	sessionIDsJSON, err := json.Marshal(sessionIDs)
+	if err != nil {
+		return fmt.Errorf("RetryDecryption: %s", err)
+	}
+	_, err = chrome.RunAsyncFn[chrome.Void](t, c.browser.Ctx, fmt.Sprintf(`
+		const room = window.__client.getRoom("%s");
+		if (!room) {
+			throw new Error("unknown room %s");
+		}
+		const sessionIDs = %s || [];
+		const events = room.getLiveTimeline().getEvents().filter((ev) => {
+			return ev.isDecryptionFailure() && (
+				sessionIDs.length === 0 || sessionIDs.includes(ev.getWireContent().session_id)
+			);
+		});
+		const crypto = window.__client.getCrypto();
+		await Promise.all(events.map((ev) => ev.attemptDecryption(crypto, { isRetry: true })));`,
+		roomID, roomID, string(sessionIDsJSON)))
+	return err
+}
+
+// FallbackKeyUsed returns true if a sync response has listed no unused signed_curve25519 fallback key after
+// a previous sync response listed one. This is recorded by wrapping the crypto backend's processKeyCounts.
+func (c *JSClient) FallbackKeyUsed(t ct.TestLike) (used bool, err error) {
+	t.Helper()
+	res, err := chrome.RunAsyncFn[bool](t, c.browser.Ctx, `return window.__fallbackKeyUsed === true;`)
+	if err != nil {
+		return false, err
+	}
+	return *res, nil
+}
+
 func (c *JSClient) WaitUntilEventInRoom(t ct.TestLike, roomID string, checker func(e api.Event) bool) api.Waiter {
+	t.Helper()
+	return c.WaitUntilEventInRoomWithOpts(t, roomID, api.TimelineListenerOpts{}, checker)
+}
+
+func (c *JSClient) WaitUntilEventInRoomWithOpts(t ct.TestLike, roomID string, opts api.TimelineListenerOpts, checker func(e api.Event) bool) api.Waiter {
 	t.Helper()
 	return &jsTimelineWaiter{
 		roomID:  roomID,
-		checker: checker,
+		checker: opts.Filter(checker),
 		client:  c,
 	}
 }
 
 func (c *JSClient) Logf(t ct.TestLike, format string, args ...interface{}) {
 	t.Helper()
+	logging.Write(t.Name(), api.ClientID(c.userID, c.opts.DeviceID, api.ClientTypeJS), fmt.Sprintf(format, args...))
 	formatted := fmt.Sprintf(t.Name()+": "+format, args...)
 	firstLine := strings.Split(formatted, "\n")[0]
 	if c.browser.Ctx.Err() == nil { // don't log on dead browsers
@@ -769,12 +1815,43 @@ func jsToEvent(j JSEvent) api.Event {
 	var ev api.Event
 	ev.Sender = j.Sender
 	ev.ID = j.ID
+	ev.Type = j.Type
+	ev.StateKey = j.StateKey
 	switch j.Type {
+	case "m.room.topic":
+		ev.Text, _ = j.Content["topic"].(string)
 	case "m.room.member":
 		ev.Target = *j.StateKey
 		ev.Membership = j.Content["membership"].(string)
 	case "m.room.message":
 		ev.Text = j.Content["body"].(string)
+		// the JS SDK replaces the content of events which failed to decrypt
+		ev.FailedToDecrypt = j.Content["msgtype"] == "m.bad.encrypted"
+		if ev.FailedToDecrypt {
+			ev.Type = "m.room.encrypted"
+			// the replaced content does not say why
+			ev.DecryptionFailureReason = api.DecryptionFailureReasonUnknown
+		}
+		if relatesTo, ok := j.Content["m.relates_to"].(map[string]interface{}); ok {
+			switch relatesTo["rel_type"] {
+			case "m.replace":
+				// the body of an edit is a fallback, the new body is in m.new_content
+				ev.EditOf, _ = relatesTo["event_id"].(string)
+				if newContent, ok := j.Content["m.new_content"].(map[string]interface{}); ok {
+					ev.Text, _ = newContent["body"].(string)
+				}
+			case "m.thread":
+				ev.ThreadRoot, _ = relatesTo["event_id"].(string)
+			}
+		}
+		if j.Content["msgtype"] == "m.file" {
+			ev.File = &api.EventFile{
+				Name: ev.Text,
+			}
+			if filename, ok := j.Content["filename"].(string); ok && filename != "" {
+				ev.File.Name = filename
+			}
+		}
 	}
 	return ev
 }
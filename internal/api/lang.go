@@ -7,6 +7,7 @@ type ClientTypeLang string
 var (
 	ClientTypeRust ClientTypeLang = "rust"
 	ClientTypeJS   ClientTypeLang = "js"
+	ClientTypeNio  ClientTypeLang = "nio"
 )
 
 // LanguageBindings is the interface any new language implementation needs to satisfy to
@@ -0,0 +1,43 @@
+//go:build nio
+
+package langs
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/api/nio"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/must"
+)
+
+func init() {
+	fmt.Println("Adding nio bindings")
+	SetLanguageBinding(api.ClientTypeNio, &NioLanguageBindings{})
+}
+
+type NioLanguageBindings struct{}
+
+func (b *NioLanguageBindings) PreTestRun(contextID string) {
+	// nuke persistent storage from previous run. We do this on startup rather than teardown
+	// to allow devs to introspect DBs if tests fail.
+	if contextID == "" {
+		nio.DeleteOldStores()
+	}
+	if contextID != "" {
+		contextID = "_" + contextID
+	}
+	os.Mkdir("./logs", 0750) // ensure directory exists
+	nio.SetupNioLogs(fmt.Sprintf("./logs/nio_sdk%s.log", contextID))
+}
+
+func (b *NioLanguageBindings) PostTestRun(contextID string) {
+	nio.WriteNioLogs()
+}
+
+func (b *NioLanguageBindings) MustCreateClient(t ct.TestLike, cfg api.ClientCreationOpts) api.Client {
+	client, err := nio.NewNioClient(t, cfg)
+	must.NotError(t, "NewNioClient: %s", err)
+	return client
+}
@@ -0,0 +1,14 @@
+package api
+
+import "time"
+
+// OutboundSessionInfo describes the megolm session a client is using to encrypt messages in a room,
+// see Client.GetOutboundSessionInfo.
+type OutboundSessionInfo struct {
+	SessionID string
+	// The index of the next message which will be encrypted with this session, which is the number of
+	// messages encrypted with it so far.
+	MessageIndex int
+	// When the session was created, or the zero time if the client cannot report it.
+	CreationTime time.Time
+}
@@ -0,0 +1,471 @@
+# A driver for matrix-nio which is controlled by the Go test process over stdin/stdout.
+#
+# Each line on stdin is a JSON request: {"id": 1, "method": "login", "params": {...}}
+# Each request gets exactly one JSON response line on stdout: {"id": 1, "result": ...} or {"id": 1, "error": "..."}
+# Timeline events are pushed as they arrive: {"event": {"room_id": "...", "event_id": "...", ...}}
+#
+# Anything written to stderr ends up in the nio log file.
+# Requires: pip install "matrix-nio[e2e]"
+import asyncio
+import json
+import logging
+import os
+import sys
+import tempfile
+
+from nio import (
+    AsyncClient,
+    AsyncClientConfig,
+    ErrorResponse,
+    JoinedMembersError,
+    MegolmEvent,
+    RoomMemberEvent,
+    RoomMessagesError,
+    RoomMessageText,
+    RoomPutStateError,
+    RoomSendError,
+    ReceiptEvent,
+    RoomTopicEvent,
+    UpdateDeviceError,
+    SyncResponse,
+)
+
+logging.basicConfig(stream=sys.stderr, level=logging.INFO)
+logger = logging.getLogger("nio-driver")
+
+
+def serialise_event(room_id, event):
+    ev = {
+        "room_id": room_id,
+        "event_id": event.event_id,
+        "sender": event.sender,
+        "failed_to_decrypt": False,
+        # nio sets this on both decrypted events and MegolmEvents
+        "session_id": getattr(event, "session_id", None) or "",
+    }
+    if isinstance(event, RoomMessageText):
+        ev["type"] = "m.room.message"
+        ev["body"] = event.body
+        # nio copies the unencrypted m.relates_to into decrypted events
+        relates_to = event.source.get("content", {}).get("m.relates_to", {})
+        if relates_to.get("rel_type") == "m.thread":
+            ev["thread_root"] = relates_to.get("event_id", "")
+    elif isinstance(event, RoomMemberEvent):
+        ev["type"] = "m.room.member"
+        ev["state_key"] = event.state_key
+        ev["membership"] = event.membership
+    elif isinstance(event, RoomTopicEvent):
+        ev["type"] = "m.room.topic"
+        ev["state_key"] = event.source.get("state_key", "")
+        ev["body"] = event.topic
+    elif isinstance(event, MegolmEvent):
+        # nio leaves events as MegolmEvent if they could not be decrypted
+        ev["type"] = "m.room.encrypted"
+        ev["failed_to_decrypt"] = True
+    else:
+        ev["type"] = event.source.get("type", "")
+    return ev
+
+
+class Driver:
+    def __init__(self):
+        self.client = None
+        self.sync_task = None
+        # room_id => list of serialised events, oldest first
+        self.timelines = {}
+        # room_id => pagination token to backpaginate from
+        self.prev_batch = {}
+        # room_id => event_id => MegolmEvent which failed to decrypt, so we can request the room key and retry
+        self.undecrypted = {}
+        # event_id => megolm session ID we encrypted it with, for events we sent
+        self.outbound_session_ids = {}
+        # room_id => user_id => event_id of their latest m.read receipt
+        self.read_receipts = {}
+        self.stdout_lock = asyncio.Lock()
+
+    async def write(self, obj):
+        async with self.stdout_lock:
+            sys.stdout.write(json.dumps(obj) + "\n")
+            sys.stdout.flush()
+
+    def must_client(self):
+        if self.client is None:
+            raise Exception("client has not been created, call 'create' first")
+        return self.client
+
+    async def on_sync(self, response: SyncResponse):
+        for room_id, room_info in response.rooms.join.items():
+            if room_id not in self.prev_batch:
+                self.prev_batch[room_id] = room_info.timeline.prev_batch
+            timeline = self.timelines.setdefault(room_id, [])
+            for event in room_info.timeline.events:
+                self.track_undecrypted(room_id, event)
+                ev = serialise_event(room_id, event)
+                timeline.append(ev)
+                await self.write({"event": ev})
+            for event in room_info.ephemeral:
+                if not isinstance(event, ReceiptEvent):
+                    continue
+                for receipt in event.receipts:
+                    if receipt.receipt_type == "m.read":
+                        self.read_receipts.setdefault(room_id, {})[receipt.user_id] = receipt.event_id
+        # room keys may have arrived in this sync, so tell the Go process about any events we can now decrypt
+        for room_id in list(self.undecrypted):
+            for ev in self.decrypt_undecrypted(room_id):
+                await self.write({"event": ev})
+
+    async def create(self, params):
+        config = AsyncClientConfig(
+            encryption_enabled=True,
+            store_sync_tokens=params["persistent_storage"],
+            # the pickle key encrypts the olm account and sessions in the store
+            pickle_key=params.get("store_passphrase") or "DEFAULT_KEY",
+        )
+        self.client = AsyncClient(
+            params["base_url"],
+            params["user_id"],
+            device_id=params.get("device_id") or None,
+            store_path=params["store_path"],
+            config=config,
+            ssl=False,
+        )
+        self.client.add_response_callback(self.on_sync, SyncResponse)
+        return None
+
+    async def login(self, params):
+        client = self.must_client()
+        res = await client.login(params["password"], device_name="complement-crypto")
+        if isinstance(res, ErrorResponse):
+            raise Exception(f"login failed: {res}")
+        # block until device keys and OTKs have been uploaded
+        if client.should_upload_keys:
+            res = await client.keys_upload()
+            if isinstance(res, ErrorResponse):
+                raise Exception(f"keys_upload failed: {res}")
+        return {"access_token": client.access_token, "device_id": client.device_id}
+
+    async def start_syncing(self, params):
+        client = self.must_client()
+        client.synced.clear()
+        self.sync_task = asyncio.ensure_future(client.sync_forever(timeout=30000, full_state=True))
+        await asyncio.wait_for(client.synced.wait(), timeout=params["timeout_secs"])
+        return None
+
+    async def stop_syncing(self, params):
+        if self.sync_task is not None:
+            self.sync_task.cancel()
+            self.sync_task = None
+        return None
+
+    async def access_token(self, params):
+        return self.must_client().access_token
+
+    async def is_room_encrypted(self, params):
+        room = self.must_client().rooms.get(params["room_id"])
+        if room is None:
+            raise Exception(f"unknown room {params['room_id']}")
+        return room.encrypted
+
+    async def invite(self, params):
+        res = await self.must_client().room_invite(params["room_id"], params["user_id"])
+        if isinstance(res, ErrorResponse):
+            raise Exception(f"room_invite failed: {res}")
+        return None
+
+    async def join(self, params):
+        # nio cannot join via specific servers, so this only works for local rooms or rooms we are invited to.
+        res = await self.must_client().join(params["room_id"])
+        if isinstance(res, ErrorResponse):
+            raise Exception(f"join failed: {res}")
+        return None
+
+    # nio only encrypts for members it knows about, so make sure it knows about all of them.
+    async def sync_members(self, room_id):
+        client = self.must_client()
+        room = client.rooms.get(room_id)
+        if room is not None and not room.members_synced:
+            res = await client.joined_members(room_id)
+            if isinstance(res, JoinedMembersError):
+                raise Exception(f"joined_members failed: {res}")
+        return room
+
+    async def send_message(self, params):
+        client = self.must_client()
+        room = await self.sync_members(params["room_id"])
+        content = {"msgtype": "m.text", "body": params["text"]}
+        thread_root_id = params.get("thread_root_id")
+        if thread_root_id:
+            # as per MSC3440, with a reply fallback to the root for clients which do not support threads
+            content["m.relates_to"] = {
+                "rel_type": "m.thread",
+                "event_id": thread_root_id,
+                "is_falling_back": True,
+                "m.in_reply_to": {"event_id": thread_root_id},
+            }
+        res = await client.room_send(
+            params["room_id"],
+            "m.room.message",
+            content,
+            ignore_unverified_devices=True,
+        )
+        if isinstance(res, RoomSendError):
+            raise Exception(f"room_send failed: {res}")
+        # nio only exposes the current outbound session, so remember which one encrypted this event.
+        session = client.olm.outbound_group_sessions.get(params["room_id"]) if client.olm else None
+        if room is not None and room.encrypted and session is not None:
+            self.outbound_session_ids[res.event_id] = session.id
+        return res.event_id
+
+    async def react(self, params):
+        client = self.must_client()
+        await self.sync_members(params["room_id"])
+        res = await client.room_send(
+            params["room_id"],
+            "m.reaction",
+            {"m.relates_to": {"rel_type": "m.annotation", "event_id": params["event_id"], "key": params["key"]}},
+            ignore_unverified_devices=True,
+        )
+        if isinstance(res, RoomSendError):
+            raise Exception(f"room_send failed: {res}")
+        return None
+
+    async def set_room_topic(self, params):
+        # nio does not support MSC3414, so the topic is always sent in the clear
+        res = await self.must_client().room_put_state(params["room_id"], "m.room.topic", {"topic": params["topic"]})
+        if isinstance(res, RoomPutStateError):
+            raise Exception(f"room_put_state failed: {res}")
+        return res.event_id
+
+    async def redact(self, params):
+        res = await self.must_client().room_redact(
+            params["room_id"], params["event_id"], reason=params["reason"] or None
+        )
+        if isinstance(res, ErrorResponse):
+            raise Exception(f"room_redact failed: {res}")
+        return None
+
+    async def get_outbound_session_id(self, params):
+        session_id = self.outbound_session_ids.get(params["event_id"])
+        if session_id is None:
+            raise Exception(f"event {params['event_id']} was not sent encrypted by this client")
+        return session_id
+
+    async def get_outbound_session_info(self, params):
+        client = self.must_client()
+        session = client.olm.outbound_group_sessions.get(params["room_id"]) if client.olm else None
+        if session is None:
+            return None
+        return {
+            "session_id": session.id,
+            "message_index": session.message_index,
+            "creation_time_ms": int(session.creation_time.timestamp() * 1000),
+        }
+
+    async def get_device_ids(self, params):
+        client = self.must_client()
+        if client.olm is None:
+            return []
+        # deleted devices are kept in the device store, but are not active
+        return [device.id for device in client.device_store.active_user_devices(params["user_id"])]
+
+    async def set_device_display_name(self, params):
+        client = self.must_client()
+        res = await client.update_device(client.device_id, {"display_name": params["name"]})
+        if isinstance(res, UpdateDeviceError):
+            raise Exception(f"update_device failed: {res}")
+        return None
+
+    async def blacklist_device(self, params):
+        client = self.must_client()
+        device = client.device_store[params["user_id"]].get(params["device_id"]) if client.olm else None
+        if device is None:
+            raise Exception(f"unknown device {params['device_id']} of {params['user_id']}")
+        client.blacklist_device(device)
+        return None
+
+    async def backpaginate(self, params):
+        room_id = params["room_id"]
+        start = self.prev_batch.get(room_id)
+        if start is None:
+            # we have reached the start of the room, or never synced it.
+            return None
+        res = await self.must_client().room_messages(room_id, start, limit=params["count"])
+        if isinstance(res, RoomMessagesError):
+            raise Exception(f"room_messages failed: {res}")
+        self.prev_batch[room_id] = res.end
+        for event in res.chunk:
+            self.track_undecrypted(room_id, event)
+        events = [serialise_event(room_id, event) for event in res.chunk]
+        # res.chunk is newest first
+        events.reverse()
+        self.timelines[room_id] = events + self.timelines.get(room_id, [])
+        for ev in events:
+            await self.write({"event": ev})
+        return None
+
+    async def get_timeline(self, params):
+        room_id = params["room_id"]
+        if room_id not in self.timelines:
+            raise Exception(f"unknown room {room_id}")
+        self.decrypt_undecrypted(room_id)
+        return self.timelines[room_id]
+
+    async def mark_as_read(self, params):
+        room_id = params["room_id"]
+        timeline = self.timelines.get(room_id)
+        if not timeline:
+            raise Exception(f"no events in room {room_id}")
+        event_id = timeline[-1]["event_id"]
+        res = await self.must_client().room_read_markers(room_id, fully_read_event=event_id, read_event=event_id)
+        if isinstance(res, ErrorResponse):
+            raise Exception(f"room_read_markers failed: {res}")
+        return None
+
+    async def get_read_receipt(self, params):
+        return self.read_receipts.get(params["room_id"], {}).get(params["user_id"], "")
+
+    def track_undecrypted(self, room_id, event):
+        if isinstance(event, MegolmEvent):
+            self.undecrypted.setdefault(room_id, {})[event.event_id] = event
+
+    # nio does not retry decryption when it receives room keys, so try again with any keys
+    # received since, e.g in response to a room key request. If session_ids is given, only
+    # events encrypted with those sessions are retried. Returns the newly decrypted events.
+    def decrypt_undecrypted(self, room_id, session_ids=None):
+        decrypted = []
+        undecrypted = self.undecrypted.get(room_id, {})
+        for event_id, megolm_event in list(undecrypted.items()):
+            if session_ids and megolm_event.session_id not in session_ids:
+                continue
+            try:
+                event = self.must_client().decrypt_event(megolm_event)
+            except Exception:
+                continue
+            del undecrypted[event_id]
+            ev = serialise_event(room_id, event)
+            self.timelines[room_id] = [ev if e["event_id"] == event_id else e for e in self.timelines[room_id]]
+            decrypted.append(ev)
+        return decrypted
+
+    async def retry_decryption(self, params):
+        for ev in self.decrypt_undecrypted(params["room_id"], params.get("session_ids")):
+            await self.write({"event": ev})
+        return None
+
+    async def request_room_key(self, params):
+        room_id = params["room_id"]
+        session_id = params["session_id"]
+        events = [e for e in self.undecrypted.get(room_id, {}).values() if e.session_id == session_id]
+        if not events:
+            raise Exception(f"no undecryptable events for session {session_id}")
+        res = await self.must_client().request_room_key(events[0])
+        if isinstance(res, ErrorResponse):
+            raise Exception(f"request_room_key failed: {res}")
+        return None
+
+    async def cancel_room_key_request(self, params):
+        client = self.must_client()
+        # nio uses the session ID as the request ID
+        key_request = client.olm.outgoing_key_requests.pop(params["session_id"], None)
+        if key_request is None:
+            raise Exception(f"no outstanding room key request for session {params['session_id']}")
+        client.olm.store.remove_outgoing_key_request(key_request)
+        res = await client.to_device(key_request.as_cancellation(client.user_id, client.device_id))
+        if isinstance(res, ErrorResponse):
+            raise Exception(f"to_device failed: {res}")
+        return None
+
+    async def export_keys(self, params):
+        client = self.must_client()
+        # nio can only export keys to a file
+        with tempfile.TemporaryDirectory() as tmp:
+            path = os.path.join(tmp, "keys.txt")
+            await client.export_keys(path, params["passphrase"], count=params["rounds"])
+            with open(path) as f:
+                return f.read()
+
+    async def import_keys(self, params):
+        client = self.must_client()
+        with tempfile.TemporaryDirectory() as tmp:
+            path = os.path.join(tmp, "keys.txt")
+            with open(path, "w") as f:
+                f.write(params["export"])
+            await client.import_keys(path, params["passphrase"])
+        for room_id in list(self.undecrypted):
+            for ev in self.decrypt_undecrypted(room_id):
+                await self.write({"event": ev})
+        return None
+
+    async def close(self, params):
+        await self.stop_syncing(params)
+        if self.client is not None:
+            await self.client.close()
+        return None
+
+    async def handle(self, line):
+        req = json.loads(line)
+        try:
+            if req["method"] not in METHODS:
+                raise Exception(f"unknown method {req['method']}")
+            result = await getattr(self, req["method"])(req.get("params") or {})
+            await self.write({"id": req["id"], "result": result})
+        except Exception as e:
+            logger.exception("request %s failed", req["method"])
+            await self.write({"id": req["id"], "error": f"{type(e).__name__}: {e}"})
+        if req["method"] == "close":
+            asyncio.get_event_loop().stop()
+
+
+# The methods which can be called by the Go process.
+METHODS = {
+    "create",
+    "login",
+    "start_syncing",
+    "stop_syncing",
+    "access_token",
+    "is_room_encrypted",
+    "invite",
+    "join",
+    "send_message",
+    "react",
+    "set_room_topic",
+    "redact",
+    "get_outbound_session_id",
+    "get_outbound_session_info",
+    "get_device_ids",
+    "set_device_display_name",
+    "blacklist_device",
+    "backpaginate",
+    "get_timeline",
+    "mark_as_read",
+    "get_read_receipt",
+    "retry_decryption",
+    "request_room_key",
+    "cancel_room_key_request",
+    "export_keys",
+    "import_keys",
+    "close",
+}
+
+
+async def main():
+    driver = Driver()
+    loop = asyncio.get_event_loop()
+    reader = asyncio.StreamReader()
+    await loop.connect_read_pipe(lambda: asyncio.StreamReaderProtocol(reader), sys.stdin)
+    while True:
+        line = await reader.readline()
+        if not line:
+            # the Go process went away
+            await driver.close({})
+            return
+        # handle requests concurrently, as some requests block until events arrive via sync
+        asyncio.ensure_future(driver.handle(line))
+
+
+if __name__ == "__main__":
+    try:
+        asyncio.get_event_loop().run_until_complete(main())
+    except RuntimeError:
+        # the loop was stopped by a 'close' request
+        pass
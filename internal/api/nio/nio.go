@@ -0,0 +1,771 @@
+package nio
+
+import (
+	"bufio"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/keyexport"
+	"github.com/matrix-org/complement-crypto/internal/logging"
+	"github.com/matrix-org/complement/ct"
+)
+
+// The python script which drives matrix-nio. It is run with `python3 -c` so the tests do not
+// need to know where this file lives on disk.
+//
+//go:embed driver.py
+var driverScript string
+
+// The python interpreter to use. Must have matrix-nio[e2e] installed.
+var pythonBinary = "python3"
+
+// How long to wait for the driver to respond to a request before giving up.
+const requestTimeout = 30 * time.Second
+
+var logFile *os.File
+
+func SetupNioLogs(filename string) {
+	var err error
+	logFile, err = os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		panic(err)
+	}
+	logFile.Truncate(0)
+}
+
+func WriteNioLogs() {
+	logFile.Close()
+}
+
+// DeleteOldStores removes persistent storage from previous runs.
+func DeleteOldStores() {
+	os.RemoveAll("./nio_storage")
+}
+
+type driverRequest struct {
+	ID     int64  `json:"id"`
+	Method string `json:"method"`
+	Params any    `json:"params"`
+}
+
+type driverResponse struct {
+	ID     int64           `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  string          `json:"error"`
+	// Set if this is a pushed timeline event rather than a response
+	Event *nioEvent `json:"event"`
+}
+
+// nioEvent is a timeline event serialised by the driver
+type nioEvent struct {
+	RoomID          string  `json:"room_id"`
+	ID              string  `json:"event_id"`
+	Sender          string  `json:"sender"`
+	Type            string  `json:"type"`
+	Body            string  `json:"body"`
+	StateKey        *string `json:"state_key"`
+	ThreadRoot      string  `json:"thread_root"`
+	Membership      string  `json:"membership"`
+	FailedToDecrypt bool    `json:"failed_to_decrypt"`
+	SessionID       string  `json:"session_id"`
+}
+
+func (e *nioEvent) toEvent() *api.Event {
+	ev := &api.Event{
+		ID:              e.ID,
+		Sender:          e.Sender,
+		Type:            e.Type,
+		FailedToDecrypt: e.FailedToDecrypt,
+		SessionID:       e.SessionID,
+		StateKey:        e.StateKey,
+		ThreadRoot:      e.ThreadRoot,
+	}
+	if e.FailedToDecrypt {
+		// nio does not say why events fail to decrypt
+		ev.DecryptionFailureReason = api.DecryptionFailureReasonUnknown
+	}
+	switch e.Type {
+	case "m.room.member":
+		if e.StateKey != nil {
+			ev.Target = *e.StateKey
+		}
+		ev.Membership = e.Membership
+	case "m.room.message", "m.room.topic":
+		ev.Text = e.Body
+	}
+	return ev
+}
+
+// NioClient is a client which drives matrix-nio in a python subprocess.
+//
+// nio does not implement secret storage, key backups, verification or notifications, so those
+// functions return errors.
+type NioClient struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	// serialises writes to stdin
+	stdinMu   sync.Mutex
+	nextID    atomic.Int64
+	pending   map[int64]chan driverResponse
+	pendingMu sync.Mutex
+	// closed when the subprocess exits
+	exited      chan struct{}
+	listeners   map[int32]func(ev *nioEvent)
+	listenerID  atomic.Int32
+	listenersMu sync.RWMutex
+	userID      string
+	opts        api.ClientCreationOpts
+	storePath   string
+	// the test which created this client, used to tag driver logs
+	testName string
+}
+
+func NewNioClient(t ct.TestLike, opts api.ClientCreationOpts) (api.Client, error) {
+	t.Logf("NewNioClient[%s][%s] creating...", opts.UserID, opts.DeviceID)
+	// make the store before starting the driver, so there is no process to clean up if this fails.
+	// @alice:hs1, FOOBAR => alice_hs1_FOOBAR
+	username := strings.Replace(opts.UserID[1:], ":", "_", -1) + "_" + opts.DeviceID
+	storePath := "nio_storage/" + username
+	var err error
+	if !opts.PersistentStorage {
+		storePath, err = os.MkdirTemp("", "nio_storage_"+username)
+		if err != nil {
+			return nil, fmt.Errorf("failed to make temporary store: %s", err)
+		}
+	} else if err := os.MkdirAll(storePath, 0750); err != nil {
+		return nil, fmt.Errorf("failed to make store: %s", err)
+	}
+	cmd := exec.Command(pythonBinary, "-u", "-c", driverScript)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stdin pipe: %s", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stdout pipe: %s", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stderr pipe: %s", err)
+	}
+	c := &NioClient{
+		cmd:       cmd,
+		stdin:     stdin,
+		pending:   make(map[int64]chan driverResponse),
+		exited:    make(chan struct{}),
+		listeners: make(map[int32]func(ev *nioEvent)),
+		userID:    opts.UserID,
+		opts:      opts,
+		storePath: storePath,
+		testName:  t.Name(),
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %s", pythonBinary, err)
+	}
+	go c.readStderr(stderr)
+	go c.readStdout(stdout)
+
+	err = c.call("create", map[string]any{
+		"base_url":           opts.BaseURL,
+		"user_id":            opts.UserID,
+		"device_id":          opts.DeviceID,
+		"store_path":         storePath,
+		"persistent_storage": opts.PersistentStorage,
+		"store_passphrase":   opts.StorePassphrase,
+	}, nil)
+	if err != nil {
+		c.ForceClose(t)
+		return nil, fmt.Errorf("failed to create client: %s", err)
+	}
+	c.Logf(t, "NewNioClient[%s,%s] created client storage=%v", opts.UserID, opts.DeviceID, opts.PersistentStorage)
+	return &api.LoggedClient{Client: c}, nil
+}
+
+// call the given method in the driver, blocking until there is a response. If result is not nil,
+// the result of the method is unmarshalled into it.
+func (c *NioClient) call(method string, params any, result any) error {
+	id := c.nextID.Add(1)
+	ch := make(chan driverResponse, 1)
+	c.pendingMu.Lock()
+	c.pending[id] = ch
+	c.pendingMu.Unlock()
+	defer func() {
+		c.pendingMu.Lock()
+		delete(c.pending, id)
+		c.pendingMu.Unlock()
+	}()
+
+	req, err := json.Marshal(driverRequest{
+		ID:     id,
+		Method: method,
+		Params: params,
+	})
+	if err != nil {
+		return fmt.Errorf("%s: failed to marshal request: %s", method, err)
+	}
+	c.stdinMu.Lock()
+	_, err = c.stdin.Write(append(req, '\n'))
+	c.stdinMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("%s: failed to write request: %s", method, err)
+	}
+
+	select {
+	case res := <-ch:
+		if res.Error != "" {
+			return fmt.Errorf("%s: %s", method, res.Error)
+		}
+		if result != nil {
+			if err := json.Unmarshal(res.Result, result); err != nil {
+				return fmt.Errorf("%s: failed to unmarshal result %s: %s", method, string(res.Result), err)
+			}
+		}
+		return nil
+	case <-c.exited:
+		return fmt.Errorf("%s: driver process exited", method)
+	case <-time.After(requestTimeout):
+		return fmt.Errorf("%s: timed out after %v", method, requestTimeout)
+	}
+}
+
+func (c *NioClient) readStdout(stdout io.Reader) {
+	defer close(c.exited)
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 1024*1024), 10*1024*1024)
+	for scanner.Scan() {
+		var res driverResponse
+		if err := json.Unmarshal(scanner.Bytes(), &res); err != nil {
+			writeToLog("[%s,%s] invalid driver output: %s\n", c.opts.UserID, c.opts.DeviceID, scanner.Text())
+			continue
+		}
+		if res.Event != nil {
+			c.listenersMu.RLock()
+			var listeners []func(ev *nioEvent)
+			for _, l := range c.listeners {
+				listeners = append(listeners, l)
+			}
+			c.listenersMu.RUnlock()
+			for _, l := range listeners {
+				l(res.Event)
+			}
+			continue
+		}
+		c.pendingMu.Lock()
+		ch := c.pending[res.ID]
+		c.pendingMu.Unlock()
+		if ch != nil {
+			ch <- res
+		}
+	}
+}
+
+func (c *NioClient) readStderr(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		writeToLog("[%s,%s] %s\n", c.opts.UserID, c.opts.DeviceID, scanner.Text())
+		logging.Write(c.testName, api.ClientID(c.userID, c.opts.DeviceID, api.ClientTypeNio), scanner.Text())
+	}
+}
+
+func writeToLog(s string, args ...interface{}) {
+	if logFile == nil {
+		return
+	}
+	str := fmt.Sprintf(s, args...)
+	logFile.WriteString(time.Now().Format("15:04:05.000000Z07:00") + " " + str)
+}
+
+func (c *NioClient) listenForEvents(callback func(ev *nioEvent)) (cancel func()) {
+	id := c.listenerID.Add(1)
+	c.listenersMu.Lock()
+	c.listeners[id] = callback
+	c.listenersMu.Unlock()
+	return func() {
+		c.listenersMu.Lock()
+		delete(c.listeners, id)
+		c.listenersMu.Unlock()
+	}
+}
+
+// Close is called to clean up resources.
+// Specifically, we need to shut off existing browsers and any FFI bindings.
+// If we get callbacks/events after this point, tests may panic if the callbacks
+// log messages.
+func (c *NioClient) Close(t ct.TestLike) {
+	t.Helper()
+	if err := c.call("close", nil, nil); err != nil {
+		t.Logf("NioClient.Close: %s", err)
+	}
+	c.stdin.Close()
+	c.cmd.Wait()
+	if !c.opts.PersistentStorage {
+		os.RemoveAll(c.storePath)
+	}
+	c.listenersMu.Lock()
+	c.listeners = make(map[int32]func(ev *nioEvent))
+	c.listenersMu.Unlock()
+}
+
+func (c *NioClient) ForceClose(t ct.TestLike) {
+	t.Helper()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+}
+
+// Remove any persistent storage, if it was enabled.
+func (c *NioClient) DeletePersistentStorage(t ct.TestLike) {
+	t.Helper()
+	os.RemoveAll(c.storePath)
+}
+
+func (c *NioClient) PersistentStoragePath(t ct.TestLike) string {
+	return c.storePath
+}
+
+func (c *NioClient) Login(t ct.TestLike, opts api.ClientCreationOpts) error {
+	if opts.UseOIDC {
+		return fmt.Errorf("UseOIDC: %w", api.ErrNotSupported)
+	}
+	var res struct {
+		DeviceID string `json:"device_id"`
+	}
+	if err := c.call("login", map[string]any{"password": opts.Password}, &res); err != nil {
+		return err
+	}
+	if c.opts.DeviceID == "" {
+		c.opts.DeviceID = res.DeviceID
+	}
+	return nil
+}
+
+// StartSyncing to begin syncing from sync v2 / sliding sync.
+// Tests should call stopSyncing() at the end of the test.
+func (c *NioClient) StartSyncing(t ct.TestLike) (stopSyncing func(), err error) {
+	t.Helper()
+	err = c.call("start_syncing", map[string]any{"timeout_secs": 5}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("[%s](nio) failed to StartSyncing: %s", c.userID, err)
+	}
+	return func() {
+		if err := c.call("stop_syncing", nil, nil); err != nil {
+			t.Logf("[%s](nio) failed to stop syncing: %s", c.userID, err)
+		}
+	}, nil
+}
+
+func (c *NioClient) ListenForSyncStates(t ct.TestLike, callback func(s api.SyncState)) (cancel func(), err error) {
+	return nil, fmt.Errorf("ListenForSyncStates: %w", api.ErrNotSupported)
+}
+
+func (c *NioClient) ListenForBackupStates(t ct.TestLike, ctx context.Context) (<-chan api.BackupState, error) {
+	return nil, fmt.Errorf("ListenForBackupStates: %w", api.ErrNotSupported)
+}
+
+func (c *NioClient) ClearCacheAndRestart(t ct.TestLike) error {
+	return fmt.Errorf("ClearCacheAndRestart: %w", api.ErrNotSupported)
+}
+
+func (c *NioClient) Restart(t ct.TestLike) error {
+	return fmt.Errorf("Restart: %w", api.ErrNotSupported)
+}
+
+// Kill sends SIGKILL to the driver process.
+func (c *NioClient) Kill(t ct.TestLike) error {
+	t.Helper()
+	c.ForceClose(t)
+	return nil
+}
+
+func (c *NioClient) RestoreFromStorage(t ct.TestLike) error {
+	return fmt.Errorf("RestoreFromStorage: %w", api.ErrNotSupported)
+}
+
+// SetStorePassphrase is unsupported as nio clients cannot be re-created, see Restart.
+func (c *NioClient) SetStorePassphrase(t ct.TestLike, passphrase string) error {
+	return fmt.Errorf("SetStorePassphrase: %w", api.ErrNotSupported)
+}
+
+// GetEncryptionAlgorithm is unsupported as nio rooms only remember whether they are encrypted.
+func (c *NioClient) GetEncryptionAlgorithm(t ct.TestLike, roomID string) (string, error) {
+	return "", fmt.Errorf("GetEncryptionAlgorithm: %w", api.ErrNotSupported)
+}
+
+// IsRoomEncrypted returns true if the room is encrypted. May return an error e.g if you
+// provide a bogus room ID.
+func (c *NioClient) IsRoomEncrypted(t ct.TestLike, roomID string) (bool, error) {
+	t.Helper()
+	var isEncrypted bool
+	err := c.call("is_room_encrypted", map[string]any{"room_id": roomID}, &isEncrypted)
+	return isEncrypted, err
+}
+
+func (c *NioClient) IsDirect(t ct.TestLike, roomID string) (bool, error) {
+	return false, fmt.Errorf("IsDirect: %w", api.ErrNotSupported)
+}
+
+func (c *NioClient) InviteUser(t ct.TestLike, roomID, userID string) error {
+	if c.opts.EnableShareHistoryOnInvite {
+		return fmt.Errorf("sharing room history on invite: %w", api.ErrNotSupported)
+	}
+	return c.call("invite", map[string]any{"room_id": roomID, "user_id": userID}, nil)
+}
+
+func (c *NioClient) IgnoreUser(t ct.TestLike, userID string) error {
+	return fmt.Errorf("IgnoreUser: %w", api.ErrNotSupported)
+}
+
+func (c *NioClient) UnignoreUser(t ct.TestLike, userID string) error {
+	return fmt.Errorf("UnignoreUser: %w", api.ErrNotSupported)
+}
+
+// JoinRoom joins the given room. nio cannot join via specific servers, so serverNames are ignored.
+func (c *NioClient) JoinRoom(t ct.TestLike, roomID string, serverNames []string) error {
+	t.Helper()
+	if c.opts.EnableShareHistoryOnInvite {
+		return fmt.Errorf("accepting shared room history: %w", api.ErrNotSupported)
+	}
+	return c.call("join", map[string]any{"room_id": roomID}, nil)
+}
+
+func (c *NioClient) FollowTombstone(t ct.TestLike, roomID string, serverNames []string) (newRoomID string, err error) {
+	return "", fmt.Errorf("FollowTombstone: %w", api.ErrNotSupported)
+}
+
+func (c *NioClient) SendMessage(t ct.TestLike, roomID, text string) (eventID string, err error) {
+	t.Helper()
+	err = c.call("send_message", map[string]any{"room_id": roomID, "text": text}, &eventID)
+	return eventID, err
+}
+
+func (c *NioClient) SendThreadedMessage(t ct.TestLike, roomID, threadRootID, text string) (eventID string, err error) {
+	t.Helper()
+	err = c.call("send_message", map[string]any{"room_id": roomID, "text": text, "thread_root_id": threadRootID}, &eventID)
+	return eventID, err
+}
+
+func (c *NioClient) SendEncryptedFile(t ct.TestLike, roomID, filename string, contents []byte) (eventID string, err error) {
+	return "", fmt.Errorf("SendEncryptedFile: %w", api.ErrNotSupported)
+}
+
+func (c *NioClient) RedactEvent(t ct.TestLike, roomID, eventID, reason string) error {
+	t.Helper()
+	return c.call("redact", map[string]any{"room_id": roomID, "event_id": eventID, "reason": reason}, nil)
+}
+
+func (c *NioClient) React(t ct.TestLike, roomID, eventID, key string) error {
+	t.Helper()
+	return c.call("react", map[string]any{"room_id": roomID, "event_id": eventID, "key": key}, nil)
+}
+
+func (c *NioClient) SetRoomTopic(t ct.TestLike, roomID, topic string) (eventID string, err error) {
+	t.Helper()
+	err = c.call("set_room_topic", map[string]any{"room_id": roomID, "topic": topic}, &eventID)
+	return
+}
+
+func (c *NioClient) EditMessage(t ct.TestLike, roomID, eventID, newBody string) error {
+	return fmt.Errorf("EditMessage: %w", api.ErrNotSupported)
+}
+
+func (c *NioClient) GetOutboundSessionInfo(t ct.TestLike, roomID string) (*api.OutboundSessionInfo, error) {
+	t.Helper()
+	var info *struct {
+		SessionID      string `json:"session_id"`
+		MessageIndex   int    `json:"message_index"`
+		CreationTimeMs int64  `json:"creation_time_ms"`
+	}
+	if err := c.call("get_outbound_session_info", map[string]any{"room_id": roomID}, &info); err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, nil
+	}
+	return &api.OutboundSessionInfo{
+		SessionID:    info.SessionID,
+		MessageIndex: info.MessageIndex,
+		CreationTime: time.UnixMilli(info.CreationTimeMs),
+	}, nil
+}
+
+func (c *NioClient) GetOutboundSessionID(t ct.TestLike, roomID, eventID string) (sessionID string, err error) {
+	t.Helper()
+	err = c.call("get_outbound_session_id", map[string]any{"room_id": roomID, "event_id": eventID}, &sessionID)
+	return sessionID, err
+}
+
+func (c *NioClient) WaitUntilEventInRoom(t ct.TestLike, roomID string, checker func(e api.Event) bool) api.Waiter {
+	t.Helper()
+	return c.WaitUntilEventInRoomWithOpts(t, roomID, api.TimelineListenerOpts{}, checker)
+}
+
+func (c *NioClient) WaitUntilEventInRoomWithOpts(t ct.TestLike, roomID string, opts api.TimelineListenerOpts, checker func(e api.Event) bool) api.Waiter {
+	t.Helper()
+	return &nioTimelineWaiter{
+		roomID:  roomID,
+		checker: opts.Filter(checker),
+		client:  c,
+	}
+}
+
+func (c *NioClient) Backpaginate(t ct.TestLike, roomID string, count int) ([]*api.Event, error) {
+	t.Helper()
+	if err := c.call("backpaginate", map[string]any{"room_id": roomID, "count": count}, nil); err != nil {
+		return nil, err
+	}
+	// nio decrypts the events in /messages responses before returning them
+	return c.GetTimeline(t, roomID)
+}
+
+func (c *NioClient) GetEvent(t ct.TestLike, roomID, eventID string) (*api.Event, error) {
+	t.Helper()
+	timeline, err := c.GetTimeline(t, roomID)
+	if err != nil {
+		return nil, err
+	}
+	for _, ev := range timeline {
+		if ev.ID == eventID {
+			return ev, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to find event %s in room %s", eventID, roomID)
+}
+
+func (c *NioClient) GetThread(t ct.TestLike, roomID, threadRootID string) ([]*api.Event, error) {
+	return nil, fmt.Errorf("GetThread: %w", api.ErrNotSupported)
+}
+
+// MarkAsRead sends a read receipt and read marker for the last event in the timeline.
+func (c *NioClient) MarkAsRead(t ct.TestLike, roomID string) error {
+	t.Helper()
+	return c.call("mark_as_read", map[string]any{"room_id": roomID}, nil)
+}
+
+// GetReadReceipt returns the event in the latest m.read receipt from the user seen in /sync.
+func (c *NioClient) GetReadReceipt(t ct.TestLike, roomID, userID string) (eventID string, err error) {
+	t.Helper()
+	err = c.call("get_read_receipt", map[string]any{"room_id": roomID, "user_id": userID}, &eventID)
+	return eventID, err
+}
+
+func (c *NioClient) GetTimeline(t ct.TestLike, roomID string) ([]*api.Event, error) {
+	t.Helper()
+	var events []nioEvent
+	if err := c.call("get_timeline", map[string]any{"room_id": roomID}, &events); err != nil {
+		return nil, err
+	}
+	timeline := make([]*api.Event, len(events))
+	for i := range events {
+		timeline[i] = events[i].toEvent()
+	}
+	return timeline, nil
+}
+
+func (c *NioClient) BackupKeys(t ct.TestLike) (recoveryKey string, err error) {
+	return "", fmt.Errorf("BackupKeys: %w", api.ErrNotSupported)
+}
+
+func (c *NioClient) LoadBackup(t ct.TestLike, recoveryKey string) error {
+	return fmt.Errorf("LoadBackup: %w", api.ErrNotSupported)
+}
+
+func (c *NioClient) ExportRoomKeys(t ct.TestLike, passphrase string) ([]byte, error) {
+	t.Helper()
+	var export string
+	err := c.call("export_keys", map[string]any{"passphrase": passphrase, "rounds": keyexport.DefaultRounds}, &export)
+	return []byte(export), err
+}
+
+func (c *NioClient) ImportRoomKeys(t ct.TestLike, export []byte, passphrase string) error {
+	t.Helper()
+	return c.call("import_keys", map[string]any{"export": string(export), "passphrase": passphrase}, nil)
+}
+
+func (c *NioClient) CreateSecretStorageKey(t ct.TestLike) (recoveryKey string, err error) {
+	return "", fmt.Errorf("CreateSecretStorageKey: %w", api.ErrNotSupported)
+}
+
+func (c *NioClient) UnlockSecretStorage(t ct.TestLike, recoveryKey string) error {
+	return fmt.Errorf("UnlockSecretStorage: %w", api.ErrNotSupported)
+}
+
+func (c *NioClient) StoreSecret(t ct.TestLike, name, value string) error {
+	return fmt.Errorf("StoreSecret: %w", api.ErrNotSupported)
+}
+
+func (c *NioClient) GetSecret(t ct.TestLike, name string) (value string, err error) {
+	return "", fmt.Errorf("GetSecret: %w", api.ErrNotSupported)
+}
+
+func (c *NioClient) GetDeviceTrust(t ct.TestLike, userID, deviceID string) (api.TrustLevel, error) {
+	return api.TrustLevelUnknown, fmt.Errorf("GetDeviceTrust: %w", api.ErrNotSupported)
+}
+
+func (c *NioClient) GetDeviceIDs(t ct.TestLike, userID string) ([]string, error) {
+	var deviceIDs []string
+	if err := c.call("get_device_ids", map[string]any{"user_id": userID}, &deviceIDs); err != nil {
+		return nil, err
+	}
+	return deviceIDs, nil
+}
+
+func (c *NioClient) SetDeviceDisplayName(t ct.TestLike, name string) error {
+	t.Helper()
+	return c.call("set_device_display_name", map[string]any{"name": name}, nil)
+}
+
+func (c *NioClient) ListenForDeviceListChanges(t ct.TestLike, callback func(userIDs []string)) (cancel func(), err error) {
+	return nil, fmt.Errorf("ListenForDeviceListChanges: %w", api.ErrNotSupported)
+}
+
+func (c *NioClient) CreateDehydratedDevice(t ct.TestLike) error {
+	return fmt.Errorf("CreateDehydratedDevice: %w", api.ErrNotSupported)
+}
+
+func (c *NioClient) RehydrateDevice(t ct.TestLike, recoveryKey string) error {
+	return fmt.Errorf("RehydrateDevice: %w", api.ErrNotSupported)
+}
+
+func (c *NioClient) ResetCrossSigning(t ct.TestLike, authCallback func() (password string)) error {
+	return fmt.Errorf("ResetCrossSigning: %w", api.ErrNotSupported)
+}
+
+func (c *NioClient) BootstrapCrossSigning(t ct.TestLike, authCallback func() (password string)) error {
+	return fmt.Errorf("BootstrapCrossSigning: %w", api.ErrNotSupported)
+}
+
+// SetGlobalOnlyTrustVerified is not supported as nio refuses to send messages to rooms with unverified devices
+// rather than withholding room keys from them.
+func (c *NioClient) SetGlobalOnlyTrustVerified(t ct.TestLike, enabled bool) error {
+	return fmt.Errorf("SetGlobalOnlyTrustVerified: %w", api.ErrNotSupported)
+}
+
+func (c *NioClient) SetRoomOnlyTrustVerified(t ct.TestLike, roomID string, enabled bool) error {
+	return fmt.Errorf("SetRoomOnlyTrustVerified: %w", api.ErrNotSupported)
+}
+
+// BlacklistDevice blacklists the device in nio's device store. nio neither rotates the room key nor sends
+// m.room_key.withheld when a device is blacklisted, so the device can decrypt messages until the key is next rotated.
+func (c *NioClient) BlacklistDevice(t ct.TestLike, userID, deviceID string) error {
+	t.Helper()
+	return c.call("blacklist_device", map[string]any{"user_id": userID, "device_id": deviceID}, nil)
+}
+
+func (c *NioClient) RequestRoomKey(t ct.TestLike, roomID, sessionID string) error {
+	t.Helper()
+	return c.call("request_room_key", map[string]any{"room_id": roomID, "session_id": sessionID}, nil)
+}
+
+func (c *NioClient) CancelRoomKeyRequest(t ct.TestLike, roomID, sessionID string) error {
+	t.Helper()
+	return c.call("cancel_room_key_request", map[string]any{"room_id": roomID, "session_id": sessionID}, nil)
+}
+
+func (c *NioClient) RetryDecryption(t ct.TestLike, roomID string, sessionIDs []string) error {
+	t.Helper()
+	return c.call("retry_decryption", map[string]any{"room_id": roomID, "session_ids": sessionIDs}, nil)
+}
+
+func (c *NioClient) FallbackKeyUsed(t ct.TestLike) (used bool, err error) {
+	// nio does not upload fallback keys
+	return false, fmt.Errorf("FallbackKeyUsed: %w", api.ErrNotSupported)
+}
+
+func (c *NioClient) GetNotification(t ct.TestLike, roomID, eventID string) (*api.Notification, error) {
+	return nil, fmt.Errorf("GetNotification: %w", api.ErrNotSupported)
+}
+
+func (c *NioClient) ListenForVerificationRequests(t ct.TestLike) chan api.VerificationStage {
+	ct.Fatalf(t, "ListenForVerificationRequests: %s", api.ErrNotSupported)
+	return nil
+}
+
+func (c *NioClient) RequestOwnUserVerification(t ct.TestLike) chan api.VerificationStage {
+	ct.Fatalf(t, "RequestOwnUserVerification: %s", api.ErrNotSupported)
+	return nil
+}
+
+func (c *NioClient) RequestUserVerification(t ct.TestLike, userID, roomID string) (chan api.VerificationStage, error) {
+	return nil, fmt.Errorf("RequestUserVerification: %w", api.ErrNotSupported)
+}
+
+func (c *NioClient) Logf(t ct.TestLike, format string, args ...interface{}) {
+	t.Helper()
+	logging.Write(t.Name(), api.ClientID(c.userID, c.opts.DeviceID, api.ClientTypeNio), fmt.Sprintf(format, args...))
+	writeToLog("[%s,%s] %s\n", c.opts.UserID, c.opts.DeviceID, fmt.Sprintf(t.Name()+": "+format, args...))
+	t.Logf(format, args...)
+}
+
+func (c *NioClient) UserID() string {
+	return c.userID
+}
+
+func (c *NioClient) CurrentAccessToken(t ct.TestLike) string {
+	var token string
+	if err := c.call("access_token", nil, &token); err != nil {
+		ct.Fatalf(t, "CurrentAccessToken: %s", err)
+	}
+	return token
+}
+
+func (c *NioClient) Type() api.ClientTypeLang {
+	return api.ClientTypeNio
+}
+
+func (c *NioClient) Opts() api.ClientCreationOpts {
+	return c.opts
+}
+
+type nioTimelineWaiter struct {
+	roomID  string
+	checker func(e api.Event) bool
+	client  *NioClient
+}
+
+func (w *nioTimelineWaiter) Waitf(t ct.TestLike, s time.Duration, format string, args ...any) {
+	t.Helper()
+	err := w.TryWaitf(t, s, format, args...)
+	if err != nil {
+		ct.Fatalf(t, err.Error())
+	}
+}
+
+func (w *nioTimelineWaiter) TryWaitf(t ct.TestLike, s time.Duration, format string, args ...any) error {
+	t.Helper()
+	updates := make(chan bool, 3)
+	cancel := w.client.listenForEvents(func(ev *nioEvent) {
+		if ev.RoomID != w.roomID || !w.checker(*ev.toEvent()) {
+			return
+		}
+		select {
+		case updates <- true:
+		default:
+		}
+	})
+	defer cancel()
+
+	// check if it already exists in the timeline
+	timeline, _ := w.client.GetTimeline(t, w.roomID)
+	for _, ev := range timeline {
+		if w.checker(*ev) {
+			return nil
+		}
+	}
+
+	msg := fmt.Sprintf(format, args...)
+	select {
+	case <-time.After(s):
+		return fmt.Errorf("%s (nio): Wait[%s]: timed out: %s", w.client.userID, w.roomID, msg)
+	case <-updates:
+		return nil // event exists
+	}
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	formRegexp       = regexp.MustCompile(`(?is)<form[^>]*method="post"[^>]*>.*?</form>`)
+	formActionRegexp = regexp.MustCompile(`(?i)<form[^>]*action="([^"]*)"`)
+	inputRegexp      = regexp.MustCompile(`(?i)<input[^>]*>`)
+	nameAttrRegexp   = regexp.MustCompile(`(?i)\sname="([^"]*)"`)
+	valueAttrRegexp  = regexp.MustCompile(`(?i)\svalue="([^"]*)"`)
+)
+
+// CompleteOIDCLogin logs in to an OIDC provider as a user would in a browser: it follows loginURL, the
+// authorization URL generated by the client, then submits the username and password and grants consent.
+// Returns the URL the provider redirected to, which contains the authorization code for the client to
+// complete the login with.
+//
+// Only the HTML forms served by matrix-authentication-service are supported, see deploy.NewOIDCHomeserver.
+func CompleteOIDCLogin(loginURL, username, password, redirectURI string) (callbackURL string, err error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return "", err
+	}
+	cli := &http.Client{
+		Jar:     jar,
+		Timeout: 10 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			// the redirect URI does not exist, so stop here and hand it to the client
+			if strings.HasPrefix(req.URL.String(), redirectURI) {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	res, err := cli.Get(loginURL)
+	// login page, consent page, and possibly a "continue" page
+	for i := 0; i < 5; i++ {
+		if err != nil {
+			return "", fmt.Errorf("CompleteOIDCLogin: %s", err)
+		}
+		location := res.Header.Get("Location")
+		if location != "" && strings.HasPrefix(location, redirectURI) {
+			res.Body.Close()
+			return location, nil
+		}
+		body, readErr := io.ReadAll(res.Body)
+		res.Body.Close()
+		if readErr != nil {
+			return "", fmt.Errorf("CompleteOIDCLogin: failed to read %s: %s", res.Request.URL, readErr)
+		}
+		form := formRegexp.FindString(string(body))
+		if form == "" {
+			return "", fmt.Errorf("CompleteOIDCLogin: no form to submit on %s (HTTP %d)", res.Request.URL, res.StatusCode)
+		}
+		action := res.Request.URL
+		if m := formActionRegexp.FindStringSubmatch(form); m != nil && m[1] != "" {
+			action, err = res.Request.URL.Parse(html.UnescapeString(m[1]))
+			if err != nil {
+				return "", fmt.Errorf("CompleteOIDCLogin: bad form action on %s: %s", res.Request.URL, err)
+			}
+		}
+		values := url.Values{}
+		for _, input := range inputRegexp.FindAllString(form, -1) {
+			name := nameAttrRegexp.FindStringSubmatch(input)
+			if name == nil {
+				continue
+			}
+			value := ""
+			if m := valueAttrRegexp.FindStringSubmatch(input); m != nil {
+				value = html.UnescapeString(m[1])
+			}
+			switch name[1] {
+			case "username":
+				value = username
+			case "password":
+				value = password
+			}
+			values.Set(name[1], value)
+		}
+		res, err = cli.PostForm(action.String(), values)
+	}
+	return "", fmt.Errorf("CompleteOIDCLogin: not redirected to %s after submitting all forms", redirectURI)
+}
@@ -0,0 +1,97 @@
+package rust
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+	"github.com/tidwall/gjson"
+)
+
+// csapi returns a client which makes Client-Server API requests as this device, for the few things which the
+// FFI bindings do not expose. Requests are sent to the same homeserver URL as the FFI client uses, and trust
+// the same certificates.
+func (c *RustClient) csapi(t ct.TestLike) (*client.CSAPI, error) {
+	t.Helper()
+	session, err := c.FFIClient.Session()
+	if err != nil {
+		return nil, fmt.Errorf("Session: %s", err)
+	}
+	httpClient, err := newHTTPClient(c.opts.DisableSSLVerification, c.opts.RootCertificates)
+	if err != nil {
+		return nil, err
+	}
+	return &client.CSAPI{
+		UserID:           session.UserId,
+		AccessToken:      session.AccessToken,
+		DeviceID:         session.DeviceId,
+		BaseURL:          session.HomeserverUrl,
+		Client:           client.NewLoggedClient(t, c.userID, httpClient),
+		SyncUntilTimeout: 5 * time.Second,
+	}, nil
+}
+
+// doCSAPI makes a Client-Server API request as this device, returning the JSON response body. The query and
+// JSON request body are optional. Returns an error if the request fails or the response is not a 2xx.
+func (c *RustClient) doCSAPI(t ct.TestLike, method string, paths []string, query url.Values, reqBody any) (gjson.Result, error) {
+	t.Helper()
+	cli, err := c.csapi(t)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	var opts []client.RequestOpt
+	if query != nil {
+		opts = append(opts, client.WithQueries(query))
+	}
+	if reqBody != nil {
+		opts = append(opts, client.WithJSONBody(t, reqBody))
+	}
+	res := cli.Do(t, method, paths, opts...)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return gjson.Result{}, fmt.Errorf("%s %s: failed to read response: %s", method, res.Request.URL.Path, err)
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return gjson.Result{}, fmt.Errorf("%s %s returned HTTP %d: %s", method, res.Request.URL.Path, res.StatusCode, string(body))
+	}
+	if !gjson.ValidBytes(body) {
+		return gjson.Result{}, fmt.Errorf("%s %s returned invalid JSON: %s", method, res.Request.URL.Path, string(body))
+	}
+	return gjson.ParseBytes(body), nil
+}
+
+// newHTTPClient returns an HTTP client which verifies TLS certificates in the same way as a ClientBuilder
+// configured with DisableSslVerification and AddRootCertificates. rootCertificates are DER encoded.
+func newHTTPClient(disableSSLVerification bool, rootCertificates [][]byte) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: disableSSLVerification,
+	}
+	if len(rootCertificates) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, der := range rootCertificates {
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse root certificate: %s", err)
+			}
+			pool.AddCert(cert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}, nil
+}
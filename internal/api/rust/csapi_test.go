@@ -0,0 +1,54 @@
+package rust
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/must"
+)
+
+func TestNewHTTPClient(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	must.NotError(t, "GenerateKey", err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "complement-crypto test CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	must.NotError(t, "CreateCertificate", err)
+
+	// by default, only the system roots are trusted
+	cli, err := newHTTPClient(false, nil)
+	must.NotError(t, "newHTTPClient", err)
+	tlsConfig := cli.Transport.(*http.Transport).TLSClientConfig
+	must.Equal(t, tlsConfig.InsecureSkipVerify, false, "verifies certificates by default")
+	must.Equal(t, tlsConfig.RootCAs == nil, true, "uses the system roots by default")
+
+	// root certificates are trusted in addition to the system roots
+	cli, err = newHTTPClient(false, [][]byte{der})
+	must.NotError(t, "newHTTPClient", err)
+	cert, err := x509.ParseCertificate(der)
+	must.NotError(t, "ParseCertificate", err)
+	_, err = cert.Verify(x509.VerifyOptions{Roots: cli.Transport.(*http.Transport).TLSClientConfig.RootCAs})
+	must.NotError(t, "root certificate is not trusted", err)
+
+	cli, err = newHTTPClient(true, nil)
+	must.NotError(t, "newHTTPClient", err)
+	must.Equal(t, cli.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify, true, "disables verification")
+
+	_, err = newHTTPClient(false, [][]byte{[]byte("not a certificate")})
+	if err == nil {
+		t.Errorf("newHTTPClient: expected an error for an invalid root certificate")
+	}
+}
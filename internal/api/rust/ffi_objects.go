@@ -0,0 +1,98 @@
+package rust
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// FFI objects which hold Rust resources (clients, sync services, listener task handles, ...) must be
+// explicitly destroyed or cancelled. If they are not, listeners keep firing after the test has finished and
+// the objects are eventually freed by Go finalisers after the tokio runtime has gone, which hangs or panics
+// in a way which is very hard to attribute to the test which leaked them. ffiObjects tracks these objects
+// per client so leaks can be reported when the client is closed.
+
+// ffiObject describes a tracked FFI object.
+type ffiObject struct {
+	kind     string
+	testName string
+	created  time.Time
+	seq      int
+}
+
+// ffiObjects is a registry of FFI objects which have been created but not yet destroyed.
+type ffiObjects struct {
+	mu      sync.Mutex
+	live    map[any]ffiObject
+	nextSeq int
+}
+
+func newFFIObjects() *ffiObjects {
+	return &ffiObjects{
+		live: make(map[any]ffiObject),
+	}
+}
+
+// track records that obj, which must be a pointer, was created by the test. The kind describes the object
+// for leak reports e.g "Timeline.AddListener(!foo:hs1)". Call release when the object is destroyed.
+func (o *ffiObjects) track(t ct.TestLike, kind string, obj any) {
+	if obj == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.nextSeq++
+	o.live[obj] = ffiObject{
+		kind:     kind,
+		testName: t.Name(),
+		created:  time.Now(),
+		seq:      o.nextSeq,
+	}
+}
+
+// release records that obj was destroyed. Releasing an untracked object does nothing.
+func (o *ffiObjects) release(obj any) {
+	if obj == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.live, obj)
+}
+
+// leaked returns descriptions of the objects which have not been released, oldest first.
+func (o *ffiObjects) leaked() []string {
+	o.mu.Lock()
+	objs := make([]ffiObject, 0, len(o.live))
+	for _, obj := range o.live {
+		objs = append(objs, obj)
+	}
+	o.mu.Unlock()
+	sort.Slice(objs, func(i, j int) bool {
+		return objs[i].seq < objs[j].seq
+	})
+	descs := make([]string, len(objs))
+	for i, obj := range objs {
+		descs[i] = fmt.Sprintf("%s (created by %s at %s)", obj.kind, obj.testName, obj.created.Format("15:04:05.000"))
+	}
+	return descs
+}
+
+// reportFFILeaks reports FFI objects made by this client which were not destroyed. The test fails if
+// api.ClientCreationOpts.FailOnFFILeaks is set, otherwise the leaks are logged.
+func (c *RustClient) reportFFILeaks(t ct.TestLike) {
+	t.Helper()
+	leaked := c.ffiObjects.leaked()
+	if len(leaked) == 0 {
+		return
+	}
+	format := "[%s] %d FFI objects were not destroyed when the client was closed: %v"
+	if c.opts.FailOnFFILeaks {
+		ct.Errorf(t, format, c.userID, len(leaked), leaked)
+		return
+	}
+	c.Logf(t, "WARNING: "+format, c.userID, len(leaked), leaked)
+}
@@ -0,0 +1,36 @@
+package rust
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement/must"
+)
+
+func TestFFIObjects(t *testing.T) {
+	type handle struct{ id int }
+	objects := newFFIObjects()
+	client, listener, stream := &handle{1}, &handle{2}, &handle{3}
+	objects.track(t, "Client", client)
+	objects.track(t, "Timeline.AddListener(!foo:hs1)", listener)
+	objects.track(t, "SyncService.State", stream)
+
+	objects.release(listener)
+	// releasing twice or releasing untracked objects is fine
+	objects.release(listener)
+	objects.release(&handle{4})
+	objects.release(nil)
+
+	leaked := objects.leaked()
+	must.Equal(t, len(leaked), 2, "number of leaked objects")
+	if !strings.HasPrefix(leaked[0], "Client (created by "+t.Name()) {
+		t.Errorf("leaked[0]: want the client first, got %s", leaked[0])
+	}
+	if !strings.HasPrefix(leaked[1], "SyncService.State") {
+		t.Errorf("leaked[1]: want the sync state handle, got %s", leaked[1])
+	}
+
+	objects.release(client)
+	objects.release(stream)
+	must.Equal(t, len(objects.leaked()), 0, "number of leaked objects after release")
+}
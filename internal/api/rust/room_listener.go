@@ -55,3 +55,13 @@ func (l *RoomsListener) BroadcastUpdateForRoom(roomID string) {
 		}
 	}
 }
+
+// TryLen returns the number of registered listeners. Never blocks, so it is safe to call whilst diagnosing
+// deadlocks: returns ok=false if the listeners are locked.
+func (l *RoomsListener) TryLen() (n int, ok bool) {
+	if !l.mu.TryRLock() {
+		return 0, false
+	}
+	defer l.mu.RUnlock()
+	return len(l.listeners), true
+}
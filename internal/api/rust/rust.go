@@ -1,7 +1,10 @@
 package rust
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -11,6 +14,8 @@ import (
 
 	"github.com/matrix-org/complement-crypto/internal/api"
 	"github.com/matrix-org/complement-crypto/internal/api/rust/matrix_sdk_ffi"
+	"github.com/matrix-org/complement-crypto/internal/logging"
+	"github.com/matrix-org/complement-crypto/internal/secretstorage"
 	"github.com/matrix-org/complement/ct"
 	"github.com/matrix-org/complement/helpers"
 	"github.com/matrix-org/complement/must"
@@ -29,9 +34,10 @@ func DeleteOldLogs(prefix string) {
 
 func SetupLogs(prefix string) {
 	// log new files
+	logFilePrefix = prefix
 	matrix_sdk_ffi.SetupTracing(matrix_sdk_ffi.TracingConfiguration{
 		LogLevel:              matrix_sdk_ffi.LogLevelTrace,
-		ExtraTargets:          nil,
+		ExtraTargets:          []string{spanTarget},
 		WriteToStdoutOrSystem: false,
 		WriteToFiles: &matrix_sdk_ffi.TracingFileConfiguration{
 			Path:       "./logs",
@@ -58,6 +64,7 @@ type RustRoomInfo struct {
 
 type RustClient struct {
 	FFIClient             *matrix_sdk_ffi.Client
+	newClientBuilder      func() *matrix_sdk_ffi.ClientBuilder
 	syncService           *matrix_sdk_ffi.SyncService
 	roomsListener         *RoomsListener
 	entriesController     *matrix_sdk_ffi.RoomListDynamicEntriesController
@@ -69,51 +76,129 @@ type RustClient struct {
 	persistentStoragePath string
 	opts                  api.ClientCreationOpts
 	closed                *atomic.Bool
+	// true if room keys are only sent to trusted devices, read when building the client
+	onlyTrustVerified *atomic.Bool
+	// the passphrase for the on-disk stores, read when building the client
+	storePassphrase *atomic.Pointer[string]
+	// stops the current sync loop, if any. Replaced when the sync loop is restarted.
+	stopSyncingFn func()
+	// informed whenever the sync service changes state
+	syncStateListeners api.SyncStateListeners
+	// the last state of the sync service, for diagnosing deadlocks without taking any locks
+	lastSyncState atomic.Pointer[api.SyncState]
+	// informed whenever the key backup changes state
+	backupStateListeners api.BackupStateListeners
+	// listens for backup states from the FFI client, set when ListenForBackupStates is first called
+	backupStateHandle *matrix_sdk_ffi.TaskHandle
+	backupStateMu     sync.Mutex
+	// the secret storage key from the last recovery key created or unlocked, for StoreSecret and GetSecret
+	secretStorageKey atomic.Pointer[[]byte]
 
 	// for push notification tests (single/multi-process)
 	notifClient *matrix_sdk_ffi.NotificationClient
+
+	// the size of each rust log file when this client was made, see correlateLogs
+	logOffsets map[string]int64
+	// FFI objects made by this client which have not been destroyed yet, reported on Close
+	ffiObjects *ffiObjects
+	// clients abandoned by Kill, destroyed on Close
+	killedClients []*matrix_sdk_ffi.Client
+	// the session of the last killed client, used by RestoreFromStorage. nil if the client is alive.
+	killedSession *matrix_sdk_ffi.Session
 }
 
 func NewRustClient(t ct.TestLike, opts api.ClientCreationOpts) (api.Client, error) {
 	t.Logf("NewRustClient[%s][%s] creating...", opts.UserID, opts.DeviceID)
 	matrix_sdk_ffi.LogEvent("rust.go", &zero, matrix_sdk_ffi.LogLevelInfo, t.Name(), fmt.Sprintf("NewRustClient[%s][%s] creating...", opts.UserID, opts.DeviceID))
-	slidingSyncVersion := matrix_sdk_ffi.SlidingSyncVersionBuilderNative{}
+	var slidingSyncVersion matrix_sdk_ffi.SlidingSyncVersionBuilder = matrix_sdk_ffi.SlidingSyncVersionBuilderNative{}
+	var sessionSlidingSyncVersion matrix_sdk_ffi.SlidingSyncVersion = matrix_sdk_ffi.SlidingSyncVersionNative{}
+	if opts.SlidingSyncURL != "" {
+		slidingSyncVersion = matrix_sdk_ffi.SlidingSyncVersionBuilderProxy{Url: opts.SlidingSyncURL}
+		sessionSlidingSyncVersion = matrix_sdk_ffi.SlidingSyncVersionProxy{Url: opts.SlidingSyncURL}
+	}
 	clientSessionDelegate := NewMemoryClientSessionDelegate()
-	ab := matrix_sdk_ffi.NewClientBuilder().
-		HomeserverUrl(opts.BaseURL).
-		SlidingSyncVersionBuilder(slidingSyncVersion).
-		AutoEnableCrossSigning(true).
-		SetSessionDelegate(clientSessionDelegate)
 	xprocessName := opts.GetExtraOption(CrossProcessStoreLocksHolderName, "").(string)
-	if xprocessName != "" {
-		t.Logf("setting cross process store locks holder name=%s", xprocessName)
-		ab = ab.CrossProcessStoreLocksHolderName(xprocessName)
-	}
 	// @alice:hs1, FOOBAR => alice_hs1_FOOBAR
 	username := strings.Replace(opts.UserID[1:], ":", "_", -1) + "_" + opts.DeviceID
 	sessionPath := "rust_storage/" + username
-	ab = ab.SessionPaths(sessionPath, sessionPath).Username(username)
-	client, err := ab.Build()
+	storeBackend := resolveStoreBackend(opts.StoreBackend)
+	if opts.MigrateStoreFrom != api.StoreBackendDefault && resolveStoreBackend(opts.MigrateStoreFrom) != storeBackend {
+		return nil, fmt.Errorf("migrating store from %s to %s: %w", opts.MigrateStoreFrom, storeBackend, api.ErrNotSupported)
+	}
+	switch storeBackend {
+	case api.StoreBackendSQLite:
+	case api.StoreBackendInMemory:
+		if opts.PersistentStorage {
+			return nil, fmt.Errorf("store backend %s cannot be used with PersistentStorage", storeBackend)
+		}
+	default:
+		return nil, fmt.Errorf("store backend %s: %w", storeBackend, api.ErrNotSupported)
+	}
+	onlyTrustVerified := &atomic.Bool{}
+	storePassphrase := &atomic.Pointer[string]{}
+	if opts.StorePassphrase != "" {
+		storePassphrase.Store(&opts.StorePassphrase)
+	}
+	// Restarting the client needs to build a new client with the same options, so keep hold of how to make the builder.
+	newClientBuilder := func() *matrix_sdk_ffi.ClientBuilder {
+		ab := matrix_sdk_ffi.NewClientBuilder().
+			HomeserverUrl(opts.BaseURL).
+			SlidingSyncVersionBuilder(slidingSyncVersion).
+			AutoEnableCrossSigning(true).
+			SetSessionDelegate(clientSessionDelegate)
+		if opts.EnableShareHistoryOnInvite {
+			ab = ab.EnableShareHistoryOnInvite(true)
+		}
+		if opts.DisableSSLVerification {
+			ab = ab.DisableSslVerification()
+		}
+		if len(opts.RootCertificates) > 0 {
+			ab = ab.AddRootCertificates(opts.RootCertificates)
+		}
+		if onlyTrustVerified.Load() {
+			ab = ab.RoomKeyRecipientStrategy(matrix_sdk_ffi.CollectStrategyDeviceBasedStrategy{
+				OnlyAllowTrustedDevices: true,
+			})
+		}
+		if xprocessName != "" {
+			t.Logf("setting cross process store locks holder name=%s", xprocessName)
+			ab = ab.CrossProcessStoreLocksHolderName(xprocessName)
+		}
+		if passphrase := storePassphrase.Load(); passphrase != nil {
+			ab = ab.Passphrase(passphrase)
+		}
+		if storeBackend == api.StoreBackendInMemory {
+			return ab.InMemoryStore().Username(username)
+		}
+		return ab.SessionPaths(sessionPath, sessionPath).Username(username)
+	}
+	client, err := newClientBuilder().Build()
 	if err != nil {
 		return nil, fmt.Errorf("ClientBuilder.Build failed: %s", err)
 	}
 	c := &RustClient{
 		userID:                opts.UserID,
 		FFIClient:             client,
+		newClientBuilder:      newClientBuilder,
 		roomsListener:         NewRoomsListener(),
 		rooms:                 make(map[string]*RustRoomInfo),
 		roomsMu:               &sync.RWMutex{},
 		opts:                  opts,
 		persistentStoragePath: "./rust_storage/" + username,
 		closed:                &atomic.Bool{},
+		onlyTrustVerified:     onlyTrustVerified,
+		storePassphrase:       storePassphrase,
+		logOffsets:            logFileOffsets(),
+		ffiObjects:            newFFIObjects(),
 	}
+	c.ffiObjects.track(t, "Client", client)
 	if opts.AccessToken != "" { // restore the session
 		session := matrix_sdk_ffi.Session{
 			AccessToken:        opts.AccessToken,
 			UserId:             opts.UserID,
 			DeviceId:           opts.DeviceID,
 			HomeserverUrl:      opts.BaseURL,
-			SlidingSyncVersion: matrix_sdk_ffi.SlidingSyncVersionNative{},
+			SlidingSyncVersion: sessionSlidingSyncVersion,
 		}
 		if err := client.RestoreSession(session); err != nil {
 			return nil, fmt.Errorf("RestoreSession: %s", err)
@@ -127,6 +212,7 @@ func NewRustClient(t ct.TestLike, opts api.ClientCreationOpts) (api.Client, erro
 				return nil, fmt.Errorf("NotificationClient failed: %s", err)
 			}
 			c.notifClient = notifClient
+			c.ffiObjects.track(t, "NotificationClient", notifClient)
 		}
 	}
 
@@ -134,6 +220,14 @@ func NewRustClient(t ct.TestLike, opts api.ClientCreationOpts) (api.Client, erro
 	return &api.LoggedClient{Client: c}, nil
 }
 
+// resolveStoreBackend returns the store backend which will actually be used for the given option.
+func resolveStoreBackend(backend api.StoreBackend) api.StoreBackend {
+	if backend == api.StoreBackendDefault {
+		return api.StoreBackendSQLite
+	}
+	return backend
+}
+
 func (c *RustClient) Opts() api.ClientCreationOpts {
 	// add access token if we weren't made with it
 	if c.opts.AccessToken == "" && c.FFIClient != nil {
@@ -146,6 +240,7 @@ func (c *RustClient) Opts() api.ClientCreationOpts {
 }
 
 func (c *RustClient) GetNotification(t ct.TestLike, roomID, eventID string) (*api.Notification, error) {
+	defer c.span(t, "GetNotification")()
 	if c.notifClient == nil {
 		var err error
 		c.Logf(t, "creating NotificationClient")
@@ -155,19 +250,28 @@ func (c *RustClient) GetNotification(t ct.TestLike, roomID, eventID string) (*ap
 		if err != nil {
 			return nil, fmt.Errorf("GetNotification: failed to create NotificationClient: %s", err)
 		}
+		c.ffiObjects.track(t, "NotificationClient", c.notifClient)
 	}
-	notifItem, err := c.notifClient.GetNotification(roomID, eventID)
+	notifItem, err := watchFFI(c, t, fmt.Sprintf("GetNotification(%s, %s)", roomID, eventID), func() (*matrix_sdk_ffi.NotificationItem, error) {
+		return c.notifClient.GetNotification(roomID, eventID)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("GetNotification: %s", err)
 	}
 	// TODO: handle NotificationEventInvite
-	notifEvent := notifItem.Event.(matrix_sdk_ffi.NotificationEventTimeline)
+	notifEvent, ok := notifItem.Event.(matrix_sdk_ffi.NotificationEventTimeline)
+	if !ok {
+		return nil, fmt.Errorf("GetNotification: notification is not for a timeline event: %T", notifItem.Event)
+	}
 	// TODO: handle notifications other than messages..
 	evType, err := notifEvent.Event.EventType()
 	if err != nil {
 		return nil, fmt.Errorf("notifItem.Event.EventType => %s", err)
 	}
-	msgLike := evType.(matrix_sdk_ffi.TimelineEventTypeMessageLike)
+	msgLike, ok := evType.(matrix_sdk_ffi.TimelineEventTypeMessageLike)
+	if !ok {
+		return nil, fmt.Errorf("GetNotification: notification is not for a message-like event: %T", evType)
+	}
 	failedToDecrypt := true
 	body := ""
 	switch msg := msgLike.Content.(type) {
@@ -189,26 +293,80 @@ func (c *RustClient) GetNotification(t ct.TestLike, roomID, eventID string) (*ap
 			FailedToDecrypt: failedToDecrypt,
 		},
 		HasMentions: notifItem.HasMention,
+		IsNoisy:     notifItem.IsNoisy,
+	}
+	if failedToDecrypt {
+		n.Event.DecryptionFailureReason = api.DecryptionFailureReasonUnknown
 	}
 	return &n, nil
 }
 
 func (c *RustClient) Login(t ct.TestLike, opts api.ClientCreationOpts) error {
-	var deviceID *string
-	if opts.DeviceID != "" {
-		deviceID = &opts.DeviceID
-	}
-	err := c.FFIClient.Login(opts.UserID, opts.Password, nil, deviceID)
-	if err != nil {
-		return fmt.Errorf("Client.Login failed: %s", err)
+	defer c.span(t, "Login")()
+	if opts.UseOIDC {
+		if err := c.loginWithOIDC(t, opts); err != nil {
+			return err
+		}
+	} else {
+		var deviceID *string
+		if opts.DeviceID != "" {
+			deviceID = &opts.DeviceID
+		}
+		err := c.watchFFIErr(t, fmt.Sprintf("Login(%s)", opts.UserID), func() error {
+			return c.FFIClient.Login(opts.UserID, opts.Password, nil, deviceID)
+		})
+		if err != nil {
+			return fmt.Errorf("Client.Login failed: %s", err)
+		}
 	}
 	// let the client upload device keys and OTKs
 	e := c.FFIClient.Encryption()
-	e.WaitForE2eeInitializationTasks()
-	e.Destroy()
+	defer e.Destroy()
+	return c.watchFFIErr(t, "WaitForE2eeInitializationTasks()", func() error {
+		e.WaitForE2eeInitializationTasks()
+		return nil
+	})
+}
+
+// loginWithOIDC logs in via the homeserver's OIDC provider using the authorization code grant. The FFI
+// client refreshes the access token itself, saving the new session via the session delegate.
+func (c *RustClient) loginWithOIDC(t ct.TestLike, opts api.ClientCreationOpts) error {
+	t.Helper()
+	oidcConfig := c.oidcConfiguration()
+	authData, err := c.FFIClient.UrlForOidc(&oidcConfig, matrix_sdk_ffi.OidcPromptConsent{})
+	if err != nil {
+		return fmt.Errorf("Client.UrlForOidc failed: %s", err)
+	}
+	defer authData.Destroy()
+	// @alice:hs1 => alice
+	localpart := strings.SplitN(strings.TrimPrefix(opts.UserID, "@"), ":", 2)[0]
+	callbackURL, err := api.CompleteOIDCLogin(authData.LoginUrl(), localpart, opts.Password, oidcConfig.RedirectUri)
+	if err != nil {
+		return err
+	}
+	err = c.watchFFIErr(t, "LoginWithOidcCallback()", func() error {
+		return c.FFIClient.LoginWithOidcCallback(authData, callbackURL)
+	})
+	if err != nil {
+		return fmt.Errorf("Client.LoginWithOidcCallback failed: %s", err)
+	}
+	c.Logf(t, "logged in via OIDC as %s", opts.UserID)
 	return nil
 }
 
+func (c *RustClient) oidcConfiguration() matrix_sdk_ffi.OidcConfiguration {
+	clientName := "complement-crypto"
+	clientURI := "http://localhost/complement-crypto"
+	return matrix_sdk_ffi.OidcConfiguration{
+		ClientName:          &clientName,
+		ClientUri:           &clientURI,
+		RedirectUri:         "http://localhost/complement-crypto/redirect",
+		StaticRegistrations: map[string]string{},
+		// written to the same place as the rest of this client's storage
+		DynamicRegistrationsFile: c.persistentStoragePath + "/oidc_registrations.json",
+	}
+}
+
 func (c *RustClient) CurrentAccessToken(t ct.TestLike) string {
 	s, err := c.FFIClient.Session()
 	if err != nil {
@@ -222,6 +380,7 @@ func (c *RustClient) ListenForVerificationRequests(t ct.TestLike) chan api.Verif
 }
 
 func (c *RustClient) RequestOwnUserVerification(t ct.TestLike) chan api.VerificationStage {
+	defer c.span(t, "RequestOwnUserVerification")()
 	svc, err := c.FFIClient.GetSessionVerificationController()
 	if err != nil {
 		ct.Fatalf(t, "GetSessionVerificationController: %s", err)
@@ -282,6 +441,13 @@ func (c *RustClient) RequestOwnUserVerification(t ct.TestLike) chan api.Verifica
 	return ch
 }
 
+// RequestUserVerification is not supported as the FFI bindings send user verification requests in a DM which
+// the rust SDK picks itself, so they cannot be sent in the given room. See "Why was a test skipped for one
+// client?" in FAQ.md.
+func (c *RustClient) RequestUserVerification(t ct.TestLike, userID, roomID string) (chan api.VerificationStage, error) {
+	return nil, fmt.Errorf("RequestUserVerification: %w", api.ErrNotSupported)
+}
+
 func (c *RustClient) DeletePersistentStorage(t ct.TestLike) {
 	t.Helper()
 	if c.persistentStoragePath != "" {
@@ -291,6 +457,14 @@ func (c *RustClient) DeletePersistentStorage(t ct.TestLike) {
 		}
 	}
 }
+func (c *RustClient) PersistentStoragePath(t ct.TestLike) string {
+	// the sqlite stores are always on disk, even if persistent storage is not enabled.
+	if resolveStoreBackend(c.opts.StoreBackend) == api.StoreBackendInMemory {
+		return ""
+	}
+	return c.persistentStoragePath
+}
+
 func (c *RustClient) ForceClose(t ct.TestLike) {
 	t.Helper()
 	t.Fatalf("Cannot force close a rust client, use an RPC client instead.")
@@ -298,6 +472,9 @@ func (c *RustClient) ForceClose(t ct.TestLike) {
 
 func (c *RustClient) Close(t ct.TestLike) {
 	t.Helper()
+	if t.Failed() {
+		c.correlateLogs(t)
+	}
 	c.closed.Store(true)
 	c.roomsMu.Lock()
 	for _, rri := range c.rooms {
@@ -305,28 +482,46 @@ func (c *RustClient) Close(t ct.TestLike) {
 			// ensure we don't see AddTimelineListener callbacks as they can cause panics
 			// if we t.Logf after t has passed/failed.
 			rri.stream.Cancel()
+			c.ffiObjects.release(rri.stream)
 		}
 	}
 	c.roomsMu.Unlock()
 	if c.entriesController != nil {
 		c.entriesController.Destroy()
+		c.ffiObjects.release(c.entriesController)
 		c.entriesController = nil
 	}
 	if c.entriesAdapters != nil {
 		c.entriesAdapters.Destroy()
+		c.ffiObjects.release(c.entriesAdapters)
 		c.entriesAdapters = nil
 	}
-	c.FFIClient.Destroy()
-	c.FFIClient = nil
+	c.stopListeningForBackupStates()
+	if c.FFIClient != nil {
+		c.FFIClient.Destroy()
+		c.ffiObjects.release(c.FFIClient)
+		c.FFIClient = nil
+	}
+	for _, client := range c.killedClients {
+		client.Destroy()
+		c.ffiObjects.release(client)
+	}
+	c.killedClients = nil
 	if c.notifClient != nil {
 		c.notifClient.Destroy()
+		c.ffiObjects.release(c.notifClient)
 	}
+	c.reportFFILeaks(t)
 }
 
 func (c *RustClient) GetEvent(t ct.TestLike, roomID, eventID string) (*api.Event, error) {
 	t.Helper()
+	defer c.span(t, "GetEvent")()
 	room := c.findRoom(t, roomID)
-	timelineItem, err := mustGetTimeline(t, room).GetEventTimelineItemByEventId(eventID)
+	timeline := c.mustGetTimeline(t, room)
+	timelineItem, err := watchFFI(c, t, fmt.Sprintf("GetEventTimelineItemByEventId(%s)", eventID), func() (matrix_sdk_ffi.EventTimelineItem, error) {
+		return timeline.GetEventTimelineItemByEventId(eventID)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to GetEventTimelineItemByEventId(%s): %s", eventID, err)
 	}
@@ -334,13 +529,123 @@ func (c *RustClient) GetEvent(t ct.TestLike, roomID, eventID string) (*api.Event
 	if ev == nil {
 		return nil, fmt.Errorf("found timeline item %s but failed to convert it to an Event", eventID)
 	}
+	if source := fileMediaSource(timelineItem); ev.File != nil && source != nil {
+		// this downloads and decrypts the file
+		contents, err := watchFFI(c, t, fmt.Sprintf("GetMediaContent(%s)", eventID), func() ([]byte, error) {
+			return c.FFIClient.GetMediaContent(source)
+		})
+		if err != nil {
+			ev.File.DownloadError = err.Error()
+		} else {
+			ev.File.Contents = contents
+		}
+	}
 	return ev, nil
 }
 
+// MarkAsRead sends a read receipt for the latest event in the timeline which the SDK thinks a receipt can be
+// sent for.
+func (c *RustClient) MarkAsRead(t ct.TestLike, roomID string) error {
+	t.Helper()
+	defer c.span(t, "MarkAsRead")()
+	room := c.findRoom(t, roomID)
+	if room == nil {
+		return fmt.Errorf("MarkAsRead: cannot find room %s", roomID)
+	}
+	timeline := c.mustGetTimeline(t, room)
+	return c.watchFFIErr(t, "Timeline.MarkAsRead()", func() error {
+		return timeline.MarkAsRead(matrix_sdk_ffi.ReceiptTypeRead)
+	})
+}
+
+// GetReadReceipt returns the newest event in the timeline which has a read receipt from the user. The timeline
+// shows receipts for hidden events on the nearest visible event before them, so this may not be the event in the
+// receipt itself.
+func (c *RustClient) GetReadReceipt(t ct.TestLike, roomID, userID string) (eventID string, err error) {
+	t.Helper()
+	defer c.span(t, "GetReadReceipt")()
+	room := c.findRoom(t, roomID)
+	if room == nil {
+		return "", fmt.Errorf("GetReadReceipt: cannot find room %s", roomID)
+	}
+	c.ensureListening(t, roomID)
+	c.roomsMu.RLock()
+	var eventIDs []string
+	if info := c.rooms[roomID]; info != nil {
+		for _, ev := range info.timeline {
+			if ev != nil && ev.ID != "" {
+				eventIDs = append(eventIDs, ev.ID)
+			}
+		}
+	}
+	c.roomsMu.RUnlock()
+	timeline := c.mustGetTimeline(t, room)
+	for i := len(eventIDs) - 1; i >= 0; i-- {
+		item, err := watchFFI(c, t, fmt.Sprintf("GetEventTimelineItemByEventId(%s)", eventIDs[i]), func() (matrix_sdk_ffi.EventTimelineItem, error) {
+			return timeline.GetEventTimelineItemByEventId(eventIDs[i])
+		})
+		if err != nil {
+			continue // the item may have been removed since we copied the timeline
+		}
+		if _, exists := item.ReadReceipts[userID]; exists {
+			return eventIDs[i], nil
+		}
+	}
+	return "", nil
+}
+
+// GetThread fetches the thread via /relations directly, as the FFI bindings do not expose /relations, then
+// returns the client's view of each event. The rust SDK cannot decrypt events which did not come from its own
+// timeline, so every event in the thread must already be in the room timeline e.g by backpaginating first.
+func (c *RustClient) GetThread(t ct.TestLike, roomID, threadRootID string) ([]*api.Event, error) {
+	t.Helper()
+	defer c.span(t, "GetThread")()
+	res, err := c.doCSAPI(t, "GET", []string{"_matrix", "client", "v1", "rooms", roomID, "relations", threadRootID, "m.thread"}, url.Values{
+		"dir": []string{"f"},
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get thread %s in room %s: %s", threadRootID, roomID, err)
+	}
+	var thread []*api.Event
+	for _, relation := range res.Get("chunk").Array() {
+		ev, err := c.GetEvent(t, roomID, relation.Get("event_id").Str)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get thread %s in room %s: %s", threadRootID, roomID, err)
+		}
+		thread = append(thread, ev)
+	}
+	return thread, nil
+}
+
+func (c *RustClient) GetTimeline(t ct.TestLike, roomID string) ([]*api.Event, error) {
+	t.Helper()
+	defer c.span(t, "GetTimeline")()
+	if c.findRoom(t, roomID) == nil {
+		return nil, fmt.Errorf("GetTimeline: cannot find room %s", roomID)
+	}
+	c.ensureListening(t, roomID)
+	c.roomsMu.RLock()
+	defer c.roomsMu.RUnlock()
+	info := c.rooms[roomID]
+	if info == nil {
+		return nil, fmt.Errorf("GetTimeline: room %s has no timeline", roomID)
+	}
+	timeline := make([]*api.Event, 0, len(info.timeline))
+	for _, ev := range info.timeline {
+		if ev == nil { // e.g day divider
+			continue
+		}
+		evCopy := *ev
+		timeline = append(timeline, &evCopy)
+	}
+	return timeline, nil
+}
+
 // StartSyncing to begin syncing from sync v2 / sliding sync.
 // Tests should call stopSyncing() at the end of the test.
 func (c *RustClient) StartSyncing(t ct.TestLike) (stopSyncing func(), err error) {
 	t.Helper()
+	defer c.span(t, "StartSyncing")()
 	// It's critical that we destroy the sync_service_builder object before we return.
 	// You might be tempted to chain this function call e.g FFIClient.SyncService().Finish()
 	// but if you do that, the builder is never destroyed. If that happens, the builder will
@@ -356,21 +661,29 @@ func (c *RustClient) StartSyncing(t ct.TestLike) (stopSyncing func(), err error)
 		sb = sb2
 	}
 	defer sb.Destroy()
-	syncService, err := sb.Finish()
+	syncService, err := watchFFI(c, t, "SyncServiceBuilder.Finish()", sb.Finish)
 	if err != nil {
 		return nil, fmt.Errorf("[%s]failed to make sync service: %s", c.userID, err)
 	}
+	c.ffiObjects.track(t, "SyncService", syncService)
 	rls := syncService.RoomListService()
+	c.ffiObjects.track(t, "RoomListService", rls)
 	roomList, err := rls.AllRooms()
 	if err != nil {
 		return nil, fmt.Errorf("[%s]failed to call SyncService.RoomListService.AllRooms: %s", c.userID, err)
 	}
+	c.ffiObjects.track(t, "RoomList", roomList)
 	must.NotEqual(t, roomList, nil, "AllRooms room list must not be nil")
 	genericListener := newGenericStateListener[matrix_sdk_ffi.RoomListLoadingState]()
 	result, err := roomList.LoadingState(genericListener)
 	if err != nil {
 		return nil, fmt.Errorf("[%s]failed to call RoomList.LoadingState: %s", c.userID, err)
 	}
+	syncStateHandle := syncService.State(&syncServiceStateObserver{func(s api.SyncState) {
+		c.lastSyncState.Store(&s)
+		c.syncStateListeners.Broadcast(s)
+	}})
+	c.ffiObjects.track(t, "SyncService.State", syncStateHandle)
 	go syncService.Start()
 	c.allRooms = roomList
 	c.syncService = syncService
@@ -426,6 +739,8 @@ func (c *RustClient) StartSyncing(t ct.TestLike) (stopSyncing func(), err error)
 	entriesController.SetFilter(matrix_sdk_ffi.RoomListEntriesDynamicFilterKindNonLeft{})
 	c.entriesController = entriesController
 	c.entriesAdapters = entriesAdapters
+	c.ffiObjects.track(t, "RoomListEntriesWithDynamicAdapters", entriesAdapters)
+	c.ffiObjects.track(t, "RoomListDynamicEntriesController", entriesController)
 
 	isSyncing := false
 
@@ -446,23 +761,183 @@ func (c *RustClient) StartSyncing(t ct.TestLike) (stopSyncing func(), err error)
 
 	result.StateStream.Cancel()
 
+	var stopOnce sync.Once
+	c.stopSyncingFn = func() {
+		stopOnce.Do(func() {
+			t.Logf("%s: Stopping sync service", c.userID)
+			// we need to destroy all of these as they have been allocated Rust side.
+			// If we don't, then the Go GC will eventually call Destroy for us, but
+			// by this point there will be no tokio runtime running, which will then
+			// cause a panic (as cleanup code triggered by Destroy calls async functions)
+			roomList.Destroy()
+			rls.Destroy()
+			syncService.Stop()
+			syncStateHandle.Cancel()
+			syncService.Destroy()
+			c.ffiObjects.release(roomList)
+			c.ffiObjects.release(rls)
+			c.ffiObjects.release(syncStateHandle)
+			c.ffiObjects.release(syncService)
+			c.syncService = nil
+			c.allRooms = nil
+		})
+	}
+	// always stop the current sync loop, which may not be this one if ClearCacheAndRestart was called.
 	return func() {
-		t.Logf("%s: Stopping sync service", c.userID)
-		// we need to destroy all of these as they have been allocated Rust side.
-		// If we don't, then the Go GC will eventually call Destroy for us, but
-		// by this point there will be no tokio runtime running, which will then
-		// cause a panic (as cleanup code triggered by Destroy calls async functions)
-		roomList.Destroy()
-		rls.Destroy()
-		syncService.Stop()
-		syncService.Destroy()
+		c.stopSyncingFn()
 	}, nil
 }
 
+func (c *RustClient) ListenForSyncStates(t ct.TestLike, callback func(s api.SyncState)) (cancel func(), err error) {
+	return c.syncStateListeners.Add(callback), nil
+}
+
+func (c *RustClient) ClearCacheAndRestart(t ct.TestLike) error {
+	t.Helper()
+	defer c.span(t, "ClearCacheAndRestart")()
+	wasSyncing := c.syncService != nil
+	if wasSyncing {
+		c.stopSyncingFn()
+	}
+	c.dropRooms()
+	// this clears the state store and event cache but leaves the crypto store alone.
+	if err := c.watchFFIErr(t, "ClearCaches()", c.FFIClient.ClearCaches); err != nil {
+		return fmt.Errorf("ClearCacheAndRestart: ClearCaches: %s", err)
+	}
+	if !wasSyncing {
+		return nil
+	}
+	_, err := c.StartSyncing(t)
+	return err
+}
+
+// Restart destroys the FFI client then builds a new one from the same on-disk store, restoring the session.
+func (c *RustClient) Restart(t ct.TestLike) error {
+	t.Helper()
+	defer c.span(t, "Restart")()
+	session, err := c.FFIClient.Session()
+	if err != nil {
+		return fmt.Errorf("Restart: Session: %s", err)
+	}
+	wasSyncing := c.syncService != nil
+	if wasSyncing {
+		c.stopSyncingFn()
+	}
+	c.dropRooms()
+	wasListeningForBackupStates := c.stopListeningForBackupStates()
+	c.FFIClient.Destroy()
+	c.ffiObjects.release(c.FFIClient)
+	c.FFIClient = nil
+	client, err := watchFFI(c, t, "ClientBuilder.Build()", c.newClientBuilder().Build)
+	if err != nil {
+		return fmt.Errorf("Restart: ClientBuilder.Build: %s", err)
+	}
+	c.FFIClient = client
+	c.ffiObjects.track(t, "Client", client)
+	err = c.watchFFIErr(t, "RestoreSession()", func() error {
+		return client.RestoreSession(session)
+	})
+	if err != nil {
+		return fmt.Errorf("Restart: RestoreSession: %s", err)
+	}
+	if wasListeningForBackupStates {
+		c.listenForBackupStates(t)
+	}
+	if !wasSyncing {
+		return nil
+	}
+	_, err = c.StartSyncing(t)
+	return err
+}
+
+// Kill abandons the FFI client without destroying it, so nothing is shut down cleanly. The sync loop is stopped
+// first, else the abandoned client would carry on syncing in the background. Abandoned clients are destroyed on
+// Close, as the Go GC may otherwise destroy them after the tokio runtime has gone.
+func (c *RustClient) Kill(t ct.TestLike) error {
+	t.Helper()
+	defer c.span(t, "Kill")()
+	session, err := c.FFIClient.Session()
+	if err != nil {
+		return fmt.Errorf("Kill: Session: %s", err)
+	}
+	if c.syncService != nil {
+		c.stopSyncingFn()
+	}
+	c.dropRooms()
+	c.stopListeningForBackupStates()
+	c.killedClients = append(c.killedClients, c.FFIClient)
+	c.killedSession = &session
+	c.FFIClient = nil
+	return nil
+}
+
+// RestoreFromStorage builds a new FFI client from the on-disk store of the killed client, restoring its session.
+func (c *RustClient) RestoreFromStorage(t ct.TestLike) error {
+	t.Helper()
+	defer c.span(t, "RestoreFromStorage")()
+	if c.killedSession == nil {
+		return fmt.Errorf("RestoreFromStorage: client was not killed")
+	}
+	client, err := watchFFI(c, t, "ClientBuilder.Build()", c.newClientBuilder().Build)
+	if err != nil {
+		return fmt.Errorf("RestoreFromStorage: ClientBuilder.Build: %s", err)
+	}
+	c.ffiObjects.track(t, "Client", client)
+	err = c.watchFFIErr(t, "RestoreSession()", func() error {
+		return client.RestoreSession(*c.killedSession)
+	})
+	if err != nil {
+		// keep the killed session so the caller can try again e.g with the right store passphrase
+		client.Destroy()
+		c.ffiObjects.release(client)
+		return fmt.Errorf("RestoreFromStorage: RestoreSession: %s", err)
+	}
+	c.FFIClient = client
+	c.killedSession = nil
+	return nil
+}
+
+// SetStorePassphrase sets the passphrase given to the ClientBuilder when the client is next built, which is
+// used to encrypt the SQLite stores.
+func (c *RustClient) SetStorePassphrase(t ct.TestLike, passphrase string) error {
+	t.Helper()
+	c.opts.StorePassphrase = passphrase
+	if passphrase == "" {
+		c.storePassphrase.Store(nil)
+	} else {
+		c.storePassphrase.Store(&passphrase)
+	}
+	return nil
+}
+
+// dropRooms drops our references to rooms and timelines, they will be re-created when we next sync.
+func (c *RustClient) dropRooms() {
+	c.roomsMu.Lock()
+	for _, rri := range c.rooms {
+		if rri.stream != nil {
+			rri.stream.Cancel()
+			c.ffiObjects.release(rri.stream)
+		}
+	}
+	c.rooms = make(map[string]*RustRoomInfo)
+	c.roomsMu.Unlock()
+	if c.entriesController != nil {
+		c.entriesController.Destroy()
+		c.ffiObjects.release(c.entriesController)
+		c.entriesController = nil
+	}
+	if c.entriesAdapters != nil {
+		c.entriesAdapters.Destroy()
+		c.ffiObjects.release(c.entriesAdapters)
+		c.entriesAdapters = nil
+	}
+}
+
 // IsRoomEncrypted returns true if the room is encrypted. May return an error e.g if you
 // provide a bogus room ID.
 func (c *RustClient) IsRoomEncrypted(t ct.TestLike, roomID string) (bool, error) {
 	t.Helper()
+	defer c.span(t, "IsRoomEncrypted")()
 	r := c.findRoom(t, roomID)
 	if r == nil {
 		rooms := c.FFIClient.Rooms()
@@ -471,13 +946,39 @@ func (c *RustClient) IsRoomEncrypted(t ct.TestLike, roomID string) (bool, error)
 	return r.IsEncrypted()
 }
 
+// GetEncryptionAlgorithm is not supported as the FFI bindings only expose whether a room is encrypted, not
+// its algorithm. See "Why was a test skipped for one client?" in FAQ.md.
+func (c *RustClient) GetEncryptionAlgorithm(t ct.TestLike, roomID string) (string, error) {
+	return "", fmt.Errorf("GetEncryptionAlgorithm: %w", api.ErrNotSupported)
+}
+
+// IsDirect returns true if the room is a direct message room, based on the m.direct account data.
+func (c *RustClient) IsDirect(t ct.TestLike, roomID string) (bool, error) {
+	t.Helper()
+	defer c.span(t, "IsDirect")()
+	r := c.findRoom(t, roomID)
+	if r == nil {
+		rooms := c.FFIClient.Rooms()
+		return false, fmt.Errorf("failed to find room %s, got %d rooms", roomID, len(rooms))
+	}
+	return r.IsDirect(), nil
+}
+
 func (c *RustClient) BackupKeys(t ct.TestLike) (recoveryKey string, err error) {
 	t.Helper()
+	defer c.span(t, "BackupKeys")()
+	switch c.opts.BackupAlgorithm {
+	case api.BackupAlgorithmDefault, api.BackupAlgorithmCurve25519AESSHA2:
+	default:
+		return "", fmt.Errorf("BackupKeys: backup algorithm %s: %w", c.opts.BackupAlgorithm, api.ErrNotSupported)
+	}
 	genericListener := newGenericStateListener[matrix_sdk_ffi.EnableRecoveryProgress]()
 	var listener matrix_sdk_ffi.EnableRecoveryProgressListener = genericListener
 	e := c.FFIClient.Encryption()
 	defer e.Destroy()
-	recoveryKey, err = e.EnableRecovery(true, nil, listener)
+	recoveryKey, err = watchFFI(c, t, "EnableRecovery()", func() (string, error) {
+		return e.EnableRecovery(true, nil, listener)
+	})
 	if err != nil {
 		return "", fmt.Errorf("EnableRecovery: %s", err)
 	}
@@ -507,19 +1008,374 @@ func (c *RustClient) BackupKeys(t ct.TestLike) (recoveryKey string, err error) {
 	return recoveryKey, nil
 }
 
+// GetDeviceIDs is not supported as the FFI bindings do not expose device lists. See "Why was a test skipped for
+// one client?" in FAQ.md.
+func (c *RustClient) GetDeviceIDs(t ct.TestLike, userID string) ([]string, error) {
+	return nil, fmt.Errorf("GetDeviceIDs: %w", api.ErrNotSupported)
+}
+
+// SetDeviceDisplayName updates the device via the homeserver directly, as the FFI bindings cannot update devices.
+func (c *RustClient) SetDeviceDisplayName(t ct.TestLike, name string) error {
+	t.Helper()
+	session, err := c.FFIClient.Session()
+	if err != nil {
+		return fmt.Errorf("SetDeviceDisplayName: Session: %s", err)
+	}
+	_, err = c.doCSAPI(t, "PUT", []string{"_matrix", "client", "v3", "devices", session.DeviceId}, nil, map[string]any{
+		"display_name": name,
+	})
+	if err != nil {
+		return fmt.Errorf("SetDeviceDisplayName: %s", err)
+	}
+	return nil
+}
+
+// ListenForDeviceListChanges is not supported for the same reason as GetDeviceIDs.
+func (c *RustClient) ListenForDeviceListChanges(t ct.TestLike, callback func(userIDs []string)) (cancel func(), err error) {
+	return nil, fmt.Errorf("ListenForDeviceListChanges: %w", api.ErrNotSupported)
+}
+
+// GetDeviceTrust returns the trust level of this device. Other devices are not supported as the FFI bindings
+// only expose their owner's identity, not the devices themselves. See "Why was a test skipped for one client?"
+// in FAQ.md.
+func (c *RustClient) GetDeviceTrust(t ct.TestLike, userID, deviceID string) (api.TrustLevel, error) {
+	t.Helper()
+	defer c.span(t, "GetDeviceTrust")()
+	ownDeviceID, err := c.FFIClient.DeviceId()
+	if err != nil {
+		return api.TrustLevelUnknown, fmt.Errorf("DeviceId: %s", err)
+	}
+	if userID != c.userID || deviceID != ownDeviceID {
+		return api.TrustLevelUnknown, fmt.Errorf("GetDeviceTrust: other devices: %w", api.ErrNotSupported)
+	}
+	e := c.FFIClient.Encryption()
+	defer e.Destroy()
+	switch e.VerificationState() {
+	case matrix_sdk_ffi.VerificationStateVerified:
+		return api.TrustLevelVerified, nil
+	case matrix_sdk_ffi.VerificationStateUnverified:
+		return api.TrustLevelUnverified, nil
+	default:
+		return api.TrustLevelUnknown, nil
+	}
+}
+
+func (c *RustClient) ResetCrossSigning(t ct.TestLike, authCallback func() (password string)) error {
+	t.Helper()
+	defer c.span(t, "ResetCrossSigning")()
+	e := c.FFIClient.Encryption()
+	defer e.Destroy()
+	handle, err := watchFFI(c, t, "ResetIdentity()", e.ResetIdentity)
+	if err != nil {
+		return fmt.Errorf("ResetIdentity: %s", err)
+	}
+	if handle == nil {
+		return nil // the identity was reset without needing auth
+	}
+	defer handle.Destroy()
+	switch authType := handle.AuthType().(type) {
+	case matrix_sdk_ffi.CrossSigningResetAuthTypeUiaa:
+		var authData matrix_sdk_ffi.AuthData = matrix_sdk_ffi.AuthDataPassword{
+			PasswordDetails: matrix_sdk_ffi.AuthDataPasswordDetails{
+				Identifier: c.userID,
+				Password:   authCallback(),
+			},
+		}
+		err := c.watchFFIErr(t, "IdentityResetHandle.Reset()", func() error {
+			return handle.Reset(&authData)
+		})
+		if err != nil {
+			return fmt.Errorf("IdentityResetHandle.Reset: %s", err)
+		}
+		return nil
+	case matrix_sdk_ffi.CrossSigningResetAuthTypeOidc:
+		handle.Cancel()
+		return fmt.Errorf("ResetCrossSigning: OIDC approval is not supported, got approval URL %s", authType.Info.ApprovalUrl)
+	default:
+		handle.Cancel()
+		return fmt.Errorf("ResetCrossSigning: unknown auth type %T", authType)
+	}
+}
+
+// BootstrapCrossSigning resets the identity unless this device is already verified by it. Clients are built with
+// AutoEnableCrossSigning, so this is usually done when logging in for the first time if the server does not need auth.
+func (c *RustClient) BootstrapCrossSigning(t ct.TestLike, authCallback func() (password string)) error {
+	t.Helper()
+	defer c.span(t, "BootstrapCrossSigning")()
+	e := c.FFIClient.Encryption()
+	defer e.Destroy()
+	// cross-signing is enabled in the background after login
+	e.WaitForE2eeInitializationTasks()
+	if e.VerificationState() == matrix_sdk_ffi.VerificationStateVerified {
+		return nil
+	}
+	return c.ResetCrossSigning(t, authCallback)
+}
+
+// SetGlobalOnlyTrustVerified restarts the client, as the FFI bindings only accept the room key recipient
+// strategy when building the client.
+func (c *RustClient) SetGlobalOnlyTrustVerified(t ct.TestLike, enabled bool) error {
+	t.Helper()
+	defer c.span(t, "SetGlobalOnlyTrustVerified")()
+	if c.onlyTrustVerified.Swap(enabled) == enabled {
+		return nil
+	}
+	return c.Restart(t)
+}
+
+// SetRoomOnlyTrustVerified is not supported as the FFI bindings do not expose per-room trust settings. See
+// "Why was a test skipped for one client?" in FAQ.md.
+func (c *RustClient) SetRoomOnlyTrustVerified(t ct.TestLike, roomID string, enabled bool) error {
+	return fmt.Errorf("SetRoomOnlyTrustVerified: %w", api.ErrNotSupported)
+}
+
+// BlacklistDevice is not supported as the FFI bindings do not expose the local trust of devices. See "Why was
+// a test skipped for one client?" in FAQ.md.
+func (c *RustClient) BlacklistDevice(t ct.TestLike, userID, deviceID string) error {
+	return fmt.Errorf("BlacklistDevice: %w", api.ErrNotSupported)
+}
+
+// CreateDehydratedDevice is not supported as the FFI bindings do not expose dehydrated devices, even though
+// the SDK supports them. See "Why was a test skipped for one client?" in FAQ.md.
+func (c *RustClient) CreateDehydratedDevice(t ct.TestLike) error {
+	return fmt.Errorf("CreateDehydratedDevice: %w", api.ErrNotSupported)
+}
+
+// RehydrateDevice is not supported for the same reason as CreateDehydratedDevice.
+func (c *RustClient) RehydrateDevice(t ct.TestLike, recoveryKey string) error {
+	return fmt.Errorf("RehydrateDevice: %w", api.ErrNotSupported)
+}
+
+// RequestRoomKey is not supported as the FFI bindings do not expose room key requests.
+func (c *RustClient) RequestRoomKey(t ct.TestLike, roomID, sessionID string) error {
+	return fmt.Errorf("RequestRoomKey: %w", api.ErrNotSupported)
+}
+
+// CancelRoomKeyRequest is not supported as the FFI bindings do not expose room key requests.
+func (c *RustClient) CancelRoomKeyRequest(t ct.TestLike, roomID, sessionID string) error {
+	return fmt.Errorf("CancelRoomKeyRequest: %w", api.ErrNotSupported)
+}
+
+// RetryDecryption retries decrypting events in the timeline. The FFI bindings only retry the given sessions, so
+// if none are given, the sessions of every undecryptable event in the timeline are retried.
+func (c *RustClient) RetryDecryption(t ct.TestLike, roomID string, sessionIDs []string) error {
+	t.Helper()
+	defer c.span(t, "RetryDecryption")()
+	room := c.findRoom(t, roomID)
+	if room == nil {
+		return fmt.Errorf("RetryDecryption: cannot find room %s", roomID)
+	}
+	if len(sessionIDs) == 0 {
+		events, err := c.GetTimeline(t, roomID)
+		if err != nil {
+			return fmt.Errorf("RetryDecryption: %s", err)
+		}
+		for _, ev := range events {
+			if ev.FailedToDecrypt && ev.SessionID != "" && !slices.Contains(sessionIDs, ev.SessionID) {
+				sessionIDs = append(sessionIDs, ev.SessionID)
+			}
+		}
+		if len(sessionIDs) == 0 {
+			return nil
+		}
+	}
+	timeline := c.mustGetTimeline(t, room)
+	return c.watchFFIErr(t, "Timeline.RetryDecryption()", func() error {
+		timeline.RetryDecryption(sessionIDs)
+		return nil
+	})
+}
+
+// FallbackKeyUsed is not supported as the FFI bindings do not expose the unused fallback key types in /sync
+// responses, and the SDK replaces a used fallback key without telling the application.
+func (c *RustClient) FallbackKeyUsed(t ct.TestLike) (used bool, err error) {
+	return false, fmt.Errorf("FallbackKeyUsed: %w", api.ErrNotSupported)
+}
+
+func (c *RustClient) ListenForBackupStates(t ct.TestLike, ctx context.Context) (<-chan api.BackupState, error) {
+	c.listenForBackupStates(t)
+	return c.backupStateListeners.Listen(ctx), nil
+}
+
+// listenForBackupStates broadcasts backup states from the FFI client to backupStateListeners, starting with
+// the current state. Does nothing if we are already listening.
+func (c *RustClient) listenForBackupStates(t ct.TestLike) {
+	c.backupStateMu.Lock()
+	defer c.backupStateMu.Unlock()
+	if c.backupStateHandle != nil {
+		return
+	}
+	e := c.FFIClient.Encryption()
+	defer e.Destroy()
+	c.backupStateListeners.Broadcast(backupStateFromFFI(e.BackupState()))
+	c.backupStateHandle = e.BackupStateListener(&backupStateListener{
+		broadcast: c.backupStateListeners.Broadcast,
+	})
+	c.ffiObjects.track(t, "Encryption.BackupStateListener", c.backupStateHandle)
+}
+
+// stopListeningForBackupStates stops listening to the FFI client, returning true if we were listening.
+func (c *RustClient) stopListeningForBackupStates() bool {
+	c.backupStateMu.Lock()
+	defer c.backupStateMu.Unlock()
+	if c.backupStateHandle == nil {
+		return false
+	}
+	c.backupStateHandle.Cancel()
+	c.ffiObjects.release(c.backupStateHandle)
+	c.backupStateHandle = nil
+	return true
+}
+
+// CreateSecretStorageKey uses recovery, which is how the FFI bindings expose secret storage. If recovery is not
+// enabled, enabling it also creates a key backup.
+func (c *RustClient) CreateSecretStorageKey(t ct.TestLike) (recoveryKey string, err error) {
+	t.Helper()
+	defer c.span(t, "CreateSecretStorageKey")()
+	e := c.FFIClient.Encryption()
+	defer e.Destroy()
+	if e.RecoveryState() == matrix_sdk_ffi.RecoveryStateEnabled {
+		recoveryKey, err = watchFFI(c, t, "ResetRecoveryKey()", e.ResetRecoveryKey)
+	} else {
+		genericListener := newGenericStateListener[matrix_sdk_ffi.EnableRecoveryProgress]()
+		defer genericListener.Close()
+		var listener matrix_sdk_ffi.EnableRecoveryProgressListener = genericListener
+		recoveryKey, err = watchFFI(c, t, "EnableRecovery()", func() (string, error) {
+			return e.EnableRecovery(false, nil, listener)
+		})
+	}
+	if err != nil {
+		return "", err
+	}
+	return recoveryKey, c.rememberSecretStorageKey(recoveryKey)
+}
+
+// UnlockSecretStorage imports the secrets the rust SDK manages from secret storage. The rust SDK does not keep the
+// secret storage key, so it is remembered here for StoreSecret and GetSecret.
+func (c *RustClient) UnlockSecretStorage(t ct.TestLike, recoveryKey string) error {
+	t.Helper()
+	defer c.span(t, "UnlockSecretStorage")()
+	e := c.FFIClient.Encryption()
+	defer e.Destroy()
+	err := c.watchFFIErr(t, "Recover()", func() error {
+		return e.Recover(recoveryKey)
+	})
+	if err != nil {
+		return err
+	}
+	return c.rememberSecretStorageKey(recoveryKey)
+}
+
+// StoreSecret encrypts the secret and writes it to account data directly, as the FFI bindings only store the
+// secrets the rust SDK manages.
+func (c *RustClient) StoreSecret(t ct.TestLike, name, value string) error {
+	t.Helper()
+	key, keyID, err := c.defaultSecretStorageKey(t)
+	if err != nil {
+		return fmt.Errorf("StoreSecret(%s): %s", name, err)
+	}
+	encrypted, err := secretstorage.Encrypt(key, name, value)
+	if err != nil {
+		return fmt.Errorf("StoreSecret(%s): %s", name, err)
+	}
+	_, err = c.doCSAPI(t, "PUT", []string{"_matrix", "client", "v3", "user", c.userID, "account_data", name}, nil, map[string]any{
+		"encrypted": map[string]any{
+			keyID: encrypted,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("StoreSecret(%s): %s", name, err)
+	}
+	return nil
+}
+
+// GetSecret reads the secret from account data directly, as the FFI bindings only read the secrets the rust SDK
+// manages.
+func (c *RustClient) GetSecret(t ct.TestLike, name string) (value string, err error) {
+	t.Helper()
+	key, keyID, err := c.defaultSecretStorageKey(t)
+	if err != nil {
+		return "", fmt.Errorf("GetSecret(%s): %s", name, err)
+	}
+	res, err := c.doCSAPI(t, "GET", []string{"_matrix", "client", "v3", "user", c.userID, "account_data", name}, nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("GetSecret(%s): %s", name, err)
+	}
+	encrypted, ok := res.Get("encrypted").Map()[keyID]
+	if !ok {
+		return "", fmt.Errorf("GetSecret(%s): secret is not encrypted with the default key %s", name, keyID)
+	}
+	value, err = secretstorage.Decrypt(key, name, secretstorage.EncryptedSecret{
+		IV:         encrypted.Get("iv").Str,
+		Ciphertext: encrypted.Get("ciphertext").Str,
+		MAC:        encrypted.Get("mac").Str,
+	})
+	if err != nil {
+		return "", fmt.Errorf("GetSecret(%s): %s", name, err)
+	}
+	return value, nil
+}
+
+func (c *RustClient) rememberSecretStorageKey(recoveryKey string) error {
+	key, err := secretstorage.DecodeRecoveryKey(recoveryKey)
+	if err != nil {
+		return fmt.Errorf("failed to decode recovery key: %s", err)
+	}
+	c.secretStorageKey.Store(&key)
+	return nil
+}
+
+// defaultSecretStorageKey returns the remembered secret storage key and the ID of the default key, which it
+// is assumed to be as recovery always uses the default key.
+func (c *RustClient) defaultSecretStorageKey(t ct.TestLike) (key []byte, keyID string, err error) {
+	t.Helper()
+	keyPtr := c.secretStorageKey.Load()
+	if keyPtr == nil {
+		return nil, "", fmt.Errorf("secret storage has not been created or unlocked on this client")
+	}
+	res, err := c.doCSAPI(t, "GET", []string{"_matrix", "client", "v3", "user", c.userID, "account_data", secretstorage.DefaultKeyEventType}, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	keyID = res.Get("key").Str
+	if keyID == "" {
+		return nil, "", fmt.Errorf("no default secret storage key")
+	}
+	return *keyPtr, keyID, nil
+}
+
 func (c *RustClient) LoadBackup(t ct.TestLike, recoveryKey string) error {
 	t.Helper()
+	defer c.span(t, "LoadBackup")()
 	e := c.FFIClient.Encryption()
 	defer e.Destroy()
-	return e.Recover(recoveryKey)
+	return c.watchFFIErr(t, "Recover()", func() error {
+		return e.Recover(recoveryKey)
+	})
+}
+
+// ExportRoomKeys is not supported as the FFI bindings do not expose room key exports. See "Why was a test
+// skipped for one client?" in FAQ.md.
+func (c *RustClient) ExportRoomKeys(t ct.TestLike, passphrase string) ([]byte, error) {
+	return nil, fmt.Errorf("ExportRoomKeys: %w", api.ErrNotSupported)
+}
+
+// ImportRoomKeys is not supported for the same reason as ExportRoomKeys.
+func (c *RustClient) ImportRoomKeys(t ct.TestLike, export []byte, passphrase string) error {
+	return fmt.Errorf("ImportRoomKeys: %w", api.ErrNotSupported)
 }
 
 func (c *RustClient) WaitUntilEventInRoom(t ct.TestLike, roomID string, checker func(api.Event) bool) api.Waiter {
+	t.Helper()
+	return c.WaitUntilEventInRoomWithOpts(t, roomID, api.TimelineListenerOpts{}, checker)
+}
+
+func (c *RustClient) WaitUntilEventInRoomWithOpts(t ct.TestLike, roomID string, opts api.TimelineListenerOpts, checker func(api.Event) bool) api.Waiter {
 	t.Helper()
 	c.ensureListening(t, roomID)
 	return &timelineWaiter{
 		roomID:  roomID,
-		checker: checker,
+		checker: opts.Filter(checker),
 		client:  c,
 	}
 }
@@ -528,7 +1384,186 @@ func (c *RustClient) Type() api.ClientTypeLang {
 	return api.ClientTypeRust
 }
 
+// SendThreadedMessage sends the raw event content, as the FFI bindings can only reply to events rather than
+// send them in threads. The rust SDK still encrypts raw events in encrypted rooms.
+func (c *RustClient) SendThreadedMessage(t ct.TestLike, roomID, threadRootID, text string) (eventID string, err error) {
+	t.Helper()
+	defer c.span(t, "SendThreadedMessage")()
+	content, err := json.Marshal(map[string]any{
+		"msgtype": "m.text",
+		"body":    text,
+		"m.relates_to": map[string]any{
+			"rel_type": "m.thread",
+			"event_id": threadRootID,
+			// clients which do not support threads show this as a reply to the root
+			"is_falling_back": true,
+			"m.in_reply_to": map[string]any{
+				"event_id": threadRootID,
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("SendThreadedMessage: %s", err)
+	}
+	return c.sendAndWaitForEventID(t, "SendThreadedMessage", roomID, func(ev *api.Event) bool {
+		return ev.Text == text
+	}, func(timeline *matrix_sdk_ffi.Timeline) error {
+		room := c.findRoom(t, roomID)
+		if room == nil {
+			return fmt.Errorf("failed to find room %s", roomID)
+		}
+		return c.watchFFIErr(t, "Room.SendRaw()", func() error {
+			return room.SendRaw("m.room.message", string(content))
+		})
+	})
+}
+
 func (c *RustClient) SendMessage(t ct.TestLike, roomID, text string) (eventID string, err error) {
+	t.Helper()
+	defer c.span(t, "SendMessage")()
+	return c.sendAndWaitForEventID(t, "SendMessage", roomID, func(ev *api.Event) bool {
+		return ev.Text == text
+	}, func(timeline *matrix_sdk_ffi.Timeline) error {
+		timeline.Send(matrix_sdk_ffi.MessageEventContentFromHtml(text, text))
+		return nil
+	})
+}
+
+func (c *RustClient) SendEncryptedFile(t ct.TestLike, roomID, filename string, contents []byte) (eventID string, err error) {
+	t.Helper()
+	defer c.span(t, "SendEncryptedFile")()
+	// the FFI bindings upload files from disk, and use the file name in the path as the filename.
+	dir, err := os.MkdirTemp("", "complement-crypto-upload")
+	if err != nil {
+		return "", fmt.Errorf("SendEncryptedFile(rust) %s: %s", c.userID, err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, filename)
+	if err = os.WriteFile(path, contents, 0o644); err != nil {
+		return "", fmt.Errorf("SendEncryptedFile(rust) %s: %s", c.userID, err)
+	}
+	mimetype := "application/octet-stream"
+	size := uint64(len(contents))
+	hasFileName := api.CheckEventHasFileName(filename)
+	return c.sendAndWaitForEventID(t, "SendEncryptedFile", roomID, func(ev *api.Event) bool {
+		return hasFileName(*ev)
+	}, func(timeline *matrix_sdk_ffi.Timeline) error {
+		handle, err := timeline.SendFile(matrix_sdk_ffi.UploadParameters{
+			Filename: path,
+		}, matrix_sdk_ffi.FileInfo{
+			Mimetype: &mimetype,
+			Size:     &size,
+		}, nil)
+		if err != nil {
+			return err
+		}
+		return handle.Join()
+	})
+}
+
+func (c *RustClient) RedactEvent(t ct.TestLike, roomID, eventID, reason string) error {
+	t.Helper()
+	defer c.span(t, "RedactEvent")()
+	r := c.findRoom(t, roomID)
+	if r == nil {
+		return fmt.Errorf("RedactEvent: unknown room %s", roomID)
+	}
+	var reasonPtr *string
+	if reason != "" {
+		reasonPtr = &reason
+	}
+	err := c.watchFFIErr(t, fmt.Sprintf("Redact(%s, %s)", roomID, eventID), func() error {
+		return r.Redact(eventID, reasonPtr)
+	})
+	if err != nil {
+		return fmt.Errorf("RedactEvent(%s, %s): %s", roomID, eventID, err)
+	}
+	return nil
+}
+
+// React toggles the reaction on the event, so returns once the reaction has been queued rather than sent.
+func (c *RustClient) React(t ct.TestLike, roomID, eventID, key string) error {
+	t.Helper()
+	defer c.span(t, "React")()
+	r := c.findRoom(t, roomID)
+	if r == nil {
+		return fmt.Errorf("React: unknown room %s", roomID)
+	}
+	timeline, err := watchFFI(c, t, "Room.Timeline()", r.Timeline)
+	if err != nil {
+		return fmt.Errorf("React(%s, %s): %s", roomID, eventID, err)
+	}
+	err = c.watchFFIErr(t, fmt.Sprintf("ToggleReaction(%s, %s)", eventID, key), func() error {
+		return timeline.ToggleReaction(matrix_sdk_ffi.EventOrTransactionIdEventId{
+			EventId: eventID,
+		}, key)
+	})
+	if err != nil {
+		return fmt.Errorf("React(%s, %s): %s", roomID, eventID, err)
+	}
+	return nil
+}
+
+func (c *RustClient) EditMessage(t ct.TestLike, roomID, eventID, newBody string) error {
+	t.Helper()
+	defer c.span(t, "EditMessage")()
+	// the timeline aggregates edits onto the original event rather than showing the m.replace event
+	_, err := c.sendAndWaitForEventID(t, "EditMessage", roomID, func(ev *api.Event) bool {
+		return ev.ID == eventID && ev.Edited && ev.Text == newBody
+	}, func(timeline *matrix_sdk_ffi.Timeline) error {
+		return timeline.Edit(matrix_sdk_ffi.EventOrTransactionIdEventId{
+			EventId: eventID,
+		}, matrix_sdk_ffi.EditedContentRoomMessage{
+			Content: matrix_sdk_ffi.MessageEventContentFromHtml(newBody, newBody),
+		})
+	})
+	return err
+}
+
+// SetRoomTopic sets the topic via the room, as the timeline cannot send state events. The FFI bindings do
+// not support MSC3414, so the topic is only encrypted if the SDK was built with support for it.
+func (c *RustClient) SetRoomTopic(t ct.TestLike, roomID, topic string) (string, error) {
+	t.Helper()
+	defer c.span(t, "SetRoomTopic")()
+	return c.sendAndWaitForEventID(t, "SetRoomTopic", roomID, func(ev *api.Event) bool {
+		return ev.Type == "m.room.topic" && ev.Text == topic
+	}, func(timeline *matrix_sdk_ffi.Timeline) error {
+		r := c.findRoom(t, roomID)
+		if r == nil {
+			return fmt.Errorf("failed to find room %s", roomID)
+		}
+		return r.SetTopic(topic)
+	})
+}
+
+// GetOutboundSessionID fetches the event from the homeserver, as the FFI bindings only expose the session ID
+// for events which failed to decrypt.
+func (c *RustClient) GetOutboundSessionID(t ct.TestLike, roomID, eventID string) (sessionID string, err error) {
+	t.Helper()
+	ev, err := c.doCSAPI(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "event", eventID}, nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("GetOutboundSessionID(%s): %s", eventID, err)
+	}
+	if sender := ev.Get("sender").Str; sender != c.userID {
+		return "", fmt.Errorf("GetOutboundSessionID(%s): event was sent by %s", eventID, sender)
+	}
+	if ev.Get("type").Str != "m.room.encrypted" {
+		return "", fmt.Errorf("GetOutboundSessionID(%s): event is not encrypted", eventID)
+	}
+	return ev.Get("content.session_id").Str, nil
+}
+
+// GetOutboundSessionInfo is not supported as matrix-sdk-ffi does not expose outbound sessions.
+// See "Why was a test skipped for one client?" in FAQ.md.
+func (c *RustClient) GetOutboundSessionInfo(t ct.TestLike, roomID string) (*api.OutboundSessionInfo, error) {
+	return nil, fmt.Errorf("GetOutboundSessionInfo: %w", api.ErrNotSupported)
+}
+
+// sendAndWaitForEventID calls send with the timeline for the room, then blocks until an event sent by this
+// client which matches appears in the timeline with an event ID.
+func (c *RustClient) sendAndWaitForEventID(
+	t ct.TestLike, funcName, roomID string, match func(ev *api.Event) bool, send func(timeline *matrix_sdk_ffi.Timeline) error,
+) (eventID string, err error) {
 	t.Helper()
 	var isChannelClosed atomic.Bool
 	ch := make(chan bool)
@@ -548,7 +1583,7 @@ func (c *RustClient) SendMessage(t ct.TestLike, roomID, text string) (eventID st
 			if ev == nil {
 				continue
 			}
-			if ev.Text == text && ev.Sender == c.userID && ev.ID != "" {
+			if match(ev) && ev.Sender == c.userID && ev.ID != "" {
 				// if we haven't seen this event yet, assign the return arg and signal that
 				// the function should unblock. It's important to only close the channel once
 				// else this will panic on the 2nd call.
@@ -564,18 +1599,24 @@ func (c *RustClient) SendMessage(t ct.TestLike, roomID, text string) (eventID st
 	})
 	defer cancel()
 	if r == nil {
-		err = fmt.Errorf("SendMessage(rust) %s: failed to find room %s", c.userID, roomID)
+		err = fmt.Errorf("%s(rust) %s: failed to find room %s", funcName, c.userID, roomID)
 		return
 	}
-	timeline, err := r.Timeline()
+	timeline, err := watchFFI(c, t, "Room.Timeline()", r.Timeline)
+	if err != nil {
+		err = fmt.Errorf("%s(rust) %s: %s", funcName, c.userID, err)
+		return
+	}
+	err = c.watchFFIErr(t, fmt.Sprintf("%s(%s)", funcName, roomID), func() error {
+		return send(timeline)
+	})
 	if err != nil {
-		err = fmt.Errorf("SendMessage(rust) %s: %s", c.userID, err)
+		err = fmt.Errorf("%s(rust) %s: %s", funcName, c.userID, err)
 		return
 	}
-	timeline.Send(matrix_sdk_ffi.MessageEventContentFromHtml(text, text))
 	select {
 	case <-time.After(11 * time.Second):
-		err = fmt.Errorf("SendMessage(rust) %s: timed out after 11s", c.userID)
+		err = fmt.Errorf("%s(rust) %s: timed out after 11s", funcName, c.userID)
 		return
 	case <-ch:
 		return
@@ -584,23 +1625,106 @@ func (c *RustClient) SendMessage(t ct.TestLike, roomID, text string) (eventID st
 
 func (c *RustClient) InviteUser(t ct.TestLike, roomID, userID string) error {
 	t.Helper()
+	defer c.span(t, "InviteUser")()
 	r := c.findRoom(t, roomID)
-	return r.InviteUserById(userID)
+	return c.watchFFIErr(t, fmt.Sprintf("InviteUserById(%s, %s)", roomID, userID), func() error {
+		return r.InviteUserById(userID)
+	})
+}
+
+func (c *RustClient) JoinRoom(t ct.TestLike, roomID string, serverNames []string) error {
+	t.Helper()
+	defer c.span(t, "JoinRoom")()
+	// if history sharing is enabled, this will also download and import the room key bundle from the inviter.
+	_, err := watchFFI(c, t, fmt.Sprintf("JoinRoomByIdOrAlias(%s, %v)", roomID, serverNames), func() (*matrix_sdk_ffi.Room, error) {
+		return c.FFIClient.JoinRoomByIdOrAlias(roomID, serverNames)
+	})
+	if err != nil {
+		return fmt.Errorf("JoinRoomByIdOrAlias(%s): %s", roomID, err)
+	}
+	return nil
 }
 
-func (c *RustClient) Backpaginate(t ct.TestLike, roomID string, count int) error {
+func (c *RustClient) FollowTombstone(t ct.TestLike, roomID string, serverNames []string) (newRoomID string, err error) {
 	t.Helper()
+	defer c.span(t, "FollowTombstone")()
 	r := c.findRoom(t, roomID)
 	if r == nil {
-		return fmt.Errorf("Backpaginate: cannot find room %s", roomID)
+		return "", fmt.Errorf("FollowTombstone: unknown room %s", roomID)
 	}
-	_, err := mustGetTimeline(t, r).PaginateBackwards(uint16(count))
+	info, err := watchFFI(c, t, fmt.Sprintf("RoomInfo(%s)", roomID), r.RoomInfo)
 	if err != nil {
-		return fmt.Errorf("cannot PaginateBackwards in %s: %s", roomID, err)
+		return "", fmt.Errorf("FollowTombstone: RoomInfo(%s): %s", roomID, err)
+	}
+	if info.Tombstone == nil {
+		return "", fmt.Errorf("FollowTombstone: room %s has no tombstone", roomID)
+	}
+	newRoomID = info.Tombstone.ReplacementRoomId
+	if err = c.JoinRoom(t, newRoomID, serverNames); err != nil {
+		return "", fmt.Errorf("FollowTombstone: %s", err)
+	}
+	return newRoomID, nil
+}
+
+func (c *RustClient) IgnoreUser(t ct.TestLike, userID string) error {
+	t.Helper()
+	defer c.span(t, "IgnoreUser")()
+	err := c.watchFFIErr(t, fmt.Sprintf("IgnoreUser(%s)", userID), func() error {
+		return c.FFIClient.IgnoreUser(userID)
+	})
+	if err != nil {
+		return fmt.Errorf("IgnoreUser(%s): %s", userID, err)
+	}
+	return nil
+}
+
+func (c *RustClient) UnignoreUser(t ct.TestLike, userID string) error {
+	t.Helper()
+	defer c.span(t, "UnignoreUser")()
+	err := c.watchFFIErr(t, fmt.Sprintf("UnignoreUser(%s)", userID), func() error {
+		return c.FFIClient.UnignoreUser(userID)
+	})
+	if err != nil {
+		return fmt.Errorf("UnignoreUser(%s): %s", userID, err)
 	}
 	return nil
 }
 
+func (c *RustClient) Backpaginate(t ct.TestLike, roomID string, count int) ([]*api.Event, error) {
+	t.Helper()
+	defer c.span(t, "Backpaginate")()
+	r := c.findRoom(t, roomID)
+	if r == nil {
+		return nil, fmt.Errorf("Backpaginate: cannot find room %s", roomID)
+	}
+	c.ensureListening(t, roomID)
+	// paginated events are added to the timeline by the timeline listener, which may happen after
+	// PaginateBackwards returns, so wait for the listener to see them.
+	updated := make(chan struct{}, 1)
+	cancel := c.roomsListener.AddListener(func(broadcastRoomID string) bool {
+		if broadcastRoomID == roomID {
+			select {
+			case updated <- struct{}{}:
+			default:
+			}
+		}
+		return false
+	})
+	defer cancel()
+	timeline := c.mustGetTimeline(t, r)
+	_, err := watchFFI(c, t, fmt.Sprintf("PaginateBackwards(%s, %d)", roomID, count), func() (bool, error) {
+		return timeline.PaginateBackwards(uint16(count))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot PaginateBackwards in %s: %s", roomID, err)
+	}
+	select {
+	case <-updated:
+	case <-time.After(time.Second): // there may have been nothing to paginate
+	}
+	return c.GetTimeline(t, roomID)
+}
+
 func (c *RustClient) UserID() string {
 	return c.userID
 }
@@ -671,6 +1795,7 @@ func (c *RustClient) findRoom(t ct.TestLike, roomID string) *matrix_sdk_ffi.Room
 
 func (c *RustClient) Logf(t ct.TestLike, format string, args ...interface{}) {
 	t.Helper()
+	logging.Write(t.Name(), api.ClientID(c.userID, c.opts.DeviceID, api.ClientTypeRust), fmt.Sprintf(format, args...))
 	c.logToFile(t, format, args...)
 	if !c.closed.Load() {
 		t.Logf(format, args...)
@@ -711,7 +1836,8 @@ func (c *RustClient) ensureListening(t ct.TestLike, roomID string) {
 	// _before_ we have set the initial entries in the timeline. This would cause a lost update
 	// as setting the initial entries clears the timeline, which can then result in test flakes.
 	waiter := helpers.NewWaiter()
-	result := mustGetTimeline(t, r).AddListener(&timelineListener{fn: func(diff []*matrix_sdk_ffi.TimelineDiff) {
+	roomTimeline := c.mustGetTimeline(t, r)
+	listener := &timelineListener{fn: func(diff []*matrix_sdk_ffi.TimelineDiff) {
 		waiter.Waitf(t, 5*time.Second, "timed out waiting for Timeline.AddListener to return")
 		timeline := c.rooms[roomID].timeline
 		var newEvents []*api.Event
@@ -813,8 +1939,12 @@ func (c *RustClient) ensureListening(t ct.TestLike, roomID string) {
 		for _, e := range newEvents {
 			c.Logf(t, "[%s]TimelineDiff change: %+v", c.userID, e)
 		}
-	}})
+	}}
+	result, _ := watchFFI(c, t, fmt.Sprintf("Timeline.AddListener(%s)", roomID), func() (*matrix_sdk_ffi.TaskHandle, error) {
+		return roomTimeline.AddListener(listener), nil
+	})
 	c.rooms[roomID].stream = result
+	c.ffiObjects.track(t, fmt.Sprintf("Timeline.AddListener(%s)", roomID), result)
 	c.rooms[roomID].timeline = make([]*api.Event, 0)
 	c.Logf(t, "[%s]AddTimelineListener[%s] set up", c.userID, roomID)
 	waiter.Finish()
@@ -903,11 +2033,12 @@ func (w *timelineWaiter) TryWaitf(t ct.TestLike, s time.Duration, format string,
 	}
 }
 
-func mustGetTimeline(t ct.TestLike, room *matrix_sdk_ffi.Room) *matrix_sdk_ffi.Timeline {
+func (c *RustClient) mustGetTimeline(t ct.TestLike, room *matrix_sdk_ffi.Room) *matrix_sdk_ffi.Timeline {
+	t.Helper()
 	if room == nil {
 		ct.Fatalf(t, "mustGetTimeline: room does not exist")
 	}
-	timeline, err := room.Timeline()
+	timeline, err := watchFFI(c, t, "Room.Timeline()", room.Timeline)
 	must.NotError(t, "failed to get room timeline", err)
 	return timeline
 }
@@ -940,6 +2071,7 @@ func eventTimelineItemToEvent(item matrix_sdk_ffi.EventTimelineItem) *api.Event
 	}
 	switch k := item.Content.(type) {
 	case matrix_sdk_ffi.TimelineItemContentRoomMembership:
+		complementEvent.Type = "m.room.member"
 		complementEvent.Target = k.UserId
 		change := *k.Change
 		switch change {
@@ -966,21 +2098,88 @@ func eventTimelineItemToEvent(item matrix_sdk_ffi.EventTimelineItem) *api.Event
 		default:
 			fmt.Printf("%s unhandled membership %d\n", k.UserId, change)
 		}
+	case matrix_sdk_ffi.TimelineItemContentState:
+		stateKey := k.StateKey
+		complementEvent.StateKey = &stateKey
+		switch state := k.Content.(type) {
+		case matrix_sdk_ffi.OtherStateRoomTopic:
+			complementEvent.Type = "m.room.topic"
+			if state.Topic != nil {
+				complementEvent.Text = *state.Topic
+			}
+		case matrix_sdk_ffi.OtherStateRoomName:
+			complementEvent.Type = "m.room.name"
+		case matrix_sdk_ffi.OtherStateCustom:
+			complementEvent.Type = state.EventType
+		}
 	case matrix_sdk_ffi.TimelineItemContentUnableToDecrypt:
+		complementEvent.Type = "m.room.encrypted"
 		complementEvent.FailedToDecrypt = true
+		complementEvent.DecryptionFailureReason = api.DecryptionFailureReasonMalformedEvent
+		if msg, ok := k.Msg.(matrix_sdk_ffi.EncryptedMessageMegolmV1AesSha2); ok {
+			complementEvent.SessionID = msg.SessionId
+			complementEvent.DecryptionFailureReason = decryptionFailureReason(msg.Cause)
+			switch msg.Cause {
+			case matrix_sdk_ffi.UtdCauseWithheldForUnverifiedOrInsecureDevice:
+				complementEvent.WithheldCode = api.WithheldCodeUnverified
+			case matrix_sdk_ffi.UtdCauseWithheldBySender:
+				complementEvent.WithheldCode = api.WithheldCodeOther
+			}
+		}
 	}
 
 	content := item.Content
 	if content != nil {
 		switch msg := content.(type) {
 		case matrix_sdk_ffi.TimelineItemContentMessage:
-
+			complementEvent.Type = "m.room.message"
 			complementEvent.Text = msg.Content.Body
+			complementEvent.Edited = msg.Content.IsEdited
+			if msg.Content.ThreadRoot != nil {
+				complementEvent.ThreadRoot = *msg.Content.ThreadRoot
+			}
+			if file, ok := msg.Content.MsgType.(matrix_sdk_ffi.MessageTypeFile); ok {
+				complementEvent.File = &api.EventFile{
+					Name: file.Content.Filename,
+				}
+			}
 		}
 	}
 	return &complementEvent
 }
 
+// decryptionFailureReason maps the rust SDK's reason for an unable to decrypt event onto the reasons used
+// by all SDKs. The rust SDK reports UtdCauseUnknown when it just does not have the room key.
+func decryptionFailureReason(cause matrix_sdk_ffi.UtdCause) api.DecryptionFailureReason {
+	switch cause {
+	case matrix_sdk_ffi.UtdCauseUnknown:
+		return api.DecryptionFailureReasonMissingKey
+	case matrix_sdk_ffi.UtdCauseWithheldForUnverifiedOrInsecureDevice, matrix_sdk_ffi.UtdCauseWithheldBySender:
+		return api.DecryptionFailureReasonWithheld
+	case matrix_sdk_ffi.UtdCauseHistoricalMessage:
+		return api.DecryptionFailureReasonHistoricalKeyUnavailable
+	case matrix_sdk_ffi.UtdCauseSentBeforeWeJoined:
+		return api.DecryptionFailureReasonSentBeforeJoined
+	case matrix_sdk_ffi.UtdCauseVerificationViolation, matrix_sdk_ffi.UtdCauseUnsignedDevice, matrix_sdk_ffi.UtdCauseUnknownDevice:
+		return api.DecryptionFailureReasonSenderNotTrusted
+	default:
+		return api.DecryptionFailureReasonUnknown
+	}
+}
+
+// fileMediaSource returns the media source of the file attached to the timeline item, if any.
+func fileMediaSource(item matrix_sdk_ffi.EventTimelineItem) *matrix_sdk_ffi.MediaSource {
+	msg, ok := item.Content.(matrix_sdk_ffi.TimelineItemContentMessage)
+	if !ok {
+		return nil
+	}
+	file, ok := msg.Content.MsgType.(matrix_sdk_ffi.MessageTypeFile)
+	if !ok {
+		return nil
+	}
+	return file.Content.Source
+}
+
 // you call requestVerification(), then you wait for acceptedVerificationRequest and then you
 // call startSasVerification
 // you should then receivedVerificationData and approveVerification or declineVerification
@@ -1047,3 +2246,53 @@ func (s *SessionVerificationControllerDelegate) OnUpdate(status matrix_sdk_ffi.V
 		cc.VState = state
 	})
 }
+
+// backupStateListener maps backup states to api.BackupState
+type backupStateListener struct {
+	broadcast func(s api.BackupState)
+}
+
+func (l *backupStateListener) OnUpdate(state matrix_sdk_ffi.BackupState) {
+	l.broadcast(backupStateFromFFI(state))
+}
+
+func backupStateFromFFI(state matrix_sdk_ffi.BackupState) api.BackupState {
+	switch state {
+	case matrix_sdk_ffi.BackupStateCreating, matrix_sdk_ffi.BackupStateEnabling, matrix_sdk_ffi.BackupStateResuming:
+		return api.BackupStateEnabling
+	case matrix_sdk_ffi.BackupStateEnabled:
+		return api.BackupStateEnabled
+	case matrix_sdk_ffi.BackupStateDownloading:
+		return api.BackupStateDownloading
+	case matrix_sdk_ffi.BackupStateDisabling:
+		return api.BackupStateDisabling
+	default:
+		// Unknown means there is no active backup on this device.
+		return api.BackupStateDisabled
+	}
+}
+
+// syncServiceStateObserver maps sync service states to api.SyncState
+type syncServiceStateObserver struct {
+	broadcast func(s api.SyncState)
+}
+
+func (o *syncServiceStateObserver) OnUpdate(state matrix_sdk_ffi.SyncServiceState) {
+	s := api.SyncState{}
+	switch state {
+	case matrix_sdk_ffi.SyncServiceStateIdle:
+		s.State = "Idle"
+	case matrix_sdk_ffi.SyncServiceStateRunning:
+		s.State = "Running"
+		s.Syncing = true
+	case matrix_sdk_ffi.SyncServiceStateTerminated:
+		s.State = "Terminated"
+	case matrix_sdk_ffi.SyncServiceStateError:
+		s.State = "Error"
+		// the FFI bindings do not expose the underlying error, which is in the rust SDK logs.
+		s.Error = "sync service entered the error state, see the rust SDK logs"
+	default:
+		s.State = fmt.Sprintf("Unknown(%d)", state)
+	}
+	o.broadcast(s)
+}
@@ -0,0 +1,120 @@
+package rust
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/api/rust/matrix_sdk_ffi"
+	"github.com/matrix-org/complement-crypto/internal/logging"
+	"github.com/matrix-org/complement/ct"
+)
+
+// Rust SDK logs are written to files in ./logs, interleaved from every client in every test. To find the
+// logs for a single api.Client call, each call is wrapped in a tracing span named after the test, client and
+// method. The rust SDK prefixes every line logged whilst the span is entered with the span name, so these
+// lines can be copied into the test output when a test fails.
+
+// The tracing target for spans made by complement-crypto. This is added to the extra targets in SetupLogs
+// so spans are not filtered out.
+const spanTarget = "complement_crypto"
+
+// The log file prefix passed to SetupLogs, used to find the rust log files.
+var logFilePrefix string
+
+// maxCorrelatedLines bounds the number of rust log lines copied into the test output per client, as
+// trace logging can produce a lot of lines for long tests.
+const maxCorrelatedLines = 2000
+
+// span creates and enters a tracing span for the given api.Client method. Call the returned function to
+// exit the span when the method returns.
+//
+// Spans are entered per thread in rust, so the goroutine is locked to its OS thread until the span exits.
+// This covers work done whilst polling FFI futures, which happens on the calling thread, but not tasks
+// the rust SDK spawns onto its own runtime e.g the sync loop.
+func (c *RustClient) span(t ct.TestLike, method string) (exit func()) {
+	runtime.LockOSThread()
+	span := matrix_sdk_ffi.NewSpan("rust.go", &zero, matrix_sdk_ffi.LogLevelInfo, spanTarget, c.spanPrefix(t)+method)
+	span.Enter()
+	return func() {
+		span.Exit()
+		span.Destroy()
+		runtime.UnlockOSThread()
+	}
+}
+
+// spanPrefix returns the start of the name of all spans for this client in this test.
+func (c *RustClient) spanPrefix(t ct.TestLike) string {
+	return fmt.Sprintf("%s [%s] ", t.Name(), api.ClientID(c.userID, c.opts.DeviceID, api.ClientTypeRust))
+}
+
+// logFileOffsets returns the current size of each rust log file, so lines written before now can be skipped.
+func logFileOffsets() map[string]int64 {
+	offsets := make(map[string]int64)
+	for _, path := range logFilePaths() {
+		if info, err := os.Stat(path); err == nil {
+			offsets[path] = info.Size()
+		}
+	}
+	return offsets
+}
+
+func logFilePaths() []string {
+	if logFilePrefix == "" {
+		return nil
+	}
+	paths, _ := filepath.Glob(filepath.Join("./logs", logFilePrefix+"*"))
+	return paths
+}
+
+// correlateLogs copies the rust log lines which were logged in this client's spans for this test into
+// the test output and the log bundle. Only lines written since the client was created are read.
+func (c *RustClient) correlateLogs(t ct.TestLike) {
+	t.Helper()
+	prefix := c.spanPrefix(t)
+	clientID := api.ClientID(c.userID, c.opts.DeviceID, api.ClientTypeRust)
+	count := 0
+	for _, path := range logFilePaths() {
+		lines, err := linesContaining(path, c.logOffsets[path], prefix)
+		if err != nil {
+			t.Logf("correlateLogs: failed to read %s: %s", path, err)
+			continue
+		}
+		for _, line := range lines {
+			if count == maxCorrelatedLines {
+				t.Logf("correlateLogs: too many rust log lines, see %s for the rest", path)
+				return
+			}
+			count++
+			logging.Write(t.Name(), clientID, "rust: "+line)
+			t.Logf("rust: %s", line)
+		}
+	}
+}
+
+// linesContaining returns the lines in the file after offset which contain substr.
+func linesContaining(path string, offset int64, substr string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	// trace logs can include entire HTTP bodies
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if strings.Contains(scanner.Text(), substr) {
+			lines = append(lines, scanner.Text())
+		}
+	}
+	return lines, scanner.Err()
+}
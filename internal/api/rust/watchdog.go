@@ -0,0 +1,100 @@
+package rust
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// callWithWatchdog calls fn, failing the test if it does not return within timeout. FFI calls which deadlock
+// would otherwise block until the global `go test` timeout, which only dumps goroutines. On timeout, the test
+// is failed with the description returned by describe, and fn is left running in the background. Panics in fn
+// are re-raised in the caller's goroutine. If timeout is zero, fn is called directly.
+func callWithWatchdog[T any](t ct.TestLike, timeout time.Duration, describe func() string, fn func() (T, error)) (T, error) {
+	t.Helper()
+	if timeout == 0 {
+		return fn()
+	}
+	type result struct {
+		val      T
+		err      error
+		panicked any
+	}
+	// buffered so the goroutine can exit if fn eventually returns after we've given up
+	ch := make(chan result, 1)
+	go func() {
+		var res result
+		defer func() {
+			res.panicked = recover()
+			ch <- res
+		}()
+		res.val, res.err = fn()
+	}()
+	select {
+	case res := <-ch:
+		if res.panicked != nil {
+			panic(res.panicked)
+		}
+		return res.val, res.err
+	case <-time.After(timeout):
+		err := fmt.Errorf("FFI watchdog: call did not return after %v: %s", timeout, describe())
+		ct.Fatalf(t, "%s", err)
+		var zero T
+		return zero, err
+	}
+}
+
+// watchFFI calls fn, which calls into the FFI bindings, failing the test if it hangs for longer than
+// api.ClientCreationOpts.FFIWatchdogTimeout. The call describes what fn does for the failure message
+// e.g "JoinRoomByIdOrAlias(!foo:hs1)".
+func watchFFI[T any](c *RustClient, t ct.TestLike, call string, fn func() (T, error)) (T, error) {
+	t.Helper()
+	return callWithWatchdog(t, c.opts.FFIWatchdogTimeout, func() string {
+		desc := fmt.Sprintf("[%s] %s, %s", c.userID, call, c.listenerStates())
+		c.Logf(t, "%s", desc)
+		return desc
+	}, fn)
+}
+
+// watchFFIErr is watchFFI for FFI calls which only return an error.
+func (c *RustClient) watchFFIErr(t ct.TestLike, call string, fn func() error) error {
+	t.Helper()
+	_, err := watchFFI(c, t, call, func() (struct{}, error) {
+		return struct{}{}, fn()
+	})
+	return err
+}
+
+// listenerStates describes the sync loop and the listeners attached to this client. This never blocks,
+// as it is called when something is already deadlocked: anything which is locked is reported as such.
+func (c *RustClient) listenerStates() string {
+	var sb strings.Builder
+	if s := c.lastSyncState.Load(); s != nil {
+		fmt.Fprintf(&sb, "sync state=%s", s.State)
+	} else {
+		sb.WriteString("sync state=none")
+	}
+	if n, ok := c.roomsListener.TryLen(); ok {
+		fmt.Fprintf(&sb, ", %d room listeners", n)
+	} else {
+		sb.WriteString(", room listeners LOCKED")
+	}
+	if !c.roomsMu.TryRLock() {
+		sb.WriteString(", rooms LOCKED")
+		return sb.String()
+	}
+	defer c.roomsMu.RUnlock()
+	roomIDs := make([]string, 0, len(c.rooms))
+	for roomID := range c.rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	sort.Strings(roomIDs)
+	for _, roomID := range roomIDs {
+		info := c.rooms[roomID]
+		fmt.Fprintf(&sb, ", room %s timeline_listener=%v timeline_len=%d", roomID, info.stream != nil, len(info.timeline))
+	}
+	return sb.String()
+}
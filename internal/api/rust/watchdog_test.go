@@ -0,0 +1,54 @@
+package rust
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/must"
+)
+
+// fatalRecorder is a ct.TestLike which records calls to Fatalf instead of ending the test.
+type fatalRecorder struct {
+	*testing.T
+	fatal string
+}
+
+func (r *fatalRecorder) Fatalf(format string, args ...any) {
+	r.fatal = fmt.Sprintf(format, args...)
+}
+
+func TestCallWithWatchdog(t *testing.T) {
+	describe := func() string { return "listener state" }
+
+	// returns the result of calls which finish in time
+	val, err := callWithWatchdog(t, time.Second, describe, func() (string, error) {
+		return "foo", nil
+	})
+	must.NotError(t, "callWithWatchdog", err)
+	must.Equal(t, val, "foo", "callWithWatchdog value")
+
+	// fails the test for calls which hang, including the description
+	recorder := &fatalRecorder{T: t}
+	unblock := make(chan struct{})
+	defer close(unblock)
+	_, err = callWithWatchdog(recorder, 10*time.Millisecond, describe, func() (string, error) {
+		<-unblock
+		return "bar", nil
+	})
+	if err == nil {
+		t.Fatalf("callWithWatchdog did not return an error for a call which hung")
+	}
+	if !strings.Contains(recorder.fatal, err.Error()) || !strings.Contains(err.Error(), "listener state") {
+		t.Fatalf("callWithWatchdog failure message did not include the description: %s", recorder.fatal)
+	}
+
+	// re-raises panics in the caller's goroutine
+	defer func() {
+		must.Equal(t, recover(), any("baz"), "callWithWatchdog panic")
+	}()
+	callWithWatchdog(t, time.Second, describe, func() (string, error) {
+		panic("baz")
+	})
+}
@@ -0,0 +1,219 @@
+package api
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// How long MustBecomeSyncing waits for the client to start syncing.
+const syncMonitorTimeout = 5 * time.Second
+
+// SyncState is the state of a client's sync loop.
+type SyncState struct {
+	// The SDK-specific name of the state e.g "Running" for rust or "SYNCING" for JS.
+	State string
+	// True if the client is actively syncing.
+	Syncing bool
+	// Set if the sync loop encountered an error. Not all SDKs expose error details, in which
+	// case this is a generic description of the error.
+	Error string
+}
+
+// ClientSyncMonitor tracks the state of a client's sync loop, so tests can tell the difference between
+// "the event never arrived" and "the client stopped syncing". Wrap waiters with WrapWaiter to include the
+// sync state in timeout messages.
+type ClientSyncMonitor struct {
+	client  Client
+	cancel  func()
+	mu      sync.Mutex
+	current *SyncState
+	lastErr string
+	// closed and replaced whenever the state changes
+	changed chan struct{}
+}
+
+// NewClientSyncMonitor starts monitoring the sync loop of the client. This can be called before or after
+// the client starts syncing. Fails the test if the client cannot report its sync state. Call Close when done.
+func NewClientSyncMonitor(t ct.TestLike, c Client) *ClientSyncMonitor {
+	t.Helper()
+	m := &ClientSyncMonitor{
+		client:  c,
+		changed: make(chan struct{}),
+	}
+	cancel, err := c.ListenForSyncStates(t, m.onSyncState)
+	if err != nil {
+		ct.Fatalf(t, "NewClientSyncMonitor: %s", err)
+	}
+	m.cancel = cancel
+	return m
+}
+
+func (m *ClientSyncMonitor) onSyncState(s SyncState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.current = &s
+	if s.Error != "" {
+		m.lastErr = s.Error
+	}
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// WaitForSyncState waits up to the timeout for the checker to return true for the current sync state.
+// Returns an error which includes the last sync error if the timeout expires.
+func (m *ClientSyncMonitor) WaitForSyncState(timeout time.Duration, checker func(s SyncState) bool) error {
+	deadline := time.After(timeout)
+	for {
+		m.mu.Lock()
+		matched := m.current != nil && checker(*m.current)
+		changed := m.changed
+		m.mu.Unlock()
+		if matched {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return fmt.Errorf("timed out after %v waiting for sync state: %s", timeout, m)
+		}
+	}
+}
+
+// MustBecomeSyncing waits until the client is syncing, failing the test if it does not start syncing in time.
+func (m *ClientSyncMonitor) MustBecomeSyncing(t ct.TestLike) {
+	t.Helper()
+	err := m.WaitForSyncState(syncMonitorTimeout, func(s SyncState) bool {
+		return s.Syncing
+	})
+	if err != nil {
+		ct.Fatalf(t, "MustBecomeSyncing: %s: %s", m.client.UserID(), err)
+	}
+}
+
+// MustNotError fails the test if the sync loop has encountered an error since monitoring started.
+func (m *ClientSyncMonitor) MustNotError(t ct.TestLike) {
+	t.Helper()
+	if lastErr := m.LastError(); lastErr != "" {
+		ct.Fatalf(t, "MustNotError: %s: sync loop encountered an error: %s", m.client.UserID(), lastErr)
+	}
+}
+
+// LastError returns the last error encountered by the sync loop, or the empty string if there have been no errors.
+func (m *ClientSyncMonitor) LastError() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastErr
+}
+
+// String describes the current sync state and the last error, for use in test failure messages.
+func (m *ClientSyncMonitor) String() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current := "unknown"
+	if m.current != nil {
+		current = m.current.State
+	}
+	if m.lastErr == "" {
+		return fmt.Sprintf("state=%s", current)
+	}
+	return fmt.Sprintf("state=%s last_error=%s", current, m.lastErr)
+}
+
+// WrapWaiter returns a Waiter which includes the sync state in the failure message if the waiter times out.
+func (m *ClientSyncMonitor) WrapWaiter(w Waiter) Waiter {
+	// observe the wrapped waiter instead, so the sync state is logged whilst waiting
+	if observed, ok := w.(*observedWaiter); ok {
+		return ObserveWaiter(&syncMonitorWaiter{
+			Waiter:  observed.Waiter,
+			monitor: m,
+		})
+	}
+	return &syncMonitorWaiter{
+		Waiter:  w,
+		monitor: m,
+	}
+}
+
+// Close stops monitoring the sync loop.
+func (m *ClientSyncMonitor) Close() {
+	m.cancel()
+}
+
+type syncMonitorWaiter struct {
+	Waiter
+	monitor *ClientSyncMonitor
+}
+
+func (w *syncMonitorWaiter) Waitf(t ct.TestLike, s time.Duration, format string, args ...any) {
+	t.Helper()
+	if err := w.TryWaitf(t, s, format, args...); err != nil {
+		ct.Fatalf(t, "%s", err)
+	}
+}
+
+func (w *syncMonitorWaiter) TryWaitf(t ct.TestLike, s time.Duration, format string, args ...any) error {
+	t.Helper()
+	err := w.Waiter.TryWaitf(t, s, format, args...)
+	if err != nil {
+		return fmt.Errorf("%s (sync %s)", err, w.monitor)
+	}
+	return nil
+}
+
+// State describes the sync state, and what the wrapped waiter has seen if it is an ObservableWaiter.
+func (w *syncMonitorWaiter) State() string {
+	state := "sync " + w.monitor.String()
+	if o, ok := w.Waiter.(ObservableWaiter); ok {
+		state += ", " + o.State()
+	}
+	return state
+}
+
+// SyncStateListeners is a set of sync state callbacks which clients can use to implement
+// ListenForSyncStates. The zero value is ready to use.
+type SyncStateListeners struct {
+	mu        sync.Mutex
+	current   *SyncState
+	listeners map[int]func(SyncState)
+	nextID    int
+}
+
+// Add a listener, which is immediately called with the current sync state if there is one.
+// Call the returned function to remove the listener.
+func (l *SyncStateListeners) Add(callback func(SyncState)) (remove func()) {
+	l.mu.Lock()
+	if l.listeners == nil {
+		l.listeners = make(map[int]func(SyncState))
+	}
+	id := l.nextID
+	l.nextID++
+	l.listeners[id] = callback
+	var current *SyncState
+	if l.current != nil {
+		s := *l.current
+		current = &s
+	}
+	l.mu.Unlock()
+	// call the callback without holding the lock, in case it adds or removes listeners
+	if current != nil {
+		callback(*current)
+	}
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.listeners, id)
+	}
+}
+
+// Broadcast the new sync state to all listeners.
+func (l *SyncStateListeners) Broadcast(s SyncState) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.current = &s
+	for _, callback := range l.listeners {
+		callback(s)
+	}
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// WaiterConfig controls how long every Waiter returned by a TestClient waits, so slow CI machines can be given more
+// time uniformly rather than by hand-tuning the timeouts in each test. See SetWaiterConfig.
+type WaiterConfig struct {
+	// The timeout used when 0 is passed to Waitf or TryWaitf.
+	DefaultTimeout time.Duration
+	// Every timeout passed to Waitf or TryWaitf is multiplied by this. Values below 1 are treated as 1.
+	TimeoutMultiplier float64
+	// How long to wait for something which depends on federation recovering from an outage, see FederationTimeout.
+	FederationTimeout time.Duration
+	// How long a Waiter waits before logging that it is still waiting. Each later log is made after twice as long
+	// as the previous one, so long waits do not flood the logs. 0 disables logging.
+	ObserveInterval time.Duration
+}
+
+// DefaultWaiterConfig is used unless SetWaiterConfig is called.
+var DefaultWaiterConfig = WaiterConfig{
+	DefaultTimeout:    5 * time.Second,
+	TimeoutMultiplier: 1,
+	FederationTimeout: 30 * time.Second,
+	ObserveInterval:   5 * time.Second,
+}
+
+var (
+	waiterConfigMu sync.RWMutex
+	waiterConfig   = DefaultWaiterConfig
+)
+
+// SetWaiterConfig sets the config used by every Waiter returned by a TestClient.
+func SetWaiterConfig(cfg WaiterConfig) {
+	waiterConfigMu.Lock()
+	defer waiterConfigMu.Unlock()
+	waiterConfig = cfg
+}
+
+// CurrentWaiterConfig returns the config used by every Waiter returned by a TestClient.
+func CurrentWaiterConfig() WaiterConfig {
+	waiterConfigMu.RLock()
+	defer waiterConfigMu.RUnlock()
+	return waiterConfig
+}
+
+// Scale returns the timeout multiplied by TimeoutMultiplier.
+func (c WaiterConfig) Scale(timeout time.Duration) time.Duration {
+	if c.TimeoutMultiplier <= 1 {
+		return timeout
+	}
+	return time.Duration(float64(timeout) * c.TimeoutMultiplier)
+}
+
+// FederationTimeout returns how long to wait for something which depends on federation recovering from an outage
+// e.g a message from another server once it comes back online. Waiters scale timeouts themselves, so pass this to
+// Waitf as-is. Use ScaleTimeout for waits which do not use a Waiter.
+func FederationTimeout() time.Duration {
+	return CurrentWaiterConfig().FederationTimeout
+}
+
+// ScaleTimeout returns the timeout multiplied by the configured timeout multiplier, for waits which do not use a
+// Waiter e.g context timeouts.
+func ScaleTimeout(timeout time.Duration) time.Duration {
+	return CurrentWaiterConfig().Scale(timeout)
+}
+
+// ObservableWaiter is a Waiter which can describe what it has seen so far, which is logged whilst it waits.
+type ObservableWaiter interface {
+	Waiter
+	// State describes what the waiter has seen so far e.g the client's sync state. Called whilst TryWaitf
+	// is running, so MUST be safe to call concurrently.
+	State() string
+}
+
+// ObserveWaiter returns a Waiter which applies the current WaiterConfig to the timeouts passed to the waiter, and
+// logs that it is still waiting at exponentially increasing intervals, including the State if the waiter is an
+// ObservableWaiter.
+func ObserveWaiter(w Waiter) Waiter {
+	return &observedWaiter{
+		Waiter: w,
+	}
+}
+
+type observedWaiter struct {
+	Waiter
+}
+
+func (w *observedWaiter) Waitf(t ct.TestLike, s time.Duration, format string, args ...any) {
+	t.Helper()
+	if err := w.TryWaitf(t, s, format, args...); err != nil {
+		ct.Fatalf(t, "%s", err)
+	}
+}
+
+func (w *observedWaiter) TryWaitf(t ct.TestLike, s time.Duration, format string, args ...any) error {
+	t.Helper()
+	cfg := CurrentWaiterConfig()
+	if s == 0 {
+		s = cfg.DefaultTimeout
+	}
+	s = cfg.Scale(s)
+	if cfg.ObserveInterval > 0 {
+		stop := w.observe(t, cfg.ObserveInterval, s, fmt.Sprintf(format, args...))
+		defer stop()
+	}
+	return w.Waiter.TryWaitf(t, s, format, args...)
+}
+
+// observe logs that the waiter is still waiting after interval, then after twice as long each time, until stop is
+// called. Returns once nothing more will be logged.
+func (w *observedWaiter) observe(t ct.TestLike, interval, timeout time.Duration, msg string) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	start := time.Now()
+	go func() {
+		defer close(exited)
+		timer := time.NewTimer(interval)
+		defer timer.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-timer.C:
+				var state string
+				if o, ok := w.Waiter.(ObservableWaiter); ok {
+					state = " (" + o.State() + ")"
+				}
+				t.Logf("%s: still waiting after %v of %v%s", msg, time.Since(start).Round(time.Second), timeout, state)
+				interval *= 2
+				timer.Reset(interval)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/must"
+)
+
+// recordingT records logs, so tests can check what an observed waiter logged.
+type recordingT struct {
+	MockT
+	mu   sync.Mutex
+	logs []string
+}
+
+func (t *recordingT) Logf(f string, args ...any) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.logs = append(t.logs, fmt.Sprintf(f, args...))
+}
+
+// sleepWaiter waits for the given duration, recording the timeout it was given.
+type sleepWaiter struct {
+	sleep time.Duration
+	got   time.Duration
+}
+
+func (w *sleepWaiter) Waitf(t ct.TestLike, s time.Duration, format string, args ...any) {}
+
+func (w *sleepWaiter) TryWaitf(t ct.TestLike, s time.Duration, format string, args ...any) error {
+	w.got = s
+	time.Sleep(w.sleep)
+	return nil
+}
+
+func (w *sleepWaiter) State() string {
+	return "sleeping"
+}
+
+func withWaiterConfig(t *testing.T, cfg WaiterConfig) {
+	SetWaiterConfig(cfg)
+	t.Cleanup(func() {
+		SetWaiterConfig(DefaultWaiterConfig)
+	})
+}
+
+func TestObserveWaiterScalesTimeouts(t *testing.T) {
+	withWaiterConfig(t, WaiterConfig{
+		DefaultTimeout:    2 * time.Second,
+		TimeoutMultiplier: 1.5,
+	})
+	inner := &sleepWaiter{}
+	w := ObserveWaiter(inner)
+	must.NotError(t, "TryWaitf", w.TryWaitf(&recordingT{}, 10*time.Second, "waiting"))
+	must.Equal(t, inner.got, 15*time.Second, "timeout was not scaled")
+	must.NotError(t, "TryWaitf", w.TryWaitf(&recordingT{}, 0, "waiting"))
+	must.Equal(t, inner.got, 3*time.Second, "default timeout was not used")
+}
+
+func TestObserveWaiterLogsExponentially(t *testing.T) {
+	withWaiterConfig(t, WaiterConfig{
+		TimeoutMultiplier: 1,
+		ObserveInterval:   50 * time.Millisecond,
+	})
+	rt := &recordingT{}
+	// logs at 50ms, 150ms, 350ms
+	w := ObserveWaiter(&sleepWaiter{sleep: 500 * time.Millisecond})
+	must.NotError(t, "TryWaitf", w.TryWaitf(rt, time.Second, "waiting for %s", "something"))
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	must.Equal(t, len(rt.logs), 3, fmt.Sprintf("wrong number of logs: %v", rt.logs))
+	for _, log := range rt.logs {
+		must.Equal(t, strings.HasPrefix(log, "waiting for something: still waiting after"), true, "bad log: "+log)
+		must.Equal(t, strings.HasSuffix(log, "(sleeping)"), true, "log does not include state: "+log)
+	}
+}
@@ -0,0 +1,144 @@
+package cc
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/deploy"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+	"github.com/tidwall/gjson"
+)
+
+// MustDeactivate deactivates the user's account via /account/deactivate, else fails the test. The homeserver
+// logs out and deletes every device for the user, including their device keys, and makes the user leave every
+// room they are joined to. Test clients for the user are not told about the deactivation, so close them.
+func (u *User) MustDeactivate(t *testing.T) {
+	t.Helper()
+	u.MustDo(t, "POST", []string{"_matrix", "client", "v3", "account", "deactivate"}, client.WithJSONBody(t, map[string]any{
+		"auth": map[string]any{
+			"type": "m.login.password",
+			"identifier": map[string]any{
+				"type": "m.id.user",
+				"user": u.UserID,
+			},
+			"password": "complement-crypto-password",
+		},
+		"erase": false,
+	}))
+}
+
+// MustHaveInaccessibleKeyBackup fails the test unless the user's key backup cannot be accessed, because the user
+// has been deactivated. The user's existing access token must be rejected, and logging in again to get a new
+// access token must fail with M_USER_DEACTIVATED.
+func (c *TestContext) MustHaveInaccessibleKeyBackup(t *testing.T, user *User) {
+	t.Helper()
+	res := user.Do(t, "GET", []string{"_matrix", "client", "v3", "room_keys", "version"})
+	mustHaveErrorCode(t, "MustHaveInaccessibleKeyBackup: /room_keys/version", res, http.StatusUnauthorized, "M_UNKNOWN_TOKEN")
+	unauthedClient := c.Deployment.UnauthenticatedClient(t, user.ClientType.HS)
+	res = unauthedClient.Do(t, "POST", []string{"_matrix", "client", "v3", "login"}, client.WithJSONBody(t, map[string]any{
+		"type": "m.login.password",
+		"identifier": map[string]any{
+			"type": "m.id.user",
+			"user": user.UserID,
+		},
+		"password": "complement-crypto-password",
+	}))
+	mustHaveErrorCode(t, "MustHaveInaccessibleKeyBackup: /login", res, http.StatusForbidden, "M_USER_DEACTIVATED")
+}
+
+func mustHaveErrorCode(t *testing.T, msg string, res *http.Response, wantStatus int, wantErrCode string) {
+	t.Helper()
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		ct.Fatalf(t, "%s: failed to read response body: %s", msg, err)
+	}
+	errcode := gjson.GetBytes(body, "errcode").Str
+	if res.StatusCode != wantStatus || errcode != wantErrCode {
+		ct.Fatalf(t, "%s: got HTTP %d %s, want HTTP %d %s: %s", msg, res.StatusCode, errcode, wantStatus, wantErrCode, string(body))
+	}
+}
+
+// MustSendMessageExcludingUser sends a message as sender, then fails the test if the sender sent any to-device
+// messages to the excluded user's devices, e.g because the user was deactivated or left the room. If the sender
+// can report the megolm session it used, this also fails the test unless the message was encrypted with a different
+// session to `previousEventID`, an earlier message sent by the sender whilst the excluded user was in the room.
+// Returns the event ID of the message.
+func (c *TestContext) MustSendMessageExcludingUser(t *testing.T, sender api.TestClient, excluded *User, roomID, previousEventID, text string) string {
+	t.Helper()
+	return c.mustSendMessageExcluding(t, "MustSendMessageExcludingUser", sender, excluded.UserID, roomID, previousEventID, text, func(msg deploy.ToDeviceMessage) bool {
+		return msg.UserID == excluded.UserID
+	})
+}
+
+// MustLogoutAndAssertCleanup logs out the device via /logout, else fails the test, then fails the test unless the
+// server and peers have cleaned up after the device:
+//   - the device is no longer returned by /keys/query, as seen by peer.
+//   - the device's access token is rejected by the key backup endpoints.
+//   - peerClient, which is in roomID with the device, sends a message without sending the room key to the device.
+//     As with MustSendMessageExcludingUser, the message must use a new session to `previousEventID` if peerClient
+//     can report sessions.
+//
+// The device's test client is not told about the logout, so stop it syncing first. Returns the event ID of the
+// message sent by peerClient.
+func (c *TestContext) MustLogoutAndAssertCleanup(t *testing.T, device, peer *User, peerClient api.TestClient, roomID, previousEventID, text string) string {
+	t.Helper()
+	deviceID := device.DeviceID
+	device.MustDo(t, "POST", []string{"_matrix", "client", "v3", "logout"}, client.WithJSONBody(t, map[string]any{}))
+
+	if _, exists := peer.MustQueryKeys(t, device.UserID).Devices[deviceID]; exists {
+		ct.Fatalf(t, "MustLogoutAndAssertCleanup: %s %s still has device keys on the server after logging out", device.UserID, deviceID)
+	}
+	res := device.Do(t, "GET", []string{"_matrix", "client", "v3", "room_keys", "version"})
+	mustHaveErrorCode(t, "MustLogoutAndAssertCleanup: /room_keys/version", res, http.StatusUnauthorized, "M_UNKNOWN_TOKEN")
+
+	// wait for peerClient to process the device list update, else it may still encrypt for the device
+	_, err := peerClient.GetDeviceIDs(t, device.UserID)
+	if err == nil {
+		peerClient.WaitUntilDeviceList(t, device.UserID, api.CheckDeviceListExcludes(deviceID)).Waitf(
+			t, 5*time.Second, "MustLogoutAndAssertCleanup: %s did not see %s %s log out", peerClient.UserID(), device.UserID, deviceID,
+		)
+	} else if errors.Is(err, api.ErrNotSupported) {
+		t.Logf("MustLogoutAndAssertCleanup: %s cannot report its device list, waiting 1s for the device list update", peerClient.Type())
+		time.Sleep(time.Second)
+	} else {
+		ct.Fatalf(t, "MustLogoutAndAssertCleanup: GetDeviceIDs: %s", err)
+	}
+	return c.mustSendMessageExcluding(t, "MustLogoutAndAssertCleanup", peerClient, device.UserID+" "+deviceID, roomID, previousEventID, text, func(msg deploy.ToDeviceMessage) bool {
+		return msg.UserID == device.UserID && msg.DeviceID == deviceID
+	})
+}
+
+// mustSendMessageExcluding sends a message as sender, then fails the test if any to-device messages sent whilst
+// sending it match `isExcluded`, or if the sender did not rotate its outbound session since `previousEventID`.
+func (c *TestContext) mustSendMessageExcluding(t *testing.T, fnName string, sender api.TestClient, excludedName, roomID, previousEventID, text string, isExcluded func(msg deploy.ToDeviceMessage) bool) string {
+	t.Helper()
+	var eventID string
+	toDeviceLog := c.Deployment.SniffToDevice(t, func() {
+		eventID = sender.MustSendMessage(t, roomID, text)
+	})
+	sentToExcluded := toDeviceLog.Filter(isExcluded)
+	if len(sentToExcluded) > 0 {
+		ct.Fatalf(t, "%s: %s sent %d to-device messages to %s, first was %s to %s",
+			fnName, sender.UserID(), len(sentToExcluded), excludedName, sentToExcluded[0].EventType, sentToExcluded[0].DeviceID)
+	}
+	previousSessionID, err := sender.GetOutboundSessionID(t, roomID, previousEventID)
+	if err != nil {
+		if errors.Is(err, api.ErrNotSupported) {
+			t.Logf("%s: %s cannot report outbound sessions, not checking rotation", fnName, sender.Type())
+			return eventID
+		}
+		ct.Fatalf(t, "%s: GetOutboundSessionID: %s", fnName, err)
+	}
+	sessionID := sender.MustGetOutboundSessionID(t, roomID, eventID)
+	if sessionID == previousSessionID {
+		ct.Fatalf(t, "%s: %s did not rotate the room key after %s was excluded, still using %s",
+			fnName, sender.UserID(), excludedName, sessionID)
+	}
+	return eventID
+}
@@ -0,0 +1,38 @@
+package cc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement/ct"
+)
+
+// MustFailToDecryptWithReason waits until the client has seen the event, then fails the test unless the client
+// could not decrypt it for the given reason. Clients which do not expose why events fail to decrypt, such as nio,
+// only need to fail to decrypt the event. Returns the event.
+func MustFailToDecryptWithReason(t *testing.T, client api.TestClient, roomID, eventID string, reason api.DecryptionFailureReason) *api.Event {
+	t.Helper()
+	client.WaitUntilEventInRoom(t, roomID, api.CheckEventHasEventID(eventID)).Waitf(
+		t, 5*time.Second, "MustFailToDecryptWithReason: %s did not see %s", client.UserID(), eventID,
+	)
+	// the event may be seen before the decryption attempt has finished, so poll.
+	var ev *api.Event
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(100 * time.Millisecond) {
+		ev = client.MustGetEvent(t, roomID, eventID)
+		if ev.DecryptionFailureReason == reason || client.Type() == api.ClientTypeNio && ev.FailedToDecrypt {
+			break
+		}
+	}
+	if !ev.FailedToDecrypt {
+		ct.Fatalf(t, "MustFailToDecryptWithReason: %s decrypted %s, but it should have failed with %q", client.UserID(), eventID, reason)
+	}
+	if client.Type() == api.ClientTypeNio { // nio does not expose why events fail to decrypt
+		return ev
+	}
+	if ev.DecryptionFailureReason != reason {
+		ct.Fatalf(t, "MustFailToDecryptWithReason: %s failed to decrypt %s for the wrong reason: got %q want %q",
+			client.UserID(), eventID, ev.DecryptionFailureReason, reason)
+	}
+	return ev
+}
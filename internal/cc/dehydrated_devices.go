@@ -0,0 +1,43 @@
+package cc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement/ct"
+)
+
+// MustDecryptAfterRehydration logs in a new device for the user, rehydrates the user's dehydrated device using
+// the recovery key, then asserts that the new device can decrypt all the events. The events should have been sent
+// whilst the user had no devices other than the dehydrated device, so the only way to decrypt them is with the
+// room keys which were sent to the dehydrated device.
+func (c *TestContext) MustDecryptAfterRehydration(t *testing.T, user *User, recoveryKey, roomID string, eventIDs []string) {
+	t.Helper()
+	newDevice := c.MustLoginClient(t, &ClientCreationRequest{
+		User: c.MustRegisterNewDevice(t, user, "REHYDRATOR"),
+	})
+	defer newDevice.Close(t)
+	newDevice.MustRehydrateDevice(t, recoveryKey)
+	stopSyncing := newDevice.MustStartSyncing(t)
+	defer stopSyncing()
+	for _, eventID := range eventIDs {
+		newDevice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasEventID(eventID)).Waitf(
+			t, 5*time.Second, "MustDecryptAfterRehydration: %s did not see event %s", newDevice.UserID(), eventID,
+		)
+	}
+	// the keys from the dehydrated device may be imported after the events are first seen, so poll.
+	for _, eventID := range eventIDs {
+		var ev *api.Event
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(100 * time.Millisecond) {
+			ev = newDevice.MustGetEvent(t, roomID, eventID)
+			if !ev.FailedToDecrypt {
+				break
+			}
+		}
+		if ev.FailedToDecrypt {
+			ct.Fatalf(t, "MustDecryptAfterRehydration: %s (%s) failed to decrypt event %s after rehydrating",
+				newDevice.UserID(), newDevice.Type(), eventID)
+		}
+	}
+}
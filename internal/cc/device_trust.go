@@ -0,0 +1,33 @@
+package cc
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement/ct"
+)
+
+// MustSeeDeviceTrust waits until the observer trusts the user's device at the wanted level, else fails the test.
+// The observer may need to download the user's device keys first, so this waits whilst the trust is unknown.
+// Skips the test if the observer cannot report trust in the device.
+func MustSeeDeviceTrust(t *testing.T, observer api.TestClient, userID, deviceID string, want api.TrustLevel) {
+	t.Helper()
+	var trust api.TrustLevel
+	var err error
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(100 * time.Millisecond) {
+		trust, err = observer.GetDeviceTrust(t, userID, deviceID)
+		if err != nil {
+			if errors.Is(err, api.ErrNotSupported) {
+				t.Skipf("%s cannot report trust in %s's device %s: %s", observer.Type(), userID, deviceID, err)
+			}
+			ct.Fatalf(t, "MustSeeDeviceTrust: %s", err)
+		}
+		if trust == want {
+			return
+		}
+	}
+	ct.Fatalf(t, "MustSeeDeviceTrust: %s (%s) trusts %s's device %s at level %s, want %s",
+		observer.UserID(), observer.Type(), userID, deviceID, trust, want)
+}
@@ -0,0 +1,87 @@
+package cc
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/deploy"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/must"
+)
+
+// MustLoginDevices logs in `n` new devices for the user, each with its own persistent storage, else fails the test.
+// Device IDs are of the form DEVICE_0, DEVICE_1, etc. If opts.DeviceID is set, it is used instead of DEVICE as the prefix.
+// Other options are applied to every device.
+//
+// The clients are not syncing. Close them when the test is done. To ensure that the devices know about each other
+// before they start syncing, call MustWaitForDeviceKeys.
+func (c *TestContext) MustLoginDevices(t *testing.T, user *User, n int, opts api.ClientCreationOpts) []api.TestClient {
+	t.Helper()
+	prefix := opts.DeviceID
+	if prefix == "" {
+		prefix = "DEVICE"
+	}
+	devices := make([]api.TestClient, n)
+	for i := range devices {
+		deviceOpts := opts
+		deviceOpts.DeviceID = fmt.Sprintf("%s_%d", prefix, i)
+		// stores are keyed off the device ID, so each device gets its own store
+		deviceOpts.PersistentStorage = true
+		devices[i] = c.MustLoginClient(t, &ClientCreationRequest{
+			User: user,
+			Opts: deviceOpts,
+		})
+	}
+	return devices
+}
+
+// MustWaitForDeviceKeys waits until the device keys for all the devices are visible on the server via /keys/query,
+// else fails the test. Devices fetch each other's keys from /keys/query, so once this returns every device will
+// see the keys of every other device when it next queries keys, e.g after it starts syncing.
+func (c *TestContext) MustWaitForDeviceKeys(t *testing.T, user *User, devices []api.TestClient) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res := user.MustDo(t, "POST", []string{"_matrix", "client", "v3", "keys", "query"}, client.WithJSONBody(t, map[string]any{
+			"device_keys": map[string]any{
+				user.UserID: []string{},
+			},
+		}))
+		deviceKeys := must.ParseJSON(t, res.Body).Get("device_keys." + client.GjsonEscape(user.UserID))
+		var missing []string
+		for _, device := range devices {
+			deviceID := device.Opts().DeviceID
+			if !deviceKeys.Get(client.GjsonEscape(deviceID)).Exists() {
+				missing = append(missing, deviceID)
+			}
+		}
+		if len(missing) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			ct.Fatalf(t, "MustWaitForDeviceKeys: %s devices %v have no device keys on the server", user.UserID, missing)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// MustDeleteDeviceAsAdmin deletes the user's device via the Synapse admin API, as a server admin would, else fails
+// the test. The client for the device is not logged out and is not told about the deletion, but the homeserver tells
+// everyone who tracks the user's devices about the change in the device list in /sync. Returns the time the device
+// was deleted, so tests can measure how long other clients take to see the change e.g via TestClient.WaitUntilDeviceList.
+// Skips the test if the user's homeserver does not support the Synapse admin API.
+func (c *TestContext) MustDeleteDeviceAsAdmin(t *testing.T, user *User, deviceID string) time.Time {
+	t.Helper()
+	c.Deployment.RequireCapabilities(t, user.ClientType.HS, deploy.CapabilityAdminAPI)
+	admin := c.Deployment.Register(t, user.ClientType.HS, helpers.RegistrationOpts{
+		LocalpartSuffix: "admin",
+		Password:        "complement-crypto-password",
+		IsAdmin:         true,
+	})
+	admin.MustDo(t, "DELETE", []string{"_synapse", "admin", "v2", "users", user.UserID, "devices", deviceID})
+	return time.Now()
+}
@@ -0,0 +1,49 @@
+package cc
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/complement/must"
+	"github.com/tidwall/gjson"
+)
+
+// CreateEncryptedDM creates an encrypted direct message room between creator and invitee, in the same way
+// clients do: the room is created with `is_direct: true` and the trusted_private_chat preset, and the room
+// is added to the `m.direct` account data of both users. The invitee still needs to join the room.
+//
+// options are applied after the DM defaults, so can be used to customise the m.room.encryption event
+// e.g EncRoomOptions.RotationPeriodMsgs.
+func (c *TestContext) CreateEncryptedDM(t *testing.T, creator, invitee *User, options ...EncRoomOption) (roomID string) {
+	t.Helper()
+	options = append([]EncRoomOption{
+		EncRoomOptions.PresetTrustedPrivateChat(),
+		EncRoomOptions.Invite([]string{invitee.UserID}),
+		func(reqBody map[string]interface{}) {
+			reqBody["is_direct"] = true
+			// DMs are named after the other user by clients, so don't give it a name.
+			delete(reqBody, "name")
+		},
+	}, options...)
+	roomID = c.CreateNewEncryptedRoom(t, creator, options...)
+	creator.MustAddDirectRoom(t, invitee.UserID, roomID)
+	invitee.MustAddDirectRoom(t, creator.UserID, roomID)
+	return roomID
+}
+
+// MustAddDirectRoom adds roomID to the list of DM rooms with otherUserID in this user's `m.direct`
+// account data, preserving any other DM rooms.
+func (u *User) MustAddDirectRoom(t *testing.T, otherUserID, roomID string) {
+	t.Helper()
+	direct := map[string]interface{}{}
+	res := u.GetGlobalAccountData(t, "m.direct")
+	if res.StatusCode == http.StatusOK {
+		must.ParseJSON(t, res.Body).ForEach(func(userID, roomIDs gjson.Result) bool {
+			direct[userID.Str] = roomIDs.Value()
+			return true
+		})
+	}
+	roomIDs, _ := direct[otherUserID].([]interface{})
+	direct[otherUserID] = append(roomIDs, roomID)
+	u.MustSetGlobalAccountData(t, "m.direct", direct)
+}
@@ -0,0 +1,60 @@
+package cc
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/must"
+)
+
+// MustEditMessage edits the given message, which must have been sent by sender, to have the new body, else fails the
+// test. The m.replace event is fetched from the server as viewer, and must be encrypted. If the sender exposes its
+// outbound session, the edit must be encrypted with the session the sender is currently using, not the session of
+// the original message. Returns the event ID of the edit and the megolm session ID it was encrypted with.
+func (c *TestContext) MustEditMessage(t *testing.T, sender api.TestClient, viewer *User, roomID, eventID, newBody string) (editEventID, sessionID string) {
+	t.Helper()
+	sender.MustEditMessage(t, roomID, eventID, newBody)
+	res := viewer.MustDo(t, "GET", []string{"_matrix", "client", "v1", "rooms", roomID, "relations", eventID, "m.replace"})
+	// the most recent edit is first
+	for _, ev := range must.ParseJSON(t, res.Body).Get("chunk").Array() {
+		if ev.Get("sender").Str == sender.UserID() {
+			editEventID = ev.Get("event_id").Str
+			break
+		}
+	}
+	if editEventID == "" {
+		ct.Fatalf(t, "MustEditMessage: %s cannot see an edit of %s by %s", viewer.UserID, eventID, sender.UserID())
+	}
+	sessionID = viewer.MustGetMegolmSessionID(t, roomID, editEventID)
+	mustMatchOutboundSessionID(t, sender, roomID, editEventID, sessionID)
+	info, err := sender.GetOutboundSessionInfo(t, roomID)
+	if errors.Is(err, api.ErrNotSupported) {
+		t.Logf("%s cannot report outbound sessions: %s", sender.Type(), err)
+		return
+	}
+	if err != nil {
+		ct.Fatalf(t, "MustEditMessage: GetOutboundSessionInfo(%s): %s", roomID, err)
+	}
+	if info == nil || info.SessionID != sessionID {
+		ct.Fatalf(t, "MustEditMessage: edit %s was encrypted with %s, which is not the current outbound session %+v", editEventID, sessionID, info)
+	}
+	return
+}
+
+// MustDecryptEditedMessage fails the test unless the receiver can still decrypt the original message after it was
+// edited. The receiver must already have seen the edit e.g via api.CheckEventHasEdit. Clients which show the edit on
+// the original event replace its body, in which case it must be the new body.
+func MustDecryptEditedMessage(t *testing.T, receiver api.TestClient, roomID, eventID, newBody string) {
+	t.Helper()
+	original := receiver.MustGetEvent(t, roomID, eventID)
+	if original.FailedToDecrypt {
+		ct.Fatalf(t, "MustDecryptEditedMessage: %s failed to decrypt the original message %s: %s",
+			receiver.UserID(), eventID, original.DecryptionFailureReason)
+	}
+	if original.Edited && original.Text != newBody {
+		ct.Fatalf(t, "MustDecryptEditedMessage: %s shows the wrong body for edited message %s: got %q want %q",
+			receiver.UserID(), eventID, original.Text, newBody)
+	}
+}
@@ -0,0 +1,475 @@
+package cc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/matrix-org/complement-crypto/internal/deploy"
+	"github.com/matrix-org/complement/client"
+	"github.com/tidwall/gjson"
+)
+
+// fixtureCache caches users and rooms between tests when dirty runs are enabled, as registering users and
+// creating rooms dominates the runtime of small tests. See `COMPLEMENT_ENABLE_DIRTY_RUNS`.
+//
+// Each test leases fixtures from the cache via a fixtureLease. Cached fixtures are handed out to later tests
+// which ask for the same kind of user or room, and are returned to the cache when the test ends, unless the
+// test failed or changed them. Fixtures are cached per deployment, as parallel tests lease their own deployment.
+type fixtureCache struct {
+	mu   sync.Mutex
+	free map[*deploy.ComplementCryptoDeployment]*freeFixtures
+	// used to make room aliases unique
+	aliasCounter atomic.Int64
+}
+
+type freeFixtures struct {
+	users map[userRequirements][]*cachedUser
+	rooms map[roomRequirements][]*cachedRoom
+}
+
+// userRequirements are what a test asks for when registering a user. Users with the same requirements are
+// interchangeable.
+type userRequirements struct {
+	hs              string
+	localpartSuffix string
+}
+
+type cachedUser struct {
+	reqs  userRequirements
+	csapi *client.CSAPI
+	// the user's server-side state when they were registered, see userFingerprint.
+	fingerprint string
+}
+
+// roomRequirements are what a test asks for when creating a room. Rooms with the same requirements are
+// interchangeable, once everyone but the creator has left.
+type roomRequirements struct {
+	creatorUserID string
+	// the createRoom request body, without the name which is set per test
+	createBody string
+}
+
+type cachedRoom struct {
+	reqs    roomRequirements
+	roomID  string
+	creator *client.CSAPI
+	// the room's state when it was created, see roomFingerprint.
+	fingerprint string
+	// the alias given to the room for the current test
+	alias string
+}
+
+func newFixtureCache() *fixtureCache {
+	return &fixtureCache{
+		free: make(map[*deploy.ComplementCryptoDeployment]*freeFixtures),
+	}
+}
+
+func (c *fixtureCache) freeFor(d *deploy.ComplementCryptoDeployment) *freeFixtures {
+	f := c.free[d]
+	if f == nil {
+		f = &freeFixtures{
+			users: make(map[userRequirements][]*cachedUser),
+			rooms: make(map[roomRequirements][]*cachedRoom),
+		}
+		c.free[d] = f
+	}
+	return f
+}
+
+func (c *fixtureCache) takeUser(d *deploy.ComplementCryptoDeployment, reqs userRequirements) *cachedUser {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := c.freeFor(d)
+	users := f.users[reqs]
+	if len(users) == 0 {
+		return nil
+	}
+	f.users[reqs] = users[1:]
+	return users[0]
+}
+
+func (c *fixtureCache) takeRoom(d *deploy.ComplementCryptoDeployment, reqs roomRequirements) *cachedRoom {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := c.freeFor(d)
+	rooms := f.rooms[reqs]
+	if len(rooms) == 0 {
+		return nil
+	}
+	f.rooms[reqs] = rooms[1:]
+	return rooms[0]
+}
+
+// lease returns a fixtureLease for the test, which returns fixtures to the cache when the test ends.
+func (c *fixtureCache) lease(t testing.TB, d *deploy.ComplementCryptoDeployment) *fixtureLease {
+	l := &fixtureLease{
+		cache:      c,
+		deployment: d,
+	}
+	t.Cleanup(func() {
+		l.release(t)
+	})
+	return l
+}
+
+// fixtureLease is the fixtures handed out to a single test.
+type fixtureLease struct {
+	cache       *fixtureCache
+	deployment  *deploy.ComplementCryptoDeployment
+	mu          sync.Mutex
+	users       []*cachedUser
+	rooms       []*cachedRoom
+	invalidated bool
+}
+
+// user hands out a cached user which meets the requirements, else registers a new user via register.
+func (l *fixtureLease) user(t testing.TB, hs, localpartSuffix string, register func() *client.CSAPI) *client.CSAPI {
+	t.Helper()
+	reqs := userRequirements{hs: hs, localpartSuffix: localpartSuffix}
+	u := l.cache.takeUser(l.deployment, reqs)
+	if u != nil {
+		t.Logf("fixtures: reusing user %s", u.csapi.UserID)
+	} else {
+		csapi := register()
+		fingerprint, err := userFingerprint(t, csapi)
+		if err != nil {
+			// still usable by this test, just not cached
+			t.Logf("fixtures: not caching user %s: %s", csapi.UserID, err)
+			return csapi
+		}
+		u = &cachedUser{
+			reqs:        reqs,
+			csapi:       csapi,
+			fingerprint: fingerprint,
+		}
+	}
+	l.mu.Lock()
+	l.users = append(l.users, u)
+	l.mu.Unlock()
+	return u.csapi
+}
+
+// createRoom hands out a cached room which meets the requirements, else creates a new room. Either way, the
+// room is named after the test, given a fresh alias, and everyone in the invite list is invited.
+func (l *fixtureLease) createRoom(t testing.TB, creator *client.CSAPI, reqBody map[string]any) (roomID string) {
+	t.Helper()
+	name, hasName := reqBody["name"]
+	delete(reqBody, "name")
+	createBody, err := json.Marshal(reqBody)
+	if hasName {
+		reqBody["name"] = name
+	}
+	if err != nil || !l.leased(creator) {
+		// rooms can only be reused if their creator is
+		return creator.MustCreateRoom(t, reqBody)
+	}
+	reqs := roomRequirements{
+		creatorUserID: creator.UserID,
+		createBody:    string(createBody),
+	}
+	room := l.cache.takeRoom(l.deployment, reqs)
+	if room != nil {
+		t.Logf("fixtures: reusing room %s", room.roomID)
+		creator.MustDo(t, "PUT", []string{"_matrix", "client", "v3", "rooms", room.roomID, "state", "m.room.name", ""},
+			client.WithJSONBody(t, map[string]any{"name": name}))
+		invite, _ := reqBody["invite"].([]string)
+		for _, userID := range invite {
+			creator.MustInviteRoom(t, room.roomID, userID)
+		}
+	} else {
+		roomID := creator.MustCreateRoom(t, reqBody)
+		fingerprint, _, err := roomFingerprint(t, creator, roomID)
+		if err != nil {
+			t.Logf("fixtures: not caching room %s: %s", roomID, err)
+			return roomID
+		}
+		room = &cachedRoom{
+			reqs:        reqs,
+			roomID:      roomID,
+			creator:     creator,
+			fingerprint: fingerprint,
+		}
+	}
+	room.alias = fmt.Sprintf("#%s-%d:%s", aliasLocalpart(t.Name()), l.cache.aliasCounter.Add(1), serverName(creator.UserID))
+	creator.MustDo(t, "PUT", []string{"_matrix", "client", "v3", "directory", "room", room.alias},
+		client.WithJSONBody(t, map[string]any{"room_id": room.roomID}))
+	l.mu.Lock()
+	l.rooms = append(l.rooms, room)
+	l.mu.Unlock()
+	return room.roomID
+}
+
+func (l *fixtureLease) leased(csapi *client.CSAPI) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, u := range l.users {
+		if u.csapi == csapi {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *fixtureLease) invalidate() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.invalidated = true
+}
+
+// release cleans up the fixtures used by the test, then returns them to the cache unless they were changed.
+func (l *fixtureLease) release(t testing.TB) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.users) == 0 {
+		return
+	}
+	if t.Failed() || l.invalidated {
+		t.Logf("fixtures: not reusing %d users and %d rooms, as the test failed or invalidated them", len(l.users), len(l.rooms))
+		return
+	}
+	// creators stay in the rooms they created, so the rooms can be reused
+	keepRooms := make(map[*client.CSAPI]map[string]bool)
+	for _, room := range l.rooms {
+		if keepRooms[room.creator] == nil {
+			keepRooms[room.creator] = make(map[string]bool)
+		}
+		keepRooms[room.creator][room.roomID] = true
+		// the alias was for this test only
+		room.creator.Do(t, "DELETE", []string{"_matrix", "client", "v3", "directory", "room", room.alias})
+	}
+	var freeUsers []*cachedUser
+	reusable := make(map[*client.CSAPI]bool)
+	for _, u := range l.users {
+		if err := cleanUser(t, l.deployment, u.csapi, keepRooms[u.csapi]); err != nil {
+			t.Logf("fixtures: not reusing user %s: failed to clean up: %s", u.csapi.UserID, err)
+			continue
+		}
+		fingerprint, err := userFingerprint(t, u.csapi)
+		if err != nil || fingerprint != u.fingerprint {
+			t.Logf("fixtures: not reusing user %s as the test changed them", u.csapi.UserID)
+			continue
+		}
+		freeUsers = append(freeUsers, u)
+		reusable[u.csapi] = true
+	}
+	var freeRooms []*cachedRoom
+	for _, room := range l.rooms {
+		if !reusable[room.creator] {
+			continue
+		}
+		fingerprint, othersInRoom, err := roomFingerprint(t, room.creator, room.roomID)
+		if err != nil || othersInRoom || fingerprint != room.fingerprint {
+			t.Logf("fixtures: not reusing room %s as the test changed it or other users are still in it", room.roomID)
+			continue
+		}
+		freeRooms = append(freeRooms, room)
+	}
+
+	l.cache.mu.Lock()
+	defer l.cache.mu.Unlock()
+	f := l.cache.freeFor(l.deployment)
+	for _, u := range freeUsers {
+		f.users[u.reqs] = append(f.users[u.reqs], u)
+	}
+	for _, room := range freeRooms {
+		f.rooms[room.reqs] = append(f.rooms[room.reqs], room)
+	}
+	t.Logf("fixtures: returned %d/%d users and %d/%d rooms to the cache", len(freeUsers), len(l.users), len(freeRooms), len(l.rooms))
+}
+
+// cleanUser undoes the changes every test makes to a user: leaving and forgetting rooms other than keepRooms,
+// rejecting invites, and deleting devices other than the user's own device. Deleted devices are released, so
+// later tests can log in devices with the same IDs.
+func cleanUser(t testing.TB, d *deploy.ComplementCryptoDeployment, csapi *client.CSAPI, keepRooms map[string]bool) error {
+	filter := `{"room":{"timeline":{"limit":0},"state":{"types":[]},"ephemeral":{"types":[]},"account_data":{"types":[]}},"presence":{"types":[]},"account_data":{"types":[]}}`
+	syncRes, err := getJSON(csapi.Do(t, "GET", []string{"_matrix", "client", "v3", "sync"}, client.WithQueries(url.Values{
+		"timeout": []string{"0"},
+		"filter":  []string{filter},
+	})))
+	if err != nil {
+		return fmt.Errorf("failed to sync: %s", err)
+	}
+	var leave []string
+	for _, section := range []string{"join", "invite", "knock"} {
+		syncRes.Get("rooms." + section).ForEach(func(roomID, _ gjson.Result) bool {
+			if !keepRooms[roomID.Str] {
+				leave = append(leave, roomID.Str)
+			}
+			return true
+		})
+	}
+	for _, roomID := range leave {
+		if res := csapi.LeaveRoom(t, roomID); res.StatusCode != 200 {
+			return fmt.Errorf("failed to leave %s: HTTP %d", roomID, res.StatusCode)
+		}
+		csapi.Do(t, "POST", []string{"_matrix", "client", "v3", "rooms", roomID, "forget"}, client.WithJSONBody(t, map[string]any{}))
+	}
+
+	devices, err := getJSON(csapi.Do(t, "GET", []string{"_matrix", "client", "v3", "devices"}))
+	if err != nil {
+		return fmt.Errorf("failed to get devices: %s", err)
+	}
+	var deviceIDs []string
+	for _, device := range devices.Get("devices").Array() {
+		if deviceID := device.Get("device_id").Str; deviceID != csapi.DeviceID {
+			deviceIDs = append(deviceIDs, deviceID)
+		}
+	}
+	if len(deviceIDs) == 0 {
+		return nil
+	}
+	body := map[string]any{
+		"devices": deviceIDs,
+	}
+	res := csapi.Do(t, "POST", []string{"_matrix", "client", "v3", "delete_devices"}, client.WithJSONBody(t, body))
+	if res.StatusCode == 401 {
+		uia, err := getJSON(res)
+		if err != nil {
+			return fmt.Errorf("failed to delete devices: %s", err)
+		}
+		body["auth"] = map[string]any{
+			"type": "m.login.password",
+			"identifier": map[string]any{
+				"type": "m.id.user",
+				"user": csapi.UserID,
+			},
+			"password": csapi.Password,
+			"session":  uia.Get("session").Str,
+		}
+		res = csapi.Do(t, "POST", []string{"_matrix", "client", "v3", "delete_devices"}, client.WithJSONBody(t, body))
+	}
+	if _, err := getJSON(res); err != nil {
+		return fmt.Errorf("failed to delete devices %v: %s", deviceIDs, err)
+	}
+	d.ReleaseDevices(csapi.UserID, deviceIDs)
+	return nil
+}
+
+// userFingerprint summarises the server-side state of a user which tests may change, and which would affect
+// later tests if the user were reused e.g cross-signing keys, key backups or push rules.
+func userFingerprint(t testing.TB, csapi *client.CSAPI) (string, error) {
+	var sb strings.Builder
+	res := csapi.Do(t, "GET", []string{"_matrix", "client", "v3", "account", "whoami"})
+	fmt.Fprintf(&sb, "whoami=%d\n", res.StatusCode)
+	res.Body.Close()
+	profile, err := getJSON(csapi.Do(t, "GET", []string{"_matrix", "client", "v3", "profile", csapi.UserID}))
+	if err != nil {
+		return "", fmt.Errorf("failed to get profile: %s", err)
+	}
+	fmt.Fprintf(&sb, "displayname=%s avatar_url=%s\n", profile.Get("displayname").Str, profile.Get("avatar_url").Str)
+	keys, err := getJSON(csapi.Do(t, "POST", []string{"_matrix", "client", "v3", "keys", "query"}, client.WithJSONBody(t, map[string]any{
+		"device_keys": map[string]any{
+			csapi.UserID: []string{},
+		},
+	})))
+	if err != nil {
+		return "", fmt.Errorf("failed to query keys: %s", err)
+	}
+	var devicesWithKeys []string
+	userDevices := keys.Get("device_keys").Map()[csapi.UserID]
+	userDevices.ForEach(func(deviceID, _ gjson.Result) bool {
+		devicesWithKeys = append(devicesWithKeys, deviceID.Str)
+		return true
+	})
+	sort.Strings(devicesWithKeys)
+	fmt.Fprintf(&sb, "device_keys=%v\n", devicesWithKeys)
+	fmt.Fprintf(&sb, "master_key=%s\n", keys.Get("master_keys").Map()[csapi.UserID].Raw)
+	res = csapi.Do(t, "GET", []string{"_matrix", "client", "v3", "room_keys", "version"})
+	fmt.Fprintf(&sb, "backup=%d\n", res.StatusCode)
+	res.Body.Close()
+	pushRules, err := getJSON(csapi.Do(t, "GET", []string{"_matrix", "client", "v3", "pushrules", ""}))
+	if err != nil {
+		return "", fmt.Errorf("failed to get push rules: %s", err)
+	}
+	fmt.Fprintf(&sb, "push_rules=%s\n", pushRules.Raw)
+	for _, evType := range []string{"m.secret_storage.default_key", "m.cross_signing.master", "m.megolm_backup.v1", "m.ignored_user_list", "m.direct"} {
+		res = csapi.GetGlobalAccountData(t, evType)
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		fmt.Fprintf(&sb, "%s=%d %s\n", evType, res.StatusCode, body)
+	}
+	return sb.String(), nil
+}
+
+// roomFingerprint summarises the state of a room, apart from its name and the membership of users who are
+// invited, joined or have left, so rooms which tests have changed e.g by changing the history visibility or
+// banning someone are not reused. othersInRoom is true if anyone but csapi is invited or joined.
+func roomFingerprint(t testing.TB, csapi *client.CSAPI, roomID string) (fingerprint string, othersInRoom bool, err error) {
+	state, err := getJSON(csapi.Do(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "state"}))
+	if err != nil {
+		return "", false, fmt.Errorf("failed to get state: %s", err)
+	}
+	var lines []string
+	for _, ev := range state.Array() {
+		evType := ev.Get("type").Str
+		switch evType {
+		case "m.room.name", "m.room.canonical_alias":
+			continue
+		case "m.room.member":
+			if ev.Get("state_key").Str == csapi.UserID {
+				break
+			}
+			switch ev.Get("content.membership").Str {
+			case "invite", "join":
+				othersInRoom = true
+				continue
+			case "leave":
+				continue
+			}
+		}
+		var content map[string]any
+		if err := json.Unmarshal([]byte(ev.Get("content").Raw), &content); err != nil {
+			return "", false, fmt.Errorf("failed to unmarshal %s: %s", evType, err)
+		}
+		// marshalling a map sorts the keys
+		canonical, err := json.Marshal(content)
+		if err != nil {
+			return "", false, err
+		}
+		lines = append(lines, fmt.Sprintf("%s|%s|%s", evType, ev.Get("state_key").Str, canonical))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n"), othersInRoom, nil
+}
+
+// getJSON reads the JSON body of a 200 OK response.
+func getJSON(res *http.Response) (gjson.Result, error) {
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	if res.StatusCode != 200 {
+		return gjson.Result{}, fmt.Errorf("HTTP %d: %s", res.StatusCode, body)
+	}
+	if !gjson.ValidBytes(body) {
+		return gjson.Result{}, fmt.Errorf("invalid JSON: %s", body)
+	}
+	return gjson.ParseBytes(body), nil
+}
+
+var invalidAliasChars = regexp.MustCompile(`[^a-z0-9._=-]+`)
+
+// aliasLocalpart returns a valid alias localpart based on the test name.
+func aliasLocalpart(testName string) string {
+	localpart := strings.Trim(invalidAliasChars.ReplaceAllString(strings.ToLower(testName), "-"), "-")
+	if len(localpart) > 100 {
+		localpart = localpart[len(localpart)-100:]
+	}
+	return localpart
+}
+
+func serverName(userID string) string {
+	_, server, _ := strings.Cut(userID, ":")
+	return server
+}
@@ -0,0 +1,179 @@
+package cc
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/deploy"
+	"github.com/matrix-org/complement-crypto/internal/deploy/callback"
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/ct"
+)
+
+// The maximum amount of time a /sync response can be held by WithGappySync. mitmproxy gives up on
+// callbacks after 10s, at which point the response is sent to the client unaltered.
+const maxGappySyncHoldTime = 8 * time.Second
+
+// WithGappySync holds back /sync responses for the given receivers using mitmproxy whilst `inner`
+// is called, then releases them. If `inner` causes more events to be sent in a room than the
+// receivers' sync timeline limit (20 is enough for both rust and js), the next /sync response for each
+// receiver will be limited, creating a gap in their timeline which must be filled by backpaginating.
+//
+// `inner` MUST return within 8s, as mitmproxy will not wait any longer for the held responses. Any
+// responses still held at that point are released, and the test will log a warning.
+func (c *TestContext) WithGappySync(t *testing.T, receivers []api.TestClient, inner func()) {
+	t.Helper()
+	heldAccessTokens := make(map[string]bool)
+	for _, receiver := range receivers {
+		heldAccessTokens[receiver.CurrentAccessToken(t)] = true
+	}
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	releaseFn := func() {
+		releaseOnce.Do(func() {
+			close(release)
+		})
+	}
+	defer releaseFn()
+
+	c.Deployment.MITM().Configure(t).WithIntercept(mitm.InterceptOpts{
+		Filter: mitm.FilterParams{
+			PathContains: "/sync",
+		},
+		ResponseCallback: func(cd callback.Data) *callback.Response {
+			if !heldAccessTokens[cd.AccessToken] {
+				return nil
+			}
+			select {
+			case <-release:
+			case <-time.After(maxGappySyncHoldTime):
+				t.Logf("WithGappySync: WARNING: held /sync response for longer than %v, releasing it. The sync may not be gappy.", maxGappySyncHoldTime)
+			}
+			return nil
+		},
+	}, func() {
+		start := time.Now()
+		inner()
+		if time.Since(start) > maxGappySyncHoldTime {
+			t.Logf("WithGappySync: WARNING: inner function took %v, which is longer than %v. The sync may not be gappy.", time.Since(start), maxGappySyncHoldTime)
+		}
+		releaseFn()
+		// Wait for the receivers to see the released responses before we stop intercepting. Without this,
+		// the held responses may be torn down by unlocking mitmproxy before the client has processed them.
+		time.Sleep(500 * time.Millisecond)
+	})
+}
+
+// The number of events WithLimitedSync floods the room with, which is more than the sync timeline limit of
+// both rust and js.
+const limitedSyncFloodSize = 30
+
+// How long WithLimitedSync holds each /sync response for. The flood must be sent within this time.
+const limitedSyncDelay = 3 * time.Second
+
+// WithLimitedSync forces the receiver's next /sync response for the room to be limited, with anything sent in
+// `inner` in the gap. This works by delaying the receiver's /sync responses whilst `inner` is called, then flooding
+// the room with unencrypted events from flooder. The receiver only sees events sent in `inner` by backpaginating,
+// but to-device messages sent in `inner` (e.g room keys) are still delivered in the limited /sync response.
+// Returns the event IDs of the flood, in the order they were sent.
+//
+// Unlike WithGappySync, this does not intercept requests, so it can be used with MITM().Configure, and `inner`
+// can take longer than 8s, at the cost of a less precise gap.
+func (c *TestContext) WithLimitedSync(t *testing.T, receiver api.TestClient, flooder *User, roomID string, inner func()) (floodEventIDs []string) {
+	t.Helper()
+	sendFlood := func(i int) {
+		floodEventIDs = append(floodEventIDs, flooder.Unsafe_SendEventUnsynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    fmt.Sprintf("WithLimitedSync flood %d", i),
+			},
+		}))
+	}
+	c.Deployment.DelayEndpoint(t, deploy.DelaySpec{
+		Endpoint:    "/sync",
+		AccessToken: receiver.CurrentAccessToken(t),
+		Delay:       limitedSyncDelay,
+	}, func() {
+		// wake up any long-polling /sync so its response is held, else the events sent in inner may be
+		// returned straight away, before the gap.
+		sendFlood(0)
+		inner()
+		start := time.Now()
+		for i := 1; i < limitedSyncFloodSize; i++ {
+			sendFlood(i)
+		}
+		if time.Since(start) > limitedSyncDelay {
+			t.Logf("WithLimitedSync: WARNING: flooding took %v, which is longer than %v. The sync may not be limited.", time.Since(start), limitedSyncDelay)
+		}
+	})
+	return floodEventIDs
+}
+
+// MustHaveConsistentTimelines asserts that all the clients see the given events in the given order, and that
+// they all agree on whether each event could be decrypted and what its text was. Events in eventIDs must be
+// in the order they were sent. Other events in the timeline are ignored, as clients differ in which events
+// they display.
+//
+// This is useful after creating a gap with WithGappySync and then backpaginating, as divergences in ordering
+// can mask or create phantom unable-to-decrypt errors.
+func MustHaveConsistentTimelines(t *testing.T, roomID string, eventIDs []string, clients ...api.TestClient) {
+	t.Helper()
+	var want []*api.Event
+	for i, client := range clients {
+		got := timelineSubset(client.MustGetTimeline(t, roomID), eventIDs)
+		if len(got) != len(eventIDs) {
+			ct.Fatalf(t, "MustHaveConsistentTimelines: %s (%s) has %d/%d events in the timeline. Got %v want %v",
+				client.UserID(), client.Type(), len(got), len(eventIDs), eventIDsOf(got), eventIDs)
+		}
+		for j := range got {
+			if got[j].ID != eventIDs[j] {
+				ct.Fatalf(t, "MustHaveConsistentTimelines: %s (%s) has events out of order. Got %v want %v",
+					client.UserID(), client.Type(), eventIDsOf(got), eventIDs)
+			}
+		}
+		if i == 0 {
+			want = got
+			continue
+		}
+		for j := range got {
+			if got[j].FailedToDecrypt != want[j].FailedToDecrypt {
+				ct.Errorf(t, "MustHaveConsistentTimelines: event %s: %s (%s) FailedToDecrypt=%v but %s (%s) FailedToDecrypt=%v",
+					eventIDs[j], client.UserID(), client.Type(), got[j].FailedToDecrypt,
+					clients[0].UserID(), clients[0].Type(), want[j].FailedToDecrypt)
+			}
+			if got[j].Text != want[j].Text {
+				ct.Errorf(t, "MustHaveConsistentTimelines: event %s: %s (%s) has text '%s' but %s (%s) has text '%s'",
+					eventIDs[j], client.UserID(), client.Type(), got[j].Text,
+					clients[0].UserID(), clients[0].Type(), want[j].Text)
+			}
+		}
+	}
+}
+
+// timelineSubset returns the events in the timeline which are in eventIDs, in timeline order.
+func timelineSubset(timeline []*api.Event, eventIDs []string) []*api.Event {
+	wanted := make(map[string]bool, len(eventIDs))
+	for _, eventID := range eventIDs {
+		wanted[eventID] = true
+	}
+	var subset []*api.Event
+	for _, ev := range timeline {
+		if wanted[ev.ID] {
+			subset = append(subset, ev)
+		}
+	}
+	return subset
+}
+
+func eventIDsOf(events []*api.Event) []string {
+	ids := make([]string, len(events))
+	for i := range events {
+		ids[i] = events[i].ID
+	}
+	return ids
+}
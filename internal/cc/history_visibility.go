@@ -0,0 +1,92 @@
+package cc
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement/ct"
+)
+
+// The values of history_visibility in m.room.history_visibility.
+const (
+	HistoryVisibilityWorldReadable = "world_readable"
+	HistoryVisibilityShared        = "shared"
+	HistoryVisibilityInvited       = "invited"
+	HistoryVisibilityJoined        = "joined"
+)
+
+// PreJoinHistory is what a user who is invited to an encrypted room and then joins it should see of the
+// messages sent before they joined, for a given history visibility.
+type PreJoinHistory struct {
+	HistoryVisibility string
+	// True if messages sent before the user was invited are returned by the server. They can never be decrypted,
+	// as nobody shares room keys with users who are not in the room.
+	SeesBeforeInvite bool
+	// True if messages sent whilst the user was invited are returned by the server. They can be decrypted, as
+	// senders share room keys with invited users unless the history visibility is joined.
+	SeesWhileInvited bool
+}
+
+// PreJoinHistories is the expected PreJoinHistory for every history visibility, for use with MustHavePreJoinHistory.
+var PreJoinHistories = []PreJoinHistory{
+	{HistoryVisibility: HistoryVisibilityWorldReadable, SeesBeforeInvite: true, SeesWhileInvited: true},
+	{HistoryVisibility: HistoryVisibilityShared, SeesBeforeInvite: true, SeesWhileInvited: true},
+	{HistoryVisibility: HistoryVisibilityInvited, SeesBeforeInvite: false, SeesWhileInvited: true},
+	{HistoryVisibility: HistoryVisibilityJoined, SeesBeforeInvite: false, SeesWhileInvited: false},
+}
+
+// The number of times to backpaginate when looking for an event, and how many events to ask for each time.
+const (
+	maxBackpaginations   = 5
+	backpaginationAmount = 10
+)
+
+// MustHavePreJoinHistory backpaginates as the joiner, then fails the test unless the messages sent before the
+// joiner was invited and whilst they were invited are visible and decryptable as described by want.
+func MustHavePreJoinHistory(t *testing.T, joiner api.TestClient, roomID, beforeInviteEventID, whileInvitedEventID string, want PreJoinHistory) {
+	t.Helper()
+	if want.SeesBeforeInvite {
+		ev := MustBackpaginateToEvent(t, joiner, roomID, beforeInviteEventID)
+		if !ev.FailedToDecrypt {
+			ct.Fatalf(t, "MustHavePreJoinHistory(%s): %s decrypted a message sent before they were invited: %+v", want.HistoryVisibility, joiner.UserID(), ev)
+		}
+	} else {
+		MustNotBackpaginateToEvent(t, joiner, roomID, beforeInviteEventID)
+	}
+	if want.SeesWhileInvited {
+		ev := MustBackpaginateToEvent(t, joiner, roomID, whileInvitedEventID)
+		if ev.FailedToDecrypt {
+			ct.Fatalf(t, "MustHavePreJoinHistory(%s): %s could not decrypt a message sent whilst they were invited: %+v", want.HistoryVisibility, joiner.UserID(), ev)
+		}
+	} else {
+		MustNotBackpaginateToEvent(t, joiner, roomID, whileInvitedEventID)
+	}
+}
+
+// MustBackpaginateToEvent backpaginates until the event is in the client's timeline, then returns it, else fails
+// the test.
+func MustBackpaginateToEvent(t *testing.T, client api.TestClient, roomID, eventID string) *api.Event {
+	t.Helper()
+	for i := 0; i < maxBackpaginations; i++ {
+		for _, ev := range client.MustBackpaginate(t, roomID, backpaginationAmount) {
+			if ev.ID == eventID {
+				return ev
+			}
+		}
+	}
+	ct.Fatalf(t, "MustBackpaginateToEvent: %s did not see %s after backpaginating %d times", client.UserID(), eventID, maxBackpaginations)
+	return nil
+}
+
+// MustNotBackpaginateToEvent backpaginates as far as possible, then fails the test if the event is in the client's
+// timeline.
+func MustNotBackpaginateToEvent(t *testing.T, client api.TestClient, roomID, eventID string) {
+	t.Helper()
+	for i := 0; i < maxBackpaginations; i++ {
+		for _, ev := range client.MustBackpaginate(t, roomID, backpaginationAmount) {
+			if ev.ID == eventID {
+				ct.Fatalf(t, "MustNotBackpaginateToEvent: %s saw %s after backpaginating, but should not be able to see it", client.UserID(), eventID)
+			}
+		}
+	}
+}
@@ -2,13 +2,19 @@ package cc
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 
 	"github.com/matrix-org/complement"
 	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/api/js/chrome"
 	"github.com/matrix-org/complement-crypto/internal/config"
 	"github.com/matrix-org/complement-crypto/internal/deploy"
+	"github.com/matrix-org/complement-crypto/internal/deploy/js"
+	"github.com/matrix-org/complement-crypto/internal/logging"
+	"github.com/matrix-org/complement-crypto/internal/report"
 )
 
 // Instance represents a test instance.
@@ -19,18 +25,45 @@ type Instance struct {
 	ssDeployment           *deploy.ComplementCryptoDeployment
 	ssMutex                *sync.Mutex
 	complementCryptoConfig *config.ComplementCrypto
+	// deployments leased by parallel tests, see Instance.Parallel
+	pool *deploymentPool
+	// created on first use, as flags are not parsed until tests run
+	report *report.TestReport
+	// message delivery latency across all tests
+	delivery *report.DeliveryTracker
+	// SDK pairs which have already failed a test for exceeding the maximum delivery latency
+	slowDeliveryPairs map[string]bool
+	// users and rooms reused between tests, nil unless dirty runs are enabled
+	fixtures *fixtureCache
 }
 
 func NewInstance(cfg *config.ComplementCrypto) *Instance {
-	return &Instance{
+	api.SetWaiterConfig(cfg.WaiterConfig())
+	deploy.SetIDNamespace(deploy.NewIDNamespace(cfg.IDNonce))
+	i := &Instance{
 		ssMutex:                &sync.Mutex{},
 		complementCryptoConfig: cfg,
+		pool:                   newDeploymentPool(cfg.DeploymentPoolSize),
+		delivery:               report.NewDeliveryTracker(),
+		slowDeliveryPairs:      make(map[string]bool),
 	}
+	if cfg.EnableDirtyRuns {
+		i.fixtures = newFixtureCache()
+	}
+	return i
 }
 
 // TestMain is the entry point for running a test suite with this Instance.
 // The function signature matches the standard Go test suite TestMain()
 func (i *Instance) TestMain(m *testing.M, namespace string) {
+	cfg := i.complementCryptoConfig
+	if cfg.JSSDK != "" && cfg.ShouldTest(api.ClientTypeJS) {
+		distDir, err := js.Install(cfg.JSSDK, filepath.Join(os.TempDir(), "complement-crypto-js-sdk"))
+		if err != nil {
+			panic("COMPLEMENT_CRYPTO_JS_SDK: " + err.Error())
+		}
+		chrome.SetDistDirectory(distDir)
+	}
 	// Execute PreTestRun lifecycle hook
 	for _, binding := range i.complementCryptoConfig.Bindings() {
 		binding.PreTestRun("")
@@ -43,6 +76,8 @@ func (i *Instance) TestMain(m *testing.M, namespace string) {
 			i.ssDeployment.Teardown()
 		}
 		i.ssMutex.Unlock()
+		i.pool.teardown()
+		i.reportDeliveryLatency()
 		// Execute PostTestRun lifecycle hook
 		for _, binding := range i.complementCryptoConfig.Bindings() {
 			binding.PostTestRun("")
@@ -51,20 +86,36 @@ func (i *Instance) TestMain(m *testing.M, namespace string) {
 }
 
 // Deploy all backend servers if they do not already exist. Calling this multiple
-// times will return the same deployment.
+// times will return the same deployment, unless the test has leased a deployment
+// via Instance.Parallel, in which case that deployment is returned.
 //
 // Tests will rarely use this function directly, preferring to use TestContext.
 // See Instance.CreateTestContext
-func (i *Instance) Deploy(t *testing.T) *deploy.ComplementCryptoDeployment {
+func (i *Instance) Deploy(t testing.TB) *deploy.ComplementCryptoDeployment {
+	if leased := i.pool.leased(t); leased != nil {
+		return leased
+	}
 	i.ssMutex.Lock()
 	defer i.ssMutex.Unlock()
 	if i.ssDeployment != nil {
 		return i.ssDeployment
 	}
-	i.ssDeployment = deploy.RunNewDeployment(t, i.complementCryptoConfig.MITMProxyAddonsDir, i.complementCryptoConfig.MITMDump)
+	i.ssDeployment = deploy.RunNewDeployment(
+		t, i.complementCryptoConfig.NumHomeservers, i.complementCryptoConfig.MITMProxyAddonsDir, i.complementCryptoConfig.MITMDump,
+	)
 	return i.ssDeployment
 }
 
+// RequireHomeservers skips the test unless at least n homeservers are deployed, as configured by
+// `COMPLEMENT_CRYPTO_NUM_HOMESERVERS`. Returns the names of the first n homeservers e.g "hs1", "hs2", "hs3".
+func (i *Instance) RequireHomeservers(t *testing.T, n int) []string {
+	t.Helper()
+	if i.complementCryptoConfig.NumHomeservers < n {
+		t.Skipf("test requires %d homeservers but COMPLEMENT_CRYPTO_NUM_HOMESERVERS=%d", n, i.complementCryptoConfig.NumHomeservers)
+	}
+	return i.Deploy(t).HomeserverNames()[:n]
+}
+
 // ClientTypeMatrix enumerates all provided client permutations given by the test client
 // matrix `COMPLEMENT_CRYPTO_TEST_CLIENT_MATRIX`. Creates sub-tests for each permutation
 // and invokes `subTest`. Sub-tests are run in series.
@@ -77,15 +128,98 @@ func (i *Instance) ClientTypeMatrix(t *testing.T, subTest func(t *testing.T, cli
 	}
 }
 
+// BackupAlgorithmMatrix enumerates all provided client permutations given by the test client matrix
+// `COMPLEMENT_CRYPTO_TEST_CLIENT_MATRIX` for each key backup algorithm given by
+// `COMPLEMENT_CRYPTO_BACKUP_ALGORITHMS`. Creates sub-tests for each combination and invokes `subTest`.
+// Sub-tests are run in series. Tests should set TestContext.BackupAlgorithm so clients create backups
+// with the algorithm.
+func (i *Instance) BackupAlgorithmMatrix(t *testing.T, subTest func(t *testing.T, clientTypeA, clientTypeB api.ClientType, algorithm api.BackupAlgorithm)) {
+	i.ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		for _, algorithm := range i.complementCryptoConfig.BackupAlgorithms {
+			algorithm := algorithm
+			t.Run(string(algorithm), func(t *testing.T) {
+				subTest(t, clientTypeA, clientTypeB, algorithm)
+			})
+		}
+	})
+}
+
+// SlidingSyncModeMatrix enumerates all provided client permutations given by the test client matrix
+// `COMPLEMENT_CRYPTO_TEST_CLIENT_MATRIX` for each sliding sync mode given by `COMPLEMENT_CRYPTO_SLIDING_SYNC_MODES`.
+// Creates sub-tests for each combination and invokes `subTest`. Sub-tests are run in series. Only rust clients do
+// sliding sync, so permutations without a rust client are only run once. Tests should set TestContext.SlidingSyncMode
+// so rust clients sync in that mode.
+func (i *Instance) SlidingSyncModeMatrix(t *testing.T, subTest func(t *testing.T, clientTypeA, clientTypeB api.ClientType, mode api.SlidingSyncMode)) {
+	i.ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		modes := i.complementCryptoConfig.SlidingSyncModes
+		if clientTypeA.Lang != api.ClientTypeRust && clientTypeB.Lang != api.ClientTypeRust {
+			modes = modes[:1]
+		}
+		for _, mode := range modes {
+			mode := mode
+			t.Run(string(mode), func(t *testing.T) {
+				subTest(t, clientTypeA, clientTypeB, mode)
+			})
+		}
+	})
+}
+
+// StoreBackendMatrix enumerates all provided client permutations given by the test client matrix
+// `COMPLEMENT_CRYPTO_TEST_CLIENT_MATRIX` for each combination of store backends given by
+// `COMPLEMENT_CRYPTO_STORE_BACKENDS` which the two clients support. Creates sub-tests for each combination named
+// after the backends e.g "sqlite|indexeddb", and invokes `subTest`. Sub-tests are run in series. Clients which support
+// none of the backends use their default backend. Tests should set User.StoreBackend so clients use the backends.
+func (i *Instance) StoreBackendMatrix(t *testing.T, subTest func(t *testing.T, clientTypeA, clientTypeB api.ClientType, backendA, backendB api.StoreBackend)) {
+	i.ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		for _, backendA := range i.complementCryptoConfig.StoreBackendsFor(clientTypeA.Lang) {
+			for _, backendB := range i.complementCryptoConfig.StoreBackendsFor(clientTypeB.Lang) {
+				backendA, backendB := backendA, backendB
+				t.Run(fmt.Sprintf("%s|%s", storeBackendName(backendA), storeBackendName(backendB)), func(t *testing.T) {
+					subTest(t, clientTypeA, clientTypeB, backendA, backendB)
+				})
+			}
+		}
+	})
+}
+
+func storeBackendName(backend api.StoreBackend) string {
+	if backend == api.StoreBackendDefault {
+		return "default"
+	}
+	return string(backend)
+}
+
 // ShouldTest returns true if this language should be tested.
 func (i *Instance) ShouldTest(lang api.ClientTypeLang) bool {
 	return i.complementCryptoConfig.ShouldTest(lang)
 }
 
+// LibfaketimePath returns the path to libfaketime on the host, for use with NewHomeserverWithClockSkew, as
+// configured by `COMPLEMENT_CRYPTO_LIBFAKETIME`. Skips the test if it is not set.
+func (i *Instance) LibfaketimePath(t *testing.T) string {
+	t.Helper()
+	if i.complementCryptoConfig.LibfaketimePath == "" {
+		t.Skipf("COMPLEMENT_CRYPTO_LIBFAKETIME not set, cannot skew homeserver clocks")
+	}
+	return i.complementCryptoConfig.LibfaketimePath
+}
+
+// RoomKeyFixturesDir returns the directory to write room key export fixtures to, as configured by
+// `COMPLEMENT_CRYPTO_ROOM_KEY_FIXTURES_DIR`. Skips the test if it is not set.
+func (i *Instance) RoomKeyFixturesDir(t *testing.T) string {
+	t.Helper()
+	if i.complementCryptoConfig.RoomKeyFixturesDir == "" {
+		t.Skipf("COMPLEMENT_CRYPTO_ROOM_KEY_FIXTURES_DIR not set, not generating room key fixtures")
+	}
+	return i.complementCryptoConfig.RoomKeyFixturesDir
+}
+
 // ForEachClientType enumerates all known client implementations and creates sub-tests for
 // each. Sub-tests are run in series. Always defaults to `hs1`.
 func (i *Instance) ForEachClientType(t *testing.T, subTest func(t *testing.T, clientType api.ClientType)) {
-	for _, tc := range []api.ClientType{{Lang: api.ClientTypeRust, HS: "hs1"}, {Lang: api.ClientTypeJS, HS: "hs1"}} {
+	for _, tc := range []api.ClientType{
+		{Lang: api.ClientTypeRust, HS: "hs1"}, {Lang: api.ClientTypeJS, HS: "hs1"}, {Lang: api.ClientTypeNio, HS: "hs1"},
+	} {
 		tc := tc
 		if !i.complementCryptoConfig.ShouldTest(tc.Lang) {
 			continue
@@ -105,11 +239,41 @@ func (i *Instance) ForEachClientType(t *testing.T, subTest func(t *testing.T, cl
 // You can then either login individual users using testContext.MustLoginClient or use the helper functions
 // testContext.WithAliceAndBobSyncing which will automatically create js/rust clients and start sync loops
 // for you, along with handling cleanup.
-func (i *Instance) CreateTestContext(t *testing.T, clientType ...api.ClientType) *TestContext {
+//
+// The test is skipped if a homeserver cannot run the given clients, e.g rust clients need sliding sync.
+//
+// If `COMPLEMENT_ENABLE_DIRTY_RUNS` is set, users and rooms may be reused from earlier tests, see
+// TestContext.InvalidateFixtures.
+func (i *Instance) CreateTestContext(t testing.TB, clientType ...api.ClientType) *TestContext {
+	logging.Capture(t, i.complementCryptoConfig.LogArtifactsDir)
 	deployment := i.Deploy(t)
+	for _, typ := range clientType {
+		if typ.Lang == api.ClientTypeRust {
+			deployment.RequireCapabilities(t, typ.HS, deploy.CapabilitySlidingSync)
+		}
+	}
+	if i.complementCryptoConfig.TrafficRecordingsDir != "" {
+		deployment.RecordTrafficIfFailed(t, i.complementCryptoConfig.TrafficRecordingsDir)
+	}
+	if i.complementCryptoConfig.MemoryBudgetMiB > 0 {
+		monitorMemory(t, i.complementCryptoConfig.MemoryBudgetMiB, i.complementCryptoConfig.FailOverMemoryBudget)
+	}
 	tc := &TestContext{
-		Deployment:    deployment,
-		RPCBinaryPath: i.complementCryptoConfig.RPCBinaryPath,
+		Deployment:         deployment,
+		RPCBinaryPath:      i.complementCryptoConfig.RPCBinaryPath,
+		ffiWatchdogTimeout: i.complementCryptoConfig.FFIWatchdogTimeout,
+		failOnFFILeaks:     i.complementCryptoConfig.FailOnFFILeaks,
+		encryptStateEvents: i.complementCryptoConfig.EncryptedStateEvents,
+		deliveryTracker:    i.delivery,
+	}
+	if rep := i.testReport(); rep != nil {
+		tc.decryptionTracker = collectTestStats(t, rep, deployment)
+	}
+	if i.complementCryptoConfig.MaxDeliveryLatencyP95 > 0 {
+		i.checkDeliveryLatency(t, i.complementCryptoConfig.MaxDeliveryLatencyP95)
+	}
+	if i.fixtures != nil {
+		tc.fixtures = i.fixtures.lease(t, deployment)
 	}
 	// pre-register alice and bob, if told
 	if len(clientType) > 0 {
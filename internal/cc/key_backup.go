@@ -0,0 +1,77 @@
+package cc
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/complement/client"
+	"github.com/tidwall/gjson"
+)
+
+// These functions allow tests to tamper with the server-side key backup for a user, without going through
+// an SDK. This is useful to test how clients behave when the backup is deleted or rotated by another device.
+
+// GetKeyBackupVersion returns the current key backup version for this user on the server, or the empty
+// string if there is no key backup.
+func (u *User) GetKeyBackupVersion(t *testing.T) (version string, err error) {
+	t.Helper()
+	res := u.Do(t, "GET", []string{"_matrix", "client", "v3", "room_keys", "version"})
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	body, err := keyBackupResponseBody(res)
+	if err != nil {
+		return "", fmt.Errorf("GetKeyBackupVersion: %s", err)
+	}
+	return gjson.GetBytes(body, "version").Str, nil
+}
+
+// CreateKeyBackup creates a new key backup version for this user on the server, which becomes the current
+// version. The backup uses a random public key, so clients will not have the private key for it.
+// Returns the new backup version.
+func (u *User) CreateKeyBackup(t *testing.T) (version string, err error) {
+	t.Helper()
+	publicKey := make([]byte, 32)
+	if _, err := rand.Read(publicKey); err != nil {
+		return "", fmt.Errorf("CreateKeyBackup: failed to generate public key: %s", err)
+	}
+	res := u.Do(t, "POST", []string{"_matrix", "client", "v3", "room_keys", "version"}, client.WithJSONBody(t, map[string]any{
+		"algorithm": "m.megolm_backup.v1.curve25519-aes-sha2",
+		"auth_data": map[string]any{
+			"public_key": base64.RawStdEncoding.EncodeToString(publicKey),
+		},
+	}))
+	body, err := keyBackupResponseBody(res)
+	if err != nil {
+		return "", fmt.Errorf("CreateKeyBackup: %s", err)
+	}
+	return gjson.GetBytes(body, "version").Str, nil
+}
+
+// DeleteKeyBackup deletes the given key backup version for this user on the server, including all the
+// keys stored in it.
+func (u *User) DeleteKeyBackup(t *testing.T, version string) error {
+	t.Helper()
+	res := u.Do(t, "DELETE", []string{"_matrix", "client", "v3", "room_keys", "version", version})
+	if _, err := keyBackupResponseBody(res); err != nil {
+		return fmt.Errorf("DeleteKeyBackup(%s): %s", version, err)
+	}
+	return nil
+}
+
+func keyBackupResponseBody(res *http.Response) ([]byte, error) {
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %s", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned HTTP %d: %s", res.StatusCode, string(body))
+	}
+	return body, nil
+}
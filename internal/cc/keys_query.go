@@ -0,0 +1,166 @@
+package cc
+
+import (
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+)
+
+// DeviceKeys are the keys of a single device, as returned by /keys/query.
+type DeviceKeys struct {
+	UserID     string   `json:"user_id"`
+	DeviceID   string   `json:"device_id"`
+	Algorithms []string `json:"algorithms"`
+	// Key ID e.g ed25519:DEVICEID => public key
+	Keys map[string]string `json:"keys"`
+	// User ID => key ID => signature
+	Signatures map[string]map[string]string `json:"signatures"`
+}
+
+// CrossSigningKey is a master, self-signing or user-signing key, as returned by /keys/query.
+type CrossSigningKey struct {
+	UserID string   `json:"user_id"`
+	Usage  []string `json:"usage"`
+	// Key ID e.g ed25519:<public key> => public key
+	Keys map[string]string `json:"keys"`
+	// User ID => key ID => signature
+	Signatures map[string]map[string]string `json:"signatures"`
+}
+
+// KeyID returns the ID of the cross-signing key e.g ed25519:<public key>, or the empty string if k is nil.
+func (k *CrossSigningKey) KeyID() string {
+	if k == nil {
+		return ""
+	}
+	for keyID := range k.Keys {
+		return keyID
+	}
+	return ""
+}
+
+// UserKeys are all the keys the server returned for a single user. Cross-signing keys are nil if the server
+// did not return them e.g user-signing keys are only returned to the user who owns them.
+type UserKeys struct {
+	UserID         string
+	Devices        map[string]DeviceKeys
+	MasterKey      *CrossSigningKey
+	SelfSigningKey *CrossSigningKey
+	UserSigningKey *CrossSigningKey
+}
+
+// Signature is a signature on a device key or cross-signing key.
+type Signature struct {
+	// The key which was signed e.g ed25519:DEVICEID for a device, or ed25519:<public key> for a cross-signing key.
+	SignedKeyID  string
+	SignerUserID string
+	// The key which made the signature e.g ed25519:DEVICEID for a device, or ed25519:<public key> for a
+	// cross-signing key.
+	SignerKeyID string
+}
+
+// Signatures returns every signature on every key of the user, sorted. This includes devices signing their own keys.
+func (k *UserKeys) Signatures() []Signature {
+	var sigs []Signature
+	add := func(signedKeyID string, signatures map[string]map[string]string) {
+		for signerUserID, signerKeys := range signatures {
+			for signerKeyID := range signerKeys {
+				sigs = append(sigs, Signature{
+					SignedKeyID:  signedKeyID,
+					SignerUserID: signerUserID,
+					SignerKeyID:  signerKeyID,
+				})
+			}
+		}
+	}
+	for deviceID, device := range k.Devices {
+		add("ed25519:"+deviceID, device.Signatures)
+	}
+	for _, key := range []*CrossSigningKey{k.MasterKey, k.SelfSigningKey, k.UserSigningKey} {
+		if key != nil {
+			add(key.KeyID(), key.Signatures)
+		}
+	}
+	sortSignatures(sigs)
+	return sigs
+}
+
+// HasSignature returns true if the user's keys include the signature.
+func (k *UserKeys) HasSignature(sig Signature) bool {
+	for _, s := range k.Signatures() {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
+
+// DiffSignatures returns the signatures which are in after but not before, and the signatures which are in before
+// but not after, both sorted. Use this with UserKeys.Signatures to assert exactly which signatures an operation made.
+func DiffSignatures(before, after []Signature) (added, removed []Signature) {
+	inBefore := make(map[Signature]bool, len(before))
+	for _, sig := range before {
+		inBefore[sig] = true
+	}
+	inAfter := make(map[Signature]bool, len(after))
+	for _, sig := range after {
+		inAfter[sig] = true
+		if !inBefore[sig] {
+			added = append(added, sig)
+		}
+	}
+	for _, sig := range before {
+		if !inAfter[sig] {
+			removed = append(removed, sig)
+		}
+	}
+	sortSignatures(added)
+	sortSignatures(removed)
+	return added, removed
+}
+
+func sortSignatures(sigs []Signature) {
+	sort.Slice(sigs, func(i, j int) bool {
+		if sigs[i].SignedKeyID != sigs[j].SignedKeyID {
+			return sigs[i].SignedKeyID < sigs[j].SignedKeyID
+		}
+		if sigs[i].SignerUserID != sigs[j].SignerUserID {
+			return sigs[i].SignerUserID < sigs[j].SignerUserID
+		}
+		return sigs[i].SignerKeyID < sigs[j].SignerKeyID
+	})
+}
+
+// MustQueryKeys calls /keys/query as this user for all of the devices and cross-signing keys of userID, else
+// fails the test. This is what the server says, regardless of what any client believes, so it can be used to
+// check which signatures were uploaded.
+func (u *User) MustQueryKeys(t *testing.T, userID string) *UserKeys {
+	t.Helper()
+	res := u.MustDo(t, "POST", []string{"_matrix", "client", "v3", "keys", "query"}, client.WithJSONBody(t, map[string]any{
+		"device_keys": map[string]any{
+			userID: []string{},
+		},
+	}))
+	var body struct {
+		DeviceKeys      map[string]map[string]DeviceKeys `json:"device_keys"`
+		MasterKeys      map[string]*CrossSigningKey      `json:"master_keys"`
+		SelfSigningKeys map[string]*CrossSigningKey      `json:"self_signing_keys"`
+		UserSigningKeys map[string]*CrossSigningKey      `json:"user_signing_keys"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		ct.Fatalf(t, "MustQueryKeys: failed to parse /keys/query response: %s", err)
+	}
+	keys := &UserKeys{
+		UserID:         userID,
+		Devices:        body.DeviceKeys[userID],
+		MasterKey:      body.MasterKeys[userID],
+		SelfSigningKey: body.SelfSigningKeys[userID],
+		UserSigningKey: body.UserSigningKeys[userID],
+	}
+	if keys.Devices == nil {
+		keys.Devices = make(map[string]DeviceKeys)
+	}
+	return keys
+}
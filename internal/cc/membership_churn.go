@@ -0,0 +1,284 @@
+package cc
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/must"
+)
+
+// MembershipChurnOpts configures MustChurnMembership.
+type MembershipChurnOpts struct {
+	// The number of times churners join and leave the room. Defaults to 5.
+	Rounds int
+	// The number of messages which must be sent after the sender has seen every membership change in a round,
+	// before the next round starts. Defaults to 2.
+	MessagesPerRound int
+	// Picks which churners join or leave in each round. Defaults to the current time. The seed is logged, so a
+	// failing run can be repeated.
+	Seed int64
+}
+
+// ChurnedMessage is a message sent by MustChurnMembership whilst the membership of the room was not changing.
+type ChurnedMessage struct {
+	EventID string
+	Body    string
+	// The user IDs of the churners who were joined to the room when the message was sent.
+	Members map[string]bool
+}
+
+// churnerMembership is the current membership of a churner, according to the server.
+type churnerMembership struct {
+	membership string
+	eventID    string
+}
+
+// MustChurnMembership rapidly joins and leaves churners to and from the room, whilst senderClient keeps sending
+// messages into it, else fails the test. This is a stress test for how clients rotate room keys: use
+// MustOnlyDecryptMessagesSentWhilstJoined to check the result.
+//
+// In each round, a random set of churners joins or leaves the room all at once. Once the sender has seen every
+// membership change in its timeline, so knows who is in the room, MessagesPerRound messages are sent before the next
+// round. After the last round every churner joins the room, so they can all see the history of the room.
+//
+// The sender sends messages the entire time, but only messages sent from start to finish whilst the membership of
+// the room was not changing are returned, as it is unclear who should be able to decrypt the others. The room must
+// have a join rule of public so churners can join without being invited, and a history visibility of shared so
+// churners can see messages sent before they joined. `sender` must be in the room for the entire time.
+func MustChurnMembership(t *testing.T, roomID string, sender *User, senderClient api.TestClient, churners []*User, opts MembershipChurnOpts) []ChurnedMessage {
+	t.Helper()
+	if opts.Rounds == 0 {
+		opts.Rounds = 5
+	}
+	if opts.MessagesPerRound == 0 {
+		opts.MessagesPerRound = 2
+	}
+	if opts.Seed == 0 {
+		opts.Seed = time.Now().UnixNano()
+	}
+	t.Logf("MustChurnMembership: churning %d users for %d rounds with seed %d", len(churners), opts.Rounds, opts.Seed)
+	rng := rand.New(rand.NewSource(opts.Seed))
+
+	var mu sync.Mutex
+	round := -1 // -1 whilst the membership of the room is changing
+	var members map[string]bool
+	var messages []ChurnedMessage
+	var sendErr error
+	sentThisRound := 0
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			mu.Lock()
+			startRound := round
+			mu.Unlock()
+			body := fmt.Sprintf("MustChurnMembership message %d from %s", i, senderClient.UserID())
+			// Must functions cannot be called outside the test goroutine, so return errors instead.
+			eventID, err := senderClient.SendMessage(t, roomID, body)
+			mu.Lock()
+			if err != nil {
+				sendErr = fmt.Errorf("%s: %s", body, err)
+				mu.Unlock()
+				return
+			}
+			if startRound != -1 && startRound == round {
+				messages = append(messages, ChurnedMessage{
+					EventID: eventID,
+					Body:    body,
+					Members: members,
+				})
+				sentThisRound++
+			}
+			mu.Unlock()
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	current := mustGetChurnerMemberships(t, roomID, sender, churners)
+	for r := 0; r <= opts.Rounds; r++ {
+		mu.Lock()
+		round = -1
+		mu.Unlock()
+		lastRound := r == opts.Rounds
+		var changed []*User
+		for _, churner := range churners {
+			joined := current[churner.UserID].membership == "join"
+			if (lastRound && !joined) || (!lastRound && rng.Intn(2) == 0) {
+				changed = append(changed, churner)
+			}
+		}
+		mustChangeMemberships(t, roomID, serverName(sender.UserID), changed, current)
+
+		// wait for the sender to see every change, else it may share keys with the old membership of the room
+		current = mustGetChurnerMemberships(t, roomID, sender, churners)
+		joined := make(map[string]bool)
+		for _, churner := range churners {
+			if current[churner.UserID].membership == "join" {
+				joined[churner.UserID] = true
+			}
+		}
+		for _, churner := range changed {
+			senderClient.WaitUntilEventInRoom(t, roomID, api.CheckEventHasEventID(current[churner.UserID].eventID)).Waitf(
+				t, 10*time.Second, "MustChurnMembership: round %d: %s did not see %s %s", r, senderClient.UserID(), churner.UserID, current[churner.UserID].membership,
+			)
+		}
+		t.Logf("MustChurnMembership: round %d: %d churners changed membership, %d/%d joined", r, len(changed), len(joined), len(churners))
+
+		mu.Lock()
+		round = r
+		members = joined
+		sentThisRound = 0
+		mu.Unlock()
+		deadline := time.Now().Add(30 * time.Second)
+		for {
+			mu.Lock()
+			sent, err := sentThisRound, sendErr
+			mu.Unlock()
+			if err != nil {
+				ct.Fatalf(t, "MustChurnMembership: %s failed to send a message: %s", senderClient.UserID(), err)
+			}
+			if sent >= opts.MessagesPerRound {
+				break
+			}
+			if time.Now().After(deadline) {
+				ct.Fatalf(t, "MustChurnMembership: round %d: %s only sent %d/%d messages", r, senderClient.UserID(), sent, opts.MessagesPerRound)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	round = -1
+	return messages
+}
+
+// mustChangeMemberships joins the churners to the room if they are not joined, else makes them leave it. All the
+// requests are made at the same time.
+func mustChangeMemberships(t *testing.T, roomID, server string, churners []*User, current map[string]churnerMembership) {
+	t.Helper()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []string
+	for _, churner := range churners {
+		joined := current[churner.UserID].membership == "join"
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var res *http.Response
+			if joined {
+				res = churner.LeaveRoom(t, roomID)
+			} else {
+				res = churner.JoinRoom(t, roomID, []string{server})
+			}
+			if res.StatusCode != 200 {
+				mu.Lock()
+				defer mu.Unlock()
+				errs = append(errs, fmt.Sprintf("%s (joined=%v): HTTP %d", churner.UserID, joined, res.StatusCode))
+			}
+		}()
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		ct.Fatalf(t, "MustChurnMembership: %d membership changes failed:\n%s", len(errs), strings.Join(errs, "\n"))
+	}
+}
+
+// mustGetChurnerMemberships returns the current membership of every churner in the room, as seen by `user`.
+func mustGetChurnerMemberships(t *testing.T, roomID string, user *User, churners []*User) map[string]churnerMembership {
+	t.Helper()
+	res := user.MustDo(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "state"})
+	memberships := make(map[string]churnerMembership, len(churners))
+	for _, ev := range must.ParseJSON(t, res.Body).Array() {
+		if ev.Get("type").Str != "m.room.member" {
+			continue
+		}
+		memberships[ev.Get("state_key").Str] = churnerMembership{
+			membership: ev.Get("content.membership").Str,
+			eventID:    ev.Get("event_id").Str,
+		}
+	}
+	for _, churner := range churners {
+		if _, exists := memberships[churner.UserID]; !exists {
+			memberships[churner.UserID] = churnerMembership{membership: "leave"}
+		}
+	}
+	return memberships
+}
+
+// MustOnlyDecryptMessagesSentWhilstJoined checks every message from MustChurnMembership as seen by each churner,
+// else fails the test:
+//   - churners who were joined to the room when a message was sent must decrypt it.
+//   - churners who were not joined to the room when a message was sent must fail to decrypt it, if they see it at all.
+//
+// Churners backpaginate to find messages which are not in their current timeline.
+func MustOnlyDecryptMessagesSentWhilstJoined(t *testing.T, roomID string, messages []ChurnedMessage, churners []api.TestClient) {
+	t.Helper()
+	if len(messages) == 0 {
+		ct.Fatalf(t, "MustOnlyDecryptMessagesSentWhilstJoined: no messages to check")
+	}
+	lastEventID := messages[len(messages)-1].EventID
+	for _, churner := range churners {
+		// every churner is joined for the last message, so must see it
+		churner.WaitUntilEventInRoom(t, roomID, api.CheckEventIsDecrypted(lastEventID)).Waitf(
+			t, 10*time.Second, "MustOnlyDecryptMessagesSentWhilstJoined: %s did not decrypt the last message %s", churner.UserID(), lastEventID,
+		)
+		timeline := mustBackpaginateToEvents(t, churner, roomID, messages)
+		for _, msg := range messages {
+			ev := timeline[msg.EventID]
+			if msg.Members[churner.UserID()] {
+				if ev == nil || ev.FailedToDecrypt {
+					churner.WaitUntilEventInRoom(t, roomID, api.CheckEventIsDecrypted(msg.EventID)).Waitf(
+						t, 5*time.Second, "MustOnlyDecryptMessagesSentWhilstJoined: %s (%s) was joined when '%s' was sent, but failed to decrypt it",
+						churner.UserID(), churner.Type(), msg.Body,
+					)
+				}
+				continue
+			}
+			if ev != nil && !ev.FailedToDecrypt {
+				ct.Fatalf(t, "MustOnlyDecryptMessagesSentWhilstJoined: %s (%s) was not joined when '%s' was sent, but decrypted it",
+					churner.UserID(), churner.Type(), msg.Body)
+			}
+		}
+	}
+}
+
+// mustBackpaginateToEvents backpaginates until every message is in the client's timeline, or as far as possible,
+// then returns the timeline keyed by event ID.
+func mustBackpaginateToEvents(t *testing.T, client api.TestClient, roomID string, messages []ChurnedMessage) map[string]*api.Event {
+	t.Helper()
+	timeline := make(map[string]*api.Event)
+	for i := 0; i < maxBackpaginations; i++ {
+		for _, ev := range client.MustGetTimeline(t, roomID) {
+			timeline[ev.ID] = ev
+		}
+		missing := false
+		for _, msg := range messages {
+			if timeline[msg.EventID] == nil {
+				missing = true
+				break
+			}
+		}
+		if !missing {
+			break
+		}
+		client.MustBackpaginate(t, roomID, backpaginationAmount)
+	}
+	return timeline
+}
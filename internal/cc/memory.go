@@ -0,0 +1,36 @@
+package cc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/memory"
+	"github.com/matrix-org/complement/ct"
+)
+
+// monitorMemory samples memory whilst the test runs, then logs the peak when the test ends. If the peak
+// exceeds the budget, the test fails if failOverBudget is set, else a warning is logged.
+func monitorMemory(t testing.TB, budgetMiB uint64, failOverBudget bool) {
+	t.Helper()
+	monitor, err := memory.StartMonitor(500 * time.Millisecond)
+	if err != nil {
+		t.Logf("WARNING: not monitoring memory: %s", err)
+		return
+	}
+	t.Cleanup(func() {
+		peak, numSamples, err := monitor.Stop()
+		if err != nil {
+			t.Logf("WARNING: failed to sample memory: %s", err)
+		}
+		budget := budgetMiB * 1024 * 1024
+		t.Logf("peak memory over %d samples: %s (budget %s)", numSamples, peak, memory.FormatBytes(budget))
+		if peak.Total() <= budget {
+			return
+		}
+		if failOverBudget {
+			ct.Errorf(t, "memory budget exceeded: peak %s > budget %s", memory.FormatBytes(peak.Total()), memory.FormatBytes(budget))
+		} else {
+			t.Logf("WARNING: memory budget exceeded: peak %s > budget %s", memory.FormatBytes(peak.Total()), memory.FormatBytes(budget))
+		}
+	})
+}
@@ -0,0 +1,142 @@
+package cc
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement/ct"
+)
+
+// ConcurrentMessagesOpts configures MustSendConcurrentMessages.
+type ConcurrentMessagesOpts struct {
+	// The number of messages each sender sends. Defaults to 10.
+	MessagesPerSender int
+	// The maximum number of messages being sent at once, across all senders. Messages from the same sender may be
+	// sent at the same time. Defaults to the number of senders, so every sender is sending all the time.
+	Concurrency int
+}
+
+// MustSendConcurrentMessages sends messages into the room from every sender at the same time, returning the
+// bodies of the messages in the order the sends completed, else fails the test. Each body is unique, so it can be
+// used with MustHaveConvergedTimelines. The order in which messages are sent is random, which makes this useful
+// for finding races in how clients create and share megolm sessions.
+func MustSendConcurrentMessages(t *testing.T, roomID string, senders []api.TestClient, opts ConcurrentMessagesOpts) []string {
+	t.Helper()
+	if opts.MessagesPerSender == 0 {
+		opts.MessagesPerSender = 10
+	}
+	if opts.Concurrency == 0 {
+		opts.Concurrency = len(senders)
+	}
+	sem := make(chan struct{}, opts.Concurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var bodies []string
+	var errs []string
+	for i, sender := range senders {
+		for j := 0; j < opts.MessagesPerSender; j++ {
+			body := fmt.Sprintf("MustSendConcurrentMessages message %d from sender %d %s (%s)", j, i, sender.UserID(), sender.Opts().DeviceID)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				// Must functions cannot be called outside the test goroutine, so collect errors instead.
+				_, err := sender.SendMessage(t, roomID, body)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					errs = append(errs, fmt.Sprintf("%s: %s", body, err))
+					return
+				}
+				bodies = append(bodies, body)
+			}()
+		}
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		ct.Fatalf(t, "MustSendConcurrentMessages: %d messages failed to send:\n%s", len(errs), strings.Join(errs, "\n"))
+	}
+	return bodies
+}
+
+// MustHaveConvergedTimelines waits until every client has every message in bodies, then fails the test if any
+// client failed to decrypt an event in its timeline or if the clients disagree on the order of the messages. Other
+// decrypted events are ignored. Clients backpaginate if messages are not in their current timeline. As any UTD
+// fails the test, every client must be able to decrypt the entire room e.g all devices were logged in before the
+// room was created.
+func MustHaveConvergedTimelines(t *testing.T, roomID string, bodies []string, clients ...api.TestClient) {
+	t.Helper()
+	wanted := make(map[string]bool, len(bodies))
+	for _, body := range bodies {
+		wanted[body] = true
+	}
+	orders := make([][]string, len(clients))
+	for i, client := range clients {
+		for _, body := range bodies {
+			client.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(body)).Waitf(
+				t, 30*time.Second, "MustHaveConvergedTimelines: %s (%s) did not see '%s'", client.UserID(), client.Type(), body,
+			)
+		}
+		orders[i] = mustGetMessageOrder(t, client, roomID, wanted)
+	}
+	for i := 1; i < len(clients); i++ {
+		if diff := firstDifference(orders[0], orders[i]); diff != -1 {
+			ct.Fatalf(t, "MustHaveConvergedTimelines: %s (%s) and %s (%s) disagree on the order of messages at position %d:\n%s\nvs\n%s",
+				clients[0].UserID(), clients[0].Type(), clients[i].UserID(), clients[i].Type(), diff,
+				strings.Join(orders[0], "\n"), strings.Join(orders[i], "\n"))
+		}
+	}
+}
+
+// mustGetMessageOrder returns the wanted messages in the order they appear in the client's timeline, else fails
+// the test if any of them failed to decrypt.
+func mustGetMessageOrder(t *testing.T, client api.TestClient, roomID string, wanted map[string]bool) []string {
+	t.Helper()
+	var order []string
+	var undecryptable []string
+	// Decrypted messages are found by body, so if there are UTDs we won't find everything.
+	for attempt := 0; attempt < 5; attempt++ {
+		order = nil
+		undecryptable = nil
+		for _, ev := range client.MustGetTimeline(t, roomID) {
+			if ev.FailedToDecrypt {
+				undecryptable = append(undecryptable, ev.ID)
+				continue
+			}
+			if wanted[ev.Text] {
+				order = append(order, ev.Text)
+			}
+		}
+		if len(order)+len(undecryptable) >= len(wanted) {
+			break
+		}
+		client.MustBackpaginate(t, roomID, len(wanted))
+	}
+	if len(undecryptable) > 0 {
+		ct.Fatalf(t, "MustHaveConvergedTimelines: %s (%s) failed to decrypt %d events: %v",
+			client.UserID(), client.Type(), len(undecryptable), undecryptable)
+	}
+	if len(order) != len(wanted) {
+		ct.Fatalf(t, "MustHaveConvergedTimelines: %s (%s) has %d/%d messages in its timeline",
+			client.UserID(), client.Type(), len(order), len(wanted))
+	}
+	return order
+}
+
+// firstDifference returns the index of the first element which differs between a and b, or -1 if they are equal.
+func firstDifference(a, b []string) int {
+	for i := range a {
+		if i >= len(b) || a[i] != b[i] {
+			return i
+		}
+	}
+	if len(b) > len(a) {
+		return len(a)
+	}
+	return -1
+}
@@ -0,0 +1,106 @@
+package cc
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/must"
+	"github.com/tidwall/gjson"
+)
+
+// maxOTKClaims bounds MustExhaustOTKs, in case the client keeps uploading new one-time keys as they are claimed.
+const maxOTKClaims = 1000
+
+// ClaimedKey is a signed_curve25519 key returned from /keys/claim.
+type ClaimedKey struct {
+	KeyID string
+	Key   gjson.Result
+	// true if this is the device's fallback key rather than a one-time key
+	Fallback bool
+}
+
+// MustGetOTKCount returns the number of signed_curve25519 one-time keys the server has for this user's device,
+// by uploading no keys via /keys/upload. As test clients log in with the same device ID, this is the number of
+// OTKs the test client has uploaded.
+func (u *User) MustGetOTKCount(t *testing.T) int {
+	t.Helper()
+	res := u.MustDo(t, "POST", []string{"_matrix", "client", "v3", "keys", "upload"}, client.WithJSONBody(t, map[string]any{}))
+	body := must.ParseJSON(t, res.Body)
+	return int(body.Get("one_time_key_counts.signed_curve25519").Int())
+}
+
+// ClaimOTK claims a single signed_curve25519 key for the given device as this user. Returns nil if the server
+// returned no key, which happens when the device has no one-time keys left and has no fallback key.
+func (u *User) ClaimOTK(t *testing.T, targetUserID, targetDeviceID string) *ClaimedKey {
+	t.Helper()
+	res := u.MustDo(t, "POST", []string{"_matrix", "client", "v3", "keys", "claim"}, client.WithJSONBody(t, map[string]any{
+		"one_time_keys": map[string]any{
+			targetUserID: map[string]any{
+				targetDeviceID: "signed_curve25519",
+			},
+		},
+	}))
+	body := must.ParseJSON(t, res.Body)
+	keys := body.Get(fmt.Sprintf(
+		"one_time_keys.%s.%s", client.GjsonEscape(targetUserID), client.GjsonEscape(targetDeviceID),
+	))
+	for keyID, key := range keys.Map() {
+		return &ClaimedKey{
+			KeyID:    keyID,
+			Key:      key,
+			Fallback: key.Get("fallback").Bool(),
+		}
+	}
+	return nil
+}
+
+// MustClaimOTKs claims n one-time keys for the given device as this user, failing the test if the server
+// returns no key or the fallback key instead.
+func (u *User) MustClaimOTKs(t *testing.T, targetUserID, targetDeviceID string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		key := u.ClaimOTK(t, targetUserID, targetDeviceID)
+		if key == nil {
+			ct.Fatalf(t, "MustClaimOTKs: no key returned for %s|%s after claiming %d OTKs", targetUserID, targetDeviceID, i)
+		}
+		if key.Fallback {
+			ct.Fatalf(t, "MustClaimOTKs: fallback key returned for %s|%s after claiming %d OTKs", targetUserID, targetDeviceID, i)
+		}
+	}
+}
+
+// MustClaimFallbackKey claims a key for the given device as this user, failing the test if it is not the
+// fallback key. Call this once the device has run out of one-time keys.
+func (u *User) MustClaimFallbackKey(t *testing.T, targetUserID, targetDeviceID string) *ClaimedKey {
+	t.Helper()
+	key := u.ClaimOTK(t, targetUserID, targetDeviceID)
+	if key == nil {
+		ct.Fatalf(t, "MustClaimFallbackKey: no key returned for %s|%s", targetUserID, targetDeviceID)
+	}
+	if !key.Fallback {
+		ct.Fatalf(t, "MustClaimFallbackKey: key %s for %s|%s is not the fallback key: %s", key.KeyID, targetUserID, targetDeviceID, key.Key.Raw)
+	}
+	return key
+}
+
+// MustExhaustOTKs claims one-time keys for the given device as this user until the server returns the fallback
+// key, or no key if the device has no fallback key. Returns the number of one-time keys claimed, and the fallback
+// key if one was returned. Clients which are able to upload keys may replenish their one-time keys as they are
+// claimed, so block /keys/upload first to ensure the device runs out.
+func (u *User) MustExhaustOTKs(t *testing.T, targetUserID, targetDeviceID string) (claimed int, fallbackKey *ClaimedKey) {
+	t.Helper()
+	for claimed < maxOTKClaims {
+		key := u.ClaimOTK(t, targetUserID, targetDeviceID)
+		if key == nil {
+			return claimed, nil
+		}
+		if key.Fallback {
+			return claimed, key
+		}
+		claimed++
+	}
+	ct.Fatalf(t, "MustExhaustOTKs: %s|%s still has one-time keys after claiming %d, is it uploading more?", targetUserID, targetDeviceID, claimed)
+	return claimed, nil
+}
@@ -0,0 +1,103 @@
+package cc
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/complement-crypto/internal/deploy"
+)
+
+// deploymentPool hands out deployments to parallel tests. Each deployment is leased by at most one test at a
+// time, so parallel tests cannot see each other's homeservers, users, rooms or mitmproxy configuration.
+type deploymentPool struct {
+	// the free slots. Leasing blocks until a slot is free.
+	free chan *poolSlot
+	mu   sync.Mutex
+	// test name => leased slot
+	leases map[string]*poolSlot
+	// every slot which has a deployment, for teardown
+	deployed []*poolSlot
+}
+
+// poolSlot is a deployment in the pool. The deployment is made the first time the slot is leased.
+type poolSlot struct {
+	index      int
+	deployment *deploy.ComplementCryptoDeployment
+}
+
+func newDeploymentPool(size int) *deploymentPool {
+	p := &deploymentPool{
+		free:   make(chan *poolSlot, size),
+		leases: make(map[string]*poolSlot),
+	}
+	for i := 0; i < size; i++ {
+		p.free <- &poolSlot{index: i}
+	}
+	return p
+}
+
+// leased returns the deployment leased by the test or any of its parents, or nil if there is no lease.
+func (p *deploymentPool) leased(t testing.TB) *deploy.ComplementCryptoDeployment {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	name := t.Name()
+	for {
+		if slot, ok := p.leases[name]; ok {
+			return slot.deployment
+		}
+		i := strings.LastIndex(name, "/")
+		if i == -1 {
+			return nil
+		}
+		name = name[:i]
+	}
+}
+
+// Parallel marks the test as parallel via t.Parallel, then waits until a deployment in the pool is free and
+// leases it for the rest of the test, including sub-tests. Instance.Deploy, and so Instance.CreateTestContext,
+// then return the leased deployment. The pool size is configured by `COMPLEMENT_CRYPTO_DEPLOYMENT_POOL_SIZE`.
+//
+// Tests which do not call Parallel share the first deployment in the pool, which is never leased whilst they run,
+// as Go runs parallel tests after all other tests in the package have finished.
+func (i *Instance) Parallel(t *testing.T) {
+	t.Helper()
+	t.Parallel()
+	if i.pool.leased(t) != nil {
+		t.Fatalf("Parallel: %s already has a leased deployment", t.Name())
+	}
+	slot := <-i.pool.free
+	t.Cleanup(func() {
+		i.pool.mu.Lock()
+		delete(i.pool.leases, t.Name())
+		i.pool.mu.Unlock()
+		i.pool.free <- slot
+	})
+	if slot.deployment == nil {
+		if slot.index == 0 {
+			slot.deployment = i.Deploy(t)
+		} else {
+			slot.deployment = deploy.RunNewNamedDeployment(
+				t, fmt.Sprintf("pool%d", slot.index+1), i.complementCryptoConfig.NumHomeservers,
+				i.complementCryptoConfig.MITMProxyAddonsDir, i.complementCryptoConfig.MITMDump,
+			)
+			i.pool.mu.Lock()
+			i.pool.deployed = append(i.pool.deployed, slot)
+			i.pool.mu.Unlock()
+		}
+	}
+	t.Logf("Parallel: leased deployment %d of %d", slot.index+1, cap(i.pool.free))
+	i.pool.mu.Lock()
+	i.pool.leases[t.Name()] = slot
+	i.pool.mu.Unlock()
+}
+
+// teardown tears down every deployment made by the pool, except the first which is torn down by the Instance.
+func (p *deploymentPool) teardown() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, slot := range p.deployed {
+		slot.deployment.Teardown()
+	}
+}
@@ -0,0 +1,40 @@
+package cc
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement/ct"
+)
+
+// MustHaveResumedSyncing asserts that every client is syncing again, e.g after deploy.WithProxyChaos.
+// Each client in turn sends a message into the room, which every other client must see and decrypt.
+// Clients back off after failed requests, so this waits longer than usual for each message.
+func MustHaveResumedSyncing(t *testing.T, roomID string, clients ...api.TestClient) {
+	t.Helper()
+	for i, sender := range clients {
+		body := fmt.Sprintf("MustHaveResumedSyncing %d from %s", i, sender.UserID())
+		var waiters []api.Waiter
+		for j, receiver := range clients {
+			if j == i {
+				continue
+			}
+			waiters = append(waiters, receiver.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(body)))
+		}
+		eventID := sender.MustSendMessage(t, roomID, body)
+		for _, waiter := range waiters {
+			waiter.Waitf(t, 30*time.Second, "MustHaveResumedSyncing: did not see message from %s (%s)", sender.UserID(), sender.Type())
+		}
+		for j, receiver := range clients {
+			if j == i {
+				continue
+			}
+			if ev := receiver.MustGetEvent(t, roomID, eventID); ev.FailedToDecrypt {
+				ct.Fatalf(t, "MustHaveResumedSyncing: %s (%s) failed to decrypt message from %s (%s)",
+					receiver.UserID(), receiver.Type(), sender.UserID(), sender.Type())
+			}
+		}
+	}
+}
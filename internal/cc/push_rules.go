@@ -0,0 +1,37 @@
+package cc
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/must"
+)
+
+// MustSetPushRule creates or replaces the push rule with the given kind e.g "override" or "content" and ID for this
+// user, with the rule in the body of the request as per the client-server API e.g {"pattern":..., "actions":[...]}.
+// Clients only see the new rule once they have synced the m.push_rules account data, so set rules before syncing.
+func (u *User) MustSetPushRule(t *testing.T, kind, ruleID string, rule map[string]any) {
+	t.Helper()
+	res := u.Do(t, "PUT", []string{"_matrix", "client", "v3", "pushrules", "global", kind, ruleID}, client.WithJSONBody(t, rule))
+	body := must.ParseJSON(t, res.Body)
+	if res.StatusCode != http.StatusOK {
+		ct.Fatalf(t, "MustSetPushRule: %s %s/%s got HTTP %d: %s", u.UserID, kind, ruleID, res.StatusCode, body.Raw)
+	}
+}
+
+// MustSetKeywordPushRule adds a content push rule for this user which matches messages whose body contains the
+// keyword, and notifies with a sound and highlight. The server cannot see the body of encrypted messages, so only
+// clients can evaluate this rule against them, once they have decrypted the message.
+func (u *User) MustSetKeywordPushRule(t *testing.T, ruleID, keyword string) {
+	t.Helper()
+	u.MustSetPushRule(t, "content", ruleID, map[string]any{
+		"pattern": keyword,
+		"actions": []any{
+			"notify",
+			map[string]any{"set_tweak": "sound", "value": "default"},
+			map[string]any{"set_tweak": "highlight"},
+		},
+	})
+}
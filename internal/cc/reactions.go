@@ -0,0 +1,86 @@
+package cc
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/deploy/callback"
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+	"github.com/matrix-org/complement/ct"
+	"github.com/tidwall/gjson"
+)
+
+// MustReactWithoutLeakingKey reacts to the event with the key as sender, then fails the test unless the reaction was
+// sent to the server as m.room.encrypted, without the key appearing anywhere in the request in plaintext. Reactions
+// are relations, and SDKs copy m.relates_to into the cleartext of encrypted events so servers can aggregate them,
+// which can leak the key. The room must be encrypted, and nothing else may be sent into the room whilst this is
+// called. Returns the event ID of the reaction.
+func (c *TestContext) MustReactWithoutLeakingKey(t *testing.T, sender api.TestClient, roomID, eventID, key string) string {
+	t.Helper()
+	sendCh := callback.NewPassiveChannel(10*time.Second, false)
+	defer sendCh.Close()
+	var sent *callback.Data
+	c.Deployment.MITM().Configure(t).WithIntercept(mitm.InterceptOpts{
+		Filter: mitm.FilterParams{
+			PathContains: "/send/",
+			Method:       "PUT",
+		},
+		ResponseCallback: sendCh.Callback(),
+	}, func() {
+		sender.MustReact(t, roomID, eventID, key)
+		// not all SDKs block until the reaction has been sent
+		sent = sendCh.Recv(t, "MustReactWithoutLeakingKey: %s did not send the reaction to %s", sender.UserID(), eventID)
+	})
+	u, err := url.Parse(sent.URL)
+	if err != nil {
+		ct.Fatalf(t, "MustReactWithoutLeakingKey: failed to parse URL %s: %s", sent.URL, err)
+	}
+	// /_matrix/client/v3/rooms/{roomId}/send/{eventType}/{txnId}
+	_, after, _ := strings.Cut(u.Path, "/send/")
+	eventType, _, _ := strings.Cut(after, "/")
+	if eventType != "m.room.encrypted" {
+		ct.Fatalf(t, "MustReactWithoutLeakingKey: %s sent the reaction as %s: %s", sender.UserID(), eventType, string(sent.RequestBody))
+	}
+	if jsonContainsString(sent.RequestBody, key) {
+		ct.Fatalf(t, "MustReactWithoutLeakingKey: %s leaked the reaction key %q in plaintext: %s", sender.UserID(), key, string(sent.RequestBody))
+	}
+	reactionEventID := gjson.GetBytes(sent.ResponseBody, "event_id").Str
+	if reactionEventID == "" {
+		ct.Fatalf(t, "MustReactWithoutLeakingKey: server did not return an event ID for the reaction: HTTP %d %s", sent.ResponseCode, string(sent.ResponseBody))
+	}
+	return reactionEventID
+}
+
+// jsonContainsString returns true if any key or string value in the JSON contains s. The JSON is decoded first,
+// so escaped forms of s e.g "\ud83d\udc4d" for an emoji are also found.
+func jsonContainsString(raw json.RawMessage, s string) bool {
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return strings.Contains(string(raw), s)
+	}
+	var contains func(v any) bool
+	contains = func(v any) bool {
+		switch v := v.(type) {
+		case string:
+			return strings.Contains(v, s)
+		case []any:
+			for _, item := range v {
+				if contains(item) {
+					return true
+				}
+			}
+		case map[string]any:
+			for k, item := range v {
+				if strings.Contains(k, s) || contains(item) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return contains(v)
+}
@@ -0,0 +1,35 @@
+package cc
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement/ct"
+)
+
+// MustSeeReadReceipt waits until the observer sees a read receipt from the user for one of the wanted events, then
+// returns the event ID in the receipt, else fails the test. Receipts for other events are ignored, so pass every
+// event the receipt could be for. Skips the test if the observer cannot report read receipts.
+func MustSeeReadReceipt(t *testing.T, observer api.TestClient, roomID, userID string, wantEventIDs ...string) string {
+	t.Helper()
+	var eventID string
+	var err error
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(100 * time.Millisecond) {
+		eventID, err = observer.GetReadReceipt(t, roomID, userID)
+		if err != nil {
+			if errors.Is(err, api.ErrNotSupported) {
+				t.Skipf("%s cannot report read receipts: %s", observer.Type(), err)
+			}
+			ct.Fatalf(t, "MustSeeReadReceipt: %s", err)
+		}
+		if slices.Contains(wantEventIDs, eventID) {
+			return eventID
+		}
+	}
+	ct.Fatalf(t, "MustSeeReadReceipt: %s (%s) did not see a read receipt from %s for any of %v, last receipt was for '%s'",
+		observer.UserID(), observer.Type(), userID, wantEventIDs, eventID)
+	return ""
+}
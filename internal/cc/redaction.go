@@ -0,0 +1,54 @@
+package cc
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/must"
+)
+
+// MustGetMegolmSessionID fetches the given event from the server as this user, and returns the megolm session ID
+// it was encrypted with, else fails the test. This does not rely on any SDK, so works for events sent by any client.
+// Redacted events have no session ID, so call this before redacting the event.
+func (u *User) MustGetMegolmSessionID(t *testing.T, roomID, eventID string) string {
+	t.Helper()
+	res := u.MustDo(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "event", eventID})
+	ev := must.ParseJSON(t, res.Body)
+	if ev.Get("type").Str != "m.room.encrypted" {
+		ct.Fatalf(t, "MustGetMegolmSessionID: event %s is not encrypted: %s", eventID, ev.Raw)
+	}
+	sessionID := ev.Get("content.session_id").Str
+	if sessionID == "" {
+		ct.Fatalf(t, "MustGetMegolmSessionID: event %s has no session ID: %s", eventID, ev.Raw)
+	}
+	return sessionID
+}
+
+// MustRedactAndSendMessage redacts the given event, which must have been sent by sender, then sends a new message
+// with the given text, else fails the test. Returns the new event ID, and whether the new event was encrypted with a
+// different megolm session to the redacted event, as seen on the server by viewer. If the sender exposes its outbound
+// session IDs via GetOutboundSessionID, they must match what the server sees.
+//
+// This does not fail the test if the session was not rotated, as not all SDKs rotate on redaction.
+func (c *TestContext) MustRedactAndSendMessage(t *testing.T, sender api.TestClient, viewer *User, roomID, eventID, text string) (newEventID string, rotated bool) {
+	t.Helper()
+	before := viewer.MustGetMegolmSessionID(t, roomID, eventID)
+	mustMatchOutboundSessionID(t, sender, roomID, eventID, before)
+	sender.MustRedactEvent(t, roomID, eventID, "complement-crypto")
+	newEventID = sender.MustSendMessage(t, roomID, text)
+	after := viewer.MustGetMegolmSessionID(t, roomID, newEventID)
+	mustMatchOutboundSessionID(t, sender, roomID, newEventID, after)
+	t.Logf("MustRedactAndSendMessage: %s used session %s before redaction and %s after", sender.UserID(), before, after)
+	return newEventID, before != after
+}
+
+func mustMatchOutboundSessionID(t *testing.T, sender api.TestClient, roomID, eventID, want string) {
+	t.Helper()
+	got, err := sender.GetOutboundSessionID(t, roomID, eventID)
+	if err != nil {
+		t.Logf("GetOutboundSessionID(%s): %s", eventID, err)
+		return
+	}
+	must.Equal(t, got, want, "outbound session ID reported by "+sender.UserID()+" for "+eventID)
+}
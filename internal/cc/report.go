@@ -0,0 +1,209 @@
+package cc
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/deploy"
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+	"github.com/matrix-org/complement-crypto/internal/report"
+	"github.com/matrix-org/complement/ct"
+)
+
+var reportPath = flag.String(
+	"crypto.report", "",
+	"Write an HTML report summarising decryption failures and key shares for each test to this path, and a JSON report alongside it",
+)
+
+// testReport returns the report to add test statistics to, or nil if -crypto.report is not set.
+func (i *Instance) testReport() *report.TestReport {
+	if *reportPath == "" {
+		return nil
+	}
+	i.ssMutex.Lock()
+	defer i.ssMutex.Unlock()
+	if i.report == nil {
+		i.report = report.NewTestReport(*reportPath)
+	}
+	return i.report
+}
+
+// collectTestStats adds statistics for this test to the report when the test ends. Key shares are counted by
+// recording traffic through mitmproxy, so include traffic from other tests running at the same time.
+// Returns the tracker which clients made by this test should report events to.
+func collectTestStats(t testing.TB, rep *report.TestReport, deployment *deploy.ComplementCryptoDeployment) *report.DecryptionTracker {
+	tracker := &report.DecryptionTracker{}
+	start := time.Now()
+	recordingID := deployment.MITM().StartRecording(t)
+	t.Cleanup(func() {
+		flows := deployment.MITM().StopRecording(t, recordingID)
+		outcome := "pass"
+		if t.Skipped() {
+			outcome = "skip"
+		} else if t.Failed() {
+			outcome = "fail"
+		}
+		utdEvents, retried := tracker.Counts()
+		err := rep.Add(report.TestStats{
+			Name:               t.Name(),
+			Outcome:            outcome,
+			DurationMs:         float64(time.Since(start)) / float64(time.Millisecond),
+			UTDEvents:          utdEvents,
+			RetriedDecryptions: retried,
+			KeyShares:          countEncryptedToDeviceMessages(flows),
+		})
+		if err != nil {
+			t.Logf("failed to add test to report: %s", err)
+		}
+	})
+	return tracker
+}
+
+// countEncryptedToDeviceMessages returns the number of devices sent m.room.encrypted to-device messages.
+func countEncryptedToDeviceMessages(flows []mitm.RecordedFlow) int {
+	count := 0
+	for _, flow := range flows {
+		if flow.Method != "PUT" || !strings.Contains(flow.URL, "/sendToDevice/m.room.encrypted/") {
+			continue
+		}
+		var body struct {
+			Messages map[string]map[string]json.RawMessage `json:"messages"`
+		}
+		if err := json.Unmarshal(flow.RequestBody, &body); err != nil {
+			continue
+		}
+		for _, devices := range body.Messages {
+			count += len(devices)
+		}
+	}
+	return count
+}
+
+// reportingClient reports every event the test sees to a DecryptionTracker, and the time messages are sent and
+// decrypted to a DeliveryTracker. Either tracker may be nil.
+type reportingClient struct {
+	api.Client
+	tracker  *report.DecryptionTracker
+	delivery *report.DeliveryTracker
+	// identifies this client, as users can have many clients
+	clientID string
+	sdk      string
+}
+
+func newReportingClient(c api.Client, tracker *report.DecryptionTracker, delivery *report.DeliveryTracker) *reportingClient {
+	opts := c.Opts()
+	return &reportingClient{
+		Client:   c,
+		tracker:  tracker,
+		delivery: delivery,
+		clientID: opts.UserID + "|" + opts.DeviceID,
+		sdk:      string(c.Type()),
+	}
+}
+
+func (c *reportingClient) observe(ev *api.Event) {
+	if ev != nil && c.tracker != nil {
+		c.tracker.Observe(c.clientID, ev.ID, ev.FailedToDecrypt)
+	}
+}
+
+// observeLive is observe for events seen by timeline listeners. Only these count towards delivery latency, as
+// events fetched from the timeline may have been decrypted long before the test asked for them.
+func (c *reportingClient) observeLive(ev *api.Event) {
+	c.observe(ev)
+	if c.delivery != nil && !ev.FailedToDecrypt {
+		c.delivery.Decrypted(c.clientID, c.sdk, ev.ID, time.Now())
+	}
+}
+
+func (c *reportingClient) SendMessage(t ct.TestLike, roomID, text string) (eventID string, err error) {
+	start := time.Now()
+	eventID, err = c.Client.SendMessage(t, roomID, text)
+	if err == nil && c.delivery != nil {
+		c.delivery.Sent(c.clientID, c.sdk, eventID, start)
+	}
+	return eventID, err
+}
+
+func (c *reportingClient) WaitUntilEventInRoom(t ct.TestLike, roomID string, checker func(e api.Event) bool) api.Waiter {
+	return c.Client.WaitUntilEventInRoom(t, roomID, func(e api.Event) bool {
+		c.observeLive(&e)
+		return checker(e)
+	})
+}
+
+func (c *reportingClient) WaitUntilEventInRoomWithOpts(t ct.TestLike, roomID string, opts api.TimelineListenerOpts, checker func(e api.Event) bool) api.Waiter {
+	return c.Client.WaitUntilEventInRoomWithOpts(t, roomID, opts, func(e api.Event) bool {
+		c.observeLive(&e)
+		return checker(e)
+	})
+}
+
+func (c *reportingClient) GetEvent(t ct.TestLike, roomID, eventID string) (*api.Event, error) {
+	ev, err := c.Client.GetEvent(t, roomID, eventID)
+	c.observe(ev)
+	return ev, err
+}
+
+func (c *reportingClient) Backpaginate(t ct.TestLike, roomID string, count int) ([]*api.Event, error) {
+	events, err := c.Client.Backpaginate(t, roomID, count)
+	for _, ev := range events {
+		c.observe(ev)
+	}
+	return events, err
+}
+
+func (c *reportingClient) GetTimeline(t ct.TestLike, roomID string) ([]*api.Event, error) {
+	events, err := c.Client.GetTimeline(t, roomID)
+	for _, ev := range events {
+		c.observe(ev)
+	}
+	return events, err
+}
+
+// minDeliveryLatencySamples is the number of messages a pair of SDKs must deliver before the p95 latency is
+// checked, so a few slow messages early in the run do not fail tests.
+const minDeliveryLatencySamples = 20
+
+// checkDeliveryLatency fails the test when it ends if it pushed the p95 delivery latency for a pair of SDKs over
+// the maximum. Latencies are measured across the whole run, so each pair only fails the first test to exceed it.
+func (i *Instance) checkDeliveryLatency(t testing.TB, maxP95 time.Duration) {
+	t.Cleanup(func() {
+		for _, h := range i.delivery.Histograms() {
+			if h.Count < minDeliveryLatencySamples || h.P95LatencyMs <= float64(maxP95)/float64(time.Millisecond) {
+				continue
+			}
+			i.ssMutex.Lock()
+			alreadyFailed := i.slowDeliveryPairs[h.Pair()]
+			i.slowDeliveryPairs[h.Pair()] = true
+			i.ssMutex.Unlock()
+			if !alreadyFailed {
+				t.Errorf("p95 message delivery latency for %s is %.0fms over %d messages, which exceeds COMPLEMENT_CRYPTO_MAX_DELIVERY_LATENCY_P95=%s",
+					h.Pair(), h.P95LatencyMs, h.Count, maxP95)
+			}
+		}
+	})
+}
+
+// reportDeliveryLatency prints the delivery latency histograms at the end of the run, and writes them as JSON
+// alongside the test report if -crypto.report is set.
+func (i *Instance) reportDeliveryLatency() {
+	histograms := i.delivery.Histograms()
+	if len(histograms) == 0 {
+		return
+	}
+	fmt.Print(report.FormatHistograms(histograms))
+	if *reportPath == "" {
+		return
+	}
+	path := strings.TrimSuffix(*reportPath, filepath.Ext(*reportPath)) + "_latency.json"
+	if err := i.delivery.WriteJSON(path); err != nil {
+		fmt.Printf("failed to write delivery latency: %s\n", err)
+	}
+}
@@ -0,0 +1,105 @@
+package cc
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/must"
+)
+
+// ChangeRoomEncryption sends a new m.room.encryption state event in the room as this user, keeping the
+// current content and applying the options on top e.g EncRoomOptions.RotationPeriodMsgs. Options which
+// only apply to room creation, such as presets and invites, are ignored. Returns the response, so tests
+// can check that users who are not allowed to change the room's encryption config are rejected.
+func (u *User) ChangeRoomEncryption(t *testing.T, roomID string, options ...EncRoomOption) *http.Response {
+	t.Helper()
+	res := u.MustDo(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "state", "m.room.encryption", ""})
+	content, ok := must.ParseJSON(t, res.Body).Value().(map[string]interface{})
+	if !ok {
+		ct.Fatalf(t, "ChangeRoomEncryption: m.room.encryption content in %s is not an object", roomID)
+	}
+	// apply the options as if the room was being created with this content
+	reqBody := map[string]interface{}{
+		"initial_state": []map[string]interface{}{
+			{
+				"type":      "m.room.encryption",
+				"state_key": "",
+				"content":   content,
+			},
+		},
+	}
+	for _, option := range options {
+		option(reqBody)
+	}
+	return u.Do(t, "PUT", []string{"_matrix", "client", "v3", "rooms", roomID, "state", "m.room.encryption", ""}, client.WithJSONBody(t, content))
+}
+
+// MustChangeRoomEncryption is ChangeRoomEncryption but fails the test if the state event was not sent.
+// Returns the event ID of the new m.room.encryption event.
+func (u *User) MustChangeRoomEncryption(t *testing.T, roomID string, options ...EncRoomOption) (eventID string) {
+	t.Helper()
+	res := u.ChangeRoomEncryption(t, roomID, options...)
+	body := must.ParseJSON(t, res.Body)
+	if res.StatusCode != http.StatusOK {
+		ct.Fatalf(t, "MustChangeRoomEncryption: %s got HTTP %d: %s", u.UserID, res.StatusCode, body.Raw)
+	}
+	return must.GetJSONFieldStr(t, body, "event_id")
+}
+
+// CheckRoomEncryption returns an error unless every client agrees on whether the room is encrypted and, for
+// clients which can report it, which algorithm the room uses. Returns the algorithm the clients agree on, which
+// is the empty string if they agree the room is not encrypted or if no client can report the algorithm.
+func CheckRoomEncryption(t *testing.T, roomID string, clients ...api.TestClient) (algorithm string, err error) {
+	t.Helper()
+	if len(clients) == 0 {
+		return "", fmt.Errorf("CheckRoomEncryption: no clients")
+	}
+	var wantEncrypted bool
+	var algorithmFrom api.TestClient
+	for i, c := range clients {
+		isEncrypted, err := c.IsRoomEncrypted(t, roomID)
+		if err != nil {
+			return "", fmt.Errorf("CheckRoomEncryption: %s IsRoomEncrypted: %s", c.UserID(), err)
+		}
+		if i == 0 {
+			wantEncrypted = isEncrypted
+		} else if isEncrypted != wantEncrypted {
+			return "", fmt.Errorf("CheckRoomEncryption: %s thinks %s is encrypted=%v, but %s thinks encrypted=%v",
+				c.UserID(), roomID, isEncrypted, clients[0].UserID(), wantEncrypted)
+		}
+		alg, err := c.GetEncryptionAlgorithm(t, roomID)
+		if err != nil {
+			if errors.Is(err, api.ErrNotSupported) {
+				continue
+			}
+			return "", fmt.Errorf("CheckRoomEncryption: %s GetEncryptionAlgorithm: %s", c.UserID(), err)
+		}
+		if (alg != "") != isEncrypted {
+			return "", fmt.Errorf("CheckRoomEncryption: %s thinks %s is encrypted=%v but has algorithm '%s'",
+				c.UserID(), roomID, isEncrypted, alg)
+		}
+		if algorithmFrom == nil {
+			algorithm = alg
+			algorithmFrom = c
+		} else if alg != algorithm {
+			return "", fmt.Errorf("CheckRoomEncryption: %s thinks %s uses algorithm '%s', but %s thinks '%s'",
+				c.UserID(), roomID, alg, algorithmFrom.UserID(), algorithm)
+		}
+	}
+	return algorithm, nil
+}
+
+// MustAgreeOnRoomEncryption is CheckRoomEncryption but fails the test if the clients disagree.
+func MustAgreeOnRoomEncryption(t *testing.T, roomID string, clients ...api.TestClient) (algorithm string) {
+	t.Helper()
+	algorithm, err := CheckRoomEncryption(t, roomID, clients...)
+	if err != nil {
+		ct.Fatalf(t, "%s", err)
+	}
+	return algorithm
+}
@@ -0,0 +1,92 @@
+package cc
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/keyexport"
+	"github.com/matrix-org/complement/ct"
+)
+
+// RoomKeyExportFixture is a room key export made by an SDK, which is checked in so other SDKs, including later
+// versions of the same SDK, are tested against importing it. See TestGenerateRoomKeyExportFixtures.
+type RoomKeyExportFixture struct {
+	// The SDK which made the export.
+	SDK api.ClientTypeLang `json:"sdk"`
+	// True if the export was made by a client in the RPC binary, which may be a different version of the SDK.
+	Multiprocess bool `json:"multiprocess"`
+	// The passphrase the export is encrypted with.
+	Passphrase string `json:"passphrase"`
+	// The megolm session IDs in the export.
+	SessionIDs []string `json:"session_ids"`
+	// The ASCII-armored export.
+	Export string `json:"export"`
+}
+
+// Name returns the file name of this fixture e.g "rust-multiprocess.json".
+func (f *RoomKeyExportFixture) Name() string {
+	name := string(f.SDK)
+	if f.Multiprocess {
+		name += "-multiprocess"
+	}
+	return name + ".json"
+}
+
+// MustDecryptRoomKeyExport decrypts the export with the passphrase without going through an SDK, and fails the
+// test unless it is in the standard key export format. Returns the session IDs in the export, sorted.
+func MustDecryptRoomKeyExport(t *testing.T, export []byte, passphrase string) (sessionIDs []string) {
+	t.Helper()
+	sessions, err := keyexport.DecryptSessions(export, passphrase)
+	if err != nil {
+		ct.Fatalf(t, "MustDecryptRoomKeyExport: %s", err)
+	}
+	for _, s := range sessions {
+		sessionIDs = append(sessionIDs, s.SessionID)
+	}
+	slices.Sort(sessionIDs)
+	return sessionIDs
+}
+
+// MustWriteRoomKeyExportFixture writes the fixture as JSON into the directory.
+func MustWriteRoomKeyExportFixture(t *testing.T, dir string, fixture RoomKeyExportFixture) {
+	t.Helper()
+	data, err := json.MarshalIndent(fixture, "", "  ")
+	if err != nil {
+		ct.Fatalf(t, "MustWriteRoomKeyExportFixture: failed to marshal fixture: %s", err)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		ct.Fatalf(t, "MustWriteRoomKeyExportFixture: %s", err)
+	}
+	path := filepath.Join(dir, fixture.Name())
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		ct.Fatalf(t, "MustWriteRoomKeyExportFixture: %s", err)
+	}
+	t.Logf("MustWriteRoomKeyExportFixture: wrote %s", path)
+}
+
+// MustReadRoomKeyExportFixtures reads every fixture in the directory, keyed by file name. Returns an empty map if
+// the directory does not exist.
+func MustReadRoomKeyExportFixtures(t *testing.T, dir string) map[string]RoomKeyExportFixture {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		ct.Fatalf(t, "MustReadRoomKeyExportFixtures: %s", err)
+	}
+	fixtures := make(map[string]RoomKeyExportFixture, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			ct.Fatalf(t, "MustReadRoomKeyExportFixtures: %s", err)
+		}
+		var fixture RoomKeyExportFixture
+		if err := json.Unmarshal(data, &fixture); err != nil {
+			ct.Fatalf(t, "MustReadRoomKeyExportFixtures: %s is not a fixture: %s", path, err)
+		}
+		fixtures[filepath.Base(path)] = fixture
+	}
+	return fixtures
+}
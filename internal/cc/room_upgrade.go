@@ -0,0 +1,28 @@
+package cc
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/must"
+)
+
+// MustUpgradeRoom upgrades the given room to the given room version via the CS API, else fails the test. If newVersion
+// is empty, the server's default room version is used. The server tombstones the old room and copies over its state,
+// including m.room.encryption, but does not invite anyone, so the given users are invited to the replacement room to
+// allow them to follow the tombstone. Returns the ID of the replacement room.
+func (u *User) MustUpgradeRoom(t *testing.T, roomID, newVersion string, inviteUserIDs ...string) (newRoomID string) {
+	t.Helper()
+	if newVersion == "" {
+		newVersion = string(u.GetDefaultRoomVersion(t))
+	}
+	res := u.MustDo(t, "POST", []string{"_matrix", "client", "v3", "rooms", roomID, "upgrade"}, client.WithJSONBody(t, map[string]any{
+		"new_version": newVersion,
+	}))
+	newRoomID = must.ParseJSON(t, res.Body).Get("replacement_room").Str
+	must.NotEqual(t, newRoomID, "", "upgrade response did not include replacement_room")
+	for _, userID := range inviteUserIDs {
+		u.MustInviteRoom(t, newRoomID, userID)
+	}
+	return newRoomID
+}
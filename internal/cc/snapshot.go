@@ -0,0 +1,130 @@
+package cc
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement/ct"
+)
+
+// ClientPersistenceSnapshot is a copy of a client's on-disk storage, e.g the rust SDK sqlite stores or the
+// JS SDK IndexedDB databases. Snapshots can be restored in later subtests to test store corruption and
+// upgrade paths, without having to log in again.
+//
+// Snapshots are not deleted automatically, as they may outlive the test which made them. Call Delete when
+// the snapshot is no longer needed.
+type ClientPersistenceSnapshot struct {
+	// The options used to create the client, including the access token. Pass these to MustCreateClient
+	// after calling Restore to recreate the client with the restored storage.
+	Opts api.ClientCreationOpts
+	// where the client keeps its storage
+	storagePath string
+	// where the copy is kept
+	snapshotPath string
+}
+
+// SnapshotClientPersistence closes the client then copies its on-disk storage. The client must have been
+// created with persistent storage. For JS clients, this snapshots the storage of ALL JS clients with
+// persistent storage, so other JS clients should be closed first.
+func (c *TestContext) SnapshotClientPersistence(t *testing.T, cli api.TestClient) *ClientPersistenceSnapshot {
+	t.Helper()
+	if !cli.Opts().PersistentStorage {
+		ct.Fatalf(t, "SnapshotClientPersistence: %s (%s) was not created with persistent storage", cli.UserID(), cli.Type())
+	}
+	// grab the access token so we can restore the session without logging in again
+	opts := cli.Opts()
+	opts.AccessToken = cli.CurrentAccessToken(t)
+	storagePath := cli.PersistentStoragePath(t)
+	if storagePath == "" {
+		ct.Fatalf(t, "SnapshotClientPersistence: %s (%s) has no persistent storage path", cli.UserID(), cli.Type())
+	}
+	// the storage may be written to until the client is closed
+	cli.Close(t)
+
+	snapshotPath, err := os.MkdirTemp("", "complement-crypto-snapshot-")
+	if err != nil {
+		ct.Fatalf(t, "SnapshotClientPersistence: failed to make snapshot directory: %s", err)
+	}
+	if err := copyDir(storagePath, snapshotPath); err != nil {
+		ct.Fatalf(t, "SnapshotClientPersistence: failed to copy %s: %s", storagePath, err)
+	}
+	t.Logf("SnapshotClientPersistence: snapshotted %s to %s", storagePath, snapshotPath)
+	return &ClientPersistenceSnapshot{
+		Opts:         opts,
+		storagePath:  storagePath,
+		snapshotPath: snapshotPath,
+	}
+}
+
+// Restore replaces the client's on-disk storage with the contents of this snapshot. Any clients using the
+// storage MUST be closed first. Snapshots can be restored any number of times.
+func (s *ClientPersistenceSnapshot) Restore(t *testing.T) {
+	t.Helper()
+	if err := os.RemoveAll(s.storagePath); err != nil {
+		ct.Fatalf(t, "ClientPersistenceSnapshot.Restore: failed to remove %s: %s", s.storagePath, err)
+	}
+	if err := copyDir(s.snapshotPath, s.storagePath); err != nil {
+		ct.Fatalf(t, "ClientPersistenceSnapshot.Restore: failed to copy snapshot to %s: %s", s.storagePath, err)
+	}
+	t.Logf("ClientPersistenceSnapshot.Restore: restored %s from %s", s.storagePath, s.snapshotPath)
+}
+
+// StoragePath returns the directory the snapshot is restored to. Tests can modify the files in
+// this directory after calling Restore, e.g to corrupt the store.
+func (s *ClientPersistenceSnapshot) StoragePath() string {
+	return s.storagePath
+}
+
+// Delete removes the snapshot. It cannot be restored after this point.
+func (s *ClientPersistenceSnapshot) Delete() {
+	os.RemoveAll(s.snapshotPath)
+}
+
+// copyDir recursively copies the contents of src into dst, creating dst if needed.
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		default:
+			// e.g chrome's SingletonLock symlinks, which are recreated on startup
+			return nil
+		}
+	})
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy %s: %s", src, err)
+	}
+	return out.Close()
+}
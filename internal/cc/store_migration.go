@@ -0,0 +1,61 @@
+package cc
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/must"
+	"github.com/tidwall/gjson"
+)
+
+// WithStoreMigration is a scenario helper for testing store migrations. It logs in a client for req.User
+// with persistent storage using the `from` store backend, starts syncing and calls `before`. The client
+// is then closed and recreated with the same session, configured to use the `to` backend with migration
+// from `from` enabled. It then starts syncing again and calls `after`.
+//
+// This asserts that the crypto identity survived the migration, by checking that the client kept the
+// same device ID and that the device keys on the server did not change. Tests should check that sessions
+// survived, typically by ensuring messages decrypted in `before` can still be decrypted in `after`.
+func (c *TestContext) WithStoreMigration(t *testing.T, req *ClientCreationRequest, from, to api.StoreBackend, before, after func(cli api.TestClient)) {
+	t.Helper()
+	fromReq := *req
+	fromReq.Opts.PersistentStorage = true
+	fromReq.Opts.StoreBackend = from
+	var opts api.ClientCreationOpts
+	c.WithClientSyncing(t, &fromReq, func(cli api.TestClient) {
+		before(cli)
+		// grab the access token so we can restore the session without logging in again
+		opts = cli.Opts()
+	})
+	deviceKeysBefore := mustQueryDeviceKeys(t, req.User, opts.DeviceID)
+
+	opts.StoreBackend = to
+	opts.MigrateStoreFrom = from
+	migrated := c.MustCreateClient(t, &ClientCreationRequest{
+		User:         req.User,
+		Opts:         opts,
+		Multiprocess: req.Multiprocess,
+	})
+	defer migrated.Close(t)
+	stopSyncing := migrated.MustStartSyncing(t)
+	defer stopSyncing()
+
+	must.Equal(t, migrated.Opts().DeviceID, opts.DeviceID, "device ID changed after store migration")
+	deviceKeysAfter := mustQueryDeviceKeys(t, req.User, opts.DeviceID)
+	must.Equal(t, deviceKeysAfter.Get("keys").Raw, deviceKeysBefore.Get("keys").Raw, "device keys changed after store migration")
+	after(migrated)
+}
+
+// mustQueryDeviceKeys returns the device keys for the user's device, as seen by the server.
+func mustQueryDeviceKeys(t *testing.T, user *User, deviceID string) gjson.Result {
+	t.Helper()
+	res := user.MustDo(t, "POST", []string{"_matrix", "client", "v3", "keys", "query"}, client.WithJSONBody(t, map[string]any{
+		"device_keys": map[string]any{
+			user.UserID: []string{},
+		},
+	}))
+	deviceKeys := must.ParseJSON(t, res.Body).Get("device_keys." + client.GjsonEscape(user.UserID) + "." + client.GjsonEscape(deviceID))
+	must.Equal(t, deviceKeys.Exists(), true, "device "+deviceID+" has no device keys on the server")
+	return deviceKeys
+}
@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/complement-crypto/internal/api"
 	"github.com/matrix-org/complement-crypto/internal/api/langs"
 	"github.com/matrix-org/complement-crypto/internal/deploy"
 	"github.com/matrix-org/complement-crypto/internal/deploy/rpc"
+	"github.com/matrix-org/complement-crypto/internal/report"
 	"github.com/matrix-org/complement/client"
 	"github.com/matrix-org/complement/ct"
 	"github.com/matrix-org/complement/helpers"
@@ -22,6 +24,8 @@ type User struct {
 	// remember the client types that were supplied so we can seamlessly create the right
 	// test client when WithAliceSyncing/etc are called.
 	ClientType api.ClientType
+	// The default ClientCreationOpts.StoreBackend for clients of this user, see Instance.StoreBackendMatrix.
+	StoreBackend api.StoreBackend
 }
 
 // TestClientCreationRequest is a request to create a new api.Client.
@@ -41,6 +45,23 @@ type TestContext struct {
 	Deployment    *deploy.ComplementCryptoDeployment
 	RPCBinaryPath string
 	RPCInstance   atomic.Int32
+	// the default ClientCreationOpts.FFIWatchdogTimeout for clients made by this test
+	ffiWatchdogTimeout time.Duration
+	// if set, ClientCreationOpts.FailOnFFILeaks is set for clients made by this test
+	failOnFFILeaks bool
+	// set if statistics for this test are being reported, see -crypto.report
+	decryptionTracker *report.DecryptionTracker
+	// records message delivery latency across all tests, see COMPLEMENT_CRYPTO_MAX_DELIVERY_LATENCY_P95
+	deliveryTracker *report.DeliveryTracker
+	// set if users and rooms are reused between tests, see COMPLEMENT_ENABLE_DIRTY_RUNS
+	fixtures *fixtureLease
+	// if set, rooms made by CreateNewEncryptedRoom encrypt state events, see COMPLEMENT_CRYPTO_ENCRYPTED_STATE_EVENTS
+	encryptStateEvents bool
+	// The default ClientCreationOpts.BackupAlgorithm for clients made by this test, see
+	// Instance.BackupAlgorithmMatrix.
+	BackupAlgorithm api.BackupAlgorithm
+	// How rust clients made by this test do sliding sync, see Instance.SlidingSyncModeMatrix. Native if empty.
+	SlidingSyncMode api.SlidingSyncMode
 
 	// Alice is defined if at least 1 clientType is provided to CreateTestContext.
 	Alice *User
@@ -50,27 +71,50 @@ type TestContext struct {
 	Charlie *User
 }
 
-// RegisterNewUser registers a new user on the homeserver. The user ID will include the localpartSuffix.
+// RegisterNewUser registers a new user on the homeserver. The user ID will include the localpartSuffix, and the
+// nonce for this test run (see `COMPLEMENT_CRYPTO_ID_NONCE`).
 //
 // Returns a User with a single device which represents the Complement client for this registration.
 // This User can then be passed to other functions to login on new test devices.
-func (c *TestContext) RegisterNewUser(t *testing.T, clientType api.ClientType, localpartSuffix string) *User {
-	return &User{
-		CSAPI: c.Deployment.Register(t, clientType.HS, helpers.RegistrationOpts{
+//
+// If `COMPLEMENT_ENABLE_DIRTY_RUNS` is set, a user registered by an earlier test with the same homeserver and
+// localpartSuffix may be returned instead. Devices logged in by the earlier test will have been deleted.
+func (c *TestContext) RegisterNewUser(t testing.TB, clientType api.ClientType, localpartSuffix string) *User {
+	register := func() *client.CSAPI {
+		return c.Deployment.Register(t, clientType.HS, helpers.RegistrationOpts{
 			LocalpartSuffix: localpartSuffix,
 			Password:        "complement-crypto-password",
-		}),
+		})
+	}
+	var csapi *client.CSAPI
+	if c.fixtures != nil {
+		csapi = c.fixtures.user(t, clientType.HS, localpartSuffix, register)
+	} else {
+		csapi = register()
+	}
+	return &User{
+		CSAPI:      csapi,
 		ClientType: clientType,
 	}
 }
 
+// InvalidateFixtures stops the users and rooms used by this test from being reused by later tests. Users and
+// rooms are automatically not reused if the test fails, or if the test changes them in a way which is checked
+// for e.g setting up cross-signing or key backup, or changing the room's state. Tests which change users or rooms
+// in other ways should call this. Does nothing unless `COMPLEMENT_ENABLE_DIRTY_RUNS` is set.
+func (c *TestContext) InvalidateFixtures() {
+	if c.fixtures != nil {
+		c.fixtures.invalidate()
+	}
+}
+
 // WithClientSyncing is a helper function which creates a test client and automatically logs in the user and starts
 // a sync loop for them. Additional options can be specified via ClientCreationRequest, including setting the client
 // up as a multiprocess client, with persistent storage, etc.
 //
 // The callback function is invoked after this, and cleanup functions are called on your behalf when the
 // callback function ends.
-func (c *TestContext) WithClientSyncing(t *testing.T, req *ClientCreationRequest, callback func(cli api.TestClient)) {
+func (c *TestContext) WithClientSyncing(t testing.TB, req *ClientCreationRequest, callback func(cli api.TestClient)) {
 	t.Helper()
 	c.WithClientsSyncing(t, []*ClientCreationRequest{req}, func(clients []api.TestClient) {
 		callback(clients[0])
@@ -87,7 +131,7 @@ func (c *TestContext) WithClientSyncing(t *testing.T, req *ClientCreationRequest
 //
 // The callback function is invoked after this, and cleanup functions are called on your behalf when the
 // callback function ends.
-func (c *TestContext) WithClientsSyncing(t *testing.T, reqs []*ClientCreationRequest, callback func(clients []api.TestClient)) {
+func (c *TestContext) WithClientsSyncing(t testing.TB, reqs []*ClientCreationRequest, callback func(clients []api.TestClient)) {
 	t.Helper()
 	cryptoClients := make([]api.TestClient, len(reqs))
 	// Login all clients BEFORE starting any of their sync loops.
@@ -107,7 +151,7 @@ func (c *TestContext) WithClientsSyncing(t *testing.T, reqs []*ClientCreationReq
 }
 
 // mustCreateMultiprocessClient creates a new RPC process and instructs it to create a client given by the client creation options.
-func (c *TestContext) mustCreateMultiprocessClient(t *testing.T, req *ClientCreationRequest) api.TestClient {
+func (c *TestContext) mustCreateMultiprocessClient(t testing.TB, req *ClientCreationRequest) api.TestClient {
 	t.Helper()
 	if c.RPCBinaryPath == "" {
 		t.Skipf("RPC binary path not provided, skipping multiprocess test. To run this test, set COMPLEMENT_CRYPTO_RPC_BINARY")
@@ -126,7 +170,7 @@ func (c *TestContext) mustCreateMultiprocessClient(t *testing.T, req *ClientCrea
 //
 // The callback function is invoked after this, and cleanup functions are called on your behalf when the
 // callback function ends.
-func (c *TestContext) WithAliceSyncing(t *testing.T, callback func(alice api.TestClient)) {
+func (c *TestContext) WithAliceSyncing(t testing.TB, callback func(alice api.TestClient)) {
 	t.Helper()
 	must.NotEqual(t, c.Alice, nil, "No Alice defined. Call CreateTestContext() with at least 1 api.ClientType.")
 	c.WithClientSyncing(t, &ClientCreationRequest{
@@ -139,7 +183,7 @@ func (c *TestContext) WithAliceSyncing(t *testing.T, callback func(alice api.Tes
 //
 // The callback function is invoked after this, and cleanup functions are called on your behalf when the
 // callback function ends.
-func (c *TestContext) WithAliceAndBobSyncing(t *testing.T, callback func(alice, bob api.TestClient)) {
+func (c *TestContext) WithAliceAndBobSyncing(t testing.TB, callback func(alice, bob api.TestClient)) {
 	t.Helper()
 	must.NotEqual(t, c.Bob, nil, "No Bob defined. Call CreateTestContext() with at least 2 api.ClientTypes.")
 	c.WithClientsSyncing(t, []*ClientCreationRequest{
@@ -159,7 +203,7 @@ func (c *TestContext) WithAliceAndBobSyncing(t *testing.T, callback func(alice,
 //
 // The callback function is invoked after this, and cleanup functions are called on your behalf when the
 // callback function ends.
-func (c *TestContext) WithAliceBobAndCharlieSyncing(t *testing.T, callback func(alice, bob, charlie api.TestClient)) {
+func (c *TestContext) WithAliceBobAndCharlieSyncing(t testing.TB, callback func(alice, bob, charlie api.TestClient)) {
 	t.Helper()
 	must.NotEqual(t, c.Charlie, nil, "No Charlie defined. Call CreateTestContext() with at least 3 api.ClientTypes.")
 	c.WithClientsSyncing(t, []*ClientCreationRequest{
@@ -187,8 +231,14 @@ type EncRoomOption = func(reqBody map[string]interface{})
 // - Preset*: the preset argument passed to createRoom (default: "private_chat")
 // - Invite: a list of usernames to invite to the room (default: empty list)
 // - RotationPeriodMsgs: value of the rotation_period_msgs param (default: omitted)
+// - HistoryVisibility: the history_visibility of the room (default: set by the preset)
+// - EncryptStateEvents: encrypt state events as per MSC3414 (default: set by COMPLEMENT_CRYPTO_ENCRYPTED_STATE_EVENTS)
+//
+// If `COMPLEMENT_ENABLE_DIRTY_RUNS` is set, a room created by an earlier test with the same creator and options
+// may be returned instead, which will include that test's messages. The room is renamed after this test, and
+// given a new alias.
 func (c *TestContext) CreateNewEncryptedRoom(
-	t *testing.T,
+	t testing.TB,
 	user *User,
 	options ...EncRoomOption,
 ) (roomID string) {
@@ -209,10 +259,16 @@ func (c *TestContext) CreateNewEncryptedRoom(
 		},
 	}
 
+	if c.encryptStateEvents {
+		EncRoomOptions.EncryptStateEvents()(reqBody)
+	}
 	for _, option := range options {
 		option(reqBody)
 	}
 
+	if c.fixtures != nil {
+		return c.fixtures.createRoom(t, user.CSAPI, reqBody)
+	}
 	return user.MustCreateRoom(t, reqBody)
 }
 
@@ -275,6 +331,32 @@ func (encRoomOptions) RotationPeriodMs(milliseconds int) EncRoomOption {
 	}
 }
 
+// An option for CreateNewEncryptedRoom that enables encrypted state events as per MSC3414, by adding the
+// unstable `io.element.msc3414.encrypt_state_events` field to the `m.room.encryption` event supplied when
+// the room is created. Clients which do not support MSC3414 will ignore this and send state in the clear.
+func (encRoomOptions) EncryptStateEvents() EncRoomOption {
+	return func(reqBody map[string]interface{}) {
+		var initial_state = reqBody["initial_state"].([]map[string]interface{})
+		var event = initial_state[0]
+		var content = event["content"].(map[string]interface{})
+		content["io.element.msc3414.encrypt_state_events"] = true
+	}
+}
+
+// An option for CreateNewEncryptedRoom that adds an `m.room.history_visibility` event
+// with the given `history_visibility` to the initial state, overriding the preset.
+func (encRoomOptions) HistoryVisibility(historyVisibility string) EncRoomOption {
+	return func(reqBody map[string]interface{}) {
+		reqBody["initial_state"] = append(reqBody["initial_state"].([]map[string]interface{}), map[string]interface{}{
+			"type":      "m.room.history_visibility",
+			"state_key": "",
+			"content": map[string]interface{}{
+				"history_visibility": historyVisibility,
+			},
+		})
+	}
+}
+
 // MustRegisterNewDevice logs in a new device for this client, else fails the test.
 func (c *TestContext) MustRegisterNewDevice(t *testing.T, user *User, newDeviceID string) *User {
 	newDevice := c.Deployment.Login(t, user.ClientType.HS, user.CSAPI, helpers.LoginOpts{
@@ -282,13 +364,14 @@ func (c *TestContext) MustRegisterNewDevice(t *testing.T, user *User, newDeviceI
 		Password: user.Password, // TODO: remove? not needed as inherited from client?
 	})
 	return &User{
-		CSAPI:      newDevice,
-		ClientType: user.ClientType,
+		CSAPI:        newDevice,
+		ClientType:   user.ClientType,
+		StoreBackend: user.StoreBackend,
 	}
 }
 
 // MustLoginClient is the same as MustCreateClient but also logs in the client.
-func (c *TestContext) MustLoginClient(t *testing.T, req *ClientCreationRequest) api.TestClient {
+func (c *TestContext) MustLoginClient(t testing.TB, req *ClientCreationRequest) api.TestClient {
 	t.Helper()
 	client := c.MustCreateClient(t, req)
 	must.NotError(t, "failed to login client", client.Login(t, client.Opts()))
@@ -297,7 +380,7 @@ func (c *TestContext) MustLoginClient(t *testing.T, req *ClientCreationRequest)
 
 // MustCreateClient creates an api.Client from an existing Complement client and the specified client type. Additional options
 // can be set to configure the client beyond that of the Complement client e.g to add persistent storage.
-func (c *TestContext) MustCreateClient(t *testing.T, req *ClientCreationRequest) api.TestClient {
+func (c *TestContext) MustCreateClient(t testing.TB, req *ClientCreationRequest) api.TestClient {
 	t.Helper()
 	if req.User == nil {
 		ct.Fatalf(t, "MustCreateClient: ClientCreationRequest missing 'user', register one with RegisterNewUser or use an existing one.")
@@ -305,18 +388,38 @@ func (c *TestContext) MustCreateClient(t *testing.T, req *ClientCreationRequest)
 	opts := api.NewClientCreationOpts(req.User.CSAPI)
 	// now apply the supplied opts on top
 	opts.Combine(&req.Opts)
+	if opts.FFIWatchdogTimeout == 0 {
+		opts.FFIWatchdogTimeout = c.ffiWatchdogTimeout
+	}
+	if c.failOnFFILeaks {
+		opts.FailOnFFILeaks = true
+	}
+	if opts.BackupAlgorithm == api.BackupAlgorithmDefault {
+		opts.BackupAlgorithm = c.BackupAlgorithm
+	}
+	if opts.StoreBackend == api.StoreBackendDefault {
+		opts.StoreBackend = req.User.StoreBackend
+	}
+	if c.SlidingSyncMode == api.SlidingSyncModeProxy && req.User.ClientType.Lang == api.ClientTypeRust && opts.SlidingSyncURL == "" {
+		opts.SlidingSyncURL = c.Deployment.SlidingSyncProxyURL(t, req.User.ClientType.HS)
+	}
+	var client api.TestClient
 	if req.Multiprocess {
 		req.Opts = opts
-		return c.mustCreateMultiprocessClient(t, req)
+		client = c.mustCreateMultiprocessClient(t, req)
+	} else {
+		client = mustCreateClient(t, req.User.ClientType, opts)
+	}
+	if c.decryptionTracker != nil || c.deliveryTracker != nil {
+		client = api.NewTestClient(newReportingClient(client, c.decryptionTracker, c.deliveryTracker))
 	}
-	client := mustCreateClient(t, req.User.ClientType, opts)
 	return client
 }
 
 // mustCreateClient creates an api.Client with the specified language/server, else fails the test.
 //
 // Options can be provided to configure clients, such as enabling persistent storage.
-func mustCreateClient(t *testing.T, clientType api.ClientType, cfg api.ClientCreationOpts) api.TestClient {
+func mustCreateClient(t testing.TB, clientType api.ClientType, cfg api.ClientCreationOpts) api.TestClient {
 	bindings := langs.GetLanguageBindings(clientType.Lang)
 	if bindings == nil {
 		t.Fatalf("unknown language: %s", clientType.Lang)
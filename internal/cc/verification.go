@@ -0,0 +1,76 @@
+package cc
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement/ct"
+)
+
+// MustVerifyInRoom verifies the verifiee's user identity using SAS, with the verification request sent as an event
+// in the given room rather than as a to-device message, then fails the test unless both sides reach the done stage.
+// The room should be an encrypted DM between the two users, which both users have joined. The emoji shown to both
+// users must match. Skips the test if the verifier cannot send in-room verification requests.
+func MustVerifyInRoom(t *testing.T, verifier, verifiee api.TestClient, roomID string) {
+	t.Helper()
+	verifieeStages := verifiee.ListenForVerificationRequests(t)
+	verifierStages, err := verifier.RequestUserVerification(t, verifiee.UserID(), roomID)
+	if err != nil {
+		if errors.Is(err, api.ErrNotSupported) {
+			t.Skipf("%s cannot send in-room verification requests: %s", verifier.Type(), err)
+		}
+		ct.Fatalf(t, "MustVerifyInRoom: RequestUserVerification: %s", err)
+	}
+	var verifierSAS, verifieeSAS api.VerificationStageTransitioned
+	verifierDone, verifieeDone := false, false
+	approveIfBothTransitioned := func() {
+		if verifierSAS == nil || verifieeSAS == nil {
+			return
+		}
+		verifierEmoji := verifierSAS.VerificationData().Emojis
+		verifieeEmoji := verifieeSAS.VerificationData().Emojis
+		if !slices.Equal(verifierEmoji, verifieeEmoji) {
+			ct.Fatalf(t, "MustVerifyInRoom: emoji mismatch: verifier %v verifiee %v", verifierEmoji, verifieeEmoji)
+		}
+		verifierSAS.Approve()
+		verifieeSAS.Approve()
+	}
+	for !verifierDone || !verifieeDone {
+		select {
+		case stage := <-verifieeStages:
+			switch stage := stage.(type) {
+			case api.VerificationStageRequestedReceiver:
+				t.Logf("MustVerifyInRoom: [verifiee] received request %+v", stage.Request())
+				stage.Ready()
+			case api.VerificationStageStart:
+				stage.Transition()
+			case api.VerificationStageTransitioned:
+				verifieeSAS = stage
+				approveIfBothTransitioned()
+			case api.VerificationStageDone:
+				verifieeDone = true
+			case api.VerificationStageCancelled:
+				ct.Fatalf(t, "MustVerifyInRoom: %s cancelled the verification", verifiee.UserID())
+			}
+		case stage := <-verifierStages:
+			switch stage := stage.(type) {
+			case api.VerificationStageReady:
+				stage.Start("m.sas.v1")
+			case api.VerificationStageStart:
+				stage.Transition()
+			case api.VerificationStageTransitioned:
+				verifierSAS = stage
+				approveIfBothTransitioned()
+			case api.VerificationStageDone:
+				verifierDone = true
+			case api.VerificationStageCancelled:
+				ct.Fatalf(t, "MustVerifyInRoom: %s cancelled the verification", verifier.UserID())
+			}
+		case <-time.After(10 * time.Second):
+			ct.Fatalf(t, "MustVerifyInRoom: timed out after 10s: verifier done=%v verifiee done=%v", verifierDone, verifieeDone)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package cc
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/deploy"
+	"github.com/matrix-org/complement/ct"
+)
+
+// MustSendMessageWithheldFromUnverified sends a message as sender, then fails the test unless the sender sent
+// m.room_key.withheld with the code m.unverified to the receiver's device instead of the room key. If the receiver
+// exposes withheld codes, this also waits until the receiver fails to decrypt the message and reports the code.
+// Returns the event ID of the message. The sender must only be sending room keys to verified devices, and the
+// receiver must not be verified by the sender.
+func (c *TestContext) MustSendMessageWithheldFromUnverified(t *testing.T, sender, receiver api.TestClient, roomID, text string) string {
+	t.Helper()
+	eventID, _ := c.mustSendMessageWithheld(t, "MustSendMessageWithheldFromUnverified", sender, receiver, roomID, text, string(api.WithheldCodeUnverified))
+	if receiver.Type() != api.ClientTypeNio { // nio does not expose withheld codes
+		MustHaveWithheldCode(t, receiver, roomID, eventID, api.WithheldCodeUnverified)
+	}
+	return eventID
+}
+
+// MustSendMessageWithheldFromBlacklisted sends a message as sender, then fails the test unless the sender sent
+// m.room_key.withheld with the code m.blacklisted to the receiver's device, and did not send it any encrypted
+// to-device messages, so the room key cannot have been shared with it. If the receiver exposes withheld codes, this
+// also waits until the receiver fails to decrypt the message because the key was withheld. Returns the event ID of
+// the message. The sender must have blacklisted the receiver's device via BlacklistDevice.
+func (c *TestContext) MustSendMessageWithheldFromBlacklisted(t *testing.T, sender, receiver api.TestClient, roomID, text string) string {
+	t.Helper()
+	eventID, toDeviceLog := c.mustSendMessageWithheld(t, "MustSendMessageWithheldFromBlacklisted", sender, receiver, roomID, text, "m.blacklisted")
+	encrypted := toDeviceLog.Filter(func(msg deploy.ToDeviceMessage) bool {
+		return msg.EventType == "m.room.encrypted" && msg.UserID == receiver.UserID() && msg.DeviceID == receiver.Opts().DeviceID
+	})
+	if len(encrypted) > 0 {
+		ct.Fatalf(t, "MustSendMessageWithheldFromBlacklisted: %s sent %d encrypted to-device messages to blacklisted device %s (%s)",
+			sender.UserID(), len(encrypted), receiver.UserID(), receiver.Opts().DeviceID)
+	}
+	if receiver.Type() != api.ClientTypeNio { // nio does not expose withheld codes
+		// SDKs do not distinguish m.blacklisted from other codes
+		MustHaveWithheldCode(t, receiver, roomID, eventID, api.WithheldCodeOther)
+	}
+	return eventID
+}
+
+// mustSendMessageWithheld sends a message as sender whilst sniffing to-device messages, then fails the test unless
+// the sender sent m.room_key.withheld with the given code to the receiver's device. Returns the event ID of the
+// message and the sniffed to-device messages.
+func (c *TestContext) mustSendMessageWithheld(t *testing.T, caller string, sender, receiver api.TestClient, roomID, text, code string) (string, *deploy.ToDeviceLog) {
+	t.Helper()
+	var eventID string
+	toDeviceLog := c.Deployment.SniffToDevice(t, func() {
+		eventID = sender.MustSendMessage(t, roomID, text)
+	})
+	withheld := toDeviceLog.Filter(func(msg deploy.ToDeviceMessage) bool {
+		return msg.EventType == "m.room_key.withheld" && msg.UserID == receiver.UserID() && msg.DeviceID == receiver.Opts().DeviceID
+	})
+	if len(withheld) == 0 {
+		ct.Fatalf(t, "%s: %s did not send m.room_key.withheld to %s (%s)",
+			caller, sender.UserID(), receiver.UserID(), receiver.Opts().DeviceID)
+	}
+	var content struct {
+		Code string `json:"code"`
+	}
+	if err := json.Unmarshal(withheld[0].Content, &content); err != nil {
+		ct.Fatalf(t, "%s: failed to parse withheld content: %s", caller, err)
+	}
+	if content.Code != code {
+		ct.Fatalf(t, "%s: wrong withheld code: got %q want %q", caller, content.Code, code)
+	}
+	return eventID, toDeviceLog
+}
+
+// MustHaveWithheldCode waits until the client has seen the event, then fails the test unless the client could not
+// decrypt it because the room key was withheld with the given code. Not all SDKs expose withheld codes.
+func MustHaveWithheldCode(t *testing.T, client api.TestClient, roomID, eventID string, code api.WithheldCode) {
+	t.Helper()
+	ev := MustFailToDecryptWithReason(t, client, roomID, eventID, api.DecryptionFailureReasonWithheld)
+	if ev.WithheldCode != code {
+		ct.Fatalf(t, "MustHaveWithheldCode: %s has wrong withheld code for %s: got %q want %q", client.UserID(), eventID, ev.WithheldCode, code)
+	}
+}
@@ -3,7 +3,10 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/matrix-org/complement-crypto/internal/api"
 	"github.com/matrix-org/complement-crypto/internal/api/langs"
@@ -23,6 +26,8 @@ type ComplementCrypto struct {
 	//  - `r`: Run a Rust SDK FFI client on hs1.
 	//  - `J`: Run a JS SDK client on hs2.
 	//  - `R`: Run a Rust SDK FFI client on hs2.
+	//  - `n`: Run a matrix-nio (Python) client on hs1.
+	//  - `N`: Run a matrix-nio (Python) client on hs2.
 	// ```
 	// For example, for a simple "Alice and Bob" test:
 	// ```
@@ -32,6 +37,36 @@ type ComplementCrypto struct {
 	// If the matrix only consists of one letter (e.g all j's) then rust-specific tests will not run and vice versa.
 	TestClientMatrix [][2]api.ClientType
 
+	// Name: COMPLEMENT_CRYPTO_BACKUP_ALGORITHMS
+	// Default: m.megolm_backup.v1.curve25519-aes-sha2
+	// Description: A comma separated list of key backup algorithms to run key backup tests with. Key backup tests which use
+	// `BackupAlgorithmMatrix` are run for each algorithm for every permutation in the test client matrix, with the first client
+	// creating the backup and the second restoring it. This catches interop failures when one SDK creates a backup with an
+	// algorithm another SDK cannot restore. Valid values are `m.megolm_backup.v1.curve25519-aes-sha2` and the MSC3270
+	// `org.matrix.msc3270.v1.aes-hmac-sha2`. Tests are skipped for clients which cannot create backups with the algorithm.
+	BackupAlgorithms []api.BackupAlgorithm
+
+	// Name: COMPLEMENT_CRYPTO_SLIDING_SYNC_MODES
+	// Default: native
+	// Description: A comma separated list of the ways rust clients do sliding sync in tests which use `SlidingSyncModeMatrix`.
+	// Each test is run for each mode for every permutation in the test client matrix which has a rust client. Valid values
+	// are `native`, which uses simplified sliding sync (MSC4186) on the homeserver, and `proxy`, which uses a sliding sync
+	// proxy in front of the homeserver. The proxy syncs via sync v2, so room keys and other to-device messages arrive at
+	// different times to native sliding sync. The proxy is deployed the first time a test needs it.
+	SlidingSyncModes []api.SlidingSyncMode
+
+	// Name: COMPLEMENT_CRYPTO_STORE_BACKENDS
+	// Default: ""
+	// Description: A comma separated list of client store backends to run tests which use `StoreBackendMatrix` with.
+	// Each test is run for every combination of these backends which the two clients support, for every permutation in
+	// the test client matrix. Several bugs only reproduce with persistent stores, so this checks SDKs behave the same
+	// regardless of where they store crypto and room state. Valid values are `sqlite` (rust), `memory` (rust and JS)
+	// and `indexeddb` (JS). Rust clients use SQLite by default. The JS SDK keeps the sync store in memory and the crypto
+	// store in IndexedDB by default, whereas `memory` and `indexeddb` use the same backend for both. Clients which
+	// support none of the backends use their default. If this environment variable is not supplied, every client uses
+	// its default backend.
+	StoreBackends []api.StoreBackend
+
 	// Which languages should be tested in ForEachClientType tests.
 	// Derived from TestClientMatrix
 	clientLangs map[api.ClientTypeLang]bool
@@ -49,9 +84,196 @@ type ComplementCrypto struct {
 	// clients will be skipped, making this environment variable optional.
 	RPCBinaryPath string
 
+	// Name: COMPLEMENT_CRYPTO_BENCHMARK_REPORT
+	// Default: ""
+	// Description: The path to write benchmark results to as JSON, when running the benchmarks in `./tests/benchmarks`
+	// with `go test -bench`. If this environment variable is not supplied, results are only printed by `go test`.
+	BenchmarkReport string
+
+	// Name: COMPLEMENT_CRYPTO_LOG_ARTIFACTS_DIR
+	// Default: ./logs/failed
+	// Description: The directory to write log bundles to when a test fails. Each bundle contains the logs from every
+	// client in the test, tagged with the test and client name and ordered by time. Rust SDK tracing logs are not
+	// included, as they are written directly to `./logs` by the SDK.
+	LogArtifactsDir string
+
+	// Name: COMPLEMENT_CRYPTO_NUM_HOMESERVERS
+	// Default: 2
+	// Description: The number of homeservers to deploy, which must be at least 2. Homeservers are named `hs1`, `hs2`, `hs3`
+	// and so on, and all of them are reverse proxied via mitmproxy. Tests which need more homeservers than this, e.g
+	// to test federation across 3 servers, will be skipped. The test client matrix can only place clients on `hs1` and `hs2`.
+	NumHomeservers int
+
+	// Name: COMPLEMENT_CRYPTO_DEPLOYMENT_POOL_SIZE
+	// Default: 1
+	// Description: The maximum number of deployments to run at once. Tests which call `Instance.Parallel` run in parallel
+	// with other such tests, and each one exclusively leases a deployment from this pool, so tests never share homeservers or
+	// mitmproxy with another test running at the same time. Deployments are created on first use and reused by later tests.
+	// Each deployment runs `COMPLEMENT_CRYPTO_NUM_HOMESERVERS` homeservers, so this trades memory for speed. Parallel tests run
+	// one at a time with the default of 1. `go test -parallel` must be at least this value for every deployment to be used.
+	DeploymentPoolSize int
+
+	// Name: COMPLEMENT_CRYPTO_TRAFFIC_RECORDINGS_DIR
+	// Default: ""
+	// Description: The directory to write HTTP traffic recordings to when a test fails. Each recording contains every
+	// HTTP request and response which passed through mitmproxy during the test, and can be replayed offline via
+	// `go run ./cmd/replay` to reproduce flakes. If this environment variable is not supplied, traffic is not recorded.
+	TrafficRecordingsDir string
+
+	// Name: COMPLEMENT_CRYPTO_FFI_WATCHDOG_TIMEOUT
+	// Default: 2m
+	// Description: The maximum time a single call into the Rust SDK FFI bindings can take before the test is failed, as a
+	// Go duration e.g `30s`. When this happens, the call which hung and the state of the client's listeners are logged,
+	// which is more useful than the goroutine dump from the global `go test` timeout. Set to `0` to disable the watchdog.
+	FFIWatchdogTimeout time.Duration
+
+	// Name: COMPLEMENT_CRYPTO_MAX_DELIVERY_LATENCY_P95
+	// Default: ""
+	// Description: The maximum 95th percentile time between a test client sending a message and another test client
+	// decrypting it, as a Go duration e.g `5s`. Latencies are collected across the whole test suite for each pair of SDKs
+	// e.g rust to js, and a histogram for each pair is printed at the end of the run. This catches systemic slowdowns
+	// introduced by SDK changes, which individual tests tolerate as they wait for several seconds. Once a pair of SDKs has
+	// at least 20 messages, the test which pushes its 95th percentile over this value fails. If this environment variable
+	// is not supplied, the histograms are printed but tests never fail.
+	MaxDeliveryLatencyP95 time.Duration
+
+	// Name: COMPLEMENT_CRYPTO_FFI_LEAKS
+	// Default: warn
+	// Description: What to do when a Rust SDK client is closed whilst FFI objects it made (sync services, timeline
+	// listeners, task handles, etc) have not been destroyed. Leaked listeners keep running after the test ends, and
+	// can cause hangs or panics in later tests. Valid values are `warn`, which logs the leaked objects, and `fail`,
+	// which also fails the test.
+	FailOnFFILeaks bool
+
+	// Name: COMPLEMENT_CRYPTO_MEMORY_BUDGET
+	// Default: ""
+	// Description: The maximum resident memory in MiB which the test process and its child processes (browsers running
+	// the JS SDK, nio and RPC clients) may use whilst a test runs. The rust SDK is included in the test process. Memory is
+	// sampled every 500ms whilst each test runs, and the peak is logged. This detects SDKs using far more memory than
+	// expected, e.g crypto stores which grow without bound under message load. Memory is measured for the whole process,
+	// so parallel tests count towards each other's budget. Only works on Linux. If this environment variable is not
+	// supplied, memory is not monitored.
+	MemoryBudgetMiB uint64
+
+	// Name: COMPLEMENT_CRYPTO_MEMORY_OVER_BUDGET
+	// Default: warn
+	// Description: What to do when a test exceeds `COMPLEMENT_CRYPTO_MEMORY_BUDGET`. Valid values are `warn`, which logs
+	// the peak memory usage, and `fail`, which also fails the test.
+	FailOverMemoryBudget bool
+
+	// Name: COMPLEMENT_CRYPTO_WAIT_TIMEOUT_MULTIPLIER
+	// Default: 1
+	// Description: A number which every timeout tests wait for events, backup states or device lists with is multiplied
+	// by, e.g `2.5`. Use this to give slow CI machines more time, rather than increasing the timeouts in individual tests.
+	// Values below 1 are treated as 1.
+	WaitTimeoutMultiplier float64
+
+	// Name: COMPLEMENT_CRYPTO_WAIT_DEFAULT_TIMEOUT
+	// Default: 5s
+	// Description: How long tests wait when they do not give a timeout, as a Go duration e.g `10s`. This is also
+	// multiplied by `COMPLEMENT_CRYPTO_WAIT_TIMEOUT_MULTIPLIER`.
+	WaitDefaultTimeout time.Duration
+
+	// Name: COMPLEMENT_CRYPTO_WAIT_FEDERATION_TIMEOUT
+	// Default: 30s
+	// Description: How long tests wait for things which depend on federation recovering from an outage, as a Go duration
+	// e.g `1m`. Federation retries are subject to backoff, so this is much longer than other timeouts. This is also
+	// multiplied by `COMPLEMENT_CRYPTO_WAIT_TIMEOUT_MULTIPLIER`.
+	WaitFederationTimeout time.Duration
+
+	// Name: COMPLEMENT_CRYPTO_WAIT_OBSERVE_INTERVAL
+	// Default: 5s
+	// Description: How long tests wait before logging that they are still waiting, as a Go duration. Each later log is
+	// made after twice as long as the previous one, and includes the client's sync state where known, which helps tell
+	// slow CI machines apart from stuck clients. Set to `0` to disable these logs.
+	WaitObserveInterval time.Duration
+
+	// Name: COMPLEMENT_CRYPTO_JS_SDK
+	// Default: ""
+	// Description: The version of matrix-js-sdk for JS clients to run, instead of the version bundled in
+	// `internal/api/js/chrome/dist`. This lets JS SDK developers test a branch without running `./rebuild_js_sdk.sh`.
+	// The SDK is installed with `yarn` and bundled when the tests start, which requires `yarn` on the PATH. Valid values are a
+	// path to a local matrix-js-sdk checkout starting with `/` or `.` e.g `../matrix-js-sdk`, which must have been built
+	// with `yarn install && yarn build`. Relative paths are relative to the directory of the tests being run e.g `./tests`.
+	// Otherwise, the value is a branch, tag or commit of https://github.com/matrix-org/matrix-js-sdk e.g `develop`,
+	// or a package which is given to `yarn add` as-is e.g `matrix-js-sdk@34.0.0`. Multiprocess JS clients run by
+	// `COMPLEMENT_CRYPTO_RPC_BINARY` always use the bundled version. If this environment variable is not supplied,
+	// the bundled version is used.
+	JSSDK string
+
+	// Name: COMPLEMENT_CRYPTO_LIBFAKETIME
+	// Default: ""
+	// Description: The absolute path to `libfaketime.so.1` on the host, which is needed by tests which run a homeserver
+	// with a skewed clock. It is copied into the homeserver container, so must be built for the same architecture and
+	// C library as the homeserver image e.g `/usr/lib/x86_64-linux-gnu/faketime/libfaketime.so.1` from the Debian
+	// `libfaketime` package for Synapse images. If this environment variable is not supplied, these tests are skipped.
+	LibfaketimePath string
+
+	// Name: COMPLEMENT_CRYPTO_ROOM_KEY_FIXTURES_DIR
+	// Default: ""
+	// Description: The directory to write room key export fixtures to when running `TestGenerateRoomKeyExportFixtures`.
+	// Each client type in the test client matrix exports its room keys to a fixture file, which can be copied into
+	// `./tests/testdata/room_keys` so every SDK is tested against importing it. Set `COMPLEMENT_CRYPTO_RPC_BINARY` to
+	// generate fixtures from the SDK versions the RPC binary was built with e.g an old pinned rust SDK. If this environment
+	// variable is not supplied, no fixtures are generated.
+	RoomKeyFixturesDir string
+
+	// Name: COMPLEMENT_ENABLE_DIRTY_RUNS
+	// Default: 0
+	// Description: Set to `1` to reuse users and rooms between tests. Registering users and
+	// creating rooms dominates the runtime of small tests. When enabled, users made by `TestContext.RegisterNewUser` and
+	// rooms made by `TestContext.CreateNewEncryptedRoom` are cached, and later tests asking for the same kind of user or room
+	// are given a cached one instead. At the end of each test, users leave any rooms they joined and log out the devices
+	// made by the test. Users and rooms are not reused if the test failed, or if the test changed them e.g by setting up
+	// key backup or changing the room's history visibility. Complement also uses this to reuse homeservers between tests.
+	EnableDirtyRuns bool
+
+	// Name: COMPLEMENT_CRYPTO_ID_NONCE
+	// Default: random
+	// Description: The nonce included in the localpart of every user registered during the test run e.g
+	// `@user-3-k7f2q9-alice:hs1`. Localparts are otherwise allocated from a counter which restarts with each run, so
+	// runs which reuse homeservers from an earlier run would register users which already exist. A random nonce is
+	// used for each run unless this is set, which makes user IDs reproducible e.g to compare the logs of two runs
+	// against fresh homeservers. Must only contain lowercase letters and digits. Tests fail if they are given a user or
+	// device which another test in the same run is using.
+	IDNonce string
+
+	// Name: COMPLEMENT_CRYPTO_ENCRYPTED_STATE_EVENTS
+	// Default: 0
+	// Description: EXPERIMENTAL: Set to `1` to create every room made by `TestContext.CreateNewEncryptedRoom` with
+	// encrypted state events enabled, as per MSC3414. This is used to check that SDKs which are gaining support for
+	// MSC3414 do not regress the existing tests. SDKs which do not support MSC3414 will send state events in the clear.
+	EncryptedStateEvents bool
+
 	MITMProxyAddonsDir string
 }
 
+// WaiterConfig returns the config for every Waiter returned by a TestClient, see api.SetWaiterConfig.
+func (c *ComplementCrypto) WaiterConfig() api.WaiterConfig {
+	return api.WaiterConfig{
+		DefaultTimeout:    c.WaitDefaultTimeout,
+		TimeoutMultiplier: c.WaitTimeoutMultiplier,
+		FederationTimeout: c.WaitFederationTimeout,
+		ObserveInterval:   c.WaitObserveInterval,
+	}
+}
+
+// StoreBackendsFor returns the backends in StoreBackends which clients of the given language support. If they
+// support none of them, the default backend is returned.
+func (c *ComplementCrypto) StoreBackendsFor(lang api.ClientTypeLang) []api.StoreBackend {
+	supported := api.SupportedStoreBackends(lang)
+	var backends []api.StoreBackend
+	for _, backend := range c.StoreBackends {
+		if slices.Contains(supported, backend) {
+			backends = append(backends, backend)
+		}
+	}
+	if len(backends) == 0 {
+		return []api.StoreBackend{api.StoreBackendDefault}
+	}
+	return backends
+}
+
 func (c *ComplementCrypto) ShouldTest(lang api.ClientTypeLang) bool {
 	return c.clientLangs[lang]
 }
@@ -109,6 +331,18 @@ func NewComplementCryptoConfigFromEnvVars(relativePathToMITMAddonsDir string) *C
 					HS:   "hs2",
 				}
 				clientLangs[api.ClientTypeRust] = true
+			case 'n':
+				testCase[i] = api.ClientType{
+					Lang: api.ClientTypeNio,
+					HS:   "hs1",
+				}
+				clientLangs[api.ClientTypeNio] = true
+			case 'N':
+				testCase[i] = api.ClientType{
+					Lang: api.ClientTypeNio,
+					HS:   "hs2",
+				}
+				clientLangs[api.ClientTypeNio] = true
 			default:
 				panic("COMPLEMENT_CRYPTO_TEST_CLIENT_MATRIX bad value: " + val)
 			}
@@ -118,22 +352,176 @@ func NewComplementCryptoConfigFromEnvVars(relativePathToMITMAddonsDir string) *C
 	if len(testClientMatrix) == 0 {
 		panic("COMPLEMENT_CRYPTO_TEST_CLIENT_MATRIX: no tests will run as no matrix values are set")
 	}
+	var backupAlgorithms []api.BackupAlgorithm
+	if val := os.Getenv("COMPLEMENT_CRYPTO_BACKUP_ALGORITHMS"); val != "" {
+		for _, alg := range strings.Split(val, ",") {
+			switch algorithm := api.BackupAlgorithm(alg); algorithm {
+			case api.BackupAlgorithmCurve25519AESSHA2, api.BackupAlgorithmAESHMACSHA2:
+				backupAlgorithms = append(backupAlgorithms, algorithm)
+			default:
+				panic("COMPLEMENT_CRYPTO_BACKUP_ALGORITHMS bad value: " + alg)
+			}
+		}
+	} else {
+		backupAlgorithms = []api.BackupAlgorithm{api.BackupAlgorithmCurve25519AESSHA2}
+	}
+	var slidingSyncModes []api.SlidingSyncMode
+	if val := os.Getenv("COMPLEMENT_CRYPTO_SLIDING_SYNC_MODES"); val != "" {
+		for _, m := range strings.Split(val, ",") {
+			switch mode := api.SlidingSyncMode(m); mode {
+			case api.SlidingSyncModeNative, api.SlidingSyncModeProxy:
+				slidingSyncModes = append(slidingSyncModes, mode)
+			default:
+				panic("COMPLEMENT_CRYPTO_SLIDING_SYNC_MODES bad value: " + m)
+			}
+		}
+	} else {
+		slidingSyncModes = []api.SlidingSyncMode{api.SlidingSyncModeNative}
+	}
+	var storeBackends []api.StoreBackend
+	if val := os.Getenv("COMPLEMENT_CRYPTO_STORE_BACKENDS"); val != "" {
+		for _, b := range strings.Split(val, ",") {
+			switch backend := api.StoreBackend(b); backend {
+			case api.StoreBackendSQLite, api.StoreBackendInMemory, api.StoreBackendIndexedDB:
+				storeBackends = append(storeBackends, backend)
+			default:
+				panic("COMPLEMENT_CRYPTO_STORE_BACKENDS bad value: " + b)
+			}
+		}
+	}
 	rpcBinaryPath := os.Getenv("COMPLEMENT_CRYPTO_RPC_BINARY")
 	if rpcBinaryPath != "" {
 		if _, err := os.Stat(rpcBinaryPath); err != nil {
 			panic("COMPLEMENT_CRYPTO_RPC_BINARY must be the absolute path to a binary file: " + err.Error())
 		}
 	}
+	libfaketimePath := os.Getenv("COMPLEMENT_CRYPTO_LIBFAKETIME")
+	if libfaketimePath != "" {
+		if _, err := os.Stat(libfaketimePath); err != nil {
+			panic("COMPLEMENT_CRYPTO_LIBFAKETIME must be the absolute path to libfaketime.so.1: " + err.Error())
+		}
+	}
+	idNonce := os.Getenv("COMPLEMENT_CRYPTO_ID_NONCE")
+	if strings.Trim(idNonce, "abcdefghijklmnopqrstuvwxyz0123456789") != "" {
+		panic("COMPLEMENT_CRYPTO_ID_NONCE must only contain lowercase letters and digits: " + idNonce)
+	}
+	logArtifactsDir := os.Getenv("COMPLEMENT_CRYPTO_LOG_ARTIFACTS_DIR")
+	if logArtifactsDir == "" {
+		logArtifactsDir = "./logs/failed"
+	}
+	numHomeservers := 2
+	if val := os.Getenv("COMPLEMENT_CRYPTO_NUM_HOMESERVERS"); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 2 {
+			panic("COMPLEMENT_CRYPTO_NUM_HOMESERVERS must be a number >= 2: " + val)
+		}
+		numHomeservers = n
+	}
+	deploymentPoolSize := 1
+	if val := os.Getenv("COMPLEMENT_CRYPTO_DEPLOYMENT_POOL_SIZE"); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 1 {
+			panic("COMPLEMENT_CRYPTO_DEPLOYMENT_POOL_SIZE must be a number >= 1: " + val)
+		}
+		deploymentPoolSize = n
+	}
+	ffiWatchdogTimeout := 2 * time.Minute
+	if val := os.Getenv("COMPLEMENT_CRYPTO_FFI_WATCHDOG_TIMEOUT"); val != "" {
+		d, err := time.ParseDuration(val)
+		if err != nil || d < 0 {
+			panic("COMPLEMENT_CRYPTO_FFI_WATCHDOG_TIMEOUT must be a duration e.g 30s: " + val)
+		}
+		ffiWatchdogTimeout = d
+	}
+	var maxDeliveryLatencyP95 time.Duration
+	if val := os.Getenv("COMPLEMENT_CRYPTO_MAX_DELIVERY_LATENCY_P95"); val != "" {
+		d, err := time.ParseDuration(val)
+		if err != nil || d <= 0 {
+			panic("COMPLEMENT_CRYPTO_MAX_DELIVERY_LATENCY_P95 must be a duration e.g 5s: " + val)
+		}
+		maxDeliveryLatencyP95 = d
+	}
+	var failOnFFILeaks bool
+	switch val := os.Getenv("COMPLEMENT_CRYPTO_FFI_LEAKS"); val {
+	case "", "warn":
+	case "fail":
+		failOnFFILeaks = true
+	default:
+		panic("COMPLEMENT_CRYPTO_FFI_LEAKS must be 'warn' or 'fail': " + val)
+	}
+	var memoryBudgetMiB uint64
+	if val := os.Getenv("COMPLEMENT_CRYPTO_MEMORY_BUDGET"); val != "" {
+		n, err := strconv.ParseUint(val, 10, 64)
+		if err != nil || n == 0 {
+			panic("COMPLEMENT_CRYPTO_MEMORY_BUDGET must be a number of MiB > 0: " + val)
+		}
+		memoryBudgetMiB = n
+	}
+	var failOverMemoryBudget bool
+	switch val := os.Getenv("COMPLEMENT_CRYPTO_MEMORY_OVER_BUDGET"); val {
+	case "", "warn":
+	case "fail":
+		failOverMemoryBudget = true
+	default:
+		panic("COMPLEMENT_CRYPTO_MEMORY_OVER_BUDGET must be 'warn' or 'fail': " + val)
+	}
+	waitTimeoutMultiplier := 1.0
+	if val := os.Getenv("COMPLEMENT_CRYPTO_WAIT_TIMEOUT_MULTIPLIER"); val != "" {
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil || f <= 0 {
+			panic("COMPLEMENT_CRYPTO_WAIT_TIMEOUT_MULTIPLIER must be a number > 0: " + val)
+		}
+		waitTimeoutMultiplier = f
+	}
+	waitDefaultTimeout := parseWaitDuration("COMPLEMENT_CRYPTO_WAIT_DEFAULT_TIMEOUT", api.DefaultWaiterConfig.DefaultTimeout)
+	waitFederationTimeout := parseWaitDuration("COMPLEMENT_CRYPTO_WAIT_FEDERATION_TIMEOUT", api.DefaultWaiterConfig.FederationTimeout)
+	waitObserveInterval := parseWaitDuration("COMPLEMENT_CRYPTO_WAIT_OBSERVE_INTERVAL", api.DefaultWaiterConfig.ObserveInterval)
 	wd, err := os.Getwd()
 	if err != nil {
 		panic("Cannot get current working directory: " + err.Error())
 	}
 
 	return &ComplementCrypto{
-		MITMDump:           os.Getenv("COMPLEMENT_CRYPTO_MITMDUMP"),
-		RPCBinaryPath:      rpcBinaryPath,
-		TestClientMatrix:   testClientMatrix,
-		clientLangs:        clientLangs,
-		MITMProxyAddonsDir: filepath.Join(wd, relativePathToMITMAddonsDir),
+		MITMDump:              os.Getenv("COMPLEMENT_CRYPTO_MITMDUMP"),
+		BenchmarkReport:       os.Getenv("COMPLEMENT_CRYPTO_BENCHMARK_REPORT"),
+		LogArtifactsDir:       logArtifactsDir,
+		NumHomeservers:        numHomeservers,
+		DeploymentPoolSize:    deploymentPoolSize,
+		TrafficRecordingsDir:  os.Getenv("COMPLEMENT_CRYPTO_TRAFFIC_RECORDINGS_DIR"),
+		RoomKeyFixturesDir:    os.Getenv("COMPLEMENT_CRYPTO_ROOM_KEY_FIXTURES_DIR"),
+		WaitTimeoutMultiplier: waitTimeoutMultiplier,
+		WaitDefaultTimeout:    waitDefaultTimeout,
+		WaitFederationTimeout: waitFederationTimeout,
+		WaitObserveInterval:   waitObserveInterval,
+		FFIWatchdogTimeout:    ffiWatchdogTimeout,
+		FailOnFFILeaks:        failOnFFILeaks,
+		MaxDeliveryLatencyP95: maxDeliveryLatencyP95,
+		MemoryBudgetMiB:       memoryBudgetMiB,
+		FailOverMemoryBudget:  failOverMemoryBudget,
+		RPCBinaryPath:         rpcBinaryPath,
+		LibfaketimePath:       libfaketimePath,
+		JSSDK:                 os.Getenv("COMPLEMENT_CRYPTO_JS_SDK"),
+		EnableDirtyRuns:       os.Getenv("COMPLEMENT_ENABLE_DIRTY_RUNS") == "1",
+		IDNonce:               idNonce,
+		EncryptedStateEvents:  os.Getenv("COMPLEMENT_CRYPTO_ENCRYPTED_STATE_EVENTS") == "1",
+		TestClientMatrix:      testClientMatrix,
+		BackupAlgorithms:      backupAlgorithms,
+		SlidingSyncModes:      slidingSyncModes,
+		StoreBackends:         storeBackends,
+		clientLangs:           clientLangs,
+		MITMProxyAddonsDir:    filepath.Join(wd, relativePathToMITMAddonsDir),
+	}
+}
+
+// parseWaitDuration parses the environment variable as a Go duration, returning def if it is not set.
+func parseWaitDuration(name string, def time.Duration) time.Duration {
+	val := os.Getenv(name)
+	if val == "" {
+		return def
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d < 0 {
+		panic(name + " must be a duration e.g 30s: " + val)
 	}
+	return d
 }
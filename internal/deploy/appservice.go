@@ -0,0 +1,53 @@
+package deploy
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	testcontainers "github.com/testcontainers/testcontainers-go"
+)
+
+const appserviceRegistrationPath = "/conf/complement-crypto-appservice.yaml"
+
+// AppserviceHomeserver is a homeserver with an application service registered on it, see NewAppserviceHomeserver.
+type AppserviceHomeserver struct {
+	*Homeserver
+	// The appservice registered on this homeserver, which can puppet users whose localpart starts
+	// with Appservice.PuppetPrefix.
+	Appservice *api.Appservice
+}
+
+// NewAppserviceHomeserver deploys a new homeserver, configured as per NewHomeserverWithConfig, with an
+// application service registered on it. This allows tests to check how SDKs behave when bridged users,
+// who may have many devices, participate in encrypted rooms. Only Synapse images built for Complement
+// can be configured with an application service.
+func (d *ComplementCryptoDeployment) NewAppserviceHomeserver(t *testing.T) *AppserviceHomeserver {
+	t.Helper()
+	as := &api.Appservice{
+		ID:              "complement-crypto",
+		ASToken:         randomHex(t, 32),
+		HSToken:         randomHex(t, 32),
+		SenderLocalpart: "bridge-bot",
+		PuppetPrefix:    "bridged-",
+	}
+	hs := d.newHomeserver(t, homeserverOpts{
+		extraConfigYAML: fmt.Sprintf(`
+app_service_config_files:
+  - %s
+`, appserviceRegistrationPath),
+		extraFiles: []testcontainers.ContainerFile{{
+			Reader:            strings.NewReader(as.RegistrationYAML()),
+			ContainerFilePath: appserviceRegistrationPath,
+			FileMode:          0o644,
+		}},
+	})
+	as.ServerName = hs.ServerName
+	as.BaseURL = hs.BaseURL
+	t.Logf("NewAppserviceHomeserver: %s %s sender=%s", hs.ServerName, hs.BaseURL, as.SenderUserID())
+	return &AppserviceHomeserver{
+		Homeserver: hs,
+		Appservice: as,
+	}
+}
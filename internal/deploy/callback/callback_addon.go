@@ -33,6 +33,9 @@ type Response struct {
 	RespondStatusCode int `json:"respond_status_code,omitempty"`
 	// if set, changes the HTTP response body for this request.
 	RespondBody json.RawMessage `json:"respond_body,omitempty"`
+	// if set by a request callback, the request is sent to the server with this body instead. The
+	// other fields must not be set. Ignored by response callbacks.
+	RewriteRequestBody json.RawMessage `json:"rewrite_request_body,omitempty"`
 }
 
 func (cd Data) String() string {
@@ -0,0 +1,149 @@
+package callback
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// Unbounded can be used as the maximum number of times a choreography step can occur,
+// to indicate there is no upper limit.
+const Unbounded = -1
+
+// ChoreographyStep is a single expected step in a Choreography. A step matches zero or more
+// consecutive requests which match the step's method and path.
+type ChoreographyStep struct {
+	// The HTTP method which must be used for this step to match.
+	// If unset, any method matches.
+	Method string
+	// The URL path must contain this string to match.
+	PathContains string
+	// The minimum number of consecutive matching requests.
+	Min int
+	// The maximum number of consecutive matching requests, or Unbounded.
+	Max int
+}
+
+func (s ChoreographyStep) matches(d Data) bool {
+	if s.Method != "" && !strings.EqualFold(s.Method, d.Method) {
+		return false
+	}
+	return strings.Contains(urlPath(d.URL), s.PathContains)
+}
+
+func (s ChoreographyStep) String() string {
+	method := s.Method
+	if method == "" {
+		method = "*"
+	}
+	if s.Max == Unbounded {
+		return fmt.Sprintf("%s %s {%d,}", method, s.PathContains, s.Min)
+	}
+	return fmt.Sprintf("%s %s {%d,%d}", method, s.PathContains, s.Min, s.Max)
+}
+
+// Choreography is an ordered list of expected requests, each with a range of how many times they
+// are expected to occur. This allows tests to assert protocol-level behaviour e.g "exactly one
+// /keys/claim request is made before sending the room key" in addition to the user-visible outcome.
+//
+// Requests which do not match any step are ignored, so tests only need to specify the endpoints they
+// care about. Requests which match a step must occur in the order specified. Build a choreography with
+// NewChoreography and Expect, then check it against a ProxyLog at the end of the test:
+//
+//	proxyLog := callback.NewProxyLog()
+//	choreography := callback.NewChoreography().
+//		Expect("POST", "/keys/claim", 1, 1).
+//		Expect("PUT", "/sendToDevice/m.room.encrypted", 1, callback.Unbounded).
+//		Expect("PUT", "/send/m.room.encrypted", 1, 1)
+//	// ... intercept with proxyLog.Callback() and run the test ...
+//	choreography.MustMatch(t, proxyLog)
+type Choreography struct {
+	Steps []ChoreographyStep
+}
+
+func NewChoreography() *Choreography {
+	return &Choreography{}
+}
+
+// Expect adds a step to this choreography which matches requests with the given HTTP method (or any
+// method if empty) whose path contains pathContains, occurring between min and max times inclusive.
+// Use Unbounded as max for no upper limit.
+func (c *Choreography) Expect(method, pathContains string, min, max int) *Choreography {
+	c.Steps = append(c.Steps, ChoreographyStep{
+		Method:       method,
+		PathContains: pathContains,
+		Min:          min,
+		Max:          max,
+	})
+	return c
+}
+
+// Match checks the recorded requests against this choreography, returning an error describing
+// the mismatch if they do not match.
+func (c *Choreography) Match(entries []Data) error {
+	// only consider requests which we have an opinion on
+	var relevant []Data
+	for _, d := range entries {
+		for _, step := range c.Steps {
+			if step.matches(d) {
+				relevant = append(relevant, d)
+				break
+			}
+		}
+	}
+	if c.matchFrom(relevant, 0, 0, make(map[[2]int]bool)) {
+		return nil
+	}
+	var got []string
+	for _, d := range relevant {
+		got = append(got, d.Method+" "+urlPath(d.URL))
+	}
+	var want []string
+	for _, step := range c.Steps {
+		want = append(want, step.String())
+	}
+	return fmt.Errorf("requests did not match the expected choreography.\nGot:\n  %s\nWant:\n  %s",
+		strings.Join(got, "\n  "), strings.Join(want, "\n  "))
+}
+
+// matchFrom returns true if entries[i:] match c.Steps[j:]. As steps may overlap, this tries
+// every valid number of matches for each step, remembering failed (i, j) pairs.
+func (c *Choreography) matchFrom(entries []Data, i, j int, failed map[[2]int]bool) bool {
+	if j == len(c.Steps) {
+		return i == len(entries)
+	}
+	if failed[[2]int{i, j}] {
+		return false
+	}
+	step := c.Steps[j]
+	for n := 0; step.Max == Unbounded || n <= step.Max; n++ {
+		if n >= step.Min && c.matchFrom(entries, i+n, j+1, failed) {
+			return true
+		}
+		// can we consume one more entry for this step?
+		if i+n >= len(entries) || !step.matches(entries[i+n]) {
+			break
+		}
+	}
+	failed[[2]int{i, j}] = true
+	return false
+}
+
+// MustMatch checks the requests recorded in the proxy log against this choreography, failing
+// the test if they do not match.
+func (c *Choreography) MustMatch(t ct.TestLike, log *ProxyLog) {
+	t.Helper()
+	if err := c.Match(log.Entries()); err != nil {
+		ct.Fatalf(t, "Choreography.MustMatch: %s", err)
+	}
+}
+
+func urlPath(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	return parsed.Path
+}
@@ -0,0 +1,98 @@
+package callback
+
+import (
+	"strings"
+	"testing"
+)
+
+func requests(reqs ...string) []Data {
+	var entries []Data
+	for _, r := range reqs {
+		method, path, _ := strings.Cut(r, " ")
+		entries = append(entries, Data{
+			Method: method,
+			URL:    "http://hs1" + path + "?access_token=foo",
+		})
+	}
+	return entries
+}
+
+func TestChoreography(t *testing.T) {
+	sendRoomKey := NewChoreography().
+		Expect("POST", "/keys/claim", 1, 1).
+		Expect("PUT", "/sendToDevice/m.room.encrypted", 1, Unbounded).
+		Expect("PUT", "/send/m.room.encrypted", 1, 1)
+	overlapping := NewChoreography().
+		Expect("", "/keys", 0, Unbounded).
+		Expect("POST", "/keys/claim", 1, 1).
+		Expect("POST", "/keys/upload", 0, 1)
+	testCases := []struct {
+		name         string
+		choreography *Choreography
+		entries      []Data
+		wantMatch    bool
+	}{
+		{
+			name:         "exact match",
+			choreography: sendRoomKey,
+			entries:      requests("POST /_matrix/client/v3/keys/claim", "PUT /_matrix/client/v3/sendToDevice/m.room.encrypted/1", "PUT /_matrix/client/v3/rooms/!a:hs1/send/m.room.encrypted/2"),
+			wantMatch:    true,
+		},
+		{
+			name:         "unrelated requests are ignored",
+			choreography: sendRoomKey,
+			entries:      requests("GET /_matrix/client/v3/sync", "POST /_matrix/client/v3/keys/claim", "POST /_matrix/client/v3/keys/query", "PUT /_matrix/client/v3/sendToDevice/m.room.encrypted/1", "PUT /_matrix/client/v3/sendToDevice/m.room.encrypted/2", "PUT /_matrix/client/v3/rooms/!a:hs1/send/m.room.encrypted/3"),
+			wantMatch:    true,
+		},
+		{
+			name:         "too many",
+			choreography: sendRoomKey,
+			entries:      requests("POST /_matrix/client/v3/keys/claim", "POST /_matrix/client/v3/keys/claim", "PUT /_matrix/client/v3/sendToDevice/m.room.encrypted/1", "PUT /_matrix/client/v3/rooms/!a:hs1/send/m.room.encrypted/2"),
+			wantMatch:    false,
+		},
+		{
+			name:         "too few",
+			choreography: sendRoomKey,
+			entries:      requests("PUT /_matrix/client/v3/sendToDevice/m.room.encrypted/1", "PUT /_matrix/client/v3/rooms/!a:hs1/send/m.room.encrypted/2"),
+			wantMatch:    false,
+		},
+		{
+			name:         "wrong order",
+			choreography: sendRoomKey,
+			entries:      requests("POST /_matrix/client/v3/keys/claim", "PUT /_matrix/client/v3/rooms/!a:hs1/send/m.room.encrypted/2", "PUT /_matrix/client/v3/sendToDevice/m.room.encrypted/1"),
+			wantMatch:    false,
+		},
+		{
+			name:         "wrong method",
+			choreography: sendRoomKey,
+			entries:      requests("GET /_matrix/client/v3/keys/claim", "PUT /_matrix/client/v3/sendToDevice/m.room.encrypted/1", "PUT /_matrix/client/v3/rooms/!a:hs1/send/m.room.encrypted/2"),
+			wantMatch:    false,
+		},
+		{
+			name:         "no requests",
+			choreography: NewChoreography().Expect("POST", "/keys/claim", 0, 2),
+			wantMatch:    true,
+		},
+		{
+			name:         "overlapping steps backtrack",
+			choreography: overlapping,
+			entries:      requests("POST /_matrix/client/v3/keys/query", "POST /_matrix/client/v3/keys/claim", "POST /_matrix/client/v3/keys/claim", "POST /_matrix/client/v3/keys/upload"),
+			wantMatch:    true,
+		},
+		{
+			name:         "overlapping steps no match",
+			choreography: overlapping,
+			entries:      requests("POST /_matrix/client/v3/keys/query", "POST /_matrix/client/v3/keys/upload"),
+			wantMatch:    false,
+		},
+	}
+	for _, tc := range testCases {
+		err := tc.choreography.Match(tc.entries)
+		if tc.wantMatch && err != nil {
+			t.Errorf("%s: wanted match, got %s", tc.name, err)
+		}
+		if !tc.wantMatch && err == nil {
+			t.Errorf("%s: wanted no match, got match", tc.name)
+		}
+	}
+}
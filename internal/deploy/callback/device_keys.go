@@ -0,0 +1,140 @@
+package callback
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+)
+
+// DeviceKeySwap rewrites /keys/query responses to replace the identity keys of a single device with keys
+// generated by the test, as a malicious homeserver could. Both the ed25519 and curve25519 keys are replaced,
+// and the device keys are re-signed with the new ed25519 key so the device's self-signature is valid. Any
+// other signatures on the device e.g from the user's self-signing key will no longer be valid.
+//
+// Clients are expected to refuse to update a device they already know about when its ed25519 key changes,
+// and so should never encrypt anything for SpoofedCurve25519.
+//
+// Typically this is used as the ResponseCallback for POST /keys/query requests:
+//
+//	swap := callback.NewDeviceKeySwap(bob.UserID(), bob.Opts().DeviceID)
+//	tc.Deployment.MITM().Configure(t).WithIntercept(mitm.InterceptOpts{
+//		Filter: mitm.FilterParams{
+//			PathContains: "/keys/query",
+//			AccessToken:  alice.CurrentAccessToken(t),
+//		},
+//		ResponseCallback: swap.Callback(),
+//	}, func() { ... })
+type DeviceKeySwap struct {
+	UserID   string
+	DeviceID string
+	// The unpadded base64 keys which replace the device's real keys.
+	SpoofedEd25519    string
+	SpoofedCurve25519 string
+
+	signingKey ed25519.PrivateKey
+	swapped    atomic.Int64
+}
+
+// NewDeviceKeySwap generates new identity keys for the given device.
+func NewDeviceKeySwap(userID, deviceID string) (*DeviceKeySwap, error) {
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("NewDeviceKeySwap: failed to generate ed25519 key: %s", err)
+	}
+	curvePriv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("NewDeviceKeySwap: failed to generate curve25519 key: %s", err)
+	}
+	return &DeviceKeySwap{
+		UserID:            userID,
+		DeviceID:          deviceID,
+		SpoofedEd25519:    base64.RawStdEncoding.EncodeToString(edPub),
+		SpoofedCurve25519: base64.RawStdEncoding.EncodeToString(curvePriv.PublicKey().Bytes()),
+		signingKey:        edPriv,
+	}, nil
+}
+
+// Swapped returns the number of /keys/query responses which have been rewritten.
+func (s *DeviceKeySwap) Swapped() int {
+	return int(s.swapped.Load())
+}
+
+// Callback returns the callback implementation which rewrites /keys/query responses. Responses which
+// do not include the device are passed through unaltered.
+func (s *DeviceKeySwap) Callback() Fn {
+	return func(d Data) *Response {
+		body, err := s.Rewrite(d.ResponseBody)
+		if err != nil || body == nil {
+			return nil
+		}
+		s.swapped.Add(1)
+		return &Response{
+			RespondStatusCode: d.ResponseCode,
+			RespondBody:       body,
+		}
+	}
+}
+
+// Rewrite replaces the device's keys in a /keys/query response body. Returns nil if the response does
+// not include the device.
+func (s *DeviceKeySwap) Rewrite(responseBody json.RawMessage) (json.RawMessage, error) {
+	var body map[string]any
+	if err := unmarshalWithNumbers(responseBody, &body); err != nil {
+		return nil, err
+	}
+	deviceKeys, _ := body["device_keys"].(map[string]any)
+	userDevices, _ := deviceKeys[s.UserID].(map[string]any)
+	device, ok := userDevices[s.DeviceID].(map[string]any)
+	if !ok {
+		return nil, nil
+	}
+	keys, _ := device["keys"].(map[string]any)
+	if keys == nil {
+		return nil, fmt.Errorf("device %s has no keys", s.DeviceID)
+	}
+	keys["ed25519:"+s.DeviceID] = s.SpoofedEd25519
+	keys["curve25519:"+s.DeviceID] = s.SpoofedCurve25519
+
+	// sign everything except signatures and unsigned, as per the spec
+	unsigned, hasUnsigned := device["unsigned"]
+	delete(device, "signatures")
+	delete(device, "unsigned")
+	signed, err := canonicalJSON(device)
+	if err != nil {
+		return nil, err
+	}
+	device["signatures"] = map[string]any{
+		s.UserID: map[string]any{
+			"ed25519:" + s.DeviceID: base64.RawStdEncoding.EncodeToString(ed25519.Sign(s.signingKey, signed)),
+		},
+	}
+	if hasUnsigned {
+		device["unsigned"] = unsigned
+	}
+	return json.Marshal(body)
+}
+
+func unmarshalWithNumbers(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// keep integers exact when re-encoding
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// canonicalJSON encodes v as Matrix canonical JSON. encoding/json already sorts object keys and does not add
+// whitespace, so only HTML escaping needs to be disabled. This does not handle floats, which never appear in
+// device keys.
+func canonicalJSON(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,104 @@
+package callback
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+const keysQueryBody = `{
+	"failures": {},
+	"device_keys": {
+		"@bob:hs1": {
+			"BOBDEVICE": {
+				"algorithms": ["m.olm.v1.curve25519-aes-sha2", "m.megolm.v1.aes-sha2"],
+				"device_id": "BOBDEVICE",
+				"keys": {
+					"curve25519:BOBDEVICE": "realcurve",
+					"ed25519:BOBDEVICE": "realed"
+				},
+				"signatures": {
+					"@bob:hs1": {
+						"ed25519:BOBDEVICE": "realsig",
+						"ed25519:selfsigning": "crosssig"
+					}
+				},
+				"unsigned": {"device_display_name": "Bob's <phone>"},
+				"user_id": "@bob:hs1"
+			}
+		}
+	},
+	"master_keys": {"@bob:hs1": {"usage": ["master"], "user_id": "@bob:hs1", "keys": {"ed25519:m": "m"}}}
+}`
+
+func TestDeviceKeySwap(t *testing.T) {
+	swap, err := NewDeviceKeySwap("@bob:hs1", "BOBDEVICE")
+	if err != nil {
+		t.Fatalf("NewDeviceKeySwap: %s", err)
+	}
+
+	// other devices are not rewritten
+	other, err := NewDeviceKeySwap("@bob:hs1", "OTHERDEVICE")
+	if err != nil {
+		t.Fatalf("NewDeviceKeySwap: %s", err)
+	}
+	res := other.Callback()(Data{ResponseCode: 200, ResponseBody: json.RawMessage(keysQueryBody)})
+	if res != nil {
+		t.Fatalf("rewrote response for a device not in the response: %s", res.RespondBody)
+	}
+
+	res = swap.Callback()(Data{ResponseCode: 200, ResponseBody: json.RawMessage(keysQueryBody)})
+	if res == nil {
+		t.Fatalf("did not rewrite response")
+	}
+	if swap.Swapped() != 1 {
+		t.Fatalf("Swapped: got %d want 1", swap.Swapped())
+	}
+	if res.RespondStatusCode != 200 {
+		t.Fatalf("RespondStatusCode: got %d want 200", res.RespondStatusCode)
+	}
+	body := gjson.ParseBytes(res.RespondBody)
+	device := body.Get(`device_keys.@bob:hs1.BOBDEVICE`)
+	if got := device.Get(`keys.ed25519:BOBDEVICE`).Str; got != swap.SpoofedEd25519 {
+		t.Errorf("ed25519 key: got %s want %s", got, swap.SpoofedEd25519)
+	}
+	if got := device.Get(`keys.curve25519:BOBDEVICE`).Str; got != swap.SpoofedCurve25519 {
+		t.Errorf("curve25519 key: got %s want %s", got, swap.SpoofedCurve25519)
+	}
+	if !device.Get("unsigned").Exists() {
+		t.Errorf("unsigned was removed")
+	}
+	if body.Get(`master_keys.@bob:hs1`).Raw == "" {
+		t.Errorf("master_keys was removed")
+	}
+	sigs := device.Get(`signatures.@bob:hs1`).Map()
+	if len(sigs) != 1 {
+		t.Fatalf("want exactly 1 signature, got %v", sigs)
+	}
+
+	// the self-signature must be valid for the spoofed key
+	var signed map[string]any
+	if err := json.Unmarshal([]byte(device.Raw), &signed); err != nil {
+		t.Fatalf("failed to unmarshal device: %s", err)
+	}
+	delete(signed, "signatures")
+	delete(signed, "unsigned")
+	signedJSON, err := canonicalJSON(signed)
+	if err != nil {
+		t.Fatalf("canonicalJSON: %s", err)
+	}
+	pubKey, err := base64.RawStdEncoding.DecodeString(swap.SpoofedEd25519)
+	if err != nil {
+		t.Fatalf("failed to decode spoofed key: %s", err)
+	}
+	sig, err := base64.RawStdEncoding.DecodeString(sigs["ed25519:BOBDEVICE"].Str)
+	if err != nil {
+		t.Fatalf("failed to decode signature: %s", err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pubKey), signedJSON, sig) {
+		t.Fatalf("signature does not verify with the spoofed key")
+	}
+}
@@ -0,0 +1,560 @@
+package callback
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonPath is a compiled JSONPath expression. Only the commonly used subset of
+// JSONPath is supported:
+//   - $            the root object
+//   - .name        child member, also ['name'] or ["name"]
+//   - .* and [*]   all children
+//   - [n]          array index, negative indexes count from the end
+//   - ..           recursive descent e.g $..event_id
+//   - [?(expr)]    filter children where expr is true e.g [?(@.type=='m.room.encrypted')]
+//
+// Filter expressions support relative paths from '@', string/number/bool/null literals,
+// the comparison operators == != < <= > >=, existence checks (e.g [?(@.state_key)]),
+// negation with !, and combining with && and ||.
+type jsonPath []pathSegment
+
+type selectorKind int
+
+const (
+	selectName selectorKind = iota
+	selectWildcard
+	selectIndex
+	selectFilter
+)
+
+type pathSegment struct {
+	// if true, apply the selector to this node and all of its descendants.
+	recursive bool
+	kind      selectorKind
+	name      string
+	index     int
+	filter    filterExpr
+}
+
+func compileJSONPath(path string) (jsonPath, error) {
+	path = strings.TrimSpace(path)
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("jsonpath %q: must start with '$'", path)
+	}
+	segments, rest, err := parseSegments(path[1:], false)
+	if err != nil {
+		return nil, fmt.Errorf("jsonpath %q: %s", path, err)
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("jsonpath %q: unexpected trailing input %q", path, rest)
+	}
+	return segments, nil
+}
+
+// parseSegments parses as many path segments as it can from s. If inFilter is true,
+// parsing stops at the first character which cannot continue a path, rather than failing.
+func parseSegments(s string, inFilter bool) (jsonPath, string, error) {
+	var segments jsonPath
+	for len(s) > 0 {
+		var seg pathSegment
+		switch {
+		case strings.HasPrefix(s, ".."):
+			seg.recursive = true
+			s = s[2:]
+			if strings.HasPrefix(s, "[") {
+				break // handled as a bracket below
+			}
+			var err error
+			seg, s, err = parseDotSelector(s, seg)
+			if err != nil {
+				return nil, "", err
+			}
+			segments = append(segments, seg)
+			continue
+		case s[0] == '.':
+			var err error
+			seg, s, err = parseDotSelector(s[1:], seg)
+			if err != nil {
+				return nil, "", err
+			}
+			segments = append(segments, seg)
+			continue
+		case s[0] == '[':
+		default:
+			if inFilter {
+				return segments, s, nil
+			}
+			return nil, "", fmt.Errorf("unexpected character %q", s[0])
+		}
+		// bracket selector
+		end, err := findClosingBracket(s)
+		if err != nil {
+			return nil, "", err
+		}
+		inner := strings.TrimSpace(s[1:end])
+		s = s[end+1:]
+		switch {
+		case inner == "*":
+			seg.kind = selectWildcard
+		case strings.HasPrefix(inner, "?"):
+			expr := strings.TrimSpace(inner[1:])
+			if !strings.HasPrefix(expr, "(") || !strings.HasSuffix(expr, ")") {
+				return nil, "", fmt.Errorf("filter %q must be of the form ?(expr)", inner)
+			}
+			f, err := parseFilter(expr[1 : len(expr)-1])
+			if err != nil {
+				return nil, "", err
+			}
+			seg.kind = selectFilter
+			seg.filter = f
+		case strings.HasPrefix(inner, "'") || strings.HasPrefix(inner, `"`):
+			name, rest, err := parseQuoted(inner)
+			if err != nil {
+				return nil, "", err
+			}
+			if strings.TrimSpace(rest) != "" {
+				return nil, "", fmt.Errorf("unexpected input after name in [%s]", inner)
+			}
+			seg.kind = selectName
+			seg.name = name
+		default:
+			i, err := strconv.Atoi(inner)
+			if err != nil {
+				return nil, "", fmt.Errorf("invalid selector [%s]", inner)
+			}
+			seg.kind = selectIndex
+			seg.index = i
+		}
+		segments = append(segments, seg)
+	}
+	return segments, "", nil
+}
+
+func parseDotSelector(s string, seg pathSegment) (pathSegment, string, error) {
+	if strings.HasPrefix(s, "*") {
+		seg.kind = selectWildcard
+		return seg, s[1:], nil
+	}
+	i := 0
+	for i < len(s) && isNameChar(s[i]) {
+		i++
+	}
+	if i == 0 {
+		return seg, "", fmt.Errorf("expected a name after '.'")
+	}
+	seg.kind = selectName
+	seg.name = s[:i]
+	return seg, s[i:], nil
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || c == '-' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// findClosingBracket returns the index of the ']' which closes the '[' at s[0],
+// ignoring any brackets inside quoted strings or nested brackets.
+func findClosingBracket(s string) (int, error) {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if quote != 0 {
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '\'', '"':
+			quote = c
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				return i, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unterminated '['")
+}
+
+// parseQuoted parses a single or double quoted string at the start of s.
+func parseQuoted(s string) (val string, rest string, err error) {
+	quote := s[0]
+	var sb strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) {
+			i++
+			sb.WriteByte(s[i])
+			continue
+		}
+		if c == quote {
+			return sb.String(), s[i+1:], nil
+		}
+		sb.WriteByte(c)
+	}
+	return "", "", fmt.Errorf("unterminated string %s", s)
+}
+
+// Evaluate the path against a decoded JSON value, returning all matches in document order.
+// Object members are visited in sorted key order, as JSON objects have no defined ordering.
+func (p jsonPath) evaluate(root any) []any {
+	nodes := []any{root}
+	for _, seg := range p {
+		var next []any
+		for _, n := range nodes {
+			if seg.recursive {
+				walk(n, func(desc any) {
+					next = append(next, seg.apply(desc)...)
+				})
+			} else {
+				next = append(next, seg.apply(n)...)
+			}
+		}
+		nodes = next
+	}
+	return nodes
+}
+
+func (seg pathSegment) apply(n any) []any {
+	switch seg.kind {
+	case selectName:
+		if obj, ok := n.(map[string]any); ok {
+			if v, exists := obj[seg.name]; exists {
+				return []any{v}
+			}
+		}
+	case selectIndex:
+		if arr, ok := n.([]any); ok {
+			i := seg.index
+			if i < 0 {
+				i += len(arr)
+			}
+			if i >= 0 && i < len(arr) {
+				return []any{arr[i]}
+			}
+		}
+	case selectWildcard:
+		return children(n)
+	case selectFilter:
+		var matches []any
+		for _, child := range children(n) {
+			if truthy(seg.filter.eval(child)) {
+				matches = append(matches, child)
+			}
+		}
+		return matches
+	}
+	return nil
+}
+
+func children(n any) []any {
+	switch v := n.(type) {
+	case []any:
+		return v
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		result := make([]any, 0, len(v))
+		for _, k := range keys {
+			result = append(result, v[k])
+		}
+		return result
+	}
+	return nil
+}
+
+// walk calls fn on n then all descendants of n, depth first.
+func walk(n any, fn func(any)) {
+	fn(n)
+	for _, child := range children(n) {
+		walk(child, fn)
+	}
+}
+
+// filterExpr is a node in a parsed filter expression.
+type filterExpr interface {
+	eval(current any) any
+}
+
+// missing is returned when a relative path does not exist, so that existence
+// checks can tell the difference between a missing key and a JSON null.
+type missingValue struct{}
+
+var missing = missingValue{}
+
+type literalExpr struct{ val any }
+
+func (e literalExpr) eval(current any) any { return e.val }
+
+type pathExpr struct{ path jsonPath }
+
+func (e pathExpr) eval(current any) any {
+	matches := e.path.evaluate(current)
+	if len(matches) == 0 {
+		return missing
+	}
+	return matches[0]
+}
+
+type notExpr struct{ inner filterExpr }
+
+func (e notExpr) eval(current any) any { return !truthy(e.inner.eval(current)) }
+
+type binaryExpr struct {
+	op          string
+	left, right filterExpr
+}
+
+func (e binaryExpr) eval(current any) any {
+	switch e.op {
+	case "&&":
+		return truthy(e.left.eval(current)) && truthy(e.right.eval(current))
+	case "||":
+		return truthy(e.left.eval(current)) || truthy(e.right.eval(current))
+	}
+	l, r := e.left.eval(current), e.right.eval(current)
+	if l == missing || r == missing {
+		// comparisons with things which don't exist are always false, except for !=
+		return e.op == "!=" && l != r
+	}
+	switch e.op {
+	case "==":
+		return jsonEqual(l, r)
+	case "!=":
+		return !jsonEqual(l, r)
+	}
+	switch lv := l.(type) {
+	case float64:
+		rv, ok := r.(float64)
+		if !ok {
+			return false
+		}
+		return compareOrdered(e.op, lv, rv)
+	case string:
+		rv, ok := r.(string)
+		if !ok {
+			return false
+		}
+		return compareOrdered(e.op, lv, rv)
+	}
+	return false
+}
+
+func compareOrdered[T float64 | string](op string, l, r T) bool {
+	switch op {
+	case "<":
+		return l < r
+	case "<=":
+		return l <= r
+	case ">":
+		return l > r
+	case ">=":
+		return l >= r
+	}
+	return false
+}
+
+func jsonEqual(l, r any) bool {
+	switch lv := l.(type) {
+	case nil, bool, float64, string:
+		return l == r
+	case []any:
+		rv, ok := r.([]any)
+		if !ok || len(lv) != len(rv) {
+			return false
+		}
+		for i := range lv {
+			if !jsonEqual(lv[i], rv[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		rv, ok := r.(map[string]any)
+		if !ok || len(lv) != len(rv) {
+			return false
+		}
+		for k := range lv {
+			if !jsonEqual(lv[k], rv[k]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// truthy returns true if the value is considered a match by a filter. Anything
+// which exists is truthy, except for false and null.
+func truthy(v any) bool {
+	switch val := v.(type) {
+	case missingValue, nil:
+		return false
+	case bool:
+		return val
+	}
+	return true
+}
+
+// filterParser is a recursive descent parser for filter expressions:
+//
+//	or    := and ( '||' and )*
+//	and   := unary ( '&&' unary )*
+//	unary := '!' unary | cmp
+//	cmp   := value ( op value )?
+//	value := '(' or ')' | '@' path | literal
+type filterParser struct {
+	s string
+}
+
+func parseFilter(s string) (filterExpr, error) {
+	p := &filterParser{s: s}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.s != "" {
+		return nil, fmt.Errorf("unexpected trailing input in filter: %q", p.s)
+	}
+	return expr, nil
+}
+
+func (p *filterParser) skipSpace() {
+	p.s = strings.TrimLeft(p.s, " \t\n")
+}
+
+func (p *filterParser) consume(tok string) bool {
+	p.skipSpace()
+	if strings.HasPrefix(p.s, tok) {
+		p.s = p.s[len(tok):]
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) parseOr() (filterExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.consume("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.consume("&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterExpr, error) {
+	p.skipSpace()
+	if strings.HasPrefix(p.s, "!") && !strings.HasPrefix(p.s, "!=") {
+		p.s = p.s[1:]
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{inner: inner}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (filterExpr, error) {
+	left, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	// check longer operators first so '<=' isn't parsed as '<'
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if p.consume(op) {
+			right, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			return binaryExpr{op: op, left: left, right: right}, nil
+		}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseValue() (filterExpr, error) {
+	p.skipSpace()
+	if p.s == "" {
+		return nil, fmt.Errorf("unexpected end of filter")
+	}
+	switch c := p.s[0]; {
+	case c == '(':
+		p.s = p.s[1:]
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.consume(")") {
+			return nil, fmt.Errorf("missing ')' in filter")
+		}
+		return expr, nil
+	case c == '@':
+		path, rest, err := parseSegments(p.s[1:], true)
+		if err != nil {
+			return nil, err
+		}
+		p.s = rest
+		return pathExpr{path: path}, nil
+	case c == '\'' || c == '"':
+		val, rest, err := parseQuoted(p.s)
+		if err != nil {
+			return nil, err
+		}
+		p.s = rest
+		return literalExpr{val: val}, nil
+	case strings.HasPrefix(p.s, "true"):
+		p.s = p.s[4:]
+		return literalExpr{val: true}, nil
+	case strings.HasPrefix(p.s, "false"):
+		p.s = p.s[5:]
+		return literalExpr{val: false}, nil
+	case strings.HasPrefix(p.s, "null"):
+		p.s = p.s[4:]
+		return literalExpr{val: nil}, nil
+	case c == '-' || (c >= '0' && c <= '9'):
+		i := 1
+		for i < len(p.s) && strings.ContainsRune("0123456789.eE+-", rune(p.s[i])) {
+			i++
+		}
+		f, err := strconv.ParseFloat(p.s[:i], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q in filter", p.s[:i])
+		}
+		p.s = p.s[i:]
+		return literalExpr{val: f}, nil
+	}
+	return nil, fmt.Errorf("unexpected input in filter: %q", p.s)
+}
@@ -0,0 +1,98 @@
+package callback
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const syncBody = `{
+	"next_batch": "s123",
+	"rooms": {
+		"join": {
+			"!a:hs1": {
+				"timeline": {
+					"events": [
+						{"type": "m.room.member", "state_key": "@alice:hs1", "event_id": "$1", "content": {"membership": "join"}},
+						{"type": "m.room.encrypted", "event_id": "$2", "content": {"algorithm": "m.megolm.v1.aes-sha2"}},
+						{"type": "m.room.message", "event_id": "$3", "origin_server_ts": 1000}
+					],
+					"limited": true
+				}
+			},
+			"!b:hs1": {
+				"timeline": {
+					"events": [
+						{"type": "m.room.encrypted", "event_id": "$4", "origin_server_ts": 2000}
+					],
+					"limited": false
+				}
+			}
+		}
+	}
+}`
+
+func TestJSONPath(t *testing.T) {
+	var root any
+	if err := json.Unmarshal([]byte(syncBody), &root); err != nil {
+		t.Fatalf("failed to unmarshal test data: %s", err)
+	}
+	testCases := []struct {
+		path string
+		want string
+	}{
+		{path: "$.next_batch", want: `["s123"]`},
+		{path: "$['next_batch']", want: `["s123"]`},
+		{path: "$.missing", want: `null`},
+		{path: "$.rooms.join.*.timeline.limited", want: `[true,false]`},
+		{path: "$.rooms.join['!a:hs1'].timeline.events[0].event_id", want: `["$1"]`},
+		{path: "$.rooms.join['!a:hs1'].timeline.events[-1].event_id", want: `["$3"]`},
+		{path: "$.rooms.join['!a:hs1'].timeline.events[5]", want: `null`},
+		{path: "$.rooms.join['!a:hs1'].timeline.events[*].type", want: `["m.room.member","m.room.encrypted","m.room.message"]`},
+		{path: "$..event_id", want: `["$1","$2","$3","$4"]`},
+		{path: "$.rooms.join.*.timeline.events[?(@.type=='m.room.encrypted')].event_id", want: `["$2","$4"]`},
+		{path: `$.rooms.join.*.timeline.events[?(@.type != "m.room.encrypted")].event_id`, want: `["$1","$3"]`},
+		{path: "$..[?(@.state_key)].event_id", want: `["$1"]`},
+		{path: "$..[?(!@.state_key && @.event_id)].event_id", want: `["$2","$3","$4"]`},
+		{path: "$..[?(@.origin_server_ts > 1000)].event_id", want: `["$4"]`},
+		{path: "$..[?(@.origin_server_ts >= 1000 && @.type == 'm.room.message')].event_id", want: `["$3"]`},
+		{path: "$..[?(@.type == 'm.room.member' || (@.origin_server_ts < 1500))].event_id", want: `["$1","$3"]`},
+		{path: "$..[?(@.content.membership == 'join')].state_key", want: `["@alice:hs1"]`},
+		{path: "$..timeline[?(@.limited == false)].events[0].event_id", want: `null`},
+		{path: "$..[?(@.limited == false)].events[0].event_id", want: `["$4"]`},
+	}
+	for _, tc := range testCases {
+		path, err := compileJSONPath(tc.path)
+		if err != nil {
+			t.Errorf("%s: failed to compile: %s", tc.path, err)
+			continue
+		}
+		got, err := json.Marshal(path.evaluate(root))
+		if err != nil {
+			t.Errorf("%s: failed to marshal result: %s", tc.path, err)
+			continue
+		}
+		if string(got) != tc.want {
+			t.Errorf("%s: got %s want %s", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestJSONPathInvalid(t *testing.T) {
+	invalidPaths := []string{
+		"",
+		"rooms.join",
+		"$.",
+		"$.rooms[",
+		"$.rooms[abc]",
+		"$.rooms['unterminated]",
+		"$.rooms[?(@.type ==)]",
+		"$.rooms[?@.type]",
+		"$.rooms[?(@.type == 'a' &&)]",
+		"$ rooms",
+	}
+	for _, p := range invalidPaths {
+		if _, err := compileJSONPath(p); err == nil {
+			t.Errorf("%q: expected error, got none", p)
+		}
+	}
+}
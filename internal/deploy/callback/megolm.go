@@ -0,0 +1,208 @@
+package callback
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The operations which MalformEncryptedContent can apply. Each operation is one byte of the input, followed by
+// a byte which is its argument.
+const (
+	// Truncate the ciphertext to (argument % length) bytes.
+	malformOpTruncateCiphertext byte = iota
+	// Replace the algorithm with wrongAlgorithms[argument % len].
+	malformOpWrongAlgorithm
+	// Delete the field malformableFields[argument % len].
+	malformOpDeleteField
+	// Flip the bits of byte (argument % length) of the decoded ciphertext, which breaks its MAC.
+	malformOpFlipCiphertextByte
+	// Replace the field malformableFields[argument % len] with a value of the wrong type.
+	malformOpWrongType
+	// Replace the session ID with a session which does not exist, of (argument % 64) bytes.
+	malformOpUnknownSessionID
+	numMalformOps
+)
+
+var wrongAlgorithms = []any{"", "m.olm.v1.curve25519-aes-sha2", "m.megolm.v2.aes-sha2", "org.example.unknown", 42, nil}
+
+var malformableFields = []string{"session_id", "ciphertext", "algorithm", "sender_key", "device_id"}
+
+// EncryptedContentMalformation is a named input to MalformEncryptedContent.
+type EncryptedContentMalformation struct {
+	Name  string
+	Input []byte
+}
+
+// EncryptedContentMalformations are the ways of malforming m.room.encrypted content which every client must
+// handle. These are also the seed corpus for fuzzing MalformEncryptedContent.
+var EncryptedContentMalformations = []EncryptedContentMalformation{
+	{Name: "truncated ciphertext", Input: []byte{malformOpTruncateCiphertext, 20}},
+	{Name: "empty ciphertext", Input: []byte{malformOpTruncateCiphertext, 0}},
+	{Name: "corrupted ciphertext", Input: []byte{malformOpFlipCiphertextByte, 10}},
+	{Name: "olm algorithm", Input: []byte{malformOpWrongAlgorithm, 1}},
+	{Name: "unknown algorithm", Input: []byte{malformOpWrongAlgorithm, 3}},
+	{Name: "missing session_id", Input: []byte{malformOpDeleteField, 0}},
+	{Name: "missing ciphertext", Input: []byte{malformOpDeleteField, 1}},
+	{Name: "ciphertext is not a string", Input: []byte{malformOpWrongType, 1}},
+	{Name: "unknown session_id", Input: []byte{malformOpUnknownSessionID, 43}},
+}
+
+// MalformEncryptedContent applies the operations described by `input` to the content of an m.room.encrypted
+// event, so the content is malformed in some way e.g the ciphertext is truncated. Any input is valid, which
+// lets Go's native fuzzing explore combinations of operations: see FuzzMalformEncryptedContent. The same input
+// always malforms content in the same way. The returned content is always a JSON object, so it can be sent
+// as the body of a request.
+func MalformEncryptedContent(content json.RawMessage, input []byte) (json.RawMessage, error) {
+	var c map[string]any
+	if err := unmarshalWithNumbers(content, &c); err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, fmt.Errorf("content is not a JSON object: %s", string(content))
+	}
+	for i := 0; i < len(input); i += 2 {
+		var arg byte
+		if i+1 < len(input) {
+			arg = input[i+1]
+		}
+		switch input[i] % numMalformOps {
+		case malformOpTruncateCiphertext:
+			if ciphertext, ok := c["ciphertext"].(string); ok && len(ciphertext) > 0 {
+				c["ciphertext"] = ciphertext[:int(arg)%len(ciphertext)]
+			}
+		case malformOpWrongAlgorithm:
+			c["algorithm"] = wrongAlgorithms[int(arg)%len(wrongAlgorithms)]
+		case malformOpDeleteField:
+			delete(c, malformableFields[int(arg)%len(malformableFields)])
+		case malformOpFlipCiphertextByte:
+			ciphertext, _ := c["ciphertext"].(string)
+			decoded, err := base64.RawStdEncoding.DecodeString(ciphertext)
+			if err != nil || len(decoded) == 0 {
+				continue
+			}
+			decoded[int(arg)%len(decoded)] ^= 0xff
+			c["ciphertext"] = base64.RawStdEncoding.EncodeToString(decoded)
+		case malformOpWrongType:
+			c[malformableFields[int(arg)%len(malformableFields)]] = map[string]any{"malformed": true}
+		case malformOpUnknownSessionID:
+			c["session_id"] = strings.Repeat("A", int(arg)%64)
+		}
+	}
+	return json.Marshal(c)
+}
+
+// EncryptedContentMalformer malforms the content of a single m.room.encrypted event as it is sent, so the
+// event is stored by the server in its malformed form and every recipient receives it.
+//
+// Typically this is used as the RequestCallback for PUT /send/m.room.encrypted/ requests, filtered by the
+// sender's access token:
+//
+//	malformer := callback.NewEncryptedContentMalformer(callback.EncryptedContentMalformations[0].Input)
+//	tc.Deployment.MITM().Configure(t).WithIntercept(mitm.InterceptOpts{
+//		Filter: mitm.FilterParams{
+//			PathContains: "/send/m.room.encrypted/",
+//			AccessToken:  alice.CurrentAccessToken(t),
+//		},
+//		RequestCallback: malformer.Callback(),
+//	}, func() { ... })
+type EncryptedContentMalformer struct {
+	Input []byte
+
+	mu        sync.Mutex
+	malformed bool
+}
+
+// NewEncryptedContentMalformer malforms the next m.room.encrypted event with the given MalformEncryptedContent input.
+func NewEncryptedContentMalformer(input []byte) *EncryptedContentMalformer {
+	return &EncryptedContentMalformer{
+		Input: input,
+	}
+}
+
+// Malformed returns true if an event has been malformed.
+func (m *EncryptedContentMalformer) Malformed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.malformed
+}
+
+// Callback returns the callback implementation which malforms the first request body. All other requests are
+// sent to the server unaltered.
+func (m *EncryptedContentMalformer) Callback() Fn {
+	return func(d Data) *Response {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.malformed {
+			return nil
+		}
+		body, err := MalformEncryptedContent(d.RequestBody, m.Input)
+		if err != nil {
+			return nil
+		}
+		m.malformed = true
+		return &Response{
+			RewriteRequestBody: body,
+		}
+	}
+}
+
+// LoadFuzzCorpus reads every input in a Go fuzzing corpus directory e.g testdata/fuzz/FuzzMalformEncryptedContent,
+// for fuzz targets which take a single []byte. This allows inputs found by `go test -fuzz` to be replayed against
+// real clients. Returns no inputs if the directory does not exist.
+func LoadFuzzCorpus(dir string) ([][]byte, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var inputs [][]byte
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		input, err := parseFuzzCorpusFile(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", entry.Name(), err)
+		}
+		inputs = append(inputs, input)
+	}
+	return inputs, nil
+}
+
+// parseFuzzCorpusFile parses a corpus file written by `go test -fuzz`, which looks like:
+//
+//	go test fuzz v1
+//	[]byte("\x00\x14")
+func parseFuzzCorpusFile(data []byte) ([]byte, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if !scanner.Scan() || scanner.Text() != "go test fuzz v1" {
+		return nil, fmt.Errorf("missing 'go test fuzz v1' header")
+	}
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("missing input")
+	}
+	line := strings.TrimSpace(scanner.Text())
+	quoted, ok := strings.CutPrefix(line, "[]byte(")
+	if !ok || !strings.HasSuffix(quoted, ")") {
+		return nil, fmt.Errorf("input is not a []byte: %s", line)
+	}
+	input, err := strconv.Unquote(strings.TrimSuffix(quoted, ")"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unquote input %s: %s", line, err)
+	}
+	return []byte(input), nil
+}
@@ -0,0 +1,128 @@
+package callback
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func encryptedContent() json.RawMessage {
+	b, _ := json.Marshal(map[string]any{
+		"algorithm":  "m.megolm.v1.aes-sha2",
+		"sender_key": "alicecurve",
+		"device_id":  "ALICEDEVICE",
+		"session_id": "megolmsession",
+		"ciphertext": base64.RawStdEncoding.EncodeToString([]byte("megolm message with a mac and signature")),
+	})
+	return b
+}
+
+func TestMalformEncryptedContent(t *testing.T) {
+	original := encryptedContent()
+	originalCiphertext := gjson.GetBytes(original, "ciphertext").Str
+	for _, m := range EncryptedContentMalformations {
+		malformed, err := MalformEncryptedContent(original, m.Input)
+		if err != nil {
+			t.Fatalf("%s: %s", m.Name, err)
+		}
+		if bytes.Equal(malformed, original) {
+			t.Errorf("%s: did not malform content", m.Name)
+		}
+		ciphertext := gjson.GetBytes(malformed, "ciphertext")
+		switch m.Name {
+		case "truncated ciphertext":
+			if len(ciphertext.Str) != 20 {
+				t.Errorf("%s: got ciphertext %s", m.Name, ciphertext.Str)
+			}
+		case "corrupted ciphertext":
+			if len(ciphertext.Str) != len(originalCiphertext) || ciphertext.Str == originalCiphertext {
+				t.Errorf("%s: ciphertext was not corrupted in place: %s", m.Name, ciphertext.Str)
+			}
+		case "missing session_id":
+			if gjson.GetBytes(malformed, "session_id").Exists() {
+				t.Errorf("%s: session_id exists: %s", m.Name, malformed)
+			}
+		case "unknown algorithm":
+			if algorithm := gjson.GetBytes(malformed, "algorithm").Str; algorithm != "org.example.unknown" {
+				t.Errorf("%s: got algorithm %s", m.Name, algorithm)
+			}
+		}
+	}
+	if _, err := MalformEncryptedContent(json.RawMessage(`"not an object"`), []byte{0, 0}); err == nil {
+		t.Errorf("malformed content which is not an object")
+	}
+}
+
+func TestEncryptedContentMalformer(t *testing.T) {
+	malformer := NewEncryptedContentMalformer([]byte{malformOpDeleteField, 0})
+	cb := malformer.Callback()
+	if malformer.Malformed() {
+		t.Fatalf("Malformed() returned true before malforming anything")
+	}
+	res := cb(Data{RequestBody: encryptedContent()})
+	if res == nil || res.RespondStatusCode != 0 || res.RespondBody != nil {
+		t.Fatalf("malformer must only rewrite the request: %+v", res)
+	}
+	if gjson.GetBytes(res.RewriteRequestBody, "session_id").Exists() {
+		t.Fatalf("did not malform the request: %s", res.RewriteRequestBody)
+	}
+	if !malformer.Malformed() {
+		t.Fatalf("Malformed() returned false after malforming an event")
+	}
+	// only one event is malformed
+	if res := cb(Data{RequestBody: encryptedContent()}); res != nil {
+		t.Fatalf("malformed a second event")
+	}
+}
+
+func TestLoadFuzzCorpus(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a"), []byte("go test fuzz v1\n[]byte(\"\\x00\\x14\")\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	inputs, err := LoadFuzzCorpus(dir)
+	if err != nil {
+		t.Fatalf("LoadFuzzCorpus: %s", err)
+	}
+	if len(inputs) != 1 || !bytes.Equal(inputs[0], []byte{0, 20}) {
+		t.Fatalf("LoadFuzzCorpus: got %v want [[0 20]]", inputs)
+	}
+	if inputs, err := LoadFuzzCorpus(filepath.Join(dir, "missing")); err != nil || inputs != nil {
+		t.Fatalf("LoadFuzzCorpus on a missing directory: got %v %v", inputs, err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "b"), []byte("go test fuzz v1\nstring(\"nope\")\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFuzzCorpus(dir); err == nil {
+		t.Fatalf("LoadFuzzCorpus: loaded a corpus file which is not a []byte")
+	}
+}
+
+// Run with `go test -fuzz FuzzMalformEncryptedContent ./internal/deploy/callback` to explore more ways of
+// malforming events. Inputs which fail are written to testdata/fuzz/FuzzMalformEncryptedContent, and interesting
+// inputs from the fuzzing cache in $(go env GOCACHE)/fuzz can be copied there too.
+// TestMalformedEncryptedEventsAreUndecryptable replays every input in testdata against real clients.
+func FuzzMalformEncryptedContent(f *testing.F) {
+	for _, m := range EncryptedContentMalformations {
+		f.Add(m.Input)
+	}
+	original := encryptedContent()
+	f.Fuzz(func(t *testing.T, input []byte) {
+		malformed, err := MalformEncryptedContent(original, input)
+		if err != nil {
+			t.Fatalf("MalformEncryptedContent: %s", err)
+		}
+		if !gjson.ValidBytes(malformed) || !gjson.ParseBytes(malformed).IsObject() {
+			t.Fatalf("malformed content is not a JSON object: %s", malformed)
+		}
+		again, err := MalformEncryptedContent(original, input)
+		if err != nil || !bytes.Equal(again, malformed) {
+			t.Fatalf("MalformEncryptedContent is not deterministic: got %s then %s", malformed, again)
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package callback
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// The olm message types in the ciphertext of an m.olm.v1.curve25519-aes-sha2 to-device event.
+const (
+	// A pre-key message, which is sent until the sender receives a message on the session. The recipient
+	// creates a new session from it.
+	OlmMessageTypePreKey = 0
+	// A normal message on an established session.
+	OlmMessageTypeNormal = 1
+)
+
+// OlmCorruption corrupts a single olm-encrypted to-device message, so the recipient cannot decrypt it. Only
+// normal olm messages are corrupted: as these are sent on an established session, the recipient should treat
+// the session as wedged and establish a new one by sending an m.dummy event to the sender.
+//
+// Typically this is used as the RequestCallback for PUT /sendToDevice/m.room.encrypted/ requests, filtered by the
+// sender's access token:
+//
+//	corruption := callback.NewOlmCorruption(alice.UserID(), alice.Opts().DeviceID)
+//	tc.Deployment.MITM().Configure(t).WithIntercept(mitm.InterceptOpts{
+//		Filter: mitm.FilterParams{
+//			PathContains: "/sendToDevice/m.room.encrypted/",
+//			AccessToken:  bob.CurrentAccessToken(t),
+//		},
+//		RequestCallback: corruption.Callback(),
+//	}, func() { ... })
+type OlmCorruption struct {
+	RecipientUserID   string
+	RecipientDeviceID string
+
+	mu        sync.Mutex
+	corrupted bool
+}
+
+// NewOlmCorruption corrupts the next normal olm message sent to the given device.
+func NewOlmCorruption(recipientUserID, recipientDeviceID string) *OlmCorruption {
+	return &OlmCorruption{
+		RecipientUserID:   recipientUserID,
+		RecipientDeviceID: recipientDeviceID,
+	}
+}
+
+// Corrupted returns true if a message has been corrupted.
+func (c *OlmCorruption) Corrupted() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.corrupted
+}
+
+// Callback returns the callback implementation which corrupts the first normal olm message to the recipient.
+// All other requests are sent to the server unaltered.
+func (c *OlmCorruption) Callback() Fn {
+	return func(d Data) *Response {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.corrupted {
+			return nil
+		}
+		body, err := c.Rewrite(d.RequestBody)
+		if err != nil || body == nil {
+			return nil
+		}
+		c.corrupted = true
+		return &Response{
+			RewriteRequestBody: body,
+		}
+	}
+}
+
+// Rewrite corrupts the olm message to the recipient in a /sendToDevice request body, by flipping the last
+// byte of the message, which is part of its MAC. Returns nil if there is no normal olm message to the recipient.
+func (c *OlmCorruption) Rewrite(requestBody json.RawMessage) (json.RawMessage, error) {
+	var body map[string]any
+	if err := unmarshalWithNumbers(requestBody, &body); err != nil {
+		return nil, err
+	}
+	messages, _ := body["messages"].(map[string]any)
+	userMessages, _ := messages[c.RecipientUserID].(map[string]any)
+	content, _ := userMessages[c.RecipientDeviceID].(map[string]any)
+	ciphertext, _ := content["ciphertext"].(map[string]any)
+	// there is exactly one ciphertext, keyed by the recipient's curve25519 key
+	for _, msg := range ciphertext {
+		olmMsg, _ := msg.(map[string]any)
+		if olmMessageType(olmMsg) != OlmMessageTypeNormal {
+			return nil, nil
+		}
+		encoded, _ := olmMsg["body"].(string)
+		msgBody, err := base64.RawStdEncoding.DecodeString(encoded)
+		if err != nil || len(msgBody) == 0 {
+			return nil, fmt.Errorf("olm message body is not base64: %s", encoded)
+		}
+		msgBody[len(msgBody)-1] ^= 0xff
+		olmMsg["body"] = base64.RawStdEncoding.EncodeToString(msgBody)
+		return json.Marshal(body)
+	}
+	return nil, nil
+}
+
+// OlmMessageTypes returns the types of the olm messages to the given device in a /sendToDevice request body
+// e.g OlmMessageTypePreKey. Returns nil if there are no olm messages to the device.
+func OlmMessageTypes(requestBody json.RawMessage, userID, deviceID string) []int {
+	var body struct {
+		Messages map[string]map[string]struct {
+			Ciphertext map[string]map[string]any `json:"ciphertext"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal(requestBody, &body); err != nil {
+		return nil
+	}
+	var types []int
+	for _, msg := range body.Messages[userID][deviceID].Ciphertext {
+		types = append(types, olmMessageType(msg))
+	}
+	return types
+}
+
+func olmMessageType(msg map[string]any) int {
+	switch msgType := msg["type"].(type) {
+	case json.Number:
+		i, _ := msgType.Int64()
+		return int(i)
+	case float64:
+		return int(msgType)
+	}
+	return -1
+}
@@ -0,0 +1,78 @@
+package callback
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func sendToDeviceBody(msgType int, body string) json.RawMessage {
+	b, _ := json.Marshal(map[string]any{
+		"messages": map[string]any{
+			"@alice:hs1": map[string]any{
+				"ALICEDEVICE": map[string]any{
+					"algorithm":  "m.olm.v1.curve25519-aes-sha2",
+					"sender_key": "bobcurve",
+					"ciphertext": map[string]any{
+						"alicecurve": map[string]any{
+							"type": msgType,
+							"body": body,
+						},
+					},
+				},
+			},
+		},
+	})
+	return b
+}
+
+func TestOlmCorruption(t *testing.T) {
+	original := base64.RawStdEncoding.EncodeToString([]byte("olm message with a mac"))
+	corruption := NewOlmCorruption("@alice:hs1", "ALICEDEVICE")
+	cb := corruption.Callback()
+
+	// pre-key messages are not corrupted
+	if res := cb(Data{RequestBody: sendToDeviceBody(OlmMessageTypePreKey, original)}); res != nil {
+		t.Fatalf("corrupted a pre-key message: %s", res.RewriteRequestBody)
+	}
+	// messages to other devices are not corrupted
+	other := NewOlmCorruption("@alice:hs1", "OTHERDEVICE")
+	if res := other.Callback()(Data{RequestBody: sendToDeviceBody(OlmMessageTypeNormal, original)}); res != nil {
+		t.Fatalf("corrupted a message to another device: %s", res.RewriteRequestBody)
+	}
+	if corruption.Corrupted() {
+		t.Fatalf("Corrupted() returned true before corrupting anything")
+	}
+
+	res := cb(Data{RequestBody: sendToDeviceBody(OlmMessageTypeNormal, original)})
+	if res == nil {
+		t.Fatalf("did not corrupt a normal message")
+	}
+	if res.RespondStatusCode != 0 || res.RespondBody != nil {
+		t.Fatalf("corruption must not respond to the request: %+v", res)
+	}
+	corrupted := gjson.GetBytes(res.RewriteRequestBody, `messages.@alice:hs1.ALICEDEVICE.ciphertext.alicecurve.body`).Str
+	if corrupted == original || len(corrupted) != len(original) {
+		t.Fatalf("message body was not corrupted in place: got %s original %s", corrupted, original)
+	}
+	if !corruption.Corrupted() {
+		t.Fatalf("Corrupted() returned false after corrupting a message")
+	}
+
+	// only one message is corrupted
+	if res := cb(Data{RequestBody: sendToDeviceBody(OlmMessageTypeNormal, original)}); res != nil {
+		t.Fatalf("corrupted a second message")
+	}
+}
+
+func TestOlmMessageTypes(t *testing.T) {
+	types := OlmMessageTypes(sendToDeviceBody(OlmMessageTypePreKey, "AAAA"), "@alice:hs1", "ALICEDEVICE")
+	if len(types) != 1 || types[0] != OlmMessageTypePreKey {
+		t.Fatalf("OlmMessageTypes: got %v want [0]", types)
+	}
+	if types := OlmMessageTypes(sendToDeviceBody(OlmMessageTypePreKey, "AAAA"), "@alice:hs1", "OTHERDEVICE"); types != nil {
+		t.Fatalf("OlmMessageTypes for another device: got %v want nil", types)
+	}
+}
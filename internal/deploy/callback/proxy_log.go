@@ -0,0 +1,91 @@
+package callback
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/matrix-org/complement/ct"
+	"github.com/tidwall/gjson"
+)
+
+// ProxyLog records callback data sniffed by mitmproxy, so tests can make precise assertions
+// about what the server actually delivered, as opposed to what the client displayed.
+// Typically this is used as the ResponseCallback for /sync requests:
+//
+//	proxyLog := callback.NewProxyLog()
+//	tc.Deployment.MITM().Configure(t).WithIntercept(mitm.InterceptOpts{
+//		Filter:           mitm.FilterParams{PathContains: "/sync"},
+//		ResponseCallback: proxyLog.Callback(),
+//	}, func() {
+//		// ...
+//	})
+//	encryptedEvents := proxyLog.Query(t, "$.rooms.join.*.timeline.events[?(@.type=='m.room.encrypted')]")
+//
+// A ProxyLog never modifies the response. It is safe to use concurrently.
+type ProxyLog struct {
+	mu      sync.Mutex
+	entries []Data
+}
+
+func NewProxyLog() *ProxyLog {
+	return &ProxyLog{}
+}
+
+// Callback returns the callback implementation used to record data in this log.
+func (l *ProxyLog) Callback() Fn {
+	return func(d Data) *Response {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.entries = append(l.entries, d)
+		return nil // don't modify the response
+	}
+}
+
+// Entries returns a copy of all the callback data recorded so far, in the order they were received.
+func (l *ProxyLog) Entries() []Data {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := make([]Data, len(l.entries))
+	copy(entries, l.entries)
+	return entries
+}
+
+// Query runs the JSONPath expression against every recorded response body, in the
+// order they were received, and returns all matches. Responses without a JSON body are skipped.
+// Fails the test if the JSONPath expression is invalid. See jsonPath for the supported syntax.
+func (l *ProxyLog) Query(t ct.TestLike, path string) []gjson.Result {
+	t.Helper()
+	compiled, err := compileJSONPath(path)
+	if err != nil {
+		ct.Fatalf(t, "ProxyLog.Query: %s", err)
+	}
+	var results []gjson.Result
+	for _, d := range l.Entries() {
+		matches, err := queryBody(compiled, d.ResponseBody)
+		if err != nil {
+			t.Logf("ProxyLog.Query: skipping response for %s: %s", d.URL, err)
+			continue
+		}
+		results = append(results, matches...)
+	}
+	return results
+}
+
+func queryBody(path jsonPath, body json.RawMessage) ([]gjson.Result, error) {
+	if len(body) == 0 {
+		return nil, nil
+	}
+	var root any
+	if err := json.Unmarshal(body, &root); err != nil {
+		return nil, err
+	}
+	var results []gjson.Result
+	for _, match := range path.evaluate(root) {
+		b, err := json.Marshal(match)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, gjson.ParseBytes(b))
+	}
+	return results, nil
+}
@@ -0,0 +1,60 @@
+package callback
+
+import (
+	"encoding/json"
+)
+
+// StripEvents returns a response callback which removes every event of the given type from JSON responses,
+// wherever they appear e.g the state and timeline of rooms in /sync, or the required_state of rooms in sliding
+// sync. This simulates a homeserver hiding events from a client. Responses without such events are unaltered.
+func StripEvents(eventType string) Fn {
+	return func(d Data) *Response {
+		body, err := RemoveEvents(d.ResponseBody, eventType)
+		if err != nil || body == nil {
+			return nil
+		}
+		return &Response{
+			RespondStatusCode: d.ResponseCode,
+			RespondBody:       body,
+		}
+	}
+}
+
+// RemoveEvents removes every object with the given "type" from every array in the JSON body. Returns nil
+// if there were no objects with this type.
+func RemoveEvents(body json.RawMessage, eventType string) (json.RawMessage, error) {
+	var root any
+	if err := unmarshalWithNumbers(body, &root); err != nil {
+		return nil, err
+	}
+	root, removed := removeEvents(root, eventType)
+	if removed == 0 {
+		return nil, nil
+	}
+	return json.Marshal(root)
+}
+
+func removeEvents(n any, eventType string) (any, int) {
+	removed := 0
+	switch v := n.(type) {
+	case map[string]any:
+		for key, child := range v {
+			var r int
+			v[key], r = removeEvents(child, eventType)
+			removed += r
+		}
+	case []any:
+		kept := make([]any, 0, len(v))
+		for _, child := range v {
+			if obj, ok := child.(map[string]any); ok && obj["type"] == eventType {
+				removed++
+				continue
+			}
+			child, r := removeEvents(child, eventType)
+			removed += r
+			kept = append(kept, child)
+		}
+		return kept, removed
+	}
+	return n, removed
+}
@@ -0,0 +1,55 @@
+package callback
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestStripEvents(t *testing.T) {
+	syncBody := json.RawMessage(`{
+		"next_batch": "s1",
+		"rooms": {
+			"join": {
+				"!room:hs1": {
+					"state": {"events": [
+						{"type": "m.room.create", "state_key": "", "content": {}},
+						{"type": "m.room.encryption", "state_key": "", "content": {"algorithm": "m.megolm.v1.aes-sha2"}}
+					]},
+					"timeline": {"events": [
+						{"type": "m.room.encryption", "state_key": "", "content": {"algorithm": "m.megolm.v1.aes-sha2"}},
+						{"type": "m.room.encrypted", "content": {"origin_server_ts": 1700000000000}}
+					]}
+				}
+			}
+		}
+	}`)
+	cb := StripEvents("m.room.encryption")
+	res := cb(Data{ResponseCode: 200, ResponseBody: syncBody})
+	if res == nil {
+		t.Fatalf("did not strip any events")
+	}
+	if res.RespondStatusCode != 200 {
+		t.Errorf("changed the status code to %d", res.RespondStatusCode)
+	}
+	room := gjson.GetBytes(res.RespondBody, `rooms.join.!room:hs1`)
+	if got := room.Get("state.events.#.type").String(); got != `["m.room.create"]` {
+		t.Errorf("state events: got %s", got)
+	}
+	if got := room.Get("timeline.events.#.type").String(); got != `["m.room.encrypted"]` {
+		t.Errorf("timeline events: got %s", got)
+	}
+	// large integers must not be mangled when re-encoding
+	if got := room.Get("timeline.events.0.content.origin_server_ts").Raw; got != "1700000000000" {
+		t.Errorf("integer was re-encoded as %s", got)
+	}
+	if gjson.GetBytes(res.RespondBody, "next_batch").Str != "s1" {
+		t.Errorf("lost other fields: %s", res.RespondBody)
+	}
+
+	// responses without the event are unaltered
+	if res := StripEvents("m.room.encryption")(Data{ResponseCode: 200, ResponseBody: json.RawMessage(`{"rooms":{}}`)}); res != nil {
+		t.Errorf("altered a response without any events: %s", res.RespondBody)
+	}
+}
@@ -29,7 +29,7 @@ func TestCallbackAddon(t *testing.T) {
 	workingDir, err := os.Getwd()
 	must.NotError(t, "failed to get working dir", err)
 	mitmProxyAddonsDir := filepath.Join(workingDir, "../../tests/mitmproxy_addons")
-	deployment := RunNewDeployment(t, mitmProxyAddonsDir, "")
+	deployment := RunNewDeployment(t, 2, mitmProxyAddonsDir, "")
 	defer deployment.Teardown()
 	client := deployment.Register(t, "hs1", helpers.RegistrationOpts{
 		LocalpartSuffix: "callback",
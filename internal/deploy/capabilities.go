@@ -0,0 +1,169 @@
+package deploy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// HomeserverImpl is a homeserver implementation which can be used as COMPLEMENT_BASE_IMAGE.
+type HomeserverImpl string
+
+const (
+	HomeserverImplSynapse  HomeserverImpl = "synapse"
+	HomeserverImplDendrite HomeserverImpl = "dendrite"
+	HomeserverImplConduit  HomeserverImpl = "conduit"
+)
+
+// Capability is something which not all homeserver implementations support. Tests which need a capability
+// should call RequireCapabilities, which skips the test if the homeserver does not have it.
+type Capability string
+
+const (
+	// The homeserver supports the Synapse admin API under /_synapse/admin.
+	CapabilityAdminAPI Capability = "admin_api"
+	// Homeservers made by newHomeserver can be given extra config, which is needed for NewAppserviceHomeserver
+	// and NewOIDCHomeserver.
+	CapabilityExtraConfig Capability = "extra_config"
+	// The homeserver sends federation traffic via the proxy in the https_proxy environment variable, which is
+	// needed for InterceptFederationTransactions.
+	CapabilityFederationProxy Capability = "federation_proxy"
+	// The homeserver supports simplified sliding sync (MSC4186), which the rust SDK needs to sync.
+	CapabilitySlidingSync Capability = "sliding_sync"
+)
+
+// implCapabilities are the capabilities of each homeserver implementation which cannot be queried at runtime.
+// Homeserver images which are not recognised are assumed to be Synapse-compatible.
+var implCapabilities = map[HomeserverImpl][]Capability{
+	HomeserverImplSynapse:  {CapabilityAdminAPI, CapabilityExtraConfig, CapabilityFederationProxy, CapabilitySlidingSync},
+	HomeserverImplDendrite: {},
+	HomeserverImplConduit:  {},
+}
+
+// unstableFeatureCapabilities are the capabilities advertised in unstable_features in /_matrix/client/versions.
+var unstableFeatureCapabilities = map[string]Capability{
+	"org.matrix.simplified_msc3575": CapabilitySlidingSync,
+}
+
+// HomeserverCapabilities describes what a homeserver can do.
+type HomeserverCapabilities struct {
+	Impl HomeserverImpl
+	// The server name and version from /_matrix/federation/v1/version e.g "Synapse 1.110.0". Empty if unknown.
+	Version      string
+	capabilities map[Capability]bool
+}
+
+// Has returns true if the homeserver has the capability.
+func (c *HomeserverCapabilities) Has(capability Capability) bool {
+	return c.capabilities[capability]
+}
+
+// Capabilities returns the capabilities of a homeserver e.g "hs1". The homeserver is queried the first time this
+// is called, then the capabilities are cached. Homeservers made via NewHomeserverWithConfig use the same image
+// as hs1, so have the same capabilities as hs1.
+func (d *ComplementCryptoDeployment) Capabilities(t ct.TestLike, hsName string) *HomeserverCapabilities {
+	t.Helper()
+	if !slices.Contains(d.HomeserverNames(), hsName) {
+		hsName = "hs1"
+	}
+	d.capabilitiesMu.Lock()
+	defer d.capabilitiesMu.Unlock()
+	if caps, ok := d.capabilities[hsName]; ok {
+		return caps
+	}
+	baseURL := d.Deployment.UnauthenticatedClient(t, hsName).BaseURL
+	caps, err := queryCapabilities(baseURL, d.Deployment.GetConfig().BaseImageURI)
+	if err != nil {
+		ct.Fatalf(t, "Capabilities(%s): %s", hsName, err)
+	}
+	t.Logf("Capabilities(%s): impl=%s version=%q capabilities=%v", hsName, caps.Impl, caps.Version, caps.capabilities)
+	d.capabilities[hsName] = caps
+	return caps
+}
+
+// RequireCapabilities skips the test unless the homeserver has all of the capabilities.
+func (d *ComplementCryptoDeployment) RequireCapabilities(t testing.TB, hsName string, capabilities ...Capability) {
+	t.Helper()
+	caps := d.Capabilities(t, hsName)
+	for _, capability := range capabilities {
+		if !caps.Has(capability) {
+			t.Skipf("%s (%s) does not support %s", hsName, caps.Impl, capability)
+		}
+	}
+}
+
+// queryCapabilities works out the homeserver implementation and its capabilities. The implementation is
+// taken from the server name in /_matrix/federation/v1/version if it is served on the client-server port,
+// else from the image name.
+func queryCapabilities(baseURL, image string) (*HomeserverCapabilities, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	var versions struct {
+		UnstableFeatures map[string]bool `json:"unstable_features"`
+	}
+	// Complement waits until the homeserver is up, but some implementations serve /versions before they are ready.
+	var err error
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(200 * time.Millisecond) {
+		if err = getJSON(client, baseURL+"/_matrix/client/versions", &versions); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	caps := &HomeserverCapabilities{
+		capabilities: make(map[Capability]bool),
+	}
+	var serverVersion struct {
+		Server struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"server"`
+	}
+	if getJSON(client, baseURL+"/_matrix/federation/v1/version", &serverVersion) == nil && serverVersion.Server.Name != "" {
+		caps.Impl = parseHomeserverImpl(serverVersion.Server.Name)
+		caps.Version = serverVersion.Server.Name + " " + serverVersion.Server.Version
+	} else {
+		caps.Impl = parseHomeserverImpl(image)
+	}
+	for _, capability := range implCapabilities[caps.Impl] {
+		caps.capabilities[capability] = true
+	}
+	for feature, enabled := range versions.UnstableFeatures {
+		if capability, ok := unstableFeatureCapabilities[feature]; ok && enabled {
+			caps.capabilities[capability] = true
+		}
+	}
+	return caps, nil
+}
+
+// parseHomeserverImpl returns the homeserver implementation from a server name or image name. Unknown
+// implementations are assumed to be Synapse-compatible.
+func parseHomeserverImpl(name string) HomeserverImpl {
+	name = strings.ToLower(name)
+	switch {
+	case strings.Contains(name, "dendrite"):
+		return HomeserverImplDendrite
+	case strings.Contains(name, "conduit"), strings.Contains(name, "conduwuit"):
+		return HomeserverImplConduit
+	default:
+		return HomeserverImplSynapse
+	}
+}
+
+func getJSON(client *http.Client, url string, out any) error {
+	res, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("GET %s returned HTTP %d", url, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
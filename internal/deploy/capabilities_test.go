@@ -0,0 +1,79 @@
+package deploy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/complement/must"
+)
+
+func TestQueryCapabilities(t *testing.T) {
+	testCases := []struct {
+		name          string
+		serverName    string // empty if the federation API is not served
+		image         string
+		features      string
+		wantImpl      HomeserverImpl
+		wantSupported []Capability
+		wantMissing   []Capability
+	}{
+		{
+			name:          "synapse",
+			serverName:    "Synapse",
+			image:         "complement-synapse",
+			features:      `{}`,
+			wantImpl:      HomeserverImplSynapse,
+			wantSupported: []Capability{CapabilityAdminAPI, CapabilityExtraConfig, CapabilityFederationProxy, CapabilitySlidingSync},
+		},
+		{
+			name:        "dendrite without sliding sync",
+			serverName:  "Dendrite",
+			image:       "complement-dendrite:latest",
+			features:    `{"org.matrix.simplified_msc3575": false}`,
+			wantImpl:    HomeserverImplDendrite,
+			wantMissing: []Capability{CapabilityAdminAPI, CapabilityExtraConfig, CapabilitySlidingSync},
+		},
+		{
+			name:          "conduwuit with sliding sync, detected from the image",
+			image:         "ghcr.io/girlbossceo/conduwuit:complement",
+			features:      `{"org.matrix.simplified_msc3575": true}`,
+			wantImpl:      HomeserverImplConduit,
+			wantSupported: []Capability{CapabilitySlidingSync},
+			wantMissing:   []Capability{CapabilityAdminAPI, CapabilityFederationProxy},
+		},
+		{
+			name:          "unknown images are treated as synapse",
+			image:         "my-homeserver",
+			features:      `{}`,
+			wantImpl:      HomeserverImplSynapse,
+			wantSupported: []Capability{CapabilityAdminAPI},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/_matrix/client/versions", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"versions":["v1.11"],"unstable_features":%s}`, tc.features)
+			})
+			if tc.serverName != "" {
+				mux.HandleFunc("/_matrix/federation/v1/version", func(w http.ResponseWriter, r *http.Request) {
+					fmt.Fprintf(w, `{"server":{"name":%q,"version":"1.0"}}`, tc.serverName)
+				})
+			}
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+
+			caps, err := queryCapabilities(srv.URL, tc.image)
+			must.NotError(t, "queryCapabilities", err)
+			must.Equal(t, caps.Impl, tc.wantImpl, "impl")
+			for _, capability := range tc.wantSupported {
+				must.Equal(t, caps.Has(capability), true, "supports "+string(capability))
+			}
+			for _, capability := range tc.wantMissing {
+				must.Equal(t, caps.Has(capability), false, "supports "+string(capability))
+			}
+		})
+	}
+}
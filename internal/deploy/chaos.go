@@ -0,0 +1,37 @@
+package deploy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+)
+
+// proxyChaosDowntime is how long the reverse proxy is down for in each outage.
+const proxyChaosDowntime = time.Second
+
+// WithProxyChaos repeatedly takes the reverse proxy down whilst `inner` is called, returning how many
+// times it was restarted. The proxy stays up for `interval`, randomly lengthened or shortened by up to
+// `jitter`, between each outage. Whilst the proxy is down, every request and response passing through it
+// is aborted, including long-polling /sync requests, so clients see their connections reset and must retry.
+//
+// The proxy is always up when this function returns. Use cc.MustHaveResumedSyncing to check that clients
+// recovered. Chaos can be used at the same time as intercepting requests via MITM().Configure.
+//
+//	restarts := deployment.WithProxyChaos(t, 2*time.Second, 500*time.Millisecond, func() {
+//		time.Sleep(10 * time.Second) // ... whilst clients sync ...
+//	})
+func (d *ComplementCryptoDeployment) WithProxyChaos(t *testing.T, interval, jitter time.Duration, inner func()) (restarts int) {
+	t.Helper()
+	chaosID := d.mitmClient.AddChaos(t, mitm.Chaos{
+		IntervalMs: interval.Milliseconds(),
+		JitterMs:   jitter.Milliseconds(),
+		DowntimeMs: proxyChaosDowntime.Milliseconds(),
+	})
+	defer func() {
+		restarts = d.mitmClient.RemoveChaos(t, chaosID)
+		t.Logf("WithProxyChaos: restarted the proxy %d times", restarts)
+	}()
+	inner()
+	return
+}
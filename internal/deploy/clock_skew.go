@@ -0,0 +1,48 @@
+package deploy
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/ct"
+	testcontainers "github.com/testcontainers/testcontainers-go"
+)
+
+// Where libfaketime is copied to in homeservers made by NewHomeserverWithClockSkew.
+const libfaketimeContainerPath = "/complement-crypto/libfaketime.so.1"
+
+// NewHomeserverWithClockSkew deploys a new homeserver like NewHomeserverWithConfig, whose clock is offset from the
+// real time by skew e.g time.Hour makes the homeserver think it is an hour in the future. This affects timestamps
+// made by the homeserver, such as origin_server_ts, but not timestamps made by clients e.g in to-device
+// verification requests. The skew is rounded to the nearest second.
+//
+// The clock is skewed by preloading libfaketime into every process in the container. Homeserver images do not
+// include it, so libfaketimePath is the path on the host to libfaketime.so.1, which is copied into the container.
+// It must be built for the same architecture and C library as the image e.g from the Debian libfaketime package.
+//
+// The homeserver makes its federation TLS certificate using the skewed clock, so other homeservers may refuse to
+// federate with it. Tests should put clients which talk to each other on this homeserver.
+func (d *ComplementCryptoDeployment) NewHomeserverWithClockSkew(t *testing.T, skew time.Duration, libfaketimePath string) *Homeserver {
+	t.Helper()
+	if _, err := os.Stat(libfaketimePath); err != nil {
+		ct.Fatalf(t, "NewHomeserverWithClockSkew: cannot find libfaketime: %s", err)
+	}
+	hs := d.newHomeserver(t, homeserverOpts{
+		env: map[string]string{
+			"LD_PRELOAD": libfaketimeContainerPath,
+			// a relative offset in seconds e.g "+3600"
+			"FAKETIME": fmt.Sprintf("%+d", int64(skew.Round(time.Second)/time.Second)),
+			// timers in the homeserver should still fire at the right time
+			"DONT_FAKE_MONOTONIC": "1",
+		},
+		extraFiles: []testcontainers.ContainerFile{{
+			HostFilePath:      libfaketimePath,
+			ContainerFilePath: libfaketimeContainerPath,
+			FileMode:          0o755,
+		}},
+	})
+	t.Logf("NewHomeserverWithClockSkew: %s has a clock skew of %v", hs.ServerName, skew)
+	return hs
+}
@@ -0,0 +1,52 @@
+package deploy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+)
+
+// DelaySpec describes HTTP responses which should be held back by mitmproxy before they are sent to the
+// client. The server has already processed the request, so the client receives a response which is stale
+// by the time it arrives.
+type DelaySpec struct {
+	// The URL path must contain this string for responses to be delayed e.g "/sync".
+	// If unset, all responses may be delayed.
+	Endpoint string
+	// If set, only delay responses to requests made with this access token, i.e to a single client.
+	AccessToken string
+	// How long to hold each matching response for.
+	Delay time.Duration
+	// If non-zero, stop delaying responses after this many have been delayed.
+	Count int
+}
+
+// DelayEndpoint holds back responses matching the spec whilst `inner` is called, returning how many
+// responses were delayed. Delays can be used at the same time as intercepting requests via MITM().Configure.
+// Responses which are being held when `inner` returns are still delayed.
+//
+//	delayed := deployment.DelayEndpoint(t, deploy.DelaySpec{
+//		Endpoint: "/sync",
+//		Delay:    3 * time.Second,
+//		Count:    1,
+//	}, func() {
+//		// ... send events ...
+//	})
+func (d *ComplementCryptoDeployment) DelayEndpoint(t *testing.T, spec DelaySpec, inner func()) (delayed int) {
+	t.Helper()
+	delayID := d.mitmClient.AddDelay(t, mitm.Delay{
+		Filter: mitm.FilterParams{
+			PathContains: spec.Endpoint,
+			AccessToken:  spec.AccessToken,
+		}.FilterString(),
+		DelayMs: spec.Delay.Milliseconds(),
+		Count:   spec.Count,
+	})
+	defer func() {
+		delayed = d.mitmClient.RemoveDelay(t, delayID)
+		t.Logf("DelayEndpoint: delayed %d responses", delayed)
+	}()
+	inner()
+	return
+}
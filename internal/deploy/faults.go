@@ -0,0 +1,118 @@
+package deploy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+	"github.com/matrix-org/complement/ct"
+)
+
+// FaultSpec declaratively describes requests which should be randomly dropped by mitmproxy. Dropped
+// requests are never sent to the homeserver: the client instead receives an error response. This makes
+// it easy to write tests for flaky networks, without writing a callback for each scenario.
+type FaultSpec struct {
+	// The URL path must contain this string for requests to be dropped e.g "/sendToDevice".
+	// If unset, all requests may be dropped.
+	Endpoint string
+	// The HTTP method which must be used for requests to be dropped. If unset, any method may be dropped.
+	Method string
+	// If set, only drop requests made with this access token, i.e from a single client.
+	AccessToken string
+	// The probability between 0 and 1 that a matching request is dropped.
+	DropRate float64
+	// If non-zero, stop dropping requests after this many have been dropped. This ensures that
+	// clients which retry requests will eventually succeed.
+	MaxDrops int
+	// The HTTP status code returned for dropped requests. Defaults to 502.
+	StatusCode int
+	// If non-zero, the seed for the random number generator, making the dropped requests repeatable.
+	Seed int64
+}
+
+// WithFaultInjection drops requests matching the spec whilst `inner` is called, returning how many
+// requests were dropped. Faults can be nested, and can be used at the same time as intercepting
+// requests via MITM().Configure. If a request matches multiple faults, the outermost fault is tried first.
+//
+//	dropped := deployment.WithFaultInjection(t, deploy.FaultSpec{
+//		Endpoint: "/sendToDevice",
+//		DropRate: 0.3,
+//		MaxDrops: 5,
+//	}, func() {
+//		// ... send messages ...
+//	})
+func (d *ComplementCryptoDeployment) WithFaultInjection(t *testing.T, spec FaultSpec, inner func()) (dropped int) {
+	t.Helper()
+	faultID := d.mitmClient.AddFault(t, mitm.Fault{
+		Filter: mitm.FilterParams{
+			PathContains: spec.Endpoint,
+			Method:       spec.Method,
+			AccessToken:  spec.AccessToken,
+		}.FilterString(),
+		DropRate:   spec.DropRate,
+		MaxDrops:   spec.MaxDrops,
+		StatusCode: spec.StatusCode,
+		Seed:       spec.Seed,
+	})
+	defer func() {
+		dropped = d.mitmClient.RemoveFault(t, faultID).Dropped
+		t.Logf("WithFaultInjection: dropped %d requests", dropped)
+	}()
+	inner()
+	return
+}
+
+// RateLimitSpec describes requests which should be rate limited by mitmproxy.
+type RateLimitSpec struct {
+	// The URL path must contain this string for requests to be rate limited e.g "/keys/claim".
+	Endpoint string
+	// The HTTP method which must be used for requests to be rate limited. If unset, any method may be rate limited.
+	Method string
+	// If set, only rate limit requests made with this access token, i.e from a single client.
+	AccessToken string
+	// The number of matching requests to rate limit. Requests after this are sent to the homeserver.
+	Count int
+	// How long clients are told to wait before retrying, via retry_after_ms and the Retry-After header.
+	RetryAfter time.Duration
+}
+
+// WithRateLimit responds to the next spec.Count requests matching the spec with a 429 M_LIMIT_EXCEEDED
+// whilst `inner` is called. Rate limited requests are never sent to the homeserver. Returns how many
+// requests were rate limited, and how long after the last rate limited request the client retried it.
+// retryDelay is zero if the client did not make another matching request whilst `inner` was called.
+//
+//	limited, retryDelay := deployment.WithRateLimit(t, deploy.RateLimitSpec{
+//		Endpoint:   "/keys/claim",
+//		Count:      1,
+//		RetryAfter: time.Second,
+//	}, func() {
+//		// ... send messages ...
+//	})
+func (d *ComplementCryptoDeployment) WithRateLimit(t *testing.T, spec RateLimitSpec, inner func()) (limited int, retryDelay time.Duration) {
+	t.Helper()
+	if spec.Count <= 0 {
+		ct.Fatalf(t, "WithRateLimit: Count must be positive, got %d", spec.Count)
+	}
+	faultID := d.mitmClient.AddFault(t, mitm.Fault{
+		Filter: mitm.FilterParams{
+			PathContains: spec.Endpoint,
+			Method:       spec.Method,
+			AccessToken:  spec.AccessToken,
+		}.FilterString(),
+		DropRate:     1,
+		MaxDrops:     spec.Count,
+		StatusCode:   429,
+		ErrCode:      "M_LIMIT_EXCEEDED",
+		RetryAfterMs: spec.RetryAfter.Milliseconds(),
+	})
+	defer func() {
+		stats := d.mitmClient.RemoveFault(t, faultID)
+		limited = stats.Dropped
+		if stats.RetryDelayMs != nil {
+			retryDelay = time.Duration(*stats.RetryDelayMs) * time.Millisecond
+		}
+		t.Logf("WithRateLimit: rate limited %d requests, retried after %v", limited, retryDelay)
+	}()
+	inner()
+	return
+}
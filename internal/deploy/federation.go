@@ -0,0 +1,118 @@
+package deploy
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement-crypto/internal/deploy/callback"
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+	"github.com/matrix-org/complement/ct"
+)
+
+// The regular (forward) proxy in mitmproxy, as reachable by homeservers on the docker network.
+const mitmForwardProxyURL = "http://mitmproxy:8080"
+
+// configureFederationProxy sets the environment variables which make homeservers send their federation
+// traffic via mitmproxy. Complement only passes environment variables to homeservers which start with
+// COMPLEMENT_SHARE_ENV_PREFIX, so this returns false if it is not set.
+func configureFederationProxy() bool {
+	prefix := os.Getenv("COMPLEMENT_SHARE_ENV_PREFIX")
+	if prefix == "" {
+		return false
+	}
+	// Synapse sends outbound federation requests via the proxy in https_proxy.
+	os.Setenv(prefix+"https_proxy", mitmForwardProxyURL)
+	return true
+}
+
+// FederationProxied returns true if federation traffic between the homeservers made by Complement goes
+// via mitmproxy, so it can be intercepted in the same way as client-server traffic. This requires
+// COMPLEMENT_SHARE_ENV_PREFIX to be set, as homeservers are told to use the proxy via environment variables.
+func (d *ComplementCryptoDeployment) FederationProxied() bool {
+	return d.federationProxied
+}
+
+// FederationTransaction is a federation transaction sent via PUT /_matrix/federation/v1/send/{txnID}.
+type FederationTransaction struct {
+	// The transaction ID from the request path.
+	TxnID string
+	// The server which sent this transaction, and the server it was sent to e.g "hs1", "hs2".
+	Origin      string
+	Destination string
+	PDUs        []json.RawMessage
+	EDUs        []FederationEDU
+}
+
+// FederationEDU is an ephemeral data unit in a federation transaction e.g to-device messages are sent as
+// m.direct_to_device EDUs.
+type FederationEDU struct {
+	Type    string          `json:"edu_type"`
+	Content json.RawMessage `json:"content"`
+}
+
+// HasEDU returns true if this transaction contains an EDU of the given type.
+func (txn FederationTransaction) HasEDU(eduType string) bool {
+	for _, edu := range txn.EDUs {
+		if edu.Type == eduType {
+			return true
+		}
+	}
+	return false
+}
+
+// InterceptFederationTransactions calls fn for every federation transaction whilst `inner` is called.
+// If fn returns a response, the transaction is not sent to the destination and the response is returned
+// to the origin instead, e.g an HTTP 502 to make the origin retry the transaction later. fn may also block
+// to delay the transaction, but homeservers only send one transaction at a time to each destination, so
+// this delays everything the origin sends to the destination.
+//
+// Transactions cannot be modified, as the origin signs the request body. This intercepts requests via
+// MITM().Configure, so cannot be used at the same time as other intercepts. Skips the test if federation
+// traffic does not go via mitmproxy, see FederationProxied, or if the homeservers cannot be told to use a proxy.
+func (d *ComplementCryptoDeployment) InterceptFederationTransactions(t *testing.T, fn func(txn FederationTransaction) *callback.Response, inner func()) {
+	t.Helper()
+	if !d.FederationProxied() {
+		t.Skipf("InterceptFederationTransactions: federation traffic does not go via mitmproxy, set COMPLEMENT_SHARE_ENV_PREFIX")
+	}
+	d.RequireCapabilities(t, "hs1", CapabilityFederationProxy)
+	d.MITM().Configure(t).WithIntercept(mitm.InterceptOpts{
+		Filter: mitm.FilterParams{
+			PathContains: "/_matrix/federation/v1/send/",
+			Method:       "PUT",
+		},
+		RequestCallback: func(cd callback.Data) *callback.Response {
+			txn, err := parseFederationTransaction(cd)
+			if err != nil {
+				ct.Errorf(t, "InterceptFederationTransactions: failed to parse %s: %s", cd.URL, err)
+				return nil
+			}
+			return fn(txn)
+		},
+	}, inner)
+}
+
+func parseFederationTransaction(cd callback.Data) (txn FederationTransaction, err error) {
+	u, err := url.Parse(cd.URL)
+	if err != nil {
+		return txn, err
+	}
+	var body struct {
+		Origin string            `json:"origin"`
+		PDUs   []json.RawMessage `json:"pdus"`
+		EDUs   []FederationEDU   `json:"edus"`
+	}
+	if err = json.Unmarshal(cd.RequestBody, &body); err != nil {
+		return txn, err
+	}
+	_, txnID, _ := strings.Cut(u.Path, "/_matrix/federation/v1/send/")
+	return FederationTransaction{
+		TxnID:       txnID,
+		Origin:      body.Origin,
+		Destination: u.Hostname(),
+		PDUs:        body.PDUs,
+		EDUs:        body.EDUs,
+	}, nil
+}
@@ -0,0 +1,139 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// FederationOutage takes a homeserver offline, then detects when federation with it has
+// actually resumed. Tests should use this instead of calling PauseServer/UnpauseServer and
+// sleeping for an arbitrary length of time, hoping that the other homeservers have noticed.
+//
+// Federation traffic between homeservers may not go through mitmproxy (see FederationProxied), so healing
+// is detected by repeatedly asking every other homeserver, via its reverse proxy, for the profile of a user
+// on the paused homeserver. This is a federated request, which fails with a 5xx whilst the other
+// homeserver cannot reach the paused homeserver or is backing off from it.
+//
+// The homeserver is brought back online automatically when the test ends.
+type FederationOutage struct {
+	t      *testing.T
+	d      *ComplementCryptoDeployment
+	hsName string
+	mu     sync.Mutex
+	active bool
+	// the number of failed probes since End was called
+	retries int
+}
+
+// FederationOutage returns an outage for the given homeserver (e.g "hs2"). The homeserver is not
+// taken offline until Begin is called.
+func (d *ComplementCryptoDeployment) FederationOutage(t *testing.T, hsName string) *FederationOutage {
+	o := &FederationOutage{
+		t:      t,
+		d:      d,
+		hsName: hsName,
+	}
+	t.Cleanup(o.End)
+	return o
+}
+
+// Begin takes the homeserver offline. All requests to it will fail until End is called.
+func (o *FederationOutage) Begin() {
+	o.t.Helper()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.active {
+		return
+	}
+	o.d.PauseServer(o.t, o.hsName)
+	o.active = true
+}
+
+// End brings the homeserver back online. Other homeservers may take a while to notice: call
+// WaitUntilHealed to wait until they have. Calling End when there is no outage does nothing.
+func (o *FederationOutage) End() {
+	o.t.Helper()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.active {
+		return
+	}
+	o.d.UnpauseServer(o.t, o.hsName)
+	o.active = false
+	o.retries = 0
+}
+
+// WaitUntilHealed blocks until every other homeserver can make federated requests to this homeserver,
+// or until the context is done, in which case the context error is returned. End must be called first.
+//
+// Homeservers back off from destinations which were unreachable. Synapse resets this backoff when it
+// next receives a transaction from the destination, so tests may need to send something from the
+// recovered homeserver (e.g a typing notification) for this to return promptly.
+func (o *FederationOutage) WaitUntilHealed(ctx context.Context) error {
+	o.t.Helper()
+	o.mu.Lock()
+	active := o.active
+	o.mu.Unlock()
+	if active {
+		return fmt.Errorf("WaitUntilHealed: %s is still offline, call End first", o.hsName)
+	}
+	start := time.Now()
+	for _, otherHS := range o.otherHomeservers() {
+		for !o.probe(ctx, otherHS) {
+			o.mu.Lock()
+			o.retries++
+			o.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("WaitUntilHealed: %s cannot reach %s after %d retries: %w", otherHS, o.hsName, o.Retries(), ctx.Err())
+			case <-time.After(500 * time.Millisecond):
+			}
+		}
+	}
+	o.t.Logf("WaitUntilHealed: federation with %s resumed after %v (%d retries)", o.hsName, time.Since(start), o.Retries())
+	return nil
+}
+
+// Retries returns the number of failed attempts to reach the homeserver since End was called.
+func (o *FederationOutage) Retries() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.retries
+}
+
+func (o *FederationOutage) otherHomeservers() (hsNames []string) {
+	o.d.mu.RLock()
+	defer o.d.mu.RUnlock()
+	for hsName := range o.d.dnsToReverseProxyURL {
+		if hsName != o.hsName {
+			hsNames = append(hsNames, hsName)
+		}
+	}
+	return
+}
+
+// probe returns true if otherHS can make a federated request to the homeserver. The probe user
+// does not exist, so a healthy federation connection returns a 404.
+func (o *FederationOutage) probe(ctx context.Context, otherHS string) bool {
+	o.d.mu.RLock()
+	baseURL := o.d.dnsToReverseProxyURL[otherHS]
+	o.d.mu.RUnlock()
+	userID := fmt.Sprintf("@complement-crypto-federation-probe:%s", o.hsName)
+	reqCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, "GET", baseURL+"/_matrix/client/v3/profile/"+url.PathEscape(userID), nil)
+	if err != nil {
+		return false
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+	return res.StatusCode < 500
+}
@@ -0,0 +1,191 @@
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/must"
+	testcontainers "github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// Homeserver is an additional homeserver deployed for a single test with its own configuration,
+// see NewHomeserverWithConfig. It is on the same network as the homeservers made by Complement, so can
+// federate with them.
+//
+// Unlike those homeservers, traffic to this homeserver does not go via mitmproxy.
+type Homeserver struct {
+	// The server name of this homeserver, which is also its hostname on the docker network e.g "hs3"
+	// when there are 2 homeservers made by Complement.
+	ServerName string
+	// The URL of the client-server API, reachable from the host.
+	BaseURL   string
+	container testcontainers.Container
+	// used to make unique localparts
+	userCounter atomic.Int64
+}
+
+// NewHomeserverWithConfig deploys a new homeserver using the same image as hs1, with extra
+// environment variables set on the container e.g to enable MSCs or change rate limits. Which environment
+// variables are supported depends on the homeserver image. Environment variables propagated by Complement
+// via PASS_ are also set, but can be overridden by `env`.
+//
+// The homeserver is destroyed when the test ends, and its logs are written to ./logs.
+func (d *ComplementCryptoDeployment) NewHomeserverWithConfig(t *testing.T, env map[string]string) *Homeserver {
+	t.Helper()
+	return d.newHomeserver(t, homeserverOpts{env: env})
+}
+
+// homeserverOpts configures a homeserver made by newHomeserver.
+type homeserverOpts struct {
+	// extra environment variables set on the container
+	env map[string]string
+	// If set, this is merged into the Synapse config, overwriting any top-level keys which are already set. This only
+	// works for Synapse images built for Complement, so the test is skipped if hs1 does not have CapabilityExtraConfig.
+	extraConfigYAML string
+	// copied into the container before it starts, e.g for config which refers to other files.
+	extraFiles []testcontainers.ContainerFile
+}
+
+// newHomeserver deploys a new homeserver with the given options.
+func (d *ComplementCryptoDeployment) newHomeserver(t *testing.T, opts homeserverOpts) *Homeserver {
+	t.Helper()
+	env := opts.env
+	extraConfigYAML := opts.extraConfigYAML
+	if extraConfigYAML != "" {
+		d.RequireCapabilities(t, "hs1", CapabilityExtraConfig)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	cfg := d.Deployment.GetConfig()
+
+	d.mu.Lock()
+	d.numExtraHomeservers++
+	// hs1..hsN are made by Complement
+	serverName := fmt.Sprintf("hs%d", d.numHomeservers+d.numExtraHomeservers)
+	d.mu.Unlock()
+
+	// mirror how Complement configures homeserver containers
+	containerEnv := map[string]string{
+		"SERVER_NAME": serverName,
+	}
+	if cfg.EnvVarsPropagatePrefix != "" {
+		for _, ev := range os.Environ() {
+			if strings.HasPrefix(ev, cfg.EnvVarsPropagatePrefix) {
+				k, v, _ := strings.Cut(strings.TrimPrefix(ev, cfg.EnvVarsPropagatePrefix), "=")
+				containerEnv[k] = v
+			}
+		}
+	}
+	for k, v := range env {
+		containerEnv[k] = v
+	}
+	caCert, err := cfg.CACertificateBytes()
+	must.NotError(t, "failed to get CA certificate", err)
+	caKey, err := cfg.CAPrivateKeyBytes()
+	must.NotError(t, "failed to get CA key", err)
+
+	networkName := d.Deployment.Network()
+	req := testcontainers.ContainerRequest{
+		Image:        cfg.BaseImageURI,
+		ExposedPorts: []string{"8008/tcp"},
+		Env:          containerEnv,
+		Files: []testcontainers.ContainerFile{
+			{
+				Reader:            bytes.NewReader(caCert),
+				ContainerFilePath: "/complement/ca/ca.crt",
+				FileMode:          0o644,
+			},
+			{
+				Reader:            bytes.NewReader(caKey),
+				ContainerFilePath: "/complement/ca/ca.key",
+				FileMode:          0o644,
+			},
+		},
+		WaitingFor: wait.ForHTTP("/_matrix/client/versions").WithPort("8008/tcp"),
+		Networks:   []string{networkName},
+		NetworkAliases: map[string][]string{
+			networkName: {serverName},
+		},
+		HostConfigModifier: func(hc *container.HostConfig) {
+			if runtime.GOOS == "linux" {
+				hc.ExtraHosts = []string{"host.docker.internal:host-gateway"}
+			}
+		},
+	}
+	req.Files = append(req.Files, opts.extraFiles...)
+	if extraConfigYAML != "" {
+		// Complement Synapse images render this template into the shared config which is loaded after
+		// homeserver.yaml, so appending to it overrides the existing config.
+		req.Files = append(req.Files, testcontainers.ContainerFile{
+			Reader:            strings.NewReader("\n" + extraConfigYAML), // the template may not end with a newline
+			ContainerFilePath: "/conf/complement-crypto-extra.yaml",
+			FileMode:          0o644,
+		})
+		req.Entrypoint = []string{
+			"/bin/sh", "-c",
+			"cat /conf/complement-crypto-extra.yaml >> /conf/workers-shared-extra.yaml.j2 && exec /start_for_complement.sh",
+		}
+	}
+	hsContainer, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	must.NotError(t, "failed to start homeserver container "+serverName, err)
+	hs := &Homeserver{
+		ServerName: serverName,
+		BaseURL:    externalURL(t, hsContainer, "8008/tcp"),
+		container:  hsContainer,
+	}
+	t.Logf("NewHomeserverWithConfig: %s %s env=%v", serverName, hs.BaseURL, env)
+	t.Cleanup(hs.destroy)
+	return hs
+}
+
+// Register a new user on this homeserver.
+func (hs *Homeserver) Register(t *testing.T, opts helpers.RegistrationOpts) *client.CSAPI {
+	t.Helper()
+	password := opts.Password
+	if password == "" {
+		password = "complement_meets_min_password_req"
+	}
+	cli := &client.CSAPI{
+		BaseURL:          hs.BaseURL,
+		Client:           client.NewLoggedClient(t, hs.ServerName, nil),
+		SyncUntilTimeout: 5 * time.Second,
+		Password:         password,
+	}
+	localpart := idNamespace.Localpart(hs.userCounter.Add(1), opts.LocalpartSuffix)
+	if opts.IsAdmin {
+		cli.UserID, cli.AccessToken, cli.DeviceID = cli.RegisterSharedSecret(t, localpart, password, opts.IsAdmin)
+	} else {
+		cli.UserID, cli.AccessToken, cli.DeviceID = cli.RegisterUser(t, localpart, password)
+	}
+	mustClaim(t, idNamespace.ClaimUser(t.Name(), cli.UserID))
+	mustClaim(t, idNamespace.ClaimDevice(t.Name(), cli.UserID, cli.DeviceID))
+	return cli
+}
+
+func (hs *Homeserver) destroy() {
+	filename := fmt.Sprintf("container-%s.log", hs.ServerName)
+	logs, err := hs.container.Logs(context.Background())
+	if err != nil {
+		log.Printf("failed to get logs for file %s: %s", filename, err)
+	} else if err = writeContainerLogs(logs, filename); err != nil {
+		log.Printf("failed to write logs to %s: %s", filename, err)
+	}
+	if err := hs.container.Terminate(context.Background()); err != nil {
+		log.Printf("failed to stop %s: %s", hs.ServerName, err)
+	}
+}
@@ -0,0 +1,220 @@
+package deploy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+	"github.com/matrix-org/complement/must"
+	"gopkg.in/yaml.v3"
+)
+
+// The actions an InterceptRule can take.
+const (
+	InterceptActionDrop    = "drop"
+	InterceptActionDelay   = "delay"
+	InterceptActionRewrite = "rewrite"
+)
+
+// InterceptScript is a plan for how mitmproxy should interfere with traffic during a test, written in YAML so
+// network scenarios can be added without writing Go callbacks. For example:
+//
+//	description: Drop Alice's first two /sendToDevice requests, so she must retry sending room keys.
+//	rules:
+//	  - match:
+//	      endpoint: /sendToDevice
+//	      method: PUT
+//	      user: alice
+//	    action: drop
+//	    count: 2
+//
+// Rules are applied via the mitmproxy controller, so scripts can be used whilst tests intercept requests
+// via MITM().Configure. See ComplementCryptoDeployment.WithInterceptScript.
+type InterceptScript struct {
+	// What the script does, for test logs.
+	Description string `yaml:"description"`
+	// The rules to apply. Every rule is applied at the same time.
+	Rules []InterceptRule `yaml:"rules"`
+}
+
+// InterceptRule is a single action mitmproxy takes on matching HTTP flows.
+type InterceptRule struct {
+	Match InterceptMatch `yaml:"match"`
+	// One of "drop", "delay" or "rewrite".
+	Action string `yaml:"action"`
+	// When to act: "request" is before the request reaches the server, "response" is after the server has
+	// responded. Defaults to "request" for drops, and "response" for delays and rewrites.
+	Phase mitm.Phase `yaml:"phase"`
+	// If non-zero, stop after acting on this many flows.
+	Count int `yaml:"count"`
+	// For drops, the HTTP status code to respond with. Defaults to 502.
+	StatusCode int `yaml:"status_code"`
+	// For drops, the Matrix error code to respond with. Defaults to M_UNKNOWN.
+	ErrCode string `yaml:"errcode"`
+	// For delays, how long to hold each matching flow for e.g "2s".
+	Delay time.Duration `yaml:"delay"`
+	// For rewrites, the RFC 6901 JSON pointer to the value to replace in the body e.g "/device_keys".
+	Pointer string `yaml:"pointer"`
+	// For rewrites, the value to set, which may be any YAML value.
+	Value any `yaml:"value"`
+}
+
+// InterceptMatch describes which HTTP flows an InterceptRule applies to. Every field which is set must match.
+type InterceptMatch struct {
+	// The URL path must contain this string e.g "/keys/query". If unset, every path matches.
+	Endpoint string `yaml:"endpoint"`
+	// The HTTP method e.g "PUT". If unset, every method matches.
+	Method string `yaml:"method"`
+	// The name of the user making the request, as given to WithInterceptScript e.g "alice". If unset, requests
+	// from every user match.
+	User string `yaml:"user"`
+}
+
+// LoadInterceptScript reads and validates the intercept script in the YAML file at path.
+func LoadInterceptScript(path string) (*InterceptScript, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read intercept script: %s", err)
+	}
+	script, err := ParseInterceptScript(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return script, nil
+}
+
+// ParseInterceptScript parses and validates an intercept script. Unknown fields are rejected, so typos do not
+// silently leave traffic untouched.
+func ParseInterceptScript(data []byte) (*InterceptScript, error) {
+	var script InterceptScript
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&script); err != nil {
+		return nil, fmt.Errorf("invalid intercept script: %s", err)
+	}
+	if len(script.Rules) == 0 {
+		return nil, fmt.Errorf("intercept script has no rules")
+	}
+	for i := range script.Rules {
+		if err := script.Rules[i].validate(); err != nil {
+			return nil, fmt.Errorf("rule %d: %s", i, err)
+		}
+	}
+	return &script, nil
+}
+
+// validate checks the rule makes sense and sets the default phase.
+func (r *InterceptRule) validate() error {
+	if r.Count < 0 {
+		return fmt.Errorf("count must not be negative")
+	}
+	switch r.Phase {
+	case "", mitm.PhaseRequest, mitm.PhaseResponse:
+	default:
+		return fmt.Errorf("unknown phase %q, must be %q or %q", r.Phase, mitm.PhaseRequest, mitm.PhaseResponse)
+	}
+	switch r.Action {
+	case InterceptActionDrop:
+		if r.Phase == "" {
+			r.Phase = mitm.PhaseRequest
+		}
+	case InterceptActionDelay:
+		if r.Delay <= 0 {
+			return fmt.Errorf("delay rules need a positive delay e.g 2s")
+		}
+		if r.Phase == "" {
+			r.Phase = mitm.PhaseResponse
+		}
+	case InterceptActionRewrite:
+		if r.Pointer != "" && r.Pointer[0] != '/' {
+			return fmt.Errorf("pointer %q must start with '/'", r.Pointer)
+		}
+		if _, err := json.Marshal(r.Value); err != nil {
+			return fmt.Errorf("value cannot be converted to JSON: %s", err)
+		}
+		if r.Phase == "" {
+			r.Phase = mitm.PhaseResponse
+		}
+	case "":
+		return fmt.Errorf("missing action, must be one of %q, %q or %q", InterceptActionDrop, InterceptActionDelay, InterceptActionRewrite)
+	default:
+		return fmt.Errorf("unknown action %q, must be one of %q, %q or %q", r.Action, InterceptActionDrop, InterceptActionDelay, InterceptActionRewrite)
+	}
+	return nil
+}
+
+// filter returns the mitmproxy filter for this rule, looking up the access token of the user to match.
+func (r *InterceptRule) filter(accessTokens map[string]string) (string, error) {
+	params := mitm.FilterParams{
+		PathContains: r.Match.Endpoint,
+		Method:       r.Match.Method,
+	}
+	if r.Match.User != "" {
+		accessToken, ok := accessTokens[r.Match.User]
+		if !ok {
+			return "", fmt.Errorf("unknown user %q", r.Match.User)
+		}
+		params.AccessToken = accessToken
+	}
+	return params.FilterString(), nil
+}
+
+// WithInterceptScript applies every rule in the script whilst `inner` is called, returning how many flows each
+// rule acted on, in the same order as the rules. accessTokens maps the user names used in the script to their
+// access tokens e.g {"alice": alice.CurrentAccessToken(t)}. Fails the test if the script refers to other users.
+func (d *ComplementCryptoDeployment) WithInterceptScript(t *testing.T, script *InterceptScript, accessTokens map[string]string, inner func()) (counts []int) {
+	t.Helper()
+	t.Logf("WithInterceptScript: %s", script.Description)
+	counts = make([]int, len(script.Rules))
+	// deferred first so this runs after every rule has been removed
+	defer func() {
+		t.Logf("WithInterceptScript: rules acted on %v flows", counts)
+	}()
+	for i, rule := range script.Rules {
+		filter, err := rule.filter(accessTokens)
+		must.NotError(t, fmt.Sprintf("WithInterceptScript: rule %d", i), err)
+		switch rule.Action {
+		case InterceptActionDrop:
+			faultID := d.mitmClient.AddFault(t, mitm.Fault{
+				Filter:     filter,
+				DropRate:   1,
+				MaxDrops:   rule.Count,
+				StatusCode: rule.StatusCode,
+				ErrCode:    rule.ErrCode,
+				Phase:      rule.Phase,
+			})
+			defer func() {
+				counts[i] = d.mitmClient.RemoveFault(t, faultID).Dropped
+			}()
+		case InterceptActionDelay:
+			delayID := d.mitmClient.AddDelay(t, mitm.Delay{
+				Filter:  filter,
+				DelayMs: rule.Delay.Milliseconds(),
+				Count:   rule.Count,
+				Phase:   rule.Phase,
+			})
+			defer func() {
+				counts[i] = d.mitmClient.RemoveDelay(t, delayID)
+			}()
+		case InterceptActionRewrite:
+			value, err := json.Marshal(rule.Value)
+			must.NotError(t, "WithInterceptScript: failed to marshal value", err)
+			rewriteID := d.mitmClient.AddRewrite(t, mitm.Rewrite{
+				Filter:  filter,
+				Pointer: rule.Pointer,
+				Value:   value,
+				Count:   rule.Count,
+				Phase:   rule.Phase,
+			})
+			defer func() {
+				counts[i] = d.mitmClient.RemoveRewrite(t, rewriteID)
+			}()
+		}
+	}
+	inner()
+	return
+}
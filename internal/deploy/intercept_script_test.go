@@ -0,0 +1,93 @@
+package deploy
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+	"github.com/matrix-org/complement/must"
+)
+
+func TestParseInterceptScript(t *testing.T) {
+	script, err := ParseInterceptScript([]byte(`
+description: everything
+rules:
+  - match:
+      endpoint: /sendToDevice
+      method: PUT
+      user: alice
+    action: drop
+    count: 2
+  - match:
+      endpoint: /sync
+    action: delay
+    delay: 1500ms
+  - match:
+      endpoint: /keys/query
+    action: rewrite
+    phase: request
+    pointer: /device_keys
+    value:
+      "@alice:hs1": []
+`))
+	must.NotError(t, "ParseInterceptScript", err)
+	must.Equal(t, script.Description, "everything", "description")
+	must.Equal(t, len(script.Rules), 3, "rules")
+	drop, delay, rewrite := script.Rules[0], script.Rules[1], script.Rules[2]
+	must.Equal(t, drop.Phase, mitm.PhaseRequest, "drops default to the request phase")
+	must.Equal(t, drop.Count, 2, "drop count")
+	must.Equal(t, delay.Phase, mitm.PhaseResponse, "delays default to the response phase")
+	must.Equal(t, delay.Delay, 1500*time.Millisecond, "delay")
+	must.Equal(t, rewrite.Phase, mitm.PhaseRequest, "rewrite phase")
+
+	filter, err := drop.filter(map[string]string{"alice": "syt_alice"})
+	must.NotError(t, "filter", err)
+	must.Equal(t, filter, " ~u .*/sendToDevice.* ~m PUT ~hq syt_alice", "filter")
+	_, err = drop.filter(map[string]string{"bob": "syt_bob"})
+	must.Equal(t, err != nil, true, "filter for an unknown user did not fail")
+}
+
+func TestParseInterceptScriptErrors(t *testing.T) {
+	testCases := []struct {
+		name    string
+		script  string
+		wantErr string
+	}{
+		{name: "no rules", script: `description: nothing`, wantErr: "no rules"},
+		{name: "unknown field", script: "rules:\n  - action: drop\n    cuont: 1", wantErr: "cuont"},
+		{name: "missing action", script: "rules:\n  - count: 1", wantErr: "missing action"},
+		{name: "unknown action", script: "rules:\n  - action: explode", wantErr: "unknown action"},
+		{name: "unknown phase", script: "rules:\n  - action: drop\n    phase: later", wantErr: "unknown phase"},
+		{name: "delay without duration", script: "rules:\n  - action: delay", wantErr: "positive delay"},
+		{name: "bad duration", script: "rules:\n  - action: delay\n    delay: soon", wantErr: "invalid intercept script"},
+		{name: "bad pointer", script: "rules:\n  - action: rewrite\n    pointer: device_keys", wantErr: "must start with"},
+		{name: "negative count", script: "rules:\n  - action: drop\n    count: -1", wantErr: "negative"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseInterceptScript([]byte(tc.script))
+			if err == nil {
+				t.Fatalf("ParseInterceptScript: expected an error")
+			}
+			if !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("ParseInterceptScript: got error %q, want it to contain %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// Every checked in intercept script must be valid, so mistakes are caught without running the tests.
+func TestInterceptScriptsAreValid(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("..", "..", "tests", "testdata", "intercepts", "*.yaml"))
+	must.NotError(t, "failed to list intercept scripts", err)
+	if len(paths) == 0 {
+		t.Fatalf("no intercept scripts found")
+	}
+	for _, path := range paths {
+		if _, err := LoadInterceptScript(path); err != nil {
+			t.Errorf("%s", err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Package js installs a version of matrix-js-sdk for JS clients to run when the tests start, instead of the
+// version bundled in internal/api/js/chrome/dist. See COMPLEMENT_CRYPTO_JS_SDK.
+package js
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const jsSDKRepository = "https://github.com/matrix-org/matrix-js-sdk"
+
+// The files in internal/api/js/js-sdk which are needed to bundle the JS SDK.
+var bundleFiles = []string{"index.html", "package.json", "vite.config.js", "yarn.lock"}
+
+// PackageSpec converts a version of matrix-js-sdk into the package given to `yarn add`:
+//   - paths starting with '/' or '.' are a local checkout, which is linked so the checkout is used as-is.
+//   - anything containing '@' is already a package e.g matrix-js-sdk@34.0.0, as with ./rebuild_js_sdk.sh.
+//   - anything else is a branch, tag or commit in the matrix-js-sdk repository e.g develop.
+func PackageSpec(version string) (string, error) {
+	switch {
+	case version == "":
+		return "", fmt.Errorf("no matrix-js-sdk version given")
+	case strings.HasPrefix(version, "/") || strings.HasPrefix(version, "."):
+		dir, err := filepath.Abs(version)
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve matrix-js-sdk checkout %s: %s", version, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "package.json")); err != nil {
+			return "", fmt.Errorf("%s is not a matrix-js-sdk checkout: %s", dir, err)
+		}
+		return "matrix-js-sdk@link:" + dir, nil
+	case strings.Contains(version, "@"):
+		return version, nil
+	default:
+		return "matrix-js-sdk@" + jsSDKRepository + "#" + version, nil
+	}
+}
+
+// Install bundles the given version of matrix-js-sdk in the same way as ./rebuild_js_sdk.sh, and returns the
+// directory containing the bundle, for use with chrome.SetDistDirectory. The bundle is built in workDir, which is
+// created if it does not exist. Dependencies are kept in workDir between runs, so only the first install is slow.
+// Requires `yarn` on the PATH.
+func Install(version, workDir string) (distDir string, err error) {
+	pkg, err := PackageSpec(version)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %s", workDir, err)
+	}
+	// always start from the bundled package.json and yarn.lock, else the previous install would be kept
+	srcDir := bundleSourceDir()
+	for _, name := range bundleFiles {
+		data, err := os.ReadFile(filepath.Join(srcDir, name))
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %s", name, err)
+		}
+		if err := os.WriteFile(filepath.Join(workDir, name), data, 0644); err != nil {
+			return "", fmt.Errorf("failed to write %s: %s", name, err)
+		}
+	}
+	distDir = filepath.Join(workDir, "dist")
+	if err := os.RemoveAll(distDir); err != nil {
+		return "", fmt.Errorf("failed to remove old bundle: %s", err)
+	}
+	fmt.Printf("Installing %s into %s\n", pkg, workDir)
+	if err := yarn(workDir, "add", pkg); err != nil {
+		return "", err
+	}
+	if err := yarn(workDir, "build"); err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(filepath.Join(distDir, "index.html")); err != nil {
+		return "", fmt.Errorf("yarn build did not create %s: %s", distDir, err)
+	}
+	return distDir, nil
+}
+
+func yarn(dir string, args ...string) error {
+	cmd := exec.Command("yarn", args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("yarn %s failed: %s\n%s", strings.Join(args, " "), err, string(output))
+	}
+	return nil
+}
+
+// bundleSourceDir returns the path to internal/api/js/js-sdk. Tests always run from source, so this is found
+// relative to this file.
+func bundleSourceDir() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(file), "..", "..", "api", "js", "js-sdk")
+}
@@ -0,0 +1,47 @@
+package js
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPackageSpec(t *testing.T) {
+	checkout := t.TempDir()
+	if err := os.WriteFile(filepath.Join(checkout, "package.json"), []byte(`{"name":"matrix-js-sdk"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		version string
+		want    string
+	}{
+		{version: checkout, want: "matrix-js-sdk@link:" + checkout},
+		{version: "matrix-js-sdk@34.0.0", want: "matrix-js-sdk@34.0.0"},
+		{version: "matrix-js-sdk@file:/some/sdk", want: "matrix-js-sdk@file:/some/sdk"},
+		{version: "develop", want: "matrix-js-sdk@https://github.com/matrix-org/matrix-js-sdk#develop"},
+		{version: "36c958642cda08d32bc19c2303ebdfca470d03c1", want: "matrix-js-sdk@https://github.com/matrix-org/matrix-js-sdk#36c958642cda08d32bc19c2303ebdfca470d03c1"},
+	}
+	for _, tc := range testCases {
+		got, err := PackageSpec(tc.version)
+		if err != nil {
+			t.Errorf("PackageSpec(%s): %s", tc.version, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("PackageSpec(%s): got %s want %s", tc.version, got, tc.want)
+		}
+	}
+	for _, version := range []string{"", "./does-not-exist", filepath.Join(checkout, "missing")} {
+		if _, err := PackageSpec(version); err == nil {
+			t.Errorf("PackageSpec(%s): expected an error", version)
+		}
+	}
+}
+
+func TestBundleSourceDir(t *testing.T) {
+	for _, name := range bundleFiles {
+		if _, err := os.Stat(filepath.Join(bundleSourceDir(), name)); err != nil {
+			t.Errorf("bundle file missing: %s", err)
+		}
+	}
+}
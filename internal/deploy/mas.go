@@ -0,0 +1,273 @@
+package deploy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/must"
+	testcontainers "github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+const (
+	masImage = "ghcr.io/element-hq/matrix-authentication-service:0.12.0"
+	// the client ID Synapse uses to introspect tokens. MAS client IDs are ULIDs.
+	masSynapseClientID = "0000000000000000000SYNAPSE"
+)
+
+// OIDCHomeserver is a homeserver which delegates authentication to matrix-authentication-service (MAS),
+// as per MSC3861. Users must be registered via Register, and clients must log in with
+// api.ClientCreationOpts.UseOIDC. See NewOIDCHomeserver.
+type OIDCHomeserver struct {
+	*Homeserver
+	// The OIDC issuer, which is the URL of MAS. This is reachable from the host and from containers.
+	IssuerURL string
+	mas       testcontainers.Container
+	postgres  testcontainers.Container
+}
+
+// NewOIDCHomeserver deploys a new homeserver, configured as per NewHomeserverWithConfig, which delegates
+// authentication to a new MAS instance. Access tokens issued by MAS expire after accessTokenTTL, so tests can
+// exercise token refresh. MAS does not accept a TTL of less than a minute.
+//
+// MAS must be reachable at the same URL from the host and from the homeserver, so MAS is reached via the gateway
+// of the docker network. This works on Linux, but not with Docker Desktop. Only Synapse images built for Complement
+// can be configured to use MAS.
+//
+// MAS and its database are destroyed when the test ends, and their logs are written to ./logs.
+func (d *ComplementCryptoDeployment) NewOIDCHomeserver(t *testing.T, accessTokenTTL time.Duration) *OIDCHomeserver {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	networkName := d.Deployment.Network()
+
+	issuerURL := fmt.Sprintf("http://%s:%d/", d.networkGateway(t, ctx), freePort(t))
+	clientSecret := randomHex(t, 16)
+	adminToken := randomHex(t, 16)
+
+	// Synapse does not talk to MAS until it needs to introspect a token, so can start first.
+	hs := d.newHomeserver(t, homeserverOpts{extraConfigYAML: fmt.Sprintf(`
+enable_registration: false
+password_config:
+  enabled: false
+experimental_features:
+  msc3861:
+    enabled: true
+    issuer: %s
+    client_id: %s
+    client_auth_method: client_secret_basic
+    client_secret: %s
+    admin_token: %s
+`, issuerURL, masSynapseClientID, clientSecret, adminToken)})
+	o := &OIDCHomeserver{
+		Homeserver: hs,
+		IssuerURL:  issuerURL,
+	}
+	t.Cleanup(o.destroy)
+
+	postgresAlias := "mas-postgres-" + hs.ServerName
+	var err error
+	o.postgres, err = testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image: "postgres:16-alpine",
+			Env: map[string]string{
+				"POSTGRES_PASSWORD": "postgres",
+			},
+			// postgres restarts once it has initialised the database
+			WaitingFor: wait.ForLog("database system is ready to accept connections").WithOccurrence(2),
+			Networks:   []string{networkName},
+			NetworkAliases: map[string][]string{
+				networkName: {postgresAlias},
+			},
+		},
+		Started: true,
+	})
+	must.NotError(t, "failed to start MAS database container", err)
+
+	signingKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	must.NotError(t, "failed to generate MAS signing key", err)
+	signingKeyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(signingKey),
+	})
+	masConfig := fmt.Sprintf(`
+http:
+  public_base: %[1]s
+  issuer: %[1]s
+  listeners:
+    - name: web
+      resources:
+        - name: discovery
+        - name: human
+        - name: oauth
+        - name: compat
+        - name: graphql
+        - name: assets
+      binds:
+        - address: "[::]:8080"
+database:
+  uri: postgresql://postgres:postgres@%[2]s/postgres
+matrix:
+  homeserver: %[3]s
+  endpoint: http://%[3]s:8008/
+  secret: %[4]s
+clients:
+  - client_id: %[5]s
+    client_auth_method: client_secret_basic
+    client_secret: %[6]s
+passwords:
+  enabled: true
+  schemes:
+    - version: 1
+      algorithm: argon2id
+policy:
+  data:
+    client_registration:
+      allow_insecure_uris: true
+      allow_host_mismatch: true
+      allow_missing_contacts: true
+secrets:
+  encryption: %[7]s
+  keys:
+    - kid: complement-crypto
+      key: |
+%[8]s
+experimental:
+  access_token_ttl: %[9]d
+`, issuerURL, postgresAlias, hs.ServerName, adminToken, masSynapseClientID, clientSecret, randomHex(t, 32),
+		indent(string(signingKeyPEM), "        "), int(accessTokenTTL.Seconds()))
+
+	// bind to a fixed host port so the issuer URL is known before MAS starts
+	issuerPort := strings.TrimSuffix(issuerURL[strings.LastIndex(issuerURL, ":")+1:], "/")
+	o.mas, err = testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        masImage,
+			ExposedPorts: []string{issuerPort + ":8080/tcp"},
+			Env: map[string]string{
+				"MAS_CONFIG": "/config.yaml",
+			},
+			Cmd: []string{"server"},
+			Files: []testcontainers.ContainerFile{
+				{
+					Reader:            strings.NewReader(masConfig),
+					ContainerFilePath: "/config.yaml",
+					FileMode:          0o644,
+				},
+			},
+			WaitingFor: wait.ForHTTP("/.well-known/openid-configuration").WithPort("8080/tcp"),
+			Networks:   []string{networkName},
+		},
+		Started: true,
+	})
+	must.NotError(t, "failed to start MAS container", err)
+	t.Logf("NewOIDCHomeserver: %s %s issuer=%s", hs.ServerName, hs.BaseURL, issuerURL)
+	return o
+}
+
+// Register a new user in MAS. The returned client is not logged in, as the homeserver does not support
+// password login: use api.ClientCreationOpts.UseOIDC to log in with the returned user ID and password.
+// opts.IsAdmin is not supported.
+func (o *OIDCHomeserver) Register(t *testing.T, opts helpers.RegistrationOpts) *client.CSAPI {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	password := opts.Password
+	if password == "" {
+		password = "complement_meets_min_password_req"
+	}
+	localpart := idNamespace.Localpart(o.userCounter.Add(1), opts.LocalpartSuffix)
+	userID := fmt.Sprintf("@%s:%s", localpart, o.ServerName)
+	mustClaim(t, idNamespace.ClaimUser(t.Name(), userID))
+	exitCode, output, err := o.mas.Exec(ctx, []string{
+		"mas-cli", "manage", "register-user", "--yes", "--ignore-password-complexity", "--password", password, localpart,
+	})
+	must.NotError(t, "failed to exec mas-cli", err)
+	if exitCode != 0 {
+		out, _ := io.ReadAll(output)
+		ct.Fatalf(t, "Register: mas-cli exited with code %d: %s", exitCode, string(out))
+	}
+	return &client.CSAPI{
+		BaseURL:          o.BaseURL,
+		Client:           client.NewLoggedClient(t, o.ServerName, nil),
+		SyncUntilTimeout: 5 * time.Second,
+		UserID:           userID,
+		Password:         password,
+	}
+}
+
+func (o *OIDCHomeserver) destroy() {
+	for name, c := range map[string]testcontainers.Container{
+		"mas-" + o.ServerName:          o.mas,
+		"mas-postgres-" + o.ServerName: o.postgres,
+	} {
+		if c == nil {
+			continue
+		}
+		filename := fmt.Sprintf("container-%s.log", name)
+		if logs, err := c.Logs(context.Background()); err != nil {
+			log.Printf("failed to get logs for file %s: %s", filename, err)
+		} else if err = writeContainerLogs(logs, filename); err != nil {
+			log.Printf("failed to write logs to %s: %s", filename, err)
+		}
+		if err := c.Terminate(context.Background()); err != nil {
+			log.Printf("failed to stop %s: %s", name, err)
+		}
+	}
+}
+
+// networkGateway returns the IP address of the docker network's gateway, which is the host's address on the
+// network. Containers and the host can both reach ports published on this address.
+func (d *ComplementCryptoDeployment) networkGateway(t *testing.T, ctx context.Context) string {
+	t.Helper()
+	dockerClient, err := testcontainers.NewDockerClientWithOpts(ctx)
+	must.NotError(t, "failed to make docker client", err)
+	defer dockerClient.Close()
+	res, err := dockerClient.NetworkInspect(ctx, d.Deployment.Network(), types.NetworkInspectOptions{})
+	must.NotError(t, "failed to inspect docker network", err)
+	for _, cfg := range res.IPAM.Config {
+		if cfg.Gateway != "" && !strings.Contains(cfg.Gateway, ":") { // prefer IPv4
+			return cfg.Gateway
+		}
+	}
+	ct.Fatalf(t, "docker network %s has no IPv4 gateway", d.Deployment.Network())
+	return ""
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", ":0")
+	must.NotError(t, "failed to find a free port", err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func randomHex(t testing.TB, numBytes int) string {
+	t.Helper()
+	b := make([]byte, numBytes)
+	_, err := rand.Read(b)
+	must.NotError(t, "failed to generate random bytes", err)
+	return hex.EncodeToString(b)
+}
+
+func indent(s, prefix string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	for i := range lines {
+		lines[i] = prefix + lines[i]
+	}
+	return strings.Join(lines, "\n")
+}
@@ -6,9 +6,11 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/matrix-org/complement/ct"
 	"github.com/matrix-org/complement/must"
 )
 
@@ -90,3 +92,338 @@ func (m *Client) UnlockOptions(t *testing.T, lockID []byte) {
 	must.NotError(t, "failed to do request", err)
 	must.Equal(t, res.StatusCode, 200, "controller returned wrong HTTP status")
 }
+
+// lockSharedOption sets an option which more than one lock can set at the same time, returning the lock ID which
+// must be passed to unlockSharedOption. Shared options are used by addons which tests may want to use whilst also
+// intercepting requests via .Configure, see register_shared_option in controller.py.
+func (m *Client) lockSharedOption(t ct.TestLike, name string, value any) (lockID string) {
+	jsonBody, err := json.Marshal(map[string]any{
+		"options": map[string]any{
+			name: value,
+		},
+	})
+	must.NotError(t, "failed to marshal options", err)
+	t.Logf("lockSharedOption: %v", string(jsonBody))
+	u := magicMITMURL + "/options/lock"
+	req, err := http.NewRequest("POST", u, bytes.NewBuffer(jsonBody))
+	must.NotError(t, "failed to prepare request", err)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := m.client.Do(req)
+	must.NotError(t, "failed to POST "+u, err)
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		errBody, _ := io.ReadAll(res.Body)
+		ct.Fatalf(t, "lockSharedOption: controller returned HTTP %d: %s", res.StatusCode, string(errBody))
+	}
+	var body struct {
+		ResetID string `json:"reset_id"`
+	}
+	must.NotError(t, "failed to decode response", json.NewDecoder(res.Body).Decode(&body))
+	return body.ResetID
+}
+
+// unlockSharedOption removes the value set by lockSharedOption, decoding what the addon did whilst the lock was
+// held into result, if it is not nil.
+func (m *Client) unlockSharedOption(t ct.TestLike, name, lockID string, result any) {
+	t.Logf("unlockSharedOption: %s %s", name, lockID)
+	jsonBody, err := json.Marshal(map[string]any{
+		"reset_id": lockID,
+	})
+	must.NotError(t, "failed to marshal reset ID", err)
+	u := magicMITMURL + "/options/unlock"
+	req, err := http.NewRequest("POST", u, bytes.NewBuffer(jsonBody))
+	must.NotError(t, "failed to prepare request", err)
+	req.Header.Set("Content-Type", "application/json")
+	// what the addon did can be large e.g recorded flows, so allow longer than usual to download it
+	cli := *m.client
+	cli.Timeout = time.Minute
+	res, err := cli.Do(req)
+	must.NotError(t, "failed to POST "+u, err)
+	defer res.Body.Close()
+	must.Equal(t, res.StatusCode, 200, "controller returned wrong HTTP status")
+	var body struct {
+		Unlocked map[string]json.RawMessage `json:"unlocked"`
+	}
+	must.NotError(t, "failed to decode response", json.NewDecoder(res.Body).Decode(&body))
+	if result != nil {
+		must.NotError(t, "failed to decode "+name, json.Unmarshal(body.Unlocked[name], result))
+	}
+}
+
+// NetworkCondition is a set of degraded network conditions applied to requests matching the filter.
+type NetworkCondition struct {
+	// Which HTTP requests/responses this condition applies to. If empty, applies to all requests.
+	Filter string `json:"filter,omitempty"`
+	// The number of milliseconds to delay matching requests by.
+	LatencyMs int64 `json:"latency_ms,omitempty"`
+	// If non-zero, delay matching requests and responses in proportion to their body size.
+	BandwidthBytesPerSec int64 `json:"bandwidth_bytes_per_sec,omitempty"`
+}
+
+// AddNetworkConditions starts applying the network conditions, returning an ID which must be passed to
+// RemoveNetworkConditions. If conditions from more than one call apply to a request, the delays are added
+// together. Network conditions can be applied whilst the test is intercepting requests via .Configure.
+// This is a low-level function: tests should typically use deploy.NetworkController instead.
+func (m *Client) AddNetworkConditions(t *testing.T, conditions []NetworkCondition) (networkID string) {
+	return m.lockSharedOption(t, "network", map[string]any{
+		"conditions": conditions,
+	})
+}
+
+// RemoveNetworkConditions stops applying the network conditions added by AddNetworkConditions.
+func (m *Client) RemoveNetworkConditions(t *testing.T, networkID string) {
+	m.unlockSharedOption(t, "network", networkID, nil)
+}
+
+// Phase is the point in an HTTP flow at which mitmproxy acts on it.
+type Phase string
+
+const (
+	// Before the request is sent to the server.
+	PhaseRequest Phase = "request"
+	// After the server has responded, before the response is sent to the client.
+	PhaseResponse Phase = "response"
+)
+
+// Fault describes requests which mitmproxy should randomly drop.
+type Fault struct {
+	// Which HTTP requests this fault applies to. If empty, applies to all requests.
+	Filter string `json:"filter,omitempty"`
+	// The probability between 0 and 1 that a matching request is dropped.
+	DropRate float64 `json:"drop_rate"`
+	// If non-zero, stop dropping requests after this many have been dropped.
+	MaxDrops int `json:"max_drops,omitempty"`
+	// The HTTP status code returned for dropped requests. Defaults to 502.
+	StatusCode int `json:"status_code,omitempty"`
+	// If non-zero, the seed for the random number generator, making the dropped requests repeatable.
+	Seed int64 `json:"seed,omitempty"`
+	// The Matrix error code returned for dropped requests. Defaults to M_UNKNOWN.
+	ErrCode string `json:"errcode,omitempty"`
+	// If non-zero, dropped requests include this retry_after_ms and a Retry-After header.
+	RetryAfterMs int64 `json:"retry_after_ms,omitempty"`
+	// When to drop matching flows, defaults to PhaseRequest. In PhaseResponse the server has already
+	// processed the request when the response is dropped.
+	Phase Phase `json:"phase,omitempty"`
+}
+
+// FaultStats is returned when a fault is removed.
+type FaultStats struct {
+	// The number of requests the fault dropped.
+	Dropped int `json:"dropped"`
+	// The number of milliseconds between the last dropped request and the next matching request,
+	// or nil if no matching request was made after the last dropped request.
+	RetryDelayMs *int64 `json:"retry_delay_ms"`
+}
+
+// AddFault starts dropping requests which match the fault, returning an ID which must be passed
+// to RemoveFault. Faults can be injected whilst the test is intercepting requests via .Configure.
+// This is a low-level function: tests should typically use deploy.WithFaultInjection instead.
+func (m *Client) AddFault(t *testing.T, fault Fault) (faultID string) {
+	return m.lockSharedOption(t, "faults", fault)
+}
+
+// RemoveFault stops dropping requests for the given fault, returning stats about the requests it dropped.
+func (m *Client) RemoveFault(t *testing.T, faultID string) FaultStats {
+	var stats FaultStats
+	m.unlockSharedOption(t, "faults", faultID, &stats)
+	return stats
+}
+
+// Chaos describes how often mitmproxy should take the reverse proxy down.
+type Chaos struct {
+	// The number of milliseconds the proxy is up for between outages.
+	IntervalMs int64 `json:"interval_ms"`
+	// If non-zero, each interval is randomly lengthened or shortened by up to this many milliseconds.
+	JitterMs int64 `json:"jitter_ms,omitempty"`
+	// The number of milliseconds the proxy is down for in each outage.
+	DowntimeMs int64 `json:"downtime_ms"`
+	// If non-zero, the seed for the random number generator, making the outages repeatable.
+	Seed int64 `json:"seed,omitempty"`
+}
+
+// AddChaos starts periodically taking the reverse proxy down, returning an ID which must be passed
+// to RemoveChaos. Chaos can be applied whilst the test is intercepting requests via .Configure.
+// This is a low-level function: tests should typically use deploy.WithProxyChaos instead.
+func (m *Client) AddChaos(t *testing.T, chaos Chaos) (chaosID string) {
+	return m.lockSharedOption(t, "chaos", chaos)
+}
+
+// RemoveChaos stops taking the reverse proxy down, returning the number of outages there were.
+func (m *Client) RemoveChaos(t *testing.T, chaosID string) (restarts int) {
+	var body struct {
+		Restarts int `json:"restarts"`
+	}
+	m.unlockSharedOption(t, "chaos", chaosID, &body)
+	return body.Restarts
+}
+
+// Delay describes responses which mitmproxy should hold back before sending them to the client.
+type Delay struct {
+	// Which HTTP flows this delay applies to. If empty, applies to all responses.
+	Filter string `json:"filter,omitempty"`
+	// The number of milliseconds to hold each matching response for.
+	DelayMs int64 `json:"delay_ms"`
+	// If non-zero, stop delaying responses after this many have been delayed.
+	Count int `json:"count,omitempty"`
+	// When to delay matching flows, defaults to PhaseResponse.
+	Phase Phase `json:"phase,omitempty"`
+}
+
+// AddDelay starts holding back responses which match the delay, returning an ID which must be passed
+// to RemoveDelay. Delays can be applied whilst the test is intercepting requests via .Configure.
+// This is a low-level function: tests should typically use deploy.DelayEndpoint instead.
+func (m *Client) AddDelay(t *testing.T, delay Delay) (delayID string) {
+	return m.lockSharedOption(t, "delays", delay)
+}
+
+// RemoveDelay stops holding back responses for the given delay, returning the number of responses it delayed.
+func (m *Client) RemoveDelay(t *testing.T, delayID string) (delayed int) {
+	var body struct {
+		Delayed int `json:"delayed"`
+	}
+	m.unlockSharedOption(t, "delays", delayID, &body)
+	return body.Delayed
+}
+
+// Reorder describes to-device messages in /sync responses which mitmproxy should deliver out of order.
+type Reorder struct {
+	// Which HTTP flows this reorder applies to. If empty, applies to all /sync responses.
+	Filter string `json:"filter,omitempty"`
+	// If set, only hold back to-device messages of this type.
+	EventType string `json:"event_type,omitempty"`
+	// The number of to-device messages to hold back each time. Defaults to 1.
+	Hold int `json:"hold,omitempty"`
+	// If non-zero, the number of milliseconds to hold messages for if no newer messages arrive. Defaults to 5000.
+	MaxHoldMs int64 `json:"max_hold_ms,omitempty"`
+}
+
+// AddReorder starts holding back to-device messages which match the reorder, delivering them after newer
+// messages, returning an ID which must be passed to RemoveReorder. Reorders can be applied whilst the test is
+// intercepting requests via .Configure. This is a low-level function: tests should typically use
+// deploy.WithReorderedToDevice instead.
+func (m *Client) AddReorder(t *testing.T, reorder Reorder) (reorderID string) {
+	return m.lockSharedOption(t, "reorder", reorder)
+}
+
+// RemoveReorder stops reordering to-device messages, returning the number of times messages were delivered
+// out of order. Messages which are still being held back are delivered in the next matching /sync response.
+func (m *Client) RemoveReorder(t *testing.T, reorderID string) (reordered int) {
+	var body struct {
+		Reordered int `json:"reordered"`
+	}
+	m.unlockSharedOption(t, "reorder", reorderID, &body)
+	return body.Reordered
+}
+
+// Rewrite describes a value in JSON responses which mitmproxy should replace before sending them to the client.
+type Rewrite struct {
+	// Which HTTP flows this rewrite applies to. If empty, applies to all JSON responses.
+	Filter string `json:"filter,omitempty"`
+	// The RFC 6901 JSON pointer to the value to replace, see JSONPointer.
+	Pointer string `json:"pointer"`
+	// The JSON value to set.
+	Value json.RawMessage `json:"value"`
+	// If non-zero, stop rewriting responses after this many have been rewritten.
+	Count int `json:"count,omitempty"`
+	// Whether to rewrite request or response bodies, defaults to PhaseResponse.
+	Phase Phase `json:"phase,omitempty"`
+}
+
+// JSONPointer returns the RFC 6901 JSON pointer for the given object members or array indexes, escaping
+// them as needed, e.g JSONPointer("device_keys", userID, deviceID, "keys").
+func JSONPointer(tokens ...string) string {
+	var sb strings.Builder
+	for _, token := range tokens {
+		sb.WriteString("/")
+		sb.WriteString(strings.NewReplacer("~", "~0", "/", "~1").Replace(token))
+	}
+	return sb.String()
+}
+
+// AddRewrite starts replacing the value at the rewrite's pointer in responses which match the rewrite, returning
+// an ID which must be passed to RemoveRewrite. Rewrites can be applied whilst the test is intercepting requests
+// via .Configure. This is a low-level function: tests should typically use deploy.WithResponseRewrite instead.
+func (m *Client) AddRewrite(t *testing.T, rewrite Rewrite) (rewriteID string) {
+	return m.lockSharedOption(t, "rewrites", rewrite)
+}
+
+// RemoveRewrite stops rewriting responses for the given rewrite, returning the number of responses it rewrote.
+func (m *Client) RemoveRewrite(t *testing.T, rewriteID string) (rewritten int) {
+	var body struct {
+		Rewritten int `json:"rewritten"`
+	}
+	m.unlockSharedOption(t, "rewrites", rewriteID, &body)
+	return body.Rewritten
+}
+
+// BadCertificate describes an invalid TLS certificate which the reverse proxy should serve.
+type BadCertificate struct {
+	// One of "expired", "self_signed" or "wrong_host".
+	Kind string `json:"kind"`
+}
+
+// ReverseProxyCA returns the PEM encoded CA certificate which issues the TLS certificates served by the
+// reverse proxy, apart from self-signed bad certificates.
+func (m *Client) ReverseProxyCA(t *testing.T) (caPEM []byte) {
+	u := magicMITMURL + "/certificates/ca"
+	res, err := m.client.Get(u)
+	must.NotError(t, "failed to GET "+u, err)
+	must.Equal(t, res.StatusCode, 200, "controller returned wrong HTTP status")
+	var body struct {
+		CAPEM string `json:"ca_pem"`
+	}
+	must.NotError(t, "failed to decode response", json.NewDecoder(res.Body).Decode(&body))
+	return []byte(body.CAPEM)
+}
+
+// AddBadCertificate starts serving the bad certificate from the reverse proxy to clients which connect via TLS,
+// returning an ID which must be passed to RemoveBadCertificate. Bad certificates can be applied whilst the test is
+// intercepting requests via .Configure. This is a low-level function: tests should typically use
+// deploy.WithBadCertificate instead.
+func (m *Client) AddBadCertificate(t *testing.T, badCert BadCertificate) (badCertID string) {
+	return m.lockSharedOption(t, "bad_certificates", badCert)
+}
+
+// RemoveBadCertificate stops serving the bad certificate, returning the number of TLS handshakes it was served in.
+func (m *Client) RemoveBadCertificate(t *testing.T, badCertID string) (handshakes int) {
+	var body struct {
+		Handshakes int `json:"handshakes"`
+	}
+	m.unlockSharedOption(t, "bad_certificates", badCertID, &body)
+	return body.Handshakes
+}
+
+// RecordedFlow is a single HTTP request and response which passed through mitmproxy.
+type RecordedFlow struct {
+	// When mitmproxy received the request, in milliseconds since the epoch.
+	RequestTimestampMs int64  `json:"request_ts"`
+	Method             string `json:"method"`
+	// The URL of the homeserver being proxied to e.g http://hs1:8008/_matrix/client/versions
+	URL            string              `json:"url"`
+	RequestHeaders map[string][]string `json:"request_headers"`
+	RequestBody    []byte              `json:"request_body"`
+	// When mitmproxy finished receiving the response, in milliseconds since the epoch. Zero if there was no response.
+	ResponseTimestampMs int64               `json:"response_ts,omitempty"`
+	ResponseCode        int                 `json:"response_code,omitempty"`
+	ResponseHeaders     map[string][]string `json:"response_headers,omitempty"`
+	ResponseBody        []byte              `json:"response_body,omitempty"`
+	// Set if there was no response e.g the connection was killed.
+	Error string `json:"error,omitempty"`
+}
+
+// StartRecording starts recording every HTTP flow passing through mitmproxy, returning an ID which must be
+// passed to StopRecording. Traffic can be recorded whilst the test is intercepting requests via .Configure.
+// This is a low-level function: tests should typically use deploy.RecordTraffic instead.
+func (m *Client) StartRecording(t ct.TestLike) (recordingID string) {
+	return m.lockSharedOption(t, "recordings", map[string]any{})
+}
+
+// StopRecording stops recording HTTP flows, returning every flow recorded since StartRecording in the
+// order they completed.
+func (m *Client) StopRecording(t ct.TestLike, recordingID string) []RecordedFlow {
+	var body struct {
+		Flows []RecordedFlow `json:"flows"`
+	}
+	m.unlockSharedOption(t, "recordings", recordingID, &body)
+	return body.Flows
+}
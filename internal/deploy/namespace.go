@@ -0,0 +1,134 @@
+package deploy
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// idNamespace is shared by every deployment in this test run. See SetIDNamespace.
+var idNamespace = NewIDNamespace("")
+
+// SetIDNamespace sets the namespace used for every user registered and device logged in from now on.
+// This should be called before any deployments are made.
+func SetIDNamespace(ns *IDNamespace) {
+	idNamespace = ns
+}
+
+// IDNamespace makes the user IDs allocated during a test run unique to that run, and detects when two tests are
+// handed the same user or device.
+//
+// Localparts are allocated from counters which restart with each run e.g @user-3-alice:hs1. When dirty runs reuse
+// homeservers which outlive a run, a later run can therefore allocate a user ID which already exists, and tests
+// interfere with each other via the existing user's devices, rooms and keys. To prevent this, every localpart
+// includes a per-run nonce. Complement always starts localparts with the counter, so the nonce follows it
+// e.g @user-3-k7f2q9-alice:hs1.
+type IDNamespace struct {
+	nonce string
+	mu    sync.Mutex
+	// user ID => the test which registered the user
+	users map[string]string
+	// user ID => device ID => the test which logged in the device
+	devices map[string]map[string]string
+}
+
+// NewIDNamespace makes a namespace with the given nonce, which must only contain lowercase letters and digits.
+// If the nonce is empty, a random one is used.
+func NewIDNamespace(nonce string) *IDNamespace {
+	if nonce == "" {
+		nonce = randomNonce()
+	}
+	return &IDNamespace{
+		nonce:   nonce,
+		users:   make(map[string]string),
+		devices: make(map[string]map[string]string),
+	}
+}
+
+// Nonce returns the nonce included in every localpart allocated by this namespace.
+func (n *IDNamespace) Nonce() string {
+	return n.nonce
+}
+
+// LocalpartSuffix returns the suffix to give Complement when registering a user, which includes the nonce.
+// The suffix requested by the test, if any, comes last e.g "k7f2q9-alice".
+func (n *IDNamespace) LocalpartSuffix(suffix string) string {
+	if suffix == "" {
+		return n.nonce
+	}
+	return n.nonce + "-" + suffix
+}
+
+// Localpart returns the localpart for the nth user registered on a homeserver made by this package, in the same
+// format as Complement's e.g "user-3-k7f2q9-alice".
+func (n *IDNamespace) Localpart(counter int64, suffix string) string {
+	return fmt.Sprintf("user-%d-%s", counter, n.LocalpartSuffix(suffix))
+}
+
+// ClaimUser records that the test registered the user. Returns an error if the user was already registered
+// during this run, as two tests would then share the user.
+func (n *IDNamespace) ClaimUser(testName, userID string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if owner, ok := n.users[userID]; ok {
+		return fmt.Errorf("user ID collision: %s was already registered by %s", userID, owner)
+	}
+	n.users[userID] = testName
+	return nil
+}
+
+// ClaimDevice records that the test logged in the device. Returns an error if another test logged in the same
+// device and it has not been released via ReleaseDevices. Tests may log in their own devices again, including
+// devices logged in by their parent test or subtests.
+func (n *IDNamespace) ClaimDevice(testName, userID, deviceID string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	devices := n.devices[userID]
+	if devices == nil {
+		devices = make(map[string]string)
+		n.devices[userID] = devices
+	}
+	if owner, ok := devices[deviceID]; ok && !sameTest(owner, testName) {
+		return fmt.Errorf("device ID collision: %s (%s) is still in use by %s", userID, deviceID, owner)
+	}
+	devices[deviceID] = testName
+	return nil
+}
+
+// ReleaseDevices records that the user's devices were deleted, so later tests may log in devices with the
+// same IDs.
+func (n *IDNamespace) ReleaseDevices(userID string, deviceIDs []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, deviceID := range deviceIDs {
+		delete(n.devices[userID], deviceID)
+	}
+}
+
+// sameTest returns true if the test names are the same test, or one is a subtest of the other.
+func sameTest(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
+func randomNonce() string {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		panic("failed to generate ID nonce: " + err.Error())
+	}
+	for i := range b {
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return string(b)
+}
+
+// mustClaim fails the test if err is an ID collision from ClaimUser or ClaimDevice.
+func mustClaim(t ct.TestLike, err error) {
+	t.Helper()
+	if err != nil {
+		ct.Fatalf(t, "IDNamespace: %s", err)
+	}
+}
@@ -0,0 +1,62 @@
+package deploy
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestIDNamespaceLocalparts(t *testing.T) {
+	ns := NewIDNamespace("abc123")
+	if got := ns.LocalpartSuffix(""); got != "abc123" {
+		t.Errorf("LocalpartSuffix: got %s want abc123", got)
+	}
+	if got := ns.LocalpartSuffix("alice"); got != "abc123-alice" {
+		t.Errorf("LocalpartSuffix: got %s want abc123-alice", got)
+	}
+	if got := ns.Localpart(3, "alice"); got != "user-3-abc123-alice" {
+		t.Errorf("Localpart: got %s want user-3-abc123-alice", got)
+	}
+
+	random := NewIDNamespace("")
+	if !regexp.MustCompile(`^[a-z0-9]{6}$`).MatchString(random.Nonce()) {
+		t.Errorf("random nonce is not a valid localpart: %s", random.Nonce())
+	}
+	if random.Nonce() == NewIDNamespace("").Nonce() {
+		t.Errorf("random nonces should differ between namespaces")
+	}
+}
+
+func TestIDNamespaceCollisions(t *testing.T) {
+	ns := NewIDNamespace("abc123")
+	if err := ns.ClaimUser("TestA", "@user-1-abc123-alice:hs1"); err != nil {
+		t.Fatalf("ClaimUser: %s", err)
+	}
+	if err := ns.ClaimUser("TestB", "@user-1-abc123-alice:hs1"); err == nil {
+		t.Errorf("ClaimUser: expected a collision when registering the same user twice")
+	}
+
+	if err := ns.ClaimDevice("TestA", "@user-1-abc123-alice:hs1", "OTHER_DEVICE"); err != nil {
+		t.Fatalf("ClaimDevice: %s", err)
+	}
+	// the same test, and its subtests, can log in the device again
+	for _, testName := range []string{"TestA", "TestA/jr"} {
+		if err := ns.ClaimDevice(testName, "@user-1-abc123-alice:hs1", "OTHER_DEVICE"); err != nil {
+			t.Errorf("ClaimDevice(%s): %s", testName, err)
+		}
+	}
+	// other tests cannot, even if their name starts with the same test name
+	for _, testName := range []string{"TestB", "TestAB"} {
+		if err := ns.ClaimDevice(testName, "@user-1-abc123-alice:hs1", "OTHER_DEVICE"); err == nil {
+			t.Errorf("ClaimDevice(%s): expected a collision with a device in use by another test", testName)
+		}
+	}
+	// other users can have devices with the same ID
+	if err := ns.ClaimDevice("TestB", "@user-2-abc123-bob:hs1", "OTHER_DEVICE"); err != nil {
+		t.Errorf("ClaimDevice: %s", err)
+	}
+	// once released, other tests can use the device ID
+	ns.ReleaseDevices("@user-1-abc123-alice:hs1", []string{"OTHER_DEVICE"})
+	if err := ns.ClaimDevice("TestB", "@user-1-abc123-alice:hs1", "OTHER_DEVICE"); err != nil {
+		t.Errorf("ClaimDevice after ReleaseDevices: %s", err)
+	}
+}
@@ -0,0 +1,121 @@
+package deploy
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+)
+
+// NetworkController simulates degraded network conditions between clients and homeservers,
+// by delaying HTTP traffic as it passes through mitmproxy. Conditions can be applied to all
+// traffic to a homeserver, or to all traffic from a single client.
+//
+// Conditions are applied immediately, and are reset automatically when the test ends. They can
+// be used at the same time as intercepting requests via MITM().Configure.
+type NetworkController struct {
+	t          *testing.T
+	mitmClient *mitm.Client
+	mu         sync.Mutex
+	// keyed on the mitmproxy filter
+	conditions map[string]mitm.NetworkCondition
+	// the ID of the conditions currently applied, if any
+	networkID string
+}
+
+// Network returns a controller which can degrade network conditions for this test.
+// All conditions are reset when the test ends.
+func (d *ComplementCryptoDeployment) Network(t *testing.T) *NetworkController {
+	n := &NetworkController{
+		t:          t,
+		mitmClient: d.mitmClient,
+		conditions: make(map[string]mitm.NetworkCondition),
+	}
+	t.Cleanup(n.Reset)
+	return n
+}
+
+// SetLatency delays all requests to the given homeserver (e.g "hs1") by the given duration.
+// A latency of 0 removes any latency previously set.
+func (n *NetworkController) SetLatency(hsName string, latency time.Duration) {
+	n.update(homeserverFilter(hsName), func(c *mitm.NetworkCondition) {
+		c.LatencyMs = latency.Milliseconds()
+	})
+}
+
+// SetBandwidth limits the bandwidth of all requests and responses to the given homeserver (e.g "hs1").
+// A bandwidth of 0 removes any limit previously set.
+func (n *NetworkController) SetBandwidth(hsName string, bytesPerSecond int64) {
+	n.update(homeserverFilter(hsName), func(c *mitm.NetworkCondition) {
+		c.BandwidthBytesPerSec = bytesPerSecond
+	})
+}
+
+// SetClientLatency delays all requests made with the given access token by the given duration.
+// A latency of 0 removes any latency previously set.
+func (n *NetworkController) SetClientLatency(accessToken string, latency time.Duration) {
+	n.update(clientFilter(accessToken), func(c *mitm.NetworkCondition) {
+		c.LatencyMs = latency.Milliseconds()
+	})
+}
+
+// SetClientBandwidth limits the bandwidth of all requests and responses made with the given access token.
+// A bandwidth of 0 removes any limit previously set.
+func (n *NetworkController) SetClientBandwidth(accessToken string, bytesPerSecond int64) {
+	n.update(clientFilter(accessToken), func(c *mitm.NetworkCondition) {
+		c.BandwidthBytesPerSec = bytesPerSecond
+	})
+}
+
+// Reset removes all degraded network conditions.
+func (n *NetworkController) Reset() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.conditions = make(map[string]mitm.NetworkCondition)
+	n.apply(nil)
+}
+
+func (n *NetworkController) update(filter string, modify func(c *mitm.NetworkCondition)) {
+	n.t.Helper()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	cond := n.conditions[filter]
+	cond.Filter = filter
+	modify(&cond)
+	if cond.LatencyMs == 0 && cond.BandwidthBytesPerSec == 0 {
+		delete(n.conditions, filter)
+	} else {
+		n.conditions[filter] = cond
+	}
+	// sort so we send conditions in a stable order, which makes the logs easier to read
+	conditions := make([]mitm.NetworkCondition, 0, len(n.conditions))
+	for _, c := range n.conditions {
+		conditions = append(conditions, c)
+	}
+	sort.Slice(conditions, func(i, j int) bool {
+		return conditions[i].Filter < conditions[j].Filter
+	})
+	n.apply(conditions)
+}
+
+// apply replaces the conditions applied by this controller. Must be called with mu held.
+func (n *NetworkController) apply(conditions []mitm.NetworkCondition) {
+	if n.networkID != "" {
+		n.mitmClient.RemoveNetworkConditions(n.t, n.networkID)
+		n.networkID = ""
+	}
+	if len(conditions) > 0 {
+		n.networkID = n.mitmClient.AddNetworkConditions(n.t, conditions)
+	}
+}
+
+func homeserverFilter(hsName string) string {
+	// in reverse proxy mode, the host is the upstream homeserver
+	return mitm.FilterExpression("~d ^" + hsName + "$").FilterString()
+}
+
+func clientFilter(accessToken string) string {
+	return mitm.FilterParams{AccessToken: accessToken}.FilterString()
+}
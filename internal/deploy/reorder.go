@@ -0,0 +1,52 @@
+package deploy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+)
+
+// ToDeviceReorderSpec describes which to-device messages mitmproxy should deliver out of order. Messages are
+// held back from /sync responses, then delivered after the messages in a later /sync response.
+type ToDeviceReorderSpec struct {
+	// If set, only reorder messages delivered to this access token, i.e to a single client.
+	AccessToken string
+	// If set, only hold back messages of this type e.g m.room.encrypted for room keys.
+	EventType string
+	// The number of messages to hold back each time. Defaults to 1.
+	Hold int
+	// How long to hold messages for if no newer messages arrive, after which they are delivered in order.
+	// Defaults to 5s.
+	MaxHold time.Duration
+}
+
+// WithReorderedToDevice delivers to-device messages matching the spec out of order whilst `inner` is called,
+// returning how many times held messages were delivered after newer messages. Messages which are still held
+// back when `inner` returns are delivered in the client's next /sync response. Reordering can be used at the
+// same time as intercepting requests via MITM().Configure.
+//
+//	reordered := deployment.WithReorderedToDevice(t, deploy.ToDeviceReorderSpec{
+//		AccessToken: bob.CurrentAccessToken(t),
+//		EventType:   "m.room.encrypted",
+//	}, func() {
+//		// ... send messages in two rooms, so bob gets the second room key first ...
+//	})
+func (d *ComplementCryptoDeployment) WithReorderedToDevice(t *testing.T, spec ToDeviceReorderSpec, inner func()) (reordered int) {
+	t.Helper()
+	reorderID := d.mitmClient.AddReorder(t, mitm.Reorder{
+		Filter: mitm.FilterParams{
+			PathContains: "/sync",
+			AccessToken:  spec.AccessToken,
+		}.FilterString(),
+		EventType: spec.EventType,
+		Hold:      spec.Hold,
+		MaxHoldMs: spec.MaxHold.Milliseconds(),
+	})
+	defer func() {
+		reordered = d.mitmClient.RemoveReorder(t, reorderID)
+		t.Logf("WithReorderedToDevice: reordered %d times", reordered)
+	}()
+	inner()
+	return
+}
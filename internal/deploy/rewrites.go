@@ -0,0 +1,63 @@
+package deploy
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+	"github.com/matrix-org/complement/must"
+)
+
+// ResponseRewriteSpec describes a value in JSON responses which should be replaced by mitmproxy before the
+// response is sent to the client, as a malicious homeserver could. This is far easier than rewriting the
+// whole response body in a ResponseCallback.
+type ResponseRewriteSpec struct {
+	// The URL path must contain this string for responses to be rewritten e.g "/keys/query".
+	// If unset, all JSON responses may be rewritten.
+	Endpoint string
+	// The HTTP method which must be used for responses to be rewritten. If unset, any method may be rewritten.
+	Method string
+	// If set, only rewrite responses to requests made with this access token, i.e to a single client.
+	AccessToken string
+	// The RFC 6901 JSON pointer to the value to replace, typically made with mitm.JSONPointer. Every object
+	// and array along the way must exist, but the last object member is added if it is missing. Responses
+	// without the parent of the pointer are not rewritten.
+	Pointer string
+	// The replacement value, which is encoded as JSON.
+	Value any
+	// If non-zero, stop rewriting responses after this many have been rewritten.
+	Count int
+}
+
+// WithResponseRewrite rewrites responses matching the spec whilst `inner` is called, returning how many
+// responses were rewritten. Rewrites can be nested, and can be used at the same time as intercepting
+// requests via MITM().Configure. If a response matches multiple rewrites, the outermost rewrite is applied first.
+//
+//	rewritten := deployment.WithResponseRewrite(t, deploy.ResponseRewriteSpec{
+//		Endpoint: "/keys/query",
+//		Pointer:  mitm.JSONPointer("device_keys", bob.UserID(), bobDeviceID, "keys", "ed25519:"+bobDeviceID),
+//		Value:    "not_a_real_key",
+//	}, func() {
+//		// ... send messages ...
+//	})
+func (d *ComplementCryptoDeployment) WithResponseRewrite(t *testing.T, spec ResponseRewriteSpec, inner func()) (rewritten int) {
+	t.Helper()
+	value, err := json.Marshal(spec.Value)
+	must.NotError(t, "WithResponseRewrite: failed to marshal value", err)
+	rewriteID := d.mitmClient.AddRewrite(t, mitm.Rewrite{
+		Filter: mitm.FilterParams{
+			PathContains: spec.Endpoint,
+			Method:       spec.Method,
+			AccessToken:  spec.AccessToken,
+		}.FilterString(),
+		Pointer: spec.Pointer,
+		Value:   value,
+		Count:   spec.Count,
+	})
+	defer func() {
+		rewritten = d.mitmClient.RemoveRewrite(t, rewriteID)
+		t.Logf("WithResponseRewrite: rewrote %d responses", rewritten)
+	}()
+	inner()
+	return
+}
@@ -2,6 +2,7 @@ package rpc
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"log"
 	"net/rpc"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/logging"
 	"github.com/matrix-org/complement/ct"
 )
 
@@ -131,9 +133,10 @@ func (r *LanguageBindings) MustCreateClient(t ct.TestLike, cfg api.ClientCreatio
 			ct.Fatalf(t, "%s: failed to create RPC client: %s", contextID, err)
 		}
 		return &RPCClient{
-			client: client,
-			lang:   r.clientType,
-			rpcCmd: rpcCmd,
+			client:   &rpcConn{client},
+			lang:     r.clientType,
+			rpcCmd:   rpcCmd,
+			clientID: api.ClientID(cfg.UserID, cfg.DeviceID, r.clientType),
 		}
 	case <-time.After(time.Second):
 		ct.Fatalf(t, "%s: timed out waiting for port number to be echoed to stdout. Did the RPC binary run, and is it actually the RPC binary? Path: %s", contextID, r.binaryPath)
@@ -141,11 +144,28 @@ func (r *LanguageBindings) MustCreateClient(t ct.TestLike, cfg api.ClientCreatio
 	panic("unreachable")
 }
 
+// rpcConn is an RPC connection which preserves api.ErrNotSupported across the connection. Errors returned by
+// RPC calls are only strings, so tests could not otherwise detect operations which the remote client does not
+// support via errors.Is.
+type rpcConn struct {
+	*rpc.Client
+}
+
+func (c *rpcConn) Call(serviceMethod string, args any, reply any) error {
+	err := c.Client.Call(serviceMethod, args, reply)
+	if err != nil && strings.HasSuffix(err.Error(), api.ErrNotSupported.Error()) {
+		return fmt.Errorf("%s: %w", strings.TrimSuffix(strings.TrimSuffix(err.Error(), api.ErrNotSupported.Error()), ": "), api.ErrNotSupported)
+	}
+	return err
+}
+
 // RPCClient implements api.Client by making RPC calls to an RPC server, which actually has a concrete api.Client
 type RPCClient struct {
-	client *rpc.Client
+	client *rpcConn
 	lang   api.ClientTypeLang
 	rpcCmd *exec.Cmd
+	// identifies this client in logs, see api.ClientID
+	clientID string
 }
 
 func (c *RPCClient) ForceClose(t ct.TestLike) {
@@ -181,6 +201,146 @@ func (c *RPCClient) GetNotification(t ct.TestLike, roomID, eventID string) (*api
 	return &notification, err
 }
 
+func (c *RPCClient) GetDeviceTrust(t ct.TestLike, userID, deviceID string) (api.TrustLevel, error) {
+	var trust api.TrustLevel
+	err := c.client.Call("Server.GetDeviceTrust", RPCGetDeviceTrust{
+		TestName: t.Name(),
+		UserID:   userID,
+		DeviceID: deviceID,
+	}, &trust)
+	return trust, err
+}
+
+func (c *RPCClient) GetDeviceIDs(t ct.TestLike, userID string) ([]string, error) {
+	var deviceIDs []string
+	err := c.client.Call("Server.GetDeviceIDs", RPCGetDeviceIDs{
+		TestName: t.Name(),
+		UserID:   userID,
+	}, &deviceIDs)
+	return deviceIDs, err
+}
+
+func (c *RPCClient) SetDeviceDisplayName(t ct.TestLike, name string) error {
+	var void int
+	return c.client.Call("Server.SetDeviceDisplayName", RPCSetDeviceDisplayName{
+		TestName: t.Name(),
+		Name:     name,
+	}, &void)
+}
+
+// ListenForDeviceListChanges is not supported over RPC, as there is no way to call the callback.
+func (c *RPCClient) ListenForDeviceListChanges(t ct.TestLike, callback func(userIDs []string)) (cancel func(), err error) {
+	return nil, fmt.Errorf("ListenForDeviceListChanges: %w", api.ErrNotSupported)
+}
+
+// ResetCrossSigning calls authCallback up front, as callbacks cannot be sent over RPC.
+func (c *RPCClient) ResetCrossSigning(t ct.TestLike, authCallback func() (password string)) error {
+	var void int
+	return c.client.Call("Server.ResetCrossSigning", RPCResetCrossSigning{
+		TestName: t.Name(),
+		Password: authCallback(),
+	}, &void)
+}
+
+// BootstrapCrossSigning calls authCallback up front, as callbacks cannot be sent over RPC.
+func (c *RPCClient) BootstrapCrossSigning(t ct.TestLike, authCallback func() (password string)) error {
+	var void int
+	return c.client.Call("Server.BootstrapCrossSigning", RPCResetCrossSigning{
+		TestName: t.Name(),
+		Password: authCallback(),
+	}, &void)
+}
+
+// Kill kills the client in the RPC server, rather than the RPC server itself. Use ForceClose to kill the server.
+func (c *RPCClient) Kill(t ct.TestLike) error {
+	var void int
+	return c.client.Call("Server.Kill", t.Name(), &void)
+}
+
+func (c *RPCClient) RestoreFromStorage(t ct.TestLike) error {
+	var void int
+	return c.client.Call("Server.RestoreFromStorage", t.Name(), &void)
+}
+
+func (c *RPCClient) SetStorePassphrase(t ct.TestLike, passphrase string) error {
+	var void int
+	return c.client.Call("Server.SetStorePassphrase", RPCStorePassphrase{
+		TestName:   t.Name(),
+		Passphrase: passphrase,
+	}, &void)
+}
+
+func (c *RPCClient) SetGlobalOnlyTrustVerified(t ct.TestLike, enabled bool) error {
+	var void int
+	return c.client.Call("Server.SetGlobalOnlyTrustVerified", RPCOnlyTrustVerified{
+		TestName: t.Name(),
+		Enabled:  enabled,
+	}, &void)
+}
+
+func (c *RPCClient) SetRoomOnlyTrustVerified(t ct.TestLike, roomID string, enabled bool) error {
+	var void int
+	return c.client.Call("Server.SetRoomOnlyTrustVerified", RPCOnlyTrustVerified{
+		TestName: t.Name(),
+		RoomID:   roomID,
+		Enabled:  enabled,
+	}, &void)
+}
+
+func (c *RPCClient) BlacklistDevice(t ct.TestLike, userID, deviceID string) error {
+	var void int
+	return c.client.Call("Server.BlacklistDevice", RPCBlacklistDevice{
+		TestName: t.Name(),
+		UserID:   userID,
+		DeviceID: deviceID,
+	}, &void)
+}
+
+func (c *RPCClient) CreateDehydratedDevice(t ct.TestLike) error {
+	var void int
+	return c.client.Call("Server.CreateDehydratedDevice", t.Name(), &void)
+}
+
+func (c *RPCClient) RehydrateDevice(t ct.TestLike, recoveryKey string) error {
+	var void int
+	return c.client.Call("Server.RehydrateDevice", RPCRehydrateDevice{
+		TestName:    t.Name(),
+		RecoveryKey: recoveryKey,
+	}, &void)
+}
+
+func (c *RPCClient) RequestRoomKey(t ct.TestLike, roomID, sessionID string) error {
+	var void int
+	return c.client.Call("Server.RequestRoomKey", RPCRoomKeyRequest{
+		TestName:  t.Name(),
+		RoomID:    roomID,
+		SessionID: sessionID,
+	}, &void)
+}
+
+func (c *RPCClient) CancelRoomKeyRequest(t ct.TestLike, roomID, sessionID string) error {
+	var void int
+	return c.client.Call("Server.CancelRoomKeyRequest", RPCRoomKeyRequest{
+		TestName:  t.Name(),
+		RoomID:    roomID,
+		SessionID: sessionID,
+	}, &void)
+}
+
+func (c *RPCClient) RetryDecryption(t ct.TestLike, roomID string, sessionIDs []string) error {
+	var void int
+	return c.client.Call("Server.RetryDecryption", RPCRetryDecryption{
+		TestName:   t.Name(),
+		RoomID:     roomID,
+		SessionIDs: sessionIDs,
+	}, &void)
+}
+
+func (c *RPCClient) FallbackKeyUsed(t ct.TestLike) (used bool, err error) {
+	err = c.client.Call("Server.FallbackKeyUsed", t.Name(), &used)
+	return
+}
+
 func (c *RPCClient) CurrentAccessToken(t ct.TestLike) string {
 	var token string
 	err := c.client.Call("Server.CurrentAccessToken", t.Name(), &token)
@@ -198,10 +358,50 @@ func (c *RPCClient) ListenForVerificationRequests(t ct.TestLike) chan api.Verifi
 	panic("unimplemented")
 }
 
+func (c *RPCClient) RequestUserVerification(t ct.TestLike, userID, roomID string) (chan api.VerificationStage, error) {
+	return nil, fmt.Errorf("RequestUserVerification: %w", api.ErrNotSupported)
+}
+
 func (c *RPCClient) InviteUser(t ct.TestLike, roomID, userID string) error {
 	panic("unimplemented")
 }
 
+// JoinRoom attempts to join the given room, via the given servers if the room is on another server.
+func (c *RPCClient) JoinRoom(t ct.TestLike, roomID string, serverNames []string) error {
+	var void int
+	return c.client.Call("Server.JoinRoom", RPCJoinRoom{
+		TestName:    t.Name(),
+		RoomID:      roomID,
+		ServerNames: serverNames,
+	}, &void)
+}
+
+// FollowTombstone joins the replacement room of the given room, via the given servers.
+func (c *RPCClient) FollowTombstone(t ct.TestLike, roomID string, serverNames []string) (newRoomID string, err error) {
+	err = c.client.Call("Server.FollowTombstone", RPCJoinRoom{
+		TestName:    t.Name(),
+		RoomID:      roomID,
+		ServerNames: serverNames,
+	}, &newRoomID)
+	return
+}
+
+func (c *RPCClient) IgnoreUser(t ct.TestLike, userID string) error {
+	var void int
+	return c.client.Call("Server.IgnoreUser", RPCIgnoreUser{
+		TestName: t.Name(),
+		UserID:   userID,
+	}, &void)
+}
+
+func (c *RPCClient) UnignoreUser(t ct.TestLike, userID string) error {
+	var void int
+	return c.client.Call("Server.UnignoreUser", RPCIgnoreUser{
+		TestName: t.Name(),
+		UserID:   userID,
+	}, &void)
+}
+
 // Remove any persistent storage, if it was enabled.
 func (c *RPCClient) DeletePersistentStorage(t ct.TestLike) {
 	var void int
@@ -210,6 +410,15 @@ func (c *RPCClient) DeletePersistentStorage(t ct.TestLike) {
 		t.Fatalf("RPCClient.DeletePersistentStorage: %s", err)
 	}
 }
+func (c *RPCClient) PersistentStoragePath(t ct.TestLike) string {
+	var path string
+	err := c.client.Call("Server.PersistentStoragePath", t.Name(), &path)
+	if err != nil {
+		t.Fatalf("RPCClient.PersistentStoragePath: %s", err)
+	}
+	return path
+}
+
 func (c *RPCClient) Login(t ct.TestLike, opts api.ClientCreationOpts) error {
 	var void int
 	fmt.Printf("RPCClient Calling login with %+v\n", opts)
@@ -218,6 +427,16 @@ func (c *RPCClient) Login(t ct.TestLike, opts api.ClientCreationOpts) error {
 	return err
 }
 
+// ListenForSyncStates is not supported over RPC, as there is no way to call the callback.
+func (c *RPCClient) ListenForSyncStates(t ct.TestLike, callback func(s api.SyncState)) (cancel func(), err error) {
+	return nil, fmt.Errorf("ListenForSyncStates: %w", api.ErrNotSupported)
+}
+
+// ListenForBackupStates is not supported over RPC, as there is no way to stream states back to the test.
+func (c *RPCClient) ListenForBackupStates(t ct.TestLike, ctx context.Context) (<-chan api.BackupState, error) {
+	return nil, fmt.Errorf("ListenForBackupStates: %w", api.ErrNotSupported)
+}
+
 // StartSyncing to begin syncing from sync v2 / sliding sync.
 // Tests should call stopSyncing() at the end of the test.
 // MUST BLOCK until the initial sync is complete.
@@ -236,6 +455,18 @@ func (c *RPCClient) StartSyncing(t ct.TestLike) (stopSyncing func(), err error)
 	}, nil
 }
 
+// ClearCacheAndRestart drops cached events and the sync token, keeping the crypto store, then resumes syncing.
+func (c *RPCClient) ClearCacheAndRestart(t ct.TestLike) error {
+	var void int
+	return c.client.Call("Server.ClearCacheAndRestart", t.Name(), &void)
+}
+
+// Restart shuts down the client and re-creates it from its persistent storage, then resumes syncing.
+func (c *RPCClient) Restart(t ct.TestLike) error {
+	var void int
+	return c.client.Call("Server.Restart", t.Name(), &void)
+}
+
 // IsRoomEncrypted returns true if the room is encrypted. May return an error e.g if you
 // provide a bogus room ID.
 func (c *RPCClient) IsRoomEncrypted(t ct.TestLike, roomID string) (bool, error) {
@@ -244,6 +475,20 @@ func (c *RPCClient) IsRoomEncrypted(t ct.TestLike, roomID string) (bool, error)
 	return isEncrypted, err
 }
 
+// GetEncryptionAlgorithm returns the algorithm in the room's m.room.encryption state.
+func (c *RPCClient) GetEncryptionAlgorithm(t ct.TestLike, roomID string) (string, error) {
+	var algorithm string
+	err := c.client.Call("Server.GetEncryptionAlgorithm", roomID, &algorithm)
+	return algorithm, err
+}
+
+// IsDirect returns true if the room is a direct message room.
+func (c *RPCClient) IsDirect(t ct.TestLike, roomID string) (bool, error) {
+	var isDirect bool
+	err := c.client.Call("Server.IsDirect", roomID, &isDirect)
+	return isDirect, err
+}
+
 // SendMessage tries to send the message, but can fail.
 func (c *RPCClient) SendMessage(t ct.TestLike, roomID, text string) (eventID string, err error) {
 	err = c.client.Call("Server.SendMessage", RPCSendMessage{
@@ -254,6 +499,86 @@ func (c *RPCClient) SendMessage(t ct.TestLike, roomID, text string) (eventID str
 	return
 }
 
+func (c *RPCClient) SendThreadedMessage(t ct.TestLike, roomID, threadRootID, text string) (eventID string, err error) {
+	err = c.client.Call("Server.SendThreadedMessage", RPCSendThreadedMessage{
+		TestName:     t.Name(),
+		RoomID:       roomID,
+		ThreadRootID: threadRootID,
+		Text:         text,
+	}, &eventID)
+	return
+}
+
+func (c *RPCClient) SendEncryptedFile(t ct.TestLike, roomID, filename string, contents []byte) (eventID string, err error) {
+	err = c.client.Call("Server.SendEncryptedFile", RPCSendEncryptedFile{
+		TestName: t.Name(),
+		RoomID:   roomID,
+		Filename: filename,
+		Contents: contents,
+	}, &eventID)
+	return
+}
+
+func (c *RPCClient) RedactEvent(t ct.TestLike, roomID, eventID, reason string) error {
+	var void int
+	return c.client.Call("Server.RedactEvent", RPCRedactEvent{
+		TestName: t.Name(),
+		RoomID:   roomID,
+		EventID:  eventID,
+		Reason:   reason,
+	}, &void)
+}
+
+func (c *RPCClient) React(t ct.TestLike, roomID, eventID, key string) error {
+	var void int
+	return c.client.Call("Server.React", RPCReact{
+		TestName: t.Name(),
+		RoomID:   roomID,
+		EventID:  eventID,
+		Key:      key,
+	}, &void)
+}
+
+func (c *RPCClient) EditMessage(t ct.TestLike, roomID, eventID, newBody string) error {
+	var void int
+	return c.client.Call("Server.EditMessage", RPCEditMessage{
+		TestName: t.Name(),
+		RoomID:   roomID,
+		EventID:  eventID,
+		NewBody:  newBody,
+	}, &void)
+}
+
+func (c *RPCClient) SetRoomTopic(t ct.TestLike, roomID, topic string) (eventID string, err error) {
+	err = c.client.Call("Server.SetRoomTopic", RPCSetRoomTopic{
+		TestName: t.Name(),
+		RoomID:   roomID,
+		Topic:    topic,
+	}, &eventID)
+	return
+}
+
+func (c *RPCClient) GetOutboundSessionID(t ct.TestLike, roomID, eventID string) (sessionID string, err error) {
+	err = c.client.Call("Server.GetOutboundSessionID", RPCGetEvent{
+		TestName: t.Name(),
+		RoomID:   roomID,
+		EventID:  eventID,
+	}, &sessionID)
+	return
+}
+
+func (c *RPCClient) GetOutboundSessionInfo(t ct.TestLike, roomID string) (*api.OutboundSessionInfo, error) {
+	var info api.OutboundSessionInfo
+	err := c.client.Call("Server.GetOutboundSessionInfo", RPCGetEvent{
+		TestName: t.Name(),
+		RoomID:   roomID,
+	}, &info)
+	if err != nil || info.SessionID == "" {
+		return nil, err
+	}
+	return &info, nil
+}
+
 // Wait until an event is seen in the given room. The checker functions can be custom or you can use
 // a pre-defined one like api.CheckEventHasMembership, api.CheckEventHasBody, or api.CheckEventHasEventID.
 func (c *RPCClient) WaitUntilEventInRoom(t ct.TestLike, roomID string, checker func(e api.Event) bool) api.Waiter {
@@ -272,15 +597,28 @@ func (c *RPCClient) WaitUntilEventInRoom(t ct.TestLike, roomID string, checker f
 	}
 }
 
-// Backpaginate in this room by `count` events.
-func (c *RPCClient) Backpaginate(t ct.TestLike, roomID string, count int) error {
-	var void int
+// WaitUntilEventInRoomWithOpts is WaitUntilEventInRoom but only events which match the options are
+// passed to the checker function. Events are filtered in this process, as checkers cannot be sent over RPC.
+func (c *RPCClient) WaitUntilEventInRoomWithOpts(t ct.TestLike, roomID string, opts api.TimelineListenerOpts, checker func(e api.Event) bool) api.Waiter {
+	return c.WaitUntilEventInRoom(t, roomID, opts.Filter(checker))
+}
+
+// Backpaginate in this room by `count` events, returning the timeline.
+func (c *RPCClient) Backpaginate(t ct.TestLike, roomID string, count int) ([]*api.Event, error) {
+	var events []api.Event
 	err := c.client.Call("Server.Backpaginate", RPCBackpaginate{
 		TestName: t.Name(),
 		RoomID:   roomID,
 		Count:    count,
-	}, &void)
-	return err
+	}, &events)
+	if err != nil {
+		return nil, err
+	}
+	timeline := make([]*api.Event, len(events))
+	for i := range events {
+		timeline[i] = &events[i]
+	}
+	return timeline, nil
 }
 
 // GetEvent will return the client's view of this event, or return an error if the event cannot be found.
@@ -294,6 +632,59 @@ func (c *RPCClient) GetEvent(t ct.TestLike, roomID, eventID string) (*api.Event,
 	return &ev, err
 }
 
+// GetTimeline returns the client's view of the room timeline, oldest event first.
+func (c *RPCClient) GetTimeline(t ct.TestLike, roomID string) ([]*api.Event, error) {
+	var events []api.Event
+	err := c.client.Call("Server.GetTimeline", RPCGetTimeline{
+		TestName: t.Name(),
+		RoomID:   roomID,
+	}, &events)
+	if err != nil {
+		return nil, err
+	}
+	timeline := make([]*api.Event, len(events))
+	for i := range events {
+		timeline[i] = &events[i]
+	}
+	return timeline, nil
+}
+
+func (c *RPCClient) GetThread(t ct.TestLike, roomID, threadRootID string) ([]*api.Event, error) {
+	var events []api.Event
+	err := c.client.Call("Server.GetThread", RPCGetThread{
+		TestName:     t.Name(),
+		RoomID:       roomID,
+		ThreadRootID: threadRootID,
+	}, &events)
+	if err != nil {
+		return nil, err
+	}
+	thread := make([]*api.Event, len(events))
+	for i := range events {
+		thread[i] = &events[i]
+	}
+	return thread, nil
+}
+
+// MarkAsRead sends a public read receipt for the latest event in the room's timeline.
+func (c *RPCClient) MarkAsRead(t ct.TestLike, roomID string) error {
+	var void int
+	return c.client.Call("Server.MarkAsRead", RPCMarkAsRead{
+		TestName: t.Name(),
+		RoomID:   roomID,
+	}, &void)
+}
+
+// GetReadReceipt returns the ID of the event which the user's public read receipt in the room is for.
+func (c *RPCClient) GetReadReceipt(t ct.TestLike, roomID, userID string) (eventID string, err error) {
+	err = c.client.Call("Server.GetReadReceipt", RPCGetReadReceipt{
+		TestName: t.Name(),
+		RoomID:   roomID,
+		UserID:   userID,
+	}, &eventID)
+	return
+}
+
 // BackupKeys will backup E2EE keys, else return an error.
 func (c *RPCClient) BackupKeys(t ct.TestLike) (recoveryKey string, err error) {
 	err = c.client.Call("Server.BackupKeys", 0, &recoveryKey)
@@ -306,9 +697,58 @@ func (c *RPCClient) LoadBackup(t ct.TestLike, recoveryKey string) error {
 	return c.client.Call("Server.LoadBackup", recoveryKey, &void)
 }
 
+func (c *RPCClient) ExportRoomKeys(t ct.TestLike, passphrase string) (export []byte, err error) {
+	err = c.client.Call("Server.ExportRoomKeys", RPCRoomKeys{
+		TestName:   t.Name(),
+		Passphrase: passphrase,
+	}, &export)
+	return
+}
+
+func (c *RPCClient) ImportRoomKeys(t ct.TestLike, export []byte, passphrase string) error {
+	var void int
+	return c.client.Call("Server.ImportRoomKeys", RPCRoomKeys{
+		TestName:   t.Name(),
+		Export:     export,
+		Passphrase: passphrase,
+	}, &void)
+}
+
+func (c *RPCClient) CreateSecretStorageKey(t ct.TestLike) (recoveryKey string, err error) {
+	err = c.client.Call("Server.CreateSecretStorageKey", t.Name(), &recoveryKey)
+	return
+}
+
+func (c *RPCClient) UnlockSecretStorage(t ct.TestLike, recoveryKey string) error {
+	var void int
+	return c.client.Call("Server.UnlockSecretStorage", RPCSecret{
+		TestName: t.Name(),
+		Value:    recoveryKey,
+	}, &void)
+}
+
+func (c *RPCClient) StoreSecret(t ct.TestLike, name, value string) error {
+	var void int
+	return c.client.Call("Server.StoreSecret", RPCSecret{
+		TestName: t.Name(),
+		Name:     name,
+		Value:    value,
+	}, &void)
+}
+
+func (c *RPCClient) GetSecret(t ct.TestLike, name string) (value string, err error) {
+	err = c.client.Call("Server.GetSecret", RPCSecret{
+		TestName: t.Name(),
+		Name:     name,
+	}, &value)
+	return
+}
+
 // Log something to stdout and the underlying client log file
 func (c *RPCClient) Logf(t ct.TestLike, format string, args ...interface{}) {
 	str := fmt.Sprintf(format, args...)
+	// the remote client is in another process, so capture the line here
+	logging.Write(t.Name(), c.clientID, str)
 	str = t.Name() + ": " + str
 	var void int
 	err := c.client.Call("Server.Logf", str, &void)
@@ -335,7 +775,7 @@ func (c *RPCClient) Opts() api.ClientCreationOpts {
 
 type RPCWaiter struct {
 	waiterID int
-	client   *rpc.Client
+	client   *rpcConn
 	checker  func(e api.Event) bool
 }
 
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -100,6 +101,20 @@ func (s *Server) DeletePersistentStorage(testName string, void *int) error {
 	return nil
 }
 
+func (s *Server) PersistentStoragePath(testName string, path *string) error {
+	defer s.keepAlive()
+	*path = s.activeClient.PersistentStoragePath(&api.MockT{TestName: testName})
+	if *path != "" && !filepath.IsAbs(*path) {
+		// the RPC server may run in a different working directory to the test process
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		*path = filepath.Join(wd, *path)
+	}
+	return nil
+}
+
 func (s *Server) CurrentAccessToken(testName string, token *string) error {
 	defer s.keepAlive()
 	*token = s.activeClient.CurrentAccessToken(&api.MockT{TestName: testName})
@@ -131,6 +146,16 @@ func (s *Server) StopSyncing(testName string, void *int) error {
 	return nil
 }
 
+func (s *Server) ClearCacheAndRestart(testName string, void *int) error {
+	defer s.keepAlive()
+	return s.activeClient.ClearCacheAndRestart(&api.MockT{TestName: testName})
+}
+
+func (s *Server) Restart(testName string, void *int) error {
+	defer s.keepAlive()
+	return s.activeClient.Restart(&api.MockT{TestName: testName})
+}
+
 func (s *Server) IsRoomEncrypted(roomID string, isEncrypted *bool) error {
 	defer s.keepAlive()
 	var err error
@@ -138,6 +163,20 @@ func (s *Server) IsRoomEncrypted(roomID string, isEncrypted *bool) error {
 	return err
 }
 
+func (s *Server) GetEncryptionAlgorithm(roomID string, algorithm *string) error {
+	defer s.keepAlive()
+	var err error
+	*algorithm, err = s.activeClient.GetEncryptionAlgorithm(&api.MockT{}, roomID)
+	return err
+}
+
+func (s *Server) IsDirect(roomID string, isDirect *bool) error {
+	defer s.keepAlive()
+	var err error
+	*isDirect, err = s.activeClient.IsDirect(&api.MockT{}, roomID)
+	return err
+}
+
 type RPCSendMessage struct {
 	TestName string
 	RoomID   string
@@ -154,6 +193,96 @@ func (s *Server) SendMessage(msg RPCSendMessage, eventID *string) error {
 	return nil
 }
 
+type RPCSendThreadedMessage struct {
+	TestName     string
+	RoomID       string
+	ThreadRootID string
+	Text         string
+}
+
+func (s *Server) SendThreadedMessage(msg RPCSendThreadedMessage, eventID *string) (err error) {
+	defer s.keepAlive()
+	*eventID, err = s.activeClient.SendThreadedMessage(&api.MockT{TestName: msg.TestName}, msg.RoomID, msg.ThreadRootID, msg.Text)
+	return
+}
+
+type RPCSendEncryptedFile struct {
+	TestName string
+	RoomID   string
+	Filename string
+	Contents []byte
+}
+
+func (s *Server) SendEncryptedFile(input RPCSendEncryptedFile, eventID *string) (err error) {
+	defer s.keepAlive()
+	*eventID, err = s.activeClient.SendEncryptedFile(&api.MockT{TestName: input.TestName}, input.RoomID, input.Filename, input.Contents)
+	return err
+}
+
+type RPCRedactEvent struct {
+	TestName string
+	RoomID   string
+	EventID  string
+	Reason   string
+}
+
+func (s *Server) RedactEvent(input RPCRedactEvent, void *int) error {
+	defer s.keepAlive()
+	return s.activeClient.RedactEvent(&api.MockT{TestName: input.TestName}, input.RoomID, input.EventID, input.Reason)
+}
+
+type RPCReact struct {
+	TestName string
+	RoomID   string
+	EventID  string
+	Key      string
+}
+
+func (s *Server) React(input RPCReact, void *int) error {
+	defer s.keepAlive()
+	return s.activeClient.React(&api.MockT{TestName: input.TestName}, input.RoomID, input.EventID, input.Key)
+}
+
+type RPCEditMessage struct {
+	TestName string
+	RoomID   string
+	EventID  string
+	NewBody  string
+}
+
+func (s *Server) EditMessage(input RPCEditMessage, void *int) error {
+	defer s.keepAlive()
+	return s.activeClient.EditMessage(&api.MockT{TestName: input.TestName}, input.RoomID, input.EventID, input.NewBody)
+}
+
+type RPCSetRoomTopic struct {
+	TestName string
+	RoomID   string
+	Topic    string
+}
+
+func (s *Server) SetRoomTopic(input RPCSetRoomTopic, eventID *string) (err error) {
+	defer s.keepAlive()
+	*eventID, err = s.activeClient.SetRoomTopic(&api.MockT{TestName: input.TestName}, input.RoomID, input.Topic)
+	return
+}
+
+func (s *Server) GetOutboundSessionID(input RPCGetEvent, sessionID *string) (err error) {
+	defer s.keepAlive()
+	*sessionID, err = s.activeClient.GetOutboundSessionID(&api.MockT{TestName: input.TestName}, input.RoomID, input.EventID)
+	return err
+}
+
+// GetOutboundSessionInfo returns the zero value if there is no outbound session, as gob cannot encode nil.
+func (s *Server) GetOutboundSessionInfo(input RPCGetEvent, output *api.OutboundSessionInfo) error {
+	defer s.keepAlive()
+	info, err := s.activeClient.GetOutboundSessionInfo(&api.MockT{TestName: input.TestName}, input.RoomID)
+	if err == nil && info != nil {
+		*output = *info
+	}
+	return err
+}
+
 type RPCWaitUntilEvent struct {
 	TestName string
 	RoomID   string
@@ -247,9 +376,97 @@ type RPCBackpaginate struct {
 	Count    int
 }
 
-func (s *Server) Backpaginate(input RPCBackpaginate, void *int) error {
+func (s *Server) Backpaginate(input RPCBackpaginate, output *[]api.Event) error {
 	defer s.keepAlive()
-	return s.activeClient.Backpaginate(&api.MockT{TestName: input.TestName}, input.RoomID, input.Count)
+	timeline, err := s.activeClient.Backpaginate(&api.MockT{TestName: input.TestName}, input.RoomID, input.Count)
+	if err != nil {
+		return err
+	}
+	events := make([]api.Event, len(timeline))
+	for i := range timeline {
+		events[i] = *timeline[i]
+	}
+	*output = events
+	return nil
+}
+
+type RPCGetThread struct {
+	TestName     string
+	RoomID       string
+	ThreadRootID string
+}
+
+// GetThread returns the events in the thread fetched from the server, oldest event first.
+func (s *Server) GetThread(input RPCGetThread, output *[]api.Event) error {
+	defer s.keepAlive()
+	thread, err := s.activeClient.GetThread(&api.MockT{TestName: input.TestName}, input.RoomID, input.ThreadRootID)
+	if err != nil {
+		return err
+	}
+	events := make([]api.Event, len(thread))
+	for i := range thread {
+		events[i] = *thread[i]
+	}
+	*output = events
+	return nil
+}
+
+type RPCMarkAsRead struct {
+	TestName string
+	RoomID   string
+}
+
+// MarkAsRead sends a public read receipt for the latest event in the room's timeline.
+func (s *Server) MarkAsRead(input RPCMarkAsRead, void *int) error {
+	defer s.keepAlive()
+	return s.activeClient.MarkAsRead(&api.MockT{TestName: input.TestName}, input.RoomID)
+}
+
+type RPCGetReadReceipt struct {
+	TestName string
+	RoomID   string
+	UserID   string
+}
+
+// GetReadReceipt returns the ID of the event which the user's public read receipt in the room is for.
+func (s *Server) GetReadReceipt(input RPCGetReadReceipt, eventID *string) error {
+	defer s.keepAlive()
+	var err error
+	*eventID, err = s.activeClient.GetReadReceipt(&api.MockT{TestName: input.TestName}, input.RoomID, input.UserID)
+	return err
+}
+
+type RPCJoinRoom struct {
+	TestName    string
+	RoomID      string
+	ServerNames []string
+}
+
+// JoinRoom attempts to join the given room, via the given servers if the room is on another server.
+func (s *Server) JoinRoom(input RPCJoinRoom, void *int) error {
+	defer s.keepAlive()
+	return s.activeClient.JoinRoom(&api.MockT{TestName: input.TestName}, input.RoomID, input.ServerNames)
+}
+
+func (s *Server) FollowTombstone(input RPCJoinRoom, newRoomID *string) (err error) {
+	defer s.keepAlive()
+	*newRoomID, err = s.activeClient.FollowTombstone(&api.MockT{TestName: input.TestName}, input.RoomID, input.ServerNames)
+	return err
+}
+
+type RPCIgnoreUser struct {
+	TestName string
+	UserID   string
+}
+
+func (s *Server) IgnoreUser(input RPCIgnoreUser, void *int) error {
+	defer s.keepAlive()
+	return s.activeClient.IgnoreUser(&api.MockT{TestName: input.TestName}, input.UserID)
+}
+
+func (s *Server) UnignoreUser(input RPCIgnoreUser, void *int) error {
+	defer s.keepAlive()
+	return s.activeClient.UnignoreUser(&api.MockT{TestName: input.TestName}, input.UserID)
 }
 
 type RPCGetEvent struct {
@@ -269,6 +486,26 @@ func (s *Server) GetEvent(input RPCGetEvent, output *api.Event) error {
 	return nil
 }
 
+type RPCGetTimeline struct {
+	TestName string
+	RoomID   string
+}
+
+// GetTimeline returns the client's view of the room timeline, oldest event first.
+func (s *Server) GetTimeline(input RPCGetTimeline, output *[]api.Event) error {
+	defer s.keepAlive()
+	timeline, err := s.activeClient.GetTimeline(&api.MockT{TestName: input.TestName}, input.RoomID)
+	if err != nil {
+		return err
+	}
+	events := make([]api.Event, len(timeline))
+	for i := range timeline {
+		events[i] = *timeline[i]
+	}
+	*output = events
+	return nil
+}
+
 // BackupKeys will backup E2EE keys, else fail the test.
 func (s *Server) BackupKeys(testName string, recoveryKey *string) error {
 	defer s.keepAlive()
@@ -292,11 +529,204 @@ func (s *Server) GetNotification(input RPCGetNotification, output *api.Notificat
 	return err
 }
 
+type RPCGetDeviceTrust struct {
+	TestName string
+	UserID   string
+	DeviceID string
+}
+
+func (s *Server) GetDeviceTrust(input RPCGetDeviceTrust, trust *api.TrustLevel) (err error) {
+	defer s.keepAlive()
+	*trust, err = s.activeClient.GetDeviceTrust(&api.MockT{TestName: input.TestName}, input.UserID, input.DeviceID)
+	return err
+}
+
+type RPCGetDeviceIDs struct {
+	TestName string
+	UserID   string
+}
+
+func (s *Server) GetDeviceIDs(input RPCGetDeviceIDs, deviceIDs *[]string) (err error) {
+	defer s.keepAlive()
+	*deviceIDs, err = s.activeClient.GetDeviceIDs(&api.MockT{TestName: input.TestName}, input.UserID)
+	return err
+}
+
+type RPCSetDeviceDisplayName struct {
+	TestName string
+	Name     string
+}
+
+func (s *Server) SetDeviceDisplayName(input RPCSetDeviceDisplayName, void *int) error {
+	defer s.keepAlive()
+	return s.activeClient.SetDeviceDisplayName(&api.MockT{TestName: input.TestName}, input.Name)
+}
+
+type RPCResetCrossSigning struct {
+	TestName string
+	Password string
+}
+
+func (s *Server) ResetCrossSigning(input RPCResetCrossSigning, void *int) error {
+	defer s.keepAlive()
+	return s.activeClient.ResetCrossSigning(&api.MockT{TestName: input.TestName}, func() string {
+		return input.Password
+	})
+}
+
+func (s *Server) BootstrapCrossSigning(input RPCResetCrossSigning, void *int) error {
+	defer s.keepAlive()
+	return s.activeClient.BootstrapCrossSigning(&api.MockT{TestName: input.TestName}, func() string {
+		return input.Password
+	})
+}
+
+func (s *Server) Kill(testName string, void *int) error {
+	defer s.keepAlive()
+	return s.activeClient.Kill(&api.MockT{TestName: testName})
+}
+
+func (s *Server) RestoreFromStorage(testName string, void *int) error {
+	defer s.keepAlive()
+	return s.activeClient.RestoreFromStorage(&api.MockT{TestName: testName})
+}
+
+type RPCStorePassphrase struct {
+	TestName   string
+	Passphrase string
+}
+
+func (s *Server) SetStorePassphrase(input RPCStorePassphrase, void *int) error {
+	defer s.keepAlive()
+	return s.activeClient.SetStorePassphrase(&api.MockT{TestName: input.TestName}, input.Passphrase)
+}
+
+type RPCOnlyTrustVerified struct {
+	TestName string
+	RoomID   string
+	Enabled  bool
+}
+
+func (s *Server) SetGlobalOnlyTrustVerified(input RPCOnlyTrustVerified, void *int) error {
+	defer s.keepAlive()
+	return s.activeClient.SetGlobalOnlyTrustVerified(&api.MockT{TestName: input.TestName}, input.Enabled)
+}
+
+func (s *Server) SetRoomOnlyTrustVerified(input RPCOnlyTrustVerified, void *int) error {
+	defer s.keepAlive()
+	return s.activeClient.SetRoomOnlyTrustVerified(&api.MockT{TestName: input.TestName}, input.RoomID, input.Enabled)
+}
+
+type RPCBlacklistDevice struct {
+	TestName string
+	UserID   string
+	DeviceID string
+}
+
+func (s *Server) BlacklistDevice(input RPCBlacklistDevice, void *int) error {
+	defer s.keepAlive()
+	return s.activeClient.BlacklistDevice(&api.MockT{TestName: input.TestName}, input.UserID, input.DeviceID)
+}
+
+func (s *Server) CreateDehydratedDevice(testName string, void *int) error {
+	defer s.keepAlive()
+	return s.activeClient.CreateDehydratedDevice(&api.MockT{TestName: testName})
+}
+
+type RPCRehydrateDevice struct {
+	TestName    string
+	RecoveryKey string
+}
+
+func (s *Server) RehydrateDevice(input RPCRehydrateDevice, void *int) error {
+	defer s.keepAlive()
+	return s.activeClient.RehydrateDevice(&api.MockT{TestName: input.TestName}, input.RecoveryKey)
+}
+
+type RPCRoomKeyRequest struct {
+	TestName  string
+	RoomID    string
+	SessionID string
+}
+
+func (s *Server) RequestRoomKey(input RPCRoomKeyRequest, void *int) error {
+	defer s.keepAlive()
+	return s.activeClient.RequestRoomKey(&api.MockT{TestName: input.TestName}, input.RoomID, input.SessionID)
+}
+
+func (s *Server) CancelRoomKeyRequest(input RPCRoomKeyRequest, void *int) error {
+	defer s.keepAlive()
+	return s.activeClient.CancelRoomKeyRequest(&api.MockT{TestName: input.TestName}, input.RoomID, input.SessionID)
+}
+
+type RPCRetryDecryption struct {
+	TestName   string
+	RoomID     string
+	SessionIDs []string
+}
+
+func (s *Server) RetryDecryption(input RPCRetryDecryption, void *int) error {
+	defer s.keepAlive()
+	return s.activeClient.RetryDecryption(&api.MockT{TestName: input.TestName}, input.RoomID, input.SessionIDs)
+}
+
+func (s *Server) FallbackKeyUsed(testName string, used *bool) (err error) {
+	defer s.keepAlive()
+	*used, err = s.activeClient.FallbackKeyUsed(&api.MockT{TestName: testName})
+	return err
+}
+
 func (s *Server) LoadBackup(recoveryKey string, void *int) error {
 	defer s.keepAlive()
 	return s.activeClient.LoadBackup(&api.MockT{}, recoveryKey)
 }
 
+type RPCRoomKeys struct {
+	TestName   string
+	Export     []byte
+	Passphrase string
+}
+
+func (s *Server) ExportRoomKeys(input RPCRoomKeys, export *[]byte) (err error) {
+	defer s.keepAlive()
+	*export, err = s.activeClient.ExportRoomKeys(&api.MockT{TestName: input.TestName}, input.Passphrase)
+	return err
+}
+
+func (s *Server) ImportRoomKeys(input RPCRoomKeys, void *int) error {
+	defer s.keepAlive()
+	return s.activeClient.ImportRoomKeys(&api.MockT{TestName: input.TestName}, input.Export, input.Passphrase)
+}
+
+func (s *Server) CreateSecretStorageKey(testName string, recoveryKey *string) (err error) {
+	defer s.keepAlive()
+	*recoveryKey, err = s.activeClient.CreateSecretStorageKey(&api.MockT{TestName: testName})
+	return err
+}
+
+type RPCSecret struct {
+	TestName string
+	Name     string
+	// the secret, or the recovery key for UnlockSecretStorage
+	Value string
+}
+
+func (s *Server) UnlockSecretStorage(input RPCSecret, void *int) error {
+	defer s.keepAlive()
+	return s.activeClient.UnlockSecretStorage(&api.MockT{TestName: input.TestName}, input.Value)
+}
+
+func (s *Server) StoreSecret(input RPCSecret, void *int) error {
+	defer s.keepAlive()
+	return s.activeClient.StoreSecret(&api.MockT{TestName: input.TestName}, input.Name, input.Value)
+}
+
+func (s *Server) GetSecret(input RPCSecret, value *string) (err error) {
+	defer s.keepAlive()
+	*value, err = s.activeClient.GetSecret(&api.MockT{TestName: input.TestName}, input.Name)
+	return err
+}
+
 func (s *Server) Logf(input string, void *int) error {
 	defer s.keepAlive()
 	log.Println(input)
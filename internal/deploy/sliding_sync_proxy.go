@@ -0,0 +1,83 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/must"
+	testcontainers "github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+const slidingSyncProxyImage = "ghcr.io/matrix-org/sliding-sync:v0.99.19"
+
+// SlidingSyncProxyURL returns the URL of a sliding sync proxy for the homeserver e.g "hs1", for use with
+// api.ClientCreationOpts.SlidingSyncURL. The proxy and its database are started the first time this is called
+// for the homeserver, then they are reused until the deployment is torn down.
+//
+// The proxy syncs with the homeserver via mitmproxy, so its sync v2 requests can be intercepted like any other
+// client-server traffic. Requests from clients to the proxy do not go via mitmproxy.
+func (d *ComplementCryptoDeployment) SlidingSyncProxyURL(t testing.TB, hsName string) string {
+	t.Helper()
+	hsIndex := slices.Index(d.HomeserverNames(), hsName)
+	if hsIndex == -1 {
+		ct.Fatalf(t, "SlidingSyncProxyURL: unknown homeserver %s, only homeservers made by Complement can have a proxy", hsName)
+	}
+	proxyName := "sliding-sync-" + hsName
+	d.slidingSyncProxyMu.Lock()
+	defer d.slidingSyncProxyMu.Unlock()
+	if proxy, ok := d.extraContainers[proxyName]; ok {
+		return externalURL(t, proxy, "8009/tcp")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	networkName := d.Deployment.Network()
+
+	postgresName := "sliding-sync-postgres-" + hsName
+	postgres, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image: "postgres:16-alpine",
+			Env: map[string]string{
+				"POSTGRES_PASSWORD": "postgres",
+			},
+			// postgres restarts once it has initialised the database
+			WaitingFor: wait.ForLog("database system is ready to accept connections").WithOccurrence(2),
+			Networks:   []string{networkName},
+			NetworkAliases: map[string][]string{
+				networkName: {postgresName},
+			},
+		},
+		Started: true,
+	})
+	must.NotError(t, "failed to start sliding sync proxy database container", err)
+	d.extraContainers[postgresName] = postgres
+
+	proxy, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        slidingSyncProxyImage,
+			ExposedPorts: []string{"8009/tcp"},
+			Env: map[string]string{
+				// the reverse proxy for this homeserver in mitmproxy
+				"SYNCV3_SERVER":   fmt.Sprintf("http://mitmproxy:%d", reverseProxyBasePort+hsIndex),
+				"SYNCV3_DB":       fmt.Sprintf("user=postgres password=postgres dbname=postgres sslmode=disable host=%s", postgresName),
+				"SYNCV3_SECRET":   randomHex(t, 16),
+				"SYNCV3_BINDADDR": "0.0.0.0:8009",
+			},
+			WaitingFor: wait.ForListeningPort("8009/tcp"),
+			Networks:   []string{networkName},
+			NetworkAliases: map[string][]string{
+				networkName: {proxyName},
+			},
+		},
+		Started: true,
+	})
+	must.NotError(t, "failed to start sliding sync proxy container", err)
+	d.extraContainers[proxyName] = proxy
+	proxyURL := externalURL(t, proxy, "8009/tcp")
+	t.Logf("SlidingSyncProxyURL(%s): started sliding sync proxy at %s", hsName, proxyURL)
+	return proxyURL
+}
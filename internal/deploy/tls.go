@@ -0,0 +1,64 @@
+package deploy
+
+import (
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+	"github.com/matrix-org/complement/ct"
+)
+
+// BadCertificate is a kind of invalid TLS certificate the reverse proxy can serve.
+type BadCertificate string
+
+const (
+	// A certificate issued by the reverse proxy CA which has expired.
+	BadCertificateExpired BadCertificate = "expired"
+	// A certificate which was not issued by the reverse proxy CA, so is not trusted.
+	BadCertificateSelfSigned BadCertificate = "self_signed"
+	// A certificate issued by the reverse proxy CA for a different hostname.
+	BadCertificateWrongHost BadCertificate = "wrong_host"
+)
+
+// ReverseProxyTLSURLForHS returns the URL of the reverse proxy for the homeserver e.g "hs1", using TLS. This is the
+// same proxy as the URL in api.ClientCreationOpts.BaseURL. Clients must either trust ReverseProxyCACertificate or
+// disable TLS verification to connect. Use WithBadCertificate to serve an invalid certificate instead.
+func (d *ComplementCryptoDeployment) ReverseProxyTLSURLForHS(hsName string) string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return strings.Replace(d.dnsToReverseProxyURL[hsName], "http://", "https://", 1)
+}
+
+// ReverseProxyCACertificate returns the DER encoded CA certificate which issues the TLS certificates served by
+// the reverse proxy, for use with api.ClientCreationOpts.RootCertificates.
+func (d *ComplementCryptoDeployment) ReverseProxyCACertificate(t *testing.T) []byte {
+	t.Helper()
+	block, _ := pem.Decode(d.mitmClient.ReverseProxyCA(t))
+	if block == nil || block.Type != "CERTIFICATE" {
+		ct.Fatalf(t, "ReverseProxyCACertificate: mitmproxy did not return a PEM encoded certificate")
+	}
+	return block.Bytes
+}
+
+// WithBadCertificate serves a bad TLS certificate from the reverse proxy whilst `inner` is called, returning how
+// many TLS handshakes it was served in. Requests on connections which were made before `inner` is called are
+// aborted, so clients have to handshake again, as do clients which connected whilst the bad certificate was served
+// once it is fixed. Only clients which connect via ReverseProxyTLSURLForHS are affected. Bad certificates can be
+// used at the same time as intercepting requests via MITM().Configure.
+//
+//	handshakes := deployment.WithBadCertificate(t, deploy.BadCertificateExpired, func() {
+//		// ... clients which verify certificates cannot sync ...
+//	})
+func (d *ComplementCryptoDeployment) WithBadCertificate(t *testing.T, kind BadCertificate, inner func()) (handshakes int) {
+	t.Helper()
+	badCertID := d.mitmClient.AddBadCertificate(t, mitm.BadCertificate{
+		Kind: string(kind),
+	})
+	defer func() {
+		handshakes = d.mitmClient.RemoveBadCertificate(t, badCertID)
+		t.Logf("WithBadCertificate: served %s certificate in %d handshakes", kind, handshakes)
+	}()
+	inner()
+	return
+}
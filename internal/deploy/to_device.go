@@ -0,0 +1,135 @@
+package deploy
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/complement-crypto/internal/deploy/callback"
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+)
+
+// ToDeviceMessage is a single to-device message sent via /sendToDevice, as seen on the wire.
+// Encrypted messages are not decrypted, so room key shares have the type m.room.encrypted.
+type ToDeviceMessage struct {
+	// The access token of the sender, which identifies the sending device.
+	SenderAccessToken string
+	// The event type from the request path e.g m.room.encrypted
+	EventType string
+	// The transaction ID from the request path.
+	TxnID string
+	// The recipient. DeviceID may be "*" for all devices.
+	UserID   string
+	DeviceID string
+	// The content of the message for this recipient.
+	Content json.RawMessage
+}
+
+// ToDeviceLog records all to-device messages sent via /sendToDevice, so tests can assert how many
+// messages were sent and to whom, rather than inferring it from whether decryption succeeded.
+// It is safe to use concurrently.
+type ToDeviceLog struct {
+	mu       sync.Mutex
+	messages []ToDeviceMessage
+	// access_token|txn_id => seen, to ignore retried requests
+	seenTxns map[string]bool
+}
+
+// SniffToDevice records all /sendToDevice requests whilst `inner` is called, returning the log.
+// Requests which are retried with the same transaction ID are only recorded once. This intercepts
+// requests via MITM().Configure, so cannot be used at the same time as other intercepts.
+//
+//	toDeviceLog := deployment.SniffToDevice(t, func() {
+//		alice.MustSendMessage(t, roomID, "hello")
+//	})
+//	must.Equal(t, len(toDeviceLog.MessagesTo(bob.UserID())), 1, "wrong number of to-device messages")
+func (d *ComplementCryptoDeployment) SniffToDevice(t *testing.T, inner func()) *ToDeviceLog {
+	t.Helper()
+	l := &ToDeviceLog{
+		seenTxns: make(map[string]bool),
+	}
+	d.MITM().Configure(t).WithIntercept(mitm.InterceptOpts{
+		Filter: mitm.FilterParams{
+			PathContains: "/sendToDevice",
+			Method:       "PUT",
+		},
+		RequestCallback: func(cd callback.Data) *callback.Response {
+			l.record(t, cd)
+			return nil
+		},
+	}, inner)
+	return l
+}
+
+func (l *ToDeviceLog) record(t *testing.T, cd callback.Data) {
+	u, err := url.Parse(cd.URL)
+	if err != nil {
+		t.Logf("SniffToDevice: failed to parse URL %s: %s", cd.URL, err)
+		return
+	}
+	// /_matrix/client/v3/sendToDevice/{eventType}/{txnId}
+	_, after, _ := strings.Cut(u.Path, "/sendToDevice/")
+	eventType, txnID, _ := strings.Cut(after, "/")
+	var body struct {
+		Messages map[string]map[string]json.RawMessage `json:"messages"`
+	}
+	if err := json.Unmarshal(cd.RequestBody, &body); err != nil {
+		t.Logf("SniffToDevice: failed to parse request body for %s: %s", cd.URL, err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	txnKey := cd.AccessToken + "|" + txnID
+	if l.seenTxns[txnKey] {
+		return
+	}
+	l.seenTxns[txnKey] = true
+	for userID, devices := range body.Messages {
+		for deviceID, content := range devices {
+			l.messages = append(l.messages, ToDeviceMessage{
+				SenderAccessToken: cd.AccessToken,
+				EventType:         eventType,
+				TxnID:             txnID,
+				UserID:            userID,
+				DeviceID:          deviceID,
+				Content:           content,
+			})
+		}
+	}
+}
+
+// Messages returns a copy of all the to-device messages recorded, in the order they were sent.
+func (l *ToDeviceLog) Messages() []ToDeviceMessage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	messages := make([]ToDeviceMessage, len(l.messages))
+	copy(messages, l.messages)
+	return messages
+}
+
+// Filter returns all the to-device messages for which the checker returns true.
+func (l *ToDeviceLog) Filter(checker func(msg ToDeviceMessage) bool) []ToDeviceMessage {
+	var result []ToDeviceMessage
+	for _, msg := range l.Messages() {
+		if checker(msg) {
+			result = append(result, msg)
+		}
+	}
+	return result
+}
+
+// MessagesOfType returns all the to-device messages with the given event type e.g m.room.encrypted
+func (l *ToDeviceLog) MessagesOfType(eventType string) []ToDeviceMessage {
+	return l.Filter(func(msg ToDeviceMessage) bool {
+		return msg.EventType == eventType
+	})
+}
+
+// MessagesTo returns all the to-device messages sent to any of the user's devices.
+func (l *ToDeviceLog) MessagesTo(userID string) []ToDeviceMessage {
+	return l.Filter(func(msg ToDeviceMessage) bool {
+		return msg.UserID == userID
+	})
+}
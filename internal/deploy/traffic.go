@@ -0,0 +1,72 @@
+package deploy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+)
+
+// TrafficRecording is the file written by RecordTraffic, which can be replayed via ./cmd/replay.
+type TrafficRecording struct {
+	// The name of the test which was recorded, as per t.Name()
+	TestName string `json:"test_name"`
+	// Every HTTP flow which passed through mitmproxy during the test, in the order they completed.
+	Flows []mitm.RecordedFlow `json:"flows"`
+}
+
+// RecordTraffic records every HTTP request and response passing through mitmproxy from now until the end
+// of the test, then writes them to ./logs/traffic, returning the path of the file which will be written.
+// Federation traffic is only recorded if it goes via mitmproxy, see FederationProxied.
+// Traffic can be recorded whilst also intercepting requests via MITM().Configure.
+//
+// The recording includes flows from other tests running at the same time, and can be replayed via:
+//
+//	go run ./cmd/replay -server hs1 ./logs/traffic/TestFoo.json
+func (d *ComplementCryptoDeployment) RecordTraffic(t testing.TB) (path string) {
+	t.Helper()
+	return d.recordTraffic(t, "./logs/traffic", false)
+}
+
+// RecordTrafficIfFailed is RecordTraffic but the recording is only written, to dir, if the test fails.
+func (d *ComplementCryptoDeployment) RecordTrafficIfFailed(t testing.TB, dir string) {
+	t.Helper()
+	d.recordTraffic(t, dir, true)
+}
+
+func (d *ComplementCryptoDeployment) recordTraffic(t testing.TB, dir string, onlyIfFailed bool) (path string) {
+	t.Helper()
+	// subtest names contain slashes, and client types contain pipes
+	filename := strings.NewReplacer("/", "_", "|", "_", " ", "_").Replace(t.Name()) + ".json"
+	path = filepath.Join(dir, filename)
+	recordingID := d.mitmClient.StartRecording(t)
+	t.Cleanup(func() {
+		flows := d.mitmClient.StopRecording(t, recordingID)
+		if onlyIfFailed && !t.Failed() {
+			return
+		}
+		if err := writeTrafficRecording(path, TrafficRecording{
+			TestName: t.Name(),
+			Flows:    flows,
+		}); err != nil {
+			t.Logf("failed to write traffic recording: %s", err)
+			return
+		}
+		t.Logf("wrote %d HTTP flows to %s", len(flows), path)
+	})
+	return path
+}
+
+func writeTrafficRecording(path string, recording TrafficRecording) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(recording, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
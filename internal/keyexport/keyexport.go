@@ -0,0 +1,152 @@
+// Package keyexport encrypts and decrypts room key exports in the format from the Matrix spec, which every SDK
+// can import. See https://spec.matrix.org/v1.11/client-server-api/#key-exports
+//
+// SDKs which can only export room keys as JSON use this to encrypt them with a passphrase, and tests use it to
+// check which sessions are in an export made by an SDK.
+package keyexport
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	header = "-----BEGIN MEGOLM SESSION DATA-----"
+	footer = "-----END MEGOLM SESSION DATA-----"
+	// the only version in the spec
+	version = 1
+	// The number of PBKDF2 rounds used by Encrypt. Element uses 500000, but tests encrypt lots of exports.
+	DefaultRounds = 10000
+	// version, salt, IV, rounds
+	headerLen = 1 + 16 + 16 + 4
+	macLen    = 32
+	// the number of base64 characters per line, as per Element
+	lineLen = 96
+)
+
+// Session is a single room key in an export, as per SessionData in the spec.
+type Session struct {
+	Algorithm                    string            `json:"algorithm"`
+	ForwardingCurve25519KeyChain []string          `json:"forwarding_curve25519_key_chain"`
+	RoomID                       string            `json:"room_id"`
+	SenderKey                    string            `json:"sender_key"`
+	SenderClaimedKeys            map[string]string `json:"sender_claimed_keys"`
+	SessionID                    string            `json:"session_id"`
+	SessionKey                   string            `json:"session_key"`
+	SharedHistory                bool              `json:"org.matrix.msc3061.shared_history,omitempty"`
+}
+
+// Encrypt encrypts the JSON array of sessions with the passphrase, returning the ASCII-armored export.
+func Encrypt(sessionsJSON []byte, passphrase string, rounds uint32) ([]byte, error) {
+	var random [32]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate salt and IV: %s", err)
+	}
+	salt, iv := random[:16], random[16:]
+	// bit 63 of the IV is cleared so the counter can be incremented without overflowing into the nonce on some platforms
+	iv[8] &= 0x7f
+	aesKey, macKey := deriveKeys(passphrase, salt, rounds)
+
+	payload := make([]byte, headerLen, headerLen+len(sessionsJSON)+macLen)
+	payload[0] = version
+	copy(payload[1:17], salt)
+	copy(payload[17:33], iv)
+	binary.BigEndian.PutUint32(payload[33:37], rounds)
+	ciphertext := make([]byte, len(sessionsJSON))
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	cipher.NewCTR(block, iv).XORKeyStream(ciphertext, sessionsJSON)
+	payload = append(payload, ciphertext...)
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(payload)
+	payload = mac.Sum(payload)
+
+	encoded := base64.StdEncoding.EncodeToString(payload)
+	var out bytes.Buffer
+	out.WriteString(header + "\n")
+	for len(encoded) > 0 {
+		n := min(lineLen, len(encoded))
+		out.WriteString(encoded[:n] + "\n")
+		encoded = encoded[n:]
+	}
+	out.WriteString(footer + "\n")
+	return out.Bytes(), nil
+}
+
+// Decrypt decrypts the ASCII-armored export with the passphrase, returning the JSON array of sessions. Returns an
+// error if the export is malformed or the passphrase is wrong.
+func Decrypt(export []byte, passphrase string) ([]byte, error) {
+	body, ok := strings.CutPrefix(strings.TrimSpace(string(export)), header)
+	if !ok {
+		return nil, fmt.Errorf("missing header")
+	}
+	body, ok = strings.CutSuffix(body, footer)
+	if !ok {
+		return nil, fmt.Errorf("missing footer")
+	}
+	body = strings.Join(strings.Fields(body), "")
+	payload, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		payload, err = base64.RawStdEncoding.DecodeString(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64: %s", err)
+		}
+	}
+	if len(payload) < headerLen+macLen {
+		return nil, fmt.Errorf("export is too short: %d bytes", len(payload))
+	}
+	if payload[0] != version {
+		return nil, fmt.Errorf("unsupported version %d", payload[0])
+	}
+	salt, iv := payload[1:17], payload[17:33]
+	rounds := binary.BigEndian.Uint32(payload[33:37])
+	aesKey, macKey := deriveKeys(passphrase, salt, rounds)
+
+	signed, gotMAC := payload[:len(payload)-macLen], payload[len(payload)-macLen:]
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(signed)
+	if !hmac.Equal(mac.Sum(nil), gotMAC) {
+		return nil, fmt.Errorf("MAC mismatch: wrong passphrase or corrupted export")
+	}
+	ciphertext := signed[headerLen:]
+	plaintext := make([]byte, len(ciphertext))
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	cipher.NewCTR(block, iv).XORKeyStream(plaintext, ciphertext)
+	return plaintext, nil
+}
+
+// DecryptSessions is Decrypt but also parses the sessions.
+func DecryptSessions(export []byte, passphrase string) ([]Session, error) {
+	plaintext, err := Decrypt(export, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	var sessions []Session
+	if err := json.Unmarshal(plaintext, &sessions); err != nil {
+		return nil, fmt.Errorf("export does not contain a JSON array of sessions: %s", err)
+	}
+	return sessions, nil
+}
+
+// deriveKeys returns the AES-256 key and HMAC-SHA-256 key for the passphrase.
+func deriveKeys(passphrase string, salt []byte, rounds uint32) (aesKey, macKey []byte) {
+	keys := pbkdf2.Key([]byte(passphrase), salt, int(rounds), 64, sha512.New)
+	return keys[:32], keys[32:]
+}
@@ -0,0 +1,80 @@
+package keyexport
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement/must"
+)
+
+var testSessions = []Session{
+	{
+		Algorithm:                    "m.megolm.v1.aes-sha2",
+		ForwardingCurve25519KeyChain: []string{},
+		RoomID:                       "!room:hs1",
+		SenderKey:                    "sender+curve25519+key",
+		SenderClaimedKeys:            map[string]string{"ed25519": "sender+ed25519+key"},
+		SessionID:                    "session+id",
+		SessionKey:                   "AQAAAABsession+key",
+	},
+}
+
+func mustEncrypt(t *testing.T, passphrase string) []byte {
+	t.Helper()
+	sessionsJSON, err := json.Marshal(testSessions)
+	must.NotError(t, "Marshal", err)
+	export, err := Encrypt(sessionsJSON, passphrase, 1000)
+	must.NotError(t, "Encrypt", err)
+	return export
+}
+
+func TestRoundTrip(t *testing.T) {
+	export := mustEncrypt(t, "correct horse battery staple")
+	must.Equal(t, bytes.HasPrefix(export, []byte(header+"\n")), true, "export does not start with the header")
+	must.Equal(t, bytes.HasSuffix(export, []byte(footer+"\n")), true, "export does not end with the footer")
+	for _, line := range strings.Split(string(export), "\n") {
+		must.Equal(t, len(line) <= lineLen, true, "line is too long: "+line)
+	}
+	sessions, err := DecryptSessions(export, "correct horse battery staple")
+	must.NotError(t, "DecryptSessions", err)
+	must.Equal(t, len(sessions), 1, "wrong number of sessions")
+	must.Equal(t, sessions[0].SessionID, testSessions[0].SessionID, "wrong session ID")
+	must.Equal(t, sessions[0].SessionKey, testSessions[0].SessionKey, "wrong session key")
+	must.Equal(t, sessions[0].SenderClaimedKeys["ed25519"], "sender+ed25519+key", "wrong claimed key")
+}
+
+func TestDecryptWithWrongPassphrase(t *testing.T) {
+	export := mustEncrypt(t, "correct horse battery staple")
+	_, err := Decrypt(export, "incorrect horse battery staple")
+	must.Equal(t, err != nil, true, "decrypted with the wrong passphrase")
+}
+
+func TestDecryptTamperedExport(t *testing.T) {
+	export := mustEncrypt(t, "passphrase")
+	lines := strings.Split(string(export), "\n")
+	// flip a character in the ciphertext, keeping it valid base64
+	body := []byte(lines[1])
+	if body[50] == 'A' {
+		body[50] = 'B'
+	} else {
+		body[50] = 'A'
+	}
+	lines[1] = string(body)
+	_, err := Decrypt([]byte(strings.Join(lines, "\n")), "passphrase")
+	must.Equal(t, err != nil, true, "decrypted a tampered export")
+}
+
+func TestDecryptMalformedExport(t *testing.T) {
+	testCases := map[string]string{
+		"no header": "AQID\n" + footer,
+		"no footer": header + "\nAQID",
+		"too short": header + "\nAQID\n" + footer,
+		"not b64":   header + "\n!!!!\n" + footer,
+	}
+	for name, export := range testCases {
+		_, err := Decrypt([]byte(export), "passphrase")
+		must.Equal(t, err != nil, true, name+": decrypted a malformed export")
+	}
+}
@@ -0,0 +1,133 @@
+// Package logging buffers log lines from every client, tagged with the test and client which wrote them,
+// so that a single timestamp-ordered log bundle can be written out when a test fails. Without this, the
+// logs for a failed test are spread across one file per SDK, interleaved with logs from every other test.
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Line is a single buffered log line.
+type Line struct {
+	Time time.Time
+	// The name of the test which wrote this line, as per t.Name()
+	TestName string
+	// Identifies the client which wrote this line e.g "@alice:hs1,DEVICE (rust)"
+	ClientID string
+	Message  string
+}
+
+func (l Line) String() string {
+	return fmt.Sprintf("%s [%s] [%s] %s", l.Time.Format("15:04:05.000000Z07:00"), l.TestName, l.ClientID, l.Message)
+}
+
+var (
+	mu sync.Mutex
+	// test names which are being captured
+	captured = make(map[string]bool)
+	lines    []Line
+)
+
+// Write buffers a log line from the given client, if the test (or a parent test) is being captured.
+// Lines for tests which are not being captured are dropped. Safe to call from any goroutine.
+func Write(testName, clientID, message string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if !isCaptured(testName) {
+		return
+	}
+	lines = append(lines, Line{
+		Time:     time.Now(),
+		TestName: testName,
+		ClientID: clientID,
+		Message:  strings.TrimRight(message, "\n"),
+	})
+}
+
+// Capture starts buffering log lines for this test and all of its subtests. When the test ends, the lines
+// are written to a file in dir if the test failed, ordered by time, then discarded. Capturing the same test
+// more than once does nothing. If dir is empty, nothing is captured.
+func Capture(t testing.TB, dir string) {
+	t.Helper()
+	if dir == "" {
+		return
+	}
+	testName := t.Name()
+	mu.Lock()
+	if captured[testName] {
+		mu.Unlock()
+		return
+	}
+	captured[testName] = true
+	mu.Unlock()
+	t.Cleanup(func() {
+		bundle := release(testName)
+		if !t.Failed() || len(bundle) == 0 {
+			return
+		}
+		path, err := writeBundle(dir, testName, bundle)
+		if err != nil {
+			t.Logf("failed to write log bundle: %s", err)
+			return
+		}
+		t.Logf("wrote %d log lines to %s", len(bundle), path)
+	})
+}
+
+// isCaptured returns true if this test or any of its parents are being captured. Must be called with mu held.
+func isCaptured(testName string) bool {
+	for {
+		if captured[testName] {
+			return true
+		}
+		i := strings.LastIndex(testName, "/")
+		if i == -1 {
+			return false
+		}
+		testName = testName[:i]
+	}
+}
+
+// release stops capturing the test, returning the lines for it and its subtests in time order.
+func release(testName string) []Line {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(captured, testName)
+	var bundle []Line
+	remaining := lines[:0]
+	for _, l := range lines {
+		if l.TestName == testName || strings.HasPrefix(l.TestName, testName+"/") {
+			bundle = append(bundle, l)
+		} else {
+			remaining = append(remaining, l)
+		}
+	}
+	lines = remaining
+	// lines from different goroutines can be appended slightly out of order
+	sort.SliceStable(bundle, func(i, j int) bool {
+		return bundle[i].Time.Before(bundle[j].Time)
+	})
+	return bundle
+}
+
+func writeBundle(dir, testName string, bundle []Line) (string, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", err
+	}
+	// subtest names contain slashes, and client types contain pipes
+	filename := strings.NewReplacer("/", "_", "|", "_", " ", "_").Replace(testName) + ".log"
+	path := filepath.Join(dir, filename)
+	var sb strings.Builder
+	for _, l := range bundle {
+		sb.WriteString(l.String())
+		sb.WriteString("\n")
+	}
+	return path, os.WriteFile(path, []byte(sb.String()), 0644)
+}
@@ -0,0 +1,71 @@
+package logging
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCaptureIncludesSubtests(t *testing.T) {
+	dir := t.TempDir()
+	t.Run("parent", func(t *testing.T) {
+		Capture(t, dir)
+		Write("TestCaptureIncludesSubtests/parent", "alice", "first")
+		Write("TestCaptureIncludesSubtests/parent/child", "bob", "second\n")
+		Write("TestSomethingElse", "charlie", "not captured")
+
+		mu.Lock()
+		got := len(lines)
+		mu.Unlock()
+		if got != 2 {
+			t.Errorf("buffered %d lines, want 2", got)
+		}
+	})
+	// the subtest passed, so nothing should be written and the buffer should be empty
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %s", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("wrote %d files for a passing test, want 0", len(entries))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(lines) != 0 || len(captured) != 0 {
+		t.Errorf("did not release lines for passing test: %d lines, %d captured", len(lines), len(captured))
+	}
+}
+
+func TestWriteBundleOrdersByTime(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	mu.Lock()
+	captured["TestX/rust|js"] = true
+	lines = append(lines,
+		Line{Time: now.Add(time.Second), TestName: "TestX/rust|js", ClientID: "bob", Message: "later"},
+		Line{Time: now, TestName: "TestX/rust|js", ClientID: "alice", Message: "earlier"},
+	)
+	mu.Unlock()
+
+	bundle := release("TestX/rust|js")
+	path, err := writeBundle(dir, "TestX/rust|js", bundle)
+	if err != nil {
+		t.Fatalf("writeBundle: %s", err)
+	}
+	if filepath.Base(path) != "TestX_rust_js.log" {
+		t.Errorf("wrong filename: %s", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	got := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(got) != 2 {
+		t.Fatalf("got %d lines, want 2: %v", len(got), got)
+	}
+	if !strings.HasSuffix(got[0], "[TestX/rust|js] [alice] earlier") || !strings.HasSuffix(got[1], "[TestX/rust|js] [bob] later") {
+		t.Errorf("lines are in the wrong order: %v", got)
+	}
+}
@@ -0,0 +1,194 @@
+// Package memory samples the resident memory of the test process and its child processes, so that tests
+// can detect SDKs using far more memory than expected, e.g crypto stores which grow without bound under load.
+// The test process includes the rust SDK, as it is linked in via cgo. Child processes include the browsers
+// which run the JS SDK, python processes which run nio and multiprocess RPC clients.
+//
+// Sampling reads /proc, so only works on Linux.
+package memory
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sample is the resident memory in use at a point in time.
+type Sample struct {
+	Time time.Time
+	// The RSS of the test process in bytes, which includes cgo allocations.
+	ProcessRSS uint64
+	// The total RSS of all descendant processes in bytes.
+	ChildrenRSS uint64
+}
+
+// Total returns the RSS of the test process and its descendants in bytes.
+func (s Sample) Total() uint64 {
+	return s.ProcessRSS + s.ChildrenRSS
+}
+
+func (s Sample) String() string {
+	return fmt.Sprintf("total=%s process=%s children=%s", FormatBytes(s.Total()), FormatBytes(s.ProcessRSS), FormatBytes(s.ChildrenRSS))
+}
+
+// FormatBytes formats a number of bytes as MiB e.g "12.3MiB".
+func FormatBytes(b uint64) string {
+	return fmt.Sprintf("%.1fMiB", float64(b)/(1024*1024))
+}
+
+// Take samples the RSS of this process and all of its descendants.
+func Take() (Sample, error) {
+	return sampleTree("/proc", os.Getpid())
+}
+
+func sampleTree(procDir string, pid int) (Sample, error) {
+	sample := Sample{Time: time.Now()}
+	rss, err := readRSS(procDir, pid)
+	if err != nil {
+		return sample, err
+	}
+	sample.ProcessRSS = rss
+	children, err := childrenByParent(procDir)
+	if err != nil {
+		return sample, err
+	}
+	queue := children[pid]
+	for len(queue) > 0 {
+		child := queue[0]
+		queue = append(queue[1:], children[child]...)
+		rss, err := readRSS(procDir, child)
+		if err != nil {
+			continue // the process may have exited
+		}
+		sample.ChildrenRSS += rss
+	}
+	return sample, nil
+}
+
+// readRSS returns the VmRSS of the process in bytes.
+func readRSS(procDir string, pid int) (uint64, error) {
+	f, err := os.Open(filepath.Join(procDir, strconv.Itoa(pid), "status"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// e.g "VmRSS:	   12345 kB"
+		val, ok := strings.CutPrefix(scanner.Text(), "VmRSS:")
+		if !ok {
+			continue
+		}
+		kb, err := strconv.ParseUint(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(val), "kB")), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse VmRSS of %d: %s", pid, err)
+		}
+		return kb * 1024, nil
+	}
+	// kernel threads have no VmRSS
+	return 0, scanner.Err()
+}
+
+// childrenByParent returns the PIDs of every process, keyed by the PID of their parent.
+func childrenByParent(procDir string) (map[int][]int, error) {
+	entries, err := os.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+	children := make(map[int][]int)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue // not a process
+		}
+		stat, err := os.ReadFile(filepath.Join(procDir, entry.Name(), "stat"))
+		if err != nil {
+			continue // the process may have exited
+		}
+		// e.g "1234 (chrome) S 1000 ...". The command can contain spaces and brackets, so find the last bracket.
+		i := strings.LastIndexByte(string(stat), ')')
+		if i == -1 {
+			continue
+		}
+		fields := strings.Fields(string(stat[i+1:]))
+		if len(fields) < 2 {
+			continue
+		}
+		ppid, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		children[ppid] = append(children[ppid], pid)
+	}
+	return children, nil
+}
+
+// Monitor samples memory periodically until stopped, keeping track of the peak.
+type Monitor struct {
+	mu      sync.Mutex
+	peak    Sample
+	samples int
+	err     error
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// StartMonitor samples memory every interval until Stop is called. Returns an error if memory cannot be
+// sampled e.g because this is not Linux.
+func StartMonitor(interval time.Duration) (*Monitor, error) {
+	first, err := Take()
+	if err != nil {
+		return nil, fmt.Errorf("cannot sample memory: %s", err)
+	}
+	m := &Monitor{
+		peak:    first,
+		samples: 1,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go m.loop(interval)
+	return m, nil
+}
+
+func (m *Monitor) loop(interval time.Duration) {
+	defer close(m.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.record()
+		}
+	}
+}
+
+func (m *Monitor) record() {
+	sample, err := Take()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.err = err
+		return
+	}
+	m.samples++
+	if sample.Total() > m.peak.Total() {
+		m.peak = sample
+	}
+}
+
+// Stop sampling, taking one final sample. Returns the sample with the highest total RSS, and how many
+// samples were taken. Returns an error if any sample failed.
+func (m *Monitor) Stop() (peak Sample, numSamples int, err error) {
+	close(m.stop)
+	<-m.stopped
+	m.record()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.peak, m.samples, m.err
+}
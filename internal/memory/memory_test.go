@@ -0,0 +1,70 @@
+package memory
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/must"
+)
+
+func writeProc(t *testing.T, procDir string, pid, ppid int, comm string, rssKB string) {
+	t.Helper()
+	dir := filepath.Join(procDir, strconv.Itoa(pid))
+	must.NotError(t, "mkdir", os.MkdirAll(dir, 0o755))
+	stat := strconv.Itoa(pid) + " (" + comm + ") S " + strconv.Itoa(ppid) + " 1 1 0 -1\n"
+	must.NotError(t, "write stat", os.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0o644))
+	status := "Name:\t" + comm + "\n"
+	if rssKB != "" {
+		status += "VmRSS:\t" + rssKB + " kB\n"
+	}
+	status += "Threads:\t1\n"
+	must.NotError(t, "write status", os.WriteFile(filepath.Join(dir, "status"), []byte(status), 0o644))
+}
+
+func TestSampleTree(t *testing.T) {
+	procDir := t.TempDir()
+	writeProc(t, procDir, 100, 1, "go test", "1000")
+	// a browser and its renderer, which is a grandchild of the test process
+	writeProc(t, procDir, 101, 100, "chrome", "200")
+	writeProc(t, procDir, 102, 101, "chrome (renderer) )", "300")
+	// not a descendant
+	writeProc(t, procDir, 200, 1, "other", "5000")
+	// kernel threads have no VmRSS
+	writeProc(t, procDir, 103, 100, "kthread", "")
+	// not a process
+	must.NotError(t, "mkdir", os.MkdirAll(filepath.Join(procDir, "self"), 0o755))
+
+	sample, err := sampleTree(procDir, 100)
+	must.NotError(t, "sampleTree", err)
+	must.Equal(t, sample.ProcessRSS, uint64(1000*1024), "ProcessRSS")
+	must.Equal(t, sample.ChildrenRSS, uint64(500*1024), "ChildrenRSS")
+	must.Equal(t, sample.Total(), uint64(1500*1024), "Total")
+}
+
+func TestSampleTreeMissingProcess(t *testing.T) {
+	_, err := sampleTree(t.TempDir(), 100)
+	if err == nil {
+		t.Fatalf("sampleTree: expected an error for a missing process")
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skipf("memory can only be sampled on linux")
+	}
+	monitor, err := StartMonitor(10 * time.Millisecond)
+	must.NotError(t, "StartMonitor", err)
+	time.Sleep(50 * time.Millisecond)
+	peak, numSamples, err := monitor.Stop()
+	must.NotError(t, "Stop", err)
+	if numSamples < 2 {
+		t.Errorf("expected at least 2 samples, got %d", numSamples)
+	}
+	if peak.ProcessRSS == 0 {
+		t.Errorf("expected the test process to use memory, got %s", peak)
+	}
+}
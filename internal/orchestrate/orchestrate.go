@@ -0,0 +1,280 @@
+// Package orchestrate runs scripted scenarios involving multiple clients.
+//
+// Tests often need a sequence like "Bob sends a message, then Alice and Charlie decrypt it". Writing this inline
+// means creating waiters before sending, picking timeouts and writing failure messages for every step. Instead,
+// declare the steps and Run them:
+//
+//	orchestrate.Run(t,
+//		orchestrate.Step{Actor: bob, Action: orchestrate.SendMessage(roomID, "hello")},
+//		orchestrate.Concurrently(
+//			orchestrate.Step{Actor: alice, Expect: orchestrate.SeesDecrypted(roomID, "hello")},
+//			orchestrate.Step{Actor: charlie, Expect: orchestrate.SeesDecrypted(roomID, "hello")},
+//		),
+//	)
+//
+// Every step is logged to the test and the actor's log file as it starts and finishes. If a step fails or times
+// out, the test fails with the whole script, showing which steps passed, which failed and which never ran.
+package orchestrate
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement/ct"
+)
+
+// DefaultTimeout is how long a step may take if Step.Timeout is not set.
+const DefaultTimeout = 5 * time.Second
+
+// Action is something an actor does e.g send a message.
+type Action struct {
+	// Name describes the action in logs e.g `SendMessage(!foo:hs1, "hello")`.
+	Name string
+	// Do performs the action as the actor, returning an error if it failed.
+	Do func(t ct.TestLike, actor api.TestClient) error
+}
+
+// Expectation is something an actor expects to see e.g a decrypted message.
+type Expectation struct {
+	// Name describes the expectation in logs e.g `SeesDecrypted(!foo:hs1, "hello")`.
+	Name string
+	// Waiter returns a waiter which completes when the actor sees what is expected.
+	Waiter func(t ct.TestLike, actor api.TestClient) api.Waiter
+}
+
+// Step is a single line in a scenario. Exactly one of Action, Expect or Group must be set.
+type Step struct {
+	// The client which performs the action or has the expectation. Not used for groups.
+	Actor api.TestClient
+	// The thing the actor does.
+	Action *Action
+	// The thing the actor expects to see. Expectations are registered before the step immediately before them
+	// runs, so they see anything which that step causes, in the same way tests create waiters before sending.
+	// This includes expectations in groups which only contain expectations.
+	Expect *Expectation
+	// Steps which run concurrently. The group finishes when all of its steps finish.
+	Group []Step
+	// How long this step may take, else DefaultTimeout. Not used for groups: each step in the group has its own.
+	Timeout time.Duration
+}
+
+// Concurrently returns a step which runs all the given steps at the same time.
+func Concurrently(steps ...Step) Step {
+	return Step{Group: steps}
+}
+
+func (s Step) timeout() time.Duration {
+	if s.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return s.Timeout
+}
+
+func (s Step) String() string {
+	switch {
+	case s.Group != nil:
+		return fmt.Sprintf("Concurrently(%d steps)", len(s.Group))
+	case s.Action != nil:
+		return fmt.Sprintf("%s %s", s.Actor.UserID(), s.Action.Name)
+	case s.Expect != nil:
+		return fmt.Sprintf("%s expects %s", s.Actor.UserID(), s.Expect.Name)
+	default:
+		return "invalid step"
+	}
+}
+
+type stepStatus int
+
+const (
+	statusPending stepStatus = iota
+	statusPassed
+	statusFailed
+)
+
+// result is the outcome of a step, forming a tree for groups.
+type result struct {
+	step     Step
+	status   stepStatus
+	err      error
+	duration time.Duration
+	children []*result
+}
+
+func newResult(step Step) *result {
+	r := &result{step: step}
+	for _, child := range step.Group {
+		r.children = append(r.children, newResult(child))
+	}
+	return r
+}
+
+// Run runs the steps in order, failing the test if any step fails or takes longer than its timeout.
+func Run(t ct.TestLike, steps ...Step) {
+	t.Helper()
+	if err := TryRun(t, steps...); err != nil {
+		ct.Fatalf(t, "%s", err)
+	}
+}
+
+// TryRun is Run but returns an error describing the whole script instead of failing the test.
+func TryRun(t ct.TestLike, steps ...Step) error {
+	t.Helper()
+	results := make([]*result, len(steps))
+	for i, step := range steps {
+		if err := validate(step); err != nil {
+			return fmt.Errorf("orchestrate: step %d: %s", i+1, err)
+		}
+		results[i] = newResult(step)
+	}
+	waiters := make(map[*result]api.Waiter)
+	for i := range steps {
+		// register waiters for the expectations immediately after this step, before running it.
+		for j := i + 1; j < len(steps) && onlyExpectations(steps[j]); j++ {
+			registerWaiters(t, results[j], waiters)
+		}
+		runStep(t, fmt.Sprintf("%d", i+1), results[i], waiters)
+		if results[i].status == statusFailed {
+			return fmt.Errorf("orchestrate: step %d failed: %s\n%s", i+1, results[i].err, describe(results))
+		}
+	}
+	return nil
+}
+
+// onlyExpectations returns true if the step is an expectation, or a group containing only expectations.
+func onlyExpectations(step Step) bool {
+	if step.Action != nil {
+		return false
+	}
+	for _, child := range step.Group {
+		if !onlyExpectations(child) {
+			return false
+		}
+	}
+	return true
+}
+
+// registerWaiters creates waiters for all the expectations in res which do not already have one.
+func registerWaiters(t ct.TestLike, res *result, waiters map[*result]api.Waiter) {
+	t.Helper()
+	if res.step.Expect != nil {
+		if _, exists := waiters[res]; !exists {
+			waiters[res] = res.step.Expect.Waiter(t, res.step.Actor)
+		}
+	}
+	for _, child := range res.children {
+		registerWaiters(t, child, waiters)
+	}
+}
+
+func validate(step Step) error {
+	set := 0
+	for _, isSet := range []bool{step.Action != nil, step.Expect != nil, step.Group != nil} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("exactly one of Action, Expect or Group must be set")
+	}
+	if step.Group == nil && step.Actor == nil {
+		return fmt.Errorf("%s has no Actor", step)
+	}
+	for i, child := range step.Group {
+		if err := validate(child); err != nil {
+			return fmt.Errorf("group step %d: %s", i+1, err)
+		}
+	}
+	return nil
+}
+
+// runStep runs the step, recording the outcome in res. Expectations use the waiter registered for them in waiters,
+// else create one. waiters MUST NOT be modified whilst this is running.
+func runStep(t ct.TestLike, index string, res *result, waiters map[*result]api.Waiter) {
+	t.Helper()
+	step := res.step
+	if step.Group != nil {
+		start := time.Now()
+		var wg sync.WaitGroup
+		for i, child := range res.children {
+			wg.Add(1)
+			go func(i int, child *result) {
+				defer wg.Done()
+				runStep(t, fmt.Sprintf("%s.%d", index, i+1), child, waiters)
+			}(i, child)
+		}
+		wg.Wait()
+		res.duration = time.Since(start)
+		res.status = statusPassed
+		for i, child := range res.children {
+			if child.status == statusFailed {
+				res.status = statusFailed
+				res.err = fmt.Errorf("step %s.%d: %s", index, i+1, child.err)
+				break
+			}
+		}
+		return
+	}
+	step.Actor.Logf(t, "orchestrate: step %s: %s", index, step)
+	start := time.Now()
+	if step.Action != nil {
+		res.err = runWithTimeout(step.timeout(), func() error {
+			return step.Action.Do(t, step.Actor)
+		})
+	} else {
+		waiter := waiters[res]
+		if waiter == nil {
+			waiter = step.Expect.Waiter(t, step.Actor)
+		}
+		res.err = waiter.TryWaitf(t, step.timeout(), "%s did not see %s", step.Actor.UserID(), step.Expect.Name)
+	}
+	res.duration = time.Since(start)
+	if res.err != nil {
+		res.status = statusFailed
+		step.Actor.Logf(t, "orchestrate: step %s: FAILED after %v: %s", index, res.duration, res.err)
+		return
+	}
+	res.status = statusPassed
+	step.Actor.Logf(t, "orchestrate: step %s: passed in %v", index, res.duration)
+}
+
+// runWithTimeout calls fn, returning an error if it does not return within the timeout. fn is left running
+// in the background if it times out.
+func runWithTimeout(timeout time.Duration, fn func() error) error {
+	// buffered so the goroutine can exit if fn eventually returns after we've given up
+	ch := make(chan error, 1)
+	go func() {
+		ch <- fn()
+	}()
+	select {
+	case err := <-ch:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out after %v", timeout)
+	}
+}
+
+// describe returns the whole script, marking each step with its outcome.
+func describe(results []*result) string {
+	var sb strings.Builder
+	var write func(prefix string, results []*result, depth int)
+	write = func(prefix string, results []*result, depth int) {
+		for i, res := range results {
+			index := fmt.Sprintf("%s%d", prefix, i+1)
+			indent := strings.Repeat("  ", depth)
+			switch res.status {
+			case statusPending:
+				fmt.Fprintf(&sb, "%s  [ ] %s %s\n", indent, index, res.step)
+			case statusPassed:
+				fmt.Fprintf(&sb, "%s  [✓] %s %s (%v)\n", indent, index, res.step, res.duration.Round(time.Millisecond))
+			case statusFailed:
+				fmt.Fprintf(&sb, "%s  [✗] %s %s (%v): %s\n", indent, index, res.step, res.duration.Round(time.Millisecond), res.err)
+			}
+			write(index+".", res.children, depth+1)
+		}
+	}
+	write("", results, 0)
+	return sb.String()
+}
@@ -0,0 +1,137 @@
+package orchestrate
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement/ct"
+)
+
+// fakeRoom is a room shared between fakeClients, which see every message sent in it.
+type fakeRoom struct {
+	mu     sync.Mutex
+	events []api.Event
+}
+
+func (r *fakeRoom) has(checker func(e api.Event) bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, ev := range r.events {
+		if checker(ev) {
+			return true
+		}
+	}
+	return false
+}
+
+// fakeClient implements the parts of api.TestClient used by the built-in steps.
+type fakeClient struct {
+	api.TestClient
+	userID string
+	room   *fakeRoom
+}
+
+func (c *fakeClient) UserID() string { return c.userID }
+
+func (c *fakeClient) Logf(t ct.TestLike, format string, args ...interface{}) {
+	t.Logf(format, args...)
+}
+
+func (c *fakeClient) SendMessage(t ct.TestLike, roomID, text string) (string, error) {
+	c.room.mu.Lock()
+	defer c.room.mu.Unlock()
+	c.room.events = append(c.room.events, api.Event{Sender: c.userID, Text: text})
+	return fmt.Sprintf("$%d", len(c.room.events)), nil
+}
+
+func (c *fakeClient) WaitUntilEventInRoom(t ct.TestLike, roomID string, checker func(e api.Event) bool) api.Waiter {
+	return &fakeWaiter{room: c.room, checker: checker}
+}
+
+type fakeWaiter struct {
+	room    *fakeRoom
+	checker func(e api.Event) bool
+}
+
+func (w *fakeWaiter) Waitf(t ct.TestLike, s time.Duration, format string, args ...any) {
+	if err := w.TryWaitf(t, s, format, args...); err != nil {
+		ct.Fatalf(t, "%s", err)
+	}
+}
+
+func (w *fakeWaiter) TryWaitf(t ct.TestLike, s time.Duration, format string, args ...any) error {
+	deadline := time.Now().Add(s)
+	for !w.room.has(w.checker) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf(format, args...)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+func TestRun(t *testing.T) {
+	room := &fakeRoom{}
+	alice := &fakeClient{userID: "@alice:hs1", room: room}
+	bob := &fakeClient{userID: "@bob:hs1", room: room}
+	charlie := &fakeClient{userID: "@charlie:hs1", room: room}
+
+	err := TryRun(t,
+		Step{Actor: bob, Action: SendMessage("!room", "hello")},
+		Concurrently(
+			Step{Actor: alice, Expect: SeesDecrypted("!room", "hello")},
+			Step{Actor: charlie, Expect: SeesDecrypted("!room", "hello")},
+		),
+		Step{Actor: alice, Action: SendMessage("!room", "world")},
+		Step{Actor: bob, Expect: SeesDecrypted("!room", "world")},
+	)
+	if err != nil {
+		t.Fatalf("TryRun: %s", err)
+	}
+
+	// failures describe the whole script
+	err = TryRun(t,
+		Step{Actor: bob, Action: SendMessage("!room", "again")},
+		Concurrently(
+			Step{Actor: alice, Expect: SeesDecrypted("!room", "again")},
+			Step{Actor: charlie, Expect: SeesDecrypted("!room", "never sent"), Timeout: 10 * time.Millisecond},
+		),
+		Step{Actor: alice, Action: SendMessage("!room", "not sent")},
+	)
+	if err == nil {
+		t.Fatalf("TryRun: expected an error")
+	}
+	for _, want := range []string{
+		"step 2 failed",
+		`[✓] 1 @bob:hs1 SendMessage(!room, "again")`,
+		`[✓] 2.1 @alice:hs1 expects SeesDecrypted(!room, "again")`,
+		`[✗] 2.2 @charlie:hs1 expects SeesDecrypted(!room, "never sent")`,
+		`[ ] 3 @alice:hs1 SendMessage(!room, "not sent")`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("TryRun error did not contain %q:\n%s", want, err)
+		}
+	}
+	if room.has(api.CheckEventHasBody("not sent")) {
+		t.Errorf("TryRun ran steps after the failed step")
+	}
+
+	// actions time out
+	err = TryRun(t, Step{Actor: alice, Timeout: 10 * time.Millisecond, Action: Do("hang", func(t ct.TestLike, actor api.TestClient) error {
+		time.Sleep(time.Second)
+		return nil
+	})})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("TryRun: expected a timeout error, got %v", err)
+	}
+
+	// invalid steps are rejected
+	err = TryRun(t, Step{Actor: alice})
+	if err == nil || !strings.Contains(err.Error(), "exactly one of") {
+		t.Errorf("TryRun: expected a validation error, got %v", err)
+	}
+}
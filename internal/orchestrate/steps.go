@@ -0,0 +1,69 @@
+package orchestrate
+
+import (
+	"fmt"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement/ct"
+)
+
+// SendMessage sends the given text in the room.
+func SendMessage(roomID, text string) *Action {
+	return &Action{
+		Name: fmt.Sprintf("SendMessage(%s, %q)", roomID, text),
+		Do: func(t ct.TestLike, actor api.TestClient) error {
+			_, err := actor.SendMessage(t, roomID, text)
+			return err
+		},
+	}
+}
+
+// JoinRoom joins the room via the given servers.
+func JoinRoom(roomID string, serverNames []string) *Action {
+	return &Action{
+		Name: fmt.Sprintf("JoinRoom(%s, %v)", roomID, serverNames),
+		Do: func(t ct.TestLike, actor api.TestClient) error {
+			return actor.JoinRoom(t, roomID, serverNames)
+		},
+	}
+}
+
+// InviteUser invites the user to the room.
+func InviteUser(roomID, userID string) *Action {
+	return &Action{
+		Name: fmt.Sprintf("InviteUser(%s, %s)", roomID, userID),
+		Do: func(t ct.TestLike, actor api.TestClient) error {
+			return actor.InviteUser(t, roomID, userID)
+		},
+	}
+}
+
+// Do is an action which calls fn, for actions which have no helper function.
+func Do(name string, fn func(t ct.TestLike, actor api.TestClient) error) *Action {
+	return &Action{
+		Name: name,
+		Do:   fn,
+	}
+}
+
+// SeesDecrypted expects the actor to see an event in the room with the given body.
+func SeesDecrypted(roomID, body string) *Expectation {
+	return SeesEvent(fmt.Sprintf("SeesDecrypted(%s, %q)", roomID, body), roomID, api.CheckEventHasBody(body))
+}
+
+// SeesUndecryptable expects the actor to see an event in the room from the given sender which failed to decrypt.
+func SeesUndecryptable(roomID, sender string) *Expectation {
+	return SeesEvent(fmt.Sprintf("SeesUndecryptable(%s, %s)", roomID, sender), roomID, func(e api.Event) bool {
+		return e.Sender == sender && e.FailedToDecrypt
+	})
+}
+
+// SeesEvent expects the actor to see an event in the room which matches the checker.
+func SeesEvent(name, roomID string, checker func(e api.Event) bool) *Expectation {
+	return &Expectation{
+		Name: name,
+		Waiter: func(t ct.TestLike, actor api.TestClient) api.Waiter {
+			return actor.WaitUntilEventInRoom(t, roomID, checker)
+		},
+	}
+}
@@ -0,0 +1,199 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LatencyBucketsMs are the upper bounds of the buckets in a LatencyHistogram, in milliseconds. Latencies above
+// the last bound are counted in an extra, unbounded bucket.
+var LatencyBucketsMs = []float64{100, 250, 500, 1000, 2500, 5000, 10000, 30000}
+
+// LatencyHistogram is the distribution of message delivery latencies for a pair of SDKs, over the whole test run.
+// Latency is the time between a client starting to send a message and a test seeing another client decrypt it.
+type LatencyHistogram struct {
+	// The SDK sending messages e.g "rust"
+	SenderSDK string `json:"sender_sdk"`
+	// The SDK receiving and decrypting messages e.g "js"
+	ReceiverSDK string `json:"receiver_sdk"`
+	// The number of decrypted messages, counted once per receiving client.
+	Count int `json:"count"`
+	// Buckets[i] is the number of latencies <= LatencyBucketsMs[i] and greater than the previous bound. The final
+	// bucket is the number of latencies greater than every bound.
+	Buckets      []int   `json:"buckets"`
+	P50LatencyMs float64 `json:"p50_latency_ms"`
+	P95LatencyMs float64 `json:"p95_latency_ms"`
+	MaxLatencyMs float64 `json:"max_latency_ms"`
+}
+
+// Pair returns the SDK pair for this histogram e.g "rust -> js"
+func (h LatencyHistogram) Pair() string {
+	return h.SenderSDK + " -> " + h.ReceiverSDK
+}
+
+func newLatencyHistogram(senderSDK, receiverSDK string, latenciesMs []float64) LatencyHistogram {
+	sort.Float64s(latenciesMs)
+	h := LatencyHistogram{
+		SenderSDK:   senderSDK,
+		ReceiverSDK: receiverSDK,
+		Count:       len(latenciesMs),
+		Buckets:     make([]int, len(LatencyBucketsMs)+1),
+	}
+	if len(latenciesMs) == 0 {
+		return h
+	}
+	for _, l := range latenciesMs {
+		h.Buckets[sort.SearchFloat64s(LatencyBucketsMs, l)]++
+	}
+	h.P50LatencyMs = percentile(latenciesMs, 0.5)
+	h.P95LatencyMs = percentile(latenciesMs, 0.95)
+	h.MaxLatencyMs = latenciesMs[len(latenciesMs)-1]
+	return h
+}
+
+// percentile returns the nearest-rank percentile of the sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+type sentMessage struct {
+	clientID string
+	sdk      string
+	at       time.Time
+}
+
+type decryption struct {
+	sdk string
+	at  time.Time
+}
+
+// DeliveryTracker records when clients send messages and when other clients decrypt them, across the whole test
+// run. It is safe to use concurrently.
+type DeliveryTracker struct {
+	mu sync.Mutex
+	// event ID => who sent it and when
+	sent map[string]sentMessage
+	// event ID => client ID => when it was first decrypted. Decryptions can be seen before the sender knows the
+	// event ID, so they are kept even if the event was not sent by a tracked client.
+	decrypted map[string]map[string]decryption
+}
+
+// NewDeliveryTracker creates an empty DeliveryTracker.
+func NewDeliveryTracker() *DeliveryTracker {
+	return &DeliveryTracker{
+		sent:      make(map[string]sentMessage),
+		decrypted: make(map[string]map[string]decryption),
+	}
+}
+
+// Sent records that a client started sending the event at the given time.
+func (d *DeliveryTracker) Sent(clientID, sdk, eventID string, at time.Time) {
+	if eventID == "" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sent[eventID] = sentMessage{clientID: clientID, sdk: sdk, at: at}
+}
+
+// Decrypted records that a client decrypted the event at the given time. Events can be decrypted any number
+// of times, only the first time counts.
+func (d *DeliveryTracker) Decrypted(clientID, sdk, eventID string, at time.Time) {
+	if eventID == "" {
+		return // local echo
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	clients := d.decrypted[eventID]
+	if clients == nil {
+		clients = make(map[string]decryption)
+		d.decrypted[eventID] = clients
+	}
+	if prev, ok := clients[clientID]; ok && !prev.at.After(at) {
+		return
+	}
+	clients[clientID] = decryption{sdk: sdk, at: at}
+}
+
+// Histograms returns a histogram for each pair of SDKs which delivered at least one message, sorted by pair.
+// Decryptions by the sending client are ignored.
+func (d *DeliveryTracker) Histograms() []LatencyHistogram {
+	d.mu.Lock()
+	latencies := make(map[[2]string][]float64)
+	for eventID, sent := range d.sent {
+		for clientID, dec := range d.decrypted[eventID] {
+			if clientID == sent.clientID {
+				continue
+			}
+			pair := [2]string{sent.sdk, dec.sdk}
+			latencies[pair] = append(latencies[pair], toMs(max(dec.at.Sub(sent.at), 0)))
+		}
+	}
+	d.mu.Unlock()
+	histograms := make([]LatencyHistogram, 0, len(latencies))
+	for pair, ls := range latencies {
+		histograms = append(histograms, newLatencyHistogram(pair[0], pair[1], ls))
+	}
+	sort.Slice(histograms, func(i, j int) bool {
+		return histograms[i].Pair() < histograms[j].Pair()
+	})
+	return histograms
+}
+
+// WriteJSON writes the histograms to the given path.
+func (d *DeliveryTracker) WriteJSON(path string) error {
+	data, err := json.MarshalIndent(struct {
+		BucketsMs  []float64          `json:"buckets_ms"`
+		Histograms []LatencyHistogram `json:"histograms"`
+	}{
+		BucketsMs:  LatencyBucketsMs,
+		Histograms: d.Histograms(),
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal latency histograms: %s", err)
+	}
+	return writeFile(path, data)
+}
+
+// FormatHistograms renders the histograms as text, for printing at the end of a test run.
+func FormatHistograms(histograms []LatencyHistogram) string {
+	var sb strings.Builder
+	sb.WriteString("Message delivery latency (send to decrypt):\n")
+	if len(histograms) == 0 {
+		sb.WriteString("  no messages were delivered\n")
+		return sb.String()
+	}
+	for _, h := range histograms {
+		fmt.Fprintf(&sb, "  %s: %d messages, p50 %.0fms, p95 %.0fms, max %.0fms\n",
+			h.Pair(), h.Count, h.P50LatencyMs, h.P95LatencyMs, h.MaxLatencyMs)
+		for i, n := range h.Buckets {
+			label := "> " + formatMs(LatencyBucketsMs[len(LatencyBucketsMs)-1])
+			if i < len(LatencyBucketsMs) {
+				label = "<= " + formatMs(LatencyBucketsMs[i])
+			}
+			// scale bars to at most 40 characters
+			bar := n * 40 / h.Count
+			if n > 0 && bar == 0 {
+				bar = 1
+			}
+			fmt.Fprintf(&sb, "    %9s | %-40s %d\n", label, strings.Repeat("#", bar), n)
+		}
+	}
+	return sb.String()
+}
+
+func formatMs(ms float64) string {
+	if ms >= 1000 {
+		return fmt.Sprintf("%gs", ms/1000)
+	}
+	return fmt.Sprintf("%gms", ms)
+}
@@ -0,0 +1,126 @@
+// Package report collects benchmark results and per-test decryption statistics, so they can be compared
+// between SDKs and over time.
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Result is the outcome of running a single benchmark for a pair of SDKs.
+type Result struct {
+	// The full name of the benchmark e.g BenchmarkTimelineDecryption/rust|js
+	Name string `json:"name"`
+	// The SDK sending messages e.g "rust"
+	SenderSDK string `json:"sender_sdk"`
+	// The SDK receiving and decrypting messages e.g "js"
+	ReceiverSDK string `json:"receiver_sdk"`
+	// The number of messages sent in each iteration.
+	NumMessages int `json:"num_messages"`
+	// The number of iterations run, which is b.N
+	Iterations int `json:"iterations"`
+	// The time taken for each iteration, in milliseconds.
+	LatenciesMs []float64 `json:"latencies_ms"`
+	// Derived from LatenciesMs.
+	MeanLatencyMs float64 `json:"mean_latency_ms"`
+	P50LatencyMs  float64 `json:"p50_latency_ms"`
+	MaxLatencyMs  float64 `json:"max_latency_ms"`
+	// The number of messages decrypted per second, over all iterations.
+	MessagesPerSecond float64 `json:"messages_per_second"`
+}
+
+// NewResult calculates a Result from the latency of each iteration.
+func NewResult(name, senderSDK, receiverSDK string, numMessages int, latencies []time.Duration) Result {
+	r := Result{
+		Name:        name,
+		SenderSDK:   senderSDK,
+		ReceiverSDK: receiverSDK,
+		NumMessages: numMessages,
+		Iterations:  len(latencies),
+		LatenciesMs: make([]float64, len(latencies)),
+	}
+	if len(latencies) == 0 {
+		return r
+	}
+	var total time.Duration
+	for i, l := range latencies {
+		total += l
+		r.LatenciesMs[i] = toMs(l)
+	}
+	sorted := make([]float64, len(r.LatenciesMs))
+	copy(sorted, r.LatenciesMs)
+	sort.Float64s(sorted)
+	r.MeanLatencyMs = toMs(total) / float64(len(latencies))
+	r.P50LatencyMs = sorted[len(sorted)/2]
+	r.MaxLatencyMs = sorted[len(sorted)-1]
+	r.MessagesPerSecond = float64(numMessages*len(latencies)) / total.Seconds()
+	return r
+}
+
+func toMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Report is a collection of benchmark results. It is safe to use concurrently.
+type Report struct {
+	path    string
+	mu      sync.Mutex
+	results []Result
+}
+
+// New creates a report which is written as JSON to the given path. If the path is empty, results are
+// collected but never written.
+func New(path string) *Report {
+	return &Report{
+		path: path,
+	}
+}
+
+// Add a result to the report. The report file is rewritten after every result so it is complete even if
+// a later benchmark fails, as the test binary exits without giving us a chance to write it at the end.
+func (r *Report) Add(result Result) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.results = append(r.results, result)
+	if r.path == "" {
+		return nil
+	}
+	return r.write()
+}
+
+// Results returns a copy of all the results added so far, in the order they were added.
+func (r *Report) Results() []Result {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	results := make([]Result, len(r.results))
+	copy(results, r.results)
+	return results
+}
+
+func (r *Report) write() error {
+	data, err := json.MarshalIndent(struct {
+		Results []Result `json:"results"`
+	}{
+		Results: r.results,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal report: %s", err)
+	}
+	return writeFile(r.path, data)
+}
+
+// writeFile writes to a temp file then renames it, so the file is never half written.
+func writeFile(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write report: %s", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to write report: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package report
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewResult(t *testing.T) {
+	r := NewResult("BenchmarkX", "rust", "js", 10, []time.Duration{
+		300 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond,
+	})
+	if r.Iterations != 3 {
+		t.Errorf("Iterations: got %d want 3", r.Iterations)
+	}
+	if r.MeanLatencyMs != 200 {
+		t.Errorf("MeanLatencyMs: got %v want 200", r.MeanLatencyMs)
+	}
+	if r.P50LatencyMs != 200 {
+		t.Errorf("P50LatencyMs: got %v want 200", r.P50LatencyMs)
+	}
+	if r.MaxLatencyMs != 300 {
+		t.Errorf("MaxLatencyMs: got %v want 300", r.MaxLatencyMs)
+	}
+	// 30 messages in 600ms
+	if r.MessagesPerSecond != 50 {
+		t.Errorf("MessagesPerSecond: got %v want 50", r.MessagesPerSecond)
+	}
+	// latencies are kept in iteration order
+	if r.LatenciesMs[0] != 300 {
+		t.Errorf("LatenciesMs: got %v want first latency 300", r.LatenciesMs)
+	}
+}
+
+func TestReportWritesJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+	rep := New(path)
+	for _, name := range []string{"first", "second"} {
+		if err := rep.Add(NewResult(name, "rust", "rust", 1, []time.Duration{time.Second})); err != nil {
+			t.Fatalf("Add: %s", err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read report: %s", err)
+	}
+	var got struct {
+		Results []Result `json:"results"`
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("failed to unmarshal report: %s", err)
+	}
+	if len(got.Results) != 2 || got.Results[0].Name != "first" || got.Results[1].Name != "second" {
+		t.Errorf("wrong results in report: %+v", got.Results)
+	}
+}
+
+func TestDecryptionTracker(t *testing.T) {
+	var d DecryptionTracker
+	// decrypted straight away
+	d.Observe("alice", "$a", false)
+	// UTD, then decrypted on retry, seen many times
+	d.Observe("alice", "$b", true)
+	d.Observe("alice", "$b", true)
+	d.Observe("alice", "$b", false)
+	d.Observe("alice", "$b", false)
+	// UTD forever, and counted separately for each client
+	d.Observe("alice", "$c", true)
+	d.Observe("bob", "$c", true)
+	// local echoes are ignored
+	d.Observe("alice", "", true)
+	utdEvents, retried := d.Counts()
+	if utdEvents != 3 {
+		t.Errorf("UTD events: got %d want 3", utdEvents)
+	}
+	if retried != 1 {
+		t.Errorf("retried decryptions: got %d want 1", retried)
+	}
+}
+
+func TestTestReportWritesHTMLAndJSON(t *testing.T) {
+	dir := t.TempDir()
+	rep := NewTestReport(filepath.Join(dir, "report.html"))
+	for _, stats := range []TestStats{
+		{Name: "TestFirst", Outcome: "pass", KeyShares: 2},
+		{Name: "TestSecond<script>", Outcome: "fail", UTDEvents: 1},
+	} {
+		if err := rep.Add(stats); err != nil {
+			t.Fatalf("Add: %s", err)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "report.json"))
+	if err != nil {
+		t.Fatalf("failed to read JSON report: %s", err)
+	}
+	var got struct {
+		Tests []TestStats `json:"tests"`
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("failed to unmarshal report: %s", err)
+	}
+	if len(got.Tests) != 2 || got.Tests[0].KeyShares != 2 || got.Tests[1].UTDEvents != 1 {
+		t.Errorf("wrong tests in report: %+v", got.Tests)
+	}
+	html, err := os.ReadFile(filepath.Join(dir, "report.html"))
+	if err != nil {
+		t.Fatalf("failed to read HTML report: %s", err)
+	}
+	for _, want := range []string{"1 passed, 1 failed", "TestFirst", "TestSecond&lt;script&gt;"} {
+		if !strings.Contains(string(html), want) {
+			t.Errorf("HTML report does not contain %q", want)
+		}
+	}
+}
+
+func TestDeliveryTracker(t *testing.T) {
+	d := NewDeliveryTracker()
+	start := time.Now()
+	// bob decrypts before alice's SendMessage returns, so is seen first
+	d.Decrypted("bob|B", "js", "$a", start.Add(200*time.Millisecond))
+	d.Sent("alice|A", "rust", "$a", start)
+	// only the first decryption counts
+	d.Decrypted("bob|B", "js", "$a", start.Add(time.Minute))
+	// the sender decrypting its own message is ignored
+	d.Decrypted("alice|A", "rust", "$a", start.Add(time.Millisecond))
+	d.Decrypted("charlie|C", "rust", "$a", start.Add(3*time.Second))
+	// never decrypted
+	d.Sent("alice|A", "rust", "$b", start)
+	// not sent by a tracked client
+	d.Decrypted("bob|B", "js", "$c", start)
+
+	got := d.Histograms()
+	if len(got) != 2 {
+		t.Fatalf("Histograms: got %+v want 2 histograms", got)
+	}
+	if got[0].Pair() != "rust -> js" || got[1].Pair() != "rust -> rust" {
+		t.Fatalf("Histograms: got pairs %s, %s", got[0].Pair(), got[1].Pair())
+	}
+	if got[0].Count != 1 || got[0].MaxLatencyMs != 200 || got[0].Buckets[1] != 1 {
+		t.Errorf("rust -> js: got %+v want a single 200ms latency", got[0])
+	}
+	if got[1].Count != 1 || got[1].MaxLatencyMs != 3000 || got[1].Buckets[5] != 1 {
+		t.Errorf("rust -> rust: got %+v want a single 3s latency", got[1])
+	}
+	if !strings.Contains(FormatHistograms(got), "rust -> js: 1 messages") {
+		t.Errorf("FormatHistograms: missing pair:\n%s", FormatHistograms(got))
+	}
+}
+
+func TestLatencyHistogramPercentiles(t *testing.T) {
+	latencies := make([]float64, 100)
+	for i := range latencies {
+		latencies[i] = float64(100 - i) // 100ms down to 1ms
+	}
+	latencies[0] = 60000
+	h := newLatencyHistogram("js", "rust", latencies)
+	if h.P50LatencyMs != 50 {
+		t.Errorf("P50LatencyMs: got %v want 50", h.P50LatencyMs)
+	}
+	if h.P95LatencyMs != 95 {
+		t.Errorf("P95LatencyMs: got %v want 95", h.P95LatencyMs)
+	}
+	if h.MaxLatencyMs != 60000 {
+		t.Errorf("MaxLatencyMs: got %v want 60000", h.MaxLatencyMs)
+	}
+	if h.Buckets[0] != 99 || h.Buckets[len(h.Buckets)-1] != 1 {
+		t.Errorf("Buckets: got %v", h.Buckets)
+	}
+}
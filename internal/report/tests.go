@@ -0,0 +1,175 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// TestStats are statistics about decryption for a single test, giving more insight into how SDKs behave
+// than whether the test passed.
+type TestStats struct {
+	// The full name of the test e.g TestAliceBobEncryptionWorks/rust|js
+	Name string `json:"name"`
+	// One of "pass", "fail" or "skip".
+	Outcome    string  `json:"outcome"`
+	DurationMs float64 `json:"duration_ms"`
+	// The number of events test clients saw as unable to decrypt (UTD). Each client counts separately.
+	UTDEvents int `json:"utd_events"`
+	// The number of UTD events which were later decrypted, e.g because the room key arrived late.
+	RetriedDecryptions int `json:"retried_decryptions"`
+	// The number of encrypted to-device messages sent via mitmproxy, which are mostly room keys.
+	KeyShares int `json:"key_shares"`
+}
+
+// DecryptionTracker counts the events which clients could not decrypt, and how many of those were later
+// decrypted. It is safe to use concurrently.
+type DecryptionTracker struct {
+	mu sync.Mutex
+	// the key is the client and event ID, the value is true whilst the event is undecryptable
+	utds    map[string]bool
+	retried int
+}
+
+// Observe that a client saw an event. Events can be observed any number of times.
+func (d *DecryptionTracker) Observe(clientID, eventID string, failedToDecrypt bool) {
+	if eventID == "" {
+		return // local echo
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.utds == nil {
+		d.utds = make(map[string]bool)
+	}
+	key := clientID + "|" + eventID
+	stillUTD, seenUTD := d.utds[key]
+	if failedToDecrypt {
+		if !seenUTD {
+			d.utds[key] = true
+		}
+		return
+	}
+	if stillUTD {
+		d.utds[key] = false
+		d.retried++
+	}
+}
+
+// Counts returns the number of events which were seen as UTD, and how many of those were later decrypted.
+func (d *DecryptionTracker) Counts() (utdEvents, retriedDecryptions int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.utds), d.retried
+}
+
+// TestReport is a collection of per-test statistics, written as HTML and JSON. It is safe to use concurrently.
+type TestReport struct {
+	htmlPath string
+	jsonPath string
+	mu       sync.Mutex
+	tests    []TestStats
+}
+
+// NewTestReport creates a report which is written as HTML to the given path, and as JSON to the same path
+// with a .json extension e.g report.html and report.json.
+func NewTestReport(path string) *TestReport {
+	return &TestReport{
+		htmlPath: path,
+		jsonPath: strings.TrimSuffix(path, filepath.Ext(path)) + ".json",
+	}
+}
+
+// Add the statistics for a test to the report. As with Report, the report files are rewritten after every
+// test so they are complete even if the test binary exits early e.g due to a timeout.
+func (r *TestReport) Add(stats TestStats) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tests = append(r.tests, stats)
+	data, err := json.MarshalIndent(struct {
+		Tests []TestStats `json:"tests"`
+	}{
+		Tests: r.tests,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal report: %s", err)
+	}
+	if err = writeFile(r.jsonPath, data); err != nil {
+		return err
+	}
+	var html bytes.Buffer
+	if err = testReportTemplate.Execute(&html, newTestReportSummary(r.tests)); err != nil {
+		return fmt.Errorf("failed to render report: %s", err)
+	}
+	return writeFile(r.htmlPath, html.Bytes())
+}
+
+// Tests returns a copy of all the statistics added so far, in the order they were added.
+func (r *TestReport) Tests() []TestStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tests := make([]TestStats, len(r.tests))
+	copy(tests, r.tests)
+	return tests
+}
+
+type testReportSummary struct {
+	Tests                                    []TestStats
+	Passed, Failed, Skipped                  int
+	UTDEvents, RetriedDecryptions, KeyShares int
+	TestsWithUTDs                            int
+}
+
+func newTestReportSummary(tests []TestStats) testReportSummary {
+	s := testReportSummary{
+		Tests: tests,
+	}
+	for _, test := range tests {
+		switch test.Outcome {
+		case "pass":
+			s.Passed++
+		case "fail":
+			s.Failed++
+		case "skip":
+			s.Skipped++
+		}
+		s.UTDEvents += test.UTDEvents
+		s.RetriedDecryptions += test.RetriedDecryptions
+		s.KeyShares += test.KeyShares
+		if test.UTDEvents > test.RetriedDecryptions {
+			s.TestsWithUTDs++
+		}
+	}
+	return s
+}
+
+var testReportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Complement-Crypto test report</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+tr.fail { background: #fdd; }
+tr.skip { color: #888; }
+td.utd { background: #fec; }
+</style>
+</head>
+<body>
+<h1>Complement-Crypto test report</h1>
+<p>{{.Passed}} passed, {{.Failed}} failed, {{.Skipped}} skipped.
+{{.UTDEvents}} undecryptable events, of which {{.RetriedDecryptions}} were later decrypted.
+{{.TestsWithUTDs}} tests ended with undecryptable events. {{.KeyShares}} encrypted to-device messages were sent.</p>
+<table>
+<tr><th>Test</th><th>Outcome</th><th>Duration (ms)</th><th>UTD events</th><th>Retried decryptions</th><th>Key shares</th></tr>
+{{range .Tests}}<tr class="{{.Outcome}}"><td>{{.Name}}</td><td>{{.Outcome}}</td><td>{{printf "%.0f" .DurationMs}}</td><td{{if gt .UTDEvents .RetriedDecryptions}} class="utd"{{end}}>{{.UTDEvents}}</td><td>{{.RetriedDecryptions}}</td><td>{{.KeyShares}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
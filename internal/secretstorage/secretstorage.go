@@ -0,0 +1,161 @@
+// Package secretstorage encrypts and decrypts secrets in secret storage with the m.secret_storage.v1.aes-hmac-sha2
+// algorithm from the Matrix spec. See https://spec.matrix.org/v1.11/client-server-api/#secret-storage
+//
+// SDKs which can unlock secret storage but cannot store arbitrary secrets use this to read and write secrets in
+// account data directly.
+package secretstorage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// Algorithm is the only secret storage algorithm in the spec.
+	Algorithm = "m.secret_storage.v1.aes-hmac-sha2"
+	// DefaultKeyEventType is the account data event type which holds the ID of the default key.
+	DefaultKeyEventType = "m.secret_storage.default_key"
+	// the bitcoin base58 alphabet, used to encode recovery keys
+	base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+	keyLen         = 32
+)
+
+// recoveryKeyPrefix is prepended to the key before it is encoded as a recovery key.
+var recoveryKeyPrefix = []byte{0x8b, 0x01}
+
+// EncryptedSecret is a secret encrypted with one key, as stored in the "encrypted" map of the secret's account
+// data event keyed on the key ID.
+type EncryptedSecret struct {
+	IV         string `json:"iv"`
+	Ciphertext string `json:"ciphertext"`
+	MAC        string `json:"mac"`
+}
+
+// DecodeRecoveryKey returns the secret storage key encoded in the recovery key e.g "EsTc 5rr1 ...". Returns an
+// error if the recovery key is malformed.
+func DecodeRecoveryKey(recoveryKey string) ([]byte, error) {
+	decoded, err := decodeBase58(strings.Join(strings.Fields(recoveryKey), ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) != len(recoveryKeyPrefix)+keyLen+1 {
+		return nil, fmt.Errorf("recovery key has the wrong length: %d bytes", len(decoded))
+	}
+	var parity byte
+	for _, b := range decoded {
+		parity ^= b
+	}
+	if parity != 0 {
+		return nil, fmt.Errorf("recovery key has the wrong parity")
+	}
+	if decoded[0] != recoveryKeyPrefix[0] || decoded[1] != recoveryKeyPrefix[1] {
+		return nil, fmt.Errorf("recovery key has the wrong prefix")
+	}
+	return decoded[len(recoveryKeyPrefix) : len(recoveryKeyPrefix)+keyLen], nil
+}
+
+// Encrypt encrypts the secret, which will be stored under the given name e.g "m.cross_signing.master".
+func Encrypt(key []byte, name, secret string) (*EncryptedSecret, error) {
+	var iv [16]byte
+	if _, err := rand.Read(iv[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate IV: %s", err)
+	}
+	// bit 63 of the IV is cleared so the counter can be incremented without overflowing into the nonce on some platforms
+	iv[8] &= 0x7f
+	aesKey, macKey, err := deriveKeys(key, name)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := make([]byte, len(secret))
+	cipher.NewCTR(block, iv[:]).XORKeyStream(ciphertext, []byte(secret))
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(ciphertext)
+	return &EncryptedSecret{
+		IV:         base64.StdEncoding.EncodeToString(iv[:]),
+		Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+		MAC:        base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+	}, nil
+}
+
+// Decrypt decrypts the secret stored under the given name. Returns an error if the secret is malformed or was not
+// encrypted with this key.
+func Decrypt(key []byte, name string, encrypted EncryptedSecret) (string, error) {
+	iv, err := decodeBase64(encrypted.IV)
+	if err != nil {
+		return "", fmt.Errorf("invalid iv: %s", err)
+	}
+	if len(iv) != 16 {
+		return "", fmt.Errorf("invalid iv: %d bytes", len(iv))
+	}
+	ciphertext, err := decodeBase64(encrypted.Ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("invalid ciphertext: %s", err)
+	}
+	gotMAC, err := decodeBase64(encrypted.MAC)
+	if err != nil {
+		return "", fmt.Errorf("invalid mac: %s", err)
+	}
+	aesKey, macKey, err := deriveKeys(key, name)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(ciphertext)
+	if !hmac.Equal(mac.Sum(nil), gotMAC) {
+		return "", fmt.Errorf("MAC mismatch: wrong key or corrupted secret")
+	}
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCTR(block, iv).XORKeyStream(plaintext, ciphertext)
+	return string(plaintext), nil
+}
+
+// deriveKeys returns the AES-256 key and HMAC-SHA-256 key for the secret with this name.
+func deriveKeys(key []byte, name string) (aesKey, macKey []byte, err error) {
+	keys := make([]byte, 64)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, make([]byte, 32), []byte(name)), keys); err != nil {
+		return nil, nil, fmt.Errorf("failed to derive keys: %s", err)
+	}
+	return keys[:32], keys[32:], nil
+}
+
+// decodeBase64 accepts padded and unpadded base64, as SDKs differ.
+func decodeBase64(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func decodeBase58(s string) ([]byte, error) {
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	for _, r := range s {
+		i := strings.IndexRune(base58Alphabet, r)
+		if i < 0 {
+			return nil, fmt.Errorf("recovery key contains an invalid character %q", r)
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(i)))
+	}
+	// each leading '1' is a leading zero byte
+	var leadingZeros int
+	for leadingZeros < len(s) && s[leadingZeros] == base58Alphabet[0] {
+		leadingZeros++
+	}
+	return append(make([]byte, leadingZeros), n.Bytes()...), nil
+}
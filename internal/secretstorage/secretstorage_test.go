@@ -0,0 +1,90 @@
+package secretstorage
+
+import (
+	"bytes"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement/must"
+)
+
+// encodeRecoveryKey is the inverse of DecodeRecoveryKey, as SDKs format recovery keys.
+func encodeRecoveryKey(key []byte) string {
+	b := append(append([]byte{}, recoveryKeyPrefix...), key...)
+	var parity byte
+	for _, x := range b {
+		parity ^= x
+	}
+	b = append(b, parity)
+	n := new(big.Int).SetBytes(b)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+	var encoded []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		encoded = append([]byte{base58Alphabet[mod.Int64()]}, encoded...)
+	}
+	var spaced []string
+	for len(encoded) > 0 {
+		i := min(4, len(encoded))
+		spaced = append(spaced, string(encoded[:i]))
+		encoded = encoded[i:]
+	}
+	return strings.Join(spaced, " ")
+}
+
+func TestDecodeRecoveryKey(t *testing.T) {
+	key := bytes.Repeat([]byte{0xab}, keyLen)
+	recoveryKey := encodeRecoveryKey(key)
+	got, err := DecodeRecoveryKey(recoveryKey)
+	must.NotError(t, "DecodeRecoveryKey", err)
+	must.Equal(t, bytes.Equal(got, key), true, "decoded the wrong key")
+
+	// whitespace is ignored
+	got, err = DecodeRecoveryKey(strings.ReplaceAll(recoveryKey, " ", ""))
+	must.NotError(t, "DecodeRecoveryKey without spaces", err)
+	must.Equal(t, bytes.Equal(got, key), true, "decoded the wrong key without spaces")
+
+	// flip the last character, which breaks the parity
+	last := recoveryKey[len(recoveryKey)-1]
+	flipped := base58Alphabet[(strings.IndexByte(base58Alphabet, last)+1)%len(base58Alphabet)]
+	if _, err := DecodeRecoveryKey(recoveryKey[:len(recoveryKey)-1] + string(flipped)); err == nil {
+		t.Errorf("DecodeRecoveryKey: expected an error for a corrupted recovery key")
+	}
+	if _, err := DecodeRecoveryKey("not a recovery key 0OIl"); err == nil {
+		t.Errorf("DecodeRecoveryKey: expected an error for invalid characters")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{0x01}, keyLen)
+	encrypted, err := Encrypt(key, "org.example.secret", "hunter2")
+	must.NotError(t, "Encrypt", err)
+	got, err := Decrypt(key, "org.example.secret", *encrypted)
+	must.NotError(t, "Decrypt", err)
+	must.Equal(t, got, "hunter2", "decrypted the wrong secret")
+
+	// unpadded base64 is accepted
+	unpadded := EncryptedSecret{
+		IV:         strings.TrimRight(encrypted.IV, "="),
+		Ciphertext: strings.TrimRight(encrypted.Ciphertext, "="),
+		MAC:        strings.TrimRight(encrypted.MAC, "="),
+	}
+	got, err = Decrypt(key, "org.example.secret", unpadded)
+	must.NotError(t, "Decrypt unpadded", err)
+	must.Equal(t, got, "hunter2", "decrypted the wrong secret from unpadded base64")
+}
+
+func TestDecryptFailsWithWrongKeyOrName(t *testing.T) {
+	key := bytes.Repeat([]byte{0x01}, keyLen)
+	encrypted, err := Encrypt(key, "org.example.secret", "hunter2")
+	must.NotError(t, "Encrypt", err)
+	if _, err := Decrypt(bytes.Repeat([]byte{0x02}, keyLen), "org.example.secret", *encrypted); err == nil {
+		t.Errorf("Decrypt: expected an error with the wrong key")
+	}
+	// the name is bound to the secret, so secrets cannot be swapped
+	if _, err := Decrypt(key, "org.example.other", *encrypted); err == nil {
+		t.Errorf("Decrypt: expected an error with the wrong name")
+	}
+}
@@ -4,6 +4,7 @@
 package tests
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -20,6 +21,7 @@ import (
 	"github.com/matrix-org/complement-crypto/internal/deploy/rpc"
 	"github.com/matrix-org/complement/b"
 	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
 	"github.com/matrix-org/complement/helpers"
 	"github.com/matrix-org/complement/must"
 )
@@ -42,7 +44,7 @@ func Deploy(t *testing.T) *deploy.ComplementCryptoDeployment {
 	if err != nil {
 		t.Fatalf("failed to get wd: %s", err)
 	}
-	ssDeployment = deploy.RunNewDeployment(t, filepath.Join(wd, "../../tests/mitmproxy_addons"), "")
+	ssDeployment = deploy.RunNewDeployment(t, 2, filepath.Join(wd, "../../tests/mitmproxy_addons"), "")
 	return ssDeployment
 }
 
@@ -194,6 +196,95 @@ func TestCanWaitUntilEventInRoomBeforeRoomIsKnown(t *testing.T) {
 	})
 }
 
+// Test that WaitUntilEventInRoomWithOpts only passes matching events to the checker.
+func TestWaitUntilEventInRoomWithOpts(t *testing.T) {
+	deployment := Deploy(t)
+	ForEachClient(t, "", deployment, func(t *testing.T, client api.TestClient, csapi *client.CSAPI) {
+		must.NotError(t, "Failed to login", client.Login(t, client.Opts()))
+		// the room will have lots of state events in it, which should be ignored.
+		roomID := csapi.MustCreateRoom(t, map[string]interface{}{})
+		stopSyncing := client.MustStartSyncing(t)
+		defer stopSyncing()
+		var mu sync.Mutex
+		var seen []api.Event
+		waiter := client.WaitUntilEventInRoomWithOpts(t, roomID, api.TimelineListenerOpts{
+			EventTypes:       []string{"m.room.message"},
+			IgnoreMembership: true,
+		}, func(e api.Event) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			seen = append(seen, e)
+			return true
+		})
+		csapi.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "Test Message",
+			},
+		})
+		waiter.Waitf(t, 5*time.Second, "client did not see message")
+		mu.Lock()
+		defer mu.Unlock()
+		for _, ev := range seen {
+			must.Equal(t, ev.Type, "m.room.message", "checker was called with an event of the wrong type")
+			must.Equal(t, ev.Membership, "", "checker was called with a membership event")
+		}
+	})
+}
+
+func TestClientSyncMonitor(t *testing.T) {
+	deployment := Deploy(t)
+	ForEachClient(t, "", deployment, func(t *testing.T, client api.TestClient, csapi *client.CSAPI) {
+		must.NotError(t, "Failed to login", client.Login(t, client.Opts()))
+		// RPC clients cannot report their sync state
+		cancel, err := client.ListenForSyncStates(t, func(s api.SyncState) {})
+		if err != nil {
+			t.Skipf("ListenForSyncStates: %s", err)
+		}
+		cancel()
+		// make the monitor before syncing to ensure it sees the client start syncing
+		monitor := api.NewClientSyncMonitor(t, client)
+		defer monitor.Close()
+		stopSyncing := client.MustStartSyncing(t)
+		defer stopSyncing()
+		monitor.MustBecomeSyncing(t)
+		monitor.MustNotError(t)
+
+		roomID := csapi.MustCreateRoom(t, map[string]interface{}{})
+		waiter := monitor.WrapWaiter(client.WaitUntilEventInRoom(t, roomID, api.CheckEventHasMembership(csapi.UserID, "join")))
+		waiter.Waitf(t, 5*time.Second, "client did not see own join")
+		monitor.MustNotError(t)
+	})
+}
+
+func TestBackupStates(t *testing.T) {
+	deployment := Deploy(t)
+	ForEachClient(t, "", deployment, func(t *testing.T, client api.TestClient, csapi *client.CSAPI) {
+		must.NotError(t, "Failed to login", client.Login(t, client.Opts()))
+		ctx, cancel := context.WithCancel(context.Background())
+		states, err := client.ListenForBackupStates(t, ctx)
+		if err != nil {
+			cancel()
+			t.Skipf("ListenForBackupStates: %s", err)
+		}
+		// the current state is sent immediately
+		select {
+		case s := <-states:
+			must.Equal(t, s, api.BackupStateDisabled, "initial backup state")
+		case <-time.After(5 * time.Second):
+			ct.Fatalf(t, "ListenForBackupStates did not send the current state")
+		}
+		cancel()
+
+		waiter := client.WaitUntilBackupState(t, api.BackupStateEnabled)
+		stopSyncing := client.MustStartSyncing(t)
+		defer stopSyncing()
+		client.MustBackupKeys(t)
+		waiter.Waitf(t, 5*time.Second, "client did not enable backups")
+	})
+}
+
 func TestSendingEvents(t *testing.T) {
 	deployment := Deploy(t)
 	ForEachClient(t, "", deployment, func(t *testing.T, client api.TestClient, csapi *client.CSAPI) {
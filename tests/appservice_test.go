@@ -0,0 +1,59 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+)
+
+// Test that room keys are shared with every device of a user puppeted by an appservice, as happens with bridges.
+// The puppet is registered by an appservice on hs3 and logs in 3 devices, all of which must decrypt Alice's message.
+func TestCanShareKeysWithAppservicePuppetDevices(t *testing.T) {
+	Instance().ForEachClientType(t, func(t *testing.T, clientType api.ClientType) {
+		if clientType.Lang == api.ClientTypeNio {
+			t.Skipf("nio clients cannot be created from an existing access token")
+		}
+		tc := Instance().CreateTestContext(t, clientType)
+		hs3 := tc.Deployment.NewAppserviceHomeserver(t)
+		puppet := hs3.Appservice.MustRegisterPuppet(t, "bob")
+		puppetDevices := []*cc.ClientCreationRequest{}
+		for i := 0; i < 3; i++ {
+			device := puppet
+			if i > 0 {
+				device = hs3.Appservice.MustLoginPuppet(t, puppet.UserID, fmt.Sprintf("PUPPET_%d", i))
+			}
+			puppetDevices = append(puppetDevices, &cc.ClientCreationRequest{
+				User: &cc.User{
+					CSAPI: device,
+					ClientType: api.ClientType{
+						Lang: clientType.Lang,
+						HS:   hs3.ServerName,
+					},
+				},
+				Opts: api.ClientCreationOpts{
+					AccessToken: device.AccessToken,
+				},
+			})
+		}
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, cc.EncRoomOptions.Invite([]string{puppet.UserID}))
+		puppet.MustJoinRoom(t, roomID, []string{"hs1"})
+
+		tc.WithClientsSyncing(t, puppetDevices, func(puppetClients []api.TestClient) {
+			tc.WithAliceSyncing(t, func(alice api.TestClient) {
+				wantMsgBody := "Hello bridged bob"
+				waiters := make([]api.Waiter, len(puppetClients))
+				for i, puppetClient := range puppetClients {
+					waiters[i] = puppetClient.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+				}
+				evID := alice.MustSendMessage(t, roomID, wantMsgBody)
+				for i, waiter := range waiters {
+					t.Logf("puppet device %s (%s) waiting for event %s", puppetDevices[i].User.DeviceID, puppetClients[i].Type(), evID)
+					waiter.Waitf(t, 5*time.Second, "puppet device %s did not see alice's message", puppetDevices[i].User.DeviceID)
+				}
+			})
+		})
+	})
+}
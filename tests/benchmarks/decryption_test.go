@@ -0,0 +1,77 @@
+package benchmarks_test
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement-crypto/internal/report"
+)
+
+// The number of messages Alice sends in each iteration of BenchmarkTimelineDecryption.
+const numMessagesPerIteration = 20
+
+// Measure how long it takes for N messages sent by Alice to appear decrypted in Bob's timeline. This includes
+// encrypting, sending and syncing the messages, so is only meaningful when compared against other runs on the
+// same machine.
+func BenchmarkTimelineDecryption(b *testing.B) {
+	for _, clientTypes := range benchmarkConfig.TestClientMatrix {
+		clientTypeA, clientTypeB := clientTypes[0], clientTypes[1]
+		b.Run(fmt.Sprintf("%s|%s", clientTypeA, clientTypeB), func(b *testing.B) {
+			tc := Instance().CreateTestContext(b, clientTypeA, clientTypeB)
+			roomID := tc.CreateNewEncryptedRoom(
+				b,
+				tc.Alice,
+				cc.EncRoomOptions.PresetTrustedPrivateChat(),
+				cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+			)
+			tc.Bob.MustJoinRoom(b, roomID, []string{clientTypeA.HS})
+			tc.WithAliceAndBobSyncing(b, func(alice, bob api.TestClient) {
+				// make sure room keys have been shared before we start timing
+				waiter := bob.WaitUntilEventInRoom(b, roomID, api.CheckEventHasBody("warm up"))
+				alice.MustSendMessage(b, roomID, "warm up")
+				waiter.Waitf(b, 5*time.Second, "bob did not decrypt alice's warm up message")
+
+				latencies := make([]time.Duration, 0, b.N)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					prefix := fmt.Sprintf("iteration %d message ", i)
+					start := time.Now()
+					waiter := bob.WaitUntilEventInRoom(b, roomID, checkDecryptedAllWithPrefix(prefix, numMessagesPerIteration))
+					for j := 0; j < numMessagesPerIteration; j++ {
+						alice.MustSendMessage(b, roomID, fmt.Sprintf("%s%d", prefix, j))
+					}
+					waiter.Waitf(b, 30*time.Second, "bob did not decrypt all of alice's messages in iteration %d", i)
+					latencies = append(latencies, time.Since(start))
+				}
+				b.StopTimer()
+
+				result := report.NewResult(b.Name(), string(clientTypeA.Lang), string(clientTypeB.Lang), numMessagesPerIteration, latencies)
+				b.ReportMetric(result.MessagesPerSecond, "msgs/s")
+				if err := benchmarkReport.Add(result); err != nil {
+					b.Errorf("failed to add result to report: %s", err)
+				}
+			})
+		})
+	}
+}
+
+// checkDecryptedAllWithPrefix returns a checker which returns true once `num` distinct decrypted events
+// with a body starting with `prefix` have been seen.
+func checkDecryptedAllWithPrefix(prefix string, num int) func(e api.Event) bool {
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	return func(e api.Event) bool {
+		if e.FailedToDecrypt || !strings.HasPrefix(e.Text, prefix) {
+			return false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		seen[e.Text] = true
+		return len(seen) >= num
+	}
+}
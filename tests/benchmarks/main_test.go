@@ -0,0 +1,30 @@
+package benchmarks_test
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement-crypto/internal/config"
+	"github.com/matrix-org/complement-crypto/internal/report"
+)
+
+// globals to ensure we are always referring to the same set of HSes/proxies between benchmarks
+var (
+	instance        *cc.Instance
+	benchmarkConfig *config.ComplementCrypto
+	benchmarkReport *report.Report
+)
+
+// Main entry point when users run `go test -bench .`. Defined in https://pkg.go.dev/testing#hdr-Main
+func TestMain(m *testing.M) {
+	benchmarkConfig = config.NewComplementCryptoConfigFromEnvVars("../mitmproxy_addons")
+	benchmarkReport = report.New(benchmarkConfig.BenchmarkReport)
+	instance = cc.NewInstance(benchmarkConfig)
+	instance.TestMain(m, "benchmarks")
+}
+
+// Instance returns the test instance. Guaranteed to be non-nil if called in a benchmark,
+// because TestMain would have been called before the benchmark runs.
+func Instance() *cc.Instance {
+	return instance
+}
@@ -0,0 +1,37 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement-crypto/internal/deploy/callback"
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+)
+
+// Test that sending two messages to a new device claims one-time keys once, and sends the room key before
+// either message.
+func TestSendingMessagesClaimsKeysOnce(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, cc.EncRoomOptions.PresetTrustedPrivateChat(), cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}))
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			proxyLog := recordProxyLog(t, tc, mitm.FilterParams{
+				AccessToken: alice.CurrentAccessToken(t),
+			}, func() {
+				for _, body := range []string{"first message", "second message"} {
+					waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(body))
+					alice.MustSendMessage(t, roomID, body)
+					waiter.Waitf(t, 5*time.Second, "bob did not see alice's message '%s'", body)
+				}
+			})
+			callback.NewChoreography().
+				Expect("POST", "/keys/claim", 1, 1).
+				Expect("PUT", "/sendToDevice/m.room.encrypted", 1, callback.Unbounded).
+				Expect("PUT", "/send/m.room.encrypted", 2, 2).
+				MustMatch(t, proxyLog)
+		})
+	})
+}
@@ -0,0 +1,54 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that clearing the cache of a client does not cause previously decryptable messages
+// to become undecryptable. This is a common user action e.g "Clear cache and reload".
+// Clearing the cache drops all events and the sync token but keeps the crypto store, so Bob
+// must be able to decrypt the messages again after backpaginating.
+func TestClearCacheKeepsMessagesDecryptable(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, cc.EncRoomOptions.PresetTrustedPrivateChat(), cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}))
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			var eventIDs []string
+			for i := 0; i < 3; i++ {
+				body := fmt.Sprintf("Before clearing cache %d", i)
+				waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(body))
+				eventIDs = append(eventIDs, alice.MustSendMessage(t, roomID, body))
+				waiter.Waitf(t, 5*time.Second, "bob did not see message '%s'", body)
+			}
+
+			bob.MustClearCacheAndRestart(t)
+
+			// bob should re-sync the room from scratch. Ensure we can see all the old messages.
+			bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasEventID(eventIDs[len(eventIDs)-1])).Waitf(
+				t, 5*time.Second, "bob did not see latest event after clearing cache",
+			)
+			bob.MustBackpaginate(t, roomID, 10)
+			for i, eventID := range eventIDs {
+				bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasEventID(eventID)).Waitf(
+					t, 5*time.Second, "bob did not see event %s after clearing cache", eventID,
+				)
+				ev := bob.MustGetEvent(t, roomID, eventID)
+				must.Equal(t, ev.FailedToDecrypt, false, "bob failed to decrypt event after clearing cache")
+				must.Equal(t, ev.Text, fmt.Sprintf("Before clearing cache %d", i), "bob saw the wrong text after clearing cache")
+			}
+
+			// the crypto store should still work for new messages too.
+			body := "After clearing cache"
+			waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(body))
+			alice.MustSendMessage(t, roomID, body)
+			waiter.Waitf(t, 5*time.Second, "bob did not see message sent after clearing cache")
+		})
+	})
+}
@@ -0,0 +1,69 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement-crypto/internal/deploy"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that clients can exchange encrypted messages via a homeserver whose clock is wrong, so every event has an
+// origin_server_ts far in the future or the past.
+func TestEncryptionWorksWithSkewedHomeserverClock(t *testing.T) {
+	libfaketimePath := Instance().LibfaketimePath(t)
+	for _, skew := range []time.Duration{time.Hour, -time.Hour} {
+		skew := skew
+		t.Run(skew.String(), func(t *testing.T) {
+			// the homeserver is shared by every client permutation, as it is slow to start
+			hs := Instance().Deploy(t).NewHomeserverWithClockSkew(t, skew, libfaketimePath)
+			Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+				tc := Instance().CreateTestContext(t)
+				if clientTypeA.Lang == api.ClientTypeRust || clientTypeB.Lang == api.ClientTypeRust {
+					tc.Deployment.RequireCapabilities(t, hs.ServerName, deploy.CapabilitySlidingSync)
+				}
+				alice := registerOnHomeserver(t, hs, clientTypeA.Lang, "alice")
+				bob := registerOnHomeserver(t, hs, clientTypeB.Lang, "bob")
+				roomID := tc.CreateNewEncryptedRoom(t, alice,
+					cc.EncRoomOptions.PresetTrustedPrivateChat(),
+					cc.EncRoomOptions.Invite([]string{bob.UserID}),
+				)
+				bob.MustJoinRoom(t, roomID, []string{hs.ServerName})
+				tc.WithClientsSyncing(t, []*cc.ClientCreationRequest{{User: alice}, {User: bob}}, func(clients []api.TestClient) {
+					aliceClient, bobClient := clients[0], clients[1]
+					wantMsgBody := "Sent with a skewed clock"
+					waiter := bobClient.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+					evID := aliceClient.MustSendMessage(t, roomID, wantMsgBody)
+
+					res := alice.MustDo(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "event", evID})
+					originServerTS := time.UnixMilli(must.ParseJSON(t, res.Body).Get("origin_server_ts").Int())
+					if gotSkew := time.Until(originServerTS); (gotSkew - skew).Abs() > time.Minute {
+						ct.Fatalf(t, "origin_server_ts %v is skewed by %v, want %v: is libfaketime working?", originServerTS, gotSkew, skew)
+					}
+
+					waiter.Waitf(t, 5*time.Second, "bob did not see alice's message sent with a skewed clock")
+					ev := bobClient.MustGetEvent(t, roomID, evID)
+					must.Equal(t, ev.FailedToDecrypt, false, "bob failed to decrypt alice's message")
+				})
+			})
+		})
+	}
+}
+
+func registerOnHomeserver(t *testing.T, hs *deploy.Homeserver, lang api.ClientTypeLang, localpartSuffix string) *cc.User {
+	t.Helper()
+	return &cc.User{
+		CSAPI: hs.Register(t, helpers.RegistrationOpts{
+			LocalpartSuffix: localpartSuffix,
+			Password:        "complement-crypto-password",
+		}),
+		ClientType: api.ClientType{
+			Lang: lang,
+			HS:   hs.ServerName,
+		},
+	}
+}
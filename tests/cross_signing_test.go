@@ -0,0 +1,102 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that resetting cross-signing replaces Alice's identity, and that Bob sees the new identity. Bob never
+// verified Alice, so her device is still unverified to him.
+func TestResetCrossSigningCreatesNewIdentity(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		if clientTypeA.Lang == api.ClientTypeNio || clientTypeB.Lang == api.ClientTypeNio {
+			t.Skipf("nio does not support cross-signing")
+			return
+		}
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			aliceDeviceID := alice.Opts().DeviceID
+			oldMasterKey := masterKeyOf(t, tc.Bob, tc.Alice.UserID)
+
+			alice.MustResetCrossSigning(t, func() string {
+				return tc.Alice.Password
+			})
+
+			// the keys are uploaded before ResetCrossSigning returns, so Bob sees them immediately.
+			newMasterKey := masterKeyOf(t, tc.Bob, tc.Alice.UserID)
+			if newMasterKey == "" {
+				ct.Fatalf(t, "alice has no master key after resetting cross-signing")
+			}
+			if newMasterKey == oldMasterKey {
+				ct.Fatalf(t, "alice's master key did not change after resetting cross-signing")
+			}
+
+			must.Equal(t, alice.MustGetDeviceTrust(t, tc.Alice.UserID, aliceDeviceID), api.TrustLevelVerified,
+				"alice's device was not verified by her new identity")
+			// Bob may still be downloading Alice's new keys, so this waits until he knows about her device.
+			cc.MustSeeDeviceTrust(t, bob, tc.Alice.UserID, aliceDeviceID, api.TrustLevelUnverified)
+		})
+	})
+}
+
+// Test that bootstrapping cross-signing uploads a master, self-signing and user-signing key, and that
+// bootstrapping again does not replace them.
+func TestBootstrapCrossSigningUploadsKeys(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		if clientTypeA.Lang == api.ClientTypeNio || clientTypeB.Lang == api.ClientTypeNio {
+			t.Skipf("nio does not support cross-signing")
+			return
+		}
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			aliceDeviceID := alice.Opts().DeviceID
+			authCallback := func() string {
+				return tc.Alice.Password
+			}
+			alice.MustBootstrapCrossSigning(t, authCallback)
+			masterKey := mustHaveCrossSigningKeys(t, tc.Alice)
+			must.Equal(t, alice.MustGetDeviceTrust(t, tc.Alice.UserID, aliceDeviceID), api.TrustLevelVerified,
+				"alice's device was not verified by her identity after bootstrapping cross-signing")
+
+			// cross-signing is already set up on this device, so this should do nothing.
+			alice.MustBootstrapCrossSigning(t, authCallback)
+			must.Equal(t, mustHaveCrossSigningKeys(t, tc.Alice), masterKey, "alice's master key changed after bootstrapping twice")
+
+			must.Equal(t, masterKeyOf(t, tc.Bob, tc.Alice.UserID), masterKey, "bob sees a different master key for alice")
+			cc.MustSeeDeviceTrust(t, bob, tc.Alice.UserID, aliceDeviceID, api.TrustLevelUnverified)
+		})
+	})
+}
+
+// mustHaveCrossSigningKeys fails the test if the server does not have a master, self-signing and user-signing key
+// for the user, returning the master key. The user queries their own keys as user-signing keys are only returned
+// to the user themselves.
+func mustHaveCrossSigningKeys(t *testing.T, user *cc.User) (masterKey string) {
+	t.Helper()
+	keys := user.MustQueryKeys(t, user.UserID)
+	for keyType, key := range map[string]*cc.CrossSigningKey{
+		"master key":       keys.MasterKey,
+		"self-signing key": keys.SelfSigningKey,
+		"user-signing key": keys.UserSigningKey,
+	} {
+		if key == nil || len(key.Keys) == 0 {
+			ct.Fatalf(t, "%s has no %s on the server: %+v", user.UserID, keyType, keys)
+		}
+	}
+	return keys.MasterKey.Keys[keys.MasterKey.KeyID()]
+}
+
+// masterKeyOf returns the master cross-signing key of the user, as seen by the querier, or the empty string
+// if the user has no master key.
+func masterKeyOf(t *testing.T, querier *cc.User, userID string) string {
+	t.Helper()
+	masterKey := querier.MustQueryKeys(t, userID).MasterKey
+	if masterKey == nil {
+		return ""
+	}
+	return masterKey.Keys[masterKey.KeyID()]
+}
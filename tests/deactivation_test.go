@@ -0,0 +1,60 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that deactivating Bob's account makes Alice rotate the room key without sharing it with any of Bob's
+// devices, and that Bob loses access to his key backup.
+func TestDeactivatedUserIsExcludedFromRoomKeys(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(
+			t,
+			tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID, tc.Charlie.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+		tc.Charlie.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+		backupVersion, err := tc.Bob.CreateKeyBackup(t)
+		must.NotError(t, "failed to create key backup", err)
+		t.Logf("bob created key backup version %s", backupVersion)
+
+		bob := tc.MustLoginClient(t, &cc.ClientCreationRequest{
+			User: tc.Bob,
+		})
+		defer bob.Close(t)
+		bobStopSyncing := bob.MustStartSyncing(t)
+		tc.WithClientSyncing(t, &cc.ClientCreationRequest{
+			User: tc.Charlie,
+		}, func(charlie api.TestClient) {
+			tc.WithAliceSyncing(t, func(alice api.TestClient) {
+				wantMsgBody := "Before deactivation"
+				bobWaiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+				charlieWaiter := charlie.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+				firstEventID := alice.MustSendMessage(t, roomID, wantMsgBody)
+				bobWaiter.Waitf(t, 5*time.Second, "bob did not see alice's message")
+				charlieWaiter.Waitf(t, 5*time.Second, "charlie did not see alice's message")
+
+				// Bob stops syncing first, as his access token is about to stop working
+				bobStopSyncing()
+				tc.Bob.MustDeactivate(t)
+				alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasMembership(tc.Bob.UserID, "leave")).Waitf(
+					t, 5*time.Second, "alice did not see bob leave the room",
+				)
+
+				wantMsgBody = "After deactivation"
+				charlieWaiter = charlie.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+				tc.MustSendMessageExcludingUser(t, alice, tc.Bob, roomID, firstEventID, wantMsgBody)
+				charlieWaiter.Waitf(t, 5*time.Second, "charlie did not see alice's message after bob was deactivated")
+			})
+		})
+		tc.MustHaveInaccessibleKeyBackup(t, tc.Bob)
+	})
+}
@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that an undecryptable event becomes decrypted in the timeline when decryption is retried after the room
+// key arrives late, here by importing it. Retrying before the key arrives must leave the event undecryptable.
+func TestRetryDecryptionAfterLateRoomKeys(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, cc.EncRoomOptions.PresetPublicChat())
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			body := "Before Bob joins"
+			waiter := alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(body))
+			evID := alice.MustSendMessage(t, roomID, body)
+			waiter.Waitf(t, 5*time.Second, "alice did not see own message")
+
+			tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+			bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasMembership(bob.UserID(), "join")).Waitf(t, 5*time.Second, "bob did not see own join")
+			ev := cc.MustBackpaginateToEvent(t, bob, roomID, evID)
+			must.Equal(t, ev.FailedToDecrypt, true, "bob decrypted a message from before he joined")
+
+			if err := bob.RetryDecryption(t, roomID, nil); err != nil {
+				if errors.Is(err, api.ErrNotSupported) {
+					t.Skipf("%s cannot retry decryption: %s", clientTypeB.Lang, err)
+				}
+				ct.Fatalf(t, "RetryDecryption: %s", err)
+			}
+			bob.MustRemainUndecryptable(t, roomID, evID, time.Second)
+
+			retried := bob.WaitUntilDecryptionRetried(t, roomID, evID)
+			export, err := alice.ExportRoomKeys(t, roomKeyExportPassphrase)
+			if err != nil {
+				if errors.Is(err, api.ErrNotSupported) {
+					t.Skipf("%s cannot export room keys: %s", clientTypeA.Lang, err)
+				}
+				ct.Fatalf(t, "ExportRoomKeys: %s", err)
+			}
+			if err := bob.ImportRoomKeys(t, export, roomKeyExportPassphrase); err != nil {
+				if errors.Is(err, api.ErrNotSupported) {
+					t.Skipf("%s cannot import room keys: %s", clientTypeB.Lang, err)
+				}
+				ct.Fatalf(t, "ImportRoomKeys: %s", err)
+			}
+			// not every client exposes the session ID, in which case every undecryptable event is retried
+			var sessionIDs []string
+			if ev.SessionID != "" {
+				sessionIDs = []string{ev.SessionID}
+			}
+			if err := bob.RetryDecryption(t, roomID, sessionIDs); err != nil {
+				ct.Fatalf(t, "RetryDecryption: %s", err)
+			}
+			retried.Waitf(t, 5*time.Second, "bob did not decrypt alice's message after retrying decryption")
+			must.Equal(t, bob.MustGetEvent(t, roomID, evID).Text, body, "bob decrypted the wrong body")
+		})
+	})
+}
@@ -0,0 +1,50 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+)
+
+// Test that room keys sent to a dehydrated device (MSC3814) whilst Alice was logged out can be used after she
+// logs in on a new device and rehydrates it.
+func TestCanDecryptMessagesSentToDehydratedDevice(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+
+		var recoveryKey string
+		tc.WithAliceSyncing(t, func(alice api.TestClient) {
+			recoveryKey = alice.MustBackupKeys(t)
+			if err := alice.CreateDehydratedDevice(t); err != nil {
+				if errors.Is(err, api.ErrNotSupported) || strings.Contains(err.Error(), "MSC3814") {
+					t.Skipf("dehydrated devices unsupported: %s", err)
+				}
+				ct.Fatalf(t, "CreateDehydratedDevice: %s", err)
+			}
+		})
+		// Alice logs out of her only real device
+		tc.Alice.MustDo(t, "POST", []string{"_matrix", "client", "v3", "logout"}, client.WithJSONBody(t, map[string]any{}))
+
+		var eventIDs []string
+		tc.WithClientSyncing(t, &cc.ClientCreationRequest{
+			User: tc.Bob,
+		}, func(bob api.TestClient) {
+			for i := 0; i < 3; i++ {
+				eventIDs = append(eventIDs, bob.MustSendMessage(t, roomID, fmt.Sprintf("Message for dehydrated device %d", i)))
+			}
+		})
+
+		tc.MustDecryptAfterRehydration(t, tc.Alice, recoveryKey, roomID, eventIDs)
+	})
+}
@@ -1,15 +1,22 @@
 package tests
 
 import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
 	"net/http"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/matrix-org/complement-crypto/internal/api"
 	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement-crypto/internal/deploy"
 	"github.com/matrix-org/complement-crypto/internal/deploy/callback"
 	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+	"github.com/matrix-org/complement/ct"
 	"github.com/matrix-org/complement/must"
 )
 
@@ -59,3 +66,145 @@ func TestFailedDeviceKeyDownloadRetries(t *testing.T) {
 		must.Equal(t, queryReceived.Load(), true, "No request to /keys/query was received!")
 	})
 }
+
+// Test that a message sent by one of Alice's devices can be decrypted by her 2 other devices, each of which has
+// its own store.
+func TestCanDecryptMessagesFromOwnDevices(t *testing.T) {
+	Instance().ForEachClientType(t, func(t *testing.T, clientType api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientType)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, cc.EncRoomOptions.PresetPrivateChat())
+
+		devices := tc.MustLoginDevices(t, tc.Alice, 3, api.ClientCreationOpts{})
+		for _, device := range devices {
+			defer device.Close(t)
+		}
+		tc.MustWaitForDeviceKeys(t, tc.Alice, devices)
+		for _, device := range devices {
+			stopSyncing := device.MustStartSyncing(t)
+			defer stopSyncing()
+		}
+
+		wantMsgBody := "Hello from my first device"
+		waiters := make([]api.Waiter, len(devices)-1)
+		for i, device := range devices[1:] {
+			waiters[i] = device.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+		}
+		devices[0].MustSendMessage(t, roomID, wantMsgBody)
+		for i, waiter := range waiters {
+			waiter.Waitf(t, 5*time.Second, "device %d did not decrypt the message", i+1)
+		}
+	})
+}
+
+// Test that clients do not accept device keys which have been replaced by a malicious homeserver.
+//
+// A homeserver can return any keys it likes from /keys/query, so it could try to read messages by replacing
+// the identity keys of a device with its own. Clients pin the ed25519 key of a device when they first see
+// it, so once Alice knows Bob's real keys she must not encrypt for re-signed spoofed keys.
+func TestSpoofedDeviceKeysAreRejected(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(
+			t,
+			tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			// Alice learns Bob's real device keys when sending her first message.
+			waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody("before spoofing"))
+			alice.MustSendMessage(t, roomID, "before spoofing")
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's message before spoofing")
+			bobDeviceID := bob.Opts().DeviceID
+			// not every client can report trust in other devices, in which case only the keys are checked
+			trustBefore, err := alice.GetDeviceTrust(t, tc.Bob.UserID, bobDeviceID)
+			checkTrust := !errors.Is(err, api.ErrNotSupported)
+			if checkTrust {
+				must.NotError(t, "GetDeviceTrust", err)
+			}
+
+			swap, err := callback.NewDeviceKeySwap(tc.Bob.UserID, bobDeviceID)
+			must.NotError(t, "failed to make device key swap", err)
+			var sharedWithSpoofedKey atomic.Bool
+			swapKeys := swap.Callback()
+			tc.Deployment.MITM().Configure(t).WithIntercept(mitm.InterceptOpts{
+				Filter: mitm.FilterParams{
+					AccessToken: alice.CurrentAccessToken(t),
+				},
+				ResponseCallback: func(cd callback.Data) *callback.Response {
+					if strings.Contains(cd.URL, "/keys/query") {
+						return swapKeys(cd)
+					}
+					if strings.Contains(cd.URL, "/sendToDevice/m.room.encrypted/") && strings.Contains(string(cd.RequestBody), swap.SpoofedCurve25519) {
+						sharedWithSpoofedKey.Store(true)
+					}
+					return nil
+				},
+			}, func() {
+				// When Bob logs in a new device, Alice queries his keys again and gets the spoofed keys.
+				bob2 := tc.MustLoginClient(t, &cc.ClientCreationRequest{
+					User: tc.Bob,
+					Opts: api.ClientCreationOpts{
+						DeviceID: "SPOOF_TRIGGER",
+					},
+				})
+				defer bob2.Close(t)
+				for start := time.Now(); swap.Swapped() == 0; time.Sleep(100 * time.Millisecond) {
+					if time.Since(start) > 10*time.Second {
+						ct.Fatalf(t, "alice did not query bob's device keys after he logged in a new device")
+					}
+				}
+
+				// Then Alice still encrypts for Bob's real device.
+				waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody("after spoofing"))
+				alice.MustSendMessage(t, roomID, "after spoofing")
+				waiter.Waitf(t, 5*time.Second, "bob did not see alice's message after spoofing, did alice accept the spoofed keys?")
+			})
+
+			// And nothing was encrypted for the spoofed device, which is still known to Alice with its real keys.
+			must.Equal(t, sharedWithSpoofedKey.Load(), false, "alice encrypted a to-device message for the spoofed curve25519 key")
+			if checkTrust {
+				must.Equal(t, alice.MustGetDeviceTrust(t, tc.Bob.UserID, bobDeviceID), trustBefore, "trust in bob's device changed after spoofing")
+			}
+		})
+	})
+}
+
+// Test that clients do not encrypt for devices whose keys have been tampered with by a malicious homeserver.
+// Unlike TestSpoofedDeviceKeysAreRejected, the homeserver does not re-sign the keys, so the device's
+// self-signature is invalid the first time Alice sees it and the device must be ignored.
+func TestDeviceKeysWithInvalidSignaturesAreIgnored(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, cc.EncRoomOptions.PresetTrustedPrivateChat())
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			bobDeviceID := bob.Opts().DeviceID
+			curveKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+			must.NotError(t, "failed to generate curve25519 key", err)
+			tamperedCurveKey := base64.RawStdEncoding.EncodeToString(curveKey.PublicKey().Bytes())
+
+			body := "Encrypted for tampered device keys"
+			rewritten := tc.Deployment.WithResponseRewrite(t, deploy.ResponseRewriteSpec{
+				Endpoint:    "/keys/query",
+				AccessToken: alice.CurrentAccessToken(t),
+				Pointer:     mitm.JSONPointer("device_keys", tc.Bob.UserID, bobDeviceID, "keys", "curve25519:"+bobDeviceID),
+				Value:       tamperedCurveKey,
+			}, func() {
+				// Alice only queries Bob's keys once he is in the room
+				tc.Alice.MustInviteRoom(t, roomID, tc.Bob.UserID)
+				tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+				alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasMembership(tc.Bob.UserID, "join")).Waitf(t, 5*time.Second, "alice did not see bob's join")
+
+				evID := alice.MustSendMessage(t, roomID, body)
+				bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasEventID(evID)).Waitf(t, 5*time.Second, "bob did not see alice's message")
+				// give the room key time to arrive, in case Alice did share it
+				time.Sleep(time.Second)
+				ev := bob.MustGetEvent(t, roomID, evID)
+				must.Equal(t, ev.FailedToDecrypt, true, "bob decrypted a message, so alice encrypted for his tampered device keys")
+			})
+			must.Equal(t, rewritten > 0, true, "alice never queried bob's device keys")
+		})
+	})
+}
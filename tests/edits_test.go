@@ -0,0 +1,55 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that edits are encrypted with the sender's current megolm session, not the session of the original message.
+// Charlie leaves between the two edits so Alice has to rotate her session.
+func TestEditsAreEncryptedWithCurrentSession(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		if clientTypeA.Lang == api.ClientTypeNio {
+			t.Skipf("nio cannot edit messages")
+		}
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(
+			t,
+			tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID, tc.Charlie.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+		tc.Charlie.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			wantMsgBody := "Original message"
+			waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+			eventID := alice.MustSendMessage(t, roomID, wantMsgBody)
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's message")
+			originalSessionID := tc.Bob.MustGetMegolmSessionID(t, roomID, eventID)
+
+			firstEdit := "First edit"
+			waiter = bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasEdit(eventID, firstEdit))
+			_, sessionID := tc.MustEditMessage(t, alice, tc.Bob, roomID, eventID, firstEdit)
+			must.Equal(t, sessionID, originalSessionID, "edit was not encrypted with the current session")
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's first edit")
+
+			tc.Charlie.MustLeaveRoom(t, roomID)
+			alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasMembership(tc.Charlie.UserID, "leave")).Waitf(
+				t, 5*time.Second, "alice did not see charlie leave the room",
+			)
+
+			secondEdit := "Second edit"
+			waiter = bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasEdit(eventID, secondEdit))
+			_, sessionID = tc.MustEditMessage(t, alice, tc.Bob, roomID, eventID, secondEdit)
+			must.NotEqual(t, sessionID, originalSessionID, "edit was encrypted with the session from before charlie left")
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's second edit")
+			cc.MustDecryptEditedMessage(t, bob, roomID, eventID, secondEdit)
+		})
+	})
+}
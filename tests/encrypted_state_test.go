@@ -0,0 +1,54 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that state events are encrypted in rooms with MSC3414 enabled, and can be decrypted by other members.
+// SDKs which do not support MSC3414 send state in the clear, so this test is skipped for them.
+func TestEncryptedStateEvents(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+			cc.EncRoomOptions.EncryptStateEvents(),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			topic := "An encrypted topic"
+			waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasTopic(topic))
+			eventID, err := alice.SetRoomTopic(t, roomID, topic)
+			if err != nil {
+				if errors.Is(err, api.ErrNotSupported) {
+					t.Skipf("%s cannot set the room topic: %s", clientTypeA.Lang, err)
+				}
+				ct.Fatalf(t, "SetRoomTopic: %s", err)
+			}
+
+			res := tc.Bob.MustDo(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "event", eventID})
+			sent := must.ParseJSON(t, res.Body)
+			if sent.Get("type").Str != "m.room.encrypted" {
+				t.Skipf("%s does not support MSC3414, sent topic as %s", clientTypeA.Lang, sent.Get("type").Str)
+			}
+			must.Equal(t, sent.Get("state_key").Str, "m.room.topic:", "encrypted topic has the wrong state key")
+			must.Equal(t, sent.Get("content.topic").Exists(), false, "encrypted topic leaked the topic")
+
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's topic")
+			ev := bob.MustGetEvent(t, roomID, eventID)
+			must.Equal(t, ev.FailedToDecrypt, false, "bob failed to decrypt alice's topic")
+			must.Equal(t, ev.Type, "m.room.topic", "decrypted topic has the wrong type")
+			if ev.StateKey == nil {
+				ct.Fatalf(t, "decrypted topic has no state key")
+			}
+			must.Equal(t, *ev.StateKey, "", "decrypted topic has the wrong state key")
+		})
+	})
+}
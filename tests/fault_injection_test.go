@@ -0,0 +1,113 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement-crypto/internal/deploy"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that room keys still arrive if Alice's first /sendToDevice request is dropped. Clients may either retry
+// sending the room key or fail to send the message, in which case it is resent.
+func TestRoomKeysArriveAfterDroppedToDeviceRequest(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			body := "Message after dropped to-device request"
+			waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(body))
+			var sendErr error
+			dropped := tc.Deployment.WithFaultInjection(t, deploy.FaultSpec{
+				Endpoint:    "/sendToDevice",
+				AccessToken: alice.CurrentAccessToken(t),
+				DropRate:    1,
+				MaxDrops:    1,
+			}, func() {
+				_, sendErr = alice.SendMessage(t, roomID, body)
+			})
+			must.Equal(t, dropped, 1, "did not drop alice's /sendToDevice request")
+			if sendErr != nil {
+				t.Logf("alice failed to send message with dropped /sendToDevice request, resending: %s", sendErr)
+				alice.MustSendMessage(t, roomID, body)
+			}
+			waiter.Waitf(t, 10*time.Second, "bob did not see alice's message after dropped /sendToDevice request")
+		})
+	})
+}
+
+// Test that clients back off when rate limited on endpoints used to send room keys, and that
+// no room keys are lost as a result. Retried requests must honour the Retry-After.
+func TestRoomKeysArriveWhenRateLimited(t *testing.T) {
+	retryAfter := 2 * time.Second
+	checkRetryDelay := func(t *testing.T, endpoint string, limited int, retryDelay time.Duration) {
+		t.Helper()
+		must.Equal(t, limited, 1, "did not rate limit "+endpoint)
+		if retryDelay > 0 && retryDelay < retryAfter {
+			ct.Errorf(t, "%s was retried after %v, before the Retry-After of %v", endpoint, retryDelay, retryAfter)
+		}
+	}
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		t.Run("/keys/upload", func(t *testing.T) {
+			tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+			roomID := tc.CreateNewEncryptedRoom(t, tc.Alice,
+				cc.EncRoomOptions.PresetTrustedPrivateChat(),
+				cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+			)
+			tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+			body := "Message after rate limited /keys/upload"
+			limited, retryDelay := tc.Deployment.WithRateLimit(t, deploy.RateLimitSpec{
+				Endpoint:   "/keys/upload",
+				Method:     "POST",
+				Count:      1,
+				RetryAfter: retryAfter,
+			}, func() {
+				tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+					waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(body))
+					if _, err := alice.SendMessage(t, roomID, body); err != nil {
+						t.Logf("alice failed to send message with rate limited /keys/upload, resending: %s", err)
+						alice.MustSendMessage(t, roomID, body)
+					}
+					waiter.Waitf(t, 10*time.Second, "bob did not see alice's message after rate limited /keys/upload")
+				})
+			})
+			checkRetryDelay(t, "/keys/upload", limited, retryDelay)
+		})
+		for _, endpoint := range []string{"/keys/claim", "/sendToDevice"} {
+			t.Run(endpoint, func(t *testing.T) {
+				tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+				roomID := tc.CreateNewEncryptedRoom(t, tc.Alice,
+					cc.EncRoomOptions.PresetTrustedPrivateChat(),
+					cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+				)
+				tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+				tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+					body := "Message after rate limited " + endpoint
+					waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(body))
+					var sendErr error
+					limited, retryDelay := tc.Deployment.WithRateLimit(t, deploy.RateLimitSpec{
+						Endpoint:    endpoint,
+						AccessToken: alice.CurrentAccessToken(t),
+						Count:       1,
+						RetryAfter:  retryAfter,
+					}, func() {
+						_, sendErr = alice.SendMessage(t, roomID, body)
+						if sendErr != nil {
+							t.Logf("alice failed to send message with rate limited %s, resending: %s", endpoint, sendErr)
+							alice.MustSendMessage(t, roomID, body)
+						}
+						waiter.Waitf(t, 10*time.Second, "bob did not see alice's message after rate limited %s", endpoint)
+					})
+					checkRetryDelay(t, endpoint, limited, retryDelay)
+				})
+			})
+		}
+	})
+}
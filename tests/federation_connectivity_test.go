@@ -1,14 +1,25 @@
 package tests
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/matrix-org/complement-crypto/internal/api"
 	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement-crypto/internal/deploy"
+	"github.com/matrix-org/complement-crypto/internal/deploy/callback"
+	"github.com/matrix-org/complement/ct"
 	"github.com/matrix-org/complement/must"
 )
 
+// How long clients wait before retrying /keys/claim for an unreachable server, measured from when
+// the server comes back online.
+const clientKeysClaimBackoff = 33 * time.Second
+
 // A and B are in a room, on different servers.
 // B's server goes offline.
 // C joins the room (on A's server).
@@ -44,7 +55,8 @@ func TestNewUserCannotGetKeysForOfflineServer(t *testing.T) {
 			waiter.Waitf(t, 5*time.Second, "bob did not see alice's message '%s'", wantMsgBody)
 
 			// now bob's HS becomes unreachable
-			tc.Deployment.PauseServer(t, "hs2")
+			outage := tc.Deployment.FederationOutage(t, "hs2")
+			outage.Begin()
 
 			// C now joins the room
 			tc.Alice.MustInviteRoom(t, roomID, tc.Charlie.UserID)
@@ -64,27 +76,32 @@ func TestNewUserCannotGetKeysForOfflineServer(t *testing.T) {
 				waiter.Waitf(t, 5*time.Second, "alice did not see charlie's messages '%s'", wantUndecryptableMsgBody)
 
 				// now bob's server comes back online
-				tc.Deployment.UnpauseServer(t, "hs2")
+				outage.End()
+				endedAt := time.Now()
+
+				// we may need to kick hs1 into letting it know that hs2 is back, we do this by sending a typing notif
+				// in the room, which will send an EDU over federation which should inform hs1 that hs2 is back online.
+				tc.Bob.MustSendTyping(t, roomID, true, 1000)
+				ctx, cancel := context.WithTimeout(context.Background(), api.ScaleTimeout(api.FederationTimeout()))
+				defer cancel()
+				must.NotError(t, "federation with hs2 did not resume", outage.WaitUntilHealed(ctx))
 
-				// now we need to wait a bit for charlie's client to decide to hit /keys/claim again.
+				// now we need to wait for charlie's client to decide to hit /keys/claim again.
 				// If the client hits too often, there will be constantly send lag so long as bob's HS is offline.
 				// If the client hits too infrequently, there will be multiple undecryptable messages.
 				// See https://github.com/matrix-org/matrix-rust-sdk/issues/281 for why we want to backoff.
 				// See https://github.com/matrix-org/matrix-rust-sdk/issues/2804 for discussions on what the backoff should be.
-				t.Logf("sleeping until client timeout is ready...")
-				time.Sleep(10 * time.Second)
-				// we may need to kick hs1 into letting it know that hs2 is back, we do this by sending a typing notif
-				// in the room, whic will send an EDU over federation which should inform hs1 that hs2 is back online.
-				tc.Bob.MustSendTyping(t, roomID, true, 1000)
-				// wait the remaining client timeout time
-				time.Sleep(23 * time.Second)
+				if remaining := clientKeysClaimBackoff - time.Since(endedAt); remaining > 0 {
+					t.Logf("sleeping %v until client timeout is ready...", remaining)
+					time.Sleep(remaining)
+				}
 
 				// send another message, bob should be able to decrypt it.
 				wantMsgBody = "Bob can see this because his server is now back online"
 				waiter = bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
 				evID = charlie.MustSendMessage(t, roomID, wantMsgBody)
 				t.Logf("bob (%s) waiting for event %s", bob.Type(), evID)
-				waiter.Waitf(t, 7*time.Second, "bob did not see charlie's message '%s'", wantMsgBody)
+				waiter.Waitf(t, api.FederationTimeout(), "bob did not see charlie's message '%s'", wantMsgBody)
 
 				// make sure bob cannot decrypt the msg from when his server was offline
 				// TODO: this isn't ideal, see https://github.com/matrix-org/matrix-rust-sdk/issues/2864
@@ -137,7 +154,8 @@ func TestExistingSessionCannotGetKeysForOfflineServer(t *testing.T) {
 			waiter.Waitf(t, 5*time.Second, "bob did not see charlie's message: '%s'", wantMsgBody)
 
 			// now bob's HS becomes unreachable
-			tc.Deployment.PauseServer(t, "hs2")
+			outage := tc.Deployment.FederationOutage(t, "hs2")
+			outage.Begin()
 
 			// C now joins the room ab
 			tc.Alice.MustInviteRoom(t, roomIDab, tc.Charlie.UserID)
@@ -155,10 +173,74 @@ func TestExistingSessionCannotGetKeysForOfflineServer(t *testing.T) {
 			waiter.Waitf(t, 5*time.Second, "alice did not see charlie's message: '%s'", wantDecryptableMsgBody)
 
 			// now bob's server comes back online
-			tc.Deployment.UnpauseServer(t, "hs2")
+			outage.End()
+			ctx, cancel := context.WithTimeout(context.Background(), api.ScaleTimeout(api.FederationTimeout()))
+			defer cancel()
+			must.NotError(t, "federation with hs2 did not resume", outage.WaitUntilHealed(ctx))
 
 			waiter = bob.WaitUntilEventInRoom(t, roomIDab, api.CheckEventHasBody(wantDecryptableMsgBody))
-			waiter.Waitf(t, 10*time.Second, "bob did not see charlie's message: '%s'", wantDecryptableMsgBody) // longer time to allow for retries
+			waiter.Waitf(t, api.FederationTimeout(), "bob did not see charlie's message: '%s'", wantDecryptableMsgBody) // longer time to allow for retries
+		})
+	})
+}
+
+// Test that to-device messages are not lost when a federation transaction fails. A's server only retries the
+// transaction carrying the room key once B's server sends it something, so it stops backing off.
+func TestRoomKeysAreRetriedAfterFederationTransactionFails(t *testing.T) {
+	Instance().ForEachClientType(t, func(t *testing.T, clientType api.ClientType) {
+		tc := Instance().CreateTestContext(t, api.ClientType{
+			Lang: clientType.Lang,
+			HS:   "hs1",
+		}, api.ClientType{
+			Lang: clientType.Lang,
+			HS:   "hs2",
+		})
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}))
+		tc.Bob.MustJoinRoom(t, roomID, []string{"hs1"})
+
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			// let clients sync device keys
+			time.Sleep(time.Second)
+
+			var failedTxnID atomic.Pointer[string]
+			wantMsgBody := "Bob can see this after hs1 retries"
+			waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+			tc.Deployment.InterceptFederationTransactions(t, func(txn deploy.FederationTransaction) *callback.Response {
+				if txn.Destination != "hs2" || !txn.HasEDU("m.direct_to_device") {
+					return nil
+				}
+				if !failedTxnID.CompareAndSwap(nil, &txn.TxnID) {
+					return nil
+				}
+				t.Logf("failing transaction %s from %s to %s", txn.TxnID, txn.Origin, txn.Destination)
+				return &callback.Response{
+					RespondStatusCode: http.StatusBadGateway,
+					RespondBody:       json.RawMessage(`{}`),
+				}
+			}, func() {
+				evID := alice.MustSendMessage(t, roomID, wantMsgBody)
+				t.Logf("alice sent %s", evID)
+				start := time.Now()
+				for failedTxnID.Load() == nil {
+					if time.Since(start) > 5*time.Second {
+						ct.Fatalf(t, "hs1 did not send the room key to hs2")
+					}
+					time.Sleep(100 * time.Millisecond)
+				}
+			})
+
+			// hs1 is now backing off from hs2. Receiving a request from hs2 makes it stop backing off, so
+			// send typing notifications until bob sees the message.
+			for i := 0; ; i++ {
+				tc.Bob.MustSendTyping(t, roomID, true, 1000)
+				err := waiter.TryWaitf(t, time.Second, "bob did not see alice's message '%s'", wantMsgBody)
+				if err == nil {
+					break
+				}
+				if i >= 10 {
+					ct.Fatalf(t, "%s", err)
+				}
+			}
 		})
 	})
 }
@@ -0,0 +1,68 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement-crypto/internal/orchestrate"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that room keys are delivered across a federation of 3 homeservers, including to a server which
+// was partitioned from the others when the message was sent. Requires COMPLEMENT_CRYPTO_NUM_HOMESERVERS >= 3.
+func TestCanDecryptAcrossThreeHomeservers(t *testing.T) {
+	hsNames := Instance().RequireHomeservers(t, 3)
+	Instance().ForEachClientType(t, func(t *testing.T, clientType api.ClientType) {
+		tc := Instance().CreateTestContext(t, api.ClientType{
+			Lang: clientType.Lang,
+			HS:   hsNames[0],
+		}, api.ClientType{
+			Lang: clientType.Lang,
+			HS:   hsNames[1],
+		}, api.ClientType{
+			Lang: clientType.Lang,
+			HS:   hsNames[2],
+		})
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, cc.EncRoomOptions.Invite([]string{tc.Bob.UserID, tc.Charlie.UserID}))
+		tc.Bob.MustJoinRoom(t, roomID, []string{hsNames[0]})
+		tc.Charlie.MustJoinRoom(t, roomID, []string{hsNames[0]})
+
+		tc.WithAliceBobAndCharlieSyncing(t, func(alice, bob, charlie api.TestClient) {
+			// let clients sync device keys
+			time.Sleep(time.Second)
+
+			wantMsgBody := "Hello hs2 and hs3"
+			orchestrate.Run(t,
+				orchestrate.Step{Actor: alice, Action: orchestrate.SendMessage(roomID, wantMsgBody)},
+				orchestrate.Concurrently(
+					orchestrate.Step{Actor: bob, Expect: orchestrate.SeesDecrypted(roomID, wantMsgBody)},
+					orchestrate.Step{Actor: charlie, Expect: orchestrate.SeesDecrypted(roomID, wantMsgBody)},
+				),
+			)
+
+			// partition hs3 from the other homeservers
+			outage := tc.Deployment.FederationOutage(t, hsNames[2])
+			outage.Begin()
+
+			wantMsgBody = "Sent whilst hs3 is unreachable"
+			bobWaiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+			evID := alice.MustSendMessage(t, roomID, wantMsgBody)
+			t.Logf("bob (%s) waiting for event %s", bob.Type(), evID)
+			bobWaiter.Waitf(t, 5*time.Second, "bob did not see alice's message '%s'", wantMsgBody)
+
+			outage.End()
+			// let hs1 and hs2 know that hs3 is back by sending an EDU over federation
+			charlieWaiter := charlie.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+			tc.Charlie.MustSendTyping(t, roomID, true, 1000)
+			ctx, cancel := context.WithTimeout(context.Background(), api.ScaleTimeout(api.FederationTimeout()))
+			defer cancel()
+			must.NotError(t, "federation with hs3 did not resume", outage.WaitUntilHealed(ctx))
+
+			t.Logf("charlie (%s) waiting for event %s", charlie.Type(), evID)
+			charlieWaiter.Waitf(t, api.FederationTimeout(), "charlie did not see alice's message '%s' sent whilst hs3 was offline", wantMsgBody)
+		})
+	})
+}
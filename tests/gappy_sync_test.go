@@ -0,0 +1,102 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that rust and js agree on the ordering and decryption state of encrypted events
+// which were received via a gappy sync and then backpaginated. Ordering divergences
+// have previously masked or created phantom UTD reports.
+func TestGappySyncTimelinesAreConsistent(t *testing.T) {
+	if !Instance().ShouldTest(api.ClientTypeRust) || !Instance().ShouldTest(api.ClientTypeJS) {
+		t.Skipf("test requires both rust and js clients")
+	}
+	Instance().ForEachClientType(t, func(t *testing.T, clientType api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientType,
+			api.ClientType{Lang: api.ClientTypeRust, HS: "hs1"},
+			api.ClientType{Lang: api.ClientTypeJS, HS: "hs1"},
+		)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID, tc.Charlie.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientType.HS})
+		tc.Charlie.MustJoinRoom(t, roomID, []string{clientType.HS})
+		tc.WithAliceBobAndCharlieSyncing(t, func(alice, bob, charlie api.TestClient) {
+			receivers := []api.TestClient{bob, charlie}
+			// make sure everyone has the room open before the gap
+			body := "Before the gap"
+			var waiters []api.Waiter
+			for _, receiver := range receivers {
+				waiters = append(waiters, receiver.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(body)))
+			}
+			eventIDs := []string{alice.MustSendMessage(t, roomID, body)}
+			for i, w := range waiters {
+				w.Waitf(t, 5*time.Second, "%s did not see alice's message", receivers[i].UserID())
+			}
+
+			// send more messages than the sync timeline limit whilst the receivers aren't getting /sync responses.
+			tc.WithGappySync(t, receivers, func() {
+				for i := 0; i < 25; i++ {
+					eventIDs = append(eventIDs, alice.MustSendMessage(t, roomID, fmt.Sprintf("In the gap %d", i)))
+				}
+			})
+
+			// fill the gap
+			for _, receiver := range receivers {
+				receiver.WaitUntilEventInRoom(t, roomID, api.CheckEventHasEventID(eventIDs[len(eventIDs)-1])).Waitf(
+					t, 5*time.Second, "%s did not see the latest event after the gap", receiver.UserID(),
+				)
+				receiver.MustBackpaginate(t, roomID, 50)
+				receiver.WaitUntilEventInRoom(t, roomID, api.CheckEventHasEventID(eventIDs[1])).Waitf(
+					t, 5*time.Second, "%s did not see the first event in the gap after backpaginating", receiver.UserID(),
+				)
+			}
+
+			cc.MustHaveConsistentTimelines(t, roomID, eventIDs, bob, charlie)
+			for _, ev := range bob.MustGetTimeline(t, roomID) {
+				must.Equal(t, ev.FailedToDecrypt, false, fmt.Sprintf("bob failed to decrypt event %s", ev.ID))
+			}
+		})
+	})
+}
+
+// Test that room keys sent in a gap in the timeline are not lost. To-device messages are not limited like the
+// timeline is, so they must be processed from the limited /sync response even though the events they decrypt
+// are only seen by backpaginating.
+func TestRoomKeysAreNotLostInLimitedSync(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(
+			t,
+			tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			body := "In the gap"
+			var eventID string
+			floodEventIDs := tc.WithLimitedSync(t, bob, tc.Alice, roomID, func() {
+				eventID = alice.MustSendMessage(t, roomID, body)
+			})
+
+			bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasEventID(floodEventIDs[len(floodEventIDs)-1])).Waitf(
+				t, 10*time.Second, "bob did not see the end of the flood",
+			)
+			bob.MustBackpaginate(t, roomID, len(floodEventIDs)+5)
+			bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(body)).Waitf(
+				t, 5*time.Second, "bob did not decrypt alice's message in the gap after backpaginating",
+			)
+			ev := bob.MustGetEvent(t, roomID, eventID)
+			must.Equal(t, ev.FailedToDecrypt, false, "bob failed to decrypt alice's message in the gap")
+		})
+	})
+}
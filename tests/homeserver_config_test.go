@@ -0,0 +1,47 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement/helpers"
+)
+
+// Test that homeservers made for a single test can federate and exchange encrypted messages.
+func TestCanFederateWithHomeserverWithConfig(t *testing.T) {
+	Instance().ForEachClientType(t, func(t *testing.T, clientType api.ClientType) {
+		tc := Instance().CreateTestContext(t, api.ClientType{
+			Lang: clientType.Lang,
+			HS:   "hs1",
+		})
+		hs3 := tc.Deployment.NewHomeserverWithConfig(t, map[string]string{
+			"SYNAPSE_COMPLEMENT_DATABASE": "sqlite",
+		})
+		charlie := &cc.User{
+			CSAPI: hs3.Register(t, helpers.RegistrationOpts{
+				LocalpartSuffix: "charlie",
+				Password:        "complement-crypto-password",
+			}),
+			ClientType: api.ClientType{
+				Lang: clientType.Lang,
+				HS:   hs3.ServerName,
+			},
+		}
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, cc.EncRoomOptions.Invite([]string{charlie.UserID}))
+		charlie.MustJoinRoom(t, roomID, []string{"hs1"})
+
+		tc.WithAliceSyncing(t, func(alice api.TestClient) {
+			tc.WithClientSyncing(t, &cc.ClientCreationRequest{
+				User: charlie,
+			}, func(charlieClient api.TestClient) {
+				wantMsgBody := "Hello hs3"
+				waiter := charlieClient.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+				evID := alice.MustSendMessage(t, roomID, wantMsgBody)
+				t.Logf("charlie (%s) waiting for event %s", charlieClient.Type(), evID)
+				waiter.Waitf(t, 5*time.Second, "charlie did not see alice's message '%s'", wantMsgBody)
+			})
+		})
+	})
+}
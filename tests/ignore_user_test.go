@@ -0,0 +1,45 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement/ct"
+)
+
+// Test that clients do not share room keys with users they have ignored, and resume sharing once unignored.
+func TestIgnoredUserIsNotSentRoomKeys(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}))
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			// ignore bob before alice has shared any room keys with him, so he has nothing he can ratchet forward.
+			if err := alice.IgnoreUser(t, bob.UserID()); err != nil {
+				if errors.Is(err, api.ErrNotSupported) {
+					t.Skipf("ignoring users unsupported: %s", err)
+				}
+				ct.Fatalf(t, "IgnoreUser: %s", err)
+			}
+
+			waiter := bob.WaitUntilEventInRoom(t, roomID, func(e api.Event) bool {
+				return e.Sender == alice.UserID() && e.FailedToDecrypt
+			})
+			evID := alice.MustSendMessage(t, roomID, "Bob should not be able to read this")
+			t.Logf("bob (%s) waiting for undecryptable event %s", bob.Type(), evID)
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's undecryptable message %s", evID)
+			bob.MustRemainUndecryptable(t, roomID, evID, 3*time.Second)
+
+			alice.MustUnignoreUser(t, bob.UserID())
+			wantMsgBody := "Bob can read this"
+			waiter = bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+			evID = alice.MustSendMessage(t, roomID, wantMsgBody)
+			t.Logf("bob (%s) waiting for event %s", bob.Type(), evID)
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's message '%s' after being unignored", wantMsgBody)
+		})
+	})
+}
@@ -0,0 +1,63 @@
+package tests
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement-crypto/internal/deploy"
+	"github.com/matrix-org/complement/must"
+)
+
+// The directory intercept scripts are read from, see deploy.InterceptScript for the format.
+const interceptScriptsDir = "testdata/intercepts"
+
+// Run every intercept script in testdata/intercepts against a conversation between Alice and Bob, so network
+// scenarios can be added by writing YAML rather than Go. Scripts can refer to the users "alice" and "bob".
+// Alice and Bob must decrypt each other's messages whilst the script is applied, and again once it is removed.
+func TestInterceptScripts(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join(interceptScriptsDir, "*.yaml"))
+	must.NotError(t, "failed to list intercept scripts", err)
+	for _, path := range paths {
+		script, err := deploy.LoadInterceptScript(path)
+		must.NotError(t, "LoadInterceptScript", err)
+		name := strings.TrimSuffix(filepath.Base(path), ".yaml")
+		t.Run(name, func(t *testing.T) {
+			Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+				tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+				roomID := tc.CreateNewEncryptedRoom(t, tc.Alice,
+					cc.EncRoomOptions.PresetTrustedPrivateChat(),
+					cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+				)
+				tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+				tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+					accessTokens := map[string]string{
+						"alice": alice.CurrentAccessToken(t),
+						"bob":   bob.CurrentAccessToken(t),
+					}
+					tc.Deployment.WithInterceptScript(t, script, accessTokens, func() {
+						mustExchangeMessages(t, roomID, alice, bob, "whilst running "+name)
+					})
+					mustExchangeMessages(t, roomID, alice, bob, "after running "+name)
+				})
+			})
+		})
+	}
+}
+
+// mustExchangeMessages sends a message from each client to the other, failing the test unless both are
+// decrypted. Scripts may slow traffic down considerably, so this waits for longer than most tests.
+func mustExchangeMessages(t *testing.T, roomID string, alice, bob api.TestClient, when string) {
+	t.Helper()
+	for _, pair := range [][2]api.TestClient{{alice, bob}, {bob, alice}} {
+		sender, receiver := pair[0], pair[1]
+		body := fmt.Sprintf("%s says hello %s", sender.UserID(), when)
+		waiter := receiver.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(body))
+		sender.MustSendMessage(t, roomID, body)
+		waiter.Waitf(t, 20*time.Second, "%s did not decrypt the message from %s %s", receiver.UserID(), sender.UserID(), when)
+	}
+}
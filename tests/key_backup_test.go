@@ -1,24 +1,28 @@
 package tests
 
 import (
+	"errors"
 	"testing"
 	"time"
 
 	"github.com/matrix-org/complement-crypto/internal/api"
 	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement/ct"
 	"github.com/matrix-org/complement/must"
 )
 
 // Test that backups can be created and stored in secret storage.
 // Test that backups can be restored using secret storage and the recovery key.
+// This is run for each backup algorithm, to check that backups made by one client can be restored by another.
 func TestCanBackupKeys(t *testing.T) {
-	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+	Instance().BackupAlgorithmMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType, algorithm api.BackupAlgorithm) {
 		if clientTypeA.HS != clientTypeB.HS {
 			t.Skipf("client A and B must be on the same HS as this is testing key backups so A=backup creator B=backup restorer")
 			return
 		}
-		t.Logf("backup creator = %s backup restorer = %s", clientTypeA.Lang, clientTypeB.Lang)
+		t.Logf("backup creator = %s backup restorer = %s algorithm = %s", clientTypeA.Lang, clientTypeB.Lang, algorithm)
 		tc := Instance().CreateTestContext(t, clientTypeA)
+		tc.BackupAlgorithm = algorithm
 		roomID := tc.Alice.MustCreateRoom(t, map[string]interface{}{
 			"name":   t.Name(),
 			"preset": "public_chat", // shared history visibility
@@ -44,7 +48,13 @@ func TestCanBackupKeys(t *testing.T) {
 			waiter.Waitf(t, 5*time.Second, "backup creator did not see own message %s", evID)
 
 			// Now backupCreator backs up his keys. Some clients may automatically do this, but let's be explicit about it.
-			recoveryKey := backupCreator.MustBackupKeys(t)
+			recoveryKey, err := backupCreator.BackupKeys(t)
+			if err != nil {
+				if errors.Is(err, api.ErrNotSupported) {
+					t.Skipf("backup creator cannot create %s backups: %s", algorithm, err)
+				}
+				ct.Fatalf(t, "BackupKeys: %s", err)
+			}
 			t.Logf("recovery key -> %s", recoveryKey)
 
 			// Now login on a new device
@@ -134,3 +144,55 @@ func TestBackupWrongRecoveryKeyFails(t *testing.T) {
 		})
 	})
 }
+
+// Test that a new device cannot restore keys from a key backup which was deleted on the server and replaced by a
+// backup version Alice does not have the key for.
+func TestBackupDeletedOnServerCannotBeRestored(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		if clientTypeA.HS != clientTypeB.HS {
+			t.Skipf("client A and B must be on the same HS as this is testing key backups so A=backup creator B=backup restorer")
+			return
+		}
+		tc := Instance().CreateTestContext(t, clientTypeA)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, cc.EncRoomOptions.PresetPublicChat())
+
+		tc.WithAliceSyncing(t, func(backupCreator api.TestClient) {
+			body := "An encrypted message"
+			waiter := backupCreator.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(body))
+			evID := backupCreator.MustSendMessage(t, roomID, body)
+			waiter.Waitf(t, 5*time.Second, "backup creator did not see own message %s", evID)
+			recoveryKey := backupCreator.MustBackupKeys(t)
+
+			// tamper with the backup on the server
+			version, err := tc.Alice.GetKeyBackupVersion(t)
+			must.NotError(t, "failed to get key backup version", err)
+			must.NotEqual(t, version, "", "backup creator did not create a key backup")
+			must.NotError(t, "failed to delete key backup", tc.Alice.DeleteKeyBackup(t, version))
+			newVersion, err := tc.Alice.CreateKeyBackup(t)
+			must.NotError(t, "failed to create key backup", err)
+			currentVersion, err := tc.Alice.GetKeyBackupVersion(t)
+			must.NotError(t, "failed to get key backup version", err)
+			must.Equal(t, currentVersion, newVersion, "created key backup is not the current version")
+
+			csapiAlice2 := tc.MustRegisterNewDevice(t, tc.Alice, "BACKUP_RESTORER")
+			backupRestorer := tc.MustLoginClient(t, &cc.ClientCreationRequest{
+				User: &cc.User{
+					CSAPI:      csapiAlice2.CSAPI,
+					ClientType: clientTypeB,
+				},
+			})
+			defer backupRestorer.Close(t)
+
+			// this may or may not fail depending on the client, but either way the keys must not be restored.
+			backupRestorer.LoadBackup(t, recoveryKey)
+
+			backupRestorerStopSyncing := backupRestorer.MustStartSyncing(t)
+			defer backupRestorerStopSyncing()
+			time.Sleep(time.Second)
+			backupRestorer.MustBackpaginate(t, roomID, 5) // get the old message
+
+			ev := backupRestorer.MustGetEvent(t, roomID, evID)
+			must.Equal(t, ev.FailedToDecrypt, true, "new device decrypted the event from a deleted backup")
+		})
+	})
+}
@@ -0,0 +1,92 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement-crypto/internal/deploy/callback"
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that clients surface malformed m.room.encrypted events as decryption failures, without crashing or
+// breaking the megolm session the event claims to use. Every input in the fuzzing corpus for
+// callback.MalformEncryptedContent is also tried, see callback.FuzzMalformEncryptedContent.
+func TestMalformedEncryptedEventsAreUndecryptable(t *testing.T) {
+	malformations := callback.EncryptedContentMalformations
+	corpus, err := callback.LoadFuzzCorpus("../internal/deploy/callback/testdata/fuzz/FuzzMalformEncryptedContent")
+	must.NotError(t, "failed to load fuzzing corpus", err)
+	for _, input := range corpus {
+		malformations = append(malformations, callback.EncryptedContentMalformation{
+			Name:  fmt.Sprintf("corpus %x", input),
+			Input: input,
+		})
+	}
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			firstBody := "Before any malformed events"
+			waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(firstBody))
+			firstEventID := alice.MustSendMessage(t, roomID, firstBody)
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's first message")
+
+			for _, m := range malformations {
+				t.Run(m.Name, func(t *testing.T) {
+					var eventID string
+					malformEncryptedSends(t, tc, alice, m.Input, func() {
+						var err error
+						eventID, err = alice.SendMessage(t, roomID, "This message is malformed: "+m.Name)
+						if err != nil {
+							ct.Fatalf(t, "alice failed to send a message which was malformed by the server: %s", err)
+						}
+					})
+
+					bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasEventID(eventID)).Waitf(
+						t, 5*time.Second, "bob did not see alice's malformed message %s", eventID,
+					)
+					ev := bob.MustGetEvent(t, roomID, eventID)
+					must.Equal(t, ev.FailedToDecrypt, true, "bob decrypted alice's malformed message")
+
+					validBody := "After the malformed message: " + m.Name
+					waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(validBody))
+					alice.MustSendMessage(t, roomID, validBody)
+					waiter.Waitf(t, 5*time.Second, "bob could not decrypt alice's message after the malformed message")
+					ev = bob.MustGetEvent(t, roomID, firstEventID)
+					must.Equal(t, ev.FailedToDecrypt, false, "bob can no longer decrypt alice's first message")
+				})
+			}
+
+			body := "Bob can still send messages"
+			waiter = alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(body))
+			bob.MustSendMessage(t, roomID, body)
+			waiter.Waitf(t, 5*time.Second, "alice did not see bob's message after the malformed messages")
+		})
+	})
+}
+
+// malformEncryptedSends malforms the content of the first m.room.encrypted event sent by the sender whilst inner runs,
+// using the given malformation input, and fails the test if nothing was malformed.
+func malformEncryptedSends(t *testing.T, tc *cc.TestContext, sender api.TestClient, input []byte, inner func()) {
+	t.Helper()
+	malformer := callback.NewEncryptedContentMalformer(input)
+	tc.Deployment.MITM().Configure(t).WithIntercept(mitm.InterceptOpts{
+		Filter: mitm.FilterParams{
+			PathContains: "/send/m.room.encrypted/",
+			Method:       "PUT",
+			AccessToken:  sender.CurrentAccessToken(t),
+		},
+		RequestCallback: malformer.Callback(),
+	}, inner)
+	if !malformer.Malformed() {
+		ct.Fatalf(t, "did not malform %s's message", sender.UserID())
+	}
+}
@@ -0,0 +1,48 @@
+package tests
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement/ct"
+)
+
+// Test that encrypted file attachments can be downloaded and decrypted by other clients.
+func TestCanDecryptEncryptedAttachments(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		if clientTypeA.Lang == api.ClientTypeNio || clientTypeB.Lang == api.ClientTypeNio {
+			t.Skipf("nio does not support encrypted attachments")
+			return
+		}
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(
+			t,
+			tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			filename := "secret.txt"
+			contents := []byte("the quick brown fox jumps over the lazy dog")
+			waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasFileName(filename))
+			eventID := alice.MustSendEncryptedFile(t, roomID, filename, contents)
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's file")
+
+			ev := bob.MustGetEvent(t, roomID, eventID)
+			if ev.File == nil {
+				ct.Fatalf(t, "bob's event %s has no file", eventID)
+			}
+			if ev.File.DownloadError != "" {
+				ct.Fatalf(t, "bob failed to download alice's file: %s", ev.File.DownloadError)
+			}
+			if !bytes.Equal(ev.File.Contents, contents) {
+				ct.Fatalf(t, "wrong file contents: got %q want %q", ev.File.Contents, contents)
+			}
+		})
+	})
+}
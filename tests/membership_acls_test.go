@@ -1,12 +1,14 @@
 package tests
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 	"time"
 
 	"github.com/matrix-org/complement-crypto/internal/api"
 	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement/ct"
 	"github.com/matrix-org/complement/must"
 )
 
@@ -112,6 +114,41 @@ func TestCanDecryptMessagesAfterInviteButBeforeJoin(t *testing.T) {
 	})
 }
 
+// Test what Bob can see of the messages sent before he joined, for every history visibility. He should
+// only be able to decrypt the message sent whilst he was invited.
+func TestPreJoinHistoryForEachHistoryVisibility(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		for _, want := range cc.PreJoinHistories {
+			t.Run(want.HistoryVisibility, func(t *testing.T) {
+				tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+				roomID := tc.CreateNewEncryptedRoom(
+					t,
+					tc.Alice,
+					cc.EncRoomOptions.PresetPrivateChat(),
+					cc.EncRoomOptions.HistoryVisibility(want.HistoryVisibility),
+				)
+				tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+					beforeInviteEventID := alice.MustSendMessage(t, roomID, "Before Bob is invited")
+
+					waiter := alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasMembership(bob.UserID(), "invite"))
+					tc.Alice.MustInviteRoom(t, roomID, bob.UserID())
+					waiter.Waitf(t, 5*time.Second, "alice did not see bob's invite")
+					whileInvitedEventID := alice.MustSendMessage(t, roomID, "Whilst Bob is invited")
+
+					tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+					// wait until bob is joined and can decrypt new messages before looking at history.
+					sentinelBody := "After Bob joins"
+					waiter = bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(sentinelBody))
+					alice.MustSendMessage(t, roomID, sentinelBody)
+					waiter.Waitf(t, 5*time.Second, "bob did not see alice's message after joining")
+
+					cc.MustHavePreJoinHistory(t, bob, roomID, beforeInviteEventID, whileInvitedEventID, want)
+				})
+			})
+		}
+	})
+}
+
 // In a public, `shared` history visibility room, a new user Bob cannot decrypt earlier messages prior to his join,
 // despite being able to see the events. Subsequent messages are decryptable.
 func TestBobCanSeeButNotDecryptHistoryInPublicRoom(t *testing.T) {
@@ -137,10 +174,7 @@ func TestBobCanSeeButNotDecryptHistoryInPublicRoom(t *testing.T) {
 			waiter.Waitf(t, 5*time.Second, "bob did not see own join")
 
 			// bob hits scrollback and should see but not be able to decrypt the message
-			bob.MustBackpaginate(t, roomID, 5)
-			// jJ runs need this, else the event will exist but not yet be marked as failed to decrypt. Unsure why fed slows it down.
-			time.Sleep(500 * time.Millisecond)
-			ev := bob.MustGetEvent(t, roomID, evID)
+			ev := cc.MustBackpaginateToEvent(t, bob, roomID, evID)
 			must.NotEqual(t, ev.Text, beforeJoinBody, "bob was able to decrypt a message from before he was joined")
 			must.Equal(t, ev.FailedToDecrypt, true, fmt.Sprintf("message not marked as failed to decrypt: %+v", ev))
 		})
@@ -249,16 +283,11 @@ func TestOnNewDeviceBobCanSeeButNotDecryptHistoryInPublicRoom(t *testing.T) {
 				waiter.Waitf(t, 5*time.Second, "bob2 did not see alice's message")
 			})
 
-			// now bob logs out
-			csapiBob2.MustDo(t, "POST", []string{"_matrix", "client", "v3", "logout"})
-
-			time.Sleep(time.Second) // let device keys propagate to alice
-
-			// alice sends another message which should not be decryptable due to key cycling. The message should be decryptable
-			// by bob's other logged in device though.
+			// now bob logs out. alice sends another message which should not be decryptable due to key cycling.
+			// The message should be decryptable by bob's other logged in device though.
 			undecryptableBody := "Bob's logged out device won't be able to decrypt this"
 			waiter = bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(undecryptableBody))
-			evID = alice.MustSendMessage(t, roomID, undecryptableBody)
+			evID = tc.MustLogoutAndAssertCleanup(t, csapiBob2, tc.Alice, alice, roomID, evID, undecryptableBody)
 			t.Logf("bob (%s) waiting for event %s", bob.Type(), evID)
 			waiter.Waitf(t, 5*time.Second, "bob did not see alice's event %s", evID)
 
@@ -306,3 +335,40 @@ func TestChangingDeviceAfterInviteReEncrypts(t *testing.T) {
 		})
 	})
 }
+
+// Test that encrypted DMs are seen as direct by both users, unlike regular encrypted rooms.
+func TestEncryptedDMIsDirect(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		dmRoomID := tc.CreateEncryptedDM(t, tc.Alice, tc.Bob)
+		tc.Bob.MustJoinRoom(t, dmRoomID, []string{clientTypeA.HS})
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}))
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			for _, client := range []api.TestClient{alice, bob} {
+				isDirect, err := client.IsDirect(t, dmRoomID)
+				if err != nil {
+					if errors.Is(err, api.ErrNotSupported) {
+						t.Skipf("IsDirect unsupported: %s", err)
+					}
+					ct.Fatalf(t, "%s IsDirect: %s", client.UserID(), err)
+				}
+				must.Equal(t, isDirect, true, fmt.Sprintf("%s does not think the DM is direct", client.UserID()))
+				isEncrypted, err := client.IsRoomEncrypted(t, dmRoomID)
+				must.NotError(t, "failed to check if room is encrypted", err)
+				must.Equal(t, isEncrypted, true, fmt.Sprintf("%s does not think the DM is encrypted", client.UserID()))
+
+				isDirect, err = client.IsDirect(t, roomID)
+				must.NotError(t, "failed to check if room is direct", err)
+				must.Equal(t, isDirect, false, fmt.Sprintf("%s thinks a regular room is direct", client.UserID()))
+			}
+
+			wantMsgBody := "Hello DM"
+			waiter := bob.WaitUntilEventInRoom(t, dmRoomID, api.CheckEventHasBody(wantMsgBody))
+			evID := alice.MustSendMessage(t, dmRoomID, wantMsgBody)
+			t.Logf("bob (%s) waiting for event %s", bob.Type(), evID)
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's DM")
+		})
+	})
+}
@@ -0,0 +1,37 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+)
+
+// Test that room keys are rotated correctly when lots of users join and leave an encrypted room at once, whilst
+// messages are being sent into it. Each churner should only decrypt the messages sent whilst they were joined.
+func TestMembershipChurnRotatesRoomKeys(t *testing.T) {
+	const numChurners = 24
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice,
+			cc.EncRoomOptions.PresetPublicChat(),
+			cc.EncRoomOptions.HistoryVisibility(cc.HistoryVisibilityShared),
+		)
+		churners := make([]*cc.User, numChurners)
+		reqs := []*cc.ClientCreationRequest{{User: tc.Alice}}
+		for i := range churners {
+			churners[i] = tc.RegisterNewUser(t, clientTypeB, fmt.Sprintf("churner%d", i))
+			reqs = append(reqs, &cc.ClientCreationRequest{User: churners[i]})
+		}
+
+		tc.WithClientsSyncing(t, reqs, func(clients []api.TestClient) {
+			alice := clients[0]
+			messages := cc.MustChurnMembership(t, roomID, tc.Alice, alice, churners, cc.MembershipChurnOpts{
+				Rounds:           6,
+				MessagesPerRound: 2,
+			})
+			cc.MustOnlyDecryptMessagesSentWhilstJoined(t, roomID, messages, clients[1:])
+		})
+	})
+}
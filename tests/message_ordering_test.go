@@ -0,0 +1,37 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+)
+
+// Test that messages sent at the same time from several devices are decrypted by every device, and that every
+// device sees them in the same order.
+func TestConcurrentMessagesConvergeInOrder(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(
+			t,
+			tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+		alice2 := tc.MustRegisterNewDevice(t, tc.Alice, "ALICE_TWO")
+
+		// log in every device before any of them sync, so they all know about each other before sending.
+		tc.WithClientsSyncing(t, []*cc.ClientCreationRequest{
+			{User: tc.Alice},
+			{User: alice2},
+			{User: tc.Bob},
+		}, func(devices []api.TestClient) {
+			bodies := cc.MustSendConcurrentMessages(t, roomID, devices, cc.ConcurrentMessagesOpts{
+				MessagesPerSender: 5,
+				Concurrency:       6,
+			})
+			cc.MustHaveConvergedTimelines(t, roomID, bodies, devices...)
+		})
+	})
+}
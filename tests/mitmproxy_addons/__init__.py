@@ -12,10 +12,26 @@ install("aiohttp")
 
 from callback import Callback
 from controller import MITM_DOMAIN_NAME, app
+from network import network
+from faults import faults
+from chaos import chaos
+from delays import delays
+from reorder import reorder
+from rewrites import rewrites
+from recorder import recorder
+from certificates import certificates
 
 addons = [
     asgiapp.WSGIApp(app, MITM_DOMAIN_NAME, 80), # requests to this host will be routed to the flask app
     Callback(),
+    network,
+    faults,
+    chaos,
+    delays,
+    reorder,
+    rewrites,
+    certificates,
+    recorder, # last, so it records the flow after other addons have modified it
 ]
 # testcontainers will look for this log line
 print("loading complement crypto addons", flush=True)
@@ -114,6 +114,12 @@ class Callback:
                     print(f'ERR: callback server returned non-json: {err_response_body}')
                     raise Exception("callback server content-type: " + response.content_type)
                 test_response_body = await response.json()
+                # request callbacks can modify the request rather than responding to it.
+                if "rewrite_request_body" in test_response_body:
+                    if flow.response is None:
+                        print(f'{datetime.now().strftime("%H:%M:%S.%f")} callback for {flow.request.url} rewriting request body')
+                        flow.request.text = json.dumps(test_response_body["rewrite_request_body"])
+                    return
                 # if the response includes some keys then we are modifying the response on a per-key basis.
                 if len(test_response_body) > 0:
                     # use what fields were provided preferentially.
@@ -0,0 +1,160 @@
+import datetime
+import ipaddress
+from cryptography import x509
+from cryptography.hazmat.primitives import hashes, serialization
+from cryptography.hazmat.primitives.asymmetric import ec
+from cryptography.x509.oid import NameOID
+from mitmproxy import ctx, exceptions, tls
+from OpenSSL import SSL, crypto
+from controller import MITM_DOMAIN_NAME, app, register_shared_option
+
+# The names clients use to connect to the reverse proxy.
+HOSTNAMES = ["localhost", "host.docker.internal"]
+IP_ADDRESSES = ["127.0.0.1", "::1"]
+KINDS = ["expired", "self_signed", "wrong_host"]
+
+def make_cert(common_name, key, issuer_cert, issuer_key, not_before, not_after, hostnames=None, ips=None):
+    issuer_name = issuer_cert.subject if issuer_cert else x509.Name([x509.NameAttribute(NameOID.COMMON_NAME, common_name)])
+    builder = (
+        x509.CertificateBuilder()
+        .subject_name(x509.Name([x509.NameAttribute(NameOID.COMMON_NAME, common_name)]))
+        .issuer_name(issuer_name)
+        .public_key(key.public_key())
+        .serial_number(x509.random_serial_number())
+        .not_valid_before(not_before)
+        .not_valid_after(not_after)
+    )
+    if hostnames is None:
+        builder = builder.add_extension(x509.BasicConstraints(ca=True, path_length=0), critical=True)
+    else:
+        builder = builder.add_extension(x509.BasicConstraints(ca=False, path_length=None), critical=True)
+        builder = builder.add_extension(x509.SubjectAlternativeName(
+            [x509.DNSName(h) for h in hostnames] + [x509.IPAddress(ipaddress.ip_address(ip)) for ip in (ips or [])]
+        ), critical=False)
+    return builder.sign(issuer_key, hashes.SHA256())
+
+def select_http1(conn, options):
+    # mitmproxy sees the negotiated protocol, so only offer what every client supports
+    if b"http/1.1" in options:
+        return b"http/1.1"
+    return SSL.NO_OVERLAPPING_PROTOCOLS
+
+# See README.md for information about this addon
+class Certificates:
+    def __init__(self):
+        now = datetime.datetime.now(datetime.timezone.utc)
+        day = datetime.timedelta(days=1)
+        self.ca_key = ec.generate_private_key(ec.SECP256R1())
+        self.ca_cert = make_cert("complement-crypto reverse proxy CA", self.ca_key, None, self.ca_key, now - day, now + 365 * day)
+        # kind => (certificate, key, whether the CA issued it)
+        self.certs = {}
+        for kind in ["valid"] + KINDS:
+            key = ec.generate_private_key(ec.SECP256R1())
+            hostnames, ips = HOSTNAMES, IP_ADDRESSES
+            not_before, not_after = now - day, now + 365 * day
+            issuer_cert, issuer_key = self.ca_cert, self.ca_key
+            if kind == "expired":
+                not_before, not_after = now - 30 * day, now - day
+            elif kind == "wrong_host":
+                hostnames, ips = ["wrong.host.invalid"], []
+            elif kind == "self_signed":
+                issuer_cert, issuer_key = None, key
+            cert = make_cert("complement-crypto reverse proxy", key, issuer_cert, issuer_key, not_before, not_after, hostnames, ips)
+            self.certs[kind] = (cert, key, issuer_cert is not None)
+        # lock ID => bad cert. Replaced rather than modified when the option changes, as it is read whilst
+        # handling connections.
+        self.bad_certs = {}
+        # Bumped whenever the certificate changes. Connections made with an older certificate are closed so
+        # clients have to handshake again, as they would if the server was restarted with a new certificate.
+        self.generation = 0
+        # client connection ID => generation of the certificate it was served
+        self.connections = {}
+
+    def load(self, loader):
+        loader.add_option(
+            name="bad_certificates",
+            typespec=dict,
+            default={},
+            help="Serve bad certificates from the reverse proxy, keyed on the lock ID which set the certificate",
+        )
+
+    def configure(self, updates):
+        if "bad_certificates" not in updates:
+            return
+        bad_certs = {}
+        # dicts keep their insertion order, so the most recently locked bad certificate is last
+        for bad_cert_id, bad_cert in ctx.options.bad_certificates.items():
+            if bad_cert_id in self.bad_certs:
+                bad_certs[bad_cert_id] = self.bad_certs[bad_cert_id]
+                continue
+            kind = bad_cert.get("kind", "")
+            if kind not in KINDS:
+                raise exceptions.OptionsError(f"unknown bad certificate kind {kind}")
+            bad_certs[bad_cert_id] = {
+                "kind": kind,
+                "handshakes": 0,
+            }
+            print(f"adding bad certificate {bad_cert_id} => {bad_cert}")
+        changed = bad_certs.keys() != self.bad_certs.keys()
+        self.bad_certs = bad_certs
+        if changed:
+            self.generation += 1
+
+    # Returns how many TLS handshakes the bad certificate was served in.
+    def unlocked(self, bad_cert_id: str) -> dict:
+        bad_cert = self.bad_certs[bad_cert_id]
+        print(f"removing bad certificate {bad_cert_id}, served it in {bad_cert['handshakes']} handshakes")
+        return {
+            "handshakes": bad_cert["handshakes"],
+        }
+
+    def ca_pem(self) -> str:
+        return self.ca_cert.public_bytes(serialization.Encoding.PEM).decode("ascii")
+
+    # Runs after mitmproxy has made the TLS connection, so replaces it with one which serves our certificate.
+    def tls_start_client(self, tls_start: tls.TlsData):
+        # Only the reverse proxy serves these certificates. The regular proxy, used for federation, serves
+        # certificates signed by the mitmproxy CA.
+        if tls_start.context.client.proxy_mode.type_name != "reverse":
+            return
+        kind = "valid"
+        if self.bad_certs:
+            # the most recently added bad certificate wins
+            bad_cert = list(self.bad_certs.values())[-1]
+            bad_cert["handshakes"] += 1
+            kind = bad_cert["kind"]
+        cert, key, issued_by_ca = self.certs[kind]
+        ssl_ctx = SSL.Context(SSL.TLS_SERVER_METHOD)
+        ssl_ctx.use_certificate(crypto.X509.from_cryptography(cert))
+        ssl_ctx.use_privatekey(crypto.PKey.from_cryptography_key(key))
+        if issued_by_ca:
+            ssl_ctx.add_extra_chain_cert(crypto.X509.from_cryptography(self.ca_cert))
+        ssl_ctx.set_alpn_select_callback(select_http1)
+        tls_start.ssl_conn = SSL.Connection(ssl_ctx)
+        tls_start.ssl_conn.set_accept_state()
+        self.connections[tls_start.context.client.id] = self.generation
+
+    def client_disconnected(self, client):
+        self.connections.pop(client.id, None)
+
+    def requestheaders(self, flow):
+        # always ignore the controller
+        if flow.request.pretty_host == MITM_DOMAIN_NAME:
+            return
+        generation = self.connections.get(flow.client_conn.id)
+        if generation is not None and generation != self.generation:
+            print(f"certificates closing connection which used an old certificate for {flow.request.method} {flow.request.path}")
+            flow.kill()
+
+certificates = Certificates()
+register_shared_option("bad_certificates", certificates)
+
+# Return the CA which issued the certificates served by the reverse proxy, so clients can be configured to trust it.
+# GET /certificates/ca
+# HTTP/1.1 200 OK
+# { "ca_pem": "-----BEGIN CERTIFICATE-----\n..." }
+@app.route("/certificates/ca", methods=["GET"])
+def get_ca():
+    return {
+        "ca_pem": certificates.ca_pem(),
+    }
@@ -0,0 +1,95 @@
+import random
+import time
+from mitmproxy import ctx
+from controller import MITM_DOMAIN_NAME, register_shared_option
+
+# See README.md for information about this addon
+class Chaos:
+    def __init__(self):
+        # lock ID => schedule. Replaced rather than modified when the option changes, as it is read whilst
+        # handling flows.
+        self.chaos = {}
+
+    def load(self, loader):
+        loader.add_option(
+            name="chaos",
+            typespec=dict,
+            default={},
+            help="Periodically take the proxy down, keyed on the lock ID which set the schedule",
+        )
+
+    def configure(self, updates):
+        if "chaos" not in updates:
+            return
+        schedules = {}
+        for chaos_id, chaos in ctx.options.chaos.items():
+            if chaos_id in self.chaos:
+                schedules[chaos_id] = self.chaos[chaos_id]
+                continue
+            seed = chaos.get("seed", 0)
+            c = {
+                "interval": chaos.get("interval_ms", 0) / 1000,
+                "jitter": chaos.get("jitter_ms", 0) / 1000,
+                "downtime": chaos.get("downtime_ms", 0) / 1000,
+                "rng": random.Random(seed) if seed else random.Random(),
+                "restarts": 0,
+                "killed": 0,
+            }
+            c["outage_start"] = time.monotonic() + self.next_interval(c)
+            c["outage_end"] = c["outage_start"] + c["downtime"]
+            schedules[chaos_id] = c
+            print(f"adding chaos {chaos_id} => {chaos}")
+        self.chaos = schedules
+
+    # Returns how many times the proxy went down.
+    def unlocked(self, chaos_id: str) -> dict:
+        c = self.chaos[chaos_id]
+        now = time.monotonic()
+        self.advance(c, now)
+        restarts = c["restarts"]
+        if c["outage_start"] <= now:
+            # we are mid-outage
+            restarts += 1
+        print(f"removing chaos {chaos_id}, restarted {restarts} times and killed {c['killed']} flows")
+        return {
+            "restarts": restarts,
+        }
+
+    def next_interval(self, c) -> float:
+        return max(0, c["interval"] + c["rng"].uniform(-c["jitter"], c["jitter"]))
+
+    # Move the schedule forward so that the current or next outage ends after `now`.
+    def advance(self, c, now: float):
+        while now >= c["outage_end"]:
+            c["restarts"] += 1
+            c["outage_start"] = c["outage_end"] + self.next_interval(c)
+            c["outage_end"] = c["outage_start"] + c["downtime"]
+
+    def in_outage(self) -> bool:
+        now = time.monotonic()
+        for c in self.chaos.values():
+            self.advance(c, now)
+            if c["outage_start"] <= now:
+                c["killed"] += 1
+                return True
+        return False
+
+    # Abort the connection as soon as we see the request or response, which is what clients see when
+    # the proxy goes away. This includes long-polling requests like /sync which started before the outage.
+    def requestheaders(self, flow):
+        # always ignore the controller
+        if flow.request.pretty_host == MITM_DOMAIN_NAME:
+            return
+        if self.in_outage():
+            print(f"chaos killing {flow.request.method} {flow.request.path}")
+            flow.kill()
+
+    def responseheaders(self, flow):
+        if flow.request.pretty_host == MITM_DOMAIN_NAME:
+            return
+        if self.in_outage():
+            print(f"chaos killing response to {flow.request.method} {flow.request.path}")
+            flow.kill()
+
+chaos = Chaos()
+register_shared_option("chaos", chaos)
@@ -1,14 +1,25 @@
 import random
+import threading
 from mitmproxy import ctx
 from flask import Flask, request, make_response
 # must match code in deploy.go
 MITM_DOMAIN_NAME = "mitm.code"
 app = Flask("mitmoptset")
 
-prev_options = {
-    "lock_id": "",
-    "options": {},
-}
+# lock ID => the options set by the lock
+locks = {}
+# option name => addon, for options which are shared between locks. See register_shared_option.
+shared_options = {}
+# requests to the controller can be handled concurrently
+locks_mu = threading.Lock()
+
+# Allow more than one lock to set the option at the same time. The option must be a dict, and each lock
+# adds its value to the dict keyed on the lock ID, which is removed when the lock is unlocked. This allows
+# tests to e.g inject faults whilst also intercepting requests. Before the value is removed,
+# addon.unlocked(lock_id) is called, and what it returns is included in the /options/unlock response so
+# addons can report what they did whilst the lock was held.
+def register_shared_option(name: str, addon):
+    shared_options[name] = addon
 
 # Set options on mitmproxy. See https://docs.mitmproxy.org/stable/concepts-options/
 # This is intended to be used exclusively for our addons in this package, but nothing
@@ -23,23 +34,43 @@ prev_options = {
 # {
 #   "reset_id": "some_opaque_string"
 # }
-# Calling this endpoint locks the proxy from further option modification until /options/unlock
+# Calling this endpoint locks the options from further modification until /options/unlock
 # is called. This ensures that tests can't forget to reset options when they are done with them.
+# Only the options which are set are locked, and shared options are never locked.
 @app.route("/options/lock", methods=["POST"])
 def lock_options():
-    if prev_options["lock_id"] != "":
-        return make_response(("options already locked, did you forget to unlock?", 400))
     body = request.json
     options = body.get("options", {})
-    prev_options["lock_id"] = bytes.hex(random.randbytes(8))
-    for k, v in ctx.options.items():
-        if k in options:
-            prev_options["options"][k] = v.current()
-    print(f"locking options {options}")
-    ctx.options.update(**options)
-    return {
-        "reset_id": prev_options["lock_id"]
-    }
+    with locks_mu:
+        for name in options:
+            if name in shared_options:
+                continue
+            for lock in locks.values():
+                if name in lock["prev_options"]:
+                    return make_response((f"option {name} already locked, did you forget to unlock?", 400))
+        lock_id = bytes.hex(random.randbytes(8))
+        prev_options = {}
+        updates = {}
+        for k, v in ctx.options.items():
+            if k not in options:
+                continue
+            if k in shared_options:
+                updates[k] = {**v.current(), lock_id: options[k]}
+            else:
+                prev_options[k] = v.current()
+                updates[k] = options[k]
+        print(f"locking options {options}")
+        try:
+            ctx.options.update(**updates)
+        except Exception as e:
+            return make_response((f"failed to set options: {e}", 400))
+        locks[lock_id] = {
+            "prev_options": prev_options,
+            "shared_options": [k for k in updates if k in shared_options],
+        }
+        return {
+            "reset_id": lock_id
+        }
 
 # Unlock previously set options on mitmproxy. Must be called after a call to POST /options/lock
 # to allow further option modifications.
@@ -47,17 +78,31 @@ def lock_options():
 # {
 #   "reset_id": "some_opaque_string"
 # }
+# HTTP/1.1 200 OK
+# {
+#   "unlocked": { "shared_option_name": { what the addon did whilst the lock was held } }
+# }
 @app.route("/options/unlock", methods=["POST"])
 def unlock_options() -> str:
     body = request.json
     reset_id = body.get("reset_id", "")
-    if prev_options["lock_id"] == "":
-        return make_response(("options were not locked, mismatched lock/unlock calls", 400))
-    if prev_options["lock_id"] != reset_id:
-        return make_response(("refusing to unlock, wrong id supplied", 400))
-    print(f"unlocking options back to {prev_options['options']}")
-    ctx.options.update(**prev_options["options"])
-    # apply AFTER update so if we fail to reset them back we won't unlock, indicating a problem.
-    prev_options["lock_id"] = ""
-    prev_options["options"] = {}
-    return {}
+    with locks_mu:
+        if len(locks) == 0:
+            return make_response(("options were not locked, mismatched lock/unlock calls", 400))
+        lock = locks.get(reset_id)
+        if lock is None:
+            return make_response(("refusing to unlock, wrong id supplied", 400))
+        unlocked = {}
+        updates = dict(lock["prev_options"])
+        for name in lock["shared_options"]:
+            unlocked[name] = shared_options[name].unlocked(reset_id)
+            value = dict(getattr(ctx.options, name))
+            value.pop(reset_id, None)
+            updates[name] = value
+        print(f"unlocking options back to {lock['prev_options']}")
+        ctx.options.update(**updates)
+        # apply AFTER update so if we fail to reset them back we won't unlock, indicating a problem.
+        del locks[reset_id]
+        return {
+            "unlocked": unlocked,
+        }
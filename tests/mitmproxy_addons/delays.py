@@ -0,0 +1,74 @@
+import asyncio
+from mitmproxy import ctx, flowfilter
+from controller import MITM_DOMAIN_NAME, register_shared_option
+
+# See README.md for information about this addon
+class Delays:
+    def __init__(self):
+        # lock ID => delay. Replaced rather than modified when the option changes, as it is read whilst
+        # handling flows.
+        self.delays = {}
+
+    def load(self, loader):
+        loader.add_option(
+            name="delays",
+            typespec=dict,
+            default={},
+            help="Hold back responses, keyed on the lock ID which set the delay",
+        )
+
+    def configure(self, updates):
+        if "delays" not in updates:
+            return
+        delays = {}
+        for delay_id, delay in ctx.options.delays.items():
+            if delay_id in self.delays:
+                delays[delay_id] = self.delays[delay_id]
+                continue
+            f = delay.get("filter", None)
+            delays[delay_id] = {
+                "filter": flowfilter.parse(f) if f else flowfilter.parse("."),
+                "phase": delay.get("phase", "") or "response",
+                "delay_ms": delay.get("delay_ms", 0),
+                "count": delay.get("count", 0),
+                "delayed": 0,
+            }
+            print(f"adding delay {delay_id} => {delay}")
+        self.delays = delays
+
+    # Returns how many responses were delayed.
+    def unlocked(self, delay_id: str) -> dict:
+        delay = self.delays[delay_id]
+        print(f"removing delay {delay_id}, delayed {delay['delayed']} responses")
+        return {
+            "delayed": delay["delayed"],
+        }
+
+    # By default delay the response rather than the request, so the client gets data which was correct when the
+    # server sent it but is stale by the time it arrives, just like a slow /sync on a bad connection.
+    async def response(self, flow):
+        await self.delay(flow, "response")
+
+    # Delays in the request phase hold the request before it reaches the server, e.g so another client's
+    # request is processed first.
+    async def request(self, flow):
+        await self.delay(flow, "request")
+
+    async def delay(self, flow, phase: str):
+        # always ignore the controller
+        if flow.request.pretty_host == MITM_DOMAIN_NAME:
+            return
+        total = 0
+        for delay_id, delay in self.delays.items():
+            if delay["phase"] != phase or not flowfilter.match(delay["filter"], flow):
+                continue
+            if delay["count"] > 0 and delay["delayed"] >= delay["count"]:
+                continue
+            delay["delayed"] += 1
+            print(f"delay {delay_id} delaying {flow.request.method} {flow.request.path} {phase} by {delay['delay_ms']}ms")
+            total += delay["delay_ms"] / 1000
+        if total > 0:
+            await asyncio.sleep(total)
+
+delays = Delays()
+register_shared_option("delays", delays)
@@ -0,0 +1,105 @@
+import json
+import math
+import random
+import time
+from mitmproxy import ctx, flowfilter, http
+from controller import MITM_DOMAIN_NAME, register_shared_option
+
+# See README.md for information about this addon
+class Faults:
+    def __init__(self):
+        # lock ID => fault. Replaced rather than modified when the option changes, as it is read whilst
+        # handling flows on another thread.
+        self.faults = {}
+
+    def load(self, loader):
+        loader.add_option(
+            name="faults",
+            typespec=dict,
+            default={},
+            help="Drop requests, keyed on the lock ID which set the fault",
+        )
+
+    def configure(self, updates):
+        if "faults" not in updates:
+            return
+        faults = {}
+        for fault_id, fault in ctx.options.faults.items():
+            if fault_id in self.faults:
+                # keep counting drops for existing faults
+                faults[fault_id] = self.faults[fault_id]
+                continue
+            f = fault.get("filter", None)
+            seed = fault.get("seed", 0)
+            faults[fault_id] = {
+                "filter": flowfilter.parse(f) if f else flowfilter.parse("."),
+                "phase": fault.get("phase", "") or "request",
+                "drop_rate": fault.get("drop_rate", 0),
+                "max_drops": fault.get("max_drops", 0),
+                "status_code": fault.get("status_code", 0) or 502,
+                "errcode": fault.get("errcode", "") or "M_UNKNOWN",
+                "retry_after_ms": fault.get("retry_after_ms", 0),
+                "rng": random.Random(seed) if seed else random.Random(),
+                "dropped": 0,
+                # when the last request was dropped, and how long after that the next matching request was sent
+                "last_dropped_at": None,
+                "retry_delay_ms": None,
+            }
+            print(f"adding fault {fault_id} => {fault}")
+        self.faults = faults
+
+    # Returns how many requests were dropped by the fault, and how long after the last dropped request the
+    # next matching request was sent, if it was.
+    def unlocked(self, fault_id: str) -> dict:
+        fault = self.faults[fault_id]
+        print(f"removing fault {fault_id}, dropped {fault['dropped']} requests")
+        return {
+            "dropped": fault["dropped"],
+            "retry_delay_ms": fault["retry_delay_ms"],
+        }
+
+    def request(self, flow):
+        self.drop(flow, "request")
+
+    # Faults in the response phase drop the response after the server has processed the request, so the
+    # client thinks the request failed when it succeeded.
+    def response(self, flow):
+        self.drop(flow, "response")
+
+    def drop(self, flow, phase: str):
+        # always ignore the controller, and responses we made when dropping the request
+        if flow.request.pretty_host == MITM_DOMAIN_NAME or flow.metadata.get("fault_dropped"):
+            return
+        for fault_id, fault in self.faults.items(): # safe, as configure replaces the dict
+            if fault["phase"] != phase or not flowfilter.match(fault["filter"], flow):
+                continue
+            now = time.monotonic()
+            if fault["last_dropped_at"] is not None and fault["retry_delay_ms"] is None:
+                fault["retry_delay_ms"] = int((now - fault["last_dropped_at"]) * 1000)
+            if fault["max_drops"] > 0 and fault["dropped"] >= fault["max_drops"]:
+                continue
+            if fault["rng"].random() >= fault["drop_rate"]:
+                continue
+            fault["dropped"] += 1
+            fault["last_dropped_at"] = now
+            fault["retry_delay_ms"] = None
+            flow.metadata["fault_dropped"] = True
+            print(f"fault {fault_id} dropping {flow.request.method} {flow.request.path} in the {phase} phase")
+            body = {
+                "errcode": fault["errcode"],
+                "error": "dropped by complement-crypto fault injection",
+            }
+            headers = {"Content-Type": "application/json"}
+            if fault["retry_after_ms"] > 0:
+                body["retry_after_ms"] = fault["retry_after_ms"]
+                headers["Retry-After"] = str(math.ceil(fault["retry_after_ms"] / 1000))
+            # setting a response in the request phase means the request is never sent to the server
+            flow.response = http.Response.make(
+                fault["status_code"],
+                json.dumps(body).encode("utf-8"),
+                headers,
+            )
+            return
+
+faults = Faults()
+register_shared_option("faults", faults)
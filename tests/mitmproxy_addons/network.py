@@ -0,0 +1,67 @@
+import asyncio
+from mitmproxy import ctx, flowfilter
+from controller import MITM_DOMAIN_NAME, register_shared_option
+
+# See README.md for information about this addon
+class Network:
+    def __init__(self):
+        # Replaced rather than modified when the option changes, as it is read whilst handling flows.
+        self.conditions = []
+
+    def load(self, loader):
+        loader.add_option(
+            name="network",
+            typespec=dict,
+            default={},
+            help="Delay flows to simulate degraded network conditions, keyed on the lock ID which set them",
+        )
+
+    def configure(self, updates):
+        if "network" not in updates:
+            return
+        parsed = []
+        for network in ctx.options.network.values():
+            for c in network.get("conditions", []):
+                f = c.get("filter", None)
+                parsed.append({
+                    "filter": flowfilter.parse(f) if f else flowfilter.parse("."),
+                    "latency_ms": c.get("latency_ms", 0),
+                    "bandwidth_bytes_per_sec": c.get("bandwidth_bytes_per_sec", 0),
+                })
+        print(f"network conditions={ctx.options.network}")
+        self.conditions = parsed
+
+    def unlocked(self, lock_id: str) -> dict:
+        return {}
+
+    # Returns the number of seconds to delay this flow by. Latency is only applied on the
+    # request, so it represents the extra round-trip time.
+    def delay_for(self, flow, content, include_latency: bool) -> float:
+        delay = 0.0
+        for c in self.conditions:
+            if not flowfilter.match(c["filter"], flow):
+                continue
+            if include_latency:
+                delay += c["latency_ms"] / 1000
+            if c["bandwidth_bytes_per_sec"] > 0 and content:
+                delay += len(content) / c["bandwidth_bytes_per_sec"]
+        return delay
+
+    async def request(self, flow):
+        # always ignore the controller
+        if flow.request.pretty_host == MITM_DOMAIN_NAME:
+            return
+        delay = self.delay_for(flow, flow.request.raw_content, True)
+        if delay > 0:
+            await asyncio.sleep(delay)
+
+    async def response(self, flow):
+        # always ignore the controller
+        if flow.request.pretty_host == MITM_DOMAIN_NAME:
+            return
+        delay = self.delay_for(flow, flow.response.raw_content, False)
+        if delay > 0:
+            await asyncio.sleep(delay)
+
+network = Network()
+register_shared_option("network", network)
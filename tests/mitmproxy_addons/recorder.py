@@ -0,0 +1,78 @@
+import base64
+from mitmproxy import ctx
+from controller import MITM_DOMAIN_NAME, register_shared_option
+
+# See README.md for information about this addon
+class Recorder:
+    def __init__(self):
+        # lock ID => list of recorded flows. Replaced rather than modified when the option changes, as it is
+        # read whilst handling flows.
+        self.recordings = {}
+
+    def load(self, loader):
+        loader.add_option(
+            name="recordings",
+            typespec=dict,
+            default={},
+            help="Record every flow, keyed on the lock ID which started the recording",
+        )
+
+    def configure(self, updates):
+        if "recordings" not in updates:
+            return
+        recordings = {}
+        for recording_id in ctx.options.recordings:
+            if recording_id not in self.recordings:
+                print(f"starting recording {recording_id}")
+            recordings[recording_id] = self.recordings.get(recording_id, [])
+        self.recordings = recordings
+
+    # Returns every flow recorded since the recording started.
+    def unlocked(self, recording_id: str) -> dict:
+        flows = self.recordings[recording_id]
+        print(f"stopping recording {recording_id}, recorded {len(flows)} flows")
+        return {
+            "flows": flows,
+        }
+
+    def record(self, flow, error: str):
+        # always ignore the controller
+        if flow.request.pretty_host == MITM_DOMAIN_NAME:
+            return
+        recordings = self.recordings
+        if len(recordings) == 0:
+            return
+        recorded = {
+            "request_ts": int(flow.request.timestamp_start * 1000),
+            "method": flow.request.method,
+            "url": flow.request.url,
+            "request_headers": headers_to_dict(flow.request.headers),
+            # decoded, so replayed responses don't need to be compressed
+            "request_body": base64.b64encode(flow.request.get_content(strict=False) or b"").decode("ascii"),
+        }
+        if flow.response is not None:
+            recorded["response_ts"] = int((flow.response.timestamp_end or flow.response.timestamp_start) * 1000)
+            recorded["response_code"] = flow.response.status_code
+            recorded["response_headers"] = headers_to_dict(flow.response.headers)
+            recorded["response_body"] = base64.b64encode(flow.response.get_content(strict=False) or b"").decode("ascii")
+        if error:
+            recorded["error"] = error
+        for flows in recordings.values():
+            flows.append(recorded)
+
+    # this addon is loaded last, so this sees the response after any other addon has modified it
+    def response(self, flow):
+        self.record(flow, "")
+
+    # e.g the connection was killed by the chaos addon, or the server went away
+    def error(self, flow):
+        self.record(flow, flow.error.msg if flow.error else "unknown error")
+
+def headers_to_dict(headers) -> dict:
+    d = {}
+    for k, v in headers.fields:
+        d.setdefault(k.decode("utf-8", "replace"), []).append(v.decode("utf-8", "replace"))
+    return d
+
+recorder = Recorder()
+register_shared_option("recordings", recorder)
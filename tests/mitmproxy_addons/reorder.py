@@ -0,0 +1,125 @@
+import json
+import time
+from mitmproxy import ctx, flowfilter
+from controller import MITM_DOMAIN_NAME, register_shared_option
+
+# See README.md for information about this addon
+class Reorder:
+    def __init__(self):
+        # lock ID => reorder. Replaced rather than modified when the option changes, as it is read whilst
+        # handling flows.
+        self.reorders = {}
+
+    def load(self, loader):
+        loader.add_option(
+            name="reorder",
+            typespec=dict,
+            default={},
+            help="Deliver to-device messages out of order, keyed on the lock ID which set the reorder",
+        )
+
+    def configure(self, updates):
+        if "reorder" not in updates:
+            return
+        reorders = {}
+        for reorder_id, reorder in ctx.options.reorder.items():
+            if reorder_id in self.reorders:
+                reorders[reorder_id] = self.reorders[reorder_id]
+                continue
+            f = reorder.get("filter", None)
+            reorders[reorder_id] = {
+                "filter": flowfilter.parse(f) if f else flowfilter.parse("."),
+                "event_type": reorder.get("event_type", ""),
+                "hold": reorder.get("hold", 0) or 1,
+                "max_hold": (reorder.get("max_hold_ms", 0) or 5000) / 1000,
+                # the to-device events being held back, and when the first one was held
+                "held": [],
+                "held_since": 0,
+                # true if events sent after the held events have been delivered
+                "overtaken": False,
+                "reordered": 0,
+                # set when the reorder is unlocked. Removed reorders are kept until their held events are released.
+                "removed": False,
+            }
+            print(f"adding reorder {reorder_id} => {reorder}")
+        for reorder_id, r in self.reorders.items():
+            if reorder_id in reorders or len(r["held"]) == 0:
+                continue
+            r["removed"] = True
+            reorders[reorder_id] = r
+        self.reorders = reorders
+
+    # Returns how many times held events were delivered after newer ones.
+    def unlocked(self, reorder_id: str) -> dict:
+        r = self.reorders[reorder_id]
+        print(f"removing reorder {reorder_id}, reordered {r['reordered']} times, {len(r['held'])} events still held")
+        return {
+            "reordered": r["reordered"],
+        }
+
+    def response(self, flow):
+        # always ignore the controller
+        if flow.request.pretty_host == MITM_DOMAIN_NAME:
+            return
+        if len(self.reorders) == 0 or flow.response is None or flow.response.status_code != 200:
+            return
+        try:
+            body = flow.response.json()
+        except:
+            return
+        to_device = to_device_section(body)
+        if to_device is None:
+            return
+        events = to_device.get("events", [])
+        changed = False
+        now = time.monotonic()
+        for reorder_id, r in self.reorders.items():
+            # removed reorders which have released their events are dropped when the option next changes
+            if (r["removed"] and len(r["held"]) == 0) or not flowfilter.match(r["filter"], flow):
+                continue
+            if not r["removed"] and len(r["held"]) < r["hold"]:
+                remaining = []
+                for ev in events:
+                    if len(r["held"]) < r["hold"] and (r["event_type"] == "" or ev.get("type") == r["event_type"]):
+                        if len(r["held"]) == 0:
+                            r["held_since"] = now
+                        r["held"].append(ev)
+                        r["overtaken"] = False
+                    else:
+                        if len(r["held"]) > 0:
+                            # this event was sent after the held events, but will be delivered before them
+                            r["overtaken"] = True
+                        remaining.append(ev)
+                if len(remaining) != len(events):
+                    print(f"reorder {reorder_id} holding back {len(events) - len(remaining)} events")
+                    changed = True
+                events = remaining
+            elif len(events) > 0:
+                r["overtaken"] = True
+            if len(r["held"]) > 0:
+                # deliver the held events after the newer ones, or if we've waited long enough.
+                full = len(r["held"]) >= r["hold"]
+                if (full and r["overtaken"]) or r["removed"] or now - r["held_since"] >= r["max_hold"]:
+                    if r["overtaken"]:
+                        r["reordered"] += 1
+                    print(f"reorder {reorder_id} releasing {len(r['held'])} events after {len(events)} newer events")
+                    events = events + r["held"]
+                    r["held"] = []
+                    r["overtaken"] = False
+                    changed = True
+        if not changed:
+            return
+        to_device["events"] = events
+        flow.response.text = json.dumps(body)
+
+# Returns the object containing to-device events in a /sync response, or None if there isn't one. Sync v2
+# responses always have one. Sliding sync responses only have one if the to_device extension is enabled.
+def to_device_section(body):
+    if "extensions" in body:
+        return body["extensions"].get("to_device", None)
+    if "next_batch" in body:
+        return body.setdefault("to_device", {})
+    return None
+
+reorder = Reorder()
+register_shared_option("reorder", reorder)
@@ -0,0 +1,120 @@
+import json
+from mitmproxy import ctx, exceptions, flowfilter
+from controller import MITM_DOMAIN_NAME, register_shared_option
+
+# Parse an RFC 6901 JSON pointer e.g "/device_keys/@alice:hs1/DEVICE/keys" into its reference tokens.
+def parse_pointer(pointer: str) -> list:
+    if pointer == "":
+        return []
+    if not pointer.startswith("/"):
+        raise ValueError(f"JSON pointer {pointer} must start with '/'")
+    return [t.replace("~1", "/").replace("~0", "~") for t in pointer[1:].split("/")]
+
+# Set the value at the JSON pointer tokens in doc, returning True if it was set. Objects along the way must
+# already exist, but the final member is added if it is missing. For arrays, the final token may be "-" to append.
+def set_pointer(doc, tokens: list, value) -> bool:
+    parent = doc
+    for token in tokens[:-1]:
+        if isinstance(parent, dict) and token in parent:
+            parent = parent[token]
+        elif isinstance(parent, list) and token.isdigit() and int(token) < len(parent):
+            parent = parent[int(token)]
+        else:
+            return False
+    last = tokens[-1]
+    if isinstance(parent, dict):
+        parent[last] = value
+        return True
+    if isinstance(parent, list):
+        if last == "-":
+            parent.append(value)
+            return True
+        if last.isdigit() and int(last) < len(parent):
+            parent[int(last)] = value
+            return True
+    return False
+
+# See README.md for information about this addon
+class Rewrites:
+    def __init__(self):
+        # lock ID => rewrite. Replaced rather than modified when the option changes, as it is read whilst
+        # handling flows.
+        self.rewrites = {}
+
+    def load(self, loader):
+        loader.add_option(
+            name="rewrites",
+            typespec=dict,
+            default={},
+            help="Replace values in JSON bodies, keyed on the lock ID which set the rewrite",
+        )
+
+    def configure(self, updates):
+        if "rewrites" not in updates:
+            return
+        rewrites = {}
+        # dicts keep their insertion order, so rewrites are applied in the order they were locked
+        for rewrite_id, rewrite in ctx.options.rewrites.items():
+            if rewrite_id in self.rewrites:
+                rewrites[rewrite_id] = self.rewrites[rewrite_id]
+                continue
+            try:
+                tokens = parse_pointer(rewrite.get("pointer", ""))
+            except ValueError as e:
+                raise exceptions.OptionsError(str(e))
+            f = rewrite.get("filter", None)
+            rewrites[rewrite_id] = {
+                "filter": flowfilter.parse(f) if f else flowfilter.parse("."),
+                "phase": rewrite.get("phase", "") or "response",
+                "pointer": rewrite.get("pointer", ""),
+                "tokens": tokens,
+                "value": rewrite.get("value", None),
+                "count": rewrite.get("count", 0),
+                "rewritten": 0,
+            }
+            print(f"adding rewrite {rewrite_id} => {rewrite}")
+        self.rewrites = rewrites
+
+    # Returns how many responses were rewritten.
+    def unlocked(self, rewrite_id: str) -> dict:
+        rewrite = self.rewrites[rewrite_id]
+        print(f"removing rewrite {rewrite_id}, rewrote {rewrite['rewritten']} responses")
+        return {
+            "rewritten": rewrite["rewritten"],
+        }
+
+    def response(self, flow):
+        self.rewrite(flow, flow.response, "response")
+
+    # Rewrites in the request phase change the request body before it reaches the server.
+    def request(self, flow):
+        self.rewrite(flow, flow.request, "request")
+
+    def rewrite(self, flow, message, phase: str):
+        # always ignore the controller
+        if flow.request.pretty_host == MITM_DOMAIN_NAME:
+            return
+        body = None
+        modified = False
+        for rewrite_id, rewrite in self.rewrites.items():
+            if rewrite["phase"] != phase or not flowfilter.match(rewrite["filter"], flow):
+                continue
+            if rewrite["count"] > 0 and rewrite["rewritten"] >= rewrite["count"]:
+                continue
+            if body is None:
+                try:
+                    body = json.loads(message.get_text())
+                except (ValueError, TypeError):
+                    return # not JSON, so there is nothing to rewrite
+            if len(rewrite["tokens"]) == 0:
+                body = rewrite["value"]
+            elif not set_pointer(body, rewrite["tokens"], rewrite["value"]):
+                continue
+            rewrite["rewritten"] += 1
+            modified = True
+            print(f"rewrite {rewrite_id} set {rewrite['pointer']} in {flow.request.method} {flow.request.path} {phase}")
+        if modified:
+            message.text = json.dumps(body)
+
+rewrites = Rewrites()
+register_shared_option("rewrites", rewrites)
@@ -0,0 +1,49 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that room keys sent via to-device messages still arrive in order when the network is slow. The room
+// rotates the room key on every message, with latency on Alice's homeserver and Bob's bandwidth limited.
+func TestRoomKeysArriveUnderDegradedNetwork(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+			cc.EncRoomOptions.RotationPeriodMsgs(1),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			network := tc.Deployment.Network(t)
+			network.SetLatency(clientTypeA.HS, 300*time.Millisecond)
+			network.SetClientBandwidth(bob.CurrentAccessToken(t), 50*1024)
+
+			var eventIDs []string
+			for i := 0; i < 5; i++ {
+				body := fmt.Sprintf("Slow network message %d", i)
+				waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(body))
+				eventIDs = append(eventIDs, alice.MustSendMessage(t, roomID, body))
+				waiter.Waitf(t, 10*time.Second, "bob did not see alice's message '%s' under degraded network", body)
+			}
+			for i, eventID := range eventIDs {
+				ev := bob.MustGetEvent(t, roomID, eventID)
+				must.Equal(t, ev.FailedToDecrypt, false, "bob failed to decrypt message under degraded network")
+				must.Equal(t, ev.Text, fmt.Sprintf("Slow network message %d", i), "bob saw the wrong text")
+			}
+
+			// the network recovers
+			network.Reset()
+			waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody("Network recovered"))
+			alice.MustSendMessage(t, roomID, "Network recovered")
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's message after the network recovered")
+		})
+	})
+}
@@ -0,0 +1,93 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that encrypted events can be decrypted via the push notification code path, which fetches the event
+// itself rather than using the timeline. See ./rust/notification_test.go for tests which run this in a
+// separate process.
+func TestEncryptedEventsAreDecryptableViaNotifications(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			body := "Decrypt me via a notification"
+			waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(body))
+			evID := alice.MustSendMessage(t, roomID, body)
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's message")
+
+			notif, err := bob.GetNotification(t, roomID, evID)
+			if err != nil {
+				if errors.Is(err, api.ErrNotSupported) {
+					t.Skipf("%s cannot get notifications: %s", clientTypeB.Lang, err)
+				}
+				ct.Fatalf(t, "GetNotification: %s", err)
+			}
+			must.Equal(t, notif.ID, evID, "notification is for the wrong event")
+			must.Equal(t, notif.Sender, alice.UserID(), "notification has the wrong sender")
+			must.Equal(t, notif.FailedToDecrypt, false, "bob failed to decrypt the notification")
+			must.Equal(t, notif.Text, body, "notification has the wrong body")
+		})
+	})
+}
+
+// Test that push rules which match on the content of events are evaluated against the decrypted event, as the
+// server cannot see the content of encrypted events so notifies the client about every one of them.
+func TestKeywordPushRulesMatchDecryptedContent(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+		// set the rule before Bob's client syncs, so it has the rule from the start
+		tc.Bob.MustSetKeywordPushRule(t, "pineapple", "pineapple")
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			keywordBody := "Does pineapple belong on pizza?"
+			otherBody := "No keywords here"
+			waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(otherBody))
+			keywordEventID := alice.MustSendMessage(t, roomID, keywordBody)
+			otherEventID := alice.MustSendMessage(t, roomID, otherBody)
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's messages")
+
+			for _, tt := range []struct {
+				eventID       string
+				body          string
+				wantHighlight bool
+			}{
+				{eventID: keywordEventID, body: keywordBody, wantHighlight: true},
+				{eventID: otherEventID, body: otherBody, wantHighlight: false},
+			} {
+				notif, err := bob.GetNotification(t, roomID, tt.eventID)
+				if err != nil {
+					if errors.Is(err, api.ErrNotSupported) {
+						t.Skipf("%s cannot get notifications: %s", clientTypeB.Lang, err)
+					}
+					ct.Fatalf(t, "GetNotification: %s", err)
+				}
+				must.Equal(t, notif.FailedToDecrypt, false, "bob failed to decrypt the notification")
+				must.Equal(t, notif.Text, tt.body, "notification has the wrong body")
+				if notif.HasMentions == nil {
+					t.Skipf("%s does not say if notifications are highlighted", clientTypeB.Lang)
+				}
+				must.Equal(t, *notif.HasMentions, tt.wantHighlight, "notification for '"+tt.body+"' has the wrong highlight")
+				if tt.wantHighlight && notif.IsNoisy != nil {
+					must.Equal(t, *notif.IsNoisy, true, "notification for the keyword is not noisy")
+				}
+			}
+		})
+	})
+}
@@ -0,0 +1,78 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that a client which logged in via OIDC can keep sending and receiving encrypted messages after
+// its access token expires. The homeserver delegates authentication to MAS with short-lived access tokens.
+func TestOIDCClientCanRefreshAccessToken(t *testing.T) {
+	Instance().ForEachClientType(t, func(t *testing.T, clientType api.ClientType) {
+		tc := Instance().CreateTestContext(t, api.ClientType{
+			Lang: clientType.Lang,
+			HS:   "hs1",
+		})
+		// MAS does not allow shorter access token lifetimes than this
+		accessTokenTTL := time.Minute
+		oidcHS := tc.Deployment.NewOIDCHomeserver(t, accessTokenTTL)
+		bob := &cc.User{
+			CSAPI: oidcHS.Register(t, helpers.RegistrationOpts{
+				LocalpartSuffix: "bob",
+				Password:        "complement-crypto-password",
+			}),
+			ClientType: api.ClientType{
+				Lang: clientType.Lang,
+				HS:   oidcHS.ServerName,
+			},
+		}
+		bobClient := tc.MustCreateClient(t, &cc.ClientCreationRequest{
+			User: bob,
+			Opts: api.ClientCreationOpts{
+				UseOIDC: true,
+			},
+		})
+		defer bobClient.Close(t)
+		if err := bobClient.Login(t, bobClient.Opts()); err != nil {
+			if errors.Is(err, api.ErrNotSupported) {
+				t.Skipf("OIDC login unsupported: %s", err)
+			}
+			ct.Fatalf(t, "Login: %s", err)
+		}
+		stopSyncing := bobClient.MustStartSyncing(t)
+		defer stopSyncing()
+
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, cc.EncRoomOptions.Invite([]string{bob.UserID}))
+		bobClient.MustJoinRoom(t, roomID, []string{"hs1"})
+
+		tc.WithAliceSyncing(t, func(alice api.TestClient) {
+			wantMsgBody := "Hello OIDC user"
+			waiter := bobClient.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+			alice.MustSendMessage(t, roomID, wantMsgBody)
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's message '%s'", wantMsgBody)
+			oldAccessToken := bobClient.CurrentAccessToken(t)
+
+			t.Logf("waiting %v for bob's access token to expire", accessTokenTTL)
+			time.Sleep(accessTokenTTL + 5*time.Second)
+
+			wantMsgBody = "Sent after my access token expired"
+			waiter = alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+			bobClient.MustSendMessage(t, roomID, wantMsgBody)
+			waiter.Waitf(t, 5*time.Second, "alice did not see bob's message '%s'", wantMsgBody)
+
+			wantMsgBody = "Received after your access token expired"
+			waiter = bobClient.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+			alice.MustSendMessage(t, roomID, wantMsgBody)
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's message '%s'", wantMsgBody)
+
+			must.NotEqual(t, bobClient.CurrentAccessToken(t), oldAccessToken, "bob's access token was not refreshed")
+		})
+	})
+}
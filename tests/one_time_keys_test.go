@@ -1,6 +1,7 @@
 package tests
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"sync/atomic"
@@ -17,66 +18,8 @@ import (
 	"github.com/matrix-org/complement/helpers"
 	"github.com/matrix-org/complement/match"
 	"github.com/matrix-org/complement/must"
-	"github.com/tidwall/gjson"
 )
 
-func mustClaimFallbackKey(t *testing.T, claimer *client.CSAPI, target *cc.User) (fallbackKeyID string, keyJSON gjson.Result) {
-	t.Helper()
-	res := claimer.MustDo(t, "POST", []string{
-		"_matrix", "client", "v3", "keys", "claim",
-	}, client.WithJSONBody(t, map[string]any{
-		"one_time_keys": map[string]any{
-			target.UserID: map[string]any{
-				target.DeviceID: "signed_curve25519",
-			},
-		},
-	}))
-	defer res.Body.Close()
-	result := must.ParseJSON(t, res.Body)
-	otks := result.Get(fmt.Sprintf(
-		"one_time_keys.%s.%s", client.GjsonEscape(target.UserID), client.GjsonEscape(target.DeviceID),
-	))
-	if !otks.Exists() {
-		ct.Fatalf(t, "failed to claim a OTK for %s|%s: no entry exists in the response to /keys/claim, got %v", target.UserID, target.DeviceID, result.Raw)
-	}
-	fallbackKey := otks.Get("signed_curve25519*")
-	// check it's the fallback key
-	must.MatchGJSON(t, fallbackKey, match.JSONKeyEqual("fallback", true))
-	for keyID := range otks.Map() {
-		fallbackKeyID = keyID
-	}
-	return fallbackKeyID, fallbackKey
-}
-
-func mustClaimOTKs(t *testing.T, claimer *client.CSAPI, target *cc.User, otkCount int) {
-	t.Helper()
-	for i := 0; i < otkCount; i++ {
-		res := claimer.MustDo(t, "POST", []string{
-			"_matrix", "client", "v3", "keys", "claim",
-		}, client.WithJSONBody(t, map[string]any{
-			"one_time_keys": map[string]any{
-				target.UserID: map[string]any{
-					target.DeviceID: "signed_curve25519",
-				},
-			},
-		}))
-		// check each key is not the fallback key
-		must.MatchResponse(t, res, match.HTTPResponse{
-			StatusCode: 200,
-			JSON: []match.JSON{
-				match.JSONKeyMissing(
-					fmt.Sprintf(
-						"one_time_keys.%s.%s.signed_curve25519*.fallback", client.GjsonEscape(target.UserID), client.GjsonEscape(target.DeviceID),
-					),
-				),
-				match.JSONKeyPresent(fmt.Sprintf(
-					"one_time_keys.%s.%s.signed_curve25519*", client.GjsonEscape(target.UserID), client.GjsonEscape(target.DeviceID),
-				)),
-			},
-		})
-	}
-}
-
 // - Alice logs in, uploads OTKs AND A FALLBACK KEY (which is what this is trying to test!)
 // - Block all /keys/upload
 // - Manually claim all OTKs in the test.
@@ -86,10 +29,7 @@ func mustClaimOTKs(t *testing.T, claimer *client.CSAPI, target *cc.User, otkCoun
 func TestFallbackKeyIsUsedIfOneTimeKeysRunOut(t *testing.T) {
 	Instance().ClientTypeMatrix(t, func(t *testing.T, keyProviderClientType, keyConsumerClientType api.ClientType) {
 		tc := Instance().CreateTestContext(t, keyProviderClientType, keyConsumerClientType, keyConsumerClientType)
-		otkGobbler := tc.Deployment.Register(t, keyConsumerClientType.HS, helpers.RegistrationOpts{
-			LocalpartSuffix: "eater_of_keys",
-			Password:        "complement-crypto-password",
-		})
+		otkGobbler := tc.RegisterNewUser(t, keyConsumerClientType, "eater_of_keys")
 
 		// SDK testing below
 		// =================
@@ -102,27 +42,18 @@ func TestFallbackKeyIsUsedIfOneTimeKeysRunOut(t *testing.T) {
 			tc.Alice.MustCreateRoom(t, map[string]interface{}{})
 
 			// Query OTK count so we know how many to consume
-			res, _ := tc.Alice.MustSync(t, client.SyncReq{})
-			otkCount := res.Get("device_one_time_keys_count.signed_curve25519").Int()
+			otkCount := tc.Alice.MustGetOTKCount(t)
 			t.Logf("uploaded otk count => %d", otkCount)
 
 			var roomID string
 			var waiter api.Waiter
-			// Block all /keys/upload requests for Alice
-			tc.Deployment.MITM().Configure(t).WithIntercept(mitm.InterceptOpts{
-				Filter: mitm.FilterParams{
-					PathContains: "/keys/upload",
-					Method:       "POST",
-					AccessToken:  alice.CurrentAccessToken(t),
-				},
-				RequestCallback: callback.SendError(0, http.StatusGatewayTimeout),
-			}, func() {
+			blockKeysUpload(t, tc, alice, func() {
 				// claim all OTKs
-				mustClaimOTKs(t, otkGobbler, tc.Alice, int(otkCount))
+				otkGobbler.MustClaimOTKs(t, tc.Alice.UserID, tc.Alice.DeviceID, otkCount)
 
 				// now claim the fallback key
-				fallbackKeyID, fallbackKey := mustClaimFallbackKey(t, otkGobbler, tc.Alice)
-				t.Logf("claimed fallback key %s => %s", fallbackKeyID, fallbackKey.Raw)
+				fallbackKey := otkGobbler.MustClaimFallbackKey(t, tc.Alice.UserID, tc.Alice.DeviceID)
+				t.Logf("claimed fallback key %s => %s", fallbackKey.KeyID, fallbackKey.Key.Raw)
 
 				// now bob & charlie try to talk to alice, the fallback key should be used
 				roomID = tc.CreateNewEncryptedRoom(
@@ -140,9 +71,7 @@ func TestFallbackKeyIsUsedIfOneTimeKeysRunOut(t *testing.T) {
 				charlie.MustSendMessage(t, roomID, "Goodbye world!")
 				waiter = alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody("Hello world!"))
 				// ensure that /keys/upload is actually blocked (OTK count should be 0)
-				res, _ := tc.Alice.MustSync(t, client.SyncReq{})
-				otkCount := res.Get("device_one_time_keys_count.signed_curve25519").Int()
-				must.Equal(t, otkCount, 0, "OTKs were uploaded when they should have been blocked by mitmproxy")
+				must.Equal(t, tc.Alice.MustGetOTKCount(t), 0, "OTKs were uploaded when they should have been blocked by mitmproxy")
 			})
 			// rust sdk needs /keys/upload to 200 OK before it will decrypt the hello world msg,
 			// so only wait _after_ we have unblocked the endpoint.
@@ -156,6 +85,83 @@ func TestFallbackKeyIsUsedIfOneTimeKeysRunOut(t *testing.T) {
 	})
 }
 
+// Test that clients keep working when their one-time keys run out mid-conversation. Whilst Alice cannot upload
+// more keys, Charlie has to use her fallback key and Bob keeps using his existing Olm session.
+func TestOneTimeKeysRunOutMidConversation(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, keyProviderClientType, keyConsumerClientType api.ClientType) {
+		tc := Instance().CreateTestContext(t, keyProviderClientType, keyConsumerClientType, keyConsumerClientType)
+		otkGobbler := tc.RegisterNewUser(t, keyConsumerClientType, "eater_of_keys")
+		roomID := tc.CreateNewEncryptedRoom(
+			t,
+			tc.Alice,
+			cc.EncRoomOptions.PresetPublicChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID, tc.Charlie.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{keyProviderClientType.HS})
+		tc.Charlie.MustJoinRoom(t, roomID, []string{keyProviderClientType.HS})
+
+		tc.WithAliceBobAndCharlieSyncing(t, func(alice, bob, charlie api.TestClient) {
+			// Charlie must not send anything yet, else he would have an Olm session with Alice.
+			waiter := alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody("Before OTKs run out"))
+			bob.MustSendMessage(t, roomID, "Before OTKs run out")
+			waiter.Waitf(t, 5*time.Second, "alice did not see bob's message before her OTKs ran out")
+
+			blockKeysUpload(t, tc, alice, func() {
+				claimed, fallbackKey := otkGobbler.MustExhaustOTKs(t, tc.Alice.UserID, tc.Alice.DeviceID)
+				if fallbackKey == nil {
+					ct.Fatalf(t, "alice did not upload a fallback key, claimed %d OTKs", claimed)
+				}
+				t.Logf("claimed %d OTKs then fallback key %s", claimed, fallbackKey.KeyID)
+				must.Equal(t, tc.Alice.MustGetOTKCount(t), 0, "alice has OTKs after they were all claimed")
+
+				waiter = alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody("Using the fallback key"))
+				charlie.MustSendMessage(t, roomID, "Using the fallback key")
+				waiter.Waitf(t, 5*time.Second, "alice did not see charlie's message sent with her fallback key")
+
+				// the client is told via /sync, which may happen after the message is decrypted.
+				mustSeeFallbackKeyUsed(t, alice, 5*time.Second)
+
+				waiter = alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody("After OTKs run out"))
+				bob.MustSendMessage(t, roomID, "After OTKs run out")
+				waiter.Waitf(t, 5*time.Second, "alice did not see bob's message after her OTKs ran out")
+			})
+
+			// Alice should upload new OTKs now /keys/upload works. Keep sending messages to wake up her /sync,
+			// as that is where she finds out her OTK count.
+			for i := 0; tc.Alice.MustGetOTKCount(t) == 0; i++ {
+				if i >= 10 {
+					ct.Fatalf(t, "alice did not upload new OTKs after /keys/upload was unblocked")
+				}
+				bob.MustSendMessage(t, roomID, fmt.Sprintf("kick %d", i))
+				time.Sleep(500 * time.Millisecond)
+			}
+		})
+	})
+}
+
+// mustSeeFallbackKeyUsed waits until the client reports that its fallback key was used, else fails the test.
+// Skips the test if the client does not report this.
+func mustSeeFallbackKeyUsed(t *testing.T, cli api.TestClient, timeout time.Duration) {
+	t.Helper()
+	start := time.Now()
+	for {
+		used, err := cli.FallbackKeyUsed(t)
+		if err != nil {
+			if errors.Is(err, api.ErrNotSupported) {
+				t.Skipf("cannot check if %s saw its fallback key being used: %s", cli.Type(), err)
+			}
+			ct.Fatalf(t, "FallbackKeyUsed: %s", err)
+		}
+		if used {
+			return
+		}
+		if time.Since(start) > timeout {
+			ct.Fatalf(t, "%s was not told that its fallback key was used after %v", cli.Type(), timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
 func TestFailedOneTimeKeyUploadRetries(t *testing.T) {
 	Instance().ForEachClientType(t, func(t *testing.T, clientType api.ClientType) {
 		tc := Instance().CreateTestContext(t, clientType, clientType)
@@ -248,3 +254,17 @@ func TestFailedKeysClaimRetries(t *testing.T) {
 		})
 	})
 }
+
+// blockKeysUpload fails every /keys/upload request made by the client whilst inner runs, so it cannot upload
+// new one-time keys or a new fallback key.
+func blockKeysUpload(t *testing.T, tc *cc.TestContext, cli api.TestClient, inner func()) {
+	t.Helper()
+	tc.Deployment.MITM().Configure(t).WithIntercept(mitm.InterceptOpts{
+		Filter: mitm.FilterParams{
+			PathContains: "/keys/upload",
+			Method:       "POST",
+			AccessToken:  cli.CurrentAccessToken(t),
+		},
+		RequestCallback: callback.SendError(0, http.StatusGatewayTimeout),
+	}, inner)
+}
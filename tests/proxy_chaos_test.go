@@ -0,0 +1,29 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that clients keep syncing and can still decrypt messages after the reverse proxy repeatedly goes down.
+func TestClientsResumeSyncingAfterProxyRestarts(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			restarts := tc.Deployment.WithProxyChaos(t, 2*time.Second, 500*time.Millisecond, func() {
+				time.Sleep(8 * time.Second)
+			})
+			must.Equal(t, restarts > 0, true, "proxy was never restarted")
+			cc.MustHaveResumedSyncing(t, roomID, alice, bob)
+		})
+	})
+}
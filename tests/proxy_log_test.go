@@ -0,0 +1,58 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement-crypto/internal/deploy/callback"
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that the proxy log records what the server actually delivered down /sync, and
+// that this differs from what the client displays: the event is only ever m.room.encrypted.
+func TestProxyLogRecordsEncryptedSyncEvents(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, cc.EncRoomOptions.PresetTrustedPrivateChat(), cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}))
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			body := "Hello from the proxy log test"
+			var eventID string
+			proxyLog := recordProxyLog(t, tc, mitm.FilterParams{
+				PathContains: "/sync",
+				AccessToken:  bob.CurrentAccessToken(t),
+			}, func() {
+				waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(body))
+				eventID = alice.MustSendMessage(t, roomID, body)
+				waiter.Waitf(t, 5*time.Second, "bob did not see alice's message")
+			})
+
+			// Sync v2 puts events in rooms.join.$room_id.timeline.events, sliding sync puts them in
+			// rooms.$room_id.timeline, so search everywhere.
+			events := proxyLog.Query(t, "$..[?(@.event_id=='"+eventID+"')]")
+			must.Equal(t, len(events) > 0, true, "event was not sent down /sync")
+			for _, ev := range events {
+				must.Equal(t, ev.Get("type").Str, "m.room.encrypted", "event was not encrypted down /sync")
+				must.Equal(t, ev.Get("content.body").Exists(), false, "event content was sent in plaintext")
+			}
+			// the client displayed the decrypted text
+			ev := bob.MustGetEvent(t, roomID, eventID)
+			must.Equal(t, ev.FailedToDecrypt, false, "bob failed to decrypt the event")
+			must.Equal(t, ev.Text, body, "bob saw the wrong text")
+		})
+	})
+}
+
+// recordProxyLog records every request and response which matches the filter whilst inner runs.
+func recordProxyLog(t *testing.T, tc *cc.TestContext, filter mitm.FilterParams, inner func()) *callback.ProxyLog {
+	t.Helper()
+	proxyLog := callback.NewProxyLog()
+	tc.Deployment.MITM().Configure(t).WithIntercept(mitm.InterceptOpts{
+		Filter:           filter,
+		ResponseCallback: proxyLog.Callback(),
+	}, inner)
+	return proxyLog
+}
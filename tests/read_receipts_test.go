@@ -0,0 +1,62 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement-crypto/internal/deploy/callback"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test how clients send read receipts when the latest event in the room failed to decrypt. The spec allows
+// receipts for any event, so either the undecryptable event or the message before it may be marked as read, but
+// every SDK must behave the same way.
+func TestReadReceiptsForUndecryptableEvents(t *testing.T) {
+	// "undecryptable" or "decryptable" => the clients which sent the receipt for that message
+	receiptFor := make(map[string][]string)
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			body := "Bob can decrypt this"
+			waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(body))
+			decryptableEventID := alice.MustSendMessage(t, roomID, body)
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's message")
+
+			var undecryptableEventID string
+			malformEncryptedSends(t, tc, alice, callback.EncryptedContentMalformations[0].Input, func() {
+				undecryptableEventID = alice.MustSendMessage(t, roomID, "Bob cannot decrypt this")
+			})
+			bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasEventID(undecryptableEventID)).Waitf(
+				t, 5*time.Second, "bob did not see alice's malformed message",
+			)
+			ev := bob.MustGetEvent(t, roomID, undecryptableEventID)
+			must.Equal(t, ev.FailedToDecrypt, true, "bob decrypted alice's malformed message")
+
+			if err := bob.MarkAsRead(t, roomID); err != nil {
+				if errors.Is(err, api.ErrNotSupported) {
+					t.Skipf("%s cannot send read receipts: %s", clientTypeB.Lang, err)
+				}
+				ct.Fatalf(t, "MarkAsRead: %s", err)
+			}
+			eventID := cc.MustSeeReadReceipt(t, alice, roomID, bob.UserID(), decryptableEventID, undecryptableEventID)
+			outcome := "decryptable"
+			if eventID == undecryptableEventID {
+				outcome = "undecryptable"
+			}
+			t.Logf("%s sent a read receipt for the %s message", clientTypeB.Lang, outcome)
+			receiptFor[outcome] = append(receiptFor[outcome], string(clientTypeB.Lang))
+		})
+	})
+	if len(receiptFor) > 1 {
+		ct.Fatalf(t, "SDKs disagree on whether to send read receipts for undecryptable events: %v", receiptFor)
+	}
+}
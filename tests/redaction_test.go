@@ -0,0 +1,32 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+)
+
+// Test that redacting an encrypted event does not stop other users decrypting later messages, and record
+// whether the sender rotates its megolm session on redaction.
+func TestRedactionKeyCycling(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}))
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			wantMsgBody := "Bob can read this before it is redacted"
+			waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+			evID := alice.MustSendMessage(t, roomID, wantMsgBody)
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's message '%s'", wantMsgBody)
+
+			wantMsgBody = "Bob can read this after the redaction"
+			waiter = bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+			newEvID, rotated := tc.MustRedactAndSendMessage(t, alice, tc.Bob, roomID, evID, wantMsgBody)
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's message %s after the redaction", newEvID)
+			t.Logf("%s rotated megolm session on redaction: %v", clientTypeA.Lang, rotated)
+		})
+	})
+}
@@ -0,0 +1,188 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that clients reload their stores when they are restarted, rather than logging in again, so Alice keeps
+// the same device and can still decrypt old messages.
+func TestClientRestartReloadsStores(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}))
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+
+		tc.WithClientsSyncing(t, []*cc.ClientCreationRequest{
+			{
+				User: tc.Alice,
+				Opts: api.ClientCreationOpts{
+					PersistentStorage: true,
+				},
+			},
+			{
+				User: tc.Bob,
+			},
+		}, func(clients []api.TestClient) {
+			alice, bob := clients[0], clients[1]
+			wantMsgBody := "Alice can read this before restarting"
+			waiter := alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+			evID := bob.MustSendMessage(t, roomID, wantMsgBody)
+			waiter.Waitf(t, 5*time.Second, "alice did not see bob's message '%s'", wantMsgBody)
+
+			accessToken := alice.CurrentAccessToken(t)
+			if err := alice.Restart(t); err != nil {
+				if errors.Is(err, api.ErrNotSupported) {
+					t.Skipf("restarting clients unsupported: %s", err)
+				}
+				ct.Fatalf(t, "Restart: %s", err)
+			}
+			// a new login would have a new access token
+			must.Equal(t, alice.CurrentAccessToken(t), accessToken, "access token after restart")
+
+			// the room key must have been loaded from the crypto store
+			ev := alice.MustGetEvent(t, roomID, evID)
+			must.Equal(t, ev.FailedToDecrypt, false, "alice could not decrypt bob's message after restarting")
+			must.Equal(t, ev.Text, wantMsgBody, "message body after restart")
+
+			wantMsgBody = "Alice can read this after restarting"
+			waiter = alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+			bob.MustSendMessage(t, roomID, wantMsgBody)
+			waiter.Waitf(t, 5*time.Second, "alice did not see bob's message '%s' after restarting", wantMsgBody)
+		})
+	})
+}
+
+// Test that clients recover their crypto stores after crashing, even if they were killed whilst writing to them.
+// Alice crashes straight after sending a message, whilst the new room key may still be being stored.
+func TestClientRecoversFromCrash(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}))
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+
+		tc.WithClientsSyncing(t, []*cc.ClientCreationRequest{
+			{
+				User: tc.Alice,
+				Opts: api.ClientCreationOpts{
+					PersistentStorage: true,
+				},
+			},
+			{
+				User: tc.Bob,
+			},
+		}, func(clients []api.TestClient) {
+			alice, bob := clients[0], clients[1]
+			wantMsgBody := "Alice can read this before crashing"
+			waiter := alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+			evID := bob.MustSendMessage(t, roomID, wantMsgBody)
+			waiter.Waitf(t, 5*time.Second, "alice did not see bob's message '%s'", wantMsgBody)
+
+			accessToken := alice.CurrentAccessToken(t)
+			alice.MustSendMessage(t, roomID, "Alice is about to crash")
+			if err := alice.Kill(t); err != nil {
+				if errors.Is(err, api.ErrNotSupported) {
+					t.Skipf("killing clients unsupported: %s", err)
+				}
+				ct.Fatalf(t, "Kill: %s", err)
+			}
+			if err := alice.RestoreFromStorage(t); err != nil {
+				if errors.Is(err, api.ErrNotSupported) {
+					t.Skipf("restoring killed clients unsupported: %s", err)
+				}
+				ct.Fatalf(t, "RestoreFromStorage: %s", err)
+			}
+			// the stopSyncing function from WithClientsSyncing still stops the new sync loop.
+			alice.MustStartSyncing(t)
+			must.Equal(t, alice.CurrentAccessToken(t), accessToken, "access token after crashing")
+
+			ev := alice.MustGetEvent(t, roomID, evID)
+			must.Equal(t, ev.FailedToDecrypt, false, "alice could not decrypt bob's message after crashing")
+
+			wantMsgBody = "Bob can read this after Alice crashed"
+			waiter = bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+			alice.MustSendMessage(t, roomID, wantMsgBody)
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's message '%s'", wantMsgBody)
+
+			wantMsgBody = "Alice can read this after crashing"
+			waiter = alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+			bob.MustSendMessage(t, roomID, wantMsgBody)
+			waiter.Waitf(t, 5*time.Second, "alice did not see bob's message '%s' after crashing", wantMsgBody)
+		})
+	})
+}
+
+// Test that clients which encrypt their stores with a passphrase refuse to load them with the wrong passphrase,
+// rather than silently resetting them, and load them again with the right passphrase.
+func TestStorePassphraseIsRequiredToRestoreClient(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}))
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+
+		passphrase := "complement-crypto-store-passphrase"
+		tc.WithClientsSyncing(t, []*cc.ClientCreationRequest{
+			{
+				User: tc.Alice,
+				Opts: api.ClientCreationOpts{
+					PersistentStorage: true,
+					StorePassphrase:   passphrase,
+				},
+			},
+			{
+				User: tc.Bob,
+			},
+		}, func(clients []api.TestClient) {
+			alice, bob := clients[0], clients[1]
+			wantMsgBody := "Alice can read this before restarting"
+			waiter := alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+			evID := bob.MustSendMessage(t, roomID, wantMsgBody)
+			waiter.Waitf(t, 5*time.Second, "alice did not see bob's message '%s'", wantMsgBody)
+
+			accessToken := alice.CurrentAccessToken(t)
+			deviceID := alice.Opts().DeviceID
+			if err := alice.Kill(t); err != nil {
+				if errors.Is(err, api.ErrNotSupported) {
+					t.Skipf("killing clients unsupported: %s", err)
+				}
+				ct.Fatalf(t, "Kill: %s", err)
+			}
+			if err := alice.SetStorePassphrase(t, "the wrong passphrase"); err != nil {
+				if errors.Is(err, api.ErrNotSupported) {
+					t.Skipf("changing the store passphrase unsupported: %s", err)
+				}
+				ct.Fatalf(t, "SetStorePassphrase: %s", err)
+			}
+			err := alice.RestoreFromStorage(t)
+			if err != nil && errors.Is(err, api.ErrNotSupported) {
+				t.Skipf("restoring killed clients unsupported: %s", err)
+			}
+			if err == nil {
+				ct.Fatalf(t, "RestoreFromStorage with the wrong store passphrase succeeded, want an error")
+			}
+
+			alice.MustSetStorePassphrase(t, passphrase)
+			alice.MustRestoreFromStorage(t)
+			// the stopSyncing function from WithClientsSyncing still stops the new sync loop.
+			alice.MustStartSyncing(t)
+			must.Equal(t, alice.CurrentAccessToken(t), accessToken, "access token after restoring with the right passphrase")
+			must.Equal(t, alice.Opts().DeviceID, deviceID, "device ID after restoring with the right passphrase")
+
+			// the room key must still be in the crypto store
+			ev := alice.MustGetEvent(t, roomID, evID)
+			must.Equal(t, ev.FailedToDecrypt, false, "alice could not decrypt bob's message after restoring with the right passphrase")
+			must.Equal(t, ev.Text, wantMsgBody, "message body after restoring")
+
+			wantMsgBody = "Alice can read this after restoring"
+			waiter = alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+			bob.MustSendMessage(t, roomID, wantMsgBody)
+			waiter.Waitf(t, 5*time.Second, "alice did not see bob's message '%s' after restoring", wantMsgBody)
+		})
+	})
+}
@@ -0,0 +1,101 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement-crypto/internal/deploy/callback"
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that clients agree on which rooms are encrypted, and with which algorithm.
+func TestClientsAgreeOnRoomEncryption(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		encryptedRoomID := tc.CreateNewEncryptedRoom(t, tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, encryptedRoomID, []string{clientTypeA.HS})
+		unencryptedRoomID := tc.Alice.MustCreateRoom(t, map[string]interface{}{
+			"preset": "trusted_private_chat",
+			"invite": []string{tc.Bob.UserID},
+		})
+		tc.Bob.MustJoinRoom(t, unencryptedRoomID, []string{clientTypeA.HS})
+
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			for _, roomID := range []string{encryptedRoomID, unencryptedRoomID} {
+				alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasMembership(tc.Bob.UserID, "join")).Waitf(t, 5*time.Second, "alice did not see bob's join")
+				bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasMembership(tc.Bob.UserID, "join")).Waitf(t, 5*time.Second, "bob did not see his join")
+			}
+
+			algorithm := cc.MustAgreeOnRoomEncryption(t, encryptedRoomID, alice, bob)
+			if algorithm != "" {
+				must.Equal(t, algorithm, "m.megolm.v1.aes-sha2", "encryption algorithm")
+			}
+			isEncrypted, err := alice.IsRoomEncrypted(t, encryptedRoomID)
+			must.NotError(t, "IsRoomEncrypted", err)
+			must.Equal(t, isEncrypted, true, "alice does not think the encrypted room is encrypted")
+
+			must.Equal(t, cc.MustAgreeOnRoomEncryption(t, unencryptedRoomID, alice, bob), "", "unencrypted room has an algorithm")
+			isEncrypted, err = alice.IsRoomEncrypted(t, unencryptedRoomID)
+			must.NotError(t, "IsRoomEncrypted", err)
+			must.Equal(t, isEncrypted, false, "alice thinks the unencrypted room is encrypted")
+		})
+	})
+}
+
+// Test that CheckRoomEncryption notices when clients disagree on the encryption state of a room, by hiding the
+// m.room.encryption state from Bob as a malicious homeserver could.
+func TestCheckRoomEncryptionDetectsHiddenEncryptionState(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+
+		tc.WithAliceSyncing(t, func(alice api.TestClient) {
+			bob := tc.MustLoginClient(t, &cc.ClientCreationRequest{
+				User: tc.Bob,
+			})
+			defer bob.Close(t)
+			stripEncryption := callback.StripEvents("m.room.encryption")
+			tc.Deployment.MITM().Configure(t).WithIntercept(mitm.InterceptOpts{
+				Filter: mitm.FilterParams{
+					AccessToken: bob.CurrentAccessToken(t),
+				},
+				ResponseCallback: func(cd callback.Data) *callback.Response {
+					if strings.Contains(cd.URL, "/state/m.room.encryption") {
+						return &callback.Response{
+							RespondStatusCode: http.StatusNotFound,
+							RespondBody:       json.RawMessage(`{"errcode":"M_NOT_FOUND","error":"Event not found."}`),
+						}
+					}
+					if strings.Contains(cd.URL, "/sync") {
+						return stripEncryption(cd)
+					}
+					return nil
+				},
+			}, func() {
+				stopSyncing := bob.MustStartSyncing(t)
+				defer stopSyncing()
+				bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasMembership(tc.Bob.UserID, "join")).Waitf(t, 5*time.Second, "bob did not see his join")
+
+				_, err := cc.CheckRoomEncryption(t, roomID, alice, bob)
+				if err == nil {
+					ct.Fatalf(t, "CheckRoomEncryption: alice and bob agree on the room encryption, but bob never saw m.room.encryption")
+				}
+				t.Logf("CheckRoomEncryption returned: %s", err)
+			})
+		})
+	})
+}
@@ -0,0 +1,124 @@
+package tests
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/must"
+)
+
+// The directory checked in room key export fixtures are read from.
+const roomKeyFixturesDir = "testdata/room_keys"
+
+const roomKeyExportPassphrase = "complement-crypto-export-passphrase"
+
+// Test that room keys exported by one SDK can be imported by another, so Bob can decrypt a message sent
+// before he joined.
+func TestRoomKeysCanBeExportedAndImported(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, cc.EncRoomOptions.PresetPublicChat())
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			body := "Before Bob joins"
+			waiter := alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(body))
+			evID := alice.MustSendMessage(t, roomID, body)
+			waiter.Waitf(t, 5*time.Second, "alice did not see own message")
+
+			tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+			bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasMembership(bob.UserID(), "join")).Waitf(t, 5*time.Second, "bob did not see own join")
+			ev := cc.MustBackpaginateToEvent(t, bob, roomID, evID)
+			must.Equal(t, ev.FailedToDecrypt, true, "bob decrypted a message from before he joined")
+
+			export, err := alice.ExportRoomKeys(t, roomKeyExportPassphrase)
+			if err != nil {
+				if errors.Is(err, api.ErrNotSupported) {
+					t.Skipf("%s cannot export room keys: %s", clientTypeA.Lang, err)
+				}
+				ct.Fatalf(t, "ExportRoomKeys: %s", err)
+			}
+			sessionIDs := cc.MustDecryptRoomKeyExport(t, export, roomKeyExportPassphrase)
+			must.Equal(t, len(sessionIDs) > 0, true, "alice exported no room keys")
+
+			waiter = bob.WaitUntilDecryptionRetried(t, roomID, evID)
+			if err := bob.ImportRoomKeys(t, export, roomKeyExportPassphrase); err != nil {
+				if errors.Is(err, api.ErrNotSupported) {
+					t.Skipf("%s cannot import room keys: %s", clientTypeB.Lang, err)
+				}
+				ct.Fatalf(t, "ImportRoomKeys: %s", err)
+			}
+			waiter.Waitf(t, 5*time.Second, "bob did not decrypt alice's message after importing her room keys")
+			ev = bob.MustGetEvent(t, roomID, evID)
+			must.Equal(t, ev.Text, body, "bob decrypted the wrong body")
+		})
+	})
+}
+
+// Generate room key export fixtures, which are checked into ./testdata/room_keys so every SDK is tested against
+// importing them in TestRoomKeyExportFixturesCanBeImported. Only runs when COMPLEMENT_CRYPTO_ROOM_KEY_FIXTURES_DIR
+// is set. Set COMPLEMENT_CRYPTO_RPC_BINARY to generate fixtures from the SDKs in the RPC binary instead, e.g to make
+// a fixture from an old pinned SDK.
+func TestGenerateRoomKeyExportFixtures(t *testing.T) {
+	dir := Instance().RoomKeyFixturesDir(t)
+	Instance().ForEachClientType(t, func(t *testing.T, clientType api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientType)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, cc.EncRoomOptions.PresetTrustedPrivateChat())
+		// the RPC binary only has the rust and JS SDKs
+		multiprocess := tc.RPCBinaryPath != "" && clientType.Lang != api.ClientTypeNio
+		tc.WithClientSyncing(t, &cc.ClientCreationRequest{
+			User:         tc.Alice,
+			Multiprocess: multiprocess,
+		}, func(alice api.TestClient) {
+			body := "Exported"
+			waiter := alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(body))
+			alice.MustSendMessage(t, roomID, body)
+			waiter.Waitf(t, 5*time.Second, "alice did not see own message")
+
+			export, err := alice.ExportRoomKeys(t, roomKeyExportPassphrase)
+			if err != nil {
+				if errors.Is(err, api.ErrNotSupported) {
+					t.Skipf("%s cannot export room keys: %s", clientType.Lang, err)
+				}
+				ct.Fatalf(t, "ExportRoomKeys: %s", err)
+			}
+			cc.MustWriteRoomKeyExportFixture(t, dir, cc.RoomKeyExportFixture{
+				SDK:          clientType.Lang,
+				Multiprocess: multiprocess,
+				Passphrase:   roomKeyExportPassphrase,
+				SessionIDs:   cc.MustDecryptRoomKeyExport(t, export, roomKeyExportPassphrase),
+				Export:       string(export),
+			})
+		})
+	})
+}
+
+// Test that every SDK can import the checked in room key export fixtures, which may have been made by other SDKs
+// or older versions of the same SDK. See TestGenerateRoomKeyExportFixtures.
+func TestRoomKeyExportFixturesCanBeImported(t *testing.T) {
+	fixtures := cc.MustReadRoomKeyExportFixtures(t, roomKeyFixturesDir)
+	if len(fixtures) == 0 {
+		t.Skipf("no room key export fixtures in %s", roomKeyFixturesDir)
+	}
+	for name, fixture := range fixtures {
+		sessionIDs := cc.MustDecryptRoomKeyExport(t, []byte(fixture.Export), fixture.Passphrase)
+		must.Equal(t, strings.Join(sessionIDs, ","), strings.Join(fixture.SessionIDs, ","), name+": wrong session IDs")
+	}
+	Instance().ForEachClientType(t, func(t *testing.T, clientType api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientType)
+		tc.WithAliceSyncing(t, func(alice api.TestClient) {
+			for name, fixture := range fixtures {
+				err := alice.ImportRoomKeys(t, []byte(fixture.Export), fixture.Passphrase)
+				if err != nil {
+					if errors.Is(err, api.ErrNotSupported) {
+						t.Skipf("%s cannot import room keys: %s", clientType.Lang, err)
+					}
+					ct.Errorf(t, "failed to import %s exported by %s: %s", name, fixture.SDK, err)
+				}
+			}
+		})
+	})
+}
@@ -0,0 +1,75 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that a device does not share room keys with an unverified device belonging to the same user, when the
+// new device requests a key it missed.
+func TestRoomKeyRequestIsRefusedForUnverifiedDevice(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		if clientTypeA.HS != clientTypeB.HS {
+			t.Skipf("client A and B must be on the same HS as they are devices for the same user")
+			return
+		}
+		tc := Instance().CreateTestContext(t, clientTypeA)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, cc.EncRoomOptions.PresetPublicChat())
+
+		tc.WithAliceSyncing(t, func(alice api.TestClient) {
+			body := "An encrypted message"
+			waiter := alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(body))
+			evID := alice.MustSendMessage(t, roomID, body)
+			waiter.Waitf(t, 5*time.Second, "alice did not see own message %s", evID)
+
+			csapiAlice2 := tc.MustRegisterNewDevice(t, tc.Alice, "KEY_REQUESTER")
+			requester := tc.MustLoginClient(t, &cc.ClientCreationRequest{
+				User: &cc.User{
+					CSAPI:      csapiAlice2.CSAPI,
+					ClientType: clientTypeB,
+				},
+			})
+			defer requester.Close(t)
+			stopSyncing := requester.MustStartSyncing(t)
+			defer stopSyncing()
+
+			var ev *api.Event
+			for _, e := range requester.MustBackpaginate(t, roomID, 5) {
+				if e.ID == evID {
+					ev = e
+				}
+			}
+			if ev == nil {
+				ct.Fatalf(t, "new device did not see event %s after backpaginating", evID)
+			}
+			must.Equal(t, ev.FailedToDecrypt, true, "new device decrypted the event without requesting the room key")
+			// the event was sent before the new device existed, and there is no key backup
+			cc.MustFailToDecryptWithReason(t, requester, roomID, evID, api.DecryptionFailureReasonHistoricalKeyUnavailable)
+			if ev.SessionID == "" {
+				t.Skipf("%s does not expose the session ID of undecryptable events", clientTypeB.Lang)
+			}
+
+			if err := requester.RequestRoomKey(t, roomID, ev.SessionID); err != nil {
+				if errors.Is(err, api.ErrNotSupported) {
+					t.Skipf("room key requests unsupported: %s", err)
+				}
+				ct.Fatalf(t, "RequestRoomKey: %s", err)
+			}
+			// give alice time to respond to the request
+			requester.MustRemainUndecryptable(t, roomID, evID, 3*time.Second)
+
+			if err := requester.CancelRoomKeyRequest(t, roomID, ev.SessionID); err != nil {
+				if errors.Is(err, api.ErrNotSupported) {
+					t.Skipf("cancelling room key requests unsupported: %s", err)
+				}
+				ct.Fatalf(t, "CancelRoomKeyRequest: %s", err)
+			}
+		})
+	})
+}
@@ -2,13 +2,17 @@ package tests
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"slices"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/matrix-org/complement-crypto/internal/api"
 	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement-crypto/internal/deploy"
 	"github.com/matrix-org/complement-crypto/internal/deploy/callback"
 	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
 	"github.com/matrix-org/complement/client"
@@ -94,6 +98,74 @@ func TestRoomKeyIsCycledOnDeviceLogout(t *testing.T) {
 	})
 }
 
+// This test ensures we change the m.room_key when a server admin deletes a device, and that clients see the
+// device list update in a bounded time. Unlike TestRoomKeyIsCycledOnDeviceLogout, the deleted device does not
+// log out, so the only way the other clients learn about it is via the device list update.
+func TestRoomKeyIsCycledOnDeviceDeletedByAdmin(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(
+			t,
+			tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+
+		// Alice, Bob and Bob2 are in a room.
+		csapiBob2 := tc.MustRegisterNewDevice(t, tc.Bob, "DELETED_DEVICE")
+		bob2 := tc.MustLoginClient(t, &cc.ClientCreationRequest{
+			User: csapiBob2,
+		})
+		defer bob2.Close(t)
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			bob2StopSyncing := bob2.MustStartSyncing(t)
+			// check the room works
+			wantMsgBody := "Test Message"
+			waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+			waiter2 := bob2.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+			alice.MustSendMessage(t, roomID, wantMsgBody)
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's message")
+			waiter2.Waitf(t, 5*time.Second, "bob2 did not see alice's message")
+			bob2StopSyncing()
+
+			_, err := alice.GetDeviceIDs(t, tc.Bob.UserID)
+			canWaitForDeviceList := err == nil
+			if !canWaitForDeviceList && !errors.Is(err, api.ErrNotSupported) {
+				ct.Fatalf(t, "GetDeviceIDs: %s", err)
+			}
+			if canWaitForDeviceList {
+				alice.WaitUntilDeviceList(t, tc.Bob.UserID, api.CheckDeviceListContains("DELETED_DEVICE")).Waitf(
+					t, 5*time.Second, "alice does not know about bob2",
+				)
+			}
+
+			sniffToDeviceEvent(t, tc, func(pc *callback.PassiveChannel) {
+				// When an admin deletes bob2, without bob2 logging out
+				deletedAt := tc.MustDeleteDeviceAsAdmin(t, tc.Bob, "DELETED_DEVICE")
+
+				// Then Alice sees the device list update quickly
+				if canWaitForDeviceList {
+					alice.WaitUntilDeviceList(t, tc.Bob.UserID, api.CheckDeviceListExcludes("DELETED_DEVICE")).Waitf(
+						t, 5*time.Second, "alice did not see bob2 being deleted",
+					)
+					t.Logf("alice saw bob2 being deleted after %v", time.Since(deletedAt))
+				} else {
+					t.Logf("%s cannot report its device list, waiting 1s for the device list update", clientTypeA.Lang)
+					time.Sleep(time.Second)
+				}
+
+				// And negotiates a new room key for the next message
+				wantMsgBody = "Another Test Message"
+				waiter = bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+				alice.MustSendMessage(t, roomID, wantMsgBody)
+				waiter.Waitf(t, 5*time.Second, "bob did not see alice's new message")
+				pc.Recv(t, "did not see /sendToDevice event")
+			})
+		})
+	})
+}
+
 // The room key is cycled when `rotation_period_msgs` is met (default: 100).
 //
 // This test ensures we change the m.room_key when we have sent enough messages,
@@ -125,6 +197,10 @@ func TestRoomKeyIsCycledAfterEnoughMessages(t *testing.T) {
 				alice.MustSendMessage(t, roomID, wantMsgBody)
 				waiter.Waitf(t, 5*time.Second, "bob did not see alice's message '%s'", wantMsgBody)
 			}
+			sessionBefore := tryGetOutboundSessionInfo(t, alice, roomID)
+			if sessionBefore != nil {
+				must.Equal(t, sessionBefore.MessageIndex, 4, "outbound session was not used for the first 4 messages")
+			}
 
 			// Sniff calls to /sendToDevice to ensure we see the new room key being sent.
 			sniffToDeviceEvent(t, tc, func(pc *callback.PassiveChannel) {
@@ -149,6 +225,11 @@ func TestRoomKeyIsCycledAfterEnoughMessages(t *testing.T) {
 				// Then we did send out new keys
 				pc.Recv(t, "did not see /sendToDevice after sending rotation_period_msgs messages")
 			})
+			// And the outbound session actually changed
+			if sessionBefore != nil {
+				sessionAfter := alice.MustGetOutboundSessionInfo(t, roomID)
+				must.NotEqual(t, sessionAfter.SessionID, sessionBefore.SessionID, "outbound session was not rotated")
+			}
 		})
 	})
 }
@@ -164,6 +245,8 @@ func TestRoomKeyIsCycledAfterEnoughMessages(t *testing.T) {
 //
 // See https://gitlab.matrix.org/matrix-org/olm/blob/master/docs/megolm.md#lack-of-backward-secrecy
 func TestRoomKeyIsCycledAfterEnoughTime(t *testing.T) {
+	// this test spends most of its time sleeping, so run it alongside other tests
+	Instance().Parallel(t)
 	// if this is too high, the test takes needlessly long to complete.
 	// if this is too low, it can cause flakey test failures as various assertions in rust SDK
 	// around expired sessions fail.
@@ -222,6 +305,139 @@ func TestRoomKeyIsCycledAfterEnoughTime(t *testing.T) {
 	})
 }
 
+// The room key is cycled according to the latest `m.room.encryption` event, not the one the room was created with,
+// and changes to it by users who are not allowed to send it are ignored.
+func TestRoomKeyIsCycledAfterEncryptionConfigChanges(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		// private_chat so Bob cannot change the encryption config
+		roomID := tc.CreateNewEncryptedRoom(
+			t,
+			tc.Alice,
+			cc.EncRoomOptions.PresetPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+			cc.EncRoomOptions.RotationPeriodMsgs(100),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			for i := 0; i < 4; i++ {
+				wantMsgBody := fmt.Sprintf("Before the config changes %d", i)
+				waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+				alice.MustSendMessage(t, roomID, wantMsgBody)
+				waiter.Waitf(t, 5*time.Second, "bob did not see alice's message '%s'", wantMsgBody)
+			}
+			// Alice sees state changes before Bob's next message, so by the time she sees it she knows the latest config.
+			bobSendsSentinel := func(body string) {
+				waiter := alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(body))
+				bob.MustSendMessage(t, roomID, body)
+				waiter.Waitf(t, 5*time.Second, "alice did not see bob's message '%s'", body)
+			}
+
+			t.Run("unauthorized change is ignored", func(t *testing.T) {
+				res := tc.Bob.ChangeRoomEncryption(t, roomID, cc.EncRoomOptions.RotationPeriodMsgs(1))
+				must.Equal(t, res.StatusCode, http.StatusForbidden, "bob was allowed to change the encryption config")
+				bobSendsSentinel("Bob tried to change the config")
+				sessionBefore := tryGetOutboundSessionInfo(t, alice, roomID)
+
+				sniffToDeviceEvent(t, tc, func(pc *callback.PassiveChannel) {
+					wantMsgBody := "After bob tried to change the config"
+					waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+					alice.MustSendMessage(t, roomID, wantMsgBody)
+					waiter.Waitf(t, 5*time.Second, "bob did not see alice's message '%s'", wantMsgBody)
+					if got := pc.TryRecv(t); got != nil {
+						ct.Fatalf(t, "saw /sendToDevice after bob tried to change the encryption config, implying the room key was cycled")
+					}
+				})
+				if sessionBefore != nil {
+					sessionAfter := alice.MustGetOutboundSessionInfo(t, roomID)
+					must.Equal(t, sessionAfter.SessionID, sessionBefore.SessionID, "outbound session was rotated")
+				}
+			})
+
+			t.Run("authorized change is used for subsequent messages", func(t *testing.T) {
+				tc.Alice.MustChangeRoomEncryption(t, roomID, cc.EncRoomOptions.RotationPeriodMsgs(2))
+				bobSendsSentinel("Alice changed the config")
+				sessionBefore := tryGetOutboundSessionInfo(t, alice, roomID)
+
+				// Alice's session has already encrypted more than 2 messages, so clients which rotate eagerly
+				// or lazily will rotate within the next 2 messages.
+				sniffToDeviceEvent(t, tc, func(pc *callback.PassiveChannel) {
+					for i := 0; i < 2; i++ {
+						wantMsgBody := fmt.Sprintf("After alice changed the config %d", i)
+						waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+						alice.MustSendMessage(t, roomID, wantMsgBody)
+						waiter.Waitf(t, 5*time.Second, "bob did not see alice's message '%s'", wantMsgBody)
+					}
+					pc.Recv(t, "did not see /sendToDevice after lowering rotation_period_msgs")
+				})
+				if sessionBefore != nil {
+					sessionAfter := alice.MustGetOutboundSessionInfo(t, roomID)
+					must.NotEqual(t, sessionAfter.SessionID, sessionBefore.SessionID, "outbound session was not rotated")
+				}
+			})
+		})
+	})
+}
+
+// The room key is cycled when the rotation period is exceeded, even if the room was created with the
+// default rotation period of 1 week. The rotation period is shortened server-side by sending a new
+// m.room.encryption event, so the test does not need to wait a week.
+func TestRoomKeyIsCycledAfterClientRotationPeriod(t *testing.T) {
+	Instance().Parallel(t)
+	rotationPeriod := 3 * time.Second
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		// JS enforces a minimum rotation period, see TestRoomKeyIsCycledAfterEnoughTime.
+		if clientTypeA.Lang == api.ClientTypeJS {
+			t.Skipf("Skipping on JS since we require a custom Rust build to allow small rotation_period_ms")
+			return
+		}
+		if clientTypeA.Lang == api.ClientTypeNio {
+			t.Skipf("Skipping on nio since it always rotates sessions after a week, ignoring rotation_period_ms")
+			return
+		}
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(
+			t,
+			tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			tc.Alice.MustChangeRoomEncryption(t, roomID, cc.EncRoomOptions.RotationPeriodMs(int(rotationPeriod.Milliseconds())))
+			// Alice sees the state change before Bob's message, so she uses the new rotation period from now on.
+			wantMsgBody := "Alice shortened the rotation period"
+			waiter := alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+			bob.MustSendMessage(t, roomID, wantMsgBody)
+			waiter.Waitf(t, 5*time.Second, "alice did not see bob's message '%s'", wantMsgBody)
+			// Before we start, ensure some keys have already been sent, so we
+			// don't get a false positive.
+			wantMsgBody = "Before we start"
+			waiter = bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+			alice.MustSendMessage(t, roomID, wantMsgBody)
+			waiter.Waitf(t, 5*time.Second, "Did not see 'before we start' event in the room")
+
+			toDeviceLog := tc.Deployment.SniffToDevice(t, func() {
+				// When we wait 1+period seconds
+				time.Sleep(rotationPeriod + time.Second)
+
+				// And send another message
+				wantMsgBody = "After the time expires"
+				waiter = bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+				alice.MustSendMessage(t, roomID, wantMsgBody)
+				waiter.Waitf(t, 5*time.Second, "Did not see 'after the time expires' event in the room")
+			})
+			// Then a new room key was sent to Bob
+			roomKeyShares := toDeviceLog.Filter(func(msg deploy.ToDeviceMessage) bool {
+				return msg.EventType == "m.room.encrypted" && msg.UserID == tc.Bob.UserID
+			})
+			must.Equal(t, len(roomKeyShares), 1, "did not see a new room key sent to bob after the rotation period")
+		})
+	})
+}
+
 func TestRoomKeyIsCycledOnMemberLeaving(t *testing.T) {
 	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
 		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB, clientTypeB)
@@ -313,6 +529,57 @@ func TestRoomKeyIsNotCycled(t *testing.T) {
 					}
 				})
 			})
+			t.Run("on device display name change", func(t *testing.T) {
+				// Alice should see Bob's device list change, but as Bob's device keys are unchanged, Alice should
+				// NOT send a new room key to Bob.
+				bobDeviceListChanged := make(chan struct{}, 1)
+				cancel, err := alice.ListenForDeviceListChanges(t, func(userIDs []string) {
+					if slices.Contains(userIDs, bob.UserID()) {
+						select {
+						case bobDeviceListChanged <- struct{}{}:
+						default:
+						}
+					}
+				})
+				canListenForDeviceLists := err == nil
+				if !canListenForDeviceLists && !errors.Is(err, api.ErrNotSupported) {
+					ct.Fatalf(t, "ListenForDeviceListChanges: %s", err)
+				}
+				if canListenForDeviceLists {
+					defer cancel()
+				}
+				sniffToDeviceEvent(t, tc, func(pc *callback.PassiveChannel) {
+					err := bob.SetDeviceDisplayName(t, "Little Bobby Tables' Phone")
+					if err != nil {
+						if errors.Is(err, api.ErrNotSupported) {
+							t.Skipf("%s cannot set device display names: %s", clientTypeB.Lang, err)
+						}
+						ct.Fatalf(t, "SetDeviceDisplayName: %s", err)
+					}
+
+					// the device list update should propagate to Alice in a bounded time
+					if canListenForDeviceLists {
+						select {
+						case <-bobDeviceListChanged:
+						case <-time.After(5 * time.Second):
+							ct.Fatalf(t, "alice did not see bob's device list change after setting a device display name")
+						}
+					} else {
+						t.Logf("%s cannot listen for device list changes, waiting 1s for the device list update", clientTypeA.Lang)
+						time.Sleep(time.Second)
+					}
+
+					wantMsgBody = "Message after changing device display name"
+					waiter = bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+					alice.MustSendMessage(t, roomID, wantMsgBody)
+					waiter.Waitf(t, 5*time.Second, "bob did not see alice's message")
+
+					got := pc.TryRecv(t)
+					if got != nil {
+						ct.Fatalf(t, "saw /sendToDevice when changing device display name and sending a new message")
+					}
+				})
+			})
 			t.Run("on new device login", func(t *testing.T) {
 				if clientTypeA.HS == "hs2" || clientTypeB.HS == "hs2" {
 					// we sniff /sendToDevice and assume that the access_token is for HS1.
@@ -513,3 +780,51 @@ func testRoomKeyIsNotCycledOnClientRestartJS(t *testing.T, clientType api.Client
 		})
 	})
 }
+
+// Test that the room key is shared exactly once with each of the recipient's devices, and is not
+// reshared when more messages are sent with the same key.
+func TestRoomKeyIsSharedOncePerDevice(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(
+			t,
+			tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			toDeviceLog := tc.Deployment.SniffToDevice(t, func() {
+				for _, wantMsgBody := range []string{"First message", "Second message"} {
+					waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+					alice.MustSendMessage(t, roomID, wantMsgBody)
+					waiter.Waitf(t, 5*time.Second, "bob did not see alice's message '%s'", wantMsgBody)
+				}
+			})
+			roomKeyShares := toDeviceLog.Filter(func(msg deploy.ToDeviceMessage) bool {
+				return msg.EventType == "m.room.encrypted" && msg.UserID == tc.Bob.UserID
+			})
+			must.Equal(t, len(roomKeyShares), 1, "expected exactly one encrypted to-device message to bob")
+			must.Equal(t, roomKeyShares[0].DeviceID, tc.Bob.DeviceID, "room key was sent to the wrong device")
+		})
+	})
+}
+
+// tryGetOutboundSessionInfo returns the client's outbound session for the room, or nil if the client
+// cannot report it, so tests can make white-box assertions about rotation when possible.
+func tryGetOutboundSessionInfo(t *testing.T, client api.TestClient, roomID string) *api.OutboundSessionInfo {
+	t.Helper()
+	info, err := client.GetOutboundSessionInfo(t, roomID)
+	if err != nil {
+		if errors.Is(err, api.ErrNotSupported) {
+			t.Logf("%s cannot report outbound sessions: %s", client.Type(), err)
+			return nil
+		}
+		ct.Fatalf(t, "GetOutboundSessionInfo: %s", err)
+	}
+	if info == nil {
+		ct.Fatalf(t, "GetOutboundSessionInfo: %s has no outbound session for %s", client.UserID(), roomID)
+	}
+	return info
+}
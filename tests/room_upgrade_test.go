@@ -0,0 +1,68 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that clients can follow a room upgrade, that the replacement room is encrypted with a new megolm
+// session, and that messages in the old room can still be decrypted.
+func TestRoomUpgradeUsesNewRoomKeys(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}))
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			oldMsgBody := "Bob can read this in the old room"
+			waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(oldMsgBody))
+			oldEventID := alice.MustSendMessage(t, roomID, oldMsgBody)
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's message '%s'", oldMsgBody)
+			oldSessionID := tc.Bob.MustGetMegolmSessionID(t, roomID, oldEventID)
+
+			newRoomID := tc.Alice.MustUpgradeRoom(t, roomID, "", tc.Bob.UserID)
+			for _, cli := range []api.TestClient{alice, bob} {
+				gotRoomID := mustFollowTombstone(t, cli, roomID, []string{clientTypeA.HS})
+				must.Equal(t, gotRoomID, newRoomID, "replacement room ID")
+			}
+
+			newMsgBody := "Bob can read this in the new room"
+			waiter = bob.WaitUntilEventInRoom(t, newRoomID, api.CheckEventHasBody(newMsgBody))
+			newEventID := alice.MustSendMessage(t, newRoomID, newMsgBody)
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's message '%s' in the replacement room", newMsgBody)
+			// this also checks the replacement room is encrypted, as it fails for unencrypted events
+			newSessionID := tc.Bob.MustGetMegolmSessionID(t, newRoomID, newEventID)
+			must.NotEqual(t, newSessionID, oldSessionID, "megolm session was reused across the room upgrade")
+
+			ev := bob.MustGetEvent(t, roomID, oldEventID)
+			must.Equal(t, ev.FailedToDecrypt, false, "bob failed to decrypt the message in the old room after the upgrade")
+			must.Equal(t, ev.Text, oldMsgBody, "old room message body")
+		})
+	})
+}
+
+// mustFollowTombstone follows the tombstone in the given room, retrying until the client has seen the
+// tombstone. Skips the test if the client does not support following tombstones.
+func mustFollowTombstone(t *testing.T, cli api.TestClient, roomID string, serverNames []string) (newRoomID string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		newRoomID, err := cli.FollowTombstone(t, roomID, serverNames)
+		if err == nil {
+			return newRoomID
+		}
+		if errors.Is(err, api.ErrNotSupported) {
+			t.Skipf("following tombstones unsupported: %s", err)
+		}
+		if time.Now().After(deadline) {
+			ct.Fatalf(t, "%s did not follow the tombstone in %s: %s", cli.UserID(), roomID, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
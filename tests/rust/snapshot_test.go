@@ -0,0 +1,63 @@
+package rust_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that a snapshot of a client's store can be restored in a later subtest, and that the
+// restored client can decrypt messages without logging in again.
+func TestCanRestoreClientPersistenceSnapshot(t *testing.T) {
+	tc, roomID := createAndJoinRoom(t)
+	tc.WithAliceSyncing(t, func(alice api.TestClient) {
+		var snapshot *cc.ClientPersistenceSnapshot
+		var beforeEventID string
+		t.Run("snapshot", func(t *testing.T) {
+			bob := tc.MustLoginClient(t, &cc.ClientCreationRequest{
+				User: tc.Bob,
+				Opts: api.ClientCreationOpts{
+					PersistentStorage: true,
+				},
+			})
+			stopSyncing := bob.MustStartSyncing(t)
+			waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody("before snapshot"))
+			beforeEventID = alice.MustSendMessage(t, roomID, "before snapshot")
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's message before the snapshot")
+			stopSyncing()
+			snapshot = tc.SnapshotClientPersistence(t, bob)
+		})
+		if snapshot == nil {
+			t.Fatalf("failed to take snapshot")
+		}
+		defer snapshot.Delete()
+
+		t.Run("restore", func(t *testing.T) {
+			// wipe the store to prove the snapshot is used
+			must.NotError(t, "failed to delete store", os.RemoveAll(snapshot.StoragePath()))
+			snapshot.Restore(t)
+
+			// the snapshot options include the access token, so this does not log in again.
+			bob := tc.MustCreateClient(t, &cc.ClientCreationRequest{
+				User: tc.Bob,
+				Opts: snapshot.Opts,
+			})
+			defer bob.Close(t)
+			stopSyncing := bob.MustStartSyncing(t)
+			defer stopSyncing()
+			bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasEventID(beforeEventID)).Waitf(
+				t, 5*time.Second, "bob did not see alice's message after restoring the snapshot",
+			)
+			ev := bob.MustGetEvent(t, roomID, beforeEventID)
+			must.Equal(t, ev.FailedToDecrypt, false, "bob failed to decrypt old message after restoring the snapshot")
+
+			waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody("after restore"))
+			alice.MustSendMessage(t, roomID, "after restore")
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's message after restoring the snapshot")
+		})
+	})
+}
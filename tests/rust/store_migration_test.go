@@ -0,0 +1,55 @@
+package rust_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that the crypto identity and megolm sessions survive migrating Bob's store between backends.
+// Bob decrypts a message using the `from` backend, then restarts using the `to` backend. He should still
+// decrypt the old message, and Alice should decrypt messages from him.
+func TestStoreMigrationKeepsCryptoState(t *testing.T) {
+	// Add new persistent backends here as they are supported. In-memory stores lose everything on restart,
+	// so there is nothing to migrate to or from them.
+	migrations := [][2]api.StoreBackend{
+		{api.StoreBackendSQLite, api.StoreBackendSQLite},
+	}
+	for _, migration := range migrations {
+		from, to := migration[0], migration[1]
+		t.Run(fmt.Sprintf("%s->%s", from, to), func(t *testing.T) {
+			testStoreMigrationKeepsCryptoState(t, from, to)
+		})
+	}
+}
+
+func testStoreMigrationKeepsCryptoState(t *testing.T, from, to api.StoreBackend) {
+	tc, roomID := createAndJoinRoom(t)
+	tc.WithAliceSyncing(t, func(alice api.TestClient) {
+		var beforeEventID string
+		tc.WithStoreMigration(t, &cc.ClientCreationRequest{User: tc.Bob}, from, to, func(bob api.TestClient) {
+			waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody("before migration"))
+			beforeEventID = alice.MustSendMessage(t, roomID, "before migration")
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's message before migration")
+		}, func(bob api.TestClient) {
+			bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasEventID(beforeEventID)).Waitf(
+				t, 5*time.Second, "bob did not see alice's message after migration",
+			)
+			ev := bob.MustGetEvent(t, roomID, beforeEventID)
+			must.Equal(t, ev.FailedToDecrypt, false, "bob failed to decrypt old message after migration")
+			must.Equal(t, ev.Text, "before migration", "bob saw the wrong text for the old message")
+
+			waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody("after migration"))
+			alice.MustSendMessage(t, roomID, "after migration")
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's message after migration")
+
+			waiter = alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody("from migrated bob"))
+			bob.MustSendMessage(t, roomID, "from migrated bob")
+			waiter.Waitf(t, 5*time.Second, "alice did not see bob's message after migration")
+		})
+	})
+}
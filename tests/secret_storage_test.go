@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/must"
+)
+
+const testSecretName = "org.matrix.complement_crypto.test_secret"
+
+// mustSucceedOrSkip fails the test if err is set, unless the client does not implement the operation,
+// in which case the test is skipped.
+func mustSucceedOrSkip(t *testing.T, client api.TestClient, err error, operation string) {
+	t.Helper()
+	if err == nil {
+		return
+	}
+	if errors.Is(err, api.ErrNotSupported) {
+		t.Skipf("%s cannot %s: %s", client.Type(), operation, err)
+	}
+	ct.Fatalf(t, "%s: %s", operation, err)
+}
+
+// mustLoginOtherDevice logs in a new device for Alice using the given client type.
+func mustLoginOtherDevice(t *testing.T, tc *cc.TestContext, clientType api.ClientType, deviceID string) api.TestClient {
+	t.Helper()
+	csapiAlice2 := tc.MustRegisterNewDevice(t, tc.Alice, deviceID)
+	return tc.MustLoginClient(t, &cc.ClientCreationRequest{
+		User: &cc.User{
+			CSAPI:      csapiAlice2.CSAPI,
+			ClientType: clientType,
+		},
+	})
+}
+
+// Test that a secret stored in secret storage by one client can be read by another client with the same recovery key.
+func TestCanReadSecretStoredByOtherClient(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		if clientTypeA.HS != clientTypeB.HS {
+			t.Skipf("client A and B must be on the same HS as they are devices of the same user")
+		}
+		tc := Instance().CreateTestContext(t, clientTypeA)
+		tc.WithAliceSyncing(t, func(storer api.TestClient) {
+			// Given a secret stored with a new secret storage key
+			recoveryKey, err := storer.CreateSecretStorageKey(t)
+			mustSucceedOrSkip(t, storer, err, "create a secret storage key")
+			secret := "the secret is " + t.Name()
+			mustSucceedOrSkip(t, storer, storer.StoreSecret(t, testSecretName, secret), "store a secret")
+
+			// When another device unlocks secret storage with the recovery key
+			reader := mustLoginOtherDevice(t, tc, clientTypeB, "SECRET_READER")
+			defer reader.Close(t)
+			mustSucceedOrSkip(t, reader, reader.UnlockSecretStorage(t, recoveryKey), "unlock secret storage")
+
+			// Then it can read the secret
+			got, err := reader.GetSecret(t, testSecretName)
+			mustSucceedOrSkip(t, reader, err, "get a secret")
+			must.Equal(t, got, secret, "secret read by other device")
+		})
+	})
+}
+
+// Test that replacing the default secret storage key means the old recovery key can no longer unlock secret
+// storage, and that secrets stored afterwards can be read with the new recovery key.
+func TestSecretStorageKeyRotation(t *testing.T) {
+	Instance().ForEachClientType(t, func(t *testing.T, clientType api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientType)
+		tc.WithAliceSyncing(t, func(alice api.TestClient) {
+			oldRecoveryKey, err := alice.CreateSecretStorageKey(t)
+			mustSucceedOrSkip(t, alice, err, "create a secret storage key")
+			mustSucceedOrSkip(t, alice, alice.StoreSecret(t, testSecretName, "old secret"), "store a secret")
+
+			// rotate the key, and store the secret again as it is not re-encrypted with the new key.
+			newRecoveryKey, err := alice.CreateSecretStorageKey(t)
+			mustSucceedOrSkip(t, alice, err, "replace the secret storage key")
+			if newRecoveryKey == oldRecoveryKey {
+				ct.Fatalf(t, "CreateSecretStorageKey returned the same recovery key twice")
+			}
+			alice.MustStoreSecret(t, testSecretName, "new secret")
+
+			reader := mustLoginOtherDevice(t, tc, clientType, "SECRET_READER")
+			defer reader.Close(t)
+			if err := reader.UnlockSecretStorage(t, oldRecoveryKey); err == nil {
+				ct.Fatalf(t, "UnlockSecretStorage: old recovery key unlocked secret storage after the key was replaced")
+			}
+			mustSucceedOrSkip(t, reader, reader.UnlockSecretStorage(t, newRecoveryKey), "unlock secret storage")
+			must.Equal(t, reader.MustGetSecret(t, testSecretName), "new secret", "secret read with new recovery key")
+		})
+	})
+}
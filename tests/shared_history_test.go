@@ -0,0 +1,52 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that messages sent before a user joined a room can be decrypted when the inviter shares
+// room key history on invite, as per MSC3061 / MSC4268.
+func TestSharedHistoryOnInvite(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		// private_chat defaults to `shared` history visibility
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice, cc.EncRoomOptions.PresetPrivateChat())
+		opts := api.ClientCreationOpts{
+			EnableShareHistoryOnInvite: true,
+		}
+		tc.WithClientsSyncing(t, []*cc.ClientCreationRequest{
+			{User: tc.Alice, Opts: opts},
+			{User: tc.Bob, Opts: opts},
+		}, func(clients []api.TestClient) {
+			alice, bob := clients[0], clients[1]
+			var eventIDs []string
+			for i := 0; i < 3; i++ {
+				body := fmt.Sprintf("Before bob joined %d", i)
+				waiter := alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(body))
+				eventIDs = append(eventIDs, alice.MustSendMessage(t, roomID, body))
+				waiter.Waitf(t, 5*time.Second, "alice did not see her own message '%s'", body)
+			}
+
+			must.NotError(t, "failed to invite bob", alice.InviteUser(t, roomID, bob.UserID()))
+			tc.Bob.MustSyncUntil(t, client.SyncReq{}, client.SyncInvitedTo(bob.UserID(), roomID))
+			bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+
+			bob.MustBackpaginate(t, roomID, 10)
+			for i, eventID := range eventIDs {
+				bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasEventID(eventID)).Waitf(
+					t, 5*time.Second, "bob did not see event %s sent before he joined", eventID,
+				)
+				ev := bob.MustGetEvent(t, roomID, eventID)
+				must.Equal(t, ev.FailedToDecrypt, false, "bob failed to decrypt event sent before he joined")
+				must.Equal(t, ev.Text, fmt.Sprintf("Before bob joined %d", i), "bob saw the wrong text for event sent before he joined")
+			}
+		})
+	})
+}
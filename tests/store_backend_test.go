@@ -0,0 +1,48 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+)
+
+// Test that clients can encrypt and decrypt messages regardless of the store backend they use, see
+// COMPLEMENT_CRYPTO_STORE_BACKENDS.
+func TestStoreBackendsCanExchangeMessages(t *testing.T) {
+	Instance().StoreBackendMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType, backendA, backendB api.StoreBackend) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		tc.Alice.StoreBackend = backendA
+		tc.Bob.StoreBackend = backendB
+		roomID := tc.CreateNewEncryptedRoom(
+			t,
+			tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+		// logged in before Alice syncs, so she knows about both of Bob's devices. The new device uses Bob's backend.
+		bob2 := tc.MustLoginClient(t, &cc.ClientCreationRequest{
+			User: tc.MustRegisterNewDevice(t, tc.Bob, "OTHER_DEVICE"),
+		})
+		defer bob2.Close(t)
+
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			bob2StopSyncing := bob2.MustStartSyncing(t)
+			defer bob2StopSyncing()
+
+			wantBody := "for both of bob's devices"
+			waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantBody))
+			waiter2 := bob2.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantBody))
+			alice.MustSendMessage(t, roomID, wantBody)
+			waiter.Waitf(t, 5*time.Second, "bob did not decrypt alice's message")
+			waiter2.Waitf(t, 5*time.Second, "bob's other device did not decrypt alice's message")
+
+			wantBody = "from bob"
+			waiter = alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantBody))
+			bob.MustSendMessage(t, roomID, wantBody)
+			waiter.Waitf(t, 5*time.Second, "alice did not decrypt bob's message")
+		})
+	})
+}
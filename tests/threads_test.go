@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that messages in threads are encrypted with the same megolm session as the rest of the room, and
+// can be decrypted both from the timeline and when fetching the thread via /relations.
+func TestThreadedMessagesAreDecryptable(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			rootBody := "Thread root"
+			waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(rootBody))
+			rootEventID := alice.MustSendMessage(t, roomID, rootBody)
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's thread root")
+
+			threadBody := "In the thread"
+			waiter = bob.WaitUntilEventInRoom(t, roomID, api.CheckEventInThread(rootEventID, threadBody))
+			threadEventID, err := alice.SendThreadedMessage(t, roomID, rootEventID, threadBody)
+			if err != nil {
+				if errors.Is(err, api.ErrNotSupported) {
+					t.Skipf("%s cannot send threaded messages: %s", clientTypeA.Lang, err)
+				}
+				ct.Fatalf(t, "SendThreadedMessage: %s", err)
+			}
+			waiter.Waitf(t, 5*time.Second, "bob did not see alice's threaded message")
+			ev := bob.MustGetEvent(t, roomID, threadEventID)
+			must.Equal(t, ev.FailedToDecrypt, false, "bob failed to decrypt alice's threaded message")
+			must.Equal(t, ev.ThreadRoot, rootEventID, "threaded message has the wrong thread root")
+
+			// threads are not special for encryption, so should not need a new session
+			rootSessionID, err := alice.GetOutboundSessionID(t, roomID, rootEventID)
+			if err == nil {
+				must.Equal(t, alice.MustGetOutboundSessionID(t, roomID, threadEventID), rootSessionID, "threaded message used a different session")
+			} else if !errors.Is(err, api.ErrNotSupported) {
+				ct.Fatalf(t, "GetOutboundSessionID: %s", err)
+			}
+
+			thread, err := bob.GetThread(t, roomID, rootEventID)
+			if err != nil {
+				if errors.Is(err, api.ErrNotSupported) {
+					t.Skipf("%s cannot fetch threads: %s", clientTypeB.Lang, err)
+				}
+				ct.Fatalf(t, "GetThread: %s", err)
+			}
+			must.Equal(t, len(thread), 1, "thread has the wrong number of events")
+			must.Equal(t, thread[0].ID, threadEventID, "thread has the wrong event")
+			must.Equal(t, thread[0].FailedToDecrypt, false, "bob failed to decrypt the fetched thread")
+			must.Equal(t, thread[0].Text, threadBody, "fetched thread has the wrong body")
+		})
+	})
+}
@@ -0,0 +1,88 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement-crypto/internal/deploy"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that clients which do not verify TLS certificates keep working when the homeserver serves an
+// expired certificate.
+func TestClientsWithoutSSLVerificationIgnoreBadCertificates(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+		tc.WithClientsSyncing(t, []*cc.ClientCreationRequest{
+			{
+				User: tc.Alice,
+				Opts: api.ClientCreationOpts{
+					BaseURL:                tc.Deployment.ReverseProxyTLSURLForHS(clientTypeA.HS),
+					DisableSSLVerification: true,
+				},
+			},
+			{
+				User: tc.Bob,
+				Opts: api.ClientCreationOpts{
+					BaseURL:                tc.Deployment.ReverseProxyTLSURLForHS(clientTypeB.HS),
+					DisableSSLVerification: true,
+				},
+			},
+		}, func(clients []api.TestClient) {
+			handshakes := tc.Deployment.WithBadCertificate(t, deploy.BadCertificateExpired, func() {
+				cc.MustHaveResumedSyncing(t, roomID, clients...)
+			})
+			must.Equal(t, handshakes > 0, true, "bad certificate was never served")
+		})
+	})
+}
+
+// Test that clients which verify TLS certificates refuse to talk to a homeserver serving a bad certificate, and
+// resume syncing once the certificate is fixed.
+func TestClientsWithSSLVerificationRecoverWhenCertificateIsFixed(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		if clientTypeA.Lang != api.ClientTypeRust {
+			// JS runs in a browser which cannot be told to trust another CA, and nio never verifies certificates.
+			t.Skipf("%s cannot trust the reverse proxy CA", clientTypeA.Lang)
+		}
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(t, tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+		tc.WithClientSyncing(t, &cc.ClientCreationRequest{
+			User: tc.Alice,
+			Opts: api.ClientCreationOpts{
+				BaseURL:          tc.Deployment.ReverseProxyTLSURLForHS(clientTypeA.HS),
+				RootCertificates: [][]byte{tc.Deployment.ReverseProxyCACertificate(t)},
+			},
+		}, func(alice api.TestClient) {
+			tc.WithClientSyncing(t, &cc.ClientCreationRequest{
+				User: tc.Bob,
+			}, func(bob api.TestClient) {
+				wantMsgBody := "Sent whilst the certificate was bad"
+				waiter := alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantMsgBody))
+				var eventID string
+				handshakes := tc.Deployment.WithBadCertificate(t, deploy.BadCertificateSelfSigned, func() {
+					eventID = bob.MustSendMessage(t, roomID, wantMsgBody)
+					err := waiter.TryWaitf(t, 3*time.Second, "alice did not see bob's message")
+					must.Equal(t, err != nil, true, "alice synced despite the homeserver serving a self-signed certificate")
+				})
+				must.Equal(t, handshakes > 0, true, "bad certificate was never served")
+
+				// clients back off after failed requests, so wait longer than usual
+				waiter.Waitf(t, 30*time.Second, "alice did not see bob's message after the certificate was fixed")
+				ev := alice.MustGetEvent(t, roomID, eventID)
+				must.Equal(t, ev.FailedToDecrypt, false, "alice failed to decrypt bob's message")
+			})
+		})
+	})
+}
@@ -9,8 +9,10 @@ import (
 
 	"github.com/matrix-org/complement-crypto/internal/api"
 	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement-crypto/internal/deploy"
 	"github.com/matrix-org/complement-crypto/internal/deploy/callback"
 	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+	"github.com/matrix-org/complement/ct"
 	"github.com/matrix-org/complement/helpers"
 	"github.com/matrix-org/complement/must"
 	"github.com/tidwall/gjson"
@@ -511,3 +513,146 @@ func TestToDeviceMessagesAreProcessedInOrder(t *testing.T) {
 		})
 	})
 }
+
+// Test that clients recover from a wedged olm session.
+//
+// If a client cannot decrypt a normal olm message, the session is wedged: the sender and recipient disagree about
+// the state of the session, so everything else sent on it will also fail to decrypt. The recipient should
+// establish a new session by sending an m.dummy event to the sender, which the sender then uses for new messages.
+func TestClientRecoversFromWedgedOlmSession(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(
+			t,
+			tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+			cc.EncRoomOptions.RotationPeriodMsgs(1),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			aliceDeviceID := alice.Opts().DeviceID
+			bobDeviceID := bob.Opts().DeviceID
+			aliceToken := alice.CurrentAccessToken(t)
+			corruption := callback.NewOlmCorruption(tc.Alice.UserID, aliceDeviceID)
+			corruptBobsMessages := corruption.Callback()
+			// closed when Alice sends Bob a pre-key message after the corruption
+			newSessionCh := make(chan struct{})
+			var newSessionSeen atomic.Bool
+
+			tc.Deployment.MITM().Configure(t).WithIntercept(mitm.InterceptOpts{
+				Filter: mitm.FilterParams{
+					PathContains: "/sendToDevice/m.room.encrypted/",
+					Method:       "PUT",
+				},
+				RequestCallback: func(cd callback.Data) *callback.Response {
+					if cd.AccessToken == aliceToken {
+						if !corruption.Corrupted() {
+							return nil
+						}
+						for _, msgType := range callback.OlmMessageTypes(cd.RequestBody, tc.Bob.UserID, bobDeviceID) {
+							if msgType == callback.OlmMessageTypePreKey && newSessionSeen.CompareAndSwap(false, true) {
+								close(newSessionCh)
+							}
+						}
+						return nil
+					}
+					return corruptBobsMessages(cd)
+				},
+			}, func() {
+				// Alice establishes an olm session with Bob.
+				waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody("establish session"))
+				alice.MustSendMessage(t, roomID, "establish session")
+				waiter.Waitf(t, 5*time.Second, "bob did not see alice's message")
+
+				// Bob's room key is sent on the session, and corrupted.
+				eventID := bob.MustSendMessage(t, roomID, "corrupted room key")
+				time.Sleep(time.Second) // let Alice try to decrypt it
+				if !corruption.Corrupted() {
+					ct.Fatalf(t, "bob did not send a normal olm message to alice, so nothing was corrupted")
+				}
+				cc.MustFailToDecryptWithReason(t, alice, roomID, eventID, api.DecryptionFailureReasonMissingKey)
+
+				// Alice notices the session is wedged and makes a new one.
+				select {
+				case <-newSessionCh:
+				case <-time.After(10 * time.Second):
+					ct.Fatalf(t, "alice did not send bob a pre-key message after the olm session was wedged")
+				}
+
+				// Bob's next room key is sent on the new session.
+				waiter = alice.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody("after unwedging"))
+				bob.MustSendMessage(t, roomID, "after unwedging")
+				waiter.Waitf(t, 5*time.Second, "alice did not decrypt bob's message after the olm session was unwedged")
+			})
+		})
+	})
+}
+
+// Test that clients decrypt messages when room keys arrive in a different order to the one they were sent in.
+func TestOutOfOrderRoomKeysAreUsedToDecrypt(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		var roomIDs []string
+		for i := 0; i < 2; i++ {
+			roomID := tc.CreateNewEncryptedRoom(
+				t,
+				tc.Alice,
+				cc.EncRoomOptions.PresetTrustedPrivateChat(),
+				cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+			)
+			tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+			roomIDs = append(roomIDs, roomID)
+		}
+
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			reordered := tc.Deployment.WithReorderedToDevice(t, deploy.ToDeviceReorderSpec{
+				AccessToken: bob.CurrentAccessToken(t),
+				EventType:   "m.room.encrypted",
+			}, func() {
+				var waiters []api.Waiter
+				for i, roomID := range roomIDs {
+					body := fmt.Sprintf("Message in room %d", i)
+					waiters = append(waiters, bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(body)))
+					alice.MustSendMessage(t, roomID, body)
+				}
+				for i, waiter := range waiters {
+					waiter.Waitf(t, 10*time.Second, "bob did not decrypt alice's message in room %d", i)
+				}
+			})
+			if reordered == 0 {
+				ct.Fatalf(t, "room keys were not delivered out of order, so the test did not test anything")
+			}
+		})
+	})
+}
+
+// Test that room keys are delivered whether rust clients use native sliding sync or the sliding sync proxy.
+// The proxy gets to-device messages via sync v2, so they arrive at different times relative to the room
+// events which they decrypt.
+func TestRoomKeysAreDeliveredForEachSlidingSyncMode(t *testing.T) {
+	Instance().SlidingSyncModeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType, mode api.SlidingSyncMode) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		tc.SlidingSyncMode = mode
+		roomID := tc.CreateNewEncryptedRoom(
+			t,
+			tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+			cc.EncRoomOptions.RotationPeriodMsgs(1),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			var eventIDs []string
+			for i := 0; i < 5; i++ {
+				eventIDs = append(eventIDs, alice.MustSendMessage(t, roomID, fmt.Sprintf("message %d", i)))
+			}
+			for i, eventID := range eventIDs {
+				bob.WaitUntilEventInRoom(t, roomID, api.CheckEventIsDecrypted(eventID)).Waitf(
+					t, 5*time.Second, "bob did not decrypt message %d using %s sliding sync", i, mode,
+				)
+			}
+		})
+	})
+}
@@ -79,8 +79,10 @@ func TestVerificationSAS(t *testing.T) {
 				}
 				verifier.Logf(t, "Verifier (SENDER) %s %s", verifierClientType.Lang, verifier.Opts().DeviceID)
 				verifiee.Logf(t, "Verifiee (RECEIVER) %s %s", verifieeClientType.Lang, verifiee.Opts().DeviceID)
+				sigsBefore := tc.Alice.MustQueryKeys(t, tc.Alice.UserID).Signatures()
 				verifieeStage := verifiee.ListenForVerificationRequests(t)
 				verifierStage := verifier.RequestOwnUserVerification(t)
+			verificationLoop:
 				for {
 					select {
 					case receiverStage := <-verifieeStage:
@@ -104,7 +106,7 @@ func TestVerificationSAS(t *testing.T) {
 						case api.VerificationStageDone:
 							t.Logf("[RECEIVER] VerificationStageDone")
 							if status.done(nil, &boolTrue) {
-								return
+								break verificationLoop
 							}
 						case api.VerificationStageCancelled: // should not be cancelled
 							ct.Errorf(t, "[RECEIVER] VerificationStageCancelled")
@@ -130,7 +132,7 @@ func TestVerificationSAS(t *testing.T) {
 						case api.VerificationStageDone:
 							t.Logf("[SENDER]   VerificationStageDone")
 							if status.done(&boolTrue, nil) {
-								return
+								break verificationLoop
 							}
 						case api.VerificationStageCancelled: // should not be cancelled
 							ct.Errorf(t, "[SENDER]   VerificationStageCancelled")
@@ -140,8 +142,42 @@ func TestVerificationSAS(t *testing.T) {
 						return
 					}
 				}
+				// the verifier should have uploaded a signature of the verifiee's device using the self-signing key
+				var added []cc.Signature
+				signed := false
+				for start := time.Now(); time.Since(start) < 5*time.Second && !signed; time.Sleep(100 * time.Millisecond) {
+					keys := tc.Alice.MustQueryKeys(t, tc.Alice.UserID)
+					added, _ = cc.DiffSignatures(sigsBefore, keys.Signatures())
+					signed = keys.HasSignature(cc.Signature{
+						SignedKeyID:  "ed25519:OTHER_DEVICE",
+						SignerUserID: tc.Alice.UserID,
+						SignerKeyID:  keys.SelfSigningKey.KeyID(),
+					})
+				}
+				if !signed {
+					ct.Fatalf(t, "verifier did not sign the verifiee's device with the self-signing key, added signatures: %+v", added)
+				}
+				// the verifier should now trust the verifiee's device
+				cc.MustSeeDeviceTrust(t, verifier, verifiee.UserID(), "OTHER_DEVICE", api.TrustLevelVerified)
 			})
 		})
 
 	})
 }
+
+// Test that users can verify each other via verification requests sent as events in a DM, rather than
+// as to-device messages.
+func TestVerificationInRoom(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		if clientTypeB.Lang == api.ClientTypeRust {
+			t.Skipf("rust cannot be a verifiee yet, see https://github.com/matrix-org/matrix-rust-sdk/issues/3595")
+		}
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateEncryptedDM(t, tc.Alice, tc.Bob)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			cc.MustVerifyInRoom(t, alice, bob, roomID)
+			cc.MustSeeDeviceTrust(t, alice, bob.UserID(), bob.Opts().DeviceID, api.TrustLevelVerified)
+		})
+	})
+}
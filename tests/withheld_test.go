@@ -0,0 +1,145 @@
+package tests
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement-crypto/internal/api"
+	"github.com/matrix-org/complement-crypto/internal/cc"
+	"github.com/matrix-org/complement-crypto/internal/deploy/callback"
+	"github.com/matrix-org/complement-crypto/internal/deploy/mitm"
+	"github.com/matrix-org/complement/ct"
+)
+
+// Test that clients report why they could not decrypt an event when the sender withheld the room key. Alice
+// cannot claim any one-time keys for Bob's device, so withholds the key with m.no_olm.
+func TestUnableToDecryptReportsWithheldCode(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		if clientTypeB.Lang == api.ClientTypeNio {
+			t.Skipf("nio does not expose withheld codes")
+			return
+		}
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(
+			t,
+			tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			var eventID string
+			tc.Deployment.MITM().Configure(t).WithIntercept(mitm.InterceptOpts{
+				Filter: mitm.FilterParams{
+					PathContains: "/keys/claim",
+					Method:       "POST",
+				},
+				// pretend Bob's device has run out of one-time keys and has no fallback key
+				RequestCallback: func(cd callback.Data) *callback.Response {
+					return &callback.Response{
+						RespondStatusCode: 200,
+						RespondBody:       json.RawMessage(`{"one_time_keys":{},"failures":{}}`),
+					}
+				},
+			}, func() {
+				eventID = alice.MustSendMessage(t, roomID, "you can't read this")
+			})
+			cc.MustHaveWithheldCode(t, bob, roomID, eventID, api.WithheldCodeOther)
+		})
+	})
+}
+
+// Test that clients which only send room keys to verified devices withhold them from unverified devices with
+// m.unverified, and share them again once the setting is turned off.
+func TestGlobalOnlyTrustVerifiedWithholdsRoomKeys(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(
+			t,
+			tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			mustSucceedOrSkip(t, alice, alice.SetGlobalOnlyTrustVerified(t, true), "only send room keys to verified devices")
+			tc.MustSendMessageWithheldFromUnverified(t, alice, bob, roomID, "only for verified devices")
+
+			alice.MustSetGlobalOnlyTrustVerified(t, false)
+			wantBody := "for all devices"
+			waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantBody))
+			alice.MustSendMessage(t, roomID, wantBody)
+			waiter.Waitf(t, 5*time.Second, "bob did not decrypt alice's message after she sent room keys to all devices")
+		})
+	})
+}
+
+// Test that the per-room setting to only send room keys to verified devices only affects that room.
+func TestRoomOnlyTrustVerifiedWithholdsRoomKeys(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		verifiedOnlyRoomID := tc.CreateNewEncryptedRoom(
+			t,
+			tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, verifiedOnlyRoomID, []string{clientTypeA.HS})
+		otherRoomID := tc.CreateNewEncryptedRoom(
+			t,
+			tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, otherRoomID, []string{clientTypeA.HS})
+
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			alice.WaitUntilEventInRoom(t, verifiedOnlyRoomID, api.CheckEventHasMembership(tc.Bob.UserID, "join")).Waitf(t, 5*time.Second, "alice did not see bob's join")
+			mustSucceedOrSkip(t, alice, alice.SetRoomOnlyTrustVerified(t, verifiedOnlyRoomID, true), "only send room keys to verified devices in a room")
+			tc.MustSendMessageWithheldFromUnverified(t, alice, bob, verifiedOnlyRoomID, "only for verified devices")
+
+			wantBody := "for all devices"
+			waiter := bob.WaitUntilEventInRoom(t, otherRoomID, api.CheckEventHasBody(wantBody))
+			alice.MustSendMessage(t, otherRoomID, wantBody)
+			waiter.Waitf(t, 5*time.Second, "bob did not decrypt alice's message in the other room")
+		})
+	})
+}
+
+// Test that clients withhold room keys from devices they have blacklisted with m.blacklisted, even in rooms where
+// every device is sent room keys. Bob already has the previous room key, so Alice must rotate it.
+func TestBlacklistedDeviceIsWithheldRoomKeys(t *testing.T) {
+	Instance().ClientTypeMatrix(t, func(t *testing.T, clientTypeA, clientTypeB api.ClientType) {
+		if clientTypeA.Lang == api.ClientTypeNio {
+			t.Skipf("nio does not send m.room_key.withheld to blacklisted devices")
+			return
+		}
+		tc := Instance().CreateTestContext(t, clientTypeA, clientTypeB)
+		roomID := tc.CreateNewEncryptedRoom(
+			t,
+			tc.Alice,
+			cc.EncRoomOptions.PresetTrustedPrivateChat(),
+			cc.EncRoomOptions.Invite([]string{tc.Bob.UserID}),
+		)
+		tc.Bob.MustJoinRoom(t, roomID, []string{clientTypeA.HS})
+
+		tc.WithAliceAndBobSyncing(t, func(alice, bob api.TestClient) {
+			wantBody := "before blacklisting"
+			waiter := bob.WaitUntilEventInRoom(t, roomID, api.CheckEventHasBody(wantBody))
+			firstEventID := alice.MustSendMessage(t, roomID, wantBody)
+			waiter.Waitf(t, 5*time.Second, "bob did not decrypt alice's message before being blacklisted")
+
+			mustSucceedOrSkip(t, alice, alice.BlacklistDevice(t, bob.UserID(), bob.Opts().DeviceID), "blacklist devices")
+			secondEventID := tc.MustSendMessageWithheldFromBlacklisted(t, alice, bob, roomID, "not for blacklisted devices")
+
+			firstSessionID := alice.MustGetOutboundSessionID(t, roomID, firstEventID)
+			secondSessionID := alice.MustGetOutboundSessionID(t, roomID, secondEventID)
+			if firstSessionID == secondSessionID {
+				ct.Fatalf(t, "alice did not rotate the room key after blacklisting bob's device: both messages use session %s", firstSessionID)
+			}
+		})
+	})
+}